@@ -4,3 +4,75 @@ type Codec interface {
 	Marshal(v any) ([]byte, error)
 	Unmarshal(data []byte, v any) error
 }
+
+// Deterministic is an optional interface for codecs that can tell whether
+// Marshal always produces the same bytes for equal values. Stores use it to
+// decide whether byte equality of encoded values can stand in for value
+// equality. Codecs that don't implement it are assumed deterministic.
+type Deterministic interface {
+	Deterministic() bool
+}
+
+// BufferedCodec is an optional interface for codecs that can encode into
+// a caller's buffer, so stores can reuse buffers across writes instead of
+// allocating one per value. MarshalAppend appends the encoding of v to dst,
+// the same bytes Marshal returns, and returns the extended slice.
+//
+// Implementing it also promises that Unmarshal doesn't keep data after it
+// returns, so stores may decode from a buffer they reuse. A type that
+// embeds a BufferedCodec and overrides Marshal must override MarshalAppend
+// as well, or stores will bypass its Marshal.
+type BufferedCodec interface {
+	Codec
+	MarshalAppend(dst []byte, v any) ([]byte, error)
+}
+
+// ContextCodec is an optional interface for codecs whose encoding depends
+// on where a value is stored, e.g. to encrypt each kind with its own key,
+// apply a per-kind schema or tag the format. Stores call MarshalCtx and
+// UnmarshalCtx with the kind and key of the value instead of Marshal and
+// Unmarshal when their codec implements it; Marshal and Unmarshal remain
+// for callers without that context.
+type ContextCodec interface {
+	Codec
+	MarshalCtx(kind, key string, v any) ([]byte, error)
+	UnmarshalCtx(kind, key string, data []byte, v any) error
+}
+
+// ContentTyper is an optional interface for codecs that know the media
+// type of their encoding, e.g. to set the Content-Type of stored values
+// served over HTTP.
+type ContentTyper interface {
+	ContentType() string
+}
+
+// DefaultContentType is the media type of codecs that don't implement
+// ContentTyper.
+const DefaultContentType = "application/octet-stream"
+
+// ContentType returns the media type of c's encoding: c's ContentType if c
+// is a ContentTyper and DefaultContentType otherwise.
+func ContentType(c Codec) string {
+	if ct, ok := c.(ContentTyper); ok {
+		return ct.ContentType()
+	}
+	return DefaultContentType
+}
+
+// MarshalCtx encodes v, stored under kind and key, with c's MarshalCtx if
+// c is a ContextCodec and with its Marshal otherwise.
+func MarshalCtx(c Codec, kind, key string, v any) ([]byte, error) {
+	if cc, ok := c.(ContextCodec); ok {
+		return cc.MarshalCtx(kind, key, v)
+	}
+	return c.Marshal(v)
+}
+
+// UnmarshalCtx decodes data, stored under kind and key, with c's
+// UnmarshalCtx if c is a ContextCodec and with its Unmarshal otherwise.
+func UnmarshalCtx(c Codec, kind, key string, data []byte, v any) error {
+	if cc, ok := c.(ContextCodec); ok {
+		return cc.UnmarshalCtx(kind, key, data, v)
+	}
+	return c.Unmarshal(data, v)
+}
@@ -0,0 +1,652 @@
+package codec_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/codec"
+	"github.com/zestor-dev/zestor/codec/codectest"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type sample struct {
+	Name   string            `json:"name" yaml:"name"`
+	Count  int               `json:"count" yaml:"count"`
+	Tags   []string          `json:"tags" yaml:"tags"`
+	Labels map[string]string `json:"labels" yaml:"labels"`
+}
+
+func samples() []any {
+	return []any{
+		sample{Name: "a", Count: 1, Tags: []string{"x", "y"}, Labels: map[string]string{"b": "2", "a": "1", "c": "3", "d": "4"}},
+		"plain string",
+		42,
+		map[string]int{"one": 1, "two": 2, "three": 3, "four": 4, "five": 5},
+	}
+}
+
+func TestJSON(t *testing.T) {
+	rep := codectest.RunCodecTests(t, &codec.JSON{}, samples())
+	if !rep.Deterministic {
+		t.Errorf("expected JSON to be deterministic, varying samples %v", rep.NonDeterministic)
+	}
+}
+
+func TestYAML(t *testing.T) {
+	rep := codectest.RunCodecTests(t, &codec.YAML{}, samples())
+	if !rep.Deterministic {
+		t.Errorf("expected YAML to be deterministic, varying samples %v", rep.NonDeterministic)
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	st, err := structpb.NewStruct(map[string]any{"a": 1, "b": "two", "c": true, "d": nil, "e": []any{1.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codectest.RunCodecTests(t, &codec.Protobuf{}, []any{
+		wrapperspb.String("hello"),
+		wrapperspb.Int64(7),
+		st,
+	})
+
+	if _, err := (&codec.Protobuf{}).Marshal(sample{Name: "a"}); err == nil {
+		t.Error("expected error marshaling a non-proto.Message")
+	}
+}
+
+func TestJSONStrict(t *testing.T) {
+	c := &codec.JSON{Strict: true}
+	codectest.RunCodecTests(t, c, samples())
+
+	var s sample
+	if err := c.Unmarshal([]byte(`{"name":"a","extra":1}`), &s); err == nil {
+		t.Error("expected error for unknown field")
+	}
+	if err := c.Unmarshal([]byte(`{"name":"a"} {}`), &s); err == nil {
+		t.Error("expected error for trailing data")
+	}
+
+	// the default is lenient
+	s = sample{}
+	if err := (&codec.JSON{}).Unmarshal([]byte(`{"name":"a","extra":1}`), &s); err != nil || s.Name != "a" {
+		t.Errorf("default decode = %+v, %v", s, err)
+	}
+}
+
+func TestJSONDisallowMissingFields(t *testing.T) {
+	type inner struct {
+		City string `json:"city"`
+	}
+	type Base struct {
+		ID string `json:"id"`
+	}
+	type doc struct {
+		Base
+		Name    string    `json:"name"`
+		Note    string    `json:"note,omitempty"`
+		Created time.Time `json:"created"`
+		Home    *inner    `json:"home"`
+		Items   []inner   `json:"items"`
+		Skipped string    `json:"-"`
+		Other   string
+	}
+	const full = `{"id":"1","name":"a","created":"2024-01-02T03:04:05Z","home":null,"items":[{"city":"x"}],"other":"o"}`
+
+	c := codec.NewJSON(codec.JSONOptions{DisallowMissingFields: true})
+	codectest.RunCodecTests(t, c, samples())
+	var d doc
+	if err := c.Unmarshal([]byte(full), &d); err != nil || d.Name != "a" || d.Items[0].City != "x" {
+		t.Fatalf("Unmarshal(full) = %+v, %v", d, err)
+	}
+	for field, data := range map[string]string{
+		"id":            `{"name":"a","created":"2024-01-02T03:04:05Z","home":null,"items":[],"Other":""}`,
+		"name":          `{"id":"1","created":"2024-01-02T03:04:05Z","home":null,"items":[],"Other":""}`,
+		"home.city":     `{"id":"1","name":"a","created":"2024-01-02T03:04:05Z","home":{},"items":[],"Other":""}`,
+		"items[1].city": `{"id":"1","name":"a","created":"2024-01-02T03:04:05Z","home":null,"items":[{"city":"x"},{}],"Other":""}`,
+		"Other":         `{"id":"1","name":"a","created":"2024-01-02T03:04:05Z","home":null,"items":[]}`,
+	} {
+		err := c.Unmarshal([]byte(data), new(doc))
+		var mf *codec.MissingFieldError
+		if !errors.As(err, &mf) || mf.Field != field {
+			t.Errorf("missing %s: err = %v", field, err)
+		}
+	}
+
+	var m map[string]inner
+	err := c.Unmarshal([]byte(`{"a":{"city":"x"},"b":{}}`), &m)
+	if mf := (*codec.MissingFieldError)(nil); !errors.As(err, &mf) || mf.Field != "b.city" {
+		t.Errorf("map value missing city: err = %v", err)
+	}
+
+	// the default fills missing fields with zero values
+	d = doc{}
+	if err := (&codec.JSON{}).Unmarshal([]byte(`{"name":"a"}`), &d); err != nil || d.Name != "a" {
+		t.Errorf("default decode = %+v, %v", d, err)
+	}
+}
+
+func TestJSONOptions(t *testing.T) {
+	for _, disallow := range []bool{false, true} {
+		for _, useNumber := range []bool{false, true} {
+			for _, indent := range []string{"", "  "} {
+				opts := codec.JSONOptions{DisallowUnknownFields: disallow, UseNumber: useNumber, Indent: indent}
+				t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+					c := codec.NewJSON(opts)
+					codectest.RunCodecTests(t, c, samples())
+
+					data, err := c.Marshal(sample{Name: "a", Tags: []string{"x"}})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := bytes.Contains(data, []byte("\n  \"")); got != (indent != "") {
+						t.Errorf("indented = %v for %s", got, data)
+					}
+
+					// unknown field
+					var s sample
+					err = c.Unmarshal([]byte(`{"name":"a","naem":"b"}`), &s)
+					var uf *codec.UnknownFieldError
+					if disallow {
+						if !errors.As(err, &uf) || uf.Field != "naem" {
+							t.Errorf("unknown field error = %v, want field naem", err)
+						}
+					} else if err != nil || s.Name != "a" {
+						t.Errorf("lenient decode = %+v, %v", s, err)
+					}
+
+					// large integers in interface{} values
+					var m map[string]any
+					if err := c.Unmarshal([]byte(`{"id":9007199254740993}`), &m); err != nil {
+						t.Fatal(err)
+					}
+					if useNumber {
+						if n, ok := m["id"].(json.Number); !ok || n.String() != "9007199254740993" {
+							t.Errorf("id = %#v, want json.Number", m["id"])
+						}
+					} else if _, ok := m["id"].(float64); !ok {
+						t.Errorf("id = %#v, want float64", m["id"])
+					}
+
+					// malformed input and trailing data
+					if err := c.Unmarshal([]byte(`{"name":`), &s); err == nil {
+						t.Error("expected error for malformed input")
+					}
+					if err := c.Unmarshal([]byte(`{"name":"a"} {}`), &s); err == nil {
+						t.Error("expected error for trailing data")
+					}
+				})
+			}
+		}
+	}
+
+	// the zero value is unchanged
+	var zero codec.JSON
+	data, _ := zero.Marshal(sample{Name: "a"})
+	if bytes.ContainsRune(data, '\n') {
+		t.Errorf("zero value indents: %s", data)
+	}
+}
+
+type document struct {
+	ID    any         `json:"id"`
+	Attrs []any       `json:"attrs"`
+	Raw   json.Number `json:"raw"`
+	Meta  *struct {
+		Extra map[string]any `json:"extra"`
+	} `json:"meta"`
+}
+
+func TestJSONIntNumbers(t *testing.T) {
+	c := codec.NewJSON(codec.JSONOptions{IntNumbers: true})
+	codectest.RunCodecTests(t, c, samples())
+
+	// 2^53 + 1, which float64 rounds to 2^53
+	in := map[string]any{"id": int64(9007199254740993), "ratio": 0.5, "big": json.Number("18446744073709551616")}
+	data, err := c.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := c.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, in) {
+		t.Errorf("round trip = %#v, want %#v", m, in)
+	}
+	again, _ := c.Marshal(m)
+	if !bytes.Equal(again, data) {
+		t.Errorf("re-encoded %s, want %s", again, data)
+	}
+
+	// the default loses the precision
+	var lossy map[string]any
+	if err := (&codec.JSON{}).Unmarshal(data, &lossy); err != nil {
+		t.Fatal(err)
+	}
+	if lossy["id"] == int64(9007199254740993) || lossy["id"] != float64(9007199254740992) {
+		t.Errorf("default decode id = %#v", lossy["id"])
+	}
+
+	// interfaces at any depth; typed fields are left alone
+	var d document
+	err = c.Unmarshal([]byte(`{"id":9007199254740993,"attrs":[1,[2.5],{"n":-3}],"raw":7,"meta":{"extra":{"n":1e3}}}`), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := document{
+		ID:    int64(9007199254740993),
+		Attrs: []any{int64(1), []any{2.5}, map[string]any{"n": int64(-3)}},
+		Raw:   "7",
+	}
+	if d.Meta == nil {
+		t.Fatal("meta not decoded")
+	}
+	if n := d.Meta.Extra["n"]; n != float64(1000) {
+		t.Errorf("meta.extra.n = %#v, want float64", n)
+	}
+	d.Meta = nil
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("decoded %#v, want %#v", d, want)
+	}
+
+	var v any
+	if err := c.Unmarshal([]byte(`42`), &v); err != nil || v != int64(42) {
+		t.Errorf("top-level number = %#v, %v", v, err)
+	}
+}
+
+type timed struct {
+	At     time.Time            `json:"at"`
+	Ptr    *time.Time           `json:"ptr"`
+	List   []time.Time          `json:"list"`
+	ByName map[string]time.Time `json:"by_name"`
+	Any    any                  `json:"any"`
+	Nested *timed               `json:"nested"`
+	Name   string               `json:"name"`
+}
+
+func TestNormalizeTime(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 123_000_000, time.UTC)
+	in := base.Add(456_789).In(time.FixedZone("X", 2*3600))
+	v := timed{At: in, Ptr: &in, List: []time.Time{in}, ByName: map[string]time.Time{"a": in}, Any: in, Name: "n"}
+	v.Nested = &timed{At: in, Nested: v.Nested}
+
+	got := codec.NormalizeTime(v, time.Millisecond)
+	for name, tm := range map[string]time.Time{
+		"At": got.At, "Ptr": *got.Ptr, "List": got.List[0], "ByName": got.ByName["a"], "Any": got.Any.(time.Time), "Nested": got.Nested.At,
+	} {
+		if tm != base {
+			t.Errorf("%s = %v, want %v", name, tm, base)
+		}
+	}
+	if got.Name != "n" || got.Nested.Nested != nil {
+		t.Errorf("other fields changed: %+v", got)
+	}
+	// v is copied, not normalized in place
+	if *v.Ptr != in || v.List[0] != in || v.ByName["a"] != in || v.Nested.At != in {
+		t.Errorf("NormalizeTime modified its argument: %+v", v)
+	}
+
+	// monotonic readings are dropped, so normalized times compare with ==
+	now := time.Now()
+	if got := codec.NormalizeTime(now, 0); got != now.UTC().Round(0) {
+		t.Errorf("NormalizeTime(now, 0) = %v", got)
+	}
+	// cycles are kept
+	c := &timed{At: in}
+	c.Nested = c
+	if got := codec.NormalizeTime(c, time.Second); got.Nested != got || got.At != base.Truncate(time.Second) {
+		t.Errorf("cycle: %+v", got)
+	}
+	// values without times are returned as they are
+	if got := codec.NormalizeTime(sample{Name: "a"}, time.Second); got.Name != "a" {
+		t.Errorf("got %+v", got)
+	}
+	var nilAny any
+	if got := codec.NormalizeTime(nilAny, time.Second); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
+
+func TestJSONTimePrecision(t *testing.T) {
+	c := codec.NewJSON(codec.JSONOptions{TimePrecision: time.Millisecond})
+	codectest.RunCodecTests(t, c, samples())
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 123_456_789, time.UTC)
+	a, err := c.Marshal(timed{At: at, Any: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same instant at another precision and in another zone
+	other := at.Truncate(time.Microsecond).In(time.FixedZone("X", -5*3600))
+	b, err := c.MarshalAppend(nil, timed{At: other, Any: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("encodings differ:\n%s\n%s", a, b)
+	}
+	if !bytes.Contains(a, []byte(`"at":"2024-05-01T12:00:00.123Z"`)) {
+		t.Errorf("encoding %s, want at in UTC to the millisecond", a)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	var old int
+	fb := &codec.Fallback{
+		Primary:     &codec.JSON{Strict: true},
+		Secondary:   []codec.Codec{&codec.YAML{}},
+		OnSecondary: func(codec.Codec) { old++ },
+	}
+	codectest.RunCodecTests(t, fb, samples())
+	old = 0
+
+	yml, err := (&codec.YAML{}).Marshal(sample{Name: "legacy", Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got sample
+	c, err := fb.UnmarshalMatch(yml, &got)
+	if err != nil {
+		t.Fatalf("UnmarshalMatch: %v", err)
+	}
+	if _, ok := c.(*codec.YAML); !ok || got.Name != "legacy" || got.Count != 2 {
+		t.Fatalf("expected YAML match with decoded value, got %T %+v", c, got)
+	}
+	if old != 1 {
+		t.Fatalf("expected OnSecondary once, got %d", old)
+	}
+
+	// Marshal writes the primary format
+	out, err := fb.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := fb.UnmarshalMatch(out, &got); err != nil || c != fb.Primary {
+		t.Fatalf("expected primary match for re-encoded value, got %T %v", c, err)
+	}
+
+	if err := fb.Unmarshal([]byte("\x00\x01"), &got); err == nil {
+		t.Fatal("expected error when no codec decodes")
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	pii, public := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	enc := &codec.Encrypted{
+		Codec:    &codec.JSON{},
+		Key:      public,
+		KindKeys: map[string][]byte{"users": pii},
+	}
+	rep := codectest.RunCodecTests(t, enc, samples())
+	if rep.Deterministic {
+		t.Error("expected random nonces to make Encrypted non-deterministic")
+	}
+
+	in := sample{Name: "alice", Count: 1}
+	data, err := codec.MarshalCtx(enc, "users", "alice", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("alice")) {
+		t.Fatal("plaintext in encrypted output")
+	}
+	var got sample
+	if err := codec.UnmarshalCtx(enc, "users", "alice", data, &got); err != nil || got.Name != "alice" {
+		t.Fatalf("UnmarshalCtx = %+v, %v", got, err)
+	}
+
+	// bound to the kind and its key
+	for _, kind := range []string{"orders", "admins"} {
+		if err := codec.UnmarshalCtx(enc, kind, "alice", data, &got); !errors.Is(err, codec.ErrDecrypt) {
+			t.Errorf("UnmarshalCtx(%s) error = %v, want ErrDecrypt", kind, err)
+		}
+	}
+	if err := enc.Unmarshal(data, &got); !errors.Is(err, codec.ErrDecrypt) {
+		t.Errorf("Unmarshal error = %v, want ErrDecrypt", err)
+	}
+
+	noDefault := &codec.Encrypted{Codec: &codec.JSON{}, KindKeys: map[string][]byte{"users": pii}}
+	if _, err := noDefault.MarshalCtx("orders", "alice", in); err == nil {
+		t.Error("expected error for a kind without a key")
+	}
+
+	// key rotation through Fallback
+	rotated := &codec.Fallback{
+		Primary:   &codec.Encrypted{Codec: &codec.JSON{}, KindKeys: map[string][]byte{"users": public}},
+		Secondary: []codec.Codec{enc},
+	}
+	if err := codec.UnmarshalCtx(rotated, "users", "alice", data, &got); err != nil || got.Name != "alice" {
+		t.Fatalf("Fallback UnmarshalCtx = %+v, %v", got, err)
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	rep := codectest.RunCodecTests(t, &codec.Versioned{Codec: &codec.JSON{}, Version: 3}, samples())
+	if !rep.Deterministic {
+		t.Error("expected Versioned of JSON to be deterministic")
+	}
+
+	// version 1 had a name, version 2 split it, version 3 added a count
+	type v1 struct {
+		Name string `json:"name"`
+	}
+	type v3 struct {
+		First string `json:"first"`
+		Last  string `json:"last"`
+		Count int    `json:"count"`
+	}
+	old, err := (&codec.Versioned{Codec: &codec.JSON{}, Version: 1}).Marshal(v1{Name: "Ada Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old[0] != 1 {
+		t.Fatalf("version byte = %d, want 1", old[0])
+	}
+
+	c := &codec.Versioned{Codec: &codec.JSON{}, Version: 3}
+	var got v3
+	if err := c.Unmarshal(old, &got); !errors.Is(err, codec.ErrSchemaVersion) {
+		t.Fatalf("Unmarshal without upgrades error = %v, want ErrSchemaVersion", err)
+	}
+	c.RegisterUpgrade(1, func(data []byte) ([]byte, error) {
+		var in v1
+		if err := json.Unmarshal(data, &in); err != nil {
+			return nil, err
+		}
+		first, last, _ := strings.Cut(in.Name, " ")
+		return json.Marshal(map[string]string{"first": first, "last": last})
+	})
+	c.RegisterUpgrade(2, func(data []byte) ([]byte, error) {
+		var in map[string]any
+		if err := json.Unmarshal(data, &in); err != nil {
+			return nil, err
+		}
+		in["count"] = 1
+		return json.Marshal(in)
+	})
+	if err := c.Unmarshal(old, &got); err != nil || got != (v3{First: "Ada", Last: "Lovelace", Count: 1}) {
+		t.Fatalf("Unmarshal of version 1 = %+v, %v", got, err)
+	}
+
+	// current values skip the upgrades
+	cur, _ := c.Marshal(v3{First: "Grace", Last: "Hopper", Count: 2})
+	if err := c.Unmarshal(cur, &got); err != nil || got != (v3{First: "Grace", Last: "Hopper", Count: 2}) {
+		t.Fatalf("Unmarshal of version 3 = %+v, %v", got, err)
+	}
+
+	// an older binary refuses newer values
+	if err := (&codec.Versioned{Codec: &codec.JSON{}, Version: 2}).Unmarshal(cur, &got); !errors.Is(err, codec.ErrSchemaVersion) {
+		t.Errorf("Unmarshal of a newer version error = %v, want ErrSchemaVersion", err)
+	}
+	failing := &codec.Versioned{Codec: &codec.JSON{}, Version: 2}
+	failing.RegisterUpgrade(1, func([]byte) ([]byte, error) { return nil, errors.New("boom") })
+	if err := failing.Unmarshal(old, &got); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("failing upgrade error = %v", err)
+	}
+	if err := c.Unmarshal(nil, &got); !errors.Is(err, codec.ErrSchemaVersion) {
+		t.Errorf("Unmarshal(nil) error = %v, want ErrSchemaVersion", err)
+	}
+	if _, err := (&codec.Versioned{Codec: &codec.JSON{}, Version: 256}).Marshal(got); err == nil {
+		t.Error("expected error for a version that doesn't fit a byte")
+	}
+
+	// adopted on values written without it
+	fb := &codec.Fallback{Primary: c, Secondary: []codec.Codec{&codec.JSON{Strict: true}}}
+	if err := fb.Unmarshal([]byte(`{"first":"Alan","last":"Turing","count":3}`), &got); err != nil || got.First != "Alan" {
+		t.Errorf("Fallback Unmarshal of an untagged value = %+v, %v", got, err)
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	// tagged is the legacy encoding, JSON the new one; each rejects the other
+	dw := &codec.DualWrite{Primary: &codec.JSON{Strict: true}, Legacy: &tagged{}, Mode: codec.DualWriteEnvelope}
+	codectest.RunCodecTests(t, dw, samples())
+	dw.ResetStats()
+
+	// binaries of step 1 of the cutover, and ones without DualWrite
+	old := &codec.DualWrite{Primary: &tagged{}, Legacy: &codec.JSON{Strict: true}}
+	var oldest codec.Codec = &tagged{}
+
+	in := sample{Name: "alice", Count: 1}
+	var got sample
+	legacy, _ := codec.MarshalCtx(oldest, "users", "alice", in)
+	if err := codec.UnmarshalCtx(dw, "users", "alice", legacy, &got); err != nil || got.Name != "alice" {
+		t.Fatalf("UnmarshalCtx of a legacy value = %+v, %v", got, err)
+	}
+
+	env, err := codec.MarshalCtx(dw, "users", "alice", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = sample{}
+	if err := codec.UnmarshalCtx(old, "users", "alice", env, &got); err != nil || got.Name != "alice" {
+		t.Fatalf("old binary UnmarshalCtx of an envelope = %+v, %v", got, err)
+	}
+	if err := codec.UnmarshalCtx(dw, "users", "alice", env, &got); err != nil {
+		t.Fatal(err)
+	}
+	if st := dw.Stats(); st.Reads != 2 || st.LegacyReads != 1 || st.LastLegacyRead.IsZero() {
+		t.Fatalf("Stats() = %+v, want 2 reads, 1 legacy", st)
+	}
+	if st := old.Stats(); st.Reads != 1 || st.LegacyReads != 0 {
+		t.Fatalf("old binary Stats() = %+v", st)
+	}
+
+	// shadow writes hand the legacy form to the callback
+	shadow := map[string][]byte{}
+	dw.Mode = codec.DualWriteShadow
+	dw.OnLegacy = func(kind, key string, legacy []byte) error {
+		shadow[kind+"/"+key] = legacy
+		return nil
+	}
+	data, err := codec.MarshalCtx(dw, "users", "bob", sample{Name: "bob"})
+	if err != nil || string(data) != `{"name":"bob","count":0,"tags":null,"labels":null}` {
+		t.Fatalf("shadow MarshalCtx = %s, %v", data, err)
+	}
+	if err := codec.UnmarshalCtx(oldest, "users", "bob", shadow["users/bob"], &got); err != nil || got.Name != "bob" {
+		t.Fatalf("old binary UnmarshalCtx of the shadow = %+v, %v", got, err)
+	}
+	dw.OnLegacy = func(string, string, []byte) error { return errors.New("queue full") }
+	if _, err := dw.Marshal(in); err == nil {
+		t.Error("expected OnLegacy error to fail Marshal")
+	}
+
+	// cutover: primary only, no legacy reads left
+	dw.Mode = codec.DualWritePrimaryOnly
+	dw.ResetStats()
+	data, _ = codec.MarshalCtx(dw, "users", "alice", in)
+	for _, d := range [][]byte{data, env} {
+		if err := codec.UnmarshalCtx(dw, "users", "alice", d, &got); err != nil || got.Name != "alice" {
+			t.Fatalf("UnmarshalCtx after cutover = %+v, %v", got, err)
+		}
+	}
+	if st := dw.Stats(); st.Reads != 2 || st.LegacyReads != 0 {
+		t.Fatalf("Stats() after cutover = %+v", st)
+	}
+	// once the DualWrite is gone, only rewritten values decode
+	if err := dw.Primary.Unmarshal(data, &got); err != nil {
+		t.Errorf("Primary Unmarshal of a primary-only value: %v", err)
+	}
+	if err := dw.Primary.Unmarshal(env, &got); err == nil {
+		t.Error("expected Primary alone to reject an envelope")
+	}
+}
+
+// tagged prefixes encodings with the kind and key they were written for.
+type tagged struct{ codec.JSON }
+
+func (c *tagged) MarshalCtx(kind, key string, v any) ([]byte, error) {
+	data, err := c.Marshal(v)
+	return append([]byte(kind+"/"+key+":"), data...), err
+}
+
+func (c *tagged) UnmarshalCtx(kind, key string, data []byte, v any) error {
+	rest, ok := bytes.CutPrefix(data, []byte(kind+"/"+key+":"))
+	if !ok {
+		return fmt.Errorf("not written for %s/%s: %q", kind, key, data)
+	}
+	return c.Unmarshal(rest, v)
+}
+
+func TestContentType(t *testing.T) {
+	for _, tt := range []struct {
+		c    codec.Codec
+		want string
+	}{
+		{&codec.JSON{}, "application/json"},
+		{&codec.YAML{}, "application/yaml"},
+		{&codec.Protobuf{}, "application/protobuf"},
+		{&codec.Fallback{Primary: &codec.YAML{}, Secondary: []codec.Codec{&codec.JSON{}}}, "application/yaml"},
+		// ciphertext is opaque
+		{&codec.Encrypted{Codec: &codec.JSON{}}, codec.DefaultContentType},
+		// only the Codec methods of a JSON
+		{struct{ codec.Codec }{&codec.JSON{}}, codec.DefaultContentType},
+	} {
+		if got := codec.ContentType(tt.c); got != tt.want {
+			t.Errorf("ContentType(%T) = %q, want %q", tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestContextCodec(t *testing.T) {
+	var c codec.Codec = &tagged{}
+	data, err := codec.MarshalCtx(c, "notes", "n1", "hi")
+	if err != nil || string(data) != `notes/n1:"hi"` {
+		t.Fatalf("MarshalCtx = %q, %v", data, err)
+	}
+	var got string
+	if err := codec.UnmarshalCtx(c, "notes", "n1", data, &got); err != nil || got != "hi" {
+		t.Fatalf("UnmarshalCtx = %q, %v", got, err)
+	}
+	if err := codec.UnmarshalCtx(c, "notes", "n2", data, &got); err == nil {
+		t.Error("expected error decoding another key's value")
+	}
+
+	// codecs without the interface get Marshal and Unmarshal
+	data, err = codec.MarshalCtx(&codec.JSON{}, "notes", "n1", "hi")
+	if err != nil || string(data) != `"hi"` {
+		t.Fatalf("MarshalCtx(JSON) = %q, %v", data, err)
+	}
+	if err := codec.UnmarshalCtx(&codec.JSON{}, "notes", "n1", data, &got); err != nil || got != "hi" {
+		t.Fatalf("UnmarshalCtx(JSON) = %q, %v", got, err)
+	}
+
+	// Fallback passes the context on
+	fb := &codec.Fallback{Primary: &tagged{}, Secondary: []codec.Codec{&codec.JSON{}}}
+	data, _ = codec.MarshalCtx(fb, "notes", "n1", "hi")
+	if string(data) != `notes/n1:"hi"` {
+		t.Fatalf("Fallback MarshalCtx = %q", data)
+	}
+	if c, err := fb.UnmarshalMatchCtx("notes", "n1", []byte(`"old"`), &got); err != nil || got != "old" || c == fb.Primary {
+		t.Fatalf("Fallback UnmarshalMatchCtx = %T %q, %v", c, got, err)
+	}
+}
@@ -0,0 +1,284 @@
+// Package codectest checks codec.Codec implementations against the contract
+// the stores rely on. Third-party codecs can run it from their own tests:
+//
+//	func TestCodec(t *testing.T) {
+//		codectest.RunCodecTests(t, &MyCodec{}, []any{Config{Name: "a"}})
+//	}
+package codectest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/zestor-dev/zestor/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// marshalRuns is how many times each sample is marshaled when checking for
+// deterministic output. Go randomizes map iteration, so a few runs are
+// enough to expose encoders that follow it.
+const marshalRuns = 8
+
+// Report describes what RunCodecTests observed about a codec.
+type Report struct {
+	// Deterministic is true when repeated Marshal calls produced identical
+	// bytes for every sample.
+	Deterministic bool
+	// NonDeterministic lists the indexes of samples whose encoding varied.
+	NonDeterministic []int
+}
+
+// RunCodecTests runs the codec contract against every sample as subtests of t:
+//
+//   - Unmarshal(Marshal(v)) equals v, and so does the zero value of v's type
+//   - a nil pointer marshals and decodes back without error
+//   - Unmarshal into a non-pointer or nil pointer returns an error
+//   - for a codec.BufferedCodec, MarshalAppend keeps dst and appends an
+//     encoding that decodes to v, the same bytes as Marshal when the
+//     encoding is deterministic
+//   - nothing panics
+//
+// Samples are values of the type a store would be parameterized with;
+// pointer samples (e.g. proto messages) are decoded into a fresh value of
+// the pointed-to type. Proto messages are compared with proto.Equal,
+// everything else structurally, with nil and empty slices or maps treated
+// as equal since many formats cannot tell them apart.
+//
+// Non-deterministic encoding is not a failure: it is recorded in the
+// returned Report. It fails only when the codec implements
+// codec.Deterministic and claims otherwise.
+func RunCodecTests(t *testing.T, c codec.Codec, samples []any) Report {
+	t.Helper()
+	rep := Report{Deterministic: true}
+	for i, sample := range samples {
+		t.Run(fmt.Sprintf("%d_%T", i, sample), func(t *testing.T) {
+			det := deterministic(t, c, sample)
+			if !det {
+				rep.NonDeterministic = append(rep.NonDeterministic, i)
+			}
+			if bc, ok := c.(codec.BufferedCodec); ok {
+				appendTo(t, bc, sample, det)
+			}
+			roundTrip(t, c, sample)
+			roundTrip(t, c, zeroOf(reflect.TypeOf(sample)))
+			nilPointer(t, c, reflect.TypeOf(sample))
+			badTarget(t, c, sample)
+		})
+	}
+	rep.Deterministic = len(rep.NonDeterministic) == 0
+	if d, ok := c.(codec.Deterministic); ok && d.Deterministic() && !rep.Deterministic {
+		t.Errorf("%T reports Deterministic() but samples %v encoded differently across runs", c, rep.NonDeterministic)
+	}
+	return rep
+}
+
+func roundTrip(t *testing.T, c codec.Codec, v any) {
+	t.Helper()
+	data, err := marshal(c, v)
+	if err != nil {
+		t.Errorf("Marshal(%#v): %v", v, err)
+		return
+	}
+	got, dst := fresh(reflect.TypeOf(v))
+	if err := unmarshal(c, data, dst); err != nil {
+		t.Errorf("Unmarshal(%q): %v", data, err)
+		return
+	}
+	if !equal(got(), v) {
+		t.Errorf("round trip mismatch:\n  want %#v\n  got  %#v", v, got())
+	}
+}
+
+// appendTo checks MarshalAppend against Marshal, appending to a buffer
+// that already holds data.
+func appendTo(t *testing.T, c codec.BufferedCodec, v any, det bool) {
+	t.Helper()
+	prefix := []byte("prefix")
+	out, err := marshalAppend(c, prefix, v)
+	if err != nil {
+		t.Errorf("MarshalAppend(%#v): %v", v, err)
+		return
+	}
+	if !bytes.HasPrefix(out, prefix) {
+		t.Errorf("MarshalAppend overwrote dst: %q", out)
+		return
+	}
+	data := out[len(prefix):]
+	if want, err := marshal(c, v); det && err == nil && !bytes.Equal(data, want) {
+		t.Errorf("MarshalAppend = %q, Marshal = %q", data, want)
+	}
+	got, dst := fresh(reflect.TypeOf(v))
+	if err := unmarshal(c, data, dst); err != nil {
+		t.Errorf("Unmarshal of MarshalAppend output %q: %v", data, err)
+		return
+	}
+	if !equal(got(), v) {
+		t.Errorf("MarshalAppend round trip mismatch:\n  want %#v\n  got  %#v", v, got())
+	}
+}
+
+func deterministic(t *testing.T, c codec.Codec, v any) bool {
+	t.Helper()
+	first, err := marshal(c, v)
+	if err != nil {
+		// reported by roundTrip
+		return true
+	}
+	for i := 1; i < marshalRuns; i++ {
+		again, err := marshal(c, v)
+		if err != nil {
+			t.Errorf("Marshal(%#v) failed on run %d: %v", v, i+1, err)
+			return true
+		}
+		if !bytes.Equal(first, again) {
+			t.Logf("non-deterministic encoding: %q then %q", first, again)
+			return false
+		}
+	}
+	return true
+}
+
+// nilPointer checks that a nil *T (or nil T for pointer types) can be
+// marshaled and that whatever comes out decodes into a fresh value.
+func nilPointer(t *testing.T, c codec.Codec, typ reflect.Type) {
+	t.Helper()
+	if typ.Kind() != reflect.Pointer {
+		typ = reflect.PointerTo(typ)
+	}
+	data, err := marshal(c, reflect.Zero(typ).Interface())
+	if err != nil {
+		t.Errorf("Marshal(nil %s): %v", typ, err)
+		return
+	}
+	_, dst := fresh(typ.Elem())
+	if err := unmarshal(c, data, dst); err != nil {
+		t.Errorf("Unmarshal of nil %s encoding %q: %v", typ, data, err)
+	}
+}
+
+// badTarget checks that decoding into something that cannot be written
+// fails cleanly instead of panicking or silently dropping the data.
+func badTarget(t *testing.T, c codec.Codec, v any) {
+	t.Helper()
+	data, err := marshal(c, v)
+	if err != nil {
+		return
+	}
+	typ := reflect.TypeOf(v)
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if err := unmarshal(c, data, reflect.New(typ).Elem().Interface()); err == nil {
+		t.Errorf("Unmarshal into non-pointer %s: expected error", typ)
+	}
+	if err := unmarshal(c, data, reflect.Zero(reflect.PointerTo(typ)).Interface()); err == nil {
+		t.Errorf("Unmarshal into nil *%s: expected error", typ)
+	}
+}
+
+// zeroOf returns the zero value of typ, or a pointer to a zero value for
+// pointer types, matching what a store decodes into.
+func zeroOf(typ reflect.Type) any {
+	if typ.Kind() == reflect.Pointer {
+		return reflect.New(typ.Elem()).Interface()
+	}
+	return reflect.Zero(typ).Interface()
+}
+
+// fresh allocates a decode target for a value of typ. get returns the
+// decoded value in the same shape as the original sample.
+func fresh(typ reflect.Type) (get func() any, dst any) {
+	if typ.Kind() == reflect.Pointer {
+		p := reflect.New(typ.Elem())
+		return p.Interface, p.Interface()
+	}
+	p := reflect.New(typ)
+	return p.Elem().Interface, p.Interface()
+}
+
+func equal(a, b any) bool {
+	if ma, ok := a.(proto.Message); ok {
+		if mb, ok := b.(proto.Message); ok {
+			return proto.Equal(ma, mb)
+		}
+	}
+	return deepEqual(reflect.ValueOf(a), reflect.ValueOf(b))
+}
+
+// deepEqual is reflect.DeepEqual except that nil and empty slices or maps
+// are equal.
+func deepEqual(a, b reflect.Value) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !deepEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, k := range a.MapKeys() {
+			bv := b.MapIndex(k)
+			if !bv.IsValid() || !deepEqual(a.MapIndex(k), bv) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !deepEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return deepEqual(a.Elem(), b.Elem())
+	case reflect.Func:
+		return a.IsNil() && b.IsNil()
+	}
+	return a.Equal(b)
+}
+
+func marshal(c codec.Codec, v any) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.Marshal(v)
+}
+
+func marshalAppend(c codec.BufferedCodec, dst []byte, v any) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.MarshalAppend(dst, v)
+}
+
+func unmarshal(c codec.Codec, data []byte, v any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.Unmarshal(data, v)
+}
@@ -0,0 +1,194 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DualWriteMode selects what DualWrite writes besides the Primary
+// encoding.
+type DualWriteMode int
+
+const (
+	// DualWritePrimaryOnly writes the Primary encoding alone, once no
+	// reader needs the legacy one. Reads still fall back to Legacy.
+	DualWritePrimaryOnly DualWriteMode = iota
+	// DualWriteEnvelope writes an envelope holding both encodings, which
+	// every DualWrite decodes, whichever of the two codecs is its Primary.
+	DualWriteEnvelope
+	// DualWriteShadow writes the Primary encoding and hands the Legacy one
+	// to DualWrite.OnLegacy, e.g. to keep it in a parallel kind that old
+	// binaries read.
+	DualWriteShadow
+)
+
+// envelopeMagic starts a DualWriteEnvelope encoding. The NUL byte keeps it
+// from being a JSON or YAML document.
+var envelopeMagic = []byte("\x00zdw1")
+
+// DualWrite switches the encoding of stored values from Legacy to Primary
+// while binaries of both generations run. Marshal encodes with Primary,
+// and depending on Mode with Legacy as well; Unmarshal prefers Primary and
+// falls back to Legacy, counting those reads in Stats.
+//
+// A cutover goes:
+//
+//  1. Deploy every binary with a DualWrite whose Primary is still the old
+//     codec, Legacy the new one and Mode DualWritePrimaryOnly: they keep
+//     writing the old format and learn to decode envelopes.
+//  2. Swap the two codecs and write with DualWriteEnvelope, or with
+//     DualWriteShadow for binaries that can't be upgraded and read the
+//     legacy form from where OnLegacy puts it.
+//  3. Rewrite the stored values, e.g. with the SQLite store's Recode, and
+//     switch to DualWritePrimaryOnly once no reader is older than step 2.
+//  4. Call ResetStats and wait until Stats reports no LegacyReads for as
+//     long as it takes every value to be read; then replace the DualWrite
+//     with Primary alone.
+//
+// Set JSON.Strict where JSON is involved, as with Fallback, so that a
+// payload of the other format is rejected rather than decoded into a zero
+// value.
+type DualWrite struct {
+	Primary Codec
+	Legacy  Codec
+	Mode    DualWriteMode
+
+	// OnLegacy receives the Legacy encoding of each value written in
+	// DualWriteShadow mode, with its kind and key when the store passes
+	// them (see ContextCodec). An error fails the write. It runs as part of
+	// the write, so it should queue the bytes rather than write to the
+	// same store.
+	OnLegacy func(kind, key string, legacy []byte) error
+
+	mu    sync.Mutex
+	stats DualWriteStats
+}
+
+// DualWriteStats counts the values a DualWrite decoded since it was made
+// or ResetStats was called.
+type DualWriteStats struct {
+	// Reads counts the values decoded.
+	Reads int64
+	// LegacyReads counts the reads Primary couldn't serve and Legacy did,
+	// of values still in the legacy encoding only.
+	LegacyReads int64
+	// LastLegacyRead is the time of the latest of them.
+	LastLegacyRead time.Time
+}
+
+func (d *DualWrite) Marshal(v any) ([]byte, error) {
+	return d.MarshalCtx("", "", v)
+}
+
+func (d *DualWrite) Unmarshal(data []byte, v any) error {
+	return d.UnmarshalCtx("", "", data, v)
+}
+
+// MarshalCtx encodes v per Mode, passing kind and key on to the codecs
+// that are ContextCodecs and to OnLegacy.
+func (d *DualWrite) MarshalCtx(kind, key string, v any) ([]byte, error) {
+	data, err := MarshalCtx(d.Primary, kind, key, v)
+	if err != nil || d.Mode == DualWritePrimaryOnly {
+		return data, err
+	}
+	legacy, err := MarshalCtx(d.Legacy, kind, key, v)
+	if err != nil {
+		return nil, fmt.Errorf("codec: legacy encoding: %w", err)
+	}
+	switch d.Mode {
+	case DualWriteEnvelope:
+		out := make([]byte, 0, len(envelopeMagic)+binary.MaxVarintLen64+len(data)+len(legacy))
+		out = append(out, envelopeMagic...)
+		out = binary.AppendUvarint(out, uint64(len(data)))
+		out = append(out, data...)
+		return append(out, legacy...), nil
+	case DualWriteShadow:
+		if d.OnLegacy == nil {
+			return nil, errors.New("codec: DualWriteShadow without OnLegacy")
+		}
+		if err := d.OnLegacy(kind, key, legacy); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("codec: unknown DualWriteMode %d", d.Mode)
+}
+
+// UnmarshalCtx decodes data with Primary, then with Legacy, passing kind
+// and key on to the codecs that are ContextCodecs. Of an envelope, it
+// tries both payloads with Primary, then both with Legacy.
+func (d *DualWrite) UnmarshalCtx(kind, key string, data []byte, v any) error {
+	payloads := [][]byte{data}
+	if env, ok := openEnvelope(data); ok {
+		payloads = env
+	}
+	var errs []error
+	for _, c := range []Codec{d.Primary, d.Legacy} {
+		for _, p := range payloads {
+			err := UnmarshalCtx(c, kind, key, p, v)
+			if err == nil {
+				d.count(c == d.Legacy)
+				return nil
+			}
+			errs = append(errs, fmt.Errorf("%T: %w", c, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// openEnvelope returns the Primary and Legacy payloads of a
+// DualWriteEnvelope encoding, and false if data isn't one.
+func openEnvelope(data []byte) ([][]byte, bool) {
+	rest, ok := bytes.CutPrefix(data, envelopeMagic)
+	if !ok {
+		return nil, false
+	}
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n > uint64(len(rest)-size) {
+		return nil, false
+	}
+	rest = rest[size:]
+	return [][]byte{rest[:n], rest[n:]}, true
+}
+
+func (d *DualWrite) count(legacy bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats.Reads++
+	if legacy {
+		d.stats.LegacyReads++
+		d.stats.LastLegacyRead = time.Now()
+	}
+}
+
+// Stats returns the reads counted since the DualWrite was made or
+// ResetStats was last called. Legacy is safe to drop once LegacyReads
+// stays zero over a period in which every value was read.
+func (d *DualWrite) Stats() DualWriteStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// ResetStats starts counting anew, e.g. after the values were rewritten.
+func (d *DualWrite) ResetStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats = DualWriteStats{}
+}
+
+// Deterministic reports whether the codecs Marshal uses are deterministic.
+func (d *DualWrite) Deterministic() bool {
+	det := func(c Codec) bool {
+		dc, ok := c.(Deterministic)
+		return !ok || dc.Deterministic()
+	}
+	if d.Mode == DualWriteEnvelope {
+		return det(d.Primary) && det(d.Legacy)
+	}
+	return det(d.Primary)
+}
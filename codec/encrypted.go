@@ -0,0 +1,108 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// ErrDecrypt is returned when encrypted data fails authentication: it was
+// encrypted with another key or for another kind, or has been tampered
+// with.
+var ErrDecrypt = errors.New("codec: decryption failed")
+
+// Encrypted encrypts the encoding produced by Codec with AES-GCM. Each
+// value gets a random nonce, stored in front of the ciphertext.
+//
+// Keys are 16, 24 or 32 bytes long (AES-128, -192 or -256). KindKeys
+// selects the key of a kind; kinds without an entry use Key. Stores that
+// pass the kind (see ContextCodec) also bind each value to its kind, so a
+// blob copied to another kind fails to decrypt. Marshal and Unmarshal,
+// called without a kind, always use Key.
+//
+// To rotate a key, make an Encrypted with the new key the Primary of a
+// Fallback and one with the old key its Secondary.
+type Encrypted struct {
+	Codec    Codec
+	Key      []byte
+	KindKeys map[string][]byte
+}
+
+func (e *Encrypted) Marshal(v any) ([]byte, error) {
+	return e.seal(e.Key, nil, v)
+}
+
+func (e *Encrypted) Unmarshal(data []byte, v any) error {
+	return e.open(e.Key, nil, data, v)
+}
+
+func (e *Encrypted) MarshalCtx(kind, _ string, v any) ([]byte, error) {
+	key, err := e.keyFor(kind)
+	if err != nil {
+		return nil, err
+	}
+	return e.seal(key, []byte(kind), v)
+}
+
+func (e *Encrypted) UnmarshalCtx(kind, _ string, data []byte, v any) error {
+	key, err := e.keyFor(kind)
+	if err != nil {
+		return err
+	}
+	return e.open(key, []byte(kind), data, v)
+}
+
+// Deterministic is false: every encryption uses a fresh nonce.
+func (e *Encrypted) Deterministic() bool { return false }
+
+func (e *Encrypted) keyFor(kind string) ([]byte, error) {
+	if key, ok := e.KindKeys[kind]; ok {
+		return key, nil
+	}
+	if e.Key == nil {
+		return nil, fmt.Errorf("codec: no encryption key for kind %q", kind)
+	}
+	return e.Key, nil
+}
+
+func (e *Encrypted) seal(key, kind []byte, v any) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := e.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, plain, kind), nil
+}
+
+func (e *Encrypted) open(key, kind, data []byte, v any) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return ErrDecrypt
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, kind)
+	if err != nil {
+		return ErrDecrypt
+	}
+	return e.Codec.Unmarshal(plain, v)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("codec: encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
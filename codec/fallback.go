@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Fallback decodes data written by any of several codecs, for migrating
+// stored values from one encoding to another. Marshal always uses Primary;
+// Unmarshal tries Primary, then each Secondary in order, and returns the
+// first success.
+//
+// A blob that happens to decode under more than one codec is attributed to
+// the first that accepts it, so order matters and loose decoders should go
+// last. YAML, for one, accepts any JSON document. Set JSON.Strict when JSON
+// is involved so that documents of another shape are rejected rather than
+// decoded into a zero value.
+type Fallback struct {
+	Primary   Codec
+	Secondary []Codec
+
+	// OnSecondary, if set, is called with the codec that decoded a value
+	// whenever it isn't Primary, e.g. to count rows still in an old format.
+	OnSecondary func(c Codec)
+}
+
+func (f *Fallback) Marshal(v any) ([]byte, error) {
+	return f.Primary.Marshal(v)
+}
+
+func (f *Fallback) Unmarshal(data []byte, v any) error {
+	_, err := f.UnmarshalMatch(data, v)
+	return err
+}
+
+// MarshalCtx encodes v with Primary, passing kind and key on if Primary is
+// a ContextCodec.
+func (f *Fallback) MarshalCtx(kind, key string, v any) ([]byte, error) {
+	return MarshalCtx(f.Primary, kind, key, v)
+}
+
+// UnmarshalCtx is Unmarshal passing kind and key on to the codecs that are
+// ContextCodecs.
+func (f *Fallback) UnmarshalCtx(kind, key string, data []byte, v any) error {
+	_, err := f.UnmarshalMatchCtx(kind, key, data, v)
+	return err
+}
+
+// UnmarshalMatch is like Unmarshal but also returns the codec that decoded
+// data. If none does, the error joins every codec's error.
+func (f *Fallback) UnmarshalMatch(data []byte, v any) (Codec, error) {
+	return f.match(func(c Codec) error { return c.Unmarshal(data, v) })
+}
+
+// UnmarshalMatchCtx is UnmarshalMatch passing kind and key on to the
+// codecs that are ContextCodecs.
+func (f *Fallback) UnmarshalMatchCtx(kind, key string, data []byte, v any) (Codec, error) {
+	return f.match(func(c Codec) error { return UnmarshalCtx(c, kind, key, data, v) })
+}
+
+// match returns the first of Primary and Secondary that unmarshal accepts.
+func (f *Fallback) match(unmarshal func(c Codec) error) (Codec, error) {
+	perr := unmarshal(f.Primary)
+	if perr == nil {
+		return f.Primary, nil
+	}
+	errs := []error{fmt.Errorf("%T: %w", f.Primary, perr)}
+	for _, c := range f.Secondary {
+		err := unmarshal(c)
+		if err == nil {
+			if f.OnSecondary != nil {
+				f.OnSecondary(c)
+			}
+			return c, nil
+		}
+		errs = append(errs, fmt.Errorf("%T: %w", c, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Deterministic reports whether Primary is deterministic; values are only
+// ever encoded with it.
+func (f *Fallback) Deterministic() bool {
+	d, ok := f.Primary.(Deterministic)
+	return !ok || d.Deterministic()
+}
+
+// ContentType returns the media type of Primary, which encodes all values.
+func (f *Fallback) ContentType() string { return ContentType(f.Primary) }
@@ -1,14 +1,377 @@
 package codec
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
+// JSON encodes values with encoding/json. The zero value behaves like
+// json.Marshal and json.Unmarshal; use NewJSON for the other options.
 type JSON struct {
+	// Strict rejects objects with fields the target doesn't have, and
+	// trailing data after the value. Useful with Fallback, where a lenient
+	// decode would claim blobs written by another codec.
+	Strict bool
+
+	opts JSONOptions
+}
+
+// JSONOptions configures a JSON codec built with NewJSON.
+type JSONOptions struct {
+	// DisallowUnknownFields fails decoding of objects with fields the
+	// target doesn't have, with an *UnknownFieldError naming the field.
+	DisallowUnknownFields bool
+	// DisallowMissingFields fails decoding of objects lacking a field of
+	// the target struct, with a *MissingFieldError naming it, so data
+	// written before a field was added is caught, e.g. during a migration.
+	// Fields tagged omitempty or omitzero may be missing, as may those of
+	// types decoding themselves, such as time.Time. It decodes data twice.
+	DisallowMissingFields bool
+	// UseNumber decodes numbers into interface{} values as json.Number
+	// instead of float64, so large integers keep their precision.
+	UseNumber bool
+	// IntNumbers decodes numbers into interface{} values as int64 when
+	// they are integers in its range, as json.Number when they are larger
+	// integers, and as float64 otherwise. IDs in a map[string]any then
+	// keep their precision and compare equal to the int64 they were set
+	// with; encoding writes all three back as they were read. It
+	// overrides UseNumber.
+	IntNumbers bool
+	// Indent, if set, indents encoded values with it, one element per
+	// line, for files that people read.
+	Indent string
+	// TimePrecision, if > 0, encodes every time.Time in a value in UTC
+	// and truncated to a multiple of it (see NormalizeTime), so that a
+	// value whose times came back at another precision from YAML, a
+	// database or another language encodes the same, and stores take
+	// saving it again for the no-op it is. time.Millisecond suits most
+	// uses. Decoding is unaffected.
+	TimePrecision time.Duration
+}
+
+// NewJSON returns a JSON codec with opts.
+func NewJSON(opts JSONOptions) *JSON {
+	return &JSON{opts: opts}
+}
+
+// UnknownFieldError is returned when a JSON object has a field the target
+// doesn't, with DisallowUnknownFields or Strict set.
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("json: unknown field %q", e.Field)
+}
+
+// MissingFieldError is returned when a JSON object lacks a field of the
+// target, with DisallowMissingFields set. Field is the path to it, such as
+// "items[2].name".
+type MissingFieldError struct {
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("json: missing field %q", e.Field)
 }
 
 func (j *JSON) Marshal(v any) ([]byte, error) {
+	if j.opts.TimePrecision > 0 {
+		v = NormalizeTime(v, j.opts.TimePrecision)
+	}
+	if j.opts.Indent != "" {
+		return json.MarshalIndent(v, "", j.opts.Indent)
+	}
 	return json.Marshal(v)
 }
 
+// jsonBufs holds the buffers MarshalAppend encodes into.
+var jsonBufs = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// maxPooledBuf is the largest buffer put back into a pool; bigger ones are
+// left to the garbage collector so one huge value doesn't pin its memory.
+const maxPooledBuf = 64 << 10
+
+// MarshalAppend appends the encoding of v to dst. It encodes through a
+// pooled buffer, so only dst grows.
+func (j *JSON) MarshalAppend(dst []byte, v any) ([]byte, error) {
+	buf := jsonBufs.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBuf {
+			jsonBufs.Put(buf)
+		}
+	}()
+	if j.opts.TimePrecision > 0 {
+		v = NormalizeTime(v, j.opts.TimePrecision)
+	}
+	enc := json.NewEncoder(buf)
+	if j.opts.Indent != "" {
+		enc.SetIndent("", j.opts.Indent)
+	}
+	if err := enc.Encode(v); err != nil {
+		return dst, err
+	}
+	// Encode terminates the value with a newline, Marshal doesn't
+	return append(dst, bytes.TrimSuffix(buf.Bytes(), []byte("\n"))...), nil
+}
+
 func (j *JSON) Unmarshal(data []byte, v any) error {
-	return json.Unmarshal(data, v)
+	strict := j.Strict || j.opts.DisallowUnknownFields
+	useNumber := j.opts.UseNumber || j.opts.IntNumbers
+	if !strict && !useNumber && !j.opts.DisallowMissingFields {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if useNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(v); err != nil {
+		// encoding/json reports unknown fields only in the message
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if f, qerr := strconv.Unquote(field); qerr == nil {
+				field = f
+			}
+			return &UnknownFieldError{Field: field}
+		}
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("json: trailing data after value")
+	}
+	if j.opts.DisallowMissingFields {
+		var raw any
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		if err := checkMissing(reflect.TypeOf(v), raw, ""); err != nil {
+			return err
+		}
+	}
+	if j.opts.IntNumbers {
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer {
+			numberConverter{seen: make(map[copied]bool)}.value(rv)
+		}
+	}
+	return nil
 }
+
+var numberType = reflect.TypeOf(json.Number(""))
+
+// intNumber converts n for JSONOptions.IntNumbers.
+func intNumber(n json.Number) any {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i
+	}
+	if !strings.ContainsAny(string(n), ".eE") {
+		// an integer beyond int64, which float64 would round
+		return n
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n
+}
+
+// numberConverter converts the json.Numbers held in interfaces of a
+// decoded value, for JSONOptions.IntNumbers. seen holds the pointers it
+// followed, so that cyclic values end.
+type numberConverter struct {
+	seen map[copied]bool
+}
+
+// value converts the numbers in v, in place where v can be set, and
+// returns v, or the copy it converted them in.
+func (n numberConverter) value(v reflect.Value) reflect.Value {
+	if !holdsInterface(v.Type()) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		if e := v.Elem(); e.Type() == numberType {
+			c.Set(reflect.ValueOf(intNumber(e.Interface().(json.Number))))
+		} else {
+			c.Set(n.value(e))
+		}
+		return c
+	case reflect.Pointer:
+		p := copied{v.Pointer(), v.Type()}
+		if v.IsNil() || n.seen[p] {
+			return v
+		}
+		n.seen[p] = true
+		if e := v.Elem(); e.CanSet() {
+			e.Set(n.value(e))
+		}
+		return v
+	case reflect.Struct:
+		if !v.CanSet() {
+			c := reflect.New(v.Type()).Elem()
+			c.Set(v)
+			v = c
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				f.Set(n.value(f))
+			}
+		}
+		return v
+	case reflect.Array:
+		if !v.CanSet() {
+			c := reflect.New(v.Type()).Elem()
+			c.Set(v)
+			v = c
+		}
+		for i := 0; i < v.Len(); i++ {
+			v.Index(i).Set(n.value(v.Index(i)))
+		}
+		return v
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if e := v.Index(i); e.CanSet() {
+				e.Set(n.value(e))
+			}
+		}
+		return v
+	case reflect.Map:
+		for it := v.MapRange(); it.Next(); {
+			v.SetMapIndex(it.Key(), n.value(it.Value()))
+		}
+		return v
+	}
+	return v
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkMissing returns a *MissingFieldError for the first struct field in
+// t that the decoded JSON value v lacks, for DisallowMissingFields. path
+// is the path to v.
+func checkMissing(t reflect.Type, v any, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if p := reflect.PointerTo(t); p.Implements(jsonUnmarshalerType) || p.Implements(textUnmarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if obj, ok := v.(map[string]any); ok {
+			return structMissing(t, obj, path)
+		}
+	case reflect.Slice, reflect.Array:
+		arr, _ := v.([]any)
+		for i, e := range arr {
+			if err := checkMissing(t.Elem(), e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		obj, _ := v.(map[string]any)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := checkMissing(t.Elem(), obj[k], fieldPath(path, k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// structMissing checks the fields of the struct type t against obj,
+// following encoding/json: fields of untagged embedded structs are
+// promoted, and names match case-insensitively.
+func structMissing(t reflect.Type, obj map[string]any, path string) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := structMissing(ft, obj, path); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		val, ok := obj[name]
+		if !ok {
+			for k, kv := range obj {
+				if strings.EqualFold(k, name) {
+					val, ok = kv, true
+					break
+				}
+			}
+		}
+		if !ok {
+			if hasTagOption(opts, "omitempty") || hasTagOption(opts, "omitzero") {
+				continue
+			}
+			return &MissingFieldError{Field: fieldPath(path, name)}
+		}
+		if err := checkMissing(f.Type, val, fieldPath(path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func hasTagOption(opts, opt string) bool {
+	for opts != "" {
+		var o string
+		o, opts, _ = strings.Cut(opts, ",")
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// Deterministic reports true: encoding/json sorts map keys.
+func (j *JSON) Deterministic() bool { return true }
+
+func (j *JSON) ContentType() string { return "application/json" }
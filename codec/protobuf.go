@@ -17,6 +17,16 @@ func (p *Protobuf) Marshal(v any) ([]byte, error) {
 	return proto.Marshal(msg)
 }
 
+// MarshalAppend appends the encoding of v, which must be a proto.Message,
+// to dst.
+func (p *Protobuf) MarshalAppend(dst []byte, v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return dst, fmt.Errorf("protobuf: value must implement proto.Message")
+	}
+	return proto.MarshalOptions{}.MarshalAppend(dst, msg)
+}
+
 func (p *Protobuf) Unmarshal(data []byte, v any) error {
 	msg, ok := v.(proto.Message)
 	if !ok {
@@ -24,3 +34,9 @@ func (p *Protobuf) Unmarshal(data []byte, v any) error {
 	}
 	return proto.Unmarshal(data, msg)
 }
+
+// Deterministic reports false: proto.Marshal does not order map fields, so
+// equal messages may encode to different bytes.
+func (p *Protobuf) Deterministic() bool { return false }
+
+func (p *Protobuf) ContentType() string { return "application/protobuf" }
@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// NormalizeTime returns a copy of v in which every time.Time, at any depth
+// of exported fields, pointers, slices, arrays, map values and interfaces,
+// is in UTC and truncated to a multiple of precision, without a monotonic
+// clock reading. A precision <= 0 only converts to UTC and drops the
+// monotonic reading. v itself is left alone, as is what it shares with
+// the copy in unexported fields.
+//
+// Times that went through YAML, a database or another language come back
+// at another precision than they were written with, so equal instants
+// encode differently. Normalizing makes them compare, and encode, the
+// same, e.g. in a StoreOptions.CompareFn:
+//
+//	CompareFn: func(prev, new Note) bool {
+//		return reflect.DeepEqual(codec.NormalizeTime(prev, time.Millisecond), codec.NormalizeTime(new, time.Millisecond))
+//	},
+//
+// JSONOptions.TimePrecision applies it to every value the JSON codec
+// encodes.
+func NormalizeTime[T any](v T, precision time.Duration) T {
+	n := timeNormalizer{precision: precision, copies: make(map[copied]reflect.Value)}
+	var out T
+	rv := reflect.ValueOf(&out).Elem()
+	rv.Set(n.value(reflect.ValueOf(&v).Elem()))
+	return out
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timeNormalizer copies values for NormalizeTime. copies maps the
+// pointers it met to their copies, so that shared and cyclic values stay
+// so.
+type timeNormalizer struct {
+	precision time.Duration
+	copies    map[copied]reflect.Value
+}
+
+// copied is a pointer met by NormalizeTime; a struct and its first field
+// share an address.
+type copied struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// value returns v, of a type holding times, copied with its times
+// normalized, and v unchanged otherwise.
+func (n *timeNormalizer) value(v reflect.Value) reflect.Value {
+	if !holdsTime(v.Type()) {
+		return v
+	}
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if n.precision > 0 {
+			return reflect.ValueOf(t.UTC().Truncate(n.precision))
+		}
+		return reflect.ValueOf(t.UTC().Round(0))
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		p := copied{v.Pointer(), v.Type()}
+		if c, ok := n.copies[p]; ok {
+			return c
+		}
+		c := reflect.New(v.Type().Elem())
+		n.copies[p] = c
+		c.Elem().Set(n.value(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(n.value(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < c.NumField(); i++ {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(n.value(f))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(n.value(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(n.value(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for it := v.MapRange(); it.Next(); {
+			c.SetMapIndex(it.Key(), n.value(it.Value()))
+		}
+		return c
+	}
+	return v
+}
+
+// timeTypes caches holdsTime by type.
+var timeTypes sync.Map
+
+// holdsTime reports whether values of t may hold a time.Time that
+// NormalizeTime reaches: interfaces may, whatever they hold.
+func holdsTime(t reflect.Type) bool {
+	if held, ok := timeTypes.Load(t); ok {
+		return held.(bool)
+	}
+	held := searchType(t, timeType, make(map[reflect.Type]bool))
+	timeTypes.Store(t, held)
+	return held
+}
+
+// interfaceTypes caches holdsInterface by type.
+var interfaceTypes sync.Map
+
+// holdsInterface reports whether values of t hold an interface in a place
+// the JSON codec decodes into.
+func holdsInterface(t reflect.Type) bool {
+	if held, ok := interfaceTypes.Load(t); ok {
+		return held.(bool)
+	}
+	held := searchType(t, nil, make(map[reflect.Type]bool))
+	interfaceTypes.Store(t, held)
+	return held
+}
+
+// searchType reports whether values of t may hold a value of type want,
+// or an interface, without a cache: the answers for the types inside t
+// are partial while a recursive type is being searched.
+func searchType(t, want reflect.Type, visiting map[reflect.Type]bool) bool {
+	if t == want || t.Kind() == reflect.Interface {
+		return true
+	}
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return searchType(t.Elem(), want, visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() && searchType(f.Type, want, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrSchemaVersion is returned by Versioned when a value's schema version
+// is newer than Version, or older without upgrades registered to bring it
+// up to Version.
+var ErrSchemaVersion = errors.New("codec: unsupported schema version")
+
+// MaxSchemaVersion is the largest Versioned.Version: the version is stored
+// in one byte.
+const MaxSchemaVersion = 255
+
+// Versioned tags the encoding produced by Codec with the schema version of
+// the values, in a byte in front of it. When the shape of the stored type
+// changes, bump Version and register an upgrade from the previous one:
+// Unmarshal runs a value written at an older version through the upgrades
+// in order before decoding it, instead of silently leaving new fields zero.
+//
+//	c := &codec.Versioned{Codec: &codec.JSON{}, Version: 2}
+//	c.RegisterUpgrade(1, func(old []byte) ([]byte, error) {
+//		// rewrite a version 1 JSON document into version 2
+//	})
+//
+// Values written without Versioned don't carry the byte; to adopt it on a
+// store holding such values, make it the Primary of a Fallback with the
+// plain codec as Secondary and Codec.Strict set where there is one.
+type Versioned struct {
+	Codec Codec
+	// Version is the schema version Marshal writes and Unmarshal upgrades
+	// to, from 0 to MaxSchemaVersion.
+	Version int
+
+	mu sync.RWMutex
+	// upgrade of the encoding of each version to the next
+	upgrades map[int]func([]byte) ([]byte, error)
+}
+
+// RegisterUpgrade registers fn to turn an encoding of schema version from
+// into one of version from+1. It replaces an upgrade registered for from
+// before.
+func (c *Versioned) RegisterUpgrade(from int, fn func([]byte) ([]byte, error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.upgrades == nil {
+		c.upgrades = make(map[int]func([]byte) ([]byte, error))
+	}
+	c.upgrades[from] = fn
+}
+
+func (c *Versioned) Marshal(v any) ([]byte, error) {
+	return c.tag(func() ([]byte, error) { return c.Codec.Marshal(v) })
+}
+
+func (c *Versioned) Unmarshal(data []byte, v any) error {
+	return c.untag(data, func(data []byte) error { return c.Codec.Unmarshal(data, v) })
+}
+
+// MarshalCtx encodes v with Codec, passing kind and key on if Codec is a
+// ContextCodec.
+func (c *Versioned) MarshalCtx(kind, key string, v any) ([]byte, error) {
+	return c.tag(func() ([]byte, error) { return MarshalCtx(c.Codec, kind, key, v) })
+}
+
+// UnmarshalCtx is Unmarshal passing kind and key on if Codec is a
+// ContextCodec. Upgrades run before Codec sees the data.
+func (c *Versioned) UnmarshalCtx(kind, key string, data []byte, v any) error {
+	return c.untag(data, func(data []byte) error { return UnmarshalCtx(c.Codec, kind, key, data, v) })
+}
+
+// Deterministic reports whether Codec is deterministic; the version byte
+// doesn't change between calls.
+func (c *Versioned) Deterministic() bool {
+	d, ok := c.Codec.(Deterministic)
+	return !ok || d.Deterministic()
+}
+
+// tag returns the encoding marshal produces behind the version byte.
+func (c *Versioned) tag(marshal func() ([]byte, error)) ([]byte, error) {
+	if c.Version < 0 || c.Version > MaxSchemaVersion {
+		return nil, fmt.Errorf("codec: schema version %d out of range 0-%d", c.Version, MaxSchemaVersion)
+	}
+	data, err := marshal()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1, 1+len(data))
+	out[0] = byte(c.Version)
+	return append(out, data...), nil
+}
+
+// untag upgrades the encoding behind data's version byte to Version and
+// hands it to unmarshal.
+func (c *Versioned) untag(data []byte, unmarshal func([]byte) error) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: no version byte", ErrSchemaVersion)
+	}
+	version, data := int(data[0]), data[1:]
+	if version > c.Version {
+		return fmt.Errorf("%w: %d is newer than %d", ErrSchemaVersion, version, c.Version)
+	}
+	for ; version < c.Version; version++ {
+		c.mu.RLock()
+		upgrade := c.upgrades[version]
+		c.mu.RUnlock()
+		if upgrade == nil {
+			return fmt.Errorf("%w: no upgrade from %d", ErrSchemaVersion, version)
+		}
+		var err error
+		if data, err = upgrade(data); err != nil {
+			return fmt.Errorf("codec: upgrade from schema version %d: %w", version, err)
+		}
+	}
+	return unmarshal(data)
+}
@@ -1,6 +1,9 @@
 package codec
 
 import (
+	"fmt"
+	"reflect"
+
 	"go.yaml.in/yaml/v2"
 )
 
@@ -12,5 +15,14 @@ func (y *YAML) Marshal(v any) ([]byte, error) {
 }
 
 func (y *YAML) Unmarshal(data []byte, v any) error {
+	// yaml panics when asked to decode into something it cannot set
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("yaml: Unmarshal(non-pointer %T)", v)
+	}
 	return yaml.Unmarshal(data, v)
 }
+
+// Deterministic reports true: yaml sorts map keys when marshaling.
+func (y *YAML) Deterministic() bool { return true }
+
+func (y *YAML) ContentType() string { return "application/yaml" }
@@ -0,0 +1,516 @@
+package store
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// boxed is the Store[T] Open returns: a Store[any] of a registered backend
+// whose values are all T.
+type boxed[T any] struct {
+	boxedReader[T]
+	s Store[any]
+}
+
+// boxedReader is a Reader[T] on a Reader[any] whose values are all T.
+type boxedReader[T any] struct {
+	r Reader[any]
+}
+
+// unbox returns v as a T; nil, a missing value, is the zero T.
+func unbox[T any](v any) T {
+	t, _ := v.(T)
+	return t
+}
+
+func unboxMap[T any](m map[string]any) map[string]T {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]T, len(m))
+	for k, v := range m {
+		out[k] = unbox[T](v)
+	}
+	return out
+}
+
+func unboxKVs[T any](kvs []KeyValue[any]) []KeyValue[T] {
+	if kvs == nil {
+		return nil
+	}
+	out := make([]KeyValue[T], len(kvs))
+	for i, kv := range kvs {
+		out[i] = KeyValue[T]{Key: kv.Key, Value: unbox[T](kv.Value)}
+	}
+	return out
+}
+
+func unboxEvent[T any](ev *Event[any]) *Event[T] {
+	return &Event[T]{
+		Kind:        ev.Kind,
+		Name:        ev.Name,
+		EventType:   ev.EventType,
+		Object:      unbox[T](ev.Object),
+		PrevOmitted: ev.PrevOmitted,
+		At:          ev.At,
+		Seq:         ev.Seq,
+		Version:     ev.Version,
+		Silent:      ev.Silent,
+	}
+}
+
+func (b boxedReader[T]) Get(kind, key string) (T, bool, error) {
+	v, ok, err := b.r.Get(kind, key)
+	return unbox[T](v), ok, err
+}
+
+func (b boxedReader[T]) List(kind string, filter ...FilterFunc[T]) (map[string]T, error) {
+	filters := make([]FilterFunc[any], len(filter))
+	for i, f := range filter {
+		if f != nil {
+			filters[i] = func(key string, v any) bool { return f(key, unbox[T](v)) }
+		}
+	}
+	m, err := b.r.List(kind, filters...)
+	return unboxMap[T](m), err
+}
+
+func (b boxedReader[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	m, err := ListPrefix(b.r, kind, prefix)
+	return unboxMap[T](m), err
+}
+
+func (b boxedReader[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	return KeySegments(b.r, kind, separator, prefix)
+}
+
+func (b boxedReader[T]) Count(kind string) (int, error) {
+	return b.r.Count(kind)
+}
+
+func (b boxedReader[T]) Kinds() ([]string, error) {
+	return Kinds(b.r)
+}
+
+func (b boxedReader[T]) Keys(kind string) ([]string, error) {
+	return b.r.Keys(kind)
+}
+
+func (b boxedReader[T]) Values(kind string) ([]KeyValue[T], error) {
+	kvs, err := b.r.Values(kind)
+	return unboxKVs[T](kvs), err
+}
+
+func (b boxedReader[T]) GetAll() (map[string]map[string]T, error) {
+	all, err := b.r.GetAll()
+	if all == nil {
+		return nil, err
+	}
+	out := make(map[string]map[string]T, len(all))
+	for kind, m := range all {
+		out[kind] = unboxMap[T](m)
+	}
+	return out, err
+}
+
+// SelectByLabel selects by label on the backend, if it can.
+func (b boxedReader[T]) SelectByLabel(kind string, selector map[string]string) ([]KeyValue[T], error) {
+	kvs, err := SelectByLabel(b.r, kind, selector)
+	return unboxKVs[T](kvs), err
+}
+
+func (b *boxed[T]) Set(kind, key string, value T, opts ...WriteOption) (bool, error) {
+	return b.s.Set(kind, key, value, opts...)
+}
+
+func (b *boxed[T]) SetFn(kind, key string, fn func(v T) (T, error), opts ...WriteOption) (bool, error) {
+	return b.s.SetFn(kind, key, func(v any) (any, error) {
+		return fn(unbox[T](v))
+	}, opts...)
+}
+
+func (b *boxed[T]) SetAll(kind string, values map[string]T, opts ...WriteOption) error {
+	m := make(map[string]any, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+	return b.s.SetAll(kind, m, opts...)
+}
+
+// SetAllOrdered writes values in order on the backend, if it can.
+func (b *boxed[T]) SetAllOrdered(kind string, values []KeyValue[T]) error {
+	kvs := make([]KeyValue[any], len(values))
+	for i, kv := range values {
+		kvs[i] = KeyValue[any]{Key: kv.Key, Value: kv.Value}
+	}
+	return SetAllOrdered(b.s, kind, kvs)
+}
+
+// ReplaceAll replaces a kind atomically, if the backend can.
+func (b *boxed[T]) ReplaceAll(kind string, values map[string]T, opts ...WriteOption) (ReplaceReport, error) {
+	r, ok := b.s.(Replacer[any])
+	if !ok {
+		return ReplaceReport{}, ErrUnsupported
+	}
+	m := make(map[string]any, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+	return r.ReplaceAll(kind, m, opts...)
+}
+
+// SetMulti writes to several kinds atomically, if the backend can.
+func (b *boxed[T]) SetMulti(values []KindKeyValue[T]) error {
+	w, ok := b.s.(MultiKindWriter[any])
+	if !ok {
+		return ErrUnsupported
+	}
+	kvs := make([]KindKeyValue[any], len(values))
+	for i, v := range values {
+		kvs[i] = KindKeyValue[any]{Kind: v.Kind, Key: v.Key, Value: v.Value}
+	}
+	return w.SetMulti(kvs)
+}
+
+// MergeAll merges values on the backend, if it can.
+func (b *boxed[T]) MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error {
+	m := make(map[string]any, len(incoming))
+	for k, v := range incoming {
+		m[k] = v
+	}
+	var fn func(key string, existing, incoming any) any
+	if resolve != nil {
+		fn = func(key string, existing, incoming any) any {
+			return resolve(key, unbox[T](existing), unbox[T](incoming))
+		}
+	}
+	return MergeAll(b.s, kind, m, fn)
+}
+
+func (b *boxed[T]) Delete(kind, key string, opts ...WriteOption) (bool, T, error) {
+	existed, prev, err := b.s.Delete(kind, key, opts...)
+	return existed, unbox[T](prev), err
+}
+
+// SetLabeled labels the key on the backend, if it can.
+func (b *boxed[T]) SetLabeled(kind, key string, value T, labels map[string]string) (bool, error) {
+	return SetLabeled[any](b.s, kind, key, value, labels)
+}
+
+// Swap exchanges two values on the backend, if it can.
+func (b *boxed[T]) Swap(kind, keyA, keyB string) error {
+	return Swap(b.s, kind, keyA, keyB)
+}
+
+// Versions returns the key versions of the backend, if it reports them.
+func (b *boxed[T]) Versions(kind string) (map[string]int64, error) {
+	v, ok := b.s.(Versioner)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return v.Versions(kind)
+}
+
+// WatcherCount returns the watchers of the backend's store, if it counts
+// them.
+func (b *boxed[T]) WatcherCount() int {
+	return WatcherCountOf(b.s)
+}
+
+// KindWatcherCount returns the watchers of kind on the backend's store,
+// if it counts them.
+func (b *boxed[T]) KindWatcherCount(kind string) int {
+	return KindWatcherCountOf(b.s, kind)
+}
+
+// ExistingKeys reports which keys the backend holds, if it can tell.
+func (b *boxed[T]) ExistingKeys(kind string, keys []string) (map[string]bool, error) {
+	c, ok := b.s.(KeyChecker)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return c.ExistingKeys(kind, keys)
+}
+
+// Sample returns entries the backend picked at random, if it can.
+func (b *boxed[T]) Sample(kind string, n int) ([]KeyValue[T], error) {
+	sm, ok := b.s.(Sampler[any])
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	kvs, err := sm.Sample(kind, n)
+	if err != nil {
+		return nil, err
+	}
+	return unboxKVs[T](kvs), nil
+}
+
+// Codec returns the codec passed to Open, if the backend's store tells
+// it uses one.
+func (b *boxed[T]) Codec() Codec {
+	c := CodecOf(b.s)
+	if bc, ok := c.(codecBox); ok {
+		return bc.unboxed()
+	}
+	return c
+}
+
+// Info reports the backend's Info without WatchSynchronous: events are
+// relayed by a goroutine, which a write waits for instead of the consumer.
+func (b *boxed[T]) Info() Info {
+	if i, ok := b.s.(Introspector); ok {
+		info := i.Info()
+		info.WatchFeatures = slices.DeleteFunc(slices.Clone(info.WatchFeatures), func(f WatchFeature) bool {
+			return f == WatchSynchronous
+		})
+		return info
+	}
+	return Info{}
+}
+
+// CountOlderThan counts old keys of the backend, if it can.
+func (b *boxed[T]) CountOlderThan(kind string, cutoff time.Time) (int, error) {
+	p, ok := b.s.(Pruner)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return p.CountOlderThan(kind, cutoff)
+}
+
+// DeleteOlderThan deletes old keys of the backend, if it can.
+func (b *boxed[T]) DeleteOlderThan(kind string, cutoff time.Time, opts ...WriteOption) (int, error) {
+	p, ok := b.s.(Pruner)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return p.DeleteOlderThan(kind, cutoff, opts...)
+}
+
+// CopyKind copies a kind of the backend, if it can.
+func (b *boxed[T]) CopyKind(srcKind, dstKind string, opts ...WriteOption) (int, error) {
+	m, ok := b.s.(KindMover)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return m.CopyKind(srcKind, dstKind, opts...)
+}
+
+// RenameKind renames a kind of the backend, if it can.
+func (b *boxed[T]) RenameKind(srcKind, dstKind string, opts ...WriteOption) (int, error) {
+	m, ok := b.s.(KindMover)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return m.RenameKind(srcKind, dstKind, opts...)
+}
+
+// SoftDelete trashes a key of the backend, if it can.
+func (b *boxed[T]) SoftDelete(kind, key string) (bool, error) {
+	d, ok := b.s.(SoftDeleter[any])
+	if !ok {
+		return false, ErrUnsupported
+	}
+	return d.SoftDelete(kind, key)
+}
+
+// Restore restores a trashed key of the backend, if it can.
+func (b *boxed[T]) Restore(kind, key string) (bool, error) {
+	d, ok := b.s.(SoftDeleter[any])
+	if !ok {
+		return false, ErrUnsupported
+	}
+	return d.Restore(kind, key)
+}
+
+// ListDeleted lists the trash of the backend, if it can.
+func (b *boxed[T]) ListDeleted(kind string) (map[string]T, error) {
+	d, ok := b.s.(SoftDeleter[any])
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	m, err := d.ListDeleted(kind)
+	return unboxMap[T](m), err
+}
+
+// PurgeDeleted empties the trash of the backend, if it can.
+func (b *boxed[T]) PurgeDeleted(kind string, cutoff time.Time) (int, error) {
+	d, ok := b.s.(SoftDeleter[any])
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return d.PurgeDeleted(kind, cutoff)
+}
+
+// FilterStream streams a kind of the backend, if it can.
+func (b *boxed[T]) FilterStream(kind string, filter FilterFunc[T], fn func(key string, val T) error) error {
+	fs, ok := b.s.(FilterStreamer[any])
+	if !ok {
+		return ErrUnsupported
+	}
+	var f FilterFunc[any]
+	if filter != nil {
+		f = func(key string, v any) bool { return filter(key, unbox[T](v)) }
+	}
+	return fs.FilterStream(kind, f, func(key string, v any) error { return fn(key, unbox[T](v)) })
+}
+
+// ListWhere filters a kind of the backend, if it can.
+func (b *boxed[T]) ListWhere(kind string, f Filter) (map[string]T, error) {
+	q, ok := b.s.(FilterQuerier[any])
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	m, err := q.ListWhere(kind, f)
+	return unboxMap[T](m), err
+}
+
+// CountWhere counts filtered values of the backend, if it can.
+func (b *boxed[T]) CountWhere(kind string, f Filter) (int, error) {
+	q, ok := b.s.(FilterQuerier[any])
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return q.CountWhere(kind, f)
+}
+
+// DeleteWhere deletes filtered values of the backend, if it can.
+func (b *boxed[T]) DeleteWhere(kind string, f Filter, opts ...WriteOption) (int, error) {
+	q, ok := b.s.(FilterQuerier[any])
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return q.DeleteWhere(kind, f, opts...)
+}
+
+func (b *boxed[T]) Add(kind string, value T) (string, error) {
+	return Add[any](b.s, kind, value)
+}
+
+// watchOpts turns watch options for T into ones for the boxed store. It
+// refuses WithSynchronous, which the relay of events defeats.
+func (b *boxed[T]) watchOpts(opts []WatchOption[T]) (WatchOption[any], error) {
+	var cfg WatchCfg[T]
+	for _, o := range opts {
+		if o != nil {
+			o(&cfg)
+		}
+	}
+	if cfg.Synchronous {
+		return nil, &UnsupportedOptionError{Option: WatchSynchronous, Backend: b.Info().Backend}
+	}
+	return func(w *WatchCfg[any]) {
+		w.Initial = cfg.Initial
+		w.EventTypes = cfg.EventTypes
+		w.BufferSize = cfg.BufferSize
+		w.Keys = cfg.Keys
+		w.EvictAfterDrops = cfg.EvictAfterDrops
+		w.History = cfg.History
+		w.ReplayLast = cfg.ReplayLast
+		w.MinVersions = cfg.MinVersions
+		w.Require = cfg.Require
+		w.RequireAll = cfg.RequireAll
+		w.Saturation = cfg.Saturation
+		if cfg.Transition != nil {
+			w.Transition = func(old, new any) bool {
+				return cfg.Transition(unbox[T](old), unbox[T](new))
+			}
+		}
+	}, nil
+}
+
+// forward relays the events of in as events of T until in closes or the
+// returned cancel, which also calls cancel, is called. The relay holds
+// one event at a time, so a slow consumer fills in's buffer as it would
+// the store's own channel.
+func forward[T any](in <-chan *Event[any], cancel func()) (<-chan *Event[T], func()) {
+	out := make(chan *Event[T])
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		for ev := range in {
+			select {
+			case out <- unboxEvent[T](ev):
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			close(done)
+			cancel()
+		})
+	}
+}
+
+func (b *boxed[T]) Watch(kind string, opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	o, err := b.watchOpts(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, cancel, err := b.s.Watch(kind, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, stop := forward[T](ch, cancel)
+	return out, stop, nil
+}
+
+func (b *boxed[T]) WatchH(kind string, opts ...WatchOption[T]) (*WatchHandle[T], error) {
+	o, err := b.watchOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	h, err := WatchH(b.s, kind, o)
+	if err != nil {
+		return nil, err
+	}
+	out, stop := forward[T](h.C, h.Cancel)
+	return &WatchHandle[T]{C: out, Cancel: stop, AddKey: h.AddKey, RemoveKey: h.RemoveKey, Stats: h.Stats}, nil
+}
+
+func (b *boxed[T]) WatchKinds(kinds []string, opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	o, err := b.watchOpts(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, cancel, err := WatchKinds(b.s, kinds, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, stop := forward[T](ch, cancel)
+	return out, stop, nil
+}
+
+func (b *boxed[T]) WatchAll(opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	o, err := b.watchOpts(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, cancel, err := WatchAll(b.s, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, stop := forward[T](ch, cancel)
+	return out, stop, nil
+}
+
+// Snapshot returns a view of kind on a snapshot of the backend, if it can
+// take one.
+func (b *boxed[T]) Snapshot(kind string) (Reader[T], func(), error) {
+	view, release, err := Snapshot[any](b.s, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	return boxedReader[T]{view}, release, nil
+}
+
+func (b *boxed[T]) Close() error {
+	return b.s.Close()
+}
+
+func (b *boxed[T]) Dump() string {
+	return b.s.Dump()
+}
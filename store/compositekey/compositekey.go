@@ -0,0 +1,67 @@
+// Package compositekey builds store keys out of several parts, e.g. tenant,
+// project and name, so hierarchical keys are formed the same way everywhere
+// and can be queried by prefix.
+//
+// Parts are joined with Sep. A part may contain any character: '%' and Sep
+// are percent-escaped, so an encoded part never contains Sep and
+// Decode(Encode(parts...)) returns the parts unchanged, but for a single
+// empty part (see Decode).
+//
+//	key := compositekey.Encode("acme", "web", "config")  // "acme/web/config"
+//	m, _ := store.ListPrefix(s, "settings", compositekey.Prefix("acme"))
+//	projects, _ := store.KeySegments(s, "settings", compositekey.Sep, compositekey.Prefix("acme"))
+package compositekey
+
+import "strings"
+
+// Sep separates the parts of an encoded key. Pass it as the separator of
+// store.KeySegments.
+const Sep = "/"
+
+var (
+	escaper   = strings.NewReplacer("%", "%25", Sep, "%2F")
+	unescaper = strings.NewReplacer("%2F", Sep, "%2f", Sep, "%25", "%")
+)
+
+// Encode joins parts into one key.
+func Encode(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = escaper.Replace(p)
+	}
+	return strings.Join(escaped, Sep)
+}
+
+// Decode splits a key built by Encode back into its parts. Escapes it
+// doesn't know are kept as they are. The empty key decodes to no parts, as
+// Encode() returns it; Encode("") returns it too, so a single empty part
+// doesn't round-trip.
+func Decode(key string) []string {
+	if key == "" {
+		return []string{}
+	}
+	parts := strings.Split(key, Sep)
+	for i, p := range parts {
+		parts[i] = unescaper.Replace(p)
+	}
+	return parts
+}
+
+// Prefix returns the prefix shared by every key whose leading parts are
+// parts, for ListPrefix and KeySegments. It ends with Sep, so
+// Prefix("a") matches "a/b" but not "ab/c". Prefix() is "", matching all
+// keys.
+func Prefix(parts ...string) string {
+	if len(parts) == 0 {
+		return ""
+	}
+	return Encode(parts...) + Sep
+}
+
+// Segment decodes a segment returned by KeySegments with Sep as the
+// separator. more reports whether the segment continues into deeper parts
+// (it ended with Sep) rather than being the last part of a key.
+func Segment(seg string) (part string, more bool) {
+	seg, more = strings.CutSuffix(seg, Sep)
+	return unescaper.Replace(seg), more
+}
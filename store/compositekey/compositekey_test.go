@@ -0,0 +1,71 @@
+package compositekey
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"a"},
+		{"acme", "web", "config"},
+		{"a/b", "c"},
+		{"100%", "%2F", "/"},
+		{"", "x", ""},
+		{"ünï", "ç/ø"},
+	}
+	for _, parts := range tests {
+		key := Encode(parts...)
+		if got := Decode(key); !reflect.DeepEqual(got, parts) {
+			t.Errorf("Decode(Encode(%q)) = %q (key %q)", parts, got, key)
+		}
+		if len(parts) > 0 && strings.Count(key, Sep) != len(parts)-1 {
+			t.Errorf("Encode(%q) = %q has escaped separators", parts, key)
+		}
+	}
+}
+
+func TestPrefixQueries(t *testing.T) {
+	s := gomap.NewMemStore[int](store.StoreOptions[int]{})
+	defer s.Close()
+	for i, parts := range [][]string{
+		{"acme", "web", "a"},
+		{"acme", "web/api", "b"},
+		{"acme", "db"},
+		{"acme2", "web", "c"},
+		{"acme/web", "d"},
+	} {
+		s.Set("k", Encode(parts...), i)
+	}
+
+	m, _ := store.ListPrefix(s, "k", Prefix("acme"))
+	if len(m) != 3 {
+		t.Errorf("ListPrefix(acme) = %v, want 3 keys", m)
+	}
+	m, _ = store.ListPrefix(s, "k", Prefix("acme", "web"))
+	if len(m) != 1 {
+		t.Errorf("ListPrefix(acme, web) = %v, want 1 key", m)
+	}
+
+	segs, _ := store.KeySegments(s, "k", Sep, Prefix("acme"))
+	var got []string
+	for _, seg := range segs {
+		part, more := Segment(seg)
+		if more {
+			part += "..."
+		}
+		got = append(got, part)
+	}
+	if want := []string{"db", "web/api...", "web..."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("segments = %q, want %q", got, want)
+	}
+
+	if Prefix() != "" {
+		t.Errorf("Prefix() = %q", Prefix())
+	}
+}
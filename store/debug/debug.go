@@ -0,0 +1,287 @@
+// Package debug serves the internals of a store as JSON, for a debug
+// endpoint next to net/http/pprof's:
+//
+//	s, err := debug.Wrap(users, debug.Options{Events: 20})
+//	http.Handle("/debug/zestor", debug.Handler[User](s))
+//
+// The handler reports what the store tells through the optional
+// interfaces of package store: its Info and codec (store.Introspector),
+// its watchers (store.WatchCounter), and the connection pool of a sqlite
+// store. A store wrapped with Wrap adds the errors of each operation, the
+// recent events of each kind and the saturation episodes of its watchers.
+// Values are left out unless the handler is built with WithValues.
+package debug
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// Options configures Wrap.
+type Options struct {
+	// Events is how many recent events of each kind the Store keeps for
+	// the handler; 0 keeps none. Keeping them takes a WatchAll watcher,
+	// which the store's watcher counts include.
+	Events int
+}
+
+// Store is a store.Store that counts the errors of its methods by
+// operation and the alerts of watches made WithSaturationAlert, and keeps
+// the recent events of each kind, for Handler. Every method passes through
+// to the wrapped store.
+type Store[T any] struct {
+	store.Store[T]
+	o Options
+
+	mu     sync.Mutex
+	errs   map[string]int64
+	events map[string][]*store.Event[T]
+	// saturation episodes alerted, across watchers
+	saturations atomic.Int64
+	// cancels the watch recording events, nil without Options.Events
+	cancel func()
+}
+
+// Wrap returns s with error counts and, with Options.Events, the recent
+// events of each kind.
+func Wrap[T any](s store.Store[T], o Options) (*Store[T], error) {
+	d := &Store[T]{
+		Store:  s,
+		o:      o,
+		errs:   make(map[string]int64),
+		events: make(map[string][]*store.Event[T]),
+	}
+	if o.Events > 0 {
+		ch, cancel, err := store.WatchAll(s)
+		if err != nil {
+			return nil, err
+		}
+		d.cancel = cancel
+		go d.record(ch)
+	}
+	return d, nil
+}
+
+// record keeps the last Options.Events events of each kind from ch.
+func (d *Store[T]) record(ch <-chan *store.Event[T]) {
+	for ev := range ch {
+		d.mu.Lock()
+		evs := append(d.events[ev.Kind], ev)
+		if len(evs) > d.o.Events {
+			evs = evs[len(evs)-d.o.Events:]
+		}
+		d.events[ev.Kind] = evs
+		d.mu.Unlock()
+	}
+}
+
+// count records err, if any, as an error of op.
+func (d *Store[T]) count(op string, err error) {
+	if err == nil {
+		return
+	}
+	d.mu.Lock()
+	d.errs[op]++
+	d.mu.Unlock()
+}
+
+// Errors returns how many calls of each operation failed, by method name.
+func (d *Store[T]) Errors() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]int64, len(d.errs))
+	for op, n := range d.errs {
+		out[op] = n
+	}
+	return out
+}
+
+// Saturations returns how many saturation episodes the watchers made
+// through d with store.WithSaturationAlert were alerted of.
+func (d *Store[T]) Saturations() int64 {
+	return d.saturations.Load()
+}
+
+// countSaturations returns opts with their WithSaturationAlert callback,
+// if any, counting its alerts.
+func (d *Store[T]) countSaturations(opts []store.WatchOption[T]) []store.WatchOption[T] {
+	var cfg store.WatchCfg[T]
+	for _, o := range opts {
+		o(&cfg)
+	}
+	a := cfg.Saturation
+	if a == nil || a.Fn == nil {
+		return opts
+	}
+	return append(opts[:len(opts):len(opts)], store.WithSaturationAlert[T](a.Threshold, a.Sustained, func(info store.WatcherInfo) {
+		d.saturations.Add(1)
+		a.Fn(info)
+	}))
+}
+
+func (d *Store[T]) Watch(kind string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	return d.Store.Watch(kind, d.countSaturations(opts)...)
+}
+
+func (d *Store[T]) WatchH(kind string, opts ...store.WatchOption[T]) (*store.WatchHandle[T], error) {
+	return store.WatchH(d.Store, kind, d.countSaturations(opts)...)
+}
+
+func (d *Store[T]) WatchKinds(kinds []string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	return store.WatchKinds(d.Store, kinds, d.countSaturations(opts)...)
+}
+
+func (d *Store[T]) WatchAll(opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	return store.WatchAll(d.Store, d.countSaturations(opts)...)
+}
+
+// Events returns the recent events of kind, oldest first.
+func (d *Store[T]) Events(kind string) []*store.Event[T] {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*store.Event[T](nil), d.events[kind]...)
+}
+
+// Close stops recording events and closes the wrapped store.
+func (d *Store[T]) Close() error {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	return d.Store.Close()
+}
+
+// Codec returns the codec of the wrapped store.
+func (d *Store[T]) Codec() store.Codec {
+	return store.CodecOf(d.Store)
+}
+
+// Info describes the wrapped store, seen through "debug".
+func (d *Store[T]) Info() store.Info {
+	return store.WrappedInfo(d.Store, "debug")
+}
+
+// WatcherCount returns the watchers of the wrapped store.
+func (d *Store[T]) WatcherCount() int {
+	return store.WatcherCountOf(d.Store)
+}
+
+// KindWatcherCount returns the watchers of kind on the wrapped store.
+func (d *Store[T]) KindWatcherCount(kind string) int {
+	return store.KindWatcherCountOf(d.Store, kind)
+}
+
+func (d *Store[T]) Get(kind, key string) (T, bool, error) {
+	v, ok, err := d.Store.Get(kind, key)
+	d.count("Get", err)
+	return v, ok, err
+}
+
+func (d *Store[T]) List(kind string, filter ...store.FilterFunc[T]) (map[string]T, error) {
+	m, err := d.Store.List(kind, filter...)
+	d.count("List", err)
+	return m, err
+}
+
+func (d *Store[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	m, err := store.ListPrefix(d.Store, kind, prefix)
+	d.count("ListPrefix", err)
+	return m, err
+}
+
+func (d *Store[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	segs, err := store.KeySegments(d.Store, kind, separator, prefix)
+	d.count("KeySegments", err)
+	return segs, err
+}
+
+func (d *Store[T]) Count(kind string) (int, error) {
+	n, err := d.Store.Count(kind)
+	d.count("Count", err)
+	return n, err
+}
+
+func (d *Store[T]) Kinds() ([]string, error) {
+	kinds, err := store.Kinds(d.Store)
+	d.count("Kinds", err)
+	return kinds, err
+}
+
+func (d *Store[T]) Keys(kind string) ([]string, error) {
+	keys, err := d.Store.Keys(kind)
+	d.count("Keys", err)
+	return keys, err
+}
+
+func (d *Store[T]) Values(kind string) ([]store.KeyValue[T], error) {
+	kvs, err := d.Store.Values(kind)
+	d.count("Values", err)
+	return kvs, err
+}
+
+func (d *Store[T]) GetAll() (map[string]map[string]T, error) {
+	m, err := d.Store.GetAll()
+	d.count("GetAll", err)
+	return m, err
+}
+
+func (d *Store[T]) SelectByLabel(kind string, selector map[string]string) ([]store.KeyValue[T], error) {
+	kvs, err := store.SelectByLabel(d.Store, kind, selector)
+	d.count("SelectByLabel", err)
+	return kvs, err
+}
+
+func (d *Store[T]) Set(kind, key string, value T, opts ...store.WriteOption) (bool, error) {
+	created, err := d.Store.Set(kind, key, value, opts...)
+	d.count("Set", err)
+	return created, err
+}
+
+func (d *Store[T]) SetFn(kind, key string, fn func(v T) (T, error), opts ...store.WriteOption) (bool, error) {
+	changed, err := d.Store.SetFn(kind, key, fn, opts...)
+	d.count("SetFn", err)
+	return changed, err
+}
+
+func (d *Store[T]) SetAll(kind string, values map[string]T, opts ...store.WriteOption) error {
+	err := d.Store.SetAll(kind, values, opts...)
+	d.count("SetAll", err)
+	return err
+}
+
+func (d *Store[T]) SetAllOrdered(kind string, values []store.KeyValue[T]) error {
+	err := store.SetAllOrdered(d.Store, kind, values)
+	d.count("SetAllOrdered", err)
+	return err
+}
+
+func (d *Store[T]) MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error {
+	err := store.MergeAll(d.Store, kind, incoming, resolve)
+	d.count("MergeAll", err)
+	return err
+}
+
+func (d *Store[T]) Delete(kind, key string, opts ...store.WriteOption) (bool, T, error) {
+	existed, prev, err := d.Store.Delete(kind, key, opts...)
+	d.count("Delete", err)
+	return existed, prev, err
+}
+
+func (d *Store[T]) SetLabeled(kind, key string, value T, labels map[string]string) (bool, error) {
+	created, err := store.SetLabeled(d.Store, kind, key, value, labels)
+	d.count("SetLabeled", err)
+	return created, err
+}
+
+func (d *Store[T]) Swap(kind, keyA, keyB string) error {
+	err := store.Swap(d.Store, kind, keyA, keyB)
+	d.count("Swap", err)
+	return err
+}
+
+func (d *Store[T]) Add(kind string, value T) (string, error) {
+	key, err := store.Add(d.Store, kind, value)
+	d.count("Add", err)
+	return key, err
+}
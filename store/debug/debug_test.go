@@ -0,0 +1,145 @@
+package debug
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+type account struct {
+	Owner    string
+	Password string
+}
+
+// get serves a GET of h and decodes the report.
+func get(t *testing.T, h http.Handler) (*Report, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/zestor", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET = %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	body := rec.Body.String()
+	var rep Report
+	if err := json.Unmarshal([]byte(body), &rep); err != nil {
+		t.Fatal(err)
+	}
+	return &rep, body
+}
+
+func TestHandler(t *testing.T) {
+	s, err := Wrap(gomap.NewMemStore(store.StoreOptions[account]{AllowedKinds: []string{"accounts", "audit"}}), Options{Events: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, cancel, _ := s.Watch("accounts")
+	defer cancel()
+
+	for _, key := range []string{"alice", "bob", "carol"} {
+		if _, err := s.Set("accounts", key, account{Owner: key, Password: "hunter2"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Set("audit", "x", account{Owner: "root"})
+	if _, err := s.Set("other", "x", account{}); err == nil {
+		t.Fatal("expected an error for a kind that isn't allowed")
+	}
+	s.SetFn("accounts", "alice", func(a account) (account, error) { return a, errors.New("nope") })
+	for deadline := time.Now().Add(5 * time.Second); len(s.Events("accounts")) < 2 || len(s.Events("audit")) < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("events not recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rep, body := get(t, Handler[account](s))
+	if rep.Info == nil || rep.Info.Backend != "gomap" || len(rep.Info.Wrappers) != 1 || rep.Info.Wrappers[0] != "debug" {
+		t.Errorf("info = %+v", rep.Info)
+	}
+	// the watcher above and the one recording events
+	if rep.Watchers == nil || *rep.Watchers != 2 {
+		t.Errorf("watchers = %v, want 2", rep.Watchers)
+	}
+	if rep.Errors["Set"] != 1 || rep.Errors["SetFn"] != 1 {
+		t.Errorf("errors = %v", rep.Errors)
+	}
+	acc := rep.Kinds["accounts"]
+	if acc.Count != 3 || acc.Watchers == nil || *acc.Watchers != 2 {
+		t.Errorf("accounts = %+v", acc)
+	}
+	if len(acc.Events) != 2 || acc.Events[0].Key != "bob" || acc.Events[1].Key != "carol" || acc.Events[1].Type != store.EventTypeCreate {
+		t.Errorf("accounts events = %+v, want the last two creates", acc.Events)
+	}
+	if rep.Kinds["audit"].Count != 1 {
+		t.Errorf("audit = %+v", rep.Kinds["audit"])
+	}
+
+	// values are redacted unless asked for
+	if strings.Contains(body, "hunter2") || acc.Events[1].Value != nil {
+		t.Errorf("values leaked into the default report: %s", body)
+	}
+	_, body = get(t, Handler[account](s, WithValues()))
+	if !strings.Contains(body, "hunter2") {
+		t.Errorf("expected values WithValues: %s", body)
+	}
+
+	rec := httptest.NewRecorder()
+	Handler[account](s).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/zestor", io.NopCloser(strings.NewReader(""))))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", rec.Code)
+	}
+}
+
+func TestHandlerUnwrapped(t *testing.T) {
+	ms := gomap.NewMemStore(store.StoreOptions[account]{})
+	defer ms.Close()
+	ms.Set("accounts", "alice", account{Password: "hunter2"})
+
+	rep, body := get(t, Handler(ms))
+	if rep.Errors != nil || rep.Kinds["accounts"].Count != 1 || rep.Kinds["accounts"].Events != nil {
+		t.Errorf("report = %s", body)
+	}
+	for _, field := range []string{`"errors"`, `"events"`, `"pool"`} {
+		if strings.Contains(body, field) {
+			t.Errorf("unexpected %s in %s", field, body)
+		}
+	}
+}
+
+func TestSaturations(t *testing.T) {
+	s, err := Wrap(gomap.NewMemStore(store.StoreOptions[account]{}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	alerts := make(chan store.WatcherInfo, 1)
+	_, cancel, err := s.Watch("accounts", store.WithBufferSize[account](2),
+		store.WithSaturationAlert[account](1, 0, func(info store.WatcherInfo) { alerts <- info }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	for _, owner := range []string{"alice", "bob", "carol"} {
+		s.Set("accounts", owner, account{Owner: owner})
+	}
+	select {
+	case <-alerts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert")
+	}
+	if n := s.Saturations(); n != 1 {
+		t.Errorf("Saturations() = %d, want 1", n)
+	}
+	if rep, body := get(t, Handler[account](s)); rep.Saturations != 1 {
+		t.Errorf("report = %s, want saturations 1", body)
+	}
+}
@@ -0,0 +1,153 @@
+package debug
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// HandlerOption configures Handler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	values bool
+}
+
+// WithValues includes the values of the recent events in the report.
+// They are left out by default, since they may hold personal data or
+// secrets.
+func WithValues() HandlerOption {
+	return func(c *handlerConfig) { c.values = true }
+}
+
+// Report is the JSON document Handler serves. Sections a store can't fill
+// are left out.
+type Report struct {
+	Info  *InfoReport `json:"info,omitempty"`
+	Codec string      `json:"codec,omitempty"`
+	// Watchers counts the watchers of the store (store.WatchCounter).
+	Watchers *int                  `json:"watchers,omitempty"`
+	Kinds    map[string]KindReport `json:"kinds"`
+	// Errors counts the failed calls by operation, for a Store from Wrap.
+	Errors map[string]int64 `json:"errors,omitempty"`
+	// Saturations counts the saturation episodes alerted to the watchers
+	// of a Store from Wrap (store.WithSaturationAlert).
+	Saturations int64 `json:"saturations,omitempty"`
+	// Pool holds the connection pool statistics of a sqlite store.
+	Pool *sql.DBStats `json:"pool,omitempty"`
+}
+
+// InfoReport is the store.Info of a store.
+type InfoReport struct {
+	Backend  string   `json:"backend"`
+	Location string   `json:"location,omitempty"`
+	Table    string   `json:"table,omitempty"`
+	Features []string `json:"features"`
+	Wrappers []string `json:"wrappers"`
+}
+
+// KindReport describes one kind.
+type KindReport struct {
+	Count    int           `json:"count"`
+	Watchers *int          `json:"watchers,omitempty"`
+	Events   []EventReport `json:"events,omitempty"`
+}
+
+// EventReport is a recent event. Value is only set WithValues.
+type EventReport struct {
+	Type    store.EventType `json:"type"`
+	Key     string          `json:"key"`
+	Version int64           `json:"version"`
+	Seq     uint64          `json:"seq,omitempty"`
+	At      time.Time       `json:"at"`
+	Value   any             `json:"value,omitempty"`
+}
+
+// Handler returns a handler serving the Report of s as JSON on GET, to be
+// mounted under any path, e.g. /debug/zestor. Each request counts the keys
+// of every kind. Wrap s first for error counts and recent events.
+func Handler[T any](s store.Store[T], opts ...HandlerOption) http.Handler {
+	var cfg handlerConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rep, err := report(s, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	})
+}
+
+// report gathers the Report of s.
+func report[T any](s store.Store[T], cfg handlerConfig) (*Report, error) {
+	rep := &Report{Kinds: make(map[string]KindReport)}
+	if in, ok := s.(store.Introspector); ok {
+		info := in.Info()
+		rep.Info = &InfoReport{
+			Backend:  info.Backend,
+			Location: info.Location,
+			Table:    info.Table,
+			Features: append([]string{}, info.Features...),
+			Wrappers: append([]string{}, info.Wrappers...),
+		}
+		if c := in.Codec(); c != nil {
+			rep.Codec = fmt.Sprintf("%T", c)
+		}
+	}
+	wc, counts := s.(store.WatchCounter)
+	if counts {
+		n := wc.WatcherCount()
+		rep.Watchers = &n
+	}
+	d, wrapped := s.(*Store[T])
+	if wrapped {
+		rep.Errors = d.Errors()
+		rep.Saturations = d.Saturations()
+	}
+	if p, ok := s.(interface{ DBStats() sql.DBStats }); ok {
+		st := p.DBStats()
+		rep.Pool = &st
+	}
+
+	kinds, err := store.Kinds(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range kinds {
+		n, err := s.Count(kind)
+		if err != nil {
+			return nil, err
+		}
+		kr := KindReport{Count: n}
+		if counts {
+			n := wc.KindWatcherCount(kind)
+			kr.Watchers = &n
+		}
+		if wrapped {
+			for _, ev := range d.Events(kind) {
+				er := EventReport{Type: ev.EventType, Key: ev.Name, Version: ev.Version, Seq: ev.Seq, At: ev.At}
+				if cfg.values {
+					er.Value = ev.Object
+				}
+				kr.Events = append(kr.Events, er)
+			}
+		}
+		rep.Kinds[kind] = kr
+	}
+	return rep, nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The backends accept any string as a key. Integrations that put keys
+// where some characters have a meaning of their own escape them with
+// EscapeKey first:
+//
+//   - URL paths: '/' separates segments, '?' and '#' end the path, '%'
+//     starts an escape, and "." or ".." segments are resolved away.
+//   - file names: '/' and '\' separate directories, ':', '*', '"', '<',
+//     '>' and '|' are not allowed on Windows, control characters nowhere,
+//     and a leading '.' hides the file (or names "." and "..").
+//   - command lines: a leading '-' reads as a flag.
+//
+// Escaped keys are case-sensitive like the keys they encode, so two keys
+// that differ only in case still collide on a case-insensitive file system.
+
+// EscapeKey percent-encodes the bytes of key that are unsafe in a URL path
+// segment, a file name or a command-line argument: '%', '/', '\', '?',
+// '#', ':', '*', '"', '<', '>', '|', control characters, bytes that are not
+// valid UTF-8, and a leading '.' or '-'. Other characters, including
+// non-ASCII letters, are kept, so plain keys read the same escaped.
+// UnescapeKey(EscapeKey(key)) == key for every key.
+func EscapeKey(key string) string {
+	var b strings.Builder
+	copied := 0 // key[:copied] is in b
+	for i := 0; i < len(key); {
+		r, size := utf8.DecodeRuneInString(key[i:])
+		if size == 1 && (r == utf8.RuneError || unsafeKeyByte(key[i], i == 0)) {
+			if copied == 0 {
+				b.Grow(len(key) + 8)
+			}
+			b.WriteString(key[copied:i])
+			fmt.Fprintf(&b, "%%%02X", key[i])
+			copied = i + 1
+		}
+		i += size
+	}
+	if copied == 0 {
+		return key
+	}
+	b.WriteString(key[copied:])
+	return b.String()
+}
+
+// unsafeKeyByte reports whether EscapeKey encodes the ASCII byte c, first
+// when it starts the key.
+func unsafeKeyByte(c byte, first bool) bool {
+	if c < 0x20 || c == 0x7f {
+		return true
+	}
+	switch c {
+	case '%', '/', '\\', '?', '#', ':', '*', '"', '<', '>', '|':
+		return true
+	case '.', '-':
+		return first
+	}
+	return false
+}
+
+// UnescapeKey decodes a key escaped by EscapeKey. It accepts lower-case
+// hex digits and escapes of characters EscapeKey keeps, and returns an
+// error if a '%' is not followed by two hex digits.
+func UnescapeKey(escaped string) (string, error) {
+	i := strings.IndexByte(escaped, '%')
+	if i < 0 {
+		return escaped, nil
+	}
+	var b strings.Builder
+	b.Grow(len(escaped))
+	b.WriteString(escaped[:i])
+	for ; i < len(escaped); i++ {
+		if escaped[i] != '%' {
+			b.WriteByte(escaped[i])
+			continue
+		}
+		if i+2 >= len(escaped) || !isHex(escaped[i+1]) || !isHex(escaped[i+2]) {
+			return "", fmt.Errorf("unescape key %q: bad escape at offset %d", escaped, i)
+		}
+		b.WriteByte(unhex(escaped[i+1])<<4 | unhex(escaped[i+2]))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	default:
+		return c - 'a' + 10
+	}
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+)
+
+func TestEscapeKey(t *testing.T) {
+	tests := []struct{ key, want string }{
+		{"plain-key_1.json", "plain-key_1.json"},
+		{"", ""},
+		{"ünïcödé", "ünïcödé"},
+		{"a/b", "a%2Fb"},
+		{"100%", "100%25"},
+		{"%2F", "%252F"},
+		{".hidden", "%2Ehidden"},
+		{"..", "%2E."},
+		{"-rf", "%2Drf"},
+		{"a.b-c", "a.b-c"},
+		{`C:\dir`, "C%3A%5Cdir"},
+		{"q?x#y", "q%3Fx%23y"},
+		{"tab\there", "tab%09here"},
+		{"\xff\xfe", "%FF%FE"},
+	}
+	for _, tt := range tests {
+		if got := EscapeKey(tt.key); got != tt.want {
+			t.Errorf("EscapeKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if got, err := UnescapeKey(tt.want); err != nil || got != tt.key {
+			t.Errorf("UnescapeKey(%q) = %q, %v, want %q", tt.want, got, err, tt.key)
+		}
+	}
+}
+
+func TestUnescapeKey(t *testing.T) {
+	if got, err := UnescapeKey("a%2fb%41"); err != nil || got != "a/bA" {
+		t.Errorf("lower-case and unneeded escapes: got %q, %v", got, err)
+	}
+	for _, bad := range []string{"%", "a%2", "%zz", "%2G"} {
+		if _, err := UnescapeKey(bad); err == nil {
+			t.Errorf("UnescapeKey(%q) succeeded", bad)
+		}
+	}
+}
+
+// checkEscaped reports whether escaped is safe in every integration:
+// valid UTF-8, no reserved or control characters, no leading '.' or '-'.
+func checkEscaped(escaped string) bool {
+	if !utf8.ValidString(escaped) || strings.ContainsAny(escaped, `/\?#:*"<>|`) {
+		return false
+	}
+	if strings.HasPrefix(escaped, ".") || strings.HasPrefix(escaped, "-") {
+		return false
+	}
+	for _, r := range escaped {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	// every '%' starts an escape
+	_, err := UnescapeKey(escaped)
+	return err == nil
+}
+
+func TestEscapeKeyProperties(t *testing.T) {
+	roundTrip := func(key string) bool {
+		got, err := UnescapeKey(EscapeKey(key))
+		return err == nil && got == key
+	}
+	safe := func(key string) bool {
+		return checkEscaped(EscapeKey(key))
+	}
+	// keys built from the characters that need care, arbitrary bytes
+	// included, rather than the random runes quick picks on its own
+	const alphabet = "./-%\\:?#*\"<>|\t\x00\x7f\xffaZ9_ é世🙂"
+	mixed := func(picks []uint8) bool {
+		var b strings.Builder
+		for _, p := range picks {
+			b.WriteByte(alphabet[int(p)%len(alphabet)])
+		}
+		return roundTrip(b.String()) && safe(b.String())
+	}
+	cfg := &quick.Config{MaxCount: 2000}
+	for name, f := range map[string]any{"round trip": roundTrip, "safe": safe, "mixed": mixed} {
+		if err := quick.Check(f, cfg); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func FuzzEscapeKey(f *testing.F) {
+	for _, seed := range []string{"", "a/b", ".", "..", "-x", "%", "%2F", "\xff", "é/世"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, key string) {
+		escaped := EscapeKey(key)
+		if got, err := UnescapeKey(escaped); err != nil || got != key {
+			t.Fatalf("UnescapeKey(EscapeKey(%q)) = %q, %v", key, got, err)
+		}
+		if !checkEscaped(escaped) {
+			t.Fatalf("EscapeKey(%q) = %q is not safe", key, escaped)
+		}
+	})
+}
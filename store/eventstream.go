@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// eventLine is one line of StreamEvents for an event.
+type eventLine[T any] struct {
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Type        EventType `json:"type"`
+	Value       T         `json:"value"`
+	PrevOmitted bool      `json:"prev_omitted,omitempty"`
+	At          time.Time `json:"at"`
+	Seq         uint64    `json:"seq,omitempty"`
+	Version     int64     `json:"version,omitempty"`
+}
+
+// dropLine is the line StreamEvents writes for events the watch dropped.
+type dropLine struct {
+	Dropped int64 `json:"dropped"`
+}
+
+// StreamEvents watches kind of s and writes each event to w as one line
+// of JSON (NDJSON), for piping into tools such as jq:
+//
+//	{"kind":"notes","key":"a","type":"create","value":{...},"at":"...","version":1}
+//
+// After each line it flushes w if w has a Flush method, as
+// http.ResponseWriter and bufio.Writer do. When events were dropped
+// because w fell behind the watch buffer (WithBufferSize), a line such as
+// {"dropped":3} follows the next event, or ends the stream, with the
+// number lost since the last report.
+//
+// It returns nil once ctx is done or the store closes, and the error of a
+// failed write or encoding otherwise. It needs the drop count of WatchH,
+// so it returns ErrUnsupported if s isn't a HandleWatcher.
+func StreamEvents[T any](ctx context.Context, w io.Writer, s Watcher[T], kind string, opts ...WatchOption[T]) error {
+	h, err := WatchH(s, kind, opts...)
+	if err != nil {
+		return err
+	}
+	defer h.Cancel()
+	enc := json.NewEncoder(w)
+	var dropped int64
+	// reportDrops writes the drops since the last report, if any
+	reportDrops := func() error {
+		n := h.Stats().Dropped
+		if n == dropped {
+			return nil
+		}
+		line := dropLine{Dropped: n - dropped}
+		dropped = n
+		return writeLine(enc, w, line)
+	}
+	for {
+		select {
+		case ev, ok := <-h.C:
+			if !ok {
+				return reportDrops()
+			}
+			line := eventLine[T]{
+				Kind:        ev.Kind,
+				Key:         ev.Name,
+				Type:        ev.EventType,
+				Value:       ev.Object,
+				PrevOmitted: ev.PrevOmitted,
+				At:          ev.At,
+				Seq:         ev.Seq,
+				Version:     ev.Version,
+			}
+			if err := writeLine(enc, w, line); err != nil {
+				return err
+			}
+			if err := reportDrops(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return reportDrops()
+		}
+	}
+}
+
+// writeLine encodes v as one line and flushes w.
+func writeLine(enc *json.Encoder, w io.Writer, v any) error {
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
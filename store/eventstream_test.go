@@ -0,0 +1,110 @@
+package store_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+func TestStreamEvents(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[item]{})
+	defer s.Close()
+	s.Set("items", "seed", item{})
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- store.StreamEvents[item](ctx, pw, s, "items",
+			store.WithInitialReplay[item](), store.WithBufferSize[item](1))
+		pw.Close()
+	}()
+	lines := bufio.NewScanner(pr)
+	next := func() map[string]any {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("stream ended: %v", lines.Err())
+		}
+		var m map[string]any
+		if err := json.Unmarshal(lines.Bytes(), &m); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		return m
+	}
+
+	// the replayed seed shows the subscription is live
+	if m := next(); m["key"] != "seed" || m["type"] != "create" {
+		t.Fatalf("line %v, want the replay of seed", m)
+	}
+	s.Delete("items", "seed")
+	if m := next(); m["type"] != "delete" {
+		t.Fatalf("line %v, want the delete of seed", m)
+	}
+
+	s.Set("items", "a", item{Name: "a", Count: 1})
+	m := next()
+	if m["kind"] != "items" || m["key"] != "a" || m["type"] != "create" || m["version"] != 1.0 {
+		t.Fatalf("line %v", m)
+	}
+	if v := m["value"].(map[string]any); v["name"] != "a" || v["count"] != 1.0 {
+		t.Fatalf("value %v", v)
+	}
+
+	// nothing reads the pipe while these are set, so the stream blocks
+	// and the buffer of 1 overflows; every event is either written or
+	// counted in a drop line
+	for i := 1; i <= 4; i++ {
+		s.Set("items", "b", item{Count: i})
+	}
+	seen, dropped := 0, 0
+	for seen < 4 {
+		m := next()
+		if n, ok := m["dropped"]; ok {
+			dropped += int(n.(float64))
+			seen += int(n.(float64))
+		} else if m["key"] == "b" {
+			seen++
+		} else {
+			t.Fatalf("line %v", m)
+		}
+	}
+	if seen != 4 || dropped < 2 {
+		t.Fatalf("%d events written or dropped, %d of them dropped", seen, dropped)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("StreamEvents after cancel = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StreamEvents still running after cancel")
+	}
+	if lines.Scan() {
+		t.Fatalf("line after cancel: %s", lines.Text())
+	}
+}
+
+func TestStreamEventsStoreClosed(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[item]{})
+	var sb strings.Builder
+	done := make(chan error, 1)
+	go func() { done <- store.StreamEvents[item](context.Background(), &sb, s, "items") }()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("StreamEvents after Close = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StreamEvents still running after the store closed")
+	}
+}
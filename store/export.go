@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// snapshotEntry is one line of an exported snapshot.
+type snapshotEntry struct {
+	Kind  string          `json:"kind"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ProgressFunc is called by the bulk operations as they go, with the
+// number of entries handled so far and an estimate of the total, summed
+// from Count up front. The last call, once the operation completed, has
+// done == total.
+type ProgressFunc func(done, total int64)
+
+// progressInterval is how many entries a bulk operation handles between
+// calls to its ProgressFunc.
+const progressInterval = 1000
+
+// BulkCfg configures ExportContext and DiffContext.
+type BulkCfg struct {
+	Progress ProgressFunc
+}
+
+// BulkOption is a functional option for the bulk operations.
+type BulkOption func(*BulkCfg)
+
+// WithProgress reports the progress of a bulk operation to fn, every
+// thousand entries and once it completed. fn runs on the operation's
+// goroutine, so it should return quickly.
+func WithProgress(fn ProgressFunc) BulkOption {
+	return func(c *BulkCfg) {
+		c.Progress = fn
+	}
+}
+
+// progress tracks a bulk operation for its ProgressFunc and context.
+type progress struct {
+	ctx         context.Context
+	fn          ProgressFunc
+	done, total int64
+}
+
+// newProgress applies opts and, when progress is reported, counts the
+// entries of kinds for the total.
+func newProgress[T any](ctx context.Context, r Reader[T], kinds []string, opts []BulkOption) (*progress, error) {
+	var cfg BulkCfg
+	for _, o := range opts {
+		if o != nil {
+			o(&cfg)
+		}
+	}
+	p := &progress{ctx: ctx, fn: cfg.Progress}
+	if p.fn == nil {
+		return p, nil
+	}
+	for _, kind := range kinds {
+		n, err := r.Count(kind)
+		if err != nil {
+			return nil, err
+		}
+		p.total += int64(n)
+	}
+	p.fn(0, p.total)
+	return p, nil
+}
+
+// step counts one entry and returns the context's error once it is done.
+func (p *progress) step() error {
+	p.done++
+	if p.fn != nil && p.done%progressInterval == 0 {
+		p.fn(p.done, max(p.total, p.done))
+	}
+	return p.ctx.Err()
+}
+
+// finish reports the completed operation.
+func (p *progress) finish() {
+	if p.fn != nil {
+		p.fn(p.done, p.done)
+	}
+}
+
+// Export writes the contents of r to w as a snapshot: one JSON object
+// {"kind", "key", "value"} per line, ordered by kind, then key. Values are
+// encoded with encoding/json. Only one kind's keys are held in memory at a
+// time.
+func Export[T any](r Reader[T], w io.Writer) error {
+	return ExportContext(context.Background(), r, w)
+}
+
+// ExportContext is Export that stops with ctx's error once ctx is done,
+// leaving a partial snapshot in w, and takes options such as WithProgress.
+func ExportContext[T any](ctx context.Context, r Reader[T], w io.Writer, opts ...BulkOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	kinds, err := Kinds(r)
+	if err != nil {
+		return err
+	}
+	sort.Strings(kinds)
+	p, err := newProgress(ctx, r, kinds, opts)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, kind := range kinds {
+		keys, err := r.Keys(kind)
+		if err != nil {
+			return err
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v, ok, err := r.Get(kind, key)
+			if err != nil {
+				return err
+			}
+			if err := p.step(); err != nil {
+				_ = bw.Flush()
+				return err
+			}
+			if !ok {
+				continue // deleted meanwhile
+			}
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("export %s/%s: %w", kind, key, err)
+			}
+			if err := enc.Encode(snapshotEntry{Kind: kind, Key: key, Value: raw}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	p.finish()
+	return nil
+}
+
+// Diff compares a snapshot written by Export with the current contents of
+// r and returns the keys, as "kind/key", that were added since, whose value
+// changed according to eq (nil means DefaultCompareFunc), and that were
+// removed. Each list is ordered by kind, then key.
+//
+// The snapshot is read as a stream and merged with the live keys of one
+// kind at a time, so neither side is loaded in full.
+func Diff[T any](r Reader[T], snapshot io.Reader, eq CompareFunc[T]) (added, changed, removed []string, err error) {
+	return DiffContext(context.Background(), r, snapshot, eq)
+}
+
+// DiffContext is Diff that stops with ctx's error once ctx is done, and
+// takes options such as WithProgress. Progress counts the live keys and
+// the removed ones, so done may end above the estimated total.
+func DiffContext[T any](ctx context.Context, r Reader[T], snapshot io.Reader, eq CompareFunc[T], opts ...BulkOption) (added, changed, removed []string, err error) {
+	if eq == nil {
+		eq = DefaultCompareFunc[T]
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	kinds, err := Kinds(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sort.Strings(kinds)
+	p, err := newProgress(ctx, r, kinds, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var (
+		kind    string // kind being merged
+		started bool
+		live    []string // its live keys, from i on not yet matched
+		i       int
+	)
+	// finish reports the unmatched live keys of the current kind as added,
+	// then every live kind before next that the snapshot doesn't have.
+	finish := func(next string, last bool) error {
+		if started {
+			for ; i < len(live); i++ {
+				added = append(added, kind+"/"+live[i])
+				if err := p.step(); err != nil {
+					return err
+				}
+			}
+		}
+		for len(kinds) > 0 && (last || kinds[0] < next) {
+			k := kinds[0]
+			kinds = kinds[1:]
+			keys, err := r.Keys(k)
+			if err != nil {
+				return err
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				added = append(added, k+"/"+key)
+				if err := p.step(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(snapshot))
+	var prevKey string
+	for {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, fmt.Errorf("read snapshot: %w", err)
+		}
+
+		if !started || e.Kind != kind {
+			if started && e.Kind < kind {
+				return nil, nil, nil, fmt.Errorf("snapshot not ordered: kind %q after %q", e.Kind, kind)
+			}
+			if err := finish(e.Kind, false); err != nil {
+				return nil, nil, nil, err
+			}
+			if len(kinds) > 0 && kinds[0] == e.Kind {
+				kinds = kinds[1:]
+			}
+			kind, started, i, prevKey = e.Kind, true, 0, ""
+			if live, err = r.Keys(kind); err != nil {
+				return nil, nil, nil, err
+			}
+			sort.Strings(live)
+		} else if e.Key <= prevKey {
+			return nil, nil, nil, fmt.Errorf("snapshot not ordered: key %s/%s after %s", kind, e.Key, prevKey)
+		}
+		prevKey = e.Key
+
+		for ; i < len(live) && live[i] < e.Key; i++ {
+			added = append(added, kind+"/"+live[i])
+			if err := p.step(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if err := p.step(); err != nil {
+			return nil, nil, nil, err
+		}
+		if i == len(live) || live[i] != e.Key {
+			removed = append(removed, kind+"/"+e.Key)
+			continue
+		}
+		i++
+		cur, ok, err := r.Get(kind, e.Key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !ok {
+			removed = append(removed, kind+"/"+e.Key)
+			continue
+		}
+		var old T
+		if err := json.Unmarshal(e.Value, &old); err != nil {
+			return nil, nil, nil, fmt.Errorf("snapshot %s/%s: %w", kind, e.Key, err)
+		}
+		if !eq(old, cur) {
+			changed = append(changed, kind+"/"+e.Key)
+		}
+	}
+	if err := finish("", true); err != nil {
+		return nil, nil, nil, err
+	}
+	p.finish()
+	return added, changed, removed, nil
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mapReader serves Kinds, Keys, Count and Get from a map of kinds.
+type mapReader struct {
+	Reader[int]
+	m map[string]map[string]int
+}
+
+func (r *mapReader) Kinds() ([]string, error) {
+	kinds := make([]string, 0, len(r.m))
+	for k, m := range r.m {
+		if len(m) > 0 {
+			kinds = append(kinds, k)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds, nil
+}
+
+func (r *mapReader) Keys(kind string) ([]string, error) {
+	keys := make([]string, 0, len(r.m[kind]))
+	for k := range r.m[kind] {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (r *mapReader) Count(kind string) (int, error) {
+	return len(r.m[kind]), nil
+}
+
+func (r *mapReader) Get(kind, key string) (int, bool, error) {
+	v, ok := r.m[kind][key]
+	return v, ok, nil
+}
+
+func TestExport(t *testing.T) {
+	r := &mapReader{m: map[string]map[string]int{
+		"b": {"y": 2, "x": 1},
+		"a": {"z": 3},
+	}}
+	var buf bytes.Buffer
+	if err := Export[int](r, &buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"kind":"a","key":"z","value":3}
+{"kind":"b","key":"x","value":1}
+{"kind":"b","key":"y","value":2}
+`
+	if buf.String() != want {
+		t.Errorf("Export() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	r := &mapReader{m: map[string]map[string]int{
+		"gone":  {"a": 1},
+		"kept":  {"a": 1, "b": 2, "c": 3, "e": 5},
+		"moved": {"x": 1},
+	}}
+	var snap bytes.Buffer
+	if err := Export[int](r, &snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// no change
+	added, changed, removed, err := Diff[int](r, bytes.NewReader(snap.Bytes()), nil)
+	if err != nil || len(added)+len(changed)+len(removed) != 0 {
+		t.Fatalf("Diff(unchanged) = %v, %v, %v, %v", added, changed, removed, err)
+	}
+
+	r.m = map[string]map[string]int{
+		"aaa":   {"k": 1}, // new kind before every snapshot kind
+		"kept":  {"0": 0, "a": 1, "b": 20, "d": 4, "e": 5, "f": 6},
+		"moved": {"x": 1, "y": 2},
+		"new":   {"k": 1}, // new kind between snapshot kinds
+		"zzz":   {"k": 1}, // new kind after every snapshot kind
+	}
+	added, changed, removed, err = Diff[int](r, bytes.NewReader(snap.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, got []string, want ...string) {
+		t.Helper()
+		if len(got) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	check("added", added, "aaa/k", "kept/0", "kept/d", "kept/f", "moved/y", "new/k", "zzz/k")
+	check("changed", changed, "kept/b")
+	check("removed", removed, "gone/a", "kept/c")
+
+	// a custom compare function decides what counts as changed
+	_, changed, _, _ = Diff[int](r, bytes.NewReader(snap.Bytes()), func(a, b int) bool { return true })
+	check("changed with custom compare", changed)
+}
+
+func TestDiffErrors(t *testing.T) {
+	r := &mapReader{m: map[string]map[string]int{}}
+	for name, snap := range map[string]string{
+		"unordered kinds": `{"kind":"b","key":"x","value":1}` + "\n" + `{"kind":"a","key":"x","value":1}`,
+		"unordered keys":  `{"kind":"a","key":"y","value":1}` + "\n" + `{"kind":"a","key":"x","value":1}`,
+		"malformed":       `{"kind":`,
+		"wrong type":      `{"kind":"a","key":"x","value":"one"}`,
+	} {
+		r.m = map[string]map[string]int{"a": {"x": 1}}
+		if _, _, _, err := Diff[int](r, strings.NewReader(snap), nil); err == nil {
+			t.Errorf("%s: Diff() succeeded", name)
+		}
+	}
+}
+
+func TestBulkProgress(t *testing.T) {
+	m := map[string]int{}
+	for i := 0; i < 2500; i++ {
+		m[fmt.Sprintf("key%05d", i)] = i
+	}
+	r := &mapReader{m: map[string]map[string]int{"a": m, "b": {"x": 1}}}
+
+	var calls [][2]int64
+	record := WithProgress(func(done, total int64) { calls = append(calls, [2]int64{done, total}) })
+	var snap bytes.Buffer
+	if err := ExportContext[int](context.Background(), r, &snap, record); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]int64{{0, 2501}, {1000, 2501}, {2000, 2501}, {2501, 2501}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Export progress = %v, want %v", calls, want)
+	}
+
+	// one key removed from the store since the snapshot, counted on top
+	delete(r.m, "b")
+	calls = nil
+	if _, _, removed, err := DiffContext[int](context.Background(), r, bytes.NewReader(snap.Bytes()), nil, record); err != nil || len(removed) != 1 {
+		t.Fatalf("Diff() removed %v, %v", removed, err)
+	}
+	want = [][2]int64{{0, 2500}, {1000, 2500}, {2000, 2500}, {2501, 2501}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Diff progress = %v, want %v", calls, want)
+	}
+}
+
+func TestBulkCancel(t *testing.T) {
+	m := map[string]int{}
+	for i := 0; i < 2500; i++ {
+		m[fmt.Sprintf("key%05d", i)] = i
+	}
+	r := &mapReader{m: map[string]map[string]int{"a": m}}
+	var snap bytes.Buffer
+	if err := Export[int](r, &snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelled from the progress callback, as a cancel button would
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := WithProgress(func(done, total int64) {
+		if done >= 1000 {
+			cancel()
+		}
+	})
+	var out bytes.Buffer
+	if err := ExportContext[int](ctx, r, &out, stop); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ExportContext() = %v, want context.Canceled", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 999 {
+		t.Errorf("partial snapshot has %d lines, want 999", n)
+	}
+	if _, _, _, err := DiffContext[int](ctx, r, bytes.NewReader(snap.Bytes()), nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("DiffContext() = %v, want context.Canceled", err)
+	}
+}
+
+func BenchmarkDiff(b *testing.B) {
+	m := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		m[fmt.Sprintf("key%05d", i)] = i
+	}
+	r := &mapReader{m: map[string]map[string]int{"k": m}}
+	var snap bytes.Buffer
+	if err := Export[int](r, &snap); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := Diff[int](r, bytes.NewReader(snap.Bytes()), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ErrInvalidFilter is matched by the *FilterError of a Filter that is
+// malformed or that meets a field of another type.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// FilterKeyField is the field of a Filter that names the key rather than
+// a field of the value. A value field called key can't be filtered on.
+const FilterKeyField = "key"
+
+// FilterOp is the operator of a Filter node.
+type FilterOp string
+
+const (
+	FilterOpEq     FilterOp = "eq"
+	FilterOpNe     FilterOp = "ne"
+	FilterOpLt     FilterOp = "lt"
+	FilterOpLte    FilterOp = "lte"
+	FilterOpGt     FilterOp = "gt"
+	FilterOpGte    FilterOp = "gte"
+	FilterOpPrefix FilterOp = "prefix"
+	FilterOpAnd    FilterOp = "and"
+	FilterOpOr     FilterOp = "or"
+	FilterOpNot    FilterOp = "not"
+)
+
+// Filter is a condition on the keys and values of a kind, built with F.
+// Unlike a FilterFunc it is data: it travels as JSON, in the form its
+// struct tags give it,
+//
+//	{"op":"and","args":[{"op":"eq","field":"status","value":"active"},{"op":"prefix","field":"key","value":"2024/"}]}
+//
+// and backends can evaluate it themselves, as the sqlite store does in SQL
+// for JSON values (see FilterQuerier).
+//
+// A comparison reads Field, either FilterKeyField or a dot-separated path
+// of JSON field names into the value ("author.name"), and compares it
+// with Value, a string, number or boolean. Fields are read from the value's
+// JSON encoding, so they are named as encoding/json names them. Strings
+// compare byte-wise, numbers numerically, and booleans only with eq and
+// ne; prefix takes strings. A comparison is false for a value that lacks
+// the field or holds null there, whatever its operator, so ne doesn't
+// match it either. A field holding a value of another type than Value,
+// an object or an array fails the whole evaluation with a *FilterError,
+// even where the rest of the filter would decide without it.
+type Filter struct {
+	Op    FilterOp `json:"op"`
+	Field string   `json:"field,omitempty"`
+	Value any      `json:"value,omitempty"`
+	// the operands of and, or (any number) and not (exactly one)
+	Args []Filter `json:"args,omitempty"`
+}
+
+// F builds Filters:
+//
+//	store.F.And(store.F.Eq("status", "active"), store.F.Gt("priority", 2))
+var F FilterBuilder
+
+// FilterBuilder is the type of F.
+type FilterBuilder struct{}
+
+// Eq matches values whose field equals value.
+func (FilterBuilder) Eq(field string, value any) Filter { return comparison(FilterOpEq, field, value) }
+
+// Ne matches values whose field differs from value.
+func (FilterBuilder) Ne(field string, value any) Filter { return comparison(FilterOpNe, field, value) }
+
+// Lt matches values whose field is less than value.
+func (FilterBuilder) Lt(field string, value any) Filter { return comparison(FilterOpLt, field, value) }
+
+// Lte matches values whose field is less than or equal to value.
+func (FilterBuilder) Lte(field string, value any) Filter {
+	return comparison(FilterOpLte, field, value)
+}
+
+// Gt matches values whose field is greater than value.
+func (FilterBuilder) Gt(field string, value any) Filter { return comparison(FilterOpGt, field, value) }
+
+// Gte matches values whose field is greater than or equal to value.
+func (FilterBuilder) Gte(field string, value any) Filter {
+	return comparison(FilterOpGte, field, value)
+}
+
+// Prefix matches values whose string field starts with prefix.
+func (FilterBuilder) Prefix(field, prefix string) Filter {
+	return comparison(FilterOpPrefix, field, prefix)
+}
+
+// And matches values that every filter matches; with none, every value.
+func (FilterBuilder) And(filters ...Filter) Filter { return Filter{Op: FilterOpAnd, Args: filters} }
+
+// Or matches values that any filter matches; with none, no value.
+func (FilterBuilder) Or(filters ...Filter) Filter { return Filter{Op: FilterOpOr, Args: filters} }
+
+// Not matches values that f doesn't.
+func (FilterBuilder) Not(f Filter) Filter { return Filter{Op: FilterOpNot, Args: []Filter{f}} }
+
+// comparison returns a comparison node, with numbers as float64 like
+// decoded JSON has them, so that a filter equals its wire round trip.
+func comparison(op FilterOp, field string, value any) Filter {
+	switch v := value.(type) {
+	case int:
+		value = float64(v)
+	case int8:
+		value = float64(v)
+	case int16:
+		value = float64(v)
+	case int32:
+		value = float64(v)
+	case int64:
+		value = float64(v)
+	case uint:
+		value = float64(v)
+	case uint8:
+		value = float64(v)
+	case uint16:
+		value = float64(v)
+	case uint32:
+		value = float64(v)
+	case uint64:
+		value = float64(v)
+	case float32:
+		value = float64(v)
+	}
+	return Filter{Op: op, Field: field, Value: value}
+}
+
+// ParseFilter decodes the JSON form of a Filter and validates it.
+func ParseFilter(data []byte) (Filter, error) {
+	var f Filter
+	if err := json.Unmarshal(data, &f); err != nil {
+		return Filter{}, fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	return f, f.Validate()
+}
+
+// String returns f in a compact form for messages, such as
+// and(eq(status, "active"), gt(priority, 2)).
+func (f Filter) String() string {
+	switch f.Op {
+	case FilterOpAnd, FilterOpOr, FilterOpNot:
+		args := make([]string, len(f.Args))
+		for i, a := range f.Args {
+			args[i] = a.String()
+		}
+		return fmt.Sprintf("%s(%s)", f.Op, strings.Join(args, ", "))
+	}
+	if s, ok := f.Value.(string); ok {
+		return fmt.Sprintf("%s(%s, %q)", f.Op, f.Field, s)
+	}
+	return fmt.Sprintf("%s(%s, %v)", f.Op, f.Field, f.Value)
+}
+
+// FilterError is returned for a Filter that is malformed, and for one
+// that meets a field of another type than its Value, with the Key of the
+// value concerned.
+type FilterError struct {
+	Filter Filter // the offending node
+	Key    string
+	Reason string
+}
+
+func (e *FilterError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("invalid filter %s: %s in the value of key %q", e.Filter, e.Reason, e.Key)
+	}
+	return fmt.Sprintf("invalid filter %s: %s", e.Filter, e.Reason)
+}
+
+// Is reports whether target is ErrInvalidFilter.
+func (e *FilterError) Is(target error) bool {
+	return target == ErrInvalidFilter
+}
+
+// Validate reports the first malformed node of f: an unknown operator,
+// a comparison without a field or with a Value that isn't a string, a
+// finite number or a boolean, an ordering of booleans, a prefix that
+// isn't a string, a key compared with something else than a string, or a
+// field path with an empty name or a double quote.
+func (f Filter) Validate() error {
+	invalid := func(format string, args ...any) error {
+		return &FilterError{Filter: f, Reason: fmt.Sprintf(format, args...)}
+	}
+	switch f.Op {
+	case FilterOpAnd, FilterOpOr, FilterOpNot:
+		if f.Field != "" || f.Value != nil {
+			return invalid("%s takes no field or value", f.Op)
+		}
+		if f.Op == FilterOpNot && len(f.Args) != 1 {
+			return invalid("not takes one filter, got %d", len(f.Args))
+		}
+		for _, a := range f.Args {
+			if err := a.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FilterOpEq, FilterOpNe, FilterOpLt, FilterOpLte, FilterOpGt, FilterOpGte, FilterOpPrefix:
+	default:
+		return invalid("unknown operator %q", f.Op)
+	}
+	if len(f.Args) > 0 {
+		return invalid("%s takes no filters", f.Op)
+	}
+	if f.Field == "" {
+		return invalid("no field")
+	}
+	if f.Field != FilterKeyField {
+		for _, name := range strings.Split(f.Field, ".") {
+			if name == "" || strings.Contains(name, `"`) {
+				return invalid("bad field path %q", f.Field)
+			}
+		}
+	}
+	switch v := f.Value.(type) {
+	case string:
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return invalid("value %v is not a finite number", v)
+		}
+	case bool:
+		if f.Op != FilterOpEq && f.Op != FilterOpNe {
+			return invalid("%s can't order booleans", f.Op)
+		}
+	default:
+		return invalid("value of type %T, want a string, number or boolean", f.Value)
+	}
+	if f.Op == FilterOpPrefix {
+		if _, ok := f.Value.(string); !ok {
+			return invalid("prefix of %s, want a string", jsonTypeOf(f.Value))
+		}
+	}
+	if f.Field == FilterKeyField {
+		if _, ok := f.Value.(string); !ok {
+			return invalid("key compared with %s, want a string", jsonTypeOf(f.Value))
+		}
+	}
+	return nil
+}
+
+// Match validates f and reports whether key and its value v pass it. v
+// is encoded with encoding/json only if f reads fields of it.
+func (f Filter) Match(key string, v any) (bool, error) {
+	if err := f.Validate(); err != nil {
+		return false, err
+	}
+	d := &filterDoc{v: v}
+	return f.eval(key, d)
+}
+
+// filterDoc is a value decoded from its JSON encoding on first use.
+type filterDoc struct {
+	v       any
+	decoded bool
+	doc     any
+}
+
+func (d *filterDoc) get() (any, error) {
+	if !d.decoded {
+		data, err := json.Marshal(d.v)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &d.doc); err != nil {
+			return nil, err
+		}
+		d.decoded = true
+	}
+	return d.doc, nil
+}
+
+// eval evaluates a validated f. It evaluates every operand of and and or,
+// so that a type mismatch fails f wherever it is.
+func (f Filter) eval(key string, d *filterDoc) (bool, error) {
+	switch f.Op {
+	case FilterOpAnd, FilterOpOr:
+		out := f.Op == FilterOpAnd
+		for _, a := range f.Args {
+			ok, err := a.eval(key, d)
+			if err != nil {
+				return false, err
+			}
+			if f.Op == FilterOpAnd {
+				out = out && ok
+			} else {
+				out = out || ok
+			}
+		}
+		return out, nil
+	case FilterOpNot:
+		ok, err := f.Args[0].eval(key, d)
+		return !ok, err
+	}
+
+	var field any = key
+	if f.Field != FilterKeyField {
+		doc, err := d.get()
+		if err != nil {
+			return false, err
+		}
+		field = doc
+		for _, name := range strings.Split(f.Field, ".") {
+			obj, ok := field.(map[string]any)
+			if !ok {
+				return false, nil
+			}
+			field = obj[name]
+		}
+	}
+	if field == nil {
+		return false, nil
+	}
+	if jsonTypeOf(field) != jsonTypeOf(f.Value) {
+		return false, &FilterError{Filter: f, Key: key, Reason: fmt.Sprintf("%s is %s, compared with %s", f.Field, jsonTypeOf(field), jsonTypeOf(f.Value))}
+	}
+	var c int
+	switch x := field.(type) {
+	case string:
+		if f.Op == FilterOpPrefix {
+			return strings.HasPrefix(x, f.Value.(string)), nil
+		}
+		c = strings.Compare(x, f.Value.(string))
+	case float64:
+		switch y := f.Value.(float64); {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	case bool:
+		if x != f.Value.(bool) {
+			c = 1
+		}
+	}
+	switch f.Op {
+	case FilterOpEq:
+		return c == 0, nil
+	case FilterOpNe:
+		return c != 0, nil
+	case FilterOpLt:
+		return c < 0, nil
+	case FilterOpLte:
+		return c <= 0, nil
+	case FilterOpGt:
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+// jsonTypeOf names the JSON type of a decoded JSON value.
+func jsonTypeOf(v any) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	default:
+		return fmt.Sprintf("a %T", v)
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type filterAuthor struct {
+	Name string `json:"name"`
+}
+
+type filterItem struct {
+	Status   string        `json:"status"`
+	Priority int           `json:"priority"`
+	Done     bool          `json:"done"`
+	Author   *filterAuthor `json:"author,omitempty"`
+	Tags     []string      `json:"tags,omitempty"`
+}
+
+func TestFilterMatch(t *testing.T) {
+	v := filterItem{Status: "active", Priority: 3, Author: &filterAuthor{Name: "ann"}}
+	tests := []struct {
+		f    Filter
+		want bool
+	}{
+		{F.Eq("status", "active"), true},
+		{F.Ne("status", "active"), false},
+		{F.Gt("priority", 2), true},
+		{F.Gte("priority", 3), true},
+		{F.Lt("priority", 3.5), true},
+		{F.Lte("priority", 2), false},
+		{F.Gt("status", "act"), true},
+		{F.Eq("done", false), true},
+		{F.Ne("done", true), true},
+		{F.Prefix("key", "2024/"), true},
+		{F.Prefix("author.name", "a"), true},
+		{F.Eq("author.name", "bob"), false},
+		// a missing field or null fails every comparison, ne included
+		{F.Eq("missing", "x"), false},
+		{F.Ne("missing", "x"), false},
+		{F.Not(F.Eq("missing", "x")), true},
+		{F.Eq("status.deeper", "x"), false},
+		{F.And(), true},
+		{F.Or(), false},
+		{F.And(F.Eq("status", "active"), F.Gt("priority", 5)), false},
+		{F.Or(F.Eq("status", "done"), F.Gt("priority", 1)), true},
+		{F.Not(F.Prefix("key", "2023/")), true},
+	}
+	for _, tt := range tests {
+		got, err := tt.f.Match("2024/a", v)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v, %v, want %v", tt.f, got, err, tt.want)
+		}
+	}
+}
+
+func TestFilterTypeMismatch(t *testing.T) {
+	v := filterItem{Status: "active", Priority: 3, Tags: []string{"x"}}
+	for _, f := range []Filter{
+		F.Gt("status", 3),
+		F.Eq("priority", "3"),
+		F.Prefix("priority", "3"),
+		F.Eq("done", "false"),
+		F.Eq("tags", "x"),
+		// the or is decided without the mismatch, which still fails it
+		F.Or(F.Eq("status", "active"), F.Gt("status", 1)),
+	} {
+		_, err := f.Match("k", v)
+		var fe *FilterError
+		if !errors.As(err, &fe) || !errors.Is(err, ErrInvalidFilter) || fe.Key != "k" {
+			t.Errorf("%s: err = %v, want a *FilterError for key k", f, err)
+		}
+	}
+	_, err := F.Gt("status", 3).Match("k", v)
+	if want := `invalid filter gt(status, 3): status is a string, compared with a number in the value of key "k"`; err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %s", err, want)
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	for _, f := range []Filter{
+		{Op: "like", Field: "status", Value: "a"},
+		{Op: FilterOpEq, Value: "a"},
+		{Op: FilterOpEq, Field: "status"},
+		{Op: FilterOpEq, Field: "status", Value: []any{"a"}},
+		{Op: FilterOpNot},
+		{Op: FilterOpAnd, Field: "status"},
+		F.Gt("done", true),
+		F.Eq("key", 1),
+		F.Eq("a..b", "x"),
+		F.Eq(`a"b`, "x"),
+		F.And(F.Eq("status", "a"), Filter{Op: FilterOpLt, Field: "x", Value: map[string]any{}}),
+	} {
+		if err := f.Validate(); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: Validate = %v, want ErrInvalidFilter", f, err)
+		}
+		if _, err := f.Match("k", filterItem{}); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: Match = %v, want ErrInvalidFilter", f, err)
+		}
+	}
+}
+
+func TestFilterJSON(t *testing.T) {
+	f := F.And(F.Eq("status", "active"), F.Or(F.Gt("priority", 2), F.Not(F.Eq("done", false))), F.Prefix("key", "a/"))
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `{"op":"eq","field":"done","value":false}`) {
+		t.Errorf("encoding %s lost a false value", data)
+	}
+	got, err := ParseFilter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("round trip: got %s, want %s", got, f)
+	}
+	if _, err := ParseFilter([]byte(`{"op":"gt","field":"done","value":true}`)); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("ParseFilter of an invalid filter = %v", err)
+	}
+	if _, err := ParseFilter([]byte(`{"op":`)); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("ParseFilter of bad JSON = %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package gomap
+
+import (
+	"sort"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// ListWhere evaluates f with Filter.Match, which encodes each value to
+// JSON when f reads its fields. StoreOptions.MaxListResults limits the
+// values that pass f.
+func (s *memStore[T]) ListWhere(kind string, f store.Filter) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	keys, err := s.where(kind, f)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CheckResultSize(len(keys), s.maxList); err != nil {
+		return nil, err
+	}
+	out := make(map[string]T, len(keys))
+	for _, k := range keys {
+		out[k] = s.readClone(s.kinds[kind][k])
+	}
+	return out, nil
+}
+
+func (s *memStore[T]) CountWhere(kind string, f store.Filter) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, store.ErrClosed
+	}
+	keys, err := s.where(kind, f)
+	return len(keys), err
+}
+
+func (s *memStore[T]) DeleteWhere(kind string, f store.Filter, opts ...store.WriteOption) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return 0, store.ErrClosed
+	}
+	keys, err := s.where(kind, f)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	if err := s.logWrite(s.journalDeletes(nil, kind, keys...)); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	evs := s.deleteKeys(kind, keys, wc)
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, evs, nil)
+	return len(keys), nil
+}
+
+// filterStreamBatch is how many values FilterStream reads per lock hold.
+const filterStreamBatch = 256
+
+// FilterStream takes the kind's keys, then reads their values in batches,
+// calling filter and fn without the lock held, so fn may write to the
+// store.
+func (s *memStore[T]) FilterStream(kind string, filter store.FilterFunc[T], fn func(key string, val T) error) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	keys := sortedKeys(s.kinds[kind])
+	s.mu.RUnlock()
+
+	batch := make([]store.KeyValue[T], 0, filterStreamBatch)
+	for start := 0; start < len(keys); start += filterStreamBatch {
+		batch = batch[:0]
+		s.mu.RLock()
+		if s.closed {
+			s.mu.RUnlock()
+			return store.ErrClosed
+		}
+		for _, k := range keys[start:min(start+filterStreamBatch, len(keys))] {
+			if v, ok := s.kinds[kind][k]; ok {
+				batch = append(batch, store.KeyValue[T]{Key: k, Value: s.readClone(v)})
+			}
+		}
+		s.mu.RUnlock()
+		for _, kv := range batch {
+			if filter != nil && !filter(kv.Key, kv.Value) {
+				continue
+			}
+			if err := fn(kv.Key, kv.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// where returns the keys of kind that pass f, sorted. Callers hold s.mu.
+func (s *memStore[T]) where(kind string, f store.Filter) ([]string, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k, v := range s.kinds[kind] {
+		ok, err := f.Match(k, v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
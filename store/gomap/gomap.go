@@ -1,12 +1,17 @@
 package gomap
 
 import (
+	"errors"
 	"fmt"
 	"maps"
+	"math/rand"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/zestor-dev/zestor/store"
 )
@@ -17,45 +22,533 @@ type memStore[T any] struct {
 	kinds map[string]map[string]T
 	// kind -> validation function
 	validationFns map[string]store.ValidateFunc[T]
+	// kind -> normalization function
+	normalizeFns map[string]store.NormalizeFunc[T]
+	// kind -> (key -> labels)
+	labels map[string]map[string]map[string]string
+	// kind -> (key -> time of last change), for replayed events
+	modified map[string]map[string]time.Time
+	// kind -> (key -> version), bumped with modified (Event.Version)
+	versions map[string]map[string]int64
+	// kind -> (key -> soft-deleted value) (store.SoftDeleter)
+	trash map[string]map[string]trashed[T]
+	now   func() time.Time
 	// kind -> (watcherID -> chan)
 	watchers map[string]map[string]*watcher[T]
+	// watcherID -> watchers of every kind (WatchAll), kept apart so that
+	// kinds created after they subscribed reach them too
+	allWatchers map[string]*watcher[T]
 	// compare func
 	compareFn store.CompareFunc[T]
-	closed    bool
+	cloneFn   func(T) T
+	// whether reads clone too, not just events
+	cloneOnRead bool
+	closed      bool
 	// counter for generating unique watcher IDs
 	watcherID atomic.Uint64
+	// synchronous watchers subscribed, and the order of their deliveries
+	syncWatchers int
+	turns        *turns
+	// idempotency keys seen by Set, evicted once older than idemWindow,
+	// and the order they were recorded in
+	idem       map[idemKey]idemRecord
+	idemOrder  []idemKey
+	idemWindow time.Duration
+
+	// SetAll chunking (StoreOptions.SetAllBatchSize / SetAllProgress)
+	setAllBatch    int
+	setAllProgress func(kind string, done, total int)
+
+	afterWrite func(ev *store.Event[T])
+	// StoreOptions.AllowedKinds; nil allows every kind
+	allowedKinds map[string]struct{}
+	// StoreOptions.RejectZeroValues; nil accepts zero values
+	checkZero func(kind, key string, v T) error
+	// StoreOptions.MaxListResults and MaxGetAllResults; 0 means no limit
+	maxList, maxGetAll int
+	// StoreOptions.KeyGen
+	keyGen func() string
+
+	// recent published events per kind (StoreOptions.EventHistory)
+	historySize int
+	muHistory   sync.Mutex
+	history     map[string]*ring[published[T]]
+	// sequence number of the last recorded event per kind
+	seqs map[string]uint64
+
+	// journal logs every write, in a store built by NewMemStoreFromJournal
+	journal *journal
+}
+
+// Codec returns nil: values are kept as they are.
+func (s *memStore[T]) Codec() store.Codec { return nil }
+
+// Info reports the "gomap" backend, with the features "history"
+// (StoreOptions.EventHistory) and "clone-on-read" where set.
+func (s *memStore[T]) Info() store.Info {
+	var features []string
+	if s.cloneOnRead {
+		features = append(features, "clone-on-read")
+	}
+	if s.historySize > 0 {
+		features = append(features, "history")
+	}
+	return store.Info{Backend: "gomap", Features: features, WatchFeatures: s.watchFeatures()}
+}
+
+// watchFeatures returns every watch feature, but WatchReplayHistory
+// without a history.
+func (s *memStore[T]) watchFeatures() []store.WatchFeature {
+	if s.historySize > 0 {
+		return slices.Clone(store.AllWatchFeatures)
+	}
+	return slices.DeleteFunc(slices.Clone(store.AllWatchFeatures), func(f store.WatchFeature) bool {
+		return f == store.WatchReplayHistory
+	})
+}
+
+// kindKey identifies a key across kinds.
+type kindKey struct {
+	kind, key string
+}
+
+type idemKey struct {
+	kind, key, id string
+}
+
+type idemRecord struct {
+	created bool
+	// the version the write left the key at
+	version int64
+	at      time.Time
 }
 
 type watcher[T any] struct {
-	ch         chan *store.Event[T]
+	// kinds the watcher is registered under; for a watcher of every kind,
+	// the kinds that existed when it subscribed
+	kinds []string
+	all   bool
+	ch    chan *store.Event[T]
+	// closed on removal to stop the initial replay goroutine
+	done chan struct{}
+	// held by the replay goroutine, and synchronous sends, while they
+	// send, so that removal doesn't close ch under them
+	replayMu   sync.Mutex
 	eventTypes map[store.EventType]struct{}
+	// key allowlist (empty means all keys), guarded by memStore.mu
+	keys map[string]struct{}
+
+	// WithSynchronous: ch is unbuffered and publish blocks on it, for the
+	// writes taking turns after fromTurn
+	synchronous bool
+	fromTurn    uint64
+
+	// consecutive dropped events, and the count that evicts (0 = never)
+	drops      atomic.Int64
+	evictAfter int
+	transition store.TransitionFunc[T]
+	// WithMinVersions, nil without
+	minVersions *store.VersionFilter
+	// WithSaturationAlert, nil without
+	saturation *store.SaturationMonitor
+
+	// counters of WatchHandle.Stats
+	delivered atomic.Int64
+	dropped   atomic.Int64
+	started   time.Time
+}
+
+// published is an event with the value its write replaced, which only
+// updates have, for transition filters.
+type published[T any] struct {
+	ev   *store.Event[T]
+	prev T
+}
+
+// change returns the values of ev's key before and after its write.
+func (p published[T]) change() (old, new T) {
+	switch p.ev.EventType {
+	case store.EventTypeCreate:
+		return old, p.ev.Object
+	case store.EventTypeDelete:
+		return p.ev.Object, new
+	}
+	return p.prev, p.ev.Object
 }
 
+// wants reports whether p passes the watcher's version, event type, key
+// and transition filters.
+func (w *watcher[T]) wants(p published[T]) bool {
+	ev := p.ev
+	if w.minVersions.Stale(ev.Name, ev.EventType, ev.Version) {
+		return false
+	}
+	if w.eventTypes != nil {
+		if _, ok := w.eventTypes[ev.EventType]; !ok {
+			return false
+		}
+	}
+	if len(w.keys) > 0 {
+		if _, ok := w.keys[ev.Name]; !ok {
+			return false
+		}
+	}
+	if w.transition != nil {
+		return w.transition(p.change())
+	}
+	return true
+}
+
+// send delivers ev without blocking. It reports false once the watcher has
+// dropped evictAfter events in a row and should be evicted.
+func (w *watcher[T]) send(ev *store.Event[T]) bool {
+	select {
+	case w.ch <- ev:
+		w.drops.Store(0)
+		w.delivered.Add(1)
+		w.saturation.Observe(len(w.ch), cap(w.ch))
+		return true
+	default: // no blocking
+		w.dropped.Add(1)
+		w.saturation.Observe(cap(w.ch), cap(w.ch))
+		return w.evictAfter <= 0 || w.drops.Add(1) < int64(w.evictAfter)
+	}
+}
+
+// sendWait delivers evs one by one, each once the consumer receives it,
+// for WithSynchronous. It gives up once the watcher is removed.
+func (w *watcher[T]) sendWait(evs []*store.Event[T]) {
+	w.replayMu.Lock()
+	defer w.replayMu.Unlock()
+	for _, ev := range evs {
+		// ch is closed only after done, with replayMu held
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		select {
+		case w.ch <- ev:
+			w.delivered.Add(1)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// turns orders the deliveries to synchronous watchers as their writes were
+// applied, since writes publish once they released memStore.mu: each write
+// takes a turn under memStore.mu, and delivers once the writes before it
+// have.
+type turns struct {
+	// the last turn taken, guarded by memStore.mu
+	issued uint64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// every turn up to done has ended, and those in ended too
+	done  uint64
+	ended map[uint64]struct{}
+}
+
+func newTurns() *turns {
+	q := &turns{ended: make(map[uint64]struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// wait blocks until every turn before t has ended.
+func (q *turns) wait(t uint64) {
+	q.mu.Lock()
+	for q.done+1 != t {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+}
+
+// end ends turn t, which may come before the turns preceding it end.
+func (q *turns) end(t uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ended[t] = struct{}{}
+	for {
+		if _, ok := q.ended[q.done+1]; !ok {
+			break
+		}
+		delete(q.ended, q.done+1)
+		q.done++
+	}
+	q.cond.Broadcast()
+}
+
+// unlockTurns releases s.mu after a write publishing n batches of events,
+// and returns the first of their n consecutive turns, or 0 when no
+// synchronous watcher is subscribed.
+func (s *memStore[T]) unlockTurns(n int) uint64 {
+	var first uint64
+	if s.syncWatchers > 0 {
+		first = s.turns.issued + 1
+		s.turns.issued += uint64(n)
+	}
+	s.mu.Unlock()
+	return first
+}
+
+// unlockTurn releases s.mu after a write publishing one batch of events,
+// and returns its turn.
+func (s *memStore[T]) unlockTurn() uint64 {
+	return s.unlockTurns(1)
+}
+
+// nthTurn returns the i-th of the turns unlockTurns returned first of.
+func nthTurn(first uint64, i int) uint64 {
+	if first == 0 {
+		return 0
+	}
+	return first + uint64(i)
+}
+
+// close stops the initial replay, waiting for a send in progress, and
+// closes the channel. Callers hold memStore.mu.
+func (w *watcher[T]) close() {
+	close(w.done)
+	w.replayMu.Lock()
+	close(w.ch)
+	w.replayMu.Unlock()
+}
+
+func (w *watcher[T]) stats() store.WatchStats {
+	return store.WatchStats{
+		Delivered: w.delivered.Load(),
+		Dropped:   w.dropped.Load(),
+		BufferLen: len(w.ch),
+		BufferCap: cap(w.ch),
+		Age:       time.Since(w.started),
+	}
+}
+
+// New returns an empty in-memory store, seeded with opt.Defaults, or the
+// error of a default failing normalization or validation. It refuses
+// opt.Journal: a store recovered from a journal is built by
+// NewMemStoreFromJournal, which reports its I/O errors.
+func New[T any](opt store.StoreOptions[T]) (store.Store[T], error) {
+	if opt.Journal.Path != "" {
+		return nil, errors.New("gomap: a journal needs NewMemStoreFromJournal")
+	}
+	ms := newMemStore(opt)
+	if err := ms.seedDefaults(opt.Defaults); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// NewMemStore is New for options known to be valid, such as defaults
+// written in the program: it panics where New fails, including with
+// opt.Journal set.
 func NewMemStore[T any](opt store.StoreOptions[T]) store.Store[T] {
+	s, err := New(opt)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// newMemStore returns an empty in-memory store, without its defaults.
+func newMemStore[T any](opt store.StoreOptions[T]) *memStore[T] {
 	ms := &memStore[T]{
-		kinds:         make(map[string]map[string]T),
-		watchers:      make(map[string]map[string]*watcher[T]),
-		validationFns: make(map[string]store.ValidateFunc[T]),
-		compareFn:     opt.CompareFn,
+		kinds:          make(map[string]map[string]T),
+		labels:         make(map[string]map[string]map[string]string),
+		modified:       make(map[string]map[string]time.Time),
+		versions:       make(map[string]map[string]int64),
+		trash:          make(map[string]map[string]trashed[T]),
+		now:            opt.Now,
+		watchers:       make(map[string]map[string]*watcher[T]),
+		allWatchers:    make(map[string]*watcher[T]),
+		turns:          newTurns(),
+		validationFns:  make(map[string]store.ValidateFunc[T]),
+		normalizeFns:   make(map[string]store.NormalizeFunc[T]),
+		compareFn:      opt.CompareFn,
+		cloneFn:        opt.CloneFn,
+		cloneOnRead:    opt.CloneOnRead,
+		historySize:    opt.EventHistory,
+		history:        make(map[string]*ring[published[T]]),
+		seqs:           make(map[string]uint64),
+		idem:           make(map[idemKey]idemRecord),
+		idemWindow:     opt.IdempotencyWindow,
+		setAllBatch:    opt.SetAllBatchSize,
+		setAllProgress: opt.SetAllProgress,
+		afterWrite:     opt.AfterWrite,
+		allowedKinds:   store.KindSet(opt.AllowedKinds),
+		maxList:        opt.MaxListResults,
+		maxGetAll:      opt.MaxGetAllResults,
+		keyGen:         opt.KeyGen,
+		checkZero:      store.ZeroValueCheck(opt),
+	}
+	if ms.idemWindow <= 0 {
+		ms.idemWindow = store.DefaultIdempotencyWindow
 	}
 	if ms.compareFn == nil {
 		ms.compareFn = store.DefaultCompareFunc[T]
 	}
+	if ms.now == nil {
+		ms.now = time.Now
+	}
 	if opt.ValidateFns != nil {
 		maps.Copy(ms.validationFns, opt.ValidateFns)
 	}
+	if opt.NormalizeFns != nil {
+		maps.Copy(ms.normalizeFns, opt.NormalizeFns)
+	}
 	return ms
 }
 
+// seedDefaults seeds each kind of defaults.
+func (s *memStore[T]) seedDefaults(defaults map[string]map[string]T) error {
+	for kind, values := range defaults {
+		if err := s.seed(kind, values); err != nil {
+			return fmt.Errorf("gomap: invalid default in kind %q: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// seed creates the keys of values that kind doesn't hold yet and publishes
+// their create events. Existing keys are left alone.
+func (s *memStore[T]) seed(kind string, values map[string]T) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(values))
+	prepared := make(map[string]T, len(values))
+	for k, v := range values {
+		pv, err := s.prepare(kind, k, v)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+		prepared[k] = pv
+	}
+	sort.Strings(keys)
+
+	s.mu.Lock()
+	s.ensureKind(kind)
+	keys = slices.DeleteFunc(keys, func(k string) bool {
+		_, ok := s.kinds[kind][k]
+		return ok
+	})
+	if err := s.logSets(kind, keys, prepared); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	now := s.now()
+	evs := make([]*store.Event[T], 0, len(keys))
+	for _, k := range keys {
+		s.kinds[kind][k] = prepared[k]
+		version := s.touch(kind, k, now)
+		evs = append(evs, &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: prepared[k], At: now, Version: version})
+	}
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, evs, nil)
+	return nil
+}
+
+// prepare normalizes and validates a value about to be written to kind.
+func (s *memStore[T]) prepare(kind, key string, value T) (T, error) {
+	if fn, ok := s.normalizeFns[kind]; ok {
+		nv, err := fn(value)
+		if err != nil {
+			return value, &store.NormalizeError{Kind: kind, Key: key, Err: err}
+		}
+		value = nv
+	}
+	if s.checkZero != nil {
+		if err := s.checkZero(kind, key, value); err != nil {
+			return value, err
+		}
+	}
+	if fn, ok := s.validationFns[kind]; ok {
+		if err := fn(value); err != nil {
+			return value, err
+		}
+	}
+	return value, nil
+}
+
+// clone returns a copy of a stored value to hand out, so callers and
+// watchers can't mutate the store through it. Without a CloneFn values are
+// handed out as stored.
+func (s *memStore[T]) clone(v T) T {
+	if s.cloneFn == nil {
+		return v
+	}
+	return s.cloneFn(v)
+}
+
+// readClone is clone for values returned by reads, which are only cloned
+// with StoreOptions.CloneOnRead.
+func (s *memStore[T]) readClone(v T) T {
+	if !s.cloneOnRead {
+		return v
+	}
+	return s.clone(v)
+}
+
+// checkKind returns store.ErrUnknownKind for kinds outside
+// StoreOptions.AllowedKinds.
+func (s *memStore[T]) checkKind(kinds ...string) error {
+	return store.CheckKind(s.allowedKinds, kinds...)
+}
+
 func (s *memStore[T]) ensureKind(kind string) {
 	if _, ok := s.kinds[kind]; !ok {
 		s.kinds[kind] = make(map[string]T)
 	}
+	if _, ok := s.labels[kind]; !ok {
+		s.labels[kind] = make(map[string]map[string]string)
+	}
+	if _, ok := s.modified[kind]; !ok {
+		s.modified[kind] = make(map[string]time.Time)
+	}
+	if _, ok := s.versions[kind]; !ok {
+		s.versions[kind] = make(map[string]int64)
+	}
 	if _, ok := s.watchers[kind]; !ok {
 		s.watchers[kind] = make(map[string]*watcher[T])
 	}
 }
 
+// touch records a change of key at at and returns the key's new version.
+// Callers hold s.mu and called ensureKind.
+func (s *memStore[T]) touch(kind, key string, at time.Time) int64 {
+	s.modified[kind][key] = at
+	s.versions[kind][key]++
+	return s.versions[kind][key]
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// uniqueKinds returns kinds without duplicates, in first-seen order.
+func uniqueKinds(kinds []string) []string {
+	seen := make(map[string]struct{}, len(kinds))
+	out := make([]string, 0, len(kinds))
+	for _, k := range kinds {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
 func cloneMap[T any](in map[string]T) map[string]T {
 	if in == nil {
 		return map[string]T{}
@@ -66,6 +559,10 @@ func cloneMap[T any](in map[string]T) map[string]T {
 }
 
 func (s *memStore[T]) Get(kind, key string) (T, bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		var zero T
+		return zero, false, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
@@ -74,15 +571,30 @@ func (s *memStore[T]) Get(kind, key string) (T, bool, error) {
 	}
 	m := s.kinds[kind]
 	v, ok := m[key]
+	if ok {
+		v = s.readClone(v)
+	}
 	return v, ok, nil
 }
 
 func (s *memStore[T]) List(kind string, filters ...store.FilterFunc[T]) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
 		return nil, store.ErrClosed
 	}
+	if err := store.CheckResultSize(len(s.kinds[kind]), s.maxList); err != nil {
+		return nil, err
+	}
+	return s.list(kind, filters...), nil
+}
+
+// list returns the values of kind that every filter keeps. Callers hold
+// s.mu.
+func (s *memStore[T]) list(kind string, filters ...store.FilterFunc[T]) map[string]T {
 	rs := make(map[string]T, len(s.kinds[kind]))
 OUTER:
 	for k, v := range s.kinds[kind] {
@@ -91,12 +603,60 @@ OUTER:
 				continue OUTER
 			}
 		}
-		rs[k] = v
+		rs[k] = s.readClone(v)
+	}
+	return rs
+}
+
+func (s *memStore[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	return s.list(kind, func(key string, _ T) bool {
+		return strings.HasPrefix(key, prefix)
+	}), nil
+}
+
+func (s *memStore[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	if separator == "" {
+		return nil, store.ErrSeparatorRequired
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	seen := make(map[string]struct{})
+	for k := range s.kinds[kind] {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, separator); i >= 0 {
+			rest = rest[:i+len(separator)]
+		}
+		seen[rest] = struct{}{}
+	}
+	segments := make([]string, 0, len(seen))
+	for seg := range seen {
+		segments = append(segments, seg)
 	}
-	return rs, nil
+	sort.Strings(segments)
+	return segments, nil
 }
 
 func (s *memStore[T]) Keys(kind string) ([]string, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
@@ -110,184 +670,809 @@ func (s *memStore[T]) Keys(kind string) ([]string, error) {
 }
 
 func (s *memStore[T]) Values(kind string) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
 		return nil, store.ErrClosed
 	}
+	if err := store.CheckResultSize(len(s.kinds[kind]), s.maxList); err != nil {
+		return nil, err
+	}
 	values := make([]store.KeyValue[T], 0, len(s.kinds[kind]))
 	for k, v := range s.kinds[kind] {
-		values = append(values, store.KeyValue[T]{Key: k, Value: v})
+		values = append(values, store.KeyValue[T]{Key: k, Value: s.readClone(v)})
 	}
 	return values, nil
 }
 
+func (s *memStore[T]) SelectByLabel(kind string, selector map[string]string) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	values := make([]store.KeyValue[T], 0)
+OUTER:
+	for k, v := range s.kinds[kind] {
+		labels := s.labels[kind][k]
+		for name, want := range selector {
+			if got, ok := labels[name]; !ok || got != want {
+				continue OUTER
+			}
+		}
+		values = append(values, store.KeyValue[T]{Key: k, Value: s.readClone(v)})
+	}
+	return values, nil
+}
+
+// Kinds returns the kinds that currently hold at least one key.
+func (s *memStore[T]) Kinds() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	kinds := make([]string, 0, len(s.kinds))
+	for kind, m := range s.kinds {
+		if len(m) > 0 {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds, nil
+}
+
 func (s *memStore[T]) Count(kind string) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	if s.closed {
 		return 0, store.ErrClosed
 	}
-	return len(s.kinds[kind]), nil
+	return len(s.kinds[kind]), nil
+}
+
+func (s *memStore[T]) Versions(kind string) (map[string]int64, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	return cloneMap(s.versions[kind]), nil
+}
+
+func (s *memStore[T]) ExistingKeys(kind string, keys []string) (map[string]bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	exist := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		_, exist[k] = s.kinds[kind][k]
+	}
+	return exist, nil
+}
+
+// Sample picks the entries by reservoir sampling, in one pass over the
+// kind.
+func (s *memStore[T]) Sample(kind string, n int) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	if n <= 0 {
+		return []store.KeyValue[T]{}, nil
+	}
+	out := make([]store.KeyValue[T], 0, min(n, len(s.kinds[kind])))
+	i := 0
+	for k, v := range s.kinds[kind] {
+		kv := store.KeyValue[T]{Key: k, Value: v}
+		if i < n {
+			out = append(out, kv)
+		} else if j := rand.Intn(i + 1); j < n {
+			out[j] = kv
+		}
+		i++
+	}
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	for i := range out {
+		out[i].Value = s.readClone(out[i].Value)
+	}
+	return out, nil
+}
+
+// seenWrite returns the recorded result of an earlier write carrying the same
+// idempotency key, evicting the expired keys recorded first. Callers must
+// hold s.mu.
+func (s *memStore[T]) seenWrite(kind, key, id string) (created, seen bool) {
+	cutoff := s.now().Add(-s.idemWindow)
+	for len(s.idemOrder) > 0 {
+		k := s.idemOrder[0]
+		if r, ok := s.idem[k]; ok && !r.at.Before(cutoff) {
+			break
+		}
+		delete(s.idem, k)
+		s.idemOrder = s.idemOrder[1:]
+	}
+	r, ok := s.idem[idemKey{kind, key, id}]
+	if !ok || r.at.Before(cutoff) {
+		// recorded after a later key, with a clock that stepped back
+		return false, false
+	}
+	return r.created, true
+}
+
+// recordWrite remembers the result of a write carrying an idempotency
+// key. Callers must hold s.mu.
+func (s *memStore[T]) recordWrite(kind, key, id string, created bool) {
+	if id == "" {
+		return
+	}
+	k := idemKey{kind, key, id}
+	s.idem[k] = idemRecord{created: created, version: s.versions[kind][key], at: s.now()}
+	s.idemOrder = append(s.idemOrder, k)
+}
+
+func (s *memStore[T]) Set(kind, key string, value T, opts ...store.WriteOption) (bool, error) {
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	return s.set(kind, key, value, wc, nil)
+}
+
+func (s *memStore[T]) Add(kind string, value T) (string, error) {
+	return store.AddNew(s.keyGen, func(key string) error {
+		_, err := s.set(kind, key, value, &store.WriteCfg{CreateOnly: true}, nil)
+		return err
+	})
+}
+
+func (s *memStore[T]) SetLabeled(kind, key string, value T, labels map[string]string) (bool, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return s.set(kind, key, value, &store.WriteCfg{}, labels)
+}
+
+// set writes value and, if labels is non-nil, replaces the key's labels.
+func (s *memStore[T]) set(kind, key string, value T, wc *store.WriteCfg, labels map[string]string) (bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, store.ErrClosed
+	}
+	s.ensureKind(kind)
+
+	if wc.IdempotencyKey != "" {
+		if created, seen := s.seenWrite(kind, key, wc.IdempotencyKey); seen {
+			s.mu.Unlock()
+			return created, nil
+		}
+	}
+
+	value, err := s.prepare(kind, key, value)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+
+	prev, existed := s.kinds[kind][key]
+	if existed && wc.CreateOnly {
+		s.mu.Unlock()
+		return false, store.ErrKeyExists
+	}
+	if err := s.logSets(kind, []string{key}, map[string]T{key: value}); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.kinds[kind][key] = value
+	if labels != nil {
+		s.labels[kind][key] = maps.Clone(labels)
+	}
+	// a new key is created whatever its value, the zero value included
+	if existed && s.compareFn(prev, value) {
+		s.recordWrite(kind, key, wc.IdempotencyKey, !existed)
+		s.mu.Unlock()
+		return false, nil
+	}
+	at := s.now()
+	version := s.touch(kind, key, at)
+	s.recordWrite(kind, key, wc.IdempotencyKey, !existed)
+
+	turn := s.unlockTurn()
+
+	evType := store.EventTypeUpdate
+	if !existed {
+		evType = store.EventTypeCreate
+	}
+	s.publish(kind, turn, []*store.Event[T]{{Kind: kind, Name: key, EventType: evType, Object: value, At: at, Version: version, Silent: wc.Silent}}, []T{prev})
+	return !existed, nil
+}
+
+func (s *memStore[T]) SetAll(kind string, values map[string]T, opts ...store.WriteOption) error {
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	return s.setAll(kind, keys, values, false, wc.Silent)
+}
+
+// SetAllOrdered splits the slice into SetAllBatchSize chunks in its order.
+func (s *memStore[T]) SetAllOrdered(kind string, values []store.KeyValue[T]) error {
+	keys, m := store.DedupeKeyValues(values)
+	return s.setAll(kind, keys, m, true, false)
+}
+
+// setAll sets values[k] for each of keys. If ordered, the keys are written
+// and published in their order; otherwise chunks take them sorted and
+// events list the created keys first. silent marks the events Silent.
+func (s *memStore[T]) setAll(kind string, keys []string, values map[string]T, ordered, silent bool) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return store.ErrClosed
+	}
+	s.ensureKind(kind)
+
+	// normalize and validate all values first
+	prepared := make(map[string]T, len(values))
+	for k, v := range values {
+		pv, err := s.prepare(kind, k, v)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		prepared[k] = pv
+	}
+	values = prepared
+
+	if s.setAllBatch <= 0 || len(keys) <= s.setAllBatch {
+		if err := s.logSets(kind, keys, values); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		evs, prevs := s.setAllLocked(kind, keys, values, ordered, silent)
+		turn := s.unlockTurn()
+		s.publish(kind, turn, evs, prevs)
+		if s.setAllProgress != nil {
+			s.setAllProgress(kind, len(values), len(values))
+		}
+		return nil
+	}
+	s.mu.Unlock()
+
+	// release the lock between chunks so readers aren't starved
+	if !ordered {
+		sort.Strings(keys)
+	}
+	for start := 0; start < len(keys); start += s.setAllBatch {
+		end := min(start+s.setAllBatch, len(keys))
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return store.ErrClosed
+		}
+		s.ensureKind(kind)
+		if err := s.logSets(kind, keys[start:end], values); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		evs, prevs := s.setAllLocked(kind, keys[start:end], values, ordered, silent)
+		turn := s.unlockTurn()
+		s.publish(kind, turn, evs, prevs)
+		if s.setAllProgress != nil {
+			s.setAllProgress(kind, end, len(keys))
+		}
+	}
+	return nil
+}
+
+// SetMulti prepares every value, then writes them all under one lock.
+func (s *memStore[T]) SetMulti(values []store.KindKeyValue[T]) error {
+	kinds, keys, byKind := store.GroupKinds(values)
+	if err := s.checkKind(kinds...); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return store.ErrClosed
+	}
+	for _, kind := range kinds {
+		s.ensureKind(kind)
+		for k, v := range byKind[kind] {
+			pv, err := s.prepare(kind, k, v)
+			if err != nil {
+				s.mu.Unlock()
+				return err
+			}
+			byKind[kind][k] = pv
+		}
+	}
+	var ops []journalOp
+	for _, kind := range kinds {
+		var err error
+		if ops, err = s.journalSets(ops, kind, keys[kind], byKind[kind]); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	if err := s.logWrite(ops); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	evs := make([][]*store.Event[T], len(kinds))
+	prevs := make([][]T, len(kinds))
+	for i, kind := range kinds {
+		evs[i], prevs[i] = s.setAllLocked(kind, keys[kind], byKind[kind], true, false)
+	}
+	first := s.unlockTurns(len(kinds))
+	for i, kind := range kinds {
+		s.publish(kind, nthTurn(first, i), evs[i], prevs[i])
+	}
+	return nil
+}
+
+// setAllLocked stores values[k] for each of keys and returns their events,
+// with the values they replaced: in the order of keys if ordered, else the
+// create events followed by the update events. Callers hold s.mu.
+func (s *memStore[T]) setAllLocked(kind string, keys []string, values map[string]T, ordered, silent bool) (evs []*store.Event[T], prevs []T) {
+	// track which keys are created vs updated
+	created := make([]*store.Event[T], 0, len(keys))
+	updated := make([]*store.Event[T], 0, len(keys))
+	var replaced []T
+	if ordered {
+		prevs = make([]T, 0, len(keys))
+	}
+	now := s.now()
+	for _, k := range keys {
+		v := values[k]
+		var ev *store.Event[T]
+		prev, existed := s.kinds[kind][k]
+		s.kinds[kind][k] = v
+		if existed && s.compareFn(prev, v) {
+			// an unchanged value keeps its version and change time, as
+			// in Set, and publishes nothing
+			continue
+		}
+		version := s.touch(kind, k, now)
+		if existed {
+			ev = &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeUpdate, Object: v, At: now, Version: version, Silent: silent}
+		} else {
+			ev = &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: v, At: now, Version: version, Silent: silent}
+		}
+		switch {
+		case ordered:
+			evs, prevs = append(evs, ev), append(prevs, prev)
+		case existed:
+			updated, replaced = append(updated, ev), append(replaced, prev)
+		default:
+			created = append(created, ev)
+		}
+	}
+	if ordered {
+		return evs, prevs
+	}
+	if len(replaced) > 0 {
+		prevs = append(make([]T, len(created)), replaced...)
+	}
+	return append(created, updated...), prevs
+}
+
+func (s *memStore[T]) MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(incoming))
+	for k := range incoming {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return store.ErrClosed
+	}
+	s.ensureKind(kind)
+
+	// resolve and prepare every value before writing any
+	final := make(map[string]T, len(keys))
+	for _, k := range keys {
+		v := incoming[k]
+		if prev, existed := s.kinds[kind][k]; existed && resolve != nil {
+			v = resolve(k, s.clone(prev), v)
+		}
+		pv, err := s.prepare(kind, k, v)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		final[k] = pv
+	}
+	changed := slices.DeleteFunc(slices.Clone(keys), func(k string) bool {
+		prev, existed := s.kinds[kind][k]
+		return existed && s.compareFn(prev, final[k])
+	})
+	if err := s.logSets(kind, changed, final); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	var created, updated []*store.Event[T]
+	var replaced []T
+	now := s.now()
+	for _, k := range keys {
+		v := final[k]
+		prev, existed := s.kinds[kind][k]
+		if existed && s.compareFn(prev, v) {
+			continue
+		}
+		s.kinds[kind][k] = v
+		ev := &store.Event[T]{Kind: kind, Name: k, Object: v, At: now, Version: s.touch(kind, k, now)}
+		if existed {
+			ev.EventType = store.EventTypeUpdate
+			updated = append(updated, ev)
+			replaced = append(replaced, prev)
+		} else {
+			ev.EventType = store.EventTypeCreate
+			created = append(created, ev)
+		}
+	}
+	turn := s.unlockTurn()
+
+	var prevs []T
+	if len(replaced) > 0 {
+		prevs = append(make([]T, len(created)), replaced...)
+	}
+	s.publish(kind, turn, append(created, updated...), prevs)
+	return nil
+}
+
+// ReplaceAll classifies and writes every key under one lock.
+func (s *memStore[T]) ReplaceAll(kind string, values map[string]T, opts ...store.WriteOption) (store.ReplaceReport, error) {
+	var rep store.ReplaceReport
+	if err := s.checkKind(kind); err != nil {
+		return rep, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	keys := sortedKeys(values)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return rep, store.ErrClosed
+	}
+	final := make(map[string]T, len(keys))
+	for _, k := range keys {
+		pv, err := s.prepare(kind, k, values[k])
+		if err != nil {
+			s.mu.Unlock()
+			return rep, err
+		}
+		final[k] = pv
+	}
+	for _, k := range keys {
+		prev, existed := s.kinds[kind][k]
+		switch {
+		case !existed:
+			rep.Created = append(rep.Created, k)
+		case s.compareFn(prev, final[k]):
+			rep.Unchanged = append(rep.Unchanged, k)
+		default:
+			rep.Updated = append(rep.Updated, k)
+		}
+	}
+	for _, k := range sortedKeys(s.kinds[kind]) {
+		if _, ok := final[k]; !ok {
+			rep.Deleted = append(rep.Deleted, k)
+		}
+	}
+	if wc.DryRun {
+		s.mu.Unlock()
+		return rep, nil
+	}
+
+	s.ensureKind(kind)
+	changed := append(slices.Clone(rep.Created), rep.Updated...)
+	ops, err := s.journalSets(nil, kind, changed, final)
+	if err != nil {
+		s.mu.Unlock()
+		return rep, err
+	}
+	if err := s.logWrite(s.journalDeletes(ops, kind, rep.Deleted...)); err != nil {
+		s.mu.Unlock()
+		return rep, err
+	}
+	now := s.now()
+	evs := make([]*store.Event[T], 0, len(changed)+len(rep.Deleted))
+	prevs := make([]T, len(rep.Created), len(changed)+len(rep.Deleted))
+	for i, k := range changed {
+		ev := &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: final[k], At: now, Silent: wc.Silent}
+		if i >= len(rep.Created) {
+			ev.EventType = store.EventTypeUpdate
+			prevs = append(prevs, s.kinds[kind][k])
+		}
+		s.kinds[kind][k] = final[k]
+		ev.Version = s.touch(kind, k, now)
+		evs = append(evs, ev)
+	}
+	for _, ev := range s.deleteKeys(kind, rep.Deleted, &store.WriteCfg{DeleteEvents: true}) {
+		ev.Silent = wc.Silent
+		evs = append(evs, ev)
+	}
+	prevs = append(prevs, make([]T, len(rep.Deleted))...)
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, evs, prevs)
+	return rep, nil
 }
 
-func (s *memStore[T]) Set(kind, key string, value T) (bool, error) {
+func (s *memStore[T]) Delete(kind, key string, opts ...store.WriteOption) (bool, T, error) {
+	var zero T
+	if err := s.checkKind(kind); err != nil {
+		return false, zero, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
-		return false, store.ErrClosed
+		return false, zero, store.ErrClosed
 	}
 	s.ensureKind(kind)
 
-	if fn, ok := s.validationFns[kind]; ok {
-		if err := fn(value); err != nil {
+	prev, existed := s.kinds[kind][key]
+	version := s.versions[kind][key]
+	if existed {
+		if err := s.logWrite(s.journalDeletes(nil, kind, key)); err != nil {
 			s.mu.Unlock()
-			return false, err
+			return false, zero, err
 		}
+		delete(s.kinds[kind], key)
+		delete(s.labels[kind], key)
+		delete(s.modified[kind], key)
+		delete(s.versions[kind], key)
 	}
 
-	prev, existed := s.kinds[kind][key]
-	s.kinds[kind][key] = value
-
-	if s.compareFn(prev, value) {
+	if !existed {
 		s.mu.Unlock()
-		return false, nil
+		return false, zero, nil
 	}
+	at := s.now()
 
-	// copy watchers then unlock
-	wchs := make([]*watcher[T], 0, len(s.watchers[kind]))
-	for _, ch := range s.watchers[kind] {
-		wchs = append(wchs, ch)
-	}
-	s.mu.Unlock()
+	turn := s.unlockTurn()
 
-	evType := store.EventTypeUpdate
-	if !existed {
-		evType = store.EventTypeCreate
+	if wc.WithoutPrev {
+		prev = zero
 	}
-	ev := &store.Event[T]{Kind: kind, Name: key, EventType: evType, Object: value}
-	for _, wch := range wchs {
-		if wch.eventTypes != nil {
-			if _, ok := wch.eventTypes[evType]; !ok {
-				continue
-			}
-		}
-		select {
-		case wch.ch <- ev:
-		default:
-		}
+	s.publish(kind, turn, []*store.Event[T]{{Kind: kind, Name: key, EventType: store.EventTypeDelete, Object: prev, PrevOmitted: wc.WithoutPrev, At: at, Version: version, Silent: wc.Silent}}, nil)
+	return existed, prev, nil
+}
 
+func (s *memStore[T]) CountOlderThan(kind string, cutoff time.Time) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
 	}
-	return !existed, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, store.ErrClosed
+	}
+	return len(s.olderThan(kind, cutoff)), nil
 }
 
-func (s *memStore[T]) SetAll(kind string, values map[string]T) error {
+func (s *memStore[T]) DeleteOlderThan(kind string, cutoff time.Time, opts ...store.WriteOption) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
-		return store.ErrClosed
+		return 0, store.ErrClosed
 	}
-	s.ensureKind(kind)
-
-	// validate all values first
-	if fn, ok := s.validationFns[kind]; ok {
-		for _, v := range values {
-			if err := fn(v); err != nil {
-				s.mu.Unlock()
-				return err
-			}
-		}
+	keys := s.olderThan(kind, cutoff)
+	if err := s.logWrite(s.journalDeletes(nil, kind, keys...)); err != nil {
+		s.mu.Unlock()
+		return 0, err
 	}
+	evs := s.deleteKeys(kind, keys, wc)
+	turn := s.unlockTurn()
 
-	// track which keys are created vs updated
-	created := make(map[string]T)
-	updated := make(map[string]T)
-	for k, v := range values {
-		if _, existed := s.kinds[kind][k]; existed {
-			updated[k] = v
-		} else {
-			created[k] = v
-		}
-		s.kinds[kind][k] = v
-	}
+	s.publish(kind, turn, evs, nil)
+	return len(keys), nil
+}
 
-	// copy watchers then unlock
-	wchs := make([]*watcher[T], 0, len(s.watchers[kind]))
-	for _, wch := range s.watchers[kind] {
-		wchs = append(wchs, wch)
+// deleteKeys deletes keys of kind, with their labels, and returns their
+// delete events if wc asks for them. Callers hold s.mu.
+func (s *memStore[T]) deleteKeys(kind string, keys []string, wc *store.WriteCfg) []*store.Event[T] {
+	at := s.now()
+	var evs []*store.Event[T]
+	for _, k := range keys {
+		if wc.DeleteEvents {
+			evs = append(evs, &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeDelete, Object: s.kinds[kind][k], At: at, Version: s.versions[kind][k]})
+		}
+		delete(s.kinds[kind], k)
+		delete(s.labels[kind], k)
+		delete(s.modified[kind], k)
+		delete(s.versions[kind], k)
 	}
-	s.mu.Unlock()
+	return evs
+}
 
-	for _, wch := range wchs {
-		wantsCreate := wch.eventTypes == nil
-		wantsUpdate := wch.eventTypes == nil
-		if wch.eventTypes != nil {
-			_, wantsCreate = wch.eventTypes[store.EventTypeCreate]
-			_, wantsUpdate = wch.eventTypes[store.EventTypeUpdate]
-		}
-		if wantsCreate {
-			for k, v := range created {
-				select {
-				case wch.ch <- &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: v}:
-				default:
-				}
-			}
-		}
-		if wantsUpdate {
-			for k, v := range updated {
-				select {
-				case wch.ch <- &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeUpdate, Object: v}:
-				default:
-				}
-			}
+// olderThan returns the keys of kind last changed before cutoff, sorted.
+// Callers hold s.mu.
+func (s *memStore[T]) olderThan(kind string, cutoff time.Time) []string {
+	var keys []string
+	for k, t := range s.modified[kind] {
+		if t.Before(cutoff) {
+			keys = append(keys, k)
 		}
 	}
-	return nil
+	sort.Strings(keys)
+	return keys
 }
 
-func (s *memStore[T]) Delete(kind, key string) (bool, T, error) {
-	var zero T
+func (s *memStore[T]) CopyKind(srcKind, dstKind string, opts ...store.WriteOption) (int, error) {
+	return s.copyKind(srcKind, dstKind, false, opts)
+}
 
+// RenameKind hands the maps of srcKind to dstKind when dstKind is empty,
+// so it takes constant time however many keys srcKind holds.
+func (s *memStore[T]) RenameKind(srcKind, dstKind string, opts ...store.WriteOption) (int, error) {
+	return s.copyKind(srcKind, dstKind, true, opts)
+}
+
+// copyKind implements CopyKind, and RenameKind if move is set.
+func (s *memStore[T]) copyKind(srcKind, dstKind string, move bool, opts []store.WriteOption) (int, error) {
+	if err := s.checkKind(srcKind, dstKind); err != nil {
+		return 0, err
+	}
+	if srcKind == dstKind {
+		return 0, fmt.Errorf("gomap: kind %q is both source and destination", srcKind)
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
-		return false, zero, store.ErrClosed
+		return 0, store.ErrClosed
 	}
-	s.ensureKind(kind)
-
-	prev, existed := s.kinds[kind][key]
-	if existed {
-		delete(s.kinds[kind], key)
+	if len(s.kinds[dstKind]) > 0 && !wc.Overwrite {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("gomap: %s: %w", dstKind, store.ErrKindNotEmpty)
 	}
-
-	if !existed {
+	src := s.kinds[srcKind]
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
 		s.mu.Unlock()
-		return false, zero, nil
+		return 0, nil
 	}
-
-	// copy watchers then unlock
-	wchs := make([]*watcher[T], 0, len(s.watchers[kind]))
-	for _, ch := range s.watchers[kind] {
-		wchs = append(wchs, ch)
+	s.ensureKind(dstKind)
+	ops, err := s.journalSets(nil, dstKind, keys, src)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, err
 	}
-	s.mu.Unlock()
+	if move {
+		ops = s.journalDeletes(ops, srcKind, keys...)
+	}
+	if err := s.logWrite(ops); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	at := s.now()
 
-	ev := &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeDelete, Object: prev}
-	for _, wch := range wchs {
-		if wch.eventTypes != nil {
-			if _, ok := wch.eventTypes[store.EventTypeDelete]; !ok {
-				continue
+	var dels, evs []*store.Event[T]
+	var prevs []T
+	if wc.KindEvents {
+		for _, k := range keys {
+			ev := &store.Event[T]{Kind: dstKind, Name: k, EventType: store.EventTypeCreate, Object: src[k], At: at, Version: s.versions[srcKind][k]}
+			if prev, ok := s.kinds[dstKind][k]; ok {
+				ev.EventType, ev.Version = store.EventTypeUpdate, s.versions[dstKind][k]+1
+				prevs = append(prevs, prev)
+			} else {
+				prevs = append(prevs, *new(T))
+			}
+			evs = append(evs, ev)
+			if move {
+				dels = append(dels, &store.Event[T]{Kind: srcKind, Name: k, EventType: store.EventTypeDelete, Object: src[k], At: at, Version: s.versions[srcKind][k]})
 			}
 		}
-		select {
-		case wch.ch <- ev:
-		default:
+	}
+
+	if move && len(s.kinds[dstKind]) == 0 {
+		s.kinds[dstKind], s.kinds[srcKind] = src, make(map[string]T)
+		s.labels[dstKind], s.labels[srcKind] = s.labels[srcKind], make(map[string]map[string]string)
+		s.modified[dstKind], s.modified[srcKind] = s.modified[srcKind], make(map[string]time.Time)
+		s.versions[dstKind], s.versions[srcKind] = s.versions[srcKind], make(map[string]int64)
+	} else {
+		for _, k := range keys {
+			v := src[k]
+			if !move {
+				v = s.clone(v)
+			}
+			if _, ok := s.kinds[dstKind][k]; ok {
+				s.touch(dstKind, k, at)
+			} else {
+				s.modified[dstKind][k] = s.modified[srcKind][k]
+				s.versions[dstKind][k] = s.versions[srcKind][k]
+			}
+			s.kinds[dstKind][k] = v
+			if l, ok := s.labels[srcKind][k]; ok {
+				s.labels[dstKind][k] = maps.Clone(l)
+			} else {
+				delete(s.labels[dstKind], k)
+			}
+			if move {
+				delete(src, k)
+				delete(s.labels[srcKind], k)
+				delete(s.modified[srcKind], k)
+				delete(s.versions[srcKind], k)
+			}
 		}
 	}
-	return existed, prev, nil
+	first := s.unlockTurns(2)
+
+	s.publish(srcKind, first, dels, nil)
+	s.publish(dstKind, nthTurn(first, 1), evs, prevs)
+	return len(keys), nil
 }
 
-func (s *memStore[T]) SetFn(kind, key string, fn func(v T) (T, error)) (bool, error) {
+func (s *memStore[T]) SetFn(kind, key string, fn func(v T) (T, error), opts ...store.WriteOption) (bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
@@ -300,93 +1485,424 @@ func (s *memStore[T]) SetFn(kind, key string, fn func(v T) (T, error)) (bool, er
 		s.mu.Unlock()
 		return false, store.ErrKeyNotFound
 	}
-	value, err := fn(prev)
+	value, err := fn(s.clone(prev))
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	value, err = s.prepare(kind, key, value)
 	if err != nil {
 		s.mu.Unlock()
 		return false, err
 	}
+	// compared once normalized, so that fn returning the stored value in
+	// another form is a no-op, as it is in Set and in the sqlite store
+	if s.compareFn(prev, value) {
+		s.mu.Unlock()
+		return false, nil
+	}
+	if err := s.logSets(kind, []string{key}, map[string]T{key: value}); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
 	// update value
 	s.kinds[kind][key] = value
-	// copy watchers then unlock
-	wchs := make([]*watcher[T], 0, len(s.watchers[kind]))
-	for _, ch := range s.watchers[kind] {
-		wchs = append(wchs, ch)
+	at := s.now()
+	version := s.touch(kind, key, at)
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, []*store.Event[T]{{Kind: kind, Name: key, EventType: store.EventTypeUpdate, Object: value, At: at, Version: version, Silent: wc.Silent}}, []T{prev})
+	return false, nil
+}
+
+func (s *memStore[T]) Swap(kind, keyA, keyB string) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
 	}
-	s.mu.Unlock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return store.ErrClosed
+	}
+	a, okA := s.kinds[kind][keyA]
+	b, okB := s.kinds[kind][keyB]
+	if !okA || !okB {
+		s.mu.Unlock()
+		return store.ErrKeyNotFound
+	}
+	if keyA == keyB || s.compareFn(a, b) {
+		s.mu.Unlock()
+		return nil
+	}
+	if err := s.logSets(kind, []string{keyA, keyB}, map[string]T{keyA: b, keyB: a}); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.kinds[kind][keyA], s.kinds[kind][keyB] = b, a
+	at := s.now()
+	versionA, versionB := s.touch(kind, keyA, at), s.touch(kind, keyB, at)
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, []*store.Event[T]{
+		{Kind: kind, Name: keyA, EventType: store.EventTypeUpdate, Object: b, At: at, Version: versionA},
+		{Kind: kind, Name: keyB, EventType: store.EventTypeUpdate, Object: a, At: at, Version: versionB},
+	}, []T{a, b})
+	return nil
+}
 
-	ev := &store.Event[T]{
-		Kind:      kind,
-		Name:      key,
-		EventType: store.EventTypeUpdate,
-		Object:    value,
+// publish runs the AfterWrite hook for each applied write, then delivers the
+// events to the watchers of kind without blocking. prevs, if not nil, holds
+// the value each update replaced, by index. The read lock is held so a
+// concurrent cancel cannot close a channel mid-send and the key allowlists
+// cannot change underneath us. Synchronous watchers get their events once
+// it is released, so that their consumers can read the store meanwhile,
+// in the order of the writes' turns (unlockTurn).
+func (s *memStore[T]) publish(kind string, turn uint64, evs []*store.Event[T], prevs []T) {
+	if turn != 0 {
+		defer s.turns.end(turn)
+	}
+	if len(evs) == 0 {
+		return
+	}
+	// event objects are the stored values
+	pubs := make([]published[T], len(evs))
+	for i, ev := range evs {
+		ev.Object = s.clone(ev.Object)
+		pubs[i].ev = ev
+		if prevs != nil {
+			pubs[i].prev = prevs[i]
+		}
 	}
-	for _, wch := range wchs {
-		if wch.eventTypes != nil {
-			if _, ok := wch.eventTypes[store.EventTypeUpdate]; !ok {
+	if s.afterWrite != nil {
+		for _, ev := range evs {
+			s.afterWrite(ev)
+		}
+	}
+	var evict []string
+	type waiting struct {
+		w   *watcher[T]
+		evs []*store.Event[T]
+	}
+	var waits []waiting
+	deliver := func(id string, wch *watcher[T]) {
+		var wait []*store.Event[T]
+		for _, p := range pubs {
+			// silent events only go to the history
+			if p.ev.Silent || !wch.wants(p) {
+				continue
+			}
+			if wch.synchronous {
+				// watchers subscribed after the write took its turn
+				// don't get it
+				if turn > wch.fromTurn {
+					wait = append(wait, p.ev)
+				}
 				continue
 			}
+			if !wch.send(p.ev) {
+				evict = append(evict, id)
+				return
+			}
 		}
-		select {
-		case wch.ch <- ev:
-		default: // no blocking
+		if len(wait) > 0 {
+			waits = append(waits, waiting{wch, wait})
 		}
 	}
-	return false, nil
+	s.mu.RLock()
+	s.record(kind, pubs)
+	for id, wch := range s.watchers[kind] {
+		deliver(id, wch)
+	}
+	for id, wch := range s.allWatchers {
+		deliver(id, wch)
+	}
+	s.mu.RUnlock()
+	if len(waits) > 0 {
+		s.turns.wait(turn)
+		for _, w := range waits {
+			w.w.sendWait(w.evs)
+		}
+	}
+
+	if len(evict) > 0 {
+		s.mu.Lock()
+		for _, id := range evict {
+			s.removeWatcher(kind, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// record adds evs to kind's history. Callers hold s.mu, so a watcher
+// registering meanwhile sees each event either in the history or published.
+func (s *memStore[T]) record(kind string, pubs []published[T]) {
+	if s.historySize <= 0 {
+		return
+	}
+	s.muHistory.Lock()
+	defer s.muHistory.Unlock()
+	r := s.history[kind]
+	if r == nil {
+		r = &ring[published[T]]{}
+		s.history[kind] = r
+	}
+	for _, p := range pubs {
+		s.seqs[kind]++
+		p.ev.Seq = s.seqs[kind]
+		r.push(s.historySize, p)
+	}
+}
+
+// replayHistory sends wch the recorded events of its kinds that it wants,
+// as many of the newest as fit in its buffer. Callers hold s.mu locked, so
+// no event is published to wch before them.
+//
+// It returns the keys whose latest recorded change was sent and left them
+// in place, which an initial replay need not repeat.
+func (s *memStore[T]) replayHistory(wch *watcher[T], last int) map[kindKey]struct{} {
+	var evs []*store.Event[T]
+	latest := make(map[kindKey]*store.Event[T])
+	s.muHistory.Lock()
+	kinds := wch.kinds
+	if wch.all {
+		// kinds whose keys are all deleted have history too
+		kinds = sortedKeys(s.history)
+	}
+	for _, kind := range kinds {
+		if r := s.history[kind]; r != nil {
+			for _, p := range r.items() {
+				latest[kindKey{kind, p.ev.Name}] = p.ev
+				if wch.wants(p) {
+					evs = append(evs, p.ev)
+				}
+			}
+		}
+	}
+	s.muHistory.Unlock()
+	if last > 0 && len(evs) > last {
+		evs = evs[len(evs)-last:]
+	}
+	if len(evs) > cap(wch.ch) {
+		evs = evs[len(evs)-cap(wch.ch):]
+	}
+	covered := make(map[kindKey]struct{})
+	for _, ev := range evs {
+		k := kindKey{ev.Kind, ev.Name}
+		if latest[k] == ev && ev.EventType != store.EventTypeDelete {
+			covered[k] = struct{}{}
+		}
+		e := *ev
+		e.Object = s.clone(e.Object)
+		wch.ch <- &e
+		wch.delivered.Add(1)
+	}
+	return covered
+}
+
+// removeWatcher unsubscribes a watcher from every kind it watches and
+// closes its channel; it is a no-op if the watcher is already gone. Callers
+// hold s.mu.
+func (s *memStore[T]) removeWatcher(kind, id string) {
+	wch, ok := s.allWatchers[id]
+	if ok {
+		delete(s.allWatchers, id)
+	} else if wch, ok = s.watchers[kind][id]; ok {
+		for _, k := range wch.kinds {
+			delete(s.watchers[k], id)
+		}
+	} else {
+		return
+	}
+	if wch.synchronous {
+		s.syncWatchers--
+	}
+	wch.close()
+}
+
+// WatcherCount returns how many watchers are subscribed. A watcher of
+// several kinds is registered under each with one id.
+func (s *memStore[T]) WatcherCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make(map[string]struct{})
+	for _, m := range s.watchers {
+		for id := range m {
+			ids[id] = struct{}{}
+		}
+	}
+	return len(ids) + len(s.allWatchers)
+}
+
+// KindWatcherCount returns how many watchers receive the events of kind.
+func (s *memStore[T]) KindWatcherCount(kind string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.watchers[kind]) + len(s.allWatchers)
 }
 
 func (s *memStore[T]) Watch(kind string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
-	if kind == "" {
-		return nil, nil, store.ErrKindRequired
+	h, err := s.WatchH(kind, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.C, h.Cancel, nil
+}
+
+func (s *memStore[T]) WatchH(kind string, opts ...store.WatchOption[T]) (*store.WatchHandle[T], error) {
+	return s.watch([]string{kind}, false, opts...)
+}
+
+func (s *memStore[T]) WatchKinds(kinds []string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	if len(kinds) == 0 {
+		return nil, nil, store.ErrNoKinds
+	}
+	h, err := s.watch(kinds, false, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.C, h.Cancel, nil
+}
+
+func (s *memStore[T]) WatchAll(opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	h, err := s.watch(nil, true, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.C, h.Cancel, nil
+}
+
+// watch registers one watcher under each of kinds, or, with all, for
+// every kind.
+func (s *memStore[T]) watch(kinds []string, all bool, opts ...store.WatchOption[T]) (*store.WatchHandle[T], error) {
+	if err := s.checkKind(kinds...); err != nil {
+		return nil, err
 	}
 	cfg := &store.WatchCfg[T]{}
 	for _, o := range opts {
 		o(cfg)
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckFeatures("gomap", s.watchFeatures()); err != nil {
+		return nil, err
+	}
+	kinds = uniqueKinds(kinds)
 
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
-		return nil, nil, store.ErrClosed
+		return nil, store.ErrClosed
+	}
+	if all {
+		kinds = sortedKeys(s.kinds)
 	}
-	s.ensureKind(kind)
 
 	bufSize := cfg.BufferSize
 	if bufSize <= 0 {
 		bufSize = store.DefaultWatchBufferSize
 	}
+	if cfg.Synchronous {
+		bufSize = 0
+	}
 	id := strconv.FormatUint(s.watcherID.Add(1), 10)
 	wch := &watcher[T]{
-		ch:         make(chan *store.Event[T], bufSize),
-		eventTypes: cfg.EventTypes,
+		kinds:       kinds,
+		all:         all,
+		ch:          make(chan *store.Event[T], bufSize),
+		done:        make(chan struct{}),
+		eventTypes:  cfg.EventTypes,
+		keys:        make(map[string]struct{}, len(cfg.Keys)),
+		evictAfter:  cfg.EvictAfterDrops,
+		transition:  cfg.Transition,
+		minVersions: store.NewVersionFilter(cfg.MinVersions),
+		synchronous: cfg.Synchronous,
+		started:     time.Now(),
 	}
-	s.watchers[kind][id] = wch
-
-	// capture snapshot for optional initial replay
-	var snap map[string]T
-	if cfg.Initial {
-		snap = cloneMap(s.kinds[kind])
+	maps.Copy(wch.keys, cfg.Keys)
+	if cfg.Synchronous {
+		cfg.Saturation = nil
+		wch.evictAfter = 0
+		wch.fromTurn = s.turns.issued
+		s.syncWatchers++
+	}
+	if all {
+		wch.saturation = store.NewSaturationMonitor(cfg.Saturation, nil, wch.stats)
+	} else {
+		wch.saturation = store.NewSaturationMonitor(cfg.Saturation, kinds, wch.stats)
+	}
+	if all {
+		s.allWatchers[id] = wch
+	} else {
+		for _, kind := range kinds {
+			s.ensureKind(kind)
+			s.watchers[kind][id] = wch
+		}
+	}
+	var covered map[kindKey]struct{}
+	if cfg.History {
+		covered = s.replayHistory(wch, cfg.ReplayLast)
 	}
-	s.mu.Unlock()
 
-	// used to cancel the initial snapshot goroutine
-	doneCh := make(chan struct{})
-	// send initial snapshot (nil eventTypes means all events)
-	sendInitial := wch.eventTypes == nil
-	if !sendInitial {
-		_, sendInitial = wch.eventTypes[store.EventTypeCreate]
-	}
-	if cfg.Initial && len(snap) > 0 && sendInitial {
-		go func(m map[string]T) {
-			for k, v := range m {
-				ev := &store.Event[T]{
+	// capture snapshot for optional initial replay, in kinds order
+	var snap []*store.Event[T]
+	if cfg.Initial {
+		for _, kind := range kinds {
+			for k, v := range s.kinds[kind] {
+				if len(wch.keys) > 0 {
+					if _, ok := wch.keys[k]; !ok {
+						continue
+					}
+				}
+				if _, ok := covered[kindKey{kind, k}]; ok {
+					continue
+				}
+				version := s.versions[kind][k]
+				if wch.minVersions.Stale(k, store.EventTypeCreate, version) {
+					continue
+				}
+				if wch.transition != nil {
+					var zero T
+					if !wch.transition(zero, v) {
+						continue
+					}
+				}
+				snap = append(snap, &store.Event[T]{
 					Kind:      kind,
 					Name:      k,
 					EventType: store.EventTypeCreate,
 					Object:    v,
+					At:        s.modified[kind][k],
+					Version:   version,
+				})
+			}
+		}
+	}
+	if len(snap) > 0 && wch.synchronous {
+		// taken before any write can publish, so that the snapshot comes
+		// first
+		wch.replayMu.Lock()
+	}
+	s.mu.Unlock()
+
+	// send initial snapshot
+	if len(snap) > 0 {
+		go func(evs []*store.Event[T]) {
+			if !wch.synchronous {
+				wch.replayMu.Lock()
+			}
+			defer wch.replayMu.Unlock()
+			for _, ev := range evs {
+				ev.Object = s.clone(ev.Object)
+				select {
+				case <-wch.done:
+					return
+				default:
 				}
 				select {
 				case wch.ch <- ev:
-				case <-doneCh:
+					wch.delivered.Add(1)
+				case <-wch.done:
 					return
 				}
 			}
@@ -397,15 +1913,28 @@ func (s *memStore[T]) Watch(kind string, opts ...store.WatchOption[T]) (<-chan *
 	cancel := func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
-		if w, ok := s.watchers[kind]; ok {
-			if wch, ok := w[id]; ok {
-				delete(w, id)
-				close(doneCh)
-				close(wch.ch)
-			}
+		if all {
+			s.removeWatcher("", id)
+		}
+		for _, kind := range kinds {
+			s.removeWatcher(kind, id)
 		}
 	}
-	return wch.ch, cancel, nil
+	return &store.WatchHandle[T]{
+		C:      wch.ch,
+		Cancel: cancel,
+		AddKey: func(key string) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			wch.keys[key] = struct{}{}
+		},
+		RemoveKey: func(key string) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(wch.keys, key)
+		},
+		Stats: wch.stats,
+	}, nil
 }
 
 func (s *memStore[T]) Close() error {
@@ -415,12 +1944,17 @@ func (s *memStore[T]) Close() error {
 		return nil
 	}
 	s.closed = true
-	for _, m := range s.watchers {
-		for id, wch := range m {
-			delete(m, id)
-			close(wch.ch)
+	for kind, m := range s.watchers {
+		for id := range m {
+			s.removeWatcher(kind, id)
 		}
 	}
+	for id := range s.allWatchers {
+		s.removeWatcher("", id)
+	}
+	if s.journal != nil {
+		return s.journal.close()
+	}
 	return nil
 }
 
@@ -444,10 +1978,26 @@ func (s *memStore[T]) GetAll() (map[string]map[string]T, error) {
 	if s.closed {
 		return nil, store.ErrClosed
 	}
-	// deep clone: clone outer map and each inner map
+	total := 0
+	for _, m := range s.kinds {
+		total += len(m)
+	}
+	if err := store.CheckResultSize(total, s.maxGetAll); err != nil {
+		return nil, err
+	}
+	// deep clone: clone outer map and each inner map; like Kinds, leave
+	// out kinds whose keys were all deleted
 	out := make(map[string]map[string]T, len(s.kinds))
 	for kind, m := range s.kinds {
+		if len(m) == 0 {
+			continue
+		}
 		out[kind] = cloneMap(m)
+		if s.cloneOnRead && s.cloneFn != nil {
+			for k, v := range out[kind] {
+				out[kind][k] = s.cloneFn(v)
+			}
+		}
 	}
 	return out, nil
 }
@@ -1,9 +1,23 @@
 package gomap
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/storetest"
 )
 
 func Test_memStore_Set(t *testing.T) {
@@ -61,3 +75,2237 @@ func Test_memStore_Set(t *testing.T) {
 		})
 	}
 }
+
+func Test_memStore_Normalize(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[string]{
+		NormalizeFns: map[string]store.NormalizeFunc[string]{
+			"emails": func(v string) (string, error) {
+				if v == "" {
+					return v, errors.New("empty")
+				}
+				return strings.ToLower(strings.TrimSpace(v)), nil
+			},
+		},
+	})
+	defer ms.Close()
+
+	if _, err := ms.Set("emails", "a", " Alice@Example.com"); err != nil {
+		t.Fatalf("Set() failed: %v", err)
+	}
+	if got, _, _ := ms.Get("emails", "a"); got != "alice@example.com" {
+		t.Errorf("Get() = %q, want normalized value", got)
+	}
+
+	ch, cancel, err := ms.Watch("emails")
+	if err != nil {
+		t.Fatalf("Watch() failed: %v", err)
+	}
+	defer cancel()
+
+	// un-normalized value equal to the stored canonical form is a no-op
+	if _, err := ms.Set("emails", "a", "ALICE@example.com "); err != nil {
+		t.Fatalf("Set() failed: %v", err)
+	}
+	if _, err := ms.SetFn("emails", "a", func(v string) (string, error) { return strings.ToUpper(v), nil }); err != nil {
+		t.Fatalf("SetFn() failed: %v", err)
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event for normalized no-op: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = ms.Set("emails", "b", "")
+	var nerr *store.NormalizeError
+	if !errors.As(err, &nerr) || nerr.Key != "b" {
+		t.Fatalf("Set() error = %v, want NormalizeError", err)
+	}
+	if _, ok, _ := ms.Get("emails", "b"); ok {
+		t.Error("value stored despite normalization error")
+	}
+}
+
+func Test_memStore_WatchHandleKeys(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+
+	h, err := store.WatchH(ms, "kind", store.WithKeys[int]("a"))
+	if err != nil {
+		t.Fatalf("WatchH() failed: %v", err)
+	}
+	defer h.Cancel()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case ev := <-h.C:
+			if ev.Name != want {
+				t.Errorf("event name = %s, want %s", ev.Name, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for event on %s", want)
+		}
+	}
+
+	_, _ = ms.Set("kind", "b", 1)
+	_, _ = ms.Set("kind", "a", 1)
+	expect("a")
+
+	h.AddKey("b")
+	_ = ms.SetAll("kind", map[string]int{"b": 2, "c": 2})
+	expect("b")
+
+	// an empty allowlist delivers every key again
+	h.RemoveKey("a")
+	h.RemoveKey("b")
+	_, _ = ms.Set("kind", "c", 3)
+	expect("c")
+}
+
+func Test_memStore_SetIdempotencyKey(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{IdempotencyWindow: 50 * time.Millisecond})
+	defer ms.Close()
+
+	ch, cancel, err := ms.Watch("kind")
+	if err != nil {
+		t.Fatalf("Watch() failed: %v", err)
+	}
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		created, err := ms.Set("kind", "k", 1, store.WithIdempotencyKey("req-1"))
+		if err != nil || !created {
+			t.Fatalf("Set() = %v, %v, want original result true", created, err)
+		}
+	}
+	_, _ = ms.Set("kind", "k", 2)
+	_, _ = ms.Set("kind", "k", 1, store.WithIdempotencyKey("req-1"))
+	if got, _, _ := ms.Get("kind", "k"); got != 2 {
+		t.Errorf("Get() = %d, replayed write was re-applied", got)
+	}
+	if len(ch) != 2 {
+		t.Errorf("received %d events, want 2", len(ch))
+	}
+
+	// once the window has passed the id is forgotten
+	time.Sleep(60 * time.Millisecond)
+	_, _ = ms.Set("kind", "k", 1, store.WithIdempotencyKey("req-1"))
+	if got, _, _ := ms.Get("kind", "k"); got != 1 {
+		t.Errorf("Get() = %d, want 1 after the window expired", got)
+	}
+}
+
+func Test_memStore_IdempotencyEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ms := newMemStore(store.StoreOptions[int]{IdempotencyWindow: time.Minute, Now: func() time.Time { return now }})
+	for i := 0; i < 3; i++ {
+		_, _ = ms.Set("kind", "k", i+1, store.WithIdempotencyKey(fmt.Sprint("req-", i)))
+	}
+	if r := ms.idem[idemKey{"kind", "k", "req-2"}]; !(r == idemRecord{version: 3, at: now}) {
+		t.Errorf("record = %+v", r)
+	}
+
+	now = now.Add(30 * time.Second)
+	_, _ = ms.Set("kind", "k", 4, store.WithIdempotencyKey("req-3"))
+	now = now.Add(45 * time.Second)
+	// the injected clock expires the first three keys only
+	if _, err := ms.Set("kind", "k", 5, store.WithIdempotencyKey("req-0")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := ms.Get("kind", "k"); got != 5 {
+		t.Errorf("Get() = %d, expired key not forgotten", got)
+	}
+	if len(ms.idem) != 2 || len(ms.idemOrder) != 2 {
+		t.Errorf("%d keys, %d queued, want 2", len(ms.idem), len(ms.idemOrder))
+	}
+}
+
+func Test_memStore_Labels(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+
+	_, _ = store.SetLabeled(ms, "pods", "web-1", 1, map[string]string{"app": "web", "env": "prod"})
+	_, _ = store.SetLabeled(ms, "pods", "web-2", 2, map[string]string{"app": "web", "env": "dev"})
+	_, _ = ms.Set("pods", "plain", 3)
+
+	kvs, err := store.SelectByLabel(ms, "pods", map[string]string{"app": "web", "env": "prod"})
+	if err != nil {
+		t.Fatalf("SelectByLabel() failed: %v", err)
+	}
+	if len(kvs) != 1 || kvs[0].Key != "web-1" {
+		t.Errorf("SelectByLabel() = %v, want web-1", kvs)
+	}
+
+	_, _, _ = ms.Delete("pods", "web-1")
+	_, _ = ms.Set("pods", "web-1", 1)
+	if kvs, _ := store.SelectByLabel(ms, "pods", map[string]string{"app": "web"}); len(kvs) != 1 {
+		t.Errorf("labels survived Delete: %v", kvs)
+	}
+}
+
+func Test_memStore_Snapshot(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+
+	_ = ms.SetAll("kind", map[string]int{"a": 1, "b": 2})
+	view, release, err := store.Snapshot(ms, "kind")
+	if err != nil {
+		t.Fatalf("Snapshot() failed: %v", err)
+	}
+
+	_, _ = ms.Set("kind", "c", 3)
+	_, _, _ = ms.Delete("kind", "a")
+	_, _ = ms.Set("kind", "b", 20)
+
+	if n, _ := view.Count("kind"); n != 2 {
+		t.Errorf("view.Count() = %d, want 2", n)
+	}
+	if v, ok, _ := view.Get("kind", "b"); !ok || v != 2 {
+		t.Errorf("view.Get(b) = %d, %v, want frozen value 2", v, ok)
+	}
+	if _, err := view.Keys("other"); !errors.Is(err, store.ErrOutsideSnapshot) {
+		t.Errorf("view.Keys(other) error = %v, want ErrOutsideSnapshot", err)
+	}
+
+	release()
+	if _, err := view.List("kind"); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("view.List() after release error = %v, want ErrClosed", err)
+	}
+}
+
+func Test_memStore_KeySegments(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+
+	for _, k := range []string{"org1/team1/u1", "org1/team2/u2", "org2/u3", "readme", "trail/"} {
+		_, _ = ms.Set("paths", k, 1)
+	}
+	got, err := store.KeySegments(ms, "paths", "/", "")
+	if err != nil {
+		t.Fatalf("KeySegments() failed: %v", err)
+	}
+	if want := "[org1/ org2/ readme trail/]"; fmt.Sprint(got) != want {
+		t.Errorf("KeySegments() = %v, want %v", got, want)
+	}
+	if got, _ := store.KeySegments(ms, "paths", "/", "org1/"); fmt.Sprint(got) != "[team1/ team2/]" {
+		t.Errorf("KeySegments(org1/) = %v", got)
+	}
+	if got, _ := store.KeySegments(ms, "paths", "/", "trail/"); len(got) != 0 {
+		t.Errorf("KeySegments(trail/) = %v, want none", got)
+	}
+	if m, _ := store.ListPrefix(ms, "paths", "org1/"); len(m) != 2 {
+		t.Errorf("ListPrefix() = %v", m)
+	}
+}
+
+func Test_memStore_EmptyKind(t *testing.T) {
+	s := NewMemStore[string](store.StoreOptions[string]{})
+	defer s.Close()
+
+	ch, cancel, err := s.Watch("")
+	if err != nil {
+		t.Fatalf("Watch on the empty kind: %v", err)
+	}
+	defer cancel()
+
+	if created, err := s.Set("", "a", "1"); err != nil || !created {
+		t.Fatalf("Set: created=%v err=%v", created, err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.Kind != "" || ev.Name != "a" || ev.EventType != store.EventTypeCreate {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected create event on the empty kind")
+	}
+
+	if v, ok, err := s.Get("", "a"); err != nil || !ok || v != "1" {
+		t.Fatalf("Get: %q %v %v", v, ok, err)
+	}
+	if n, _ := s.Count(""); n != 1 {
+		t.Fatalf("Count = %d", n)
+	}
+	kinds, _ := store.Kinds(s)
+	if len(kinds) != 1 || kinds[0] != "" {
+		t.Fatalf("Kinds = %q", kinds)
+	}
+	if existed, _, err := s.Delete("", "a"); err != nil || !existed {
+		t.Fatalf("Delete: existed=%v err=%v", existed, err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeDelete {
+			t.Fatalf("expected delete event, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected delete event on the empty kind")
+	}
+}
+
+func Test_memStore_EvictAfterDrops(t *testing.T) {
+	s := NewMemStore[int](store.StoreOptions[int]{})
+	defer s.Close()
+
+	slow, _, err := s.Watch("k", store.WithBufferSize[int](1), store.WithEvictAfterDrops[int](3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, cancel, err := s.Watch("k", store.WithBufferSize[int](1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	// fills the buffer, then two drops: not evicted yet
+	for i := 0; i < 3; i++ {
+		s.Set("k", "a", i+1)
+	}
+	if ev := <-slow; ev.Object != 1 {
+		t.Fatalf("expected first event, got %+v", ev)
+	}
+	// the successful send resets the count
+	for i := 3; i < 6; i++ {
+		s.Set("k", "a", i+1)
+	}
+	if ev, ok := <-slow; !ok || ev.Object != 4 {
+		t.Fatalf("expected watcher alive after non-consecutive drops, got %+v %v", ev, ok)
+	}
+
+	// three drops in a row evict
+	for i := 6; i < 10; i++ {
+		s.Set("k", "a", i+1)
+	}
+	if _, ok := <-slow; !ok {
+		t.Fatal("expected the buffered event before close")
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("expected evicted watcher to be closed")
+	}
+
+	// watchers without the option only drop
+	if _, ok := <-plain; !ok {
+		t.Fatal("expected watcher without eviction to stay open")
+	}
+}
+
+func Test_memStore_SetAllBatchSize(t *testing.T) {
+	var progress []int
+	s := NewMemStore[int](store.StoreOptions[int]{
+		SetAllBatchSize: 2,
+		SetAllProgress: func(kind string, done, total int) {
+			if kind != "k" || total != 5 {
+				t.Errorf("progress(%q, %d, %d)", kind, done, total)
+			}
+			progress = append(progress, done)
+		},
+	})
+	defer s.Close()
+
+	s.Set("k", "c", 100)
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+
+	if err := s.SetAll("k", map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[2 4 5]" {
+		t.Fatalf("progress = %v", progress)
+	}
+	if n, _ := s.Count("k"); n != 5 {
+		t.Fatalf("Count = %d", n)
+	}
+	types := map[string]store.EventType{}
+	for i := 0; i < 5; i++ {
+		select {
+		case ev := <-ch:
+			types[ev.Name] = ev.EventType
+		case <-time.After(time.Second):
+			t.Fatalf("expected 5 events, got %d", i)
+		}
+	}
+	if types["c"] != store.EventTypeUpdate || types["a"] != store.EventTypeCreate {
+		t.Fatalf("event types = %v", types)
+	}
+}
+
+func Test_memStore_AfterWrite(t *testing.T) {
+	var after []string
+	s := NewMemStore[int](store.StoreOptions[int]{
+		AfterWrite: func(ev *store.Event[int]) {
+			after = append(after, fmt.Sprintf("%s:%s=%d", ev.EventType, ev.Name, ev.Object))
+		},
+	})
+	defer s.Close()
+
+	s.Set("k", "a", 1)
+	s.Set("k", "a", 1) // no-op
+	s.SetFn("k", "a", func(v int) (int, error) { return v + 1, nil })
+	s.SetAll("k", map[string]int{"b": 3})
+	s.Delete("k", "b")
+
+	want := "create:a=1,update:a=2,create:b=3,delete:b=3"
+	if got := strings.Join(after, ","); got != want {
+		t.Fatalf("AfterWrite saw %s, want %s", got, want)
+	}
+}
+
+func Test_memStore_CloneFn(t *testing.T) {
+	s := NewMemStore[[]string](store.StoreOptions[[]string]{
+		CloneFn:     func(v []string) []string { return append([]string(nil), v...) },
+		CloneOnRead: true,
+	})
+	defer s.Close()
+
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+	s.Set("k", "a", []string{"x"})
+	select {
+	case ev := <-ch:
+		ev.Object[0] = "watcher"
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	v, _, _ := s.Get("k", "a")
+	if v[0] != "x" {
+		t.Fatalf("watcher mutation reached the store: %v", v)
+	}
+	v[0] = "getter"
+	l, _ := s.List("k")
+	if l["a"][0] != "x" {
+		t.Fatalf("Get mutation reached the store: %v", l["a"])
+	}
+	s.SetFn("k", "a", func(v []string) ([]string, error) {
+		v[0] = "fn"
+		return v, nil
+	})
+	if v, _, _ := s.Get("k", "a"); v[0] != "fn" {
+		t.Fatalf("SetFn in-place change not applied: %v", v)
+	}
+}
+
+func Test_memStore_WatchKinds(t *testing.T) {
+	s := NewMemStore[int](store.StoreOptions[int]{})
+	defer s.Close()
+
+	ch, cancel, err := store.WatchKinds(s, []string{"a", "b", "a"})
+	if err != nil {
+		t.Fatalf("WatchKinds() error = %v", err)
+	}
+	s.Set("b", "x", 1)
+	s.Set("c", "ignored", 2)
+	s.Set("a", "y", 3)
+	s.Delete("b", "x")
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-ch:
+			got = append(got, fmt.Sprintf("%s %s/%s", ev.EventType, ev.Kind, ev.Name))
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, want 3 events", got)
+		}
+	}
+	if g := strings.Join(got, ","); g != "create b/x,create a/y,delete b/x" {
+		t.Fatalf("events = %s", g)
+	}
+
+	cancel()
+	ms := s.(*memStore[int])
+	for _, kind := range []string{"a", "b"} {
+		if n := len(ms.watchers[kind]); n != 0 {
+			t.Errorf("%d watchers left on %q after cancel", n, kind)
+		}
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed after cancel")
+	}
+	cancel() // idempotent
+
+	// replay covers every kind
+	s.Set("b", "z", 4)
+	ch, cancel, _ = store.WatchKinds(s, []string{"a", "b"}, store.WithInitialReplay[int]())
+	defer cancel()
+	replayed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-ch:
+			replayed[ev.Kind+"/"+ev.Name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("replayed %v, want 2 events", replayed)
+		}
+	}
+	if !replayed["a/y"] || !replayed["b/z"] {
+		t.Errorf("replayed %v", replayed)
+	}
+
+	if _, _, err := store.WatchKinds(s, nil); !errors.Is(err, store.ErrNoKinds) {
+		t.Errorf("WatchKinds(nil) error = %v, want ErrNoKinds", err)
+	}
+}
+
+func Test_memStore_Defaults(t *testing.T) {
+	var created []string
+	s := NewMemStore[int](store.StoreOptions[int]{
+		Defaults: map[string]map[string]int{
+			"flags": {"a": 1, "b": 2},
+		},
+		AfterWrite: func(ev *store.Event[int]) {
+			created = append(created, fmt.Sprintf("%s %s/%s", ev.EventType, ev.Kind, ev.Name))
+		},
+	})
+	defer s.Close()
+
+	if m, _ := s.List("flags"); len(m) != 2 || m["a"] != 1 || m["b"] != 2 {
+		t.Fatalf("List = %v", m)
+	}
+	if got := strings.Join(created, ","); got != "create flags/a,create flags/b" {
+		t.Errorf("events = %s", got)
+	}
+
+	invalid := store.StoreOptions[int]{
+		Defaults:    map[string]map[string]int{"k": {"a": -1}},
+		ValidateFns: map[string]store.ValidateFunc[int]{"k": func(v int) error { return errors.New("negative") }},
+	}
+	if _, err := New(invalid); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("New() with an invalid default = %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("invalid default did not panic")
+		}
+	}()
+	NewMemStore[int](invalid)
+}
+
+func Test_memStore_EventAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemStore[int](store.StoreOptions[int]{Now: func() time.Time { return now }})
+	defer s.Close()
+
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+	next := func() *store.Event[int] {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return nil
+		}
+	}
+
+	t1 := now
+	s.Set("k", "a", 1)
+	if ev := next(); !ev.At.Equal(t1) {
+		t.Errorf("Set event At = %v, want %v", ev.At, t1)
+	}
+	now = now.Add(time.Minute)
+	s.SetFn("k", "a", func(v int) (int, error) { return v + 1, nil })
+	if ev := next(); !ev.At.Equal(now) {
+		t.Errorf("SetFn event At = %v, want %v", ev.At, now)
+	}
+	t2 := now
+	now = now.Add(time.Minute)
+	s.SetAll("k", map[string]int{"b": 2})
+	if ev := next(); !ev.At.Equal(now) {
+		t.Errorf("SetAll event At = %v, want %v", ev.At, now)
+	}
+	t3 := now
+	now = now.Add(time.Minute)
+	s.Set("k", "c", 3)
+	next()
+	s.Delete("k", "c")
+	if ev := next(); ev.EventType != store.EventTypeDelete || !ev.At.Equal(now) {
+		t.Errorf("Delete event = %s at %v, want %v", ev.EventType, ev.At, now)
+	}
+
+	// replay reports when each key last changed, not now
+	now = now.Add(time.Hour)
+	rch, rcancel, _ := s.Watch("k", store.WithInitialReplay[int]())
+	defer rcancel()
+	want := map[string]time.Time{"a": t2, "b": t3}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-rch:
+			if !ev.At.Equal(want[ev.Name]) {
+				t.Errorf("replayed %s At = %v, want %v", ev.Name, ev.At, want[ev.Name])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no replay")
+		}
+	}
+}
+
+func Test_memStore_CloneOnRead(t *testing.T) {
+	type testData struct {
+		Name  string
+		Value int
+	}
+	cloneFn := func(v *testData) *testData {
+		c := *v
+		return &c
+	}
+	for _, onRead := range []bool{false, true} {
+		t.Run(fmt.Sprintf("CloneOnRead=%v", onRead), func(t *testing.T) {
+			s := NewMemStore[*testData](store.StoreOptions[*testData]{CloneFn: cloneFn, CloneOnRead: onRead})
+			defer s.Close()
+			s.Set("k", "a", &testData{Name: "a", Value: 1})
+
+			v, _, _ := s.Get("k", "a")
+			v.Value = 2
+			l, _ := s.List("k")
+			l["a"].Name = "changed"
+			all, _ := s.GetAll()
+			all["k"]["a"].Value = 3
+
+			got, _, _ := s.Get("k", "a")
+			isolated := got.Name == "a" && got.Value == 1
+			if isolated != onRead {
+				t.Errorf("re-read = %+v, isolated = %v, want %v", got, isolated, onRead)
+			}
+		})
+	}
+}
+
+func BenchmarkList10k(b *testing.B) {
+	cloneFn := func(v []string) []string { return append([]string(nil), v...) }
+	for _, onRead := range []bool{false, true} {
+		b.Run(fmt.Sprintf("CloneOnRead=%v", onRead), func(b *testing.B) {
+			s := NewMemStore[[]string](store.StoreOptions[[]string]{CloneFn: cloneFn, CloneOnRead: onRead})
+			defer s.Close()
+			values := make(map[string][]string, 10000)
+			for i := 0; i < 10000; i++ {
+				values[fmt.Sprintf("key-%05d", i)] = []string{"a", "b", "c"}
+			}
+			s.SetAll("k", values)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.List("k"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_memStore_ReplayHistory(t *testing.T) {
+	s := NewMemStore[int](store.StoreOptions[int]{EventHistory: 3})
+	defer s.Close()
+	for i := 1; i <= 5; i++ {
+		s.Set("k", fmt.Sprint("key", i), i)
+	}
+	s.Set("other", "x", 0)
+
+	ch, cancel, _ := s.Watch("k", store.WithReplayHistory[int]())
+	defer cancel()
+	s.Set("k", "key6", 6)
+	for _, want := range []int{3, 4, 5, 6} {
+		select {
+		case ev := <-ch:
+			if ev.Object != want || ev.Name != fmt.Sprint("key", want) {
+				t.Fatalf("event = %s %v, want key%d %d", ev.Name, ev.Object, want, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %d", want)
+		}
+	}
+
+	// without the option, or filtered out, nothing is replayed
+	plain, cancelPlain, _ := s.Watch("k")
+	defer cancelPlain()
+	filtered, cancelFiltered, _ := s.Watch("k", store.WithReplayHistory[int](), store.WithEventTypes[int](store.EventTypeDelete))
+	defer cancelFiltered()
+	if len(plain) != 0 || len(filtered) != 0 {
+		t.Fatalf("replayed %d and %d events, want none", len(plain), len(filtered))
+	}
+}
+
+func Test_memStore_TransitionFilter(t *testing.T) {
+	s := NewMemStore[string](store.StoreOptions[string]{EventHistory: 10})
+	defer s.Close()
+	// set to empty, from a non-empty value or by deleting one
+	emptied := store.WithTransitionFilter[string](func(old, new string) bool {
+		return old != "" && new == ""
+	})
+	s.Set("k", "seeded", "")
+	ch, cancel, _ := s.Watch("k", emptied, store.WithInitialReplay[string]())
+	defer cancel()
+
+	s.Set("k", "a", "")
+	s.Set("k", "a", "x")
+	s.Set("k", "a", "")
+	s.Set("k", "b", "y")
+	s.SetFn("k", "b", func(string) (string, error) { return "", nil })
+	s.Set("k", "c", "z")
+	s.SetAll("k", map[string]string{"c": ""})
+	s.Set("k", "d", "w")
+	s.Delete("k", "d")
+	s.Delete("k", "a")
+
+	want := []string{"update:a", "update:b", "update:c", "delete:d"}
+	var got []string
+	for len(got) < len(want) {
+		select {
+		case ev := <-ch:
+			got = append(got, string(ev.EventType)+":"+ev.Name)
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") || len(ch) != 0 {
+		t.Fatalf("got %v (+%d), want %v", got, len(ch), want)
+	}
+
+	// the history keeps the replaced values
+	hist, cancelHist, _ := s.Watch("k", emptied, store.WithReplayHistory[string]())
+	defer cancelHist()
+	if len(hist) != len(want) {
+		t.Fatalf("replayed %d events, want %d", len(hist), len(want))
+	}
+
+	// creates pass the zero value as old
+	created, cancelCreated, _ := s.Watch("k", store.WithInitialReplay[string](), store.WithTransitionFilter[string](func(old, new string) bool {
+		return old == "" && new != ""
+	}))
+	defer cancelCreated()
+	s.Set("k", "e", "v")
+	if ev := <-created; ev.Name != "e" || ev.EventType != store.EventTypeCreate {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+}
+
+func Test_memStore_DeleteWithoutPrev(t *testing.T) {
+	s := NewMemStore(store.StoreOptions[string]{})
+	defer s.Close()
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+
+	s.Set("k", "a", "v")
+	<-ch
+	existed, prev, err := s.Delete("k", "a", store.WithoutPrev())
+	if err != nil || !existed || prev != "" {
+		t.Fatalf("Delete(WithoutPrev) = %v, %q, %v", existed, prev, err)
+	}
+	if ev := <-ch; ev.EventType != store.EventTypeDelete || !ev.PrevOmitted || ev.Object != "" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if existed, _, _ := s.Delete("k", "a", store.WithoutPrev()); existed {
+		t.Fatal("second Delete reported existed")
+	}
+}
+
+func Test_memStore_AllowedKinds(t *testing.T) {
+	s := NewMemStore(store.StoreOptions[string]{AllowedKinds: []string{"notes", ""}})
+	defer s.Close()
+
+	if _, err := s.Set("notes", "a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("", "a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("note", "a", "v"); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("Set of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if _, _, err := s.Get("note", "a"); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("Get of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if _, _, err := store.WatchKinds(s, []string{"notes", "note"}); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("WatchKinds with an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if kinds, _ := store.Kinds(s); len(kinds) != 2 {
+		t.Fatalf("Kinds = %v", kinds)
+	}
+}
+
+func Test_memStore_MaxResults(t *testing.T) {
+	s := NewMemStore(store.StoreOptions[int]{MaxListResults: 2, MaxGetAllResults: 3})
+	defer s.Close()
+	s.Set("a", "1", 1)
+	s.Set("a", "2", 2)
+	s.Set("b", "1", 1)
+
+	if m, err := s.List("a"); err != nil || len(m) != 2 {
+		t.Fatalf("List at the limit = %v, %v", m, err)
+	}
+	if _, err := s.GetAll(); err != nil {
+		t.Fatalf("GetAll at the limit: %v", err)
+	}
+	s.Set("a", "3", 3)
+	var tooLarge *store.ResultTooLargeError
+	if _, err := s.List("a"); !errors.As(err, &tooLarge) || tooLarge.Count != 3 || tooLarge.Limit != 2 {
+		t.Fatalf("List over the limit: got %v", err)
+	}
+	if _, err := s.Values("a"); !errors.Is(err, store.ErrResultTooLarge) {
+		t.Fatalf("Values over the limit: got %v", err)
+	}
+	if _, err := s.GetAll(); !errors.Is(err, store.ErrResultTooLarge) {
+		t.Fatalf("GetAll over the limit: got %v", err)
+	}
+	if m, err := store.ListPrefix(s, "a", ""); err != nil || len(m) != 3 {
+		t.Fatalf("ListPrefix = %v, %v", m, err)
+	}
+
+	// no limit by default
+	u := NewMemStore(store.StoreOptions[int]{})
+	defer u.Close()
+	for i := 0; i < 10; i++ {
+		u.Set("a", fmt.Sprint(i), i)
+	}
+	if m, err := u.List("a"); err != nil || len(m) != 10 {
+		t.Fatalf("List without a limit = %v, %v", m, err)
+	}
+}
+
+func Test_memStore_Swap(t *testing.T) {
+	s := NewMemStore(store.StoreOptions[string]{})
+	defer s.Close()
+	s.Set("config", "active", "blue")
+	s.Set("config", "staging", "green")
+	ch, cancel, _ := s.Watch("config")
+	defer cancel()
+
+	if err := store.Swap(s, "config", "active", "staging"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := s.Get("config", "active"); v != "green" {
+		t.Fatalf("active = %q", v)
+	}
+	if v, _, _ := s.Get("config", "staging"); v != "blue" {
+		t.Fatalf("staging = %q", v)
+	}
+	if got := []string{(<-ch).Object, (<-ch).Object}; got[0] != "green" || got[1] != "blue" {
+		t.Fatalf("event objects = %v", got)
+	}
+	if err := store.Swap(s, "config", "active", "missing"); !errors.Is(err, store.ErrKeyNotFound) {
+		t.Fatalf("Swap with a missing key: got %v", err)
+	}
+}
+
+func Test_memStore_ReplayLast(t *testing.T) {
+	s := NewMemStore[int](store.StoreOptions[int]{EventHistory: 4})
+	defer s.Close()
+	s.Set("k", "a", 1)
+	s.Set("k", "b", 1)
+	s.Set("k", "a", 2) // seq 3, the oldest kept
+	s.Set("k", "c", 1)
+	s.Set("k", "d", 1)
+	s.Delete("k", "b") // seq 6
+
+	next := func(ch <-chan *store.Event[int]) *store.Event[int] {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return nil
+		}
+	}
+
+	// the last two of the wanted events
+	ch, cancel, _ := s.Watch("k", store.WithReplayLast[int](2), store.WithEventTypes[int](store.EventTypeCreate, store.EventTypeUpdate))
+	for _, want := range []string{"c:4", "d:5"} {
+		if ev := next(ch); fmt.Sprint(ev.Name, ":", ev.Seq) != want {
+			t.Fatalf("event = %s:%d, want %s", ev.Name, ev.Seq, want)
+		}
+	}
+	if len(ch) != 0 {
+		t.Fatalf("%d more events replayed", len(ch))
+	}
+	s.Set("k", "e", 1)
+	if ev := next(ch); ev.Name != "e" || ev.Seq != 7 {
+		t.Fatalf("live event = %s:%d, want e:7", ev.Name, ev.Seq)
+	}
+	cancel()
+
+	// the initial replay leaves out e, whose latest change was replayed
+	ch, cancel, _ = s.Watch("k", store.WithReplayLast[int](2), store.WithInitialReplay[int]())
+	defer cancel()
+	if ev := next(ch); ev.Name != "b" || ev.EventType != store.EventTypeDelete || ev.Seq != 6 {
+		t.Fatalf("first event = %s %s:%d, want delete b:6", ev.EventType, ev.Name, ev.Seq)
+	}
+	if ev := next(ch); ev.Name != "e" || ev.Seq != 7 {
+		t.Fatalf("second event = %s:%d, want e:7", ev.Name, ev.Seq)
+	}
+	initial := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		ev := next(ch)
+		if ev.Seq != 0 {
+			t.Fatalf("initial event %s has Seq %d", ev.Name, ev.Seq)
+		}
+		initial[ev.Name] = true
+	}
+	if !initial["a"] || !initial["c"] || !initial["d"] || len(ch) != 0 {
+		t.Fatalf("initial replay = %v (+%d), want a, c and d", initial, len(ch))
+	}
+}
+
+func Test_memStore_WatchAll(t *testing.T) {
+	s := NewMemStore[int](store.StoreOptions[int]{})
+	s.Set("existing", "a", 1)
+
+	ch, cancel, err := store.WatchAll(s, store.WithInitialReplay[int]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			return fmt.Sprintf("%s %s/%s=%d", ev.EventType, ev.Kind, ev.Name, ev.Object)
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return ""
+		}
+	}
+	if got := next(); got != "create existing/a=1" {
+		t.Fatalf("initial replay: %s", got)
+	}
+	// a kind that didn't exist when the watcher subscribed
+	s.Set("brand-new", "x", 2)
+	if got := next(); got != "create brand-new/x=2" {
+		t.Fatalf("new kind: %s", got)
+	}
+	s.Delete("existing", "a")
+	if got := next(); got != "delete existing/a=1" {
+		t.Fatalf("existing kind: %s", got)
+	}
+
+	// Close closes the channel; cancel afterwards is a no-op
+	s.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel open after Close")
+	}
+	cancel()
+	if _, _, err := store.WatchAll(s); !errors.Is(err, store.ErrClosed) {
+		t.Fatalf("WatchAll after Close: %v", err)
+	}
+}
+
+func Test_memStore_Add(t *testing.T) {
+	s := NewMemStore[string](store.StoreOptions[string]{})
+	defer s.Close()
+	ch, cancel, _ := s.Watch("notes")
+	defer cancel()
+
+	// default keys are UUIDv7s, in the order they were added
+	k1, err := store.Add(s, "notes", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := store.Add(s, "notes", "second")
+	if len(k1) != 36 || k1[14] != '7' || k2 <= k1 {
+		t.Fatalf("keys %q, %q", k1, k2)
+	}
+	if v, _, _ := s.Get("notes", k1); v != "first" {
+		t.Fatalf("Get(%s) = %q", k1, v)
+	}
+	if ev := <-ch; ev.EventType != store.EventTypeCreate || ev.Name != k1 {
+		t.Fatalf("event %s %s", ev.EventType, ev.Name)
+	}
+
+	// CreateOnly leaves an existing value alone
+	if _, err := s.Set("notes", k1, "replaced", store.CreateOnly()); !errors.Is(err, store.ErrKeyExists) {
+		t.Fatalf("CreateOnly Set = %v", err)
+	}
+	if v, _, _ := s.Get("notes", k1); v != "first" {
+		t.Fatalf("value replaced: %q", v)
+	}
+}
+
+func Test_memStore_AddKeyGen(t *testing.T) {
+	n := 0
+	s := NewMemStore[string](store.StoreOptions[string]{KeyGen: func() string {
+		n++
+		return fmt.Sprint("id-", (n+1)/2) // each key twice
+	}})
+	defer s.Close()
+	for _, want := range []string{"id-1", "id-2"} {
+		if key, err := store.Add(s, "k", "v"); key != want || err != nil {
+			t.Fatalf("Add = %q, %v, want %s", key, err, want)
+		}
+	}
+	if n, _ := s.Count("k"); n != 2 {
+		t.Fatalf("Count = %d", n)
+	}
+
+	stuck := NewMemStore[string](store.StoreOptions[string]{KeyGen: func() string { return "same" }})
+	defer stuck.Close()
+	store.Add(stuck, "k", "v")
+	if _, err := store.Add(stuck, "k", "w"); !errors.Is(err, store.ErrKeyExists) {
+		t.Fatalf("Add with a stuck KeyGen = %v", err)
+	}
+}
+
+func Test_memStore_Conformance(t *testing.T) {
+	storetest.RunReaderTests(t, func(t *testing.T) store.Store[string] {
+		return NewMemStore[string](store.StoreOptions[string]{})
+	})
+	for _, history := range []int{0, 10} {
+		t.Run(fmt.Sprintf("EventHistory=%d", history), func(t *testing.T) {
+			storetest.RunWatchOptionTests(t, func(t *testing.T) store.Store[string] {
+				return NewMemStore[string](store.StoreOptions[string]{EventHistory: history})
+			}, "a", "b")
+		})
+	}
+	storetest.RunReplaceTests(t, func(t *testing.T) store.Store[string] {
+		return NewMemStore[string](store.StoreOptions[string]{})
+	}, "a", "b")
+}
+
+func Test_memStore_ReplaceAllInvalid(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[string]{
+		ValidateFns: map[string]store.ValidateFunc[string]{
+			"kind": func(v string) error {
+				if v == "" {
+					return errors.New("empty")
+				}
+				return nil
+			},
+		},
+	})
+	defer ms.Close()
+	_, _ = ms.Set("kind", "a", "x")
+	if _, err := ms.(store.Replacer[string]).ReplaceAll("kind", map[string]string{"b": "y", "c": ""}); err == nil {
+		t.Fatal("ReplaceAll with an invalid value succeeded")
+	}
+	if got, _ := ms.List("kind"); !reflect.DeepEqual(got, map[string]string{"a": "x"}) {
+		t.Errorf("failed ReplaceAll wrote: %v", got)
+	}
+}
+
+func Test_memStore_WatchStats(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	_, _ = ms.Set("kind", "a", 1)
+
+	h, err := store.WatchH(ms, "kind", store.WithBufferSize[int](2), store.WithInitialReplay[int]())
+	if err != nil {
+		t.Fatalf("WatchH() failed: %v", err)
+	}
+	<-h.C // the initial replay of a
+	_, _ = ms.Set("kind", "b", 2)
+	_, _ = ms.Set("kind", "c", 3)
+	_, _ = ms.Set("kind", "d", 4) // dropped
+
+	st := h.Stats()
+	if st.Delivered != 3 || st.Dropped != 1 || st.BufferLen != 2 || st.BufferCap != 2 || st.Age <= 0 {
+		t.Fatalf("Stats() = %+v", st)
+	}
+	h.Cancel()
+	if st := h.Stats(); st.Delivered != 3 || st.Dropped != 1 {
+		t.Fatalf("Stats() after Cancel = %+v", st)
+	}
+}
+
+func Test_memStore_MinVersions(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{EventHistory: 100})
+	defer ms.Close()
+
+	_, _ = ms.Set("kind", "a", 1)
+	_, _ = ms.Set("kind", "a", 2)
+	_, _ = ms.Set("kind", "b", 1)
+	_, _ = ms.Set("kind", "b", 1) // unchanged, keeps version 1
+
+	// the informer records versions and lists; a write lands before it
+	// starts watching, so the replay holds events List already saw
+	versions, err := ms.(store.Versioner).Versions("kind")
+	if err != nil || versions["a"] != 2 || versions["b"] != 1 {
+		t.Fatalf("Versions() = %v, %v", versions, err)
+	}
+	_, _ = ms.Set("kind", "a", 3)
+
+	h, err := store.WatchH(ms, "kind", store.WithReplayHistory[int](), store.WithInitialReplay[int](),
+		store.WithMinVersions[int](versions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cancel()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case ev := <-h.C:
+			if got := fmt.Sprintf("%s:%s@%d", ev.EventType, ev.Name, ev.Version); got != want {
+				t.Fatalf("event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", want)
+		}
+	}
+	expect("update:a@3")
+	if st := h.Stats(); st.BufferLen != 0 {
+		t.Fatalf("stale events buffered: %+v", st)
+	}
+
+	// a delete lifts the filter, so the re-created key is delivered
+	_, _, _ = ms.Delete("kind", "b")
+	_, _ = ms.Set("kind", "b", 5)
+	_ = store.Swap(ms, "kind", "a", "b")
+	expect("delete:b@1")
+	expect("create:b@1")
+	expect("update:a@4")
+	expect("update:b@2")
+}
+
+func Test_memStore_MergeAll(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{
+		ValidateFns: map[string]store.ValidateFunc[int]{"k": func(v int) error {
+			if v < 0 {
+				return errors.New("negative")
+			}
+			return nil
+		}},
+	})
+	defer ms.Close()
+	_ = ms.SetAll("k", map[string]int{"a": 1, "b": 5, "c": 3})
+	ch, cancel, _ := ms.Watch("k")
+	defer cancel()
+
+	keepHigher := func(key string, existing, incoming int) int { return max(existing, incoming) }
+	if err := store.MergeAll(ms, "k", map[string]int{"a": 4, "b": 2, "c": 3, "d": 7}, keepHigher); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ms.List("k")
+	if fmt.Sprint(got) != "map[a:4 b:5 c:3 d:7]" {
+		t.Fatalf("after merge: %v", got)
+	}
+	// only the keys whose value changed get an event, creates first
+	for _, want := range []string{"create:d", "update:a"} {
+		select {
+		case ev := <-ch:
+			if got := fmt.Sprintf("%s:%s", ev.EventType, ev.Name); got != want {
+				t.Fatalf("event %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", want)
+		}
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+
+	// a final value failing validation aborts the whole merge
+	err := store.MergeAll(ms, "k", map[string]int{"a": 10, "e": 1}, func(key string, existing, incoming int) int { return -1 })
+	if err == nil {
+		t.Fatal("MergeAll with an invalid resolved value succeeded")
+	}
+	if v, _, _ := ms.Get("k", "a"); v != 4 {
+		t.Fatalf("a = %d after the failed merge", v)
+	}
+	if _, ok, _ := ms.Get("k", "e"); ok {
+		t.Fatal("e written by the failed merge")
+	}
+}
+
+func Test_memStore_DeleteOlderThan(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ms := NewMemStore(store.StoreOptions[int]{Now: func() time.Time { return now }})
+	defer ms.Close()
+	p := ms.(store.Pruner)
+
+	_, _ = ms.Set("k", "old", 1)
+	now = now.Add(time.Hour)
+	_, _ = ms.Set("k", "edge", 2)
+	_, _ = store.SetLabeled(ms, "k", "new", 3, map[string]string{"env": "prod"})
+	cutoff := now // edge and new changed at the cutoff, not before it
+	now = now.Add(time.Hour)
+	_, _ = ms.Set("k", "old", 4) // updating refreshes the time
+
+	if n, err := p.CountOlderThan("k", cutoff); n != 0 || err != nil {
+		t.Fatalf("CountOlderThan(cutoff) = %d, %v, want 0", n, err)
+	}
+	if n, _ := p.CountOlderThan("k", cutoff.Add(time.Nanosecond)); n != 2 {
+		t.Fatalf("CountOlderThan(cutoff+1ns) = %d, want 2", n)
+	}
+
+	ch, cancel, _ := ms.Watch("k")
+	defer cancel()
+	if n, err := p.DeleteOlderThan("k", cutoff.Add(time.Nanosecond)); n != 2 || err != nil {
+		t.Fatalf("DeleteOlderThan = %d, %v, want 2", n, err)
+	}
+	if keys, _ := ms.Keys("k"); len(keys) != 1 || keys[0] != "old" {
+		t.Fatalf("keys left: %v", keys)
+	}
+	if kvs, _ := store.SelectByLabel(ms, "k", map[string]string{"env": "prod"}); len(kvs) != 0 {
+		t.Fatalf("labels of a deleted key left: %v", kvs)
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("event without WithDeleteEvents: %+v", ev)
+	default:
+	}
+
+	now = now.Add(time.Hour)
+	if n, _ := p.DeleteOlderThan("k", now, store.WithDeleteEvents()); n != 1 {
+		t.Fatalf("DeleteOlderThan with events = %d, want 1", n)
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeDelete || ev.Name != "old" || ev.Object != 4 {
+			t.Fatalf("event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no delete event")
+	}
+}
+
+func Test_memStore_SetAllOrdered(t *testing.T) {
+	for _, batch := range []int{0, 2} {
+		ms := NewMemStore(store.StoreOptions[int]{SetAllBatchSize: batch})
+		ms.Set("k", "b", 1)
+		ch, cancel, _ := ms.Watch("k")
+		err := store.SetAllOrdered(ms, "k", []store.KeyValue[int]{
+			{Key: "z", Value: 1}, {Key: "b", Value: 2}, {Key: "a", Value: 3}, {Key: "z", Value: 4}, {Key: "m", Value: 5},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := 0; i < 4; i++ {
+			select {
+			case ev := <-ch:
+				got = append(got, fmt.Sprintf("%s:%s=%d", ev.EventType, ev.Name, ev.Object))
+			case <-time.After(time.Second):
+				t.Fatalf("batch %d: %d events", batch, i)
+			}
+		}
+		// z keeps its first position with its last value
+		if want := "create:z=4,update:b=2,create:a=3,create:m=5"; strings.Join(got, ",") != want {
+			t.Fatalf("batch %d: events %s, want %s", batch, strings.Join(got, ","), want)
+		}
+		if v, _, _ := ms.Get("k", "z"); v != 4 {
+			t.Fatalf("batch %d: z = %d, want the last value 4", batch, v)
+		}
+		cancel()
+		ms.Close()
+	}
+}
+
+func Test_memStore_SetZeroValue(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	ch, cancel, _ := ms.Watch("k")
+	defer cancel()
+	created, err := ms.Set("k", "zero", 0)
+	if err != nil || !created {
+		t.Fatalf("Set of a new zero value = %v, %v, want created", created, err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeCreate || ev.Name != "zero" || ev.Version != 1 {
+			t.Errorf("event = %+v, want a create at version 1", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no create event")
+	}
+	if v, _ := ms.(store.Versioner).Versions("k"); v["zero"] != 1 {
+		t.Errorf("Versions() = %v", v)
+	}
+	if n, _ := ms.(store.Pruner).CountOlderThan("k", time.Now().Add(time.Hour)); n != 1 {
+		t.Errorf("CountOlderThan() = %d, want 1", n)
+	}
+	// setting it again is a no-op
+	if created, err := ms.Set("k", "zero", 0); err != nil || created {
+		t.Errorf("second Set() = %v, %v", created, err)
+	}
+}
+
+func Test_memStore_SetAllUnchanged(t *testing.T) {
+	t0 := time.Now()
+	clock := t0
+	ms := NewMemStore(store.StoreOptions[int]{Now: func() time.Time { return clock }})
+	defer ms.Close()
+	ms.SetAll("k", map[string]int{"a": 1, "b": 2})
+	ch, cancel, _ := ms.Watch("k")
+	defer cancel()
+
+	clock = t0.Add(time.Hour)
+	ms.SetAll("k", map[string]int{"a": 1, "b": 3})
+	if err := ms.(store.OrderedWriter[int]).SetAllOrdered("k", []store.KeyValue[int]{{Key: "a", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.(store.MultiKindWriter[int]).SetMulti([]store.KindKeyValue[int]{{Kind: "k", Key: "a", Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeUpdate || ev.Name != "b" {
+			t.Errorf("event = %+v, want the update of b", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no update event")
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("event %+v for an unchanged value", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if v, _ := ms.(store.Versioner).Versions("k"); v["a"] != 1 || v["b"] != 2 {
+		t.Errorf("Versions() = %v", v)
+	}
+	// a keeps its change time, b was changed
+	if n, _ := ms.(store.Pruner).CountOlderThan("k", t0.Add(time.Minute)); n != 1 {
+		t.Errorf("CountOlderThan() = %d, want 1", n)
+	}
+}
+
+func Test_memStore_RejectZeroValues(t *testing.T) {
+	type user struct {
+		Name string
+		Tags []string
+	}
+	ms := NewMemStore(store.StoreOptions[user]{
+		RejectZeroValues: true,
+		RejectZeroKinds:  []string{"users"},
+		NormalizeFns: map[string]store.NormalizeFunc[user]{"users": func(u user) (user, error) {
+			u.Name = strings.TrimSpace(u.Name)
+			return u, nil
+		}},
+	})
+	defer ms.Close()
+	if _, err := ms.Set("users", "a", user{}); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("Set of a zero value = %v", err)
+	}
+	if _, err := ms.Set("users", "a", user{Name: "  "}); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("Set of a value normalized to zero = %v", err)
+	}
+	if err := ms.SetAll("users", map[string]user{"b": {Name: "b"}, "c": {}}); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("SetAll with a zero value = %v", err)
+	}
+	if _, ok, _ := ms.Get("users", "b"); ok {
+		t.Fatal("SetAll applied values despite the error")
+	}
+	// a non-nil empty slice is not the zero value
+	if _, err := ms.Set("users", "a", user{Tags: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.SetFn("users", "a", func(user) (user, error) { return user{}, nil }); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("SetFn to a zero value = %v", err)
+	}
+	// other kinds accept zero values
+	if _, err := ms.Set("drafts", "a", user{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := ms.Get("drafts", "a"); !ok || v.Name != "" {
+		t.Fatalf("Get of a stored zero value = %+v, %v", v, ok)
+	}
+}
+
+func Test_memStore_CopyRenameKind(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	m := ms.(store.KindMover)
+	store.SetLabeled(ms, "notes", "a", 1, map[string]string{"env": "prod"})
+	ms.Set("notes", "a", 2) // version 2
+	ms.Set("notes", "b", 3)
+	notes, cancelNotes, _ := ms.Watch("notes")
+	defer cancelNotes()
+	docs, cancelDocs, _ := ms.Watch("docs")
+	defer cancelDocs()
+	versions := func(kind string) map[string]int64 {
+		v, _ := ms.(store.Versioner).Versions(kind)
+		return v
+	}
+	events := func(ch <-chan *store.Event[int], n int) string {
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case ev := <-ch:
+				got = append(got, fmt.Sprintf("%s:%s=%d", ev.EventType, ev.Name, ev.Version))
+			case <-time.After(time.Second):
+				return strings.Join(got, ",")
+			}
+		}
+		return strings.Join(got, ",")
+	}
+
+	if n, err := m.CopyKind("notes", "copies"); n != 2 || err != nil {
+		t.Fatalf("CopyKind = %d, %v", n, err)
+	}
+	ms.Set("copies", "a", 20)
+	if v, _, _ := ms.Get("notes", "a"); v != 2 {
+		t.Fatalf("copy shares values with its source: a = %d", v)
+	}
+	if kvs, _ := store.SelectByLabel(ms, "copies", map[string]string{"env": "prod"}); len(kvs) != 1 {
+		t.Fatalf("copied labels: %v", kvs)
+	}
+	if _, err := m.CopyKind("notes", "copies"); !errors.Is(err, store.ErrKindNotEmpty) {
+		t.Fatalf("CopyKind into a non-empty kind = %v", err)
+	}
+
+	if n, err := m.RenameKind("notes", "docs"); n != 2 || err != nil {
+		t.Fatalf("RenameKind = %d, %v", n, err)
+	}
+	select {
+	case ev := <-notes:
+		t.Fatalf("event without WithKindEvents: %+v", ev)
+	case ev := <-docs:
+		t.Fatalf("event without WithKindEvents: %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n, _ := ms.Count("notes"); n != 0 {
+		t.Fatalf("%d keys left in the renamed kind", n)
+	}
+	if v := versions("docs"); v["a"] != 2 || v["b"] != 1 {
+		t.Fatalf("renamed versions = %v", v)
+	}
+	// the renamed kind is usable again
+	if created, err := ms.Set("notes", "a", 4); !created || err != nil {
+		t.Fatalf("Set in the renamed kind = %v, %v", created, err)
+	}
+	events(notes, 1)
+	ms.Set("notes", "c", 5)
+	events(notes, 1)
+
+	n, err := m.RenameKind("notes", "docs", store.WithOverwrite(), store.WithKindEvents())
+	if n != 2 || err != nil {
+		t.Fatalf("RenameKind with WithOverwrite = %d, %v", n, err)
+	}
+	if got := events(notes, 2); got != "delete:a=1,delete:c=1" {
+		t.Fatalf("source events %s", got)
+	}
+	if got := events(docs, 2); got != "update:a=3,create:c=1" {
+		t.Fatalf("destination events %s", got)
+	}
+	if vals, _ := ms.List("docs"); len(vals) != 3 || vals["a"] != 4 {
+		t.Fatalf("docs after overwrite = %v", vals)
+	}
+	if kvs, _ := store.SelectByLabel(ms, "docs", map[string]string{"env": "prod"}); len(kvs) != 0 {
+		t.Fatalf("overwritten labels kept: %v", kvs)
+	}
+}
+
+func Test_memStore_Silent(t *testing.T) {
+	var seen []string
+	s := NewMemStore(store.StoreOptions[int]{
+		EventHistory: 10,
+		AfterWrite: func(ev *store.Event[int]) {
+			seen = append(seen, fmt.Sprintf("%s:%s:%v", ev.EventType, ev.Name, ev.Silent))
+		},
+	})
+	defer s.Close()
+	s.Set("k", "a", 1)
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+	seen = nil
+
+	if err := s.SetAll("k", map[string]int{"a": 2, "b": 1}, store.Silent()); err != nil {
+		t.Fatal(err)
+	}
+	s.SetFn("k", "a", func(v int) (int, error) { return v + 1, nil }, store.Silent())
+	s.Set("k", "c", 1, store.Silent())
+	s.Delete("k", "c", store.Silent())
+	select {
+	case ev := <-ch:
+		t.Fatalf("event of a silent write: %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if len(seen) != 5 || seen[0] != "create:b:true" || seen[4] != "delete:c:true" {
+		t.Fatalf("AfterWrite saw %v", seen)
+	}
+	if vs, _ := s.(store.Versioner).Versions("k"); vs["a"] != 3 || vs["b"] != 1 {
+		t.Fatalf("versions after silent writes = %v", vs)
+	}
+
+	s.Set("k", "b", 2)
+	select {
+	case ev := <-ch:
+		if ev.Name != "b" || ev.Silent {
+			t.Fatalf("event after silent writes: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event after silent writes")
+	}
+
+	// the history keeps the silent events
+	hist, cancelHist, _ := s.Watch("k", store.WithReplayHistory[int]())
+	defer cancelHist()
+	var got []string
+	for len(got) < 7 {
+		select {
+		case ev := <-hist:
+			got = append(got, fmt.Sprintf("%s:%s:%v", ev.EventType, ev.Name, ev.Silent))
+		case <-time.After(time.Second):
+			t.Fatalf("history replay %v", got)
+		}
+	}
+	if got[1] != "create:b:true" || got[6] != "update:b:false" {
+		t.Fatalf("history replay %v", got)
+	}
+}
+
+func Test_memStore_SoftDelete(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	d := ms.(store.SoftDeleter[int])
+	store.SetLabeled(ms, "k", "a", 1, map[string]string{"env": "prod"})
+	ms.Set("k", "a", 2)
+	ms.Set("k", "b", 3)
+	ch, cancel, _ := ms.Watch("k")
+	defer cancel()
+
+	if existed, err := d.SoftDelete("k", "a"); !existed || err != nil {
+		t.Fatalf("SoftDelete = %v, %v", existed, err)
+	}
+	if existed, _ := d.SoftDelete("k", "missing"); existed {
+		t.Fatal("SoftDelete of a missing key existed")
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeDelete || ev.Name != "a" || ev.Object != 2 || ev.Version != 2 {
+			t.Fatalf("SoftDelete event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no SoftDelete event")
+	}
+	if _, ok, _ := ms.Get("k", "a"); ok {
+		t.Fatal("soft-deleted key still read")
+	}
+	if n, _ := ms.Count("k"); n != 1 {
+		t.Fatalf("Count = %d", n)
+	}
+	if m, _ := d.ListDeleted("k"); len(m) != 1 || m["a"] != 2 {
+		t.Fatalf("ListDeleted = %v", m)
+	}
+
+	if restored, err := d.Restore("k", "a"); !restored || err != nil {
+		t.Fatalf("Restore = %v, %v", restored, err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeCreate || ev.Object != 2 || ev.Version != 2 {
+			t.Fatalf("Restore event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no Restore event")
+	}
+	if kvs, _ := store.SelectByLabel(ms, "k", map[string]string{"env": "prod"}); len(kvs) != 1 || kvs[0].Value != 2 {
+		t.Fatalf("restored labels: %v", kvs)
+	}
+	if m, _ := d.ListDeleted("k"); len(m) != 0 {
+		t.Fatalf("ListDeleted after Restore = %v", m)
+	}
+	if restored, _ := d.Restore("k", "a"); restored {
+		t.Fatal("restored twice")
+	}
+
+	// a key set anew keeps its trash entry until it is free again
+	d.SoftDelete("k", "b")
+	ms.Set("k", "b", 4)
+	if _, err := d.Restore("k", "b"); !errors.Is(err, store.ErrKeyExists) {
+		t.Fatalf("Restore over a live key = %v", err)
+	}
+	if v, _, _ := ms.Get("k", "b"); v != 4 {
+		t.Fatalf("b = %d", v)
+	}
+	if n, _ := d.PurgeDeleted("k", time.Now().Add(-time.Hour)); n != 0 {
+		t.Fatalf("PurgeDeleted of nothing old = %d", n)
+	}
+	if n, _ := d.PurgeDeleted("k", time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("PurgeDeleted = %d", n)
+	}
+	if m, _ := d.ListDeleted("k"); len(m) != 0 {
+		t.Fatalf("ListDeleted after PurgeDeleted = %v", m)
+	}
+}
+
+func Test_memStore_WatchCloseRace(t *testing.T) {
+	// each Watch racing Close either fails with ErrClosed or returns a
+	// channel that Close closes; run with -race
+	for round := 0; round < 20; round++ {
+		s := NewMemStore(store.StoreOptions[int]{})
+		chs := make(chan (<-chan *store.Event[int]), 8)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(chs); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var ch <-chan *store.Event[int]
+				var err error
+				if i%2 == 0 {
+					ch, _, err = s.Watch("k")
+				} else {
+					ch, _, err = store.WatchAll(s)
+				}
+				switch {
+				case err == nil:
+					chs <- ch
+				case !errors.Is(err, store.ErrClosed):
+					t.Errorf("Watch = %v, want nil or ErrClosed", err)
+				}
+			}(i)
+		}
+		s.Close()
+		wg.Wait()
+		close(chs)
+		for ch := range chs {
+			select {
+			case _, ok := <-ch:
+				if ok {
+					t.Fatal("event on a closed store")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("watch channel still open after Close")
+			}
+		}
+	}
+}
+
+func Test_memStore_Where(t *testing.T) {
+	type task struct {
+		Status   string `json:"status"`
+		Priority int    `json:"priority"`
+	}
+	ms := NewMemStore(store.StoreOptions[task]{})
+	defer ms.Close()
+	q := ms.(store.FilterQuerier[task])
+	store.SetLabeled(ms, "tasks", "a", task{"open", 1}, map[string]string{"env": "prod"})
+	ms.Set("tasks", "b", task{"open", 5})
+	ms.Set("tasks", "c", task{"done", 9})
+
+	open := store.F.Eq("status", "open")
+	if m, err := q.ListWhere("tasks", open); err != nil || len(m) != 2 || m["b"].Priority != 5 {
+		t.Fatalf("ListWhere = %v, %v", m, err)
+	}
+	if n, err := q.CountWhere("tasks", store.F.Or(store.F.Gt("priority", 4), store.F.Eq("key", "a"))); err != nil || n != 3 {
+		t.Fatalf("CountWhere = %d, %v", n, err)
+	}
+	if _, err := q.DeleteWhere("tasks", store.F.Or(open, store.F.Gt("status", 1))); !errors.Is(err, store.ErrInvalidFilter) {
+		t.Fatalf("DeleteWhere with a type mismatch = %v", err)
+	}
+	if n, _ := ms.Count("tasks"); n != 3 {
+		t.Fatalf("a failed DeleteWhere deleted values: %d left", n)
+	}
+
+	ch, cancel, _ := ms.Watch("tasks")
+	defer cancel()
+	if n, err := q.DeleteWhere("tasks", open, store.WithDeleteEvents()); err != nil || n != 2 {
+		t.Fatalf("DeleteWhere = %d, %v", n, err)
+	}
+	for _, want := range []string{"a", "b"} {
+		select {
+		case ev := <-ch:
+			if ev.EventType != store.EventTypeDelete || ev.Name != want || ev.Object.Status != "open" {
+				t.Fatalf("event %+v, want the delete of %s", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no delete event for %s", want)
+		}
+	}
+	if kvs, _ := store.SelectByLabel(ms, "tasks", map[string]string{"env": "prod"}); len(kvs) != 0 {
+		t.Fatalf("labels of a deleted key: %v", kvs)
+	}
+	if keys, _ := ms.Keys("tasks"); len(keys) != 1 || keys[0] != "c" {
+		t.Fatalf("Keys after DeleteWhere = %v", keys)
+	}
+}
+
+func Test_memStore_InitialReplayEventTypes(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	ms.Set("k", "a", 1)
+	for _, initial := range []bool{false, true} {
+		for _, types := range [][]store.EventType{nil, {store.EventTypeCreate}, {store.EventTypeUpdate}, {store.EventTypeDelete}} {
+			opts := []store.WatchOption[int]{}
+			if initial {
+				opts = append(opts, store.WithInitialReplay[int]())
+			}
+			if types != nil {
+				opts = append(opts, store.WithEventTypes[int](types...))
+			}
+			ch, cancel, err := ms.Watch("k", opts...)
+			if initial && len(types) == 1 && types[0] != store.EventTypeCreate {
+				if !errors.Is(err, store.ErrInitialReplayFiltered) {
+					t.Errorf("initial, %v: Watch = %v, want ErrInitialReplayFiltered", types, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("initial=%v, %v: Watch = %v", initial, types, err)
+			}
+			if initial {
+				select {
+				case ev := <-ch:
+					if ev.EventType != store.EventTypeCreate || ev.Name != "a" {
+						t.Errorf("initial, %v: replayed %+v", types, ev)
+					}
+				case <-time.After(time.Second):
+					t.Errorf("initial, %v: no replay", types)
+				}
+			}
+			select {
+			case ev := <-ch:
+				t.Errorf("initial=%v, %v: unexpected %+v", initial, types, ev)
+			case <-time.After(20 * time.Millisecond):
+			}
+			cancel()
+		}
+	}
+}
+
+func Test_memStore_Info(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{EventHistory: 4, CloneOnRead: true, CloneFn: func(v int) int { return v }})
+	defer ms.Close()
+	i := ms.(store.Introspector)
+	want := store.Info{Backend: "gomap", Features: []string{"clone-on-read", "history"}, WatchFeatures: store.AllWatchFeatures}
+	if got := i.Info(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+	if i.Codec() != nil {
+		t.Errorf("Codec() = %v, want nil", i.Codec())
+	}
+}
+
+func Test_memStore_WatcherCount(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	wc := ms.(store.WatchCounter)
+
+	_, cancelA, _ := ms.Watch("a")
+	_, cancelAB, _ := store.WatchKinds(ms, []string{"a", "b"})
+	_, cancelAll, _ := store.WatchAll(ms)
+	if n := wc.WatcherCount(); n != 3 {
+		t.Fatalf("WatcherCount() = %d, want 3", n)
+	}
+	for kind, want := range map[string]int{"a": 3, "b": 2, "c": 1} {
+		if n := wc.KindWatcherCount(kind); n != want {
+			t.Errorf("KindWatcherCount(%q) = %d, want %d", kind, n, want)
+		}
+	}
+
+	cancelA()
+	cancelAB()
+	cancelAll()
+	if n := wc.WatcherCount(); n != 0 {
+		t.Fatalf("WatcherCount() after cancel = %d, want 0", n)
+	}
+	if n := wc.KindWatcherCount("a"); n != 0 {
+		t.Fatalf("KindWatcherCount(a) after cancel = %d, want 0", n)
+	}
+}
+
+func Test_memStore_ExistingKeys(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{AllowedKinds: []string{"k"}})
+	defer ms.Close()
+	ms.Set("k", "a", 1)
+	ms.Set("k", "b", 2)
+
+	got, err := ms.(store.KeyChecker).ExistingKeys("k", []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"a": true, "b": true, "c": false}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ExistingKeys = %v, want %v", got, want)
+	}
+	if _, err := ms.(store.KeyChecker).ExistingKeys("other", []string{"a"}); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("ExistingKeys of a kind that isn't allowed: %v", err)
+	}
+}
+
+func Test_memStore_SetMulti(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{
+		ValidateFns: map[string]store.ValidateFunc[int]{"b": func(v int) error {
+			if v < 0 {
+				return errors.New("negative")
+			}
+			return nil
+		}},
+	})
+	defer ms.Close()
+	w := ms.(store.MultiKindWriter[int])
+
+	if err := w.SetMulti([]store.KindKeyValue[int]{{Kind: "a", Key: "x", Value: 1}, {Kind: "b", Key: "y", Value: -1}}); err == nil {
+		t.Fatal("expected validation error")
+	}
+	if _, ok, _ := ms.Get("a", "x"); ok {
+		t.Fatal("a/x written although b/y failed")
+	}
+
+	ch, cancel, _ := store.WatchAll(ms)
+	defer cancel()
+	if err := w.SetMulti([]store.KindKeyValue[int]{{Kind: "a", Key: "x", Value: 1}, {Kind: "b", Key: "y", Value: 2}, {Kind: "a", Key: "x", Value: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 2; i++ {
+		ev := <-ch
+		got = append(got, fmt.Sprintf("%s/%s=%d", ev.Kind, ev.Name, ev.Object))
+	}
+	if want := []string{"a/x=3", "b/y=2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+// jsonCodec is the journal codec of the tests.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	if n, ok := v.(int); ok && n < 0 {
+		return nil, errors.New("negative")
+	}
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func journalOpts(path string) store.StoreOptions[int] {
+	return store.StoreOptions[int]{Journal: store.JournalConfig{Path: path, Codec: jsonCodec{}}}
+}
+
+// state returns the values of every kind that holds one.
+func state(s store.Store[int]) map[string]map[string]int {
+	ms := s.(*memStore[int])
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	out := make(map[string]map[string]int)
+	for kind, m := range ms.kinds {
+		if len(m) > 0 {
+			out[kind] = maps.Clone(m)
+		}
+	}
+	return out
+}
+
+func Test_memStore_Journal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mem.journal")
+	s, err := NewMemStoreFromJournal(journalOpts(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fq := s.(store.FilterQuerier[int])
+	sd := s.(store.SoftDeleter[int])
+	km := s.(store.KindMover)
+	mw := s.(store.MultiKindWriter[int])
+	steps := []func() error{
+		func() error { _, err := s.Set("a", "x", 1); return err },
+		func() error { return s.SetAll("a", map[string]int{"y": 2, "z": 3, "w": 4}) },
+		func() error { _, _, err := s.Delete("a", "w"); return err },
+		func() error { _, err := s.SetFn("a", "x", func(v int) (int, error) { return v + 10, nil }); return err },
+		func() error { return store.Swap(s, "a", "y", "z") },
+		func() error {
+			return store.MergeAll(s, "a", map[string]int{"x": 1, "v": 5}, func(_ string, old, new int) int { return old + new })
+		},
+		func() error { _, err := km.CopyKind("a", "b"); return err },
+		func() error { _, err := km.RenameKind("b", "c"); return err },
+		func() error { _, err := fq.DeleteWhere("c", store.F.Eq(store.FilterKeyField, "x")); return err },
+		func() error { _, err := sd.SoftDelete("a", "v"); return err },
+		func() error { _, err := sd.Restore("a", "v"); return err },
+		func() error {
+			return mw.SetMulti([]store.KindKeyValue[int]{{Kind: "a", Key: "m", Value: 7}, {Kind: "d", Key: "m", Value: 8}})
+		},
+	}
+	sizes := []int64{fileSize(t, path)}
+	states := []map[string]map[string]int{state(s)}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		sizes = append(sizes, fileSize(t, path))
+		states = append(states, state(s))
+	}
+	// the process is killed: the journal is never closed
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for i := range sizes {
+		cuts := []int64{sizes[i]}
+		if i+1 < len(sizes) {
+			// torn in the middle of the next write
+			cuts = append(cuts, sizes[i]+1, (sizes[i]+sizes[i+1])/2, sizes[i+1]-1)
+		}
+		for _, cut := range cuts {
+			p := filepath.Join(dir, fmt.Sprintf("cut-%d", cut))
+			if err := os.WriteFile(p, data[:cut], 0o644); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewMemStoreFromJournal(journalOpts(p))
+			if err != nil {
+				t.Fatalf("recover after step %d, cut at %d: %v", i, cut, err)
+			}
+			if got := state(r); !reflect.DeepEqual(got, states[i]) {
+				t.Fatalf("recovered after step %d, cut at %d:\n got %v\nwant %v", i, cut, got, states[i])
+			}
+			if size := fileSize(t, p); size != sizes[i] {
+				t.Fatalf("cut at %d: journal truncated to %d, want %d", cut, size, sizes[i])
+			}
+			if warned := strings.Contains(logged.String(), "torn records"); warned != (cut != sizes[i]) {
+				t.Fatalf("cut at %d: warned = %v: %q", cut, warned, logged.String())
+			}
+			logged.Reset()
+			// writes after the truncation are recovered too
+			if _, err := r.Set("e", "after", 99); err != nil {
+				t.Fatal(err)
+			}
+			want := state(r)
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err = NewMemStoreFromJournal(journalOpts(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := state(r); !reflect.DeepEqual(got, want) {
+				t.Fatalf("reopened after cut at %d: got %v, want %v", cut, got, want)
+			}
+			r.Close()
+		}
+	}
+	s.Close()
+}
+
+func Test_memStore_JournalFailures(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mem.journal")
+	opt := journalOpts(path)
+	opt.Defaults = map[string]map[string]int{"a": {"d": 1}}
+	s, err := NewMemStoreFromJournal(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("a", "d", 2)
+
+	// a value the journal can't encode isn't written
+	if _, err := s.Set("a", "x", -1); err == nil {
+		t.Fatal("expected the journal's encoding error")
+	}
+	if _, ok, _ := s.Get("a", "x"); ok {
+		t.Fatal("value stored without its journal record")
+	}
+	s.Close()
+
+	// defaults don't overwrite recovered values
+	r, err := NewMemStoreFromJournal(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := r.Get("a", "d"); v != 2 {
+		t.Errorf("a/d = %d, want 2", v)
+	}
+	r.Close()
+
+	other := filepath.Join(dir, "other")
+	os.WriteFile(other, []byte("not a journal"), 0o644)
+	if _, err := NewMemStoreFromJournal(journalOpts(other)); err == nil {
+		t.Error("expected error for a file that isn't a journal")
+	}
+	if _, err := NewMemStoreFromJournal(store.StoreOptions[int]{Journal: store.JournalConfig{Path: path}}); err == nil {
+		t.Error("expected error without a codec")
+	}
+
+	// the other constructors don't open journals
+	if _, err := New(opt); err == nil {
+		t.Error("New() opened a journal")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("NewMemStore() with a journal did not panic")
+		}
+	}()
+	NewMemStore(opt)
+}
+
+func Test_memStore_JournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mem.journal")
+	opt := journalOpts(path)
+	opt.Journal.CompactSize = 4 << 10
+	opt.Journal.FsyncEvery = 100
+	s, err := NewMemStoreFromJournal(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if _, err := s.Set("k", fmt.Sprintf("key%d", i%20), i); err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 0 {
+			s.Delete("k", fmt.Sprintf("key%d", (i+3)%20))
+		}
+	}
+	if size := fileSize(t, path); size > 2*opt.Journal.CompactSize {
+		t.Errorf("journal is %d bytes, want it compacted below %d", size, 2*opt.Journal.CompactSize)
+	}
+	want := state(s)
+	s.Close()
+	if matches, _ := filepath.Glob(path + ".compact-*"); len(matches) > 0 {
+		t.Errorf("compaction left %v", matches)
+	}
+	r, err := NewMemStoreFromJournal(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got := state(r); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recovered %v, want %v", got, want)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func BenchmarkSetJournal(b *testing.B) {
+	for _, bc := range []struct {
+		name    string
+		journal bool
+		fsync   int
+	}{{"memory", false, 0}, {"journal", true, 0}, {"journal-fsync100", true, 100}, {"journal-fsync1", true, 1}} {
+		b.Run(bc.name, func(b *testing.B) {
+			opt := store.StoreOptions[int]{}
+			if bc.journal {
+				opt = journalOpts(filepath.Join(b.TempDir(), "mem.journal"))
+				opt.Journal.FsyncEvery = bc.fsync
+			}
+			s, err := New(opt)
+			if bc.journal {
+				s, err = NewMemStoreFromJournal(opt)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Set("k", strconv.Itoa(i%1000), i+1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_memStore_FilterStream(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	values := make(map[string]int)
+	for i := 0; i < 3*filterStreamBatch+5; i++ {
+		values[fmt.Sprintf("key%04d", i)] = i
+	}
+	ms.SetAll("k", values)
+	fs := ms.(store.FilterStreamer[int])
+
+	var keys []string
+	even := func(_ string, v int) bool { return v%2 == 0 }
+	err := fs.FilterStream("k", even, func(key string, v int) error {
+		if v%2 != 0 {
+			t.Errorf("%s = %d passed the filter", key, v)
+		}
+		keys = append(keys, key)
+		// writing from fn doesn't deadlock
+		_, err := ms.Set("other", key, v)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (len(values) + 1) / 2; len(keys) != want || !sort.StringsAreSorted(keys) {
+		t.Fatalf("streamed %d keys, sorted = %v; want %d sorted", len(keys), sort.StringsAreSorted(keys), want)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = fs.FilterStream("k", nil, func(string, int) error {
+		if n++; n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 3 {
+		t.Fatalf("FilterStream = %v after %d calls, want stop after 3", err, n)
+	}
+}
+
+func Test_memStore_Sample(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	for i := 0; i < 100; i++ {
+		ms.Set("k", strconv.Itoa(i), i)
+	}
+	sm := ms.(store.Sampler[int])
+
+	seen := make(map[string]bool)
+	for round := 0; round < 50; round++ {
+		got, err := sm.Sample("k", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 5 {
+			t.Fatalf("Sample(5) returned %d entries", len(got))
+		}
+		keys := make(map[string]bool)
+		for _, kv := range got {
+			if strconv.Itoa(kv.Value) != kv.Key || keys[kv.Key] {
+				t.Fatalf("Sample(5) = %v, want distinct stored entries", got)
+			}
+			keys[kv.Key], seen[kv.Key] = true, true
+		}
+	}
+	// 250 picks out of 100 keys reach far more than a fixed few
+	if len(seen) < 50 {
+		t.Errorf("50 samples of 5 saw only %d keys", len(seen))
+	}
+
+	if got, _ := sm.Sample("k", 1000); len(got) != 100 {
+		t.Errorf("Sample(1000) returned %d entries, want all 100", len(got))
+	}
+	for _, n := range []int{0, -1} {
+		if got, err := sm.Sample("k", n); err != nil || got == nil || len(got) != 0 {
+			t.Errorf("Sample(%d) = %v, %v, want empty", n, got, err)
+		}
+	}
+	if got, err := sm.Sample("missing", 3); err != nil || len(got) != 0 {
+		t.Errorf("Sample of a missing kind = %v, %v", got, err)
+	}
+}
+
+func Test_memStore_ValidateOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	s, err := NewMemStoreFromJournal(journalOpts(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = s.Set("n", "ok", 1)
+	_, _ = s.Set("n", "bad", 0)
+	s.Close()
+
+	for _, mode := range []store.ValidateMode{store.ValidateOff, store.ValidateWarn, store.ValidateFailFast} {
+		opts := journalOpts(path)
+		opts.ValidateFns = map[string]store.ValidateFunc[int]{"n": func(v int) error {
+			if v == 0 {
+				return errors.New("zero")
+			}
+			return nil
+		}}
+		opts.ValidateOnOpen = mode
+		s, err := NewMemStoreFromJournal(opts)
+		if mode == store.ValidateFailFast {
+			var vf *store.ValidationFailedError
+			if !errors.As(err, &vf) || vf.Report.Checked != 2 || len(vf.Report.Violations) != 1 || vf.Report.Violations[0].Key != "bad" {
+				t.Errorf("fail-fast open = %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		if v, _, _ := s.Get("n", "bad"); v != 0 {
+			t.Errorf("mode %d: bad = %d", mode, v)
+		}
+		s.Close()
+	}
+}
+
+func Test_memStore_WatchSynchronous(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{EventHistory: 10})
+	defer ms.Close()
+	_, _ = ms.Set("kind", "old", 1)
+
+	if _, _, err := ms.Watch("kind", store.WithSynchronous[int](), store.WithReplayHistory[int]()); !errors.Is(err, store.ErrSynchronousHistory) {
+		t.Fatalf("synchronous watch with history = %v", err)
+	}
+
+	h, err := store.WatchH(ms, "kind", store.WithSynchronous[int](), store.WithInitialReplay[int](), store.WithBufferSize[int](8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cap(h.C) != 0 {
+		t.Errorf("buffer = %d, want unbuffered", cap(h.C))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = ms.Set("kind", "new", 2)
+		_, _ = ms.Set("kind", "new", 3)
+	}()
+	// the initial replay comes first, then the writes in order
+	for _, want := range []string{"create:old", "create:new", "update:new"} {
+		ev := <-h.C
+		if got := string(ev.EventType) + ":" + ev.Name; got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+	<-done
+	if st := h.Stats(); st.Delivered != 3 || st.Dropped != 0 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	// cancelling releases a write waiting for the consumer
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = ms.Set("kind", "blocked", 4)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	h.Cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still blocked after Cancel")
+	}
+}
+
+func Test_memStore_WatchSynchronousConcurrentWriters(t *testing.T) {
+	ms := NewMemStore(store.StoreOptions[int]{})
+	defer ms.Close()
+	ch, cancel, err := ms.Watch("kind", store.WithSynchronous[int]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				// non-zero: creating a zero value publishes nothing
+				_, _ = ms.Set("kind", fmt.Sprintf("k%d", i%3), w*writes+i+1)
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// each key's events come in version order, so the last one holds
+	// the stored value
+	last := make(map[string]*store.Event[int])
+	for n := 0; n < writers*writes; n++ {
+		select {
+		case ev := <-ch:
+			if prev := last[ev.Name]; prev != nil && ev.Version != prev.Version+1 {
+				t.Fatalf("%s: version %d after %d", ev.Name, ev.Version, prev.Version)
+			}
+			last[ev.Name] = ev
+			// the consumer may read the store meanwhile
+			_, _, _ = ms.Get("kind", ev.Name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d events received, want %d", n, writers*writes)
+		}
+	}
+	<-done
+	for key, ev := range last {
+		if v, _, _ := ms.Get("kind", key); v != ev.Object {
+			t.Errorf("%s: last event %d, stored %d", key, ev.Object, v)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package gomap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// A journal file starts with journalMagic, followed by records. A record
+// is the length and CRC-32C of its payload, 4 bytes each, little endian,
+// and the payload: one or more ops, each an op byte, the kind and key,
+// and for a set the encoded value, each length-prefixed with a uvarint.
+// The ops of one write share a record, so they are replayed all or none.
+const (
+	journalMagic  = "zjl1"
+	journalHeader = 8
+
+	opSet    = 1
+	opDelete = 2
+
+	// maxJournalRecord bounds the length a record header may claim, so a
+	// corrupt one isn't taken for a huge record.
+	maxJournalRecord = 1 << 30
+	// snapshotOps is how many values a compaction writes per record.
+	snapshotOps = 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// journalOp is a set or delete of one key, its value encoded.
+type journalOp struct {
+	del       bool
+	kind, key string
+	value     []byte
+}
+
+// journal appends the writes of a store to its file. Its methods are
+// called with the store's lock held.
+type journal struct {
+	f    *os.File
+	path string
+	cfg  store.JournalConfig
+	// size is the length of the file; base its length after the last
+	// compaction
+	size, base int64
+	// unsynced counts the records since the last sync
+	unsynced int
+	buf      bytes.Buffer
+	// err, once set, fails every append: the file couldn't be restored
+	// after a failed write
+	err error
+}
+
+// appendOp encodes op onto b.
+func appendOp(b []byte, op journalOp) []byte {
+	if op.del {
+		b = append(b, opDelete)
+	} else {
+		b = append(b, opSet)
+	}
+	b = binary.AppendUvarint(b, uint64(len(op.kind)))
+	b = append(b, op.kind...)
+	b = binary.AppendUvarint(b, uint64(len(op.key)))
+	b = append(b, op.key...)
+	if !op.del {
+		b = binary.AppendUvarint(b, uint64(len(op.value)))
+		b = append(b, op.value...)
+	}
+	return b
+}
+
+// appendRecord encodes ops as one record onto buf.
+func appendRecord(buf *bytes.Buffer, ops []journalOp) {
+	start := buf.Len()
+	buf.Write(make([]byte, journalHeader))
+	var payload []byte
+	for _, op := range ops {
+		payload = appendOp(payload, op)
+	}
+	buf.Write(payload)
+	hdr := buf.Bytes()[start:]
+	binary.LittleEndian.PutUint32(hdr, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:], crc32.Checksum(payload, crcTable))
+}
+
+// errTorn marks a record cut short or corrupted, as a crash mid-write
+// leaves the end of the file.
+var errTorn = errors.New("torn record")
+
+// parseRecord decodes the record at the start of data and returns its ops
+// and length.
+func parseRecord(data []byte) ([]journalOp, int, error) {
+	if len(data) < journalHeader {
+		return nil, 0, errTorn
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if n == 0 || n > maxJournalRecord || int64(n) > int64(len(data)-journalHeader) {
+		return nil, 0, errTorn
+	}
+	payload := data[journalHeader : journalHeader+int(n)]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0, errTorn
+	}
+	var ops []journalOp
+	for len(payload) > 0 {
+		var op journalOp
+		switch payload[0] {
+		case opSet:
+		case opDelete:
+			op.del = true
+		default:
+			return nil, 0, fmt.Errorf("unknown op %d", payload[0])
+		}
+		payload = payload[1:]
+		fields := []*[]byte{new([]byte), new([]byte)}
+		if !op.del {
+			fields = append(fields, &op.value)
+		}
+		for _, f := range fields {
+			l, w := binary.Uvarint(payload)
+			if w <= 0 || l > uint64(len(payload)-w) {
+				return nil, 0, errors.New("op overruns its record")
+			}
+			*f, payload = payload[w:w+int(l)], payload[w+int(l):]
+		}
+		op.kind, op.key = string(*fields[0]), string(*fields[1])
+		ops = append(ops, op)
+	}
+	return ops, journalHeader + int(n), nil
+}
+
+// openJournal opens the journal of cfg and replays it with apply. A torn
+// tail, left by a crash mid-write, is cut off with a warning; any other
+// damage is an error.
+func openJournal(cfg store.JournalConfig, apply func(op journalOp) error) (*journal, error) {
+	if cfg.Codec == nil {
+		return nil, errors.New("gomap: journal: no codec")
+	}
+	if cfg.CompactSize <= 0 {
+		cfg.CompactSize = store.DefaultJournalCompactSize
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("gomap: journal: %w", err)
+	}
+	j := &journal{f: f, path: cfg.Path, cfg: cfg}
+	if err := j.replay(apply); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("gomap: journal %s: %w", cfg.Path, err)
+	}
+	return j, nil
+}
+
+// replay applies the records of the file and leaves it positioned at
+// their end.
+func (j *journal) replay(apply func(op journalOp) error) error {
+	data, err := io.ReadAll(j.f)
+	if err != nil {
+		return err
+	}
+	off := 0
+	if bytes.HasPrefix(data, []byte(journalMagic)) {
+		off = len(journalMagic)
+	} else if !bytes.HasPrefix([]byte(journalMagic), data) {
+		return errors.New("not a journal file")
+	}
+	// else new, or torn while being created
+	for off > 0 && off < len(data) {
+		ops, n, err := parseRecord(data[off:])
+		if errors.Is(err, errTorn) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		for _, op := range ops {
+			if err := apply(op); err != nil {
+				return fmt.Errorf("%s/%s at offset %d: %w", op.kind, op.key, off, err)
+			}
+		}
+		off += n
+	}
+	if off < len(data) {
+		log.Printf("zestor/gomap: journal %s: dropped %d bytes of torn records at offset %d, left by a crash mid-write", j.path, len(data)-off, off)
+		if err := j.f.Truncate(int64(off)); err != nil {
+			return err
+		}
+	}
+	if off == 0 {
+		if _, err := j.f.WriteAt([]byte(journalMagic), 0); err != nil {
+			return err
+		}
+		off = len(journalMagic)
+	}
+	if _, err := j.f.Seek(int64(off), io.SeekStart); err != nil {
+		return err
+	}
+	j.size, j.base = int64(off), int64(off)
+	return j.f.Sync()
+}
+
+// append writes ops as one record and syncs as FsyncEvery asks. A failed
+// write is cut off the file, so the records after it stay readable.
+func (j *journal) append(ops []journalOp) error {
+	if j.err != nil {
+		return j.err
+	}
+	j.buf.Reset()
+	appendRecord(&j.buf, ops)
+	if _, err := j.f.Write(j.buf.Bytes()); err != nil {
+		j.rollback()
+		return fmt.Errorf("gomap: journal: %w", err)
+	}
+	if j.cfg.FsyncEvery > 0 && j.unsynced+1 >= j.cfg.FsyncEvery {
+		if err := j.f.Sync(); err != nil {
+			j.rollback()
+			return fmt.Errorf("gomap: journal: %w", err)
+		}
+		j.unsynced = -1
+	}
+	j.size += int64(j.buf.Len())
+	j.unsynced++
+	return nil
+}
+
+// rollback cuts a failed write off the file.
+func (j *journal) rollback() {
+	if err := j.f.Truncate(j.size); err != nil {
+		j.err = fmt.Errorf("gomap: journal: restoring after a failed write: %w", err)
+		return
+	}
+	if _, err := j.f.Seek(j.size, io.SeekStart); err != nil {
+		j.err = fmt.Errorf("gomap: journal: restoring after a failed write: %w", err)
+	}
+}
+
+// needsCompaction reports whether the journal has outgrown CompactSize
+// and doubled since the last compaction.
+func (j *journal) needsCompaction() bool {
+	return j.err == nil && j.size > j.cfg.CompactSize && j.size > 2*j.base
+}
+
+// compact replaces the journal with a snapshot of kinds: it writes a new
+// file next to it, syncs it and renames it over the journal, so a crash
+// leaves one or the other.
+func (j *journal) compact(kinds map[string]map[string][]byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".compact-*")
+	if err != nil {
+		return fmt.Errorf("gomap: journal compaction: %w", err)
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("gomap: journal compaction: %w", err)
+	}
+	if info, err := j.f.Stat(); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			return fail(err)
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(journalMagic)
+	ops := make([]journalOp, 0, snapshotOps)
+	flush := func() error {
+		if len(ops) > 0 {
+			appendRecord(&buf, ops)
+			ops = ops[:0]
+		}
+		_, err := tmp.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, kind := range sortedKeys(kinds) {
+		for _, key := range sortedKeys(kinds[kind]) {
+			ops = append(ops, journalOp{kind: kind, key: key, value: kinds[kind][key]})
+			if len(ops) == snapshotOps {
+				if err := flush(); err != nil {
+					return fail(err)
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fail(err)
+	}
+	syncDir(filepath.Dir(j.path))
+	j.f.Close()
+	j.f, j.size, j.base, j.unsynced = tmp, size, size, 0
+	return nil
+}
+
+// syncDir syncs a directory, so a rename in it survives a crash. Not
+// every platform can, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// close syncs and closes the file.
+func (j *journal) close() error {
+	err := j.f.Sync()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewMemStoreFromJournal returns an in-memory store recovered from the
+// journal at opt.Journal.Path, created if it doesn't exist, which logs
+// every write to it from then on: the last write of each key wins, and
+// the records a crash cut short are dropped with a warning. Defaults are
+// seeded after recovery, so they only create keys the journal doesn't
+// hold.
+//
+// The journal holds values only. Recovered keys start at version 1 and
+// count as modified at recovery; labels, soft-deleted values, event
+// history and idempotency keys start empty.
+//
+// Every write appends to the journal under the store's lock before it is
+// applied, and fails, changing nothing, if that fails. A write to several
+// keys is one record, recovered all or none. Once the journal has grown
+// past CompactSize it is rewritten as a snapshot, during the write that
+// grew it. Close closes the journal.
+func NewMemStoreFromJournal[T any](opt store.StoreOptions[T]) (store.Store[T], error) {
+	if opt.Journal.Path == "" {
+		return nil, errors.New("gomap: no journal path")
+	}
+	ms := newMemStore(opt)
+	now := ms.now()
+	j, err := openJournal(opt.Journal, func(op journalOp) error {
+		if op.del {
+			ms.deleteKeys(op.kind, []string{op.key}, &store.WriteCfg{})
+			return nil
+		}
+		var v T
+		if err := opt.Journal.Codec.Unmarshal(op.value, &v); err != nil {
+			return err
+		}
+		ms.ensureKind(op.kind)
+		ms.kinds[op.kind][op.key] = v
+		ms.modified[op.kind][op.key] = now
+		ms.versions[op.kind][op.key] = 1
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ms.journal = j
+	if err := ms.seedDefaults(opt.Defaults); err != nil {
+		j.close()
+		return nil, err
+	}
+	if err := store.ValidateStored[T](ms, opt); err != nil {
+		j.close()
+		return nil, err
+	}
+	return ms, nil
+}
+
+// journalSet appends the set of kind/key to ops, if the store has a
+// journal.
+func (s *memStore[T]) journalSet(ops []journalOp, kind, key string, v T) ([]journalOp, error) {
+	if s.journal == nil {
+		return nil, nil
+	}
+	data, err := s.journal.cfg.Codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("gomap: journal: encode %s/%s: %w", kind, key, err)
+	}
+	return append(ops, journalOp{kind: kind, key: key, value: data}), nil
+}
+
+// journalSets appends the sets of keys of kind to values[k] to ops.
+func (s *memStore[T]) journalSets(ops []journalOp, kind string, keys []string, values map[string]T) ([]journalOp, error) {
+	if s.journal == nil {
+		return nil, nil
+	}
+	var err error
+	for _, k := range keys {
+		if ops, err = s.journalSet(ops, kind, k, values[k]); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// logSets logs the sets of keys of kind to values[k]. Callers hold s.mu,
+// and apply the sets only if it returns nil.
+func (s *memStore[T]) logSets(kind string, keys []string, values map[string]T) error {
+	ops, err := s.journalSets(nil, kind, keys, values)
+	if err != nil {
+		return err
+	}
+	return s.logWrite(ops)
+}
+
+// journalDeletes appends the deletes of keys of kind to ops.
+func (s *memStore[T]) journalDeletes(ops []journalOp, kind string, keys ...string) []journalOp {
+	if s.journal == nil {
+		return nil
+	}
+	for _, k := range keys {
+		ops = append(ops, journalOp{del: true, kind: kind, key: k})
+	}
+	return ops
+}
+
+// logWrite appends ops to the journal as one record, compacting it if it
+// has grown too large. Callers hold s.mu, and apply the write only if it
+// returns nil.
+func (s *memStore[T]) logWrite(ops []journalOp) error {
+	if s.journal == nil || len(ops) == 0 {
+		return nil
+	}
+	if err := s.journal.append(ops); err != nil {
+		return err
+	}
+	if s.journal.needsCompaction() {
+		// the write is already logged; a failed compaction leaves the
+		// journal as it was, to be tried again on a later write
+		if err := s.compactJournal(ops); err != nil {
+			log.Printf("zestor/gomap: %v", err)
+		}
+	}
+	return nil
+}
+
+// compactJournal rewrites the journal as a snapshot of the values with
+// pending, the write just logged, applied. Callers hold s.mu.
+func (s *memStore[T]) compactJournal(pending []journalOp) error {
+	snap := make(map[string]map[string][]byte, len(s.kinds))
+	for kind, m := range s.kinds {
+		enc := make(map[string][]byte, len(m))
+		for k, v := range m {
+			data, err := s.journal.cfg.Codec.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("journal compaction: encode %s/%s: %w", kind, k, err)
+			}
+			enc[k] = data
+		}
+		snap[kind] = enc
+	}
+	for _, op := range pending {
+		if op.del {
+			delete(snap[op.kind], op.key)
+			continue
+		}
+		if snap[op.kind] == nil {
+			snap[op.kind] = make(map[string][]byte)
+		}
+		snap[op.kind][op.key] = op.value
+	}
+	for kind, m := range snap {
+		if len(m) == 0 {
+			delete(snap, kind)
+		}
+	}
+	return s.journal.compact(snap)
+}
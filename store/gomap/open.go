@@ -0,0 +1,43 @@
+package gomap
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// Scheme is the URL scheme store.Open serves with an in-memory store,
+// e.g. "mem://", "mem://?history=100" or, logging writes to a journal
+// encoded with the codec passed to Open, "mem://?journal=/var/lib/app/mem.journal&fsync=1".
+const Scheme = "mem"
+
+func init() {
+	store.RegisterBackend(Scheme, store.Backend{
+		Params: []string{"journal", "fsync"},
+		Open:   open,
+	})
+}
+
+func open(u *url.URL, c store.Codec, p store.Params, so store.StoreOptions[any]) (store.Store[any], error) {
+	if u.Host != "" || u.Path != "" || u.Opaque != "" {
+		return nil, fmt.Errorf("gomap: %s://%s: an in-memory store takes no path", Scheme, u.Host+u.Path+u.Opaque)
+	}
+	path := p.String("journal", "")
+	fsync, err := p.Int("fsync", 0)
+	if err != nil {
+		return nil, fmt.Errorf("gomap: %w", err)
+	}
+	if path == "" {
+		if p.Has("fsync") {
+			return nil, errors.New("gomap: parameter fsync without journal")
+		}
+		return New[any](so)
+	}
+	if c == nil {
+		return nil, errors.New("gomap: a journal needs a codec")
+	}
+	so.Journal = store.JournalConfig{Path: path, Codec: c, FsyncEvery: fsync}
+	return NewMemStoreFromJournal[any](so)
+}
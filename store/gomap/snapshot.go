@@ -0,0 +1,119 @@
+package gomap
+
+import (
+	"maps"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// snapshot is a read-only view over a private copy of one kind.
+type snapshot[T any] struct {
+	kind string
+	ms   *memStore[T]
+}
+
+// Snapshot copies kind (copy-on-read), so the view costs O(n) up front but
+// never blocks writers afterwards.
+func (s *memStore[T]) Snapshot(kind string) (store.Reader[T], func(), error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, nil, store.ErrClosed
+	}
+	labels := make(map[string]map[string]string, len(s.labels[kind]))
+	maps.Copy(labels, s.labels[kind])
+	v := &snapshot[T]{
+		kind: kind,
+		ms: &memStore[T]{
+			kinds:       map[string]map[string]T{kind: cloneMap(s.kinds[kind])},
+			labels:      map[string]map[string]map[string]string{kind: labels},
+			cloneFn:     s.cloneFn,
+			cloneOnRead: s.cloneOnRead,
+		},
+	}
+	release := func() {
+		v.ms.mu.Lock()
+		defer v.ms.mu.Unlock()
+		v.ms.closed = true
+		v.ms.kinds = nil
+		v.ms.labels = nil
+	}
+	return v, release, nil
+}
+
+func (v *snapshot[T]) check(kind string) error {
+	if kind != v.kind {
+		return store.ErrOutsideSnapshot
+	}
+	return nil
+}
+
+func (v *snapshot[T]) Get(kind, key string) (T, bool, error) {
+	if err := v.check(kind); err != nil {
+		var zero T
+		return zero, false, err
+	}
+	return v.ms.Get(kind, key)
+}
+
+func (v *snapshot[T]) List(kind string, filters ...store.FilterFunc[T]) (map[string]T, error) {
+	if err := v.check(kind); err != nil {
+		return nil, err
+	}
+	return v.ms.List(kind, filters...)
+}
+
+func (v *snapshot[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	if err := v.check(kind); err != nil {
+		return nil, err
+	}
+	return v.ms.ListPrefix(kind, prefix)
+}
+
+func (v *snapshot[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	if err := v.check(kind); err != nil {
+		return nil, err
+	}
+	return v.ms.KeySegments(kind, separator, prefix)
+}
+
+func (v *snapshot[T]) Count(kind string) (int, error) {
+	if err := v.check(kind); err != nil {
+		return 0, err
+	}
+	return v.ms.Count(kind)
+}
+
+func (v *snapshot[T]) Keys(kind string) ([]string, error) {
+	if err := v.check(kind); err != nil {
+		return nil, err
+	}
+	return v.ms.Keys(kind)
+}
+
+func (v *snapshot[T]) Values(kind string) ([]store.KeyValue[T], error) {
+	if err := v.check(kind); err != nil {
+		return nil, err
+	}
+	return v.ms.Values(kind)
+}
+
+func (v *snapshot[T]) SelectByLabel(kind string, selector map[string]string) ([]store.KeyValue[T], error) {
+	if err := v.check(kind); err != nil {
+		return nil, err
+	}
+	return v.ms.SelectByLabel(kind, selector)
+}
+
+// Kinds returns the snapshotted kind if it holds any key.
+func (v *snapshot[T]) Kinds() ([]string, error) {
+	return v.ms.Kinds()
+}
+
+// GetAll returns only the snapshotted kind.
+func (v *snapshot[T]) GetAll() (map[string]map[string]T, error) {
+	return v.ms.GetAll()
+}
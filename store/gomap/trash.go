@@ -0,0 +1,121 @@
+package gomap
+
+import (
+	"maps"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// trashed is a soft-deleted value (store.SoftDeleter).
+type trashed[T any] struct {
+	value   T
+	labels  map[string]string
+	version int64
+	// when it was soft-deleted, for PurgeDeleted
+	at time.Time
+}
+
+func (s *memStore[T]) SoftDelete(kind, key string) (bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, store.ErrClosed
+	}
+	s.ensureKind(kind)
+	v, existed := s.kinds[kind][key]
+	if !existed {
+		s.mu.Unlock()
+		return false, nil
+	}
+	if err := s.logWrite(s.journalDeletes(nil, kind, key)); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	at := s.now()
+	version := s.versions[kind][key]
+	if s.trash[kind] == nil {
+		s.trash[kind] = make(map[string]trashed[T])
+	}
+	s.trash[kind][key] = trashed[T]{value: v, labels: s.labels[kind][key], version: version, at: at}
+	delete(s.kinds[kind], key)
+	delete(s.labels[kind], key)
+	delete(s.modified[kind], key)
+	delete(s.versions[kind], key)
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, []*store.Event[T]{{Kind: kind, Name: key, EventType: store.EventTypeDelete, Object: v, At: at, Version: version}}, nil)
+	return true, nil
+}
+
+func (s *memStore[T]) Restore(kind, key string) (bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, store.ErrClosed
+	}
+	s.ensureKind(kind)
+	t, ok := s.trash[kind][key]
+	if !ok {
+		s.mu.Unlock()
+		return false, nil
+	}
+	if _, exists := s.kinds[kind][key]; exists {
+		s.mu.Unlock()
+		return false, store.ErrKeyExists
+	}
+	if err := s.logSets(kind, []string{key}, map[string]T{key: t.value}); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	delete(s.trash[kind], key)
+	at := s.now()
+	s.kinds[kind][key] = t.value
+	if t.labels != nil {
+		s.labels[kind][key] = t.labels
+	}
+	s.modified[kind][key] = at
+	s.versions[kind][key] = t.version
+	turn := s.unlockTurn()
+
+	s.publish(kind, turn, []*store.Event[T]{{Kind: kind, Name: key, EventType: store.EventTypeCreate, Object: t.value, At: at, Version: t.version}}, nil)
+	return true, nil
+}
+
+func (s *memStore[T]) ListDeleted(kind string) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, store.ErrClosed
+	}
+	rs := make(map[string]T, len(s.trash[kind]))
+	for k, t := range s.trash[kind] {
+		rs[k] = s.readClone(t.value)
+	}
+	return rs, nil
+}
+
+func (s *memStore[T]) PurgeDeleted(kind string, cutoff time.Time) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, store.ErrClosed
+	}
+	n := len(s.trash[kind])
+	maps.DeleteFunc(s.trash[kind], func(_ string, t trashed[T]) bool {
+		return t.at.Before(cutoff)
+	})
+	return n - len(s.trash[kind]), nil
+}
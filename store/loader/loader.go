@@ -0,0 +1,255 @@
+// Package loader puts a store in front of a slow source, such as a remote
+// API, as a read-through cache. A Get that misses the store loads the
+// value from the source, writes it to the store and returns it:
+//
+//	s := loader.Wrap(users, func(ctx context.Context, kind, key string) (User, bool, error) {
+//		return api.FetchUser(ctx, key)
+//	}, loader.Options{TTL: time.Hour, NegativeTTL: time.Minute})
+//	u, ok, err := s.Get("users", "alice")
+//
+// Concurrent misses on one key share a single load, and "not found"
+// answers can be remembered for a while so that repeated misses on keys
+// the source doesn't have don't reach it each time.
+package loader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// LoadFunc fetches the value of kind and key from the source, reporting
+// false when the source has none.
+type LoadFunc[T any] func(ctx context.Context, kind, key string) (T, bool, error)
+
+// Options configures Wrap. The zero value loads each missing value once
+// and keeps it in the store for good, and remembers neither "not found"
+// nor errors.
+type Options struct {
+	// TTL is how long a loaded value is served from the store before Get
+	// loads it again; 0 means until it is deleted. It counts from the
+	// load, whoever writes the key afterwards, and applies to the values
+	// this Store loaded: values that were already in the store don't
+	// expire. List and the other reads return values past their TTL.
+	TTL time.Duration
+	// NegativeTTL is how long Get returns "not found" without asking the
+	// source again after it had no value; 0 asks every time. A value
+	// written to the store meanwhile is returned as usual.
+	NegativeTTL time.Duration
+	// ErrorTTL is how long Get returns the error of a failed load without
+	// retrying it; 0 retries on the next Get.
+	ErrorTTL time.Duration
+	// LoadTimeout bounds the context each load runs with; 0 means none.
+	LoadTimeout time.Duration
+	// Now returns the current time for the TTLs; time.Now when nil.
+	Now func() time.Time
+}
+
+// Store is a store.Store whose Get loads missing values. Every other
+// method, List and Keys included, passes through to the wrapped store
+// unchanged and never loads.
+type Store[T any] struct {
+	store.Store[T]
+	load   LoadFunc[T]
+	o      Options
+	flight *store.SingleflightReader[T]
+
+	mu sync.Mutex
+	// expiry of the values loaded with a TTL
+	loaded map[entry]time.Time
+	// keys the source had no value for, and failed loads, until when Get
+	// remembers them
+	missing map[entry]time.Time
+	failed  map[entry]failure
+	// size of missing and failed that triggers a sweep of expired entries
+	sweepAt int
+}
+
+type entry struct {
+	kind, key string
+}
+
+type failure struct {
+	err   error
+	until time.Time
+}
+
+// minSweep is the smallest map size at which expired negative and error
+// entries are swept.
+const minSweep = 1024
+
+// Wrap returns s reading through to load.
+func Wrap[T any](s store.Store[T], load LoadFunc[T], o Options) *Store[T] {
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	l := &Store[T]{
+		Store:   s,
+		load:    load,
+		o:       o,
+		loaded:  make(map[entry]time.Time),
+		missing: make(map[entry]time.Time),
+		failed:  make(map[entry]failure),
+		sweepAt: minSweep,
+	}
+	// misses go through the flight, whose Get is fetch
+	l.flight = store.NewSingleflightReader[T](fetcher[T]{s, l})
+	return l
+}
+
+// fetcher is the reader behind the flight of missed Gets.
+type fetcher[T any] struct {
+	store.Reader[T]
+	l *Store[T]
+}
+
+func (f fetcher[T]) Get(kind, key string) (T, bool, error) {
+	return f.l.fetch(kind, key)
+}
+
+// Get returns the value of kind and key from the store, or else from the
+// source, writing it to the store. Concurrent Gets of a key missing from
+// the store share one load and its result. An error of the store is
+// returned without loading.
+func (l *Store[T]) Get(kind, key string) (T, bool, error) {
+	if v, ok, err := l.cached(kind, key); ok || err != nil {
+		return v, ok, err
+	}
+	return l.flight.Get(kind, key)
+}
+
+// Codec returns the codec of the wrapped store.
+func (l *Store[T]) Codec() store.Codec {
+	return store.CodecOf(l.Store)
+}
+
+// Info describes the wrapped store, seen through a "loader", with the
+// feature "ttl" if Options.TTL is set.
+func (l *Store[T]) Info() store.Info {
+	var features []string
+	if l.o.TTL > 0 {
+		features = append(features, "ttl")
+	}
+	return store.WrappedInfo(l.Store, "loader", features...)
+}
+
+// WatcherCount returns the watchers of the wrapped store.
+func (l *Store[T]) WatcherCount() int {
+	return store.WatcherCountOf(l.Store)
+}
+
+// KindWatcherCount returns the watchers of kind on the wrapped store.
+func (l *Store[T]) KindWatcherCount(kind string) int {
+	return store.KindWatcherCountOf(l.Store, kind)
+}
+
+// cached returns the value the store holds for kind and key, unless its
+// TTL is up.
+func (l *Store[T]) cached(kind, key string) (T, bool, error) {
+	var zero T
+	v, ok, err := l.Store.Get(kind, key)
+	if err != nil || !ok {
+		return zero, false, err
+	}
+	l.mu.Lock()
+	until, expires := l.loaded[entry{kind, key}]
+	l.mu.Unlock()
+	if expires && !l.o.Now().Before(until) {
+		return zero, false, nil
+	}
+	return v, true, nil
+}
+
+// fetch loads kind and key, unless the store got the value while the
+// caller waited for the flight or the negative or error cache answers.
+func (l *Store[T]) fetch(kind, key string) (T, bool, error) {
+	var zero T
+	if v, ok, err := l.cached(kind, key); ok || err != nil {
+		return v, ok, err
+	}
+	e := entry{kind, key}
+	now := l.o.Now()
+	l.mu.Lock()
+	if until, ok := l.missing[e]; ok {
+		if now.Before(until) {
+			l.mu.Unlock()
+			return zero, false, nil
+		}
+		delete(l.missing, e)
+	}
+	if f, ok := l.failed[e]; ok {
+		if now.Before(f.until) {
+			l.mu.Unlock()
+			return zero, false, f.err
+		}
+		delete(l.failed, e)
+	}
+	l.mu.Unlock()
+
+	ctx, cancel := context.Background(), func() {}
+	if l.o.LoadTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, l.o.LoadTimeout)
+	}
+	v, found, err := l.load(ctx, kind, key)
+	cancel()
+	now = l.o.Now()
+	switch {
+	case err != nil:
+		if l.o.ErrorTTL > 0 {
+			l.mu.Lock()
+			l.failed[e] = failure{err, now.Add(l.o.ErrorTTL)}
+			l.sweep(now)
+			l.mu.Unlock()
+		}
+		return zero, false, err
+	case !found:
+		l.mu.Lock()
+		_, stale := l.loaded[e]
+		delete(l.loaded, e)
+		if l.o.NegativeTTL > 0 {
+			l.missing[e] = now.Add(l.o.NegativeTTL)
+			l.sweep(now)
+		}
+		l.mu.Unlock()
+		// the source dropped a value the store still holds past its TTL
+		if stale {
+			if _, _, err := l.Store.Delete(kind, key, store.WithoutPrev()); err != nil {
+				return zero, false, fmt.Errorf("loader: delete expired %s/%s: %w", kind, key, err)
+			}
+		}
+		return zero, false, nil
+	}
+	if _, err := l.Store.Set(kind, key, v); err != nil {
+		return zero, false, fmt.Errorf("loader: write back %s/%s: %w", kind, key, err)
+	}
+	l.mu.Lock()
+	if l.o.TTL > 0 {
+		l.loaded[e] = now.Add(l.o.TTL)
+	} else {
+		delete(l.loaded, e)
+	}
+	l.mu.Unlock()
+	return v, true, nil
+}
+
+// sweep drops the expired negative and error entries once there are many.
+// l.mu is held.
+func (l *Store[T]) sweep(now time.Time) {
+	if len(l.missing)+len(l.failed) < l.sweepAt {
+		return
+	}
+	for e, until := range l.missing {
+		if !now.Before(until) {
+			delete(l.missing, e)
+		}
+	}
+	for e, f := range l.failed {
+		if !now.Before(f.until) {
+			delete(l.failed, e)
+		}
+	}
+	l.sweepAt = max(minSweep, 2*(len(l.missing)+len(l.failed)))
+}
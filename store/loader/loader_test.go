@@ -0,0 +1,235 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+	"github.com/zestor-dev/zestor/store/typed"
+)
+
+// source is a counting loader over a map of values.
+type source struct {
+	calls   atomic.Int32
+	mu      sync.Mutex
+	values  map[string]string
+	err     error
+	release chan struct{} // if set, loads wait for it
+}
+
+func (s *source) load(ctx context.Context, kind, key string) (string, bool, error) {
+	s.calls.Add(1)
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return "", false, s.err
+	}
+	v, ok := s.values[key]
+	return v, ok, nil
+}
+
+// clock is a fake clock for Options.Now.
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time { return c.now }
+
+func TestGetLoadsOnce(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[string]{})
+	defer base.Close()
+	src := &source{values: map[string]string{"a": "loaded"}, release: make(chan struct{})}
+	s := Wrap(base, src.load, Options{})
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok, err := s.Get("k", "a"); v != "loaded" || !ok || err != nil {
+				t.Errorf("Get = %q, %v, %v", v, ok, err)
+			}
+		}()
+	}
+	// let the goroutines pile up on the load
+	time.Sleep(50 * time.Millisecond)
+	close(src.release)
+	wg.Wait()
+	if got := src.calls.Load(); got != 1 {
+		t.Fatalf("%d loads for %d concurrent Gets, want 1", got, n)
+	}
+	if v, ok, _ := base.Get("k", "a"); !ok || v != "loaded" {
+		t.Fatalf("not written back: %q, %v", v, ok)
+	}
+	// List and Keys pass through and never load
+	if keys, _ := s.Keys("k"); len(keys) != 1 {
+		t.Fatalf("Keys = %v", keys)
+	}
+	if m, _ := s.List("other"); len(m) != 0 || src.calls.Load() != 1 {
+		t.Fatalf("List = %v after %d loads", m, src.calls.Load())
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[string]{})
+	defer base.Close()
+	c := &clock{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	src := &source{values: map[string]string{}}
+	s := Wrap(base, src.load, Options{NegativeTTL: time.Minute, Now: c.Now})
+
+	for i := 0; i < 3; i++ {
+		if _, ok, err := s.Get("k", "missing"); ok || err != nil {
+			t.Fatalf("Get(missing) = %v, %v", ok, err)
+		}
+	}
+	if got := src.calls.Load(); got != 1 {
+		t.Fatalf("%d loads within NegativeTTL, want 1", got)
+	}
+	// a value written meanwhile is returned despite the negative entry
+	base.Set("k", "missing", "set")
+	if v, ok, _ := s.Get("k", "missing"); !ok || v != "set" {
+		t.Fatalf("Get after Set = %q, %v", v, ok)
+	}
+	base.Delete("k", "missing")
+
+	c.now = c.now.Add(time.Minute - time.Nanosecond)
+	s.Get("k", "missing")
+	if got := src.calls.Load(); got != 1 {
+		t.Fatalf("%d loads just before the negative entry expired, want 1", got)
+	}
+	c.now = c.now.Add(time.Nanosecond)
+	src.values["missing"] = "now here"
+	if v, ok, _ := s.Get("k", "missing"); !ok || v != "now here" || src.calls.Load() != 2 {
+		t.Fatalf("Get after expiry = %q, %v after %d loads", v, ok, src.calls.Load())
+	}
+
+	// without NegativeTTL every miss asks the source
+	s = Wrap(base, src.load, Options{Now: c.Now})
+	s.Get("k", "gone")
+	s.Get("k", "gone")
+	if got := src.calls.Load(); got != 4 {
+		t.Fatalf("%d loads without NegativeTTL, want 4", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[string]{})
+	defer base.Close()
+	c := &clock{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	boom := errors.New("boom")
+	src := &source{err: boom}
+
+	s := Wrap(base, src.load, Options{NegativeTTL: time.Minute, Now: c.Now})
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Get("k", "a"); !errors.Is(err, boom) {
+			t.Fatalf("Get = %v, want boom", err)
+		}
+	}
+	if got := src.calls.Load(); got != 2 {
+		t.Fatalf("errors cached without ErrorTTL: %d loads", got)
+	}
+
+	src.calls.Store(0)
+	s = Wrap(base, src.load, Options{ErrorTTL: time.Second, Now: c.Now})
+	s.Get("k", "a")
+	if _, _, err := s.Get("k", "a"); !errors.Is(err, boom) || src.calls.Load() != 1 {
+		t.Fatalf("Get within ErrorTTL = %v after %d loads", err, src.calls.Load())
+	}
+	c.now = c.now.Add(time.Second)
+	src.err, src.values = nil, map[string]string{"a": "ok"}
+	if v, ok, err := s.Get("k", "a"); v != "ok" || !ok || err != nil || src.calls.Load() != 2 {
+		t.Fatalf("Get after ErrorTTL = %q, %v, %v after %d loads", v, ok, err, src.calls.Load())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[string]{})
+	defer base.Close()
+	c := &clock{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	src := &source{values: map[string]string{"a": "v1"}}
+	s := Wrap(base, src.load, Options{TTL: time.Hour, Now: c.Now})
+	base.Set("k", "preset", "kept")
+
+	s.Get("k", "a")
+	src.values["a"] = "v2"
+	c.now = c.now.Add(59 * time.Minute)
+	if v, _, _ := s.Get("k", "a"); v != "v1" {
+		t.Fatalf("Get within TTL = %q, want v1", v)
+	}
+	c.now = c.now.Add(time.Minute)
+	if v, _, _ := s.Get("k", "a"); v != "v2" || src.calls.Load() != 2 {
+		t.Fatalf("Get after TTL = %q after %d loads, want v2 after 2", v, src.calls.Load())
+	}
+	if v, _, _ := s.Get("k", "preset"); v != "kept" || src.calls.Load() != 2 {
+		t.Fatalf("value not loaded by the Store expired: %q", v)
+	}
+
+	// the source dropping an expired value deletes it from the store
+	delete(src.values, "a")
+	c.now = c.now.Add(time.Hour)
+	if _, ok, err := s.Get("k", "a"); ok || err != nil {
+		t.Fatalf("Get of a dropped value = %v, %v", ok, err)
+	}
+	if _, ok, _ := base.Get("k", "a"); ok {
+		t.Fatal("expired value left in the store")
+	}
+}
+
+func TestStoreErrorsSkipLoad(t *testing.T) {
+	base := gomap.NewMemStore[string](store.StoreOptions[string]{AllowedKinds: []string{"k"}})
+	defer base.Close()
+	src := &source{values: map[string]string{"a": "v"}}
+	s := Wrap(base, src.load, Options{})
+	if _, _, err := s.Get("other", "a"); !errors.Is(err, store.ErrUnknownKind) || src.calls.Load() != 0 {
+		t.Fatalf("Get of a disallowed kind = %v after %d loads", err, src.calls.Load())
+	}
+}
+
+func TestInfoThroughWrappers(t *testing.T) {
+	base, err := store.Open[json.RawMessage]("mem://?history=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	reg := typed.NewRegistry(nil)
+	wrapped := Wrap[json.RawMessage](typed.Wrap(store.Overlay(base), reg), func(context.Context, string, string) (json.RawMessage, bool, error) {
+		return nil, false, nil
+	}, Options{TTL: time.Minute})
+
+	var s store.Store[json.RawMessage] = wrapped
+	i, ok := s.(store.Introspector)
+	if !ok {
+		t.Fatal("loader store is not an Introspector")
+	}
+	want := store.Info{
+		Backend:  "gomap",
+		Features: []string{"history", "ttl"},
+		Wrappers: []string{"overlay", "typed", "loader"},
+		// all but synchronous, which stores from Open can't honor
+		WatchFeatures: []store.WatchFeature{
+			store.WatchEvictAfterDrops, store.WatchEventTypes, store.WatchInitialReplay, store.WatchKeys,
+			store.WatchMinVersions, store.WatchReplayHistory, store.WatchSaturationAlert, store.WatchTransition,
+		},
+	}
+	if got := i.Info(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+	if c := i.Codec(); c != nil {
+		t.Errorf("Codec() = %T, want nil for gomap", c)
+	}
+
+	// a wrapped store that can't tell reports the wrappers alone
+	bare := Wrap[string](struct{ store.Store[string] }{gomap.NewMemStore(store.StoreOptions[string]{})}, nil, Options{})
+	if got := bare.Info(); !reflect.DeepEqual(got, store.Info{Wrappers: []string{"loader"}}) {
+		t.Errorf("Info() of an opaque store = %+v", got)
+	}
+}
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownScheme is returned by Open for a URL whose scheme no backend
+// registered.
+var ErrUnknownScheme = errors.New("unknown store scheme")
+
+// Codec encodes the values of a store opened with Open. The codec.Codec
+// implementations satisfy it.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Backend is a store implementation Open can pick by URL scheme.
+type Backend struct {
+	// Params are the query parameters the backend reads, besides the ones
+	// Open handles for every backend. Open rejects any other parameter.
+	Params []string
+	// Open returns a store for u. Its values are the T of the Open call,
+	// boxed in any; c, when not nil, encodes them and decodes data into a
+	// *any as a T. so holds the options Open parsed from u.
+	Open func(u *url.URL, c Codec, p Params, so StoreOptions[any]) (Store[any], error)
+}
+
+var (
+	muBackends sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+// RegisterBackend makes a backend available to Open under scheme. Backend
+// packages call it from init, so importing them is enough:
+//
+//	import _ "github.com/zestor-dev/zestor/store/sqlite"
+//
+// It panics if scheme is registered twice or b.Open is nil.
+func RegisterBackend(scheme string, b Backend) {
+	muBackends.Lock()
+	defer muBackends.Unlock()
+	if b.Open == nil {
+		panic("store: RegisterBackend " + scheme + " without Open")
+	}
+	if _, dup := backends[scheme]; dup {
+		panic("store: RegisterBackend called twice for " + scheme)
+	}
+	backends[scheme] = b
+}
+
+// Schemes returns the registered schemes, sorted.
+func Schemes() []string {
+	muBackends.RLock()
+	defer muBackends.RUnlock()
+	schemes := make([]string, 0, len(backends))
+	for s := range backends {
+		schemes = append(schemes, s)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Query parameters Open reads for every backend, into StoreOptions.
+const (
+	ParamAllowedKinds     = "kinds"       // AllowedKinds, comma-separated
+	ParamEventHistory     = "history"     // EventHistory
+	ParamMaxListResults   = "max_list"    // MaxListResults
+	ParamMaxGetAllResults = "max_get_all" // MaxGetAllResults
+)
+
+var commonParams = []string{ParamAllowedKinds, ParamEventHistory, ParamMaxListResults, ParamMaxGetAllResults}
+
+// OpenCfg holds the options of Open.
+type OpenCfg struct {
+	// parameters set on top of the URL's query, e.g. secrets kept out of it
+	Params url.Values
+}
+
+// OpenOption is a functional option for Open.
+type OpenOption func(*OpenCfg)
+
+// WithParam sets the query parameter key to value, replacing the URL's.
+func WithParam(key, value string) OpenOption {
+	return func(c *OpenCfg) {
+		if c.Params == nil {
+			c.Params = make(url.Values)
+		}
+		c.Params.Set(key, value)
+	}
+}
+
+// Open returns a store of the backend registered for the scheme of
+// rawURL, e.g. "mem://" or "sqlite:///var/lib/app/data.db?busy_timeout=5s",
+// so one binary can pick its backend from configuration. Backends that
+// serialize values encode them with c.
+//
+// The URL's query parameters configure the backend; an unknown parameter
+// or a malformed value is an error. Every backend reads "kinds",
+// "history", "max_list" and "max_get_all" into the StoreOptions of the
+// same name. Options taking T, such as CompareFn, and interfaces a backend
+// implements beyond Store are only available from its own constructor.
+func Open[T any](rawURL string, c Codec, opts ...OpenOption) (Store[T], error) {
+	var cfg OpenCfg
+	for _, o := range opts {
+		if o != nil {
+			o(&cfg)
+		}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("store: Open: %w", err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("store: Open %q: no scheme, want e.g. mem:// or sqlite:///path: %w", rawURL, ErrUnknownScheme)
+	}
+	muBackends.RLock()
+	b, ok := backends[u.Scheme]
+	muBackends.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("store: Open %q: %w %q (registered: %s); is its package imported?",
+			rawURL, ErrUnknownScheme, u.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	q := u.Query()
+	for k, v := range cfg.Params {
+		q[k] = v
+	}
+	for k := range q {
+		if !contains(commonParams, k) && !contains(b.Params, k) {
+			accepted := append(append([]string{}, commonParams...), b.Params...)
+			sort.Strings(accepted)
+			return nil, fmt.Errorf("store: Open %s: unknown parameter %q, want one of %s", u.Redacted(), k, strings.Join(accepted, ", "))
+		}
+	}
+	p := Params{values: q}
+	so, err := p.storeOptions()
+	if err != nil {
+		return nil, fmt.Errorf("store: Open %s: %w", u.Redacted(), err)
+	}
+	var bc Codec
+	if c != nil {
+		bc = newBoxCodec[T](c)
+	}
+	s, err := b.Open(u, bc, p, so)
+	if err != nil {
+		return nil, err
+	}
+	return &boxed[T]{boxedReader[T]{s}, s}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Params are the query parameters of a URL passed to Open, with the
+// parameters of WithParam applied. The getters return def for a missing
+// parameter and an error naming it for a malformed one.
+type Params struct {
+	values url.Values
+}
+
+// Has reports whether the parameter key is set.
+func (p Params) Has(key string) bool {
+	return p.values.Has(key)
+}
+
+// String returns the parameter key.
+func (p Params) String(key, def string) string {
+	if !p.values.Has(key) {
+		return def
+	}
+	return p.values.Get(key)
+}
+
+// Bool returns the parameter key, as parsed by strconv.ParseBool.
+func (p Params) Bool(key string, def bool) (bool, error) {
+	if !p.values.Has(key) {
+		return def, nil
+	}
+	v, err := strconv.ParseBool(p.values.Get(key))
+	if err != nil {
+		return false, fmt.Errorf("parameter %s=%q: want true or false", key, p.values.Get(key))
+	}
+	return v, nil
+}
+
+// Int returns the parameter key, a decimal integer.
+func (p Params) Int(key string, def int) (int, error) {
+	if !p.values.Has(key) {
+		return def, nil
+	}
+	v, err := strconv.Atoi(p.values.Get(key))
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s=%q: want an integer", key, p.values.Get(key))
+	}
+	return v, nil
+}
+
+// Duration returns the parameter key, as parsed by time.ParseDuration
+// ("5s", "250ms").
+func (p Params) Duration(key string, def time.Duration) (time.Duration, error) {
+	if !p.values.Has(key) {
+		return def, nil
+	}
+	v, err := time.ParseDuration(p.values.Get(key))
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s=%q: want a duration such as 5s or 250ms", key, p.values.Get(key))
+	}
+	return v, nil
+}
+
+// storeOptions reads the parameters every backend takes.
+func (p Params) storeOptions() (StoreOptions[any], error) {
+	var so StoreOptions[any]
+	if kinds := p.String(ParamAllowedKinds, ""); kinds != "" {
+		so.AllowedKinds = strings.Split(kinds, ",")
+	}
+	var err error
+	if so.EventHistory, err = p.Int(ParamEventHistory, 0); err != nil {
+		return so, err
+	}
+	if so.MaxListResults, err = p.Int(ParamMaxListResults, 0); err != nil {
+		return so, err
+	}
+	if so.MaxGetAllResults, err = p.Int(ParamMaxGetAllResults, 0); err != nil {
+		return so, err
+	}
+	return so, nil
+}
+
+// The optional codec.Codec interfaces a boxCodec forwards. The store
+// package doesn't import codec, so it declares their methods itself.
+type (
+	contextCodec interface {
+		MarshalCtx(kind, key string, v any) ([]byte, error)
+		UnmarshalCtx(kind, key string, data []byte, v any) error
+	}
+	bufferedCodec interface {
+		MarshalAppend(dst []byte, v any) ([]byte, error)
+	}
+	deterministicCodec interface{ Deterministic() bool }
+	contentTyper       interface{ ContentType() string }
+)
+
+// codecBox is implemented by the boxCodec wrappers, to get back the codec
+// passed to Open.
+type codecBox interface {
+	unboxed() Codec
+}
+
+// newBoxCodec wraps c in the boxCodec type that has c's optional methods
+// too, so the backend sees them as it would on c itself.
+func newBoxCodec[T any](c Codec) Codec {
+	b := boxCodec[T]{c}
+	_, ctx := c.(contextCodec)
+	_, buf := c.(bufferedCodec)
+	switch {
+	case ctx && buf:
+		return boxCtxBufCodec[T]{boxCtxCodec[T]{b}}
+	case ctx:
+		return boxCtxCodec[T]{b}
+	case buf:
+		return boxBufCodec[T]{b}
+	}
+	return b
+}
+
+// boxCodec decodes into a *any as a T, so a Store[any] built on it holds
+// the same values as a Store[T] would.
+type boxCodec[T any] struct {
+	c Codec
+}
+
+func (b boxCodec[T]) unboxed() Codec { return b.c }
+
+func (b boxCodec[T]) Marshal(v any) ([]byte, error) {
+	return b.c.Marshal(v)
+}
+
+func (b boxCodec[T]) Unmarshal(data []byte, v any) error {
+	return b.unbox(v, func(v any) error { return b.c.Unmarshal(data, v) })
+}
+
+// Deterministic forwards to c; a codec without the method counts as
+// deterministic.
+func (b boxCodec[T]) Deterministic() bool {
+	d, ok := b.c.(deterministicCodec)
+	return !ok || d.Deterministic()
+}
+
+// ContentType forwards to c, with codec.DefaultContentType for a codec
+// without the method.
+func (b boxCodec[T]) ContentType() string {
+	if ct, ok := b.c.(contentTyper); ok {
+		return ct.ContentType()
+	}
+	return "application/octet-stream"
+}
+
+// unbox runs unmarshal on v, or on a T it then stores in v if v is a *any.
+func (b boxCodec[T]) unbox(v any, unmarshal func(v any) error) error {
+	p, ok := v.(*any)
+	if !ok {
+		return unmarshal(v)
+	}
+	var t T
+	if err := unmarshal(&t); err != nil {
+		return err
+	}
+	*p = t
+	return nil
+}
+
+// boxCtxCodec is a boxCodec of a codec.ContextCodec.
+type boxCtxCodec[T any] struct {
+	boxCodec[T]
+}
+
+func (b boxCtxCodec[T]) MarshalCtx(kind, key string, v any) ([]byte, error) {
+	return b.c.(contextCodec).MarshalCtx(kind, key, v)
+}
+
+func (b boxCtxCodec[T]) UnmarshalCtx(kind, key string, data []byte, v any) error {
+	return b.unbox(v, func(v any) error { return b.c.(contextCodec).UnmarshalCtx(kind, key, data, v) })
+}
+
+// boxBufCodec is a boxCodec of a codec.BufferedCodec.
+type boxBufCodec[T any] struct {
+	boxCodec[T]
+}
+
+func (b boxBufCodec[T]) MarshalAppend(dst []byte, v any) ([]byte, error) {
+	return b.c.(bufferedCodec).MarshalAppend(dst, v)
+}
+
+// boxCtxBufCodec is a boxCodec of a codec that is both.
+type boxCtxBufCodec[T any] struct {
+	boxCtxCodec[T]
+}
+
+func (b boxCtxBufCodec[T]) MarshalAppend(dst []byte, v any) ([]byte, error) {
+	return b.c.(bufferedCodec).MarshalAppend(dst, v)
+}
@@ -0,0 +1,243 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+	"github.com/zestor-dev/zestor/store/storetest"
+)
+
+type item struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// the options a "probe" backend was opened with
+var probed struct {
+	timeout time.Duration
+	verbose bool
+	so      store.StoreOptions[any]
+	codec   store.Codec
+}
+
+func init() {
+	store.RegisterBackend("probe", store.Backend{
+		Params: []string{"timeout", "verbose"},
+		Open: func(u *url.URL, c store.Codec, p store.Params, so store.StoreOptions[any]) (store.Store[any], error) {
+			var err error
+			if probed.timeout, err = p.Duration("timeout", time.Second); err != nil {
+				return nil, err
+			}
+			if probed.verbose, err = p.Bool("verbose", false); err != nil {
+				return nil, err
+			}
+			probed.so = so
+			probed.codec = c
+			return gomap.NewMemStore[any](so), nil
+		},
+	})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func TestOpenMem(t *testing.T) {
+	s, err := store.Open[item]("mem://?history=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ch, cancel, _ := s.Watch("items", store.WithReplayHistory[item](), store.WithTransitionFilter[item](func(old, new item) bool {
+		return new.Count > old.Count
+	}))
+	defer cancel()
+	s.Set("items", "a", item{Name: "a", Count: 1})
+	if _, err := s.SetFn("items", "a", func(v item) (item, error) { v.Count++; return v, nil }); err != nil {
+		t.Fatal(err)
+	}
+	s.Set("items", "b", item{Name: "b"})
+	for _, want := range []int{1, 2} {
+		select {
+		case ev := <-ch:
+			if ev.Object.Count != want || ev.Seq != uint64(want) {
+				t.Fatalf("event %+v, want count and seq %d", ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %d", want)
+		}
+	}
+
+	v, ok, err := s.Get("items", "a")
+	if err != nil || !ok || v != (item{Name: "a", Count: 2}) {
+		t.Fatalf("Get = %+v, %v, %v", v, ok, err)
+	}
+	if _, ok, _ := s.Get("items", "missing"); ok {
+		t.Fatal("Get(missing) found a value")
+	}
+	m, err := s.List("items", func(key string, v item) bool { return v.Count == 0 })
+	if err != nil || len(m) != 1 || m["b"].Name != "b" {
+		t.Fatalf("List = %v, %v", m, err)
+	}
+	view, release, err := store.Snapshot(s, "items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if n, _ := view.Count("items"); n != 2 {
+		t.Fatalf("snapshot Count = %d", n)
+	}
+	if existed, prev, err := s.Delete("items", "b"); !existed || prev.Name != "b" || err != nil {
+		t.Fatalf("Delete = %v, %+v, %v", existed, prev, err)
+	}
+
+	// a watcher's channel closes with the store
+	s.Close()
+	select {
+	case _, ok := <-ch:
+		for ok {
+			_, ok = <-ch
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel open after Close")
+	}
+}
+
+func TestOpenParams(t *testing.T) {
+	s, err := store.Open[item]("probe://?timeout=250ms&verbose=true&history=5&kinds=a,b", jsonCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if probed.timeout != 250*time.Millisecond || !probed.verbose {
+		t.Errorf("backend params: timeout %v, verbose %v", probed.timeout, probed.verbose)
+	}
+	if probed.so.EventHistory != 5 || strings.Join(probed.so.AllowedKinds, ",") != "a,b" {
+		t.Errorf("store options: %+v", probed.so)
+	}
+
+	// WithParam overrides the URL; the default applies when unset
+	s, err = store.Open[item]("probe://?timeout=1h", nil, store.WithParam("timeout", "2s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if probed.timeout != 2*time.Second || probed.verbose {
+		t.Errorf("after WithParam: timeout %v, verbose %v", probed.timeout, probed.verbose)
+	}
+
+	for url, want := range map[string]string{
+		"probe://?timeout=5":     `timeout="5": want a duration`,
+		"probe://?verbose=maybe": `verbose="maybe": want true or false`,
+		"probe://?history=lots":  `history="lots": want an integer`,
+		"probe://?timout=5s":     `unknown parameter "timout"`,
+		"mem://?timeout=5s":      `unknown parameter "timeout"`,
+		"mem://named":            "takes no path",
+	} {
+		if _, err := store.Open[item](url, nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Open(%s) = %v, want %s", url, err, want)
+		}
+	}
+}
+
+// appendCodec is a buffered codec whose encoding isn't deterministic.
+type appendCodec struct{ jsonCodec }
+
+func (appendCodec) Deterministic() bool { return false }
+
+func (c appendCodec) MarshalAppend(dst []byte, v any) ([]byte, error) {
+	data, err := c.Marshal(v)
+	return append(dst, data...), err
+}
+
+func TestOpenCodecInterfaces(t *testing.T) {
+	s, err := store.Open[item]("probe://", appendCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := probed.codec
+	if d, ok := c.(interface{ Deterministic() bool }); !ok || d.Deterministic() {
+		t.Error("the backend's codec doesn't report the codec non-deterministic")
+	}
+	b, ok := c.(interface {
+		MarshalAppend(dst []byte, v any) ([]byte, error)
+	})
+	if !ok {
+		t.Fatal("the backend's codec has no MarshalAppend")
+	}
+	if data, err := b.MarshalAppend([]byte("x"), item{Name: "a"}); err != nil || string(data) != `x{"name":"a","count":0}` {
+		t.Errorf("MarshalAppend() = %s, %v", data, err)
+	}
+	if _, ok := c.(interface {
+		MarshalCtx(kind, key string, v any) ([]byte, error)
+	}); ok {
+		t.Error("the backend's codec has a MarshalCtx the codec lacks")
+	}
+	var v any
+	if err := c.Unmarshal([]byte(`{"name":"b"}`), &v); err != nil || v != (item{Name: "b"}) {
+		t.Errorf("Unmarshal() = %#v, %v", v, err)
+	}
+}
+
+func TestOpenUnknownScheme(t *testing.T) {
+	for _, url := range []string{"postgres://db/app", "notes.db"} {
+		_, err := store.Open[item](url, nil)
+		if !errors.Is(err, store.ErrUnknownScheme) {
+			t.Errorf("Open(%s) = %v, want ErrUnknownScheme", url, err)
+		}
+	}
+	if _, err := store.Open[item]("postgres://db/app", nil); !strings.Contains(err.Error(), "mem, probe") {
+		t.Errorf("error doesn't list the registered schemes: %v", err)
+	}
+}
+
+func TestOpenConformance(t *testing.T) {
+	storetest.RunReaderTests(t, func(t *testing.T) store.Store[item] {
+		s, err := store.Open[item]("mem://", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+	for _, url := range []string{"mem://", "mem://?history=10"} {
+		t.Run(url, func(t *testing.T) {
+			storetest.RunWatchOptionTests(t, func(t *testing.T) store.Store[item] {
+				s, err := store.Open[item](url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}, item{Name: "a"}, item{Name: "b"})
+		})
+	}
+	storetest.RunReplaceTests(t, func(t *testing.T) store.Store[item] {
+		s, err := store.Open[item]("mem://", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, item{Name: "a"}, item{Name: "b"})
+}
+
+func TestOpenSample(t *testing.T) {
+	s, err := store.Open[item]("mem://", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("items", "a", item{Name: "a", Count: 1})
+	s.Set("items", "b", item{Name: "b", Count: 2})
+	got, err := s.(store.Sampler[item]).Sample("items", 1)
+	if err != nil || len(got) != 1 || got[0].Value.Name != got[0].Key {
+		t.Fatalf("Sample(1) = %v, %v, want one typed entry", got, err)
+	}
+}
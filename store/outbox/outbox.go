@@ -0,0 +1,233 @@
+// Package outbox writes a value and a message about it in one atomic step,
+// and relays the messages to another system, such as a message broker, at
+// least once:
+//
+//	box, err := outbox.New[Order, OrderPlaced](s, "orders", "orders-outbox")
+//	err = box.SetWithMessage("o1", order, OrderPlaced{ID: "o1"})
+//
+//	// elsewhere, one relay per outbox
+//	err = box.Relay(ctx, func(m OrderPlaced) error { return broker.Publish(m) }, outbox.RelayOptions{})
+//
+// Both live in a raw store, the values and messages encoded as JSON, as
+// in package typed. The store must write to several kinds atomically
+// (store.MultiKindWriter): a value is never stored without its message,
+// nor a message sent about a value that wasn't stored.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// Defaults of RelayOptions.
+const (
+	DefaultPollInterval = time.Second
+	DefaultMinBackoff   = 100 * time.Millisecond
+	DefaultMaxBackoff   = 30 * time.Second
+)
+
+// Outbox writes values of type T to one kind of a store together with
+// messages of type M to another.
+type Outbox[T, M any] struct {
+	s                    store.Store[json.RawMessage]
+	w                    store.MultiKindWriter[json.RawMessage]
+	dataKind, outboxKind string
+}
+
+// entry is a message in the outbox kind, with the key of the value it is
+// about.
+type entry[M any] struct {
+	Key string `json:"key"`
+	Msg M      `json:"msg"`
+}
+
+// New returns an outbox writing values to dataKind of s and messages to
+// outboxKind. It returns store.ErrUnsupported if s can't write to both in
+// one step.
+func New[T, M any](s store.Store[json.RawMessage], dataKind, outboxKind string) (*Outbox[T, M], error) {
+	w, ok := s.(store.MultiKindWriter[json.RawMessage])
+	if !ok {
+		return nil, store.ErrUnsupported
+	}
+	if dataKind == outboxKind {
+		return nil, fmt.Errorf("outbox: values and messages need kinds of their own, got %q for both", dataKind)
+	}
+	return &Outbox[T, M]{s: s, w: w, dataKind: dataKind, outboxKind: outboxKind}, nil
+}
+
+// SetWithMessage sets the value of key and adds msg to the outbox, both or
+// neither. Messages are relayed in the order they were added, those about
+// one key strictly so.
+func (o *Outbox[T, M]) SetWithMessage(key string, v T, msg M) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e, err := json.Marshal(entry[M]{Key: key, Msg: msg})
+	if err != nil {
+		return err
+	}
+	// UUIDv7s sort in the order they were made
+	return o.w.SetMulti([]store.KindKeyValue[json.RawMessage]{
+		{Kind: o.dataKind, Key: key, Value: data},
+		{Kind: o.outboxKind, Key: store.NewUUIDv7(), Value: e},
+	})
+}
+
+// Get returns the value of key.
+func (o *Outbox[T, M]) Get(key string) (T, bool, error) {
+	var v T
+	raw, ok, err := o.s.Get(o.dataKind, key)
+	if err != nil || !ok {
+		return v, ok, err
+	}
+	return v, true, json.Unmarshal(raw, &v)
+}
+
+// Pending returns how many messages wait to be relayed.
+func (o *Outbox[T, M]) Pending() (int, error) {
+	return o.s.Count(o.outboxKind)
+}
+
+// RelayOptions configures Relay. The zero value uses the defaults.
+type RelayOptions struct {
+	// PollInterval is how often Relay looks for messages when it hasn't
+	// seen one added; 0 means DefaultPollInterval.
+	PollInterval time.Duration
+	// MinBackoff and MaxBackoff bound the wait before a message whose
+	// publish failed is retried, which doubles with each failure; 0 means
+	// DefaultMinBackoff and DefaultMaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+	// OnError, if set, is called with each failed publish and each error
+	// reading or deleting a message.
+	OnError func(err error)
+}
+
+// retry is the backoff of the first undelivered message about a key.
+type retry struct {
+	failures int
+	next     time.Time
+}
+
+// Relay publishes the messages of the outbox in the order they were added
+// and deletes each once publish returns nil, until ctx is done or the
+// store is closed; it returns ctx.Err() or store.ErrClosed then.
+//
+// Delivery is at least once: a message whose deletion fails, or that was
+// published by a relay stopped before it could delete it, is published
+// again. A message whose publish fails is retried with backoff, and the
+// later messages about the same key wait for it, while those about other
+// keys go on. Run one Relay per outbox.
+func (o *Outbox[T, M]) Relay(ctx context.Context, publish func(M) error, opts RelayOptions) error {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	added, cancel, err := o.s.Watch(o.outboxKind, store.WithEventTypes[json.RawMessage](store.EventTypeCreate))
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	retries := make(map[string]*retry)
+	for {
+		if err := o.drain(ctx, publish, opts, retries); err != nil {
+			return err
+		}
+		wait := opts.PollInterval
+		for _, r := range retries {
+			wait = min(wait, time.Until(r.next))
+		}
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case _, ok := <-added:
+			timer.Stop()
+			if !ok {
+				return store.ErrClosed
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// drain publishes the messages of the outbox once, skipping the keys
+// waiting for a retry.
+func (o *Outbox[T, M]) drain(ctx context.Context, publish func(M) error, opts RelayOptions, retries map[string]*retry) error {
+	report := func(err error) {
+		if opts.OnError != nil {
+			opts.OnError(err)
+		}
+	}
+	ids, err := o.s.Keys(o.outboxKind)
+	if errors.Is(err, store.ErrClosed) {
+		return err
+	}
+	if err != nil {
+		report(err)
+		return nil
+	}
+	sort.Strings(ids)
+	// keys whose earlier message wasn't delivered this round
+	blocked := make(map[string]bool)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		raw, ok, err := o.s.Get(o.outboxKind, id)
+		if err != nil || !ok {
+			if errors.Is(err, store.ErrClosed) {
+				return err
+			}
+			if err != nil {
+				report(err)
+			}
+			continue
+		}
+		var e entry[M]
+		if err := json.Unmarshal(raw, &e); err != nil {
+			report(fmt.Errorf("outbox: message %s: %w", id, err))
+			continue
+		}
+		if blocked[e.Key] {
+			continue
+		}
+		if r := retries[e.Key]; r != nil && time.Now().Before(r.next) {
+			blocked[e.Key] = true
+			continue
+		}
+		if err := publish(e.Msg); err != nil {
+			blocked[e.Key] = true
+			r := retries[e.Key]
+			if r == nil {
+				r = &retry{}
+				retries[e.Key] = r
+			}
+			r.failures++
+			backoff := opts.MinBackoff << min(r.failures-1, 30)
+			r.next = time.Now().Add(min(backoff, opts.MaxBackoff))
+			report(fmt.Errorf("outbox: publish message %s about %q: %w", id, e.Key, err))
+			continue
+		}
+		delete(retries, e.Key)
+		if _, _, err := o.s.Delete(o.outboxKind, id, store.WithoutPrev()); err != nil {
+			// published again next round, before the key's later messages
+			blocked[e.Key] = true
+			report(fmt.Errorf("outbox: delete message %s: %w", id, err))
+		}
+	}
+	return nil
+}
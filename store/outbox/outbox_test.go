@@ -0,0 +1,232 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+type order struct {
+	Total int `json:"total"`
+}
+
+type placed struct {
+	ID  string `json:"id"`
+	Seq int    `json:"seq"`
+}
+
+func setup(t *testing.T, opt store.StoreOptions[json.RawMessage]) (store.Store[json.RawMessage], *Outbox[order, placed]) {
+	t.Helper()
+	s := gomap.NewMemStore[json.RawMessage](opt)
+	t.Cleanup(func() { s.Close() })
+	box, err := New[order, placed](s, "orders", "outbox")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return s, box
+}
+
+func TestNew(t *testing.T) {
+	s := gomap.NewMemStore[json.RawMessage](store.StoreOptions[json.RawMessage]{})
+	defer s.Close()
+	if _, err := New[order, placed](s, "orders", "orders"); err == nil {
+		t.Error("New() with one kind for both: expected error")
+	}
+	var plain struct{ store.Store[json.RawMessage] }
+	plain.Store = s
+	if _, err := New[order, placed](plain, "orders", "outbox"); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("New() without SetMulti error = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestSetWithMessageAtomic(t *testing.T) {
+	reject := errors.New("outbox full")
+	opt := store.StoreOptions[json.RawMessage]{
+		ValidateFns: map[string]store.ValidateFunc[json.RawMessage]{
+			"outbox": func(json.RawMessage) error { return reject },
+		},
+	}
+	s, box := setup(t, opt)
+
+	if err := box.SetWithMessage("o1", order{Total: 5}, placed{ID: "o1"}); !errors.Is(err, reject) {
+		t.Fatalf("SetWithMessage() error = %v, want %v", err, reject)
+	}
+	if _, ok, _ := box.Get("o1"); ok {
+		t.Error("value stored without its message")
+	}
+
+	// two writes in a row, by contrast, leave the value behind
+	if _, err := s.Set("orders", "o2", json.RawMessage(`{"total":5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("outbox", "m2", json.RawMessage(`{}`)); !errors.Is(err, reject) {
+		t.Fatalf("Set(outbox) error = %v", err)
+	}
+	if _, ok, _ := s.Get("orders", "o2"); !ok {
+		t.Error("control: expected the value to be stored alone")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	_, box := setup(t, store.StoreOptions[json.RawMessage]{})
+	for i := 1; i <= 3; i++ {
+		if err := box.SetWithMessage("o1", order{Total: i}, placed{ID: "o1", Seq: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, ok, err := box.Get("o1"); err != nil || !ok || got.Total != 3 {
+		t.Fatalf("Get() = %v, %v, %v", got, ok, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan placed, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- box.Relay(ctx, func(m placed) error { got <- m; return nil }, RelayOptions{PollInterval: time.Hour})
+	}()
+	for i := 1; i <= 3; i++ {
+		if m := recv(t, got); m.Seq != i {
+			t.Fatalf("message %d: got seq %d", i, m.Seq)
+		}
+	}
+	// woken by the watch, not the poll
+	if err := box.SetWithMessage("o2", order{}, placed{ID: "o2"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := recv(t, got); m.ID != "o2" {
+		t.Fatalf("got %+v, want o2", m)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Relay() = %v, want context.Canceled", err)
+	}
+	if n, _ := box.Pending(); n != 0 {
+		t.Errorf("Pending() = %d, want 0", n)
+	}
+}
+
+func TestRelayRestart(t *testing.T) {
+	_, box := setup(t, store.StoreOptions[json.RawMessage]{})
+	if err := box.SetWithMessage("o1", order{Total: 1}, placed{ID: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first relay dies while publishing
+	ctx, cancel := context.WithCancel(context.Background())
+	publishing := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- box.Relay(ctx, func(placed) error {
+			close(publishing)
+			<-ctx.Done()
+			return ctx.Err()
+		}, RelayOptions{})
+	}()
+	<-publishing
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Relay() = %v", err)
+	}
+	if n, _ := box.Pending(); n != 1 {
+		t.Fatalf("Pending() after crash = %d, want 1", n)
+	}
+
+	// the next one delivers the message
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan placed, 1)
+	go box.Relay(ctx, func(m placed) error { got <- m; return nil }, RelayOptions{})
+	if m := recv(t, got); m.ID != "o1" {
+		t.Fatalf("got %+v", m)
+	}
+}
+
+func TestRelayRetryOrder(t *testing.T) {
+	_, box := setup(t, store.StoreOptions[json.RawMessage]{})
+	for _, m := range []placed{{"a", 1}, {"a", 2}, {"b", 1}} {
+		if err := box.SetWithMessage(m.ID, order{}, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var sent []placed
+	failures := 2
+	var errs []error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go box.Relay(ctx, func(m placed) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if m.ID == "a" && failures > 0 {
+			failures--
+			return errors.New("broker down")
+		}
+		sent = append(sent, m)
+		return nil
+	}, RelayOptions{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, OnError: func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(sent)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out, sent %v", sent)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// b isn't held up by a; a's messages stay in order
+	want := []placed{{"b", 1}, {"a", 1}, {"a", 2}}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("OnError called %d times, want 2: %v", len(errs), errs)
+	}
+}
+
+func TestRelayClosed(t *testing.T) {
+	s, box := setup(t, store.StoreOptions[json.RawMessage]{})
+	done := make(chan error, 1)
+	go func() {
+		done <- box.Relay(context.Background(), func(placed) error { return nil }, RelayOptions{})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Relay() = %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay didn't return after Close")
+	}
+}
+
+func recv(t *testing.T, ch <-chan placed) placed {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return placed{}
+	}
+}
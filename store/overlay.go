@@ -0,0 +1,663 @@
+package store
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OverlayStore is a Store whose writes stay in memory on top of a base
+// store until Commit applies them to it, for "what if" changes and for
+// tests sharing one base. Reads see the base through the pending changes:
+// a written key reads its new value, a deleted one reads as missing.
+//
+// Pending writes are not validated, normalized or published: the base
+// does that when Commit applies them, and watchers, which Watch and its
+// variants register on the base, see only committed changes. Add takes
+// its keys from NewUUIDv7, not from the base's StoreOptions.KeyGen.
+type OverlayStore[T any] struct {
+	overlayReader[T]
+	base Store[T]
+}
+
+// overlayReader is a Reader on base with the pending changes of layer
+// applied.
+type overlayReader[T any] struct {
+	base Reader[T]
+
+	mu     sync.RWMutex
+	closed bool
+	// pending changes by kind and key
+	layer map[string]map[string]*overlayEntry[T]
+}
+
+// overlayEntry is the pending change of one key.
+type overlayEntry[T any] struct {
+	value   T
+	deleted bool
+	// labels replacing the base's; nil keeps them
+	labels map[string]string
+}
+
+// Overlay returns an overlay on base. base is shared, not owned: closing
+// the overlay discards its changes and leaves base open.
+func Overlay[T any](base Store[T]) *OverlayStore[T] {
+	return &OverlayStore[T]{
+		overlayReader: overlayReader[T]{base: base, layer: make(map[string]map[string]*overlayEntry[T])},
+		base:          base,
+	}
+}
+
+// rlock read-locks r, failing if it is closed.
+func (r *overlayReader[T]) rlock() error {
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+// get returns the value of kind and key with the pending changes applied.
+// Callers hold r.mu.
+func (r *overlayReader[T]) get(kind, key string) (T, bool, error) {
+	if e, ok := r.layer[kind][key]; ok {
+		var zero T
+		if e.deleted {
+			return zero, false, nil
+		}
+		return e.value, true, nil
+	}
+	return r.base.Get(kind, key)
+}
+
+// merge replaces the base values of kind in m by the pending ones that
+// keep accepts, and drops those the overlay deleted. Callers hold r.mu.
+func (r *overlayReader[T]) merge(kind string, m map[string]T, keep func(key string, v T) bool) {
+	for k, e := range r.layer[kind] {
+		delete(m, k)
+		if !e.deleted && keep(k, e.value) {
+			m[k] = e.value
+		}
+	}
+}
+
+// keys returns the keys of kind with the pending changes applied, sorted.
+// Callers hold r.mu.
+func (r *overlayReader[T]) keys(kind string) ([]string, error) {
+	base, err := r.base.Keys(kind)
+	if err != nil {
+		return nil, err
+	}
+	pending := r.layer[kind]
+	keys := make([]string, 0, len(base)+len(pending))
+	for _, k := range base {
+		if _, ok := pending[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	for k, e := range pending {
+		if !e.deleted {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (r *overlayReader[T]) Get(kind, key string) (T, bool, error) {
+	if err := r.rlock(); err != nil {
+		var zero T
+		return zero, false, err
+	}
+	defer r.mu.RUnlock()
+	return r.get(kind, key)
+}
+
+func (r *overlayReader[T]) List(kind string, filter ...FilterFunc[T]) (map[string]T, error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	m, err := r.base.List(kind, filter...)
+	if err != nil {
+		return nil, err
+	}
+	r.merge(kind, m, func(k string, v T) bool {
+		for _, f := range filter {
+			if f != nil && !f(k, v) {
+				return false
+			}
+		}
+		return true
+	})
+	return m, nil
+}
+
+func (r *overlayReader[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	m, err := ListPrefix(r.base, kind, prefix)
+	if err != nil {
+		return nil, err
+	}
+	r.merge(kind, m, func(k string, _ T) bool { return strings.HasPrefix(k, prefix) })
+	return m, nil
+}
+
+func (r *overlayReader[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	if len(r.layer[kind]) == 0 {
+		return KeySegments(r.base, kind, separator, prefix)
+	}
+	if separator == "" {
+		return nil, ErrSeparatorRequired
+	}
+	keys, err := r.keys(kind)
+	if err != nil {
+		return nil, err
+	}
+	return keySegments(keys, separator, prefix), nil
+}
+
+func (r *overlayReader[T]) Count(kind string) (int, error) {
+	if err := r.rlock(); err != nil {
+		return 0, err
+	}
+	defer r.mu.RUnlock()
+	if len(r.layer[kind]) == 0 {
+		return r.base.Count(kind)
+	}
+	keys, err := r.keys(kind)
+	return len(keys), err
+}
+
+func (r *overlayReader[T]) Kinds() ([]string, error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	base, err := Kinds(r.base)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make([]string, 0, len(base)+len(r.layer))
+	for _, kind := range base {
+		if _, ok := r.layer[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	for kind := range r.layer {
+		keys, err := r.keys(kind)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds, nil
+}
+
+func (r *overlayReader[T]) Keys(kind string) ([]string, error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	return r.keys(kind)
+}
+
+// Values returns the values of kind sorted by key.
+func (r *overlayReader[T]) Values(kind string) ([]KeyValue[T], error) {
+	m, err := r.List(kind)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKVs(m), nil
+}
+
+func (r *overlayReader[T]) GetAll() (map[string]map[string]T, error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	all, err := r.base.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for kind := range r.layer {
+		m := all[kind]
+		if m == nil {
+			m = make(map[string]T)
+		}
+		r.merge(kind, m, func(string, T) bool { return true })
+		if len(m) > 0 {
+			all[kind] = m
+		} else {
+			delete(all, kind)
+		}
+	}
+	return all, nil
+}
+
+// SelectByLabel returns the matching values of kind sorted by key.
+func (r *overlayReader[T]) SelectByLabel(kind string, selector map[string]string) ([]KeyValue[T], error) {
+	if err := r.rlock(); err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	kvs, err := SelectByLabel(r.base, kind, selector)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]T, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	// a pending write without labels keeps the base's, so it matches if
+	// the base key did
+	matched := make(map[string]bool, len(m))
+	for k := range m {
+		matched[k] = true
+	}
+	r.merge(kind, m, func(k string, _ T) bool {
+		e := r.layer[kind][k]
+		if e.labels == nil {
+			return matched[k]
+		}
+		for name, want := range selector {
+			if got, ok := e.labels[name]; !ok || got != want {
+				return false
+			}
+		}
+		return true
+	})
+	return sortedKVs(m), nil
+}
+
+func sortedKVs[T any](m map[string]T) []KeyValue[T] {
+	kvs := make([]KeyValue[T], 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, KeyValue[T]{Key: k, Value: v})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// lock write-locks o, failing if it is closed.
+func (o *OverlayStore[T]) lock() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+// set records value as the pending value of kind and key. labels nil
+// keeps the key's labels; a key that doesn't exist gets none. Callers
+// hold o.mu.
+func (o *OverlayStore[T]) set(kind, key string, value T, labels map[string]string, createOnly bool) (bool, error) {
+	_, existed, err := o.get(kind, key)
+	if err != nil {
+		return false, err
+	}
+	if existed && createOnly {
+		return false, ErrKeyExists
+	}
+	e := &overlayEntry[T]{value: value, labels: maps.Clone(labels)}
+	if prev, ok := o.layer[kind][key]; labels == nil && ok && !prev.deleted {
+		e.labels = prev.labels
+	}
+	if e.labels == nil && !existed {
+		// a key deleted in the overlay must not get its base labels back
+		e.labels = map[string]string{}
+	}
+	if o.layer[kind] == nil {
+		o.layer[kind] = make(map[string]*overlayEntry[T])
+	}
+	o.layer[kind][key] = e
+	return !existed, nil
+}
+
+// Set records the write in the overlay. Of the options, only CreateOnly
+// applies.
+func (o *OverlayStore[T]) Set(kind, key string, value T, opts ...WriteOption) (bool, error) {
+	wc := &WriteCfg{}
+	for _, opt := range opts {
+		opt(wc)
+	}
+	if err := o.lock(); err != nil {
+		return false, err
+	}
+	defer o.mu.Unlock()
+	return o.set(kind, key, value, nil, wc.CreateOnly)
+}
+
+// SetFn reports whether fn changed the value, by reflect.DeepEqual. The
+// options don't apply: the overlay publishes nothing before Commit.
+func (o *OverlayStore[T]) SetFn(kind, key string, fn func(v T) (T, error), _ ...WriteOption) (bool, error) {
+	if err := o.lock(); err != nil {
+		return false, err
+	}
+	defer o.mu.Unlock()
+	cur, ok, err := o.get(kind, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrKeyNotFound
+	}
+	v, err := fn(cur)
+	if err != nil {
+		return false, err
+	}
+	if reflect.DeepEqual(cur, v) {
+		return false, nil
+	}
+	_, err = o.set(kind, key, v, nil, false)
+	return err == nil, err
+}
+
+// SetAll records the writes in the overlay. The options don't apply.
+func (o *OverlayStore[T]) SetAll(kind string, values map[string]T, _ ...WriteOption) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.mu.Unlock()
+	for k, v := range values {
+		if _, err := o.set(kind, k, v, nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayStore[T]) SetAllOrdered(kind string, values []KeyValue[T]) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.mu.Unlock()
+	for _, kv := range values {
+		if _, err := o.set(kind, kv.Key, kv.Value, nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayStore[T]) MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.mu.Unlock()
+	for k, v := range incoming {
+		cur, ok, err := o.get(kind, k)
+		if err != nil {
+			return err
+		}
+		if ok && resolve != nil {
+			v = resolve(k, cur, v)
+		}
+		if ok && reflect.DeepEqual(cur, v) {
+			continue
+		}
+		if _, err := o.set(kind, k, v, nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete records a deletion that hides the base's value until Commit
+// deletes it there.
+func (o *OverlayStore[T]) Delete(kind, key string, opts ...WriteOption) (bool, T, error) {
+	var zero T
+	wc := &WriteCfg{}
+	for _, opt := range opts {
+		opt(wc)
+	}
+	if err := o.lock(); err != nil {
+		return false, zero, err
+	}
+	defer o.mu.Unlock()
+	prev, ok, err := o.get(kind, key)
+	if err != nil || !ok {
+		return false, zero, err
+	}
+	if o.layer[kind] == nil {
+		o.layer[kind] = make(map[string]*overlayEntry[T])
+	}
+	o.layer[kind][key] = &overlayEntry[T]{deleted: true}
+	if wc.WithoutPrev {
+		prev = zero
+	}
+	return true, prev, nil
+}
+
+// SetLabeled fails with ErrUnsupported if the base can't label keys, as
+// Commit couldn't write them.
+func (o *OverlayStore[T]) SetLabeled(kind, key string, value T, labels map[string]string) (bool, error) {
+	if _, ok := o.base.(LabelWriter[T]); !ok {
+		return false, ErrUnsupported
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if err := o.lock(); err != nil {
+		return false, err
+	}
+	defer o.mu.Unlock()
+	return o.set(kind, key, value, labels, false)
+}
+
+func (o *OverlayStore[T]) Swap(kind, keyA, keyB string) error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.mu.Unlock()
+	a, okA, err := o.get(kind, keyA)
+	if err != nil {
+		return err
+	}
+	b, okB, err := o.get(kind, keyB)
+	if err != nil {
+		return err
+	}
+	if !okA || !okB {
+		return ErrKeyNotFound
+	}
+	if keyA == keyB {
+		return nil
+	}
+	if _, err := o.set(kind, keyA, b, nil, false); err != nil {
+		return err
+	}
+	_, err = o.set(kind, keyB, a, nil, false)
+	return err
+}
+
+func (o *OverlayStore[T]) Add(kind string, value T) (string, error) {
+	return AddNew(NewUUIDv7, func(key string) error {
+		if err := o.lock(); err != nil {
+			return err
+		}
+		defer o.mu.Unlock()
+		_, err := o.set(kind, key, value, nil, true)
+		return err
+	})
+}
+
+// Pending returns the number of keys with uncommitted changes.
+func (o *OverlayStore[T]) Pending() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	n := 0
+	for _, m := range o.layer {
+		n += len(m)
+	}
+	return n
+}
+
+// Commit applies the pending changes to the base, by kind and key in
+// order, with the base's Set, SetLabeled and Delete. It is not atomic: if
+// a write fails, Commit stops and returns its error, the changes applied
+// so far leave the overlay and the rest stay pending, so Commit can be
+// called again.
+func (o *OverlayStore[T]) Commit() error {
+	if err := o.lock(); err != nil {
+		return err
+	}
+	defer o.mu.Unlock()
+	kinds := make([]string, 0, len(o.layer))
+	for kind := range o.layer {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		m := o.layer[kind]
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var err error
+			switch e := m[k]; {
+			case e.deleted:
+				_, _, err = o.base.Delete(kind, k, WithoutPrev())
+			case e.labels != nil:
+				_, err = SetLabeled(o.base, kind, k, e.value, e.labels)
+			default:
+				_, err = o.base.Set(kind, k, e.value)
+			}
+			if err != nil {
+				return fmt.Errorf("store: Overlay Commit %s/%s: %w", kind, k, err)
+			}
+			delete(m, k)
+		}
+		delete(o.layer, kind)
+	}
+	return nil
+}
+
+// Discard drops the pending changes.
+func (o *OverlayStore[T]) Discard() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.layer = make(map[string]map[string]*overlayEntry[T])
+	}
+}
+
+func (o *OverlayStore[T]) Watch(kind string, opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	if err := o.rlock(); err != nil {
+		return nil, nil, err
+	}
+	defer o.mu.RUnlock()
+	return o.base.Watch(kind, opts...)
+}
+
+func (o *OverlayStore[T]) WatchH(kind string, opts ...WatchOption[T]) (*WatchHandle[T], error) {
+	if err := o.rlock(); err != nil {
+		return nil, err
+	}
+	defer o.mu.RUnlock()
+	return WatchH(o.base, kind, opts...)
+}
+
+func (o *OverlayStore[T]) WatchKinds(kinds []string, opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	if err := o.rlock(); err != nil {
+		return nil, nil, err
+	}
+	defer o.mu.RUnlock()
+	return WatchKinds(o.base, kinds, opts...)
+}
+
+func (o *OverlayStore[T]) WatchAll(opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	if err := o.rlock(); err != nil {
+		return nil, nil, err
+	}
+	defer o.mu.RUnlock()
+	return WatchAll(o.base, opts...)
+}
+
+// WatcherCount returns the watchers of the base, which an overlay's
+// watchers subscribe to.
+func (o *OverlayStore[T]) WatcherCount() int {
+	return WatcherCountOf(o.base)
+}
+
+// KindWatcherCount returns the watchers of kind on the base.
+func (o *OverlayStore[T]) KindWatcherCount(kind string) int {
+	return KindWatcherCountOf(o.base, kind)
+}
+
+// Snapshot returns a view of kind on a snapshot of the base with the
+// changes pending now applied; later writes to the overlay don't show. It
+// fails with ErrUnsupported if the base can't take snapshots.
+func (o *OverlayStore[T]) Snapshot(kind string) (Reader[T], func(), error) {
+	if err := o.rlock(); err != nil {
+		return nil, nil, err
+	}
+	defer o.mu.RUnlock()
+	view, release, err := Snapshot(o.base, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	layer := make(map[string]map[string]*overlayEntry[T])
+	if m := o.layer[kind]; m != nil {
+		// entries are replaced, never modified, so sharing them is safe
+		layer[kind] = maps.Clone(m)
+	}
+	return &overlayReader[T]{base: view, layer: layer}, release, nil
+}
+
+// Close discards the pending changes. It leaves the base open.
+// Codec returns the codec of the base.
+func (o *OverlayStore[T]) Codec() Codec {
+	return CodecOf(o.base)
+}
+
+// Info describes the base, seen through an "overlay".
+func (o *OverlayStore[T]) Info() Info {
+	return WrappedInfo(o.base, "overlay")
+}
+
+func (o *OverlayStore[T]) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.layer = nil
+	return nil
+}
+
+// Dump lists the values of every kind with the pending changes applied.
+func (o *OverlayStore[T]) Dump() string {
+	all, err := o.GetAll()
+	if err != nil {
+		return err.Error()
+	}
+	kinds := make([]string, 0, len(all))
+	for kind := range all {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	sb := strings.Builder{}
+	for _, kind := range kinds {
+		sb.WriteString(fmt.Sprintf("%s:\n", kind))
+		for _, kv := range sortedKVs(all[kind]) {
+			sb.WriteString(fmt.Sprintf("  %s: %+v\n", kv.Key, kv.Value))
+		}
+	}
+	return sb.String()
+}
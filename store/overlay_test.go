@@ -0,0 +1,192 @@
+package store_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+	"github.com/zestor-dev/zestor/store/storetest"
+)
+
+func TestOverlay(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[int]{})
+	defer base.Close()
+	base.Set("k", "a/1", 1)
+	store.SetLabeled(base, "k", "a/2", 2, map[string]string{"env": "prod"})
+	base.Set("k", "b", 3)
+	base.Set("gone", "x", 1)
+
+	o := store.Overlay(base)
+	defer o.Close()
+	if created, err := o.Set("k", "a/1", 10); created || err != nil {
+		t.Fatalf("Set over a base key = %v, %v", created, err)
+	}
+	o.Set("k", "a/2", 20) // keeps its base labels
+	o.SetLabeled("k", "c", 30, map[string]string{"env": "prod"})
+	if existed, prev, _ := o.Delete("k", "b"); !existed || prev != 3 {
+		t.Fatalf("Delete(b) = %v, %d", existed, prev)
+	}
+	o.Delete("gone", "x")
+	if _, err := o.Set("k", "c", 0, store.CreateOnly()); !errors.Is(err, store.ErrKeyExists) {
+		t.Fatalf("CreateOnly on a pending key = %v", err)
+	}
+	if existed, _, _ := o.Delete("k", "b"); existed {
+		t.Fatal("deleted key deleted again")
+	}
+
+	if _, ok, _ := o.Get("k", "b"); ok {
+		t.Fatal("deleted key still read")
+	}
+	if v, _, _ := o.Get("k", "a/1"); v != 10 {
+		t.Fatalf("Get(a/1) = %d", v)
+	}
+	want := map[string]int{"a/1": 10, "a/2": 20, "c": 30}
+	if m, _ := o.List("k"); !reflect.DeepEqual(m, want) {
+		t.Fatalf("List = %v", m)
+	}
+	if m, _ := o.List("k", func(_ string, v int) bool { return v > 15 }); len(m) != 2 {
+		t.Fatalf("filtered List = %v", m)
+	}
+	if m, _ := o.ListPrefix("k", "a/"); len(m) != 2 || m["a/1"] != 10 {
+		t.Fatalf("ListPrefix = %v", m)
+	}
+	if keys, _ := o.Keys("k"); !reflect.DeepEqual(keys, []string{"a/1", "a/2", "c"}) {
+		t.Fatalf("Keys = %v", keys)
+	}
+	if segs, _ := o.KeySegments("k", "/", ""); !reflect.DeepEqual(segs, []string{"a/", "c"}) {
+		t.Fatalf("KeySegments = %v", segs)
+	}
+	if n, _ := o.Count("k"); n != 3 {
+		t.Fatalf("Count = %d", n)
+	}
+	if kinds, _ := o.Kinds(); !reflect.DeepEqual(kinds, []string{"k"}) {
+		t.Fatalf("Kinds = %v", kinds)
+	}
+	kvs, _ := o.SelectByLabel("k", map[string]string{"env": "prod"})
+	if !reflect.DeepEqual(kvs, []store.KeyValue[int]{{Key: "a/2", Value: 20}, {Key: "c", Value: 30}}) {
+		t.Fatalf("SelectByLabel = %v", kvs)
+	}
+	if o.Pending() != 5 {
+		t.Fatalf("Pending = %d", o.Pending())
+	}
+
+	// the base is untouched until Commit
+	if m, _ := base.List("k"); !reflect.DeepEqual(m, map[string]int{"a/1": 1, "a/2": 2, "b": 3}) {
+		t.Fatalf("base changed before Commit: %v", m)
+	}
+
+	view, release, err := o.Snapshot("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	o.Set("k", "d", 40)
+	if _, ok, _ := view.Get("k", "d"); ok {
+		t.Fatal("snapshot sees a later write")
+	}
+	if v, _, _ := view.Get("k", "a/1"); v != 10 {
+		t.Fatalf("snapshot Get(a/1) = %d", v)
+	}
+	o.Delete("k", "d")
+
+	ch, cancel, _ := o.Watch("k")
+	defer cancel()
+	select {
+	case ev := <-ch:
+		t.Fatalf("event before Commit: %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := o.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if o.Pending() != 0 {
+		t.Fatalf("Pending after Commit = %d", o.Pending())
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("%d events after Commit, want 4", i)
+		}
+	}
+	if m, _ := base.List("k"); !reflect.DeepEqual(m, want) {
+		t.Fatalf("base after Commit = %v", m)
+	}
+	if kvs, _ := store.SelectByLabel(base, "k", map[string]string{"env": "prod"}); len(kvs) != 2 {
+		t.Fatalf("base labels after Commit: %v", kvs)
+	}
+	if n, _ := base.Count("gone"); n != 0 {
+		t.Fatal("deletion not committed")
+	}
+}
+
+func TestOverlayDiscardAndClose(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[int]{})
+	defer base.Close()
+	base.Set("k", "a", 1)
+
+	o := store.Overlay(base)
+	o.Set("k", "a", 2)
+	o.Delete("k", "a")
+	o.Set("k", "a", 3)
+	o.Discard()
+	if v, _, _ := o.Get("k", "a"); v != 1 {
+		t.Fatalf("Get after Discard = %d", v)
+	}
+	if err := o.Swap("k", "a", "missing"); !errors.Is(err, store.ErrKeyNotFound) {
+		t.Fatalf("Swap with a missing key = %v", err)
+	}
+
+	o.Set("k", "b", 2)
+	o.Close()
+	if _, _, err := o.Get("k", "a"); !errors.Is(err, store.ErrClosed) {
+		t.Fatalf("Get after Close = %v", err)
+	}
+	if _, ok, err := base.Get("k", "a"); !ok || err != nil {
+		t.Fatal("Close closed the base")
+	}
+	if _, ok, _ := base.Get("k", "b"); ok {
+		t.Fatal("Close committed")
+	}
+}
+
+func TestOverlayCommitFailure(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[int]{
+		ValidateFns: map[string]store.ValidateFunc[int]{"k": func(v int) error {
+			if v < 0 {
+				return errors.New("negative")
+			}
+			return nil
+		}},
+	})
+	defer base.Close()
+	o := store.Overlay(base)
+	o.Set("k", "a", 1)
+	o.Set("k", "b", -1)
+	o.Set("k", "c", 3)
+	if err := o.Commit(); err == nil {
+		t.Fatal("Commit of an invalid value succeeded")
+	}
+	if o.Pending() != 2 {
+		t.Fatalf("Pending after a failed Commit = %d, want 2", o.Pending())
+	}
+	if _, ok, _ := base.Get("k", "a"); !ok {
+		t.Fatal("changes before the failure not applied")
+	}
+	o.Set("k", "b", 2)
+	if err := o.Commit(); err != nil {
+		t.Fatalf("retried Commit: %v", err)
+	}
+	if n, _ := base.Count("k"); n != 3 {
+		t.Fatalf("base Count = %d", n)
+	}
+}
+
+func TestOverlayConformance(t *testing.T) {
+	storetest.RunReaderTests(t, func(t *testing.T) store.Store[item] {
+		return store.Overlay(gomap.NewMemStore(store.StoreOptions[item]{}))
+	})
+}
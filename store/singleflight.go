@@ -0,0 +1,76 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SingleflightReader wraps a Reader so that concurrent Gets for the same
+// kind and key collapse into one call to the wrapped reader, whose result
+// is handed to every caller. It keeps a cold backend from being hit once
+// per goroutine when many of them miss on the same key at once. Nothing is
+// cached: a Get that starts after the shared call returned makes a new one.
+//
+// Callers of one shared call receive the same T, so values holding
+// pointers, maps or slices alias each other and must not be mutated.
+//
+// Every other Reader method passes through unchanged.
+type SingleflightReader[T any] struct {
+	Reader[T]
+
+	mu    sync.Mutex
+	calls map[flightKey]*flightCall[T]
+}
+
+type flightKey struct {
+	kind, key string
+}
+
+type flightCall[T any] struct {
+	done chan struct{}
+	val  T
+	ok   bool
+	err  error
+}
+
+// NewSingleflightReader returns r with de-duplicated Gets.
+func NewSingleflightReader[T any](r Reader[T]) *SingleflightReader[T] {
+	return &SingleflightReader[T]{Reader: r, calls: make(map[flightKey]*flightCall[T])}
+}
+
+func (s *SingleflightReader[T]) Get(kind, key string) (T, bool, error) {
+	k := flightKey{kind, key}
+	s.mu.Lock()
+	if c, ok := s.calls[k]; ok {
+		s.mu.Unlock()
+		<-c.done
+		return c.val, c.ok, c.err
+	}
+	c := &flightCall[T]{done: make(chan struct{})}
+	s.calls[k] = c
+	s.mu.Unlock()
+
+	s.do(k, c)
+	return c.val, c.ok, c.err
+}
+
+// do runs the shared call. If the wrapped Get panics, waiters get an error
+// and the panic continues in the calling goroutine.
+func (s *SingleflightReader[T]) do(k flightKey, c *flightCall[T]) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("store: Get(%q, %q) panicked: %v", k.kind, k.key, r)
+			s.finish(k, c)
+			panic(r)
+		}
+		s.finish(k, c)
+	}()
+	c.val, c.ok, c.err = s.Reader.Get(k.kind, k.key)
+}
+
+func (s *SingleflightReader[T]) finish(k flightKey, c *flightCall[T]) {
+	s.mu.Lock()
+	delete(s.calls, k)
+	s.mu.Unlock()
+	close(c.done)
+}
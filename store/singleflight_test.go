@@ -0,0 +1,103 @@
+package store
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowReader blocks every Get until release is closed and counts calls.
+type slowReader struct {
+	Reader[string]
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (r *slowReader) Get(kind, key string) (string, bool, error) {
+	r.calls.Add(1)
+	<-r.release
+	if r.err != nil {
+		return "", false, r.err
+	}
+	return kind + "/" + key, true, nil
+}
+
+func TestSingleflightReader_Get(t *testing.T) {
+	backend := &slowReader{release: make(chan struct{})}
+	r := NewSingleflightReader[string](backend)
+
+	const n = 50
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, ok, err := r.Get("cfg", "a")
+			if err != nil || !ok {
+				t.Errorf("Get: ok=%v err=%v", ok, err)
+			}
+			results[i] = v
+		}(i)
+	}
+	// let the goroutines pile up on the in-flight call
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	if got := backend.calls.Load(); got != 1 {
+		t.Fatalf("expected 1 backend call, got %d", got)
+	}
+	for i, v := range results {
+		if v != "cfg/a" {
+			t.Fatalf("result %d = %q", i, v)
+		}
+	}
+
+	// finished calls are not cached
+	if _, _, err := r.Get("cfg", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := backend.calls.Load(); got != 2 {
+		t.Fatalf("expected a fresh backend call, got %d calls", got)
+	}
+}
+
+func TestSingleflightReader_DistinctKeys(t *testing.T) {
+	backend := &slowReader{release: make(chan struct{})}
+	close(backend.release)
+	r := NewSingleflightReader[string](backend)
+
+	for _, k := range [][2]string{{"a", "x"}, {"b", "x"}, {"a", "y"}} {
+		v, _, err := r.Get(k[0], k[1])
+		if err != nil || v != k[0]+"/"+k[1] {
+			t.Fatalf("Get(%q, %q) = %q, %v", k[0], k[1], v, err)
+		}
+	}
+	if got := backend.calls.Load(); got != 3 {
+		t.Fatalf("expected 3 backend calls, got %d", got)
+	}
+}
+
+func TestSingleflightReader_Error(t *testing.T) {
+	boom := errors.New("boom")
+	backend := &slowReader{release: make(chan struct{}), err: boom}
+	r := NewSingleflightReader[string](backend)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := r.Get("cfg", "a"); !errors.Is(err, boom) {
+				t.Errorf("expected shared error, got %v", err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+}
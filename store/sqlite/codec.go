@@ -0,0 +1,70 @@
+package sqlite
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"github.com/zestor-dev/zestor/codec"
+	"github.com/zestor-dev/zestor/store"
+)
+
+// marshal encodes the value of kind/key with the store's codec, passing
+// kind and key on to a codec.ContextCodec. A codec that panics fails the
+// operation with store.ErrCodecPanic instead of crashing the process; the
+// error rolls back the transaction the call was part of.
+func (s *sqLiteStore[T]) marshal(kind, key string, v any) (data []byte, err error) {
+	defer recoverCodec("Marshal", &err)
+	return codec.MarshalCtx(s.codec, kind, key, v)
+}
+
+// unmarshal decodes the value of kind/key with the store's codec,
+// recovering panics like marshal.
+func (s *sqLiteStore[T]) unmarshal(kind, key string, data []byte, v any) (err error) {
+	defer recoverCodec("Unmarshal", &err)
+	return codec.UnmarshalCtx(s.codec, kind, key, data, v)
+}
+
+// encBufs holds the buffers values are encoded into by encode.
+var encBufs = sync.Pool{New: func() any { return new([]byte) }}
+
+// maxPooledBuf is the largest buffer put back into encBufs; bigger ones are
+// left to the garbage collector so one huge value doesn't pin its memory.
+const maxPooledBuf = 64 << 10
+
+// encode is marshal into a pooled buffer when the codec is a
+// codec.BufferedCodec that doesn't need the context. Unless buf is nil, data
+// lives in it and must no longer be used once putBuf(buf) is called.
+func (s *sqLiteStore[T]) encode(kind, key string, v any) (data []byte, buf *[]byte, err error) {
+	bc, ok := s.codec.(codec.BufferedCodec)
+	if _, ctx := s.codec.(codec.ContextCodec); !ok || ctx {
+		data, err = s.marshal(kind, key, v)
+		return data, nil, err
+	}
+	defer recoverCodec("Marshal", &err)
+	buf = encBufs.Get().(*[]byte)
+	data, err = bc.MarshalAppend((*buf)[:0], v)
+	if err != nil {
+		putBuf(buf)
+		return nil, nil, err
+	}
+	*buf = data
+	return data, buf, nil
+}
+
+// putBuf returns a buffer from encode to the pool.
+func putBuf(buf *[]byte) {
+	if buf != nil && cap(*buf) <= maxPooledBuf {
+		encBufs.Put(buf)
+	}
+}
+
+// recoverCodec, deferred around a codec call, turns a panic into an error
+// wrapping store.ErrCodecPanic and logs the stack.
+func recoverCodec(op string, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("zestor/sqlite: codec %s panicked: %v\n%s", op, r, debug.Stack())
+		*err = fmt.Errorf("sqlite: codec %s: %w: %v", op, store.ErrCodecPanic, r)
+	}
+}
@@ -0,0 +1,464 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// DB is an open database that several typed stores can share, so that a
+// Store[Note] and a Store[User] on one file use one connection pool, set
+// up the schema once and see each other's Watch events. Open one with Open
+// and build stores on it with NewWithDB.
+//
+// Closing a store built with NewWithDB leaves the DB open. Close the DB
+// once its stores are no longer used; that also closes their watchers.
+type DB struct {
+	db *sql.DB
+	// read-only pools reads are spread across (Options.ReadDSNs), and how
+	// long a store's reads stay on db after it wrote
+	replicas       []*sql.DB
+	nextReplica    atomic.Uint64
+	readYourWrites time.Duration
+
+	// the database file, ":memory:" for an in-memory database (Info)
+	location    string
+	readOnly    bool
+	lazyRewrite bool
+	// bounds of a read and of a write transaction; 0 means none
+	readTimeout, writeTimeout time.Duration
+	groupCommit               GroupCommit
+	withinWrite               func(tx *sql.Tx, ev *store.Event[any]) error
+	// Options.WriteRateLimit, nil when writes aren't limited
+	writeLimit *rate.Limiter
+	writeWait  bool
+	// held by reads and writes, and by MaintenanceMode exclusively
+	gate *opGate
+	// held by the write transaction in progress, so the writers of the
+	// process queue for it instead of polling SQLite's lock; nil without
+	// Options.BusyTimeout
+	writer      chan struct{}
+	busyTimeout time.Duration
+	// how long a snapshot view may hold its read transaction
+	maxSnapshot time.Duration
+	// SetReader values above this size are chunked; blobs is set once the
+	// DB holds chunked values, until then writes skip looking for them
+	streamThreshold int64
+	blobs           atomic.Bool
+	// workers decoding the rows of a List
+	decodeParallelism int
+
+	// per-kind table layout; tables caches the kinds whose table exists
+	tablePerKind bool
+	muTables     sync.RWMutex
+	tables       map[string]struct{}
+
+	// in-proc pubsub shared by every store on the DB, keyed by kind, and
+	// the subscribers of every kind (WatchAll), which publish always visits
+	// so kinds first written after they subscribed reach them too
+	muSubs sync.RWMutex
+	subs   map[string]map[subscriber]struct{}
+	all    map[subscriber]struct{}
+
+	// recent events per kind, the largest StoreOptions.EventHistory of
+	// the stores on the DB
+	muHistory   sync.Mutex
+	historySize int
+	history     map[string]*ring[*rawEvent]
+	// sequence number of the last recorded event per kind
+	seqs map[string]uint64
+
+	// writes through the DB in progress and done, which ExternalChanges
+	// tells apart from those of other connections
+	writing atomic.Int64
+	wrote   atomic.Uint64
+	// subscribers of ExternalChanges, and the poller serving them while
+	// there are any (stopPoll is nil otherwise)
+	muExternal   sync.Mutex
+	external     map[*externalSub]struct{}
+	pollInterval time.Duration
+	stopPoll     chan struct{}
+	pollDone     chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// subscriber is a watcher of one of the typed stores on a DB.
+type subscriber interface {
+	// post queues evs for delivery without blocking. It is called after
+	// muSubs is released, and the events' data is the subscriber's own.
+	post(evs []*rawEvent)
+	// close is called with muSubs locked. Events posted before are still
+	// delivered.
+	close()
+	// replay is called with muSubs locked when the subscriber asked for
+	// the recent events of its kinds, oldest first.
+	replay(evs []*rawEvent)
+}
+
+// rawEvent is a change as published on the DB. event is the
+// *store.Event[T] of the publishing store; watchers of another type decode
+// data, the value's encoding, with their own store's codec instead.
+type rawEvent struct {
+	kind, key string
+	typ       store.EventType
+	event     any
+	data      []byte
+	// encoding of the value an update replaced, for transition filters
+	prev []byte
+	at   time.Time
+	// position in the kind's history, and the Seq field of event that
+	// record sets to it
+	seq   uint64
+	seqOf *uint64
+	// Event.Version, for WithMinVersions
+	version int64
+	// Event.Silent: the event goes to the history but to no subscriber
+	silent bool
+}
+
+// Open opens the database and applies the schema, upgrading a file
+// written by an older version in place. A file upgraded by a newer version
+// is refused with ErrSchemaTooNew, and one SQLite finds corrupt with
+// ErrCorrupt. A large WAL left next to the file, or WAL files left without
+// it, are logged, and repaired with Options.RecoverOnOpen. Options.Codec
+// is not used: each store built on the DB brings its own.
+func Open(o Options) (*DB, error) {
+	if o.DSN == "" {
+		return nil, errors.New("sqlite: Options.DSN is required")
+	}
+
+	dsn := normalizeDSN(o.DSN)
+	if err := prepareFile(dsn, o); err != nil {
+		return nil, err
+	}
+	// the file's name for messages, and its WAL to recover
+	path, location, recover := o.DSN, ":memory:", false
+	if f, _ := parseDSN(dsn); f.path != "" {
+		path, location = f.path, f.path
+		pending, err := checkWAL(f.path, o.RecoverOnOpen && !o.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		recover = pending && o.RecoverOnOpen && !o.ReadOnly
+	}
+	if o.ReadOnly {
+		dsn = readOnlyDSN(dsn)
+	} else {
+		dsn = immediateDSN(dsn)
+	}
+	if o.BusyTimeout > 0 {
+		dsn = busyDSN(dsn, o.BusyTimeout)
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, corruptErr(path, fmt.Errorf("sqlite: open %s: %w", o.DSN, err))
+	}
+	if err := setup(context.Background(), db, o); err != nil {
+		_ = db.Close()
+		return nil, corruptErr(path, err)
+	}
+	if recover {
+		if err := recoverWAL(context.Background(), db, path); err != nil {
+			_ = db.Close()
+			return nil, corruptErr(path, err)
+		}
+	}
+	replicas, err := openReplicas(o.ReadDSNs)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	d := &DB{
+		db:                db,
+		replicas:          replicas,
+		location:          location,
+		readYourWrites:    o.ReadYourWrites,
+		readOnly:          o.ReadOnly,
+		lazyRewrite:       o.LazyRewrite && !o.ReadOnly,
+		readTimeout:       o.ReadTimeout,
+		writeTimeout:      o.WriteTimeout,
+		groupCommit:       o.GroupCommit,
+		withinWrite:       o.WithinWrite,
+		maxSnapshot:       o.MaxSnapshotDuration,
+		streamThreshold:   o.StreamThreshold,
+		decodeParallelism: o.DecodeParallelism,
+		tablePerKind:      o.TablePerKind,
+		tables:            make(map[string]struct{}),
+		subs:              make(map[string]map[subscriber]struct{}),
+		all:               make(map[subscriber]struct{}),
+		history:           make(map[string]*ring[*rawEvent]),
+		seqs:              make(map[string]uint64),
+		external:          make(map[*externalSub]struct{}),
+		pollInterval:      o.ExternalPollInterval,
+		gate:              newOpGate(),
+	}
+	if o.BusyTimeout > 0 && !o.ReadOnly {
+		d.writer = make(chan struct{}, 1)
+		d.busyTimeout = o.BusyTimeout
+	}
+	if d.tablePerKind {
+		if err := d.loadTables(); err != nil {
+			_ = db.Close()
+			closeAll(replicas)
+			return nil, err
+		}
+	}
+	if d.maxSnapshot <= 0 {
+		d.maxSnapshot = DefaultMaxSnapshotDuration
+	}
+	if d.streamThreshold <= 0 {
+		d.streamThreshold = DefaultStreamThreshold
+	}
+	if d.pollInterval <= 0 {
+		d.pollInterval = DefaultExternalPollInterval
+	}
+	if o.WriteRateLimit > 0 {
+		d.writeLimit = rate.NewLimiter(o.WriteRateLimit, max(o.WriteBurst, 1))
+		d.writeWait = o.WriteRateWait
+	}
+	// a read-only file from before chunked values has no table for them
+	var blobs bool
+	_ = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM zestor_blob_meta);`).Scan(&blobs)
+	d.blobs.Store(blobs)
+	return d, nil
+}
+
+// Close closes every watcher of every store on the DB, then the database.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.mu.Unlock()
+
+	d.muSubs.Lock()
+	for _, m := range d.subs {
+		for sub := range m {
+			if d.unsubscribe(sub) {
+				sub.close()
+			}
+		}
+	}
+	for sub := range d.all {
+		if d.unsubscribe(sub) {
+			sub.close()
+		}
+	}
+	// nil maps make subscribe fail from now on
+	d.subs, d.all = nil, nil
+	d.muSubs.Unlock()
+	d.cancelExternal(func(*externalSub) bool { return true })
+
+	closeAll(d.replicas)
+	return d.db.Close()
+}
+
+// subscribe registers sub for the events of each of kinds. With history,
+// sub is first handed the recorded events of those kinds; no event is
+// published to it before. It fails with store.ErrClosed once d is closed.
+func (d *DB) subscribe(sub subscriber, history bool, kinds ...string) error {
+	d.muSubs.Lock()
+	defer d.muSubs.Unlock()
+	if d.subs == nil {
+		return store.ErrClosed
+	}
+	for _, kind := range kinds {
+		if d.subs[kind] == nil {
+			d.subs[kind] = make(map[subscriber]struct{})
+		}
+		d.subs[kind][sub] = struct{}{}
+	}
+	if history {
+		d.replayTo(sub, kinds)
+	}
+	return nil
+}
+
+// subscribeAll registers sub for the events of every kind, with history
+// those of the kinds recorded so far. It fails like subscribe.
+func (d *DB) subscribeAll(sub subscriber, history bool) error {
+	d.muSubs.Lock()
+	defer d.muSubs.Unlock()
+	if d.all == nil {
+		return store.ErrClosed
+	}
+	d.all[sub] = struct{}{}
+	if history {
+		d.muHistory.Lock()
+		kinds := make([]string, 0, len(d.history))
+		for kind := range d.history {
+			kinds = append(kinds, kind)
+		}
+		d.muHistory.Unlock()
+		sort.Strings(kinds)
+		d.replayTo(sub, kinds)
+	}
+	return nil
+}
+
+// replayTo hands sub the recorded events of kinds. Callers hold muSubs.
+func (d *DB) replayTo(sub subscriber, kinds []string) {
+	var evs []*rawEvent
+	d.muHistory.Lock()
+	for _, kind := range kinds {
+		if r := d.history[kind]; r != nil {
+			evs = append(evs, r.items()...)
+		}
+	}
+	d.muHistory.Unlock()
+	sub.replay(evs)
+}
+
+// subscribed reports whether sub gets the events of kind. Callers hold
+// muSubs.
+func (d *DB) subscribed(sub subscriber, kind string) bool {
+	if _, ok := d.all[sub]; ok {
+		return true
+	}
+	_, ok := d.subs[kind][sub]
+	return ok
+}
+
+// watched reports whether a write to kind is published to anyone: a
+// watcher of the kind on any store of the DB, or the event history.
+func (d *DB) watched(kind string) bool {
+	d.muHistory.Lock()
+	keep := d.historySize > 0
+	d.muHistory.Unlock()
+	if keep {
+		return true
+	}
+	d.muSubs.RLock()
+	defer d.muSubs.RUnlock()
+	return len(d.subs[kind]) > 0 || len(d.all) > 0
+}
+
+// keepHistory makes the DB record at least n recent events per kind.
+func (d *DB) keepHistory(n int) {
+	d.muHistory.Lock()
+	defer d.muHistory.Unlock()
+	if n > d.historySize {
+		d.historySize = n
+	}
+}
+
+// record adds evs to their kind's history. Callers hold muSubs, so a
+// subscriber registering meanwhile sees evs either in the history or
+// published.
+func (d *DB) record(evs []*rawEvent) {
+	d.muHistory.Lock()
+	defer d.muHistory.Unlock()
+	if d.historySize <= 0 {
+		return
+	}
+	r := d.history[evs[0].kind]
+	if r == nil {
+		r = &ring[*rawEvent]{}
+		d.history[evs[0].kind] = r
+	}
+	for _, ev := range evs {
+		d.seqs[ev.kind]++
+		ev.seq = d.seqs[ev.kind]
+		if ev.seqOf != nil {
+			*ev.seqOf = ev.seq
+		}
+		// the data of ev may be in a buffer its store reuses
+		c := *ev
+		c.data = bytes.Clone(ev.data)
+		c.prev = bytes.Clone(ev.prev)
+		r.push(d.historySize, &c)
+	}
+}
+
+// uniqueKinds returns kinds without duplicates, in first-seen order.
+func uniqueKinds(kinds []string) []string {
+	seen := make(map[string]struct{}, len(kinds))
+	out := make([]string, 0, len(kinds))
+	for _, k := range kinds {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// unsubscribe removes sub from every kind and reports whether it was still
+// subscribed. Callers hold muSubs.
+func (d *DB) unsubscribe(sub subscriber) bool {
+	_, found := d.all[sub]
+	delete(d.all, sub)
+	for kind, subs := range d.subs {
+		if _, exists := subs[sub]; !exists {
+			continue
+		}
+		found = true
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(d.subs, kind)
+		}
+	}
+	return found
+}
+
+// publish posts evs, events of one kind, to the subscribers of the kind.
+// The lock is held only to record evs and list the subscribers; each
+// subscriber filters, decodes and delivers on its own goroutine, so a slow
+// one doesn't slow down writes. A batch goes to each subscriber in one go.
+func (d *DB) publish(evs ...*rawEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	d.muSubs.RLock()
+	d.record(evs)
+	subs := make([]subscriber, 0, len(d.subs[evs[0].kind])+len(d.all))
+	for sub := range d.subs[evs[0].kind] {
+		subs = append(subs, sub)
+	}
+	for sub := range d.all {
+		subs = append(subs, sub)
+	}
+	d.muSubs.RUnlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	// silent events only go to the history, and the data of the others
+	// may be in a buffer their store reuses once publish returns
+	posted := make([]*rawEvent, 0, len(evs))
+	for _, ev := range evs {
+		if ev.silent {
+			continue
+		}
+		c := *ev
+		c.data = bytes.Clone(ev.data)
+		c.prev = bytes.Clone(ev.prev)
+		posted = append(posted, &c)
+	}
+	if len(posted) == 0 {
+		return
+	}
+	for _, sub := range subs {
+		sub.post(posted)
+	}
+}
@@ -0,0 +1,133 @@
+package sqlite
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// decodeBatch is how many rows a List hands a decode worker at a time.
+const decodeBatch = 64
+
+// row is a scanned, not yet decoded row.
+type row struct {
+	key  string
+	blob []byte
+}
+
+// listRows decodes the key/value rows of kind into a map, keeping those
+// every filter accepts. With Options.DecodeParallelism > 1 and more than
+// one batch of rows, rows are scanned here and decoded and filtered by that
+// many workers; the first error stops the scan and the other workers.
+func (s *sqLiteStore[T]) listRows(rows *sql.Rows, kind string, filter []store.FilterFunc[T]) (map[string]T, error) {
+	out := make(map[string]T, 64)
+	var mu sync.Mutex
+	// decodeInto decodes batch into out; it is called with mu unlocked
+	decodeInto := func(batch []row) error {
+		vals := make([]T, len(batch))
+		keep := make([]bool, len(batch))
+		for i, r := range batch {
+			if err := s.decode(kind, r.key, r.blob, &vals[i]); err != nil {
+				return err
+			}
+			keep[i] = true
+			for _, f := range filter {
+				if f != nil && !f(r.key, vals[i]) {
+					keep[i] = false
+					break
+				}
+			}
+		}
+		mu.Lock()
+		for i, r := range batch {
+			if keep[i] {
+				out[r.key] = vals[i]
+			}
+		}
+		mu.Unlock()
+		return nil
+	}
+
+	workers := s.h.decodeParallelism
+	var (
+		jobs    chan []row
+		done    chan struct{}
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		werr    error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			werr = err
+			close(done)
+		})
+	}
+	// stop ends the workers and returns the first error of one
+	stop := func() error {
+		if jobs == nil {
+			return nil
+		}
+		close(jobs)
+		wg.Wait()
+		return werr
+	}
+
+	batch := make([]row, 0, decodeBatch)
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.key, &r.blob); err != nil {
+			_ = stop()
+			return nil, err
+		}
+		batch = append(batch, r)
+		if len(batch) < decodeBatch {
+			continue
+		}
+		if workers <= 1 {
+			if err := decodeInto(batch); err != nil {
+				return nil, err
+			}
+			batch = batch[:0]
+			continue
+		}
+		if jobs == nil {
+			jobs = make(chan []row, workers)
+			done = make(chan struct{})
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for b := range jobs {
+						select {
+						case <-done:
+							continue // drain after a failure
+						default:
+						}
+						if err := decodeInto(b); err != nil {
+							fail(err)
+						}
+					}
+				}()
+			}
+		}
+		select {
+		case jobs <- batch:
+		case <-done:
+			return nil, stop()
+		}
+		batch = make([]row, 0, decodeBatch)
+	}
+	if err := rows.Err(); err != nil {
+		_ = stop()
+		return nil, err
+	}
+	if err := stop(); err != nil {
+		return nil, err
+	}
+	// the last, partial batch
+	if err := decodeInto(batch); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
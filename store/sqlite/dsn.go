@@ -0,0 +1,157 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultDirMode is the mode of directories created for Options.CreateDirs
+// when Options.DirMode is 0.
+const DefaultDirMode fs.FileMode = 0o755
+
+// dsnFile is the database file a DSN names.
+type dsnFile struct {
+	path string // "" for an in-memory database
+	mode string // the mode parameter: ro, rw, rwc or memory
+}
+
+// normalizeDSN turns a plain path into a file: URI. modernc accepts both,
+// but only the URI form is parsed by parseDSN and readOnlyDSN.
+func normalizeDSN(dsn string) string {
+	if strings.HasPrefix(dsn, "file:") || dsn == ":memory:" {
+		return dsn
+	}
+	return "file:" + dsn
+}
+
+// immediateDSN has dsn begin transactions with BEGIN IMMEDIATE, unless it
+// sets _txlock itself. A deferred transaction that reads before it writes
+// fails with SQLITE_BUSY when another connection committed meanwhile,
+// without waiting out busy_timeout; an immediate one takes the write lock
+// up front and waits for it. Read-only transactions stay deferred.
+func immediateDSN(dsn string) string {
+	_, rawQuery, _ := strings.Cut(dsn, "?")
+	if q, err := url.ParseQuery(rawQuery); err == nil && q.Has("_txlock") {
+		return dsn
+	}
+	return addDSNParam(dsn, "_txlock", "immediate")
+}
+
+// busyDSN sets busy_timeout on every connection the pool opens with dsn,
+// after the pragmas dsn sets itself.
+func busyDSN(dsn string, timeout time.Duration) string {
+	return addDSNParam(dsn, "_pragma", fmt.Sprintf("busy_timeout(%d)", timeout.Milliseconds()))
+}
+
+// addDSNParam appends name=value to the parameters of dsn.
+func addDSNParam(dsn, name, value string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + name + "=" + url.QueryEscape(value)
+}
+
+// parseDSN finds the file of a normalized DSN and checks the parameters
+// SQLite would reject with a bare "SQL logic error".
+func parseDSN(dsn string) (dsnFile, error) {
+	if dsn == ":memory:" {
+		return dsnFile{mode: "memory"}, nil
+	}
+	rest := strings.TrimPrefix(dsn, "file:")
+	path, rawQuery, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return dsnFile{}, fmt.Errorf("sqlite: DSN %q: bad parameters: %w", dsn, err)
+	}
+	f := dsnFile{mode: query.Get("mode")}
+	switch f.mode {
+	case "", "ro", "rw", "rwc", "memory":
+	default:
+		return dsnFile{}, fmt.Errorf("sqlite: DSN %q: mode=%s, want ro, rw, rwc or memory", dsn, f.mode)
+	}
+	switch c := query.Get("cache"); c {
+	case "", "shared", "private":
+	default:
+		return dsnFile{}, fmt.Errorf("sqlite: DSN %q: cache=%s, want shared or private", dsn, c)
+	}
+	if host, p, ok := strings.Cut(strings.TrimPrefix(path, "//"), "/"); ok && strings.HasPrefix(path, "//") {
+		// file://host/path; SQLite only takes an empty or local host
+		if host != "" && host != "localhost" {
+			return dsnFile{}, fmt.Errorf("sqlite: DSN %q: remote host %q, want file:/path or file:///path", dsn, host)
+		}
+		path = "/" + p
+	}
+	if path, err = url.PathUnescape(path); err != nil {
+		return dsnFile{}, fmt.Errorf("sqlite: DSN %q: %w", dsn, err)
+	}
+	if path == "" || path == ":memory:" || f.mode == "memory" {
+		return dsnFile{mode: "memory"}, nil
+	}
+	f.path = path
+	return f, nil
+}
+
+// prepareFile checks, before SQLite tries, that the file of dsn can be
+// opened as o asks, creating its directory with Options.CreateDirs. Its
+// errors name the path and say what to change; SQLite's would only say
+// "unable to open database file".
+func prepareFile(dsn string, o Options) error {
+	f, err := parseDSN(dsn)
+	if err != nil || f.path == "" {
+		return err
+	}
+	readOnly := o.ReadOnly || f.mode == "ro"
+	dir := filepath.Dir(f.path)
+
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && o.CreateDirs && !readOnly:
+		mode := o.DirMode
+		if mode == 0 {
+			mode = DefaultDirMode
+		}
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return fmt.Errorf("sqlite: create directory of %s: %w", f.path, err)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("sqlite: open %s: directory %s does not exist, create it or set Options.CreateDirs: %w", f.path, dir, err)
+	case err != nil:
+		return fmt.Errorf("sqlite: open %s: %w", f.path, err)
+	case !info.IsDir():
+		return fmt.Errorf("sqlite: open %s: %s is not a directory", f.path, dir)
+	}
+
+	_, err = os.Stat(f.path)
+	exists := err == nil
+	switch {
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("sqlite: open %s: %w", f.path, err)
+	case !exists && readOnly:
+		return fmt.Errorf("sqlite: open %s read-only: the file must exist, mode=ro does not create it: %w", f.path, err)
+	case !exists && f.mode == "rw":
+		return fmt.Errorf("sqlite: open %s: the file must exist with mode=rw, use mode=rwc to create it: %w", f.path, err)
+	case readOnly:
+		return nil
+	case exists:
+		// opening for writing changes nothing and fails as SQLite would
+		w, err := os.OpenFile(f.path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("sqlite: open %s: not writable, open it with Options.ReadOnly to only read it: %w", f.path, err)
+		}
+		return w.Close()
+	}
+	// SQLite creates the file, and its journal or WAL next to it
+	probe, err := os.CreateTemp(dir, ".zestor-probe-*")
+	if err != nil {
+		return fmt.Errorf("sqlite: create %s: directory %s is not writable: %w", f.path, dir, err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
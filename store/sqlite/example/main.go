@@ -3,11 +3,13 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/zestor-dev/zestor/codec"
 	"github.com/zestor-dev/zestor/store"
-	"github.com/zestor-dev/zestor/store/sqlite"
+	_ "github.com/zestor-dev/zestor/store/gomap"
+	_ "github.com/zestor-dev/zestor/store/sqlite"
 )
 
 type Note struct {
@@ -17,11 +19,12 @@ type Note struct {
 }
 
 func main() {
-	s, err := sqlite.New[Note](sqlite.Options{
-		DSN:         "file:notes.db?cache=shared",
-		Codec:       &codec.JSON{},
-		BusyTimeout: 5 * time.Second,
-	})
+	// e.g. ZESTOR_URL=mem:// for a throwaway in-memory store
+	url := os.Getenv("ZESTOR_URL")
+	if url == "" {
+		url = "sqlite://notes.db?busy_timeout=5s"
+	}
+	s, err := store.Open[Note](url, &codec.JSON{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,187 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultExternalPollInterval is how often ExternalChanges polls the
+// database when Options.ExternalPollInterval is 0.
+const DefaultExternalPollInterval = time.Second
+
+// ExternalWatcher is implemented by sqlite stores, for layers that cache
+// what they read, or rely on Watch, and must resync when the file changes
+// behind their back.
+type ExternalWatcher interface {
+	// ExternalChanges returns a channel that receives a value once a
+	// write not made through the store's DB was committed to the database
+	// file: by another process, by a DB opened separately on the same
+	// file, or by hand with the sqlite3 CLI. Such writes publish no
+	// events. Notifications arriving before the last one was received
+	// are merged into it. cancel ends the subscription and closes the
+	// channel, as closing the store does.
+	ExternalChanges() (ch <-chan struct{}, cancel func())
+}
+
+func (s *sqLiteStore[T]) ExternalChanges() (<-chan struct{}, func()) {
+	return s.h.externalChanges(s)
+}
+
+// ExternalChanges is ExternalWatcher.ExternalChanges for the writes the
+// stores on d didn't make. Closing d closes the channel.
+//
+// While it has subscribers, d polls PRAGMA data_version every
+// Options.ExternalPollInterval on a connection of its own. The pragma
+// tells that some other connection committed, which includes d's other
+// connections, so d counts the writes it makes itself: a change seen
+// while, or after, d wrote since the last poll is taken for d's own and
+// not reported. An external write in such a poll interval therefore goes
+// unnoticed; keep the interval short where that matters.
+func (d *DB) ExternalChanges() (<-chan struct{}, func()) {
+	return d.externalChanges(nil)
+}
+
+// externalSub is a subscription to ExternalChanges, owned by the store
+// that made it (nil for the DB).
+type externalSub struct {
+	ch    chan struct{}
+	owner any
+}
+
+// ownWrite marks a write through d as in progress for ExternalChanges,
+// until the returned func is called once it committed or failed.
+func (d *DB) ownWrite() func() {
+	d.writing.Add(1)
+	return func() {
+		// counted before it stops being in progress, so a poll that sees
+		// no write in progress sees it counted
+		d.wrote.Add(1)
+		d.writing.Add(-1)
+	}
+}
+
+func (d *DB) externalChanges(owner any) (<-chan struct{}, func()) {
+	sub := &externalSub{ch: make(chan struct{}, 1), owner: owner}
+	// Close cancels every subscription made before it set closed
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	d.muExternal.Lock()
+	d.external[sub] = struct{}{}
+	if d.stopPoll == nil {
+		d.stopPoll, d.pollDone = make(chan struct{}), make(chan struct{})
+		go d.pollExternal(d.stopPoll, d.pollDone)
+	}
+	d.muExternal.Unlock()
+	return sub.ch, func() { d.cancelExternal(func(s *externalSub) bool { return s == sub }) }
+}
+
+// cancelExternal ends the subscriptions match selects, and stops polling
+// once none is left.
+func (d *DB) cancelExternal(match func(*externalSub) bool) {
+	d.muExternal.Lock()
+	for sub := range d.external {
+		if match(sub) {
+			delete(d.external, sub)
+			close(sub.ch)
+		}
+	}
+	var stop, done chan struct{}
+	if len(d.external) == 0 && d.stopPoll != nil {
+		stop, done = d.stopPoll, d.pollDone
+		d.stopPoll, d.pollDone = nil, nil
+	}
+	d.muExternal.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// pollExternal notifies the subscribers of ExternalChanges of each change
+// of data_version that d's own writes don't account for, until stop is
+// closed. It closes done when it returns.
+func (d *DB) pollExternal(stop, done chan struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-done:
+		}
+	}()
+	// data_version is per connection: it stays the same on one that only
+	// sees its own commits
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	version := func() (int64, bool) {
+		var v int64
+		err := conn.QueryRowContext(ctx, `PRAGMA data_version;`).Scan(&v)
+		return v, err == nil
+	}
+	lastWrote := d.wrote.Load()
+	last, ok := version()
+	if !ok {
+		return
+	}
+	t := time.NewTicker(d.pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		wrote, writing := d.wrote.Load(), d.writing.Load()
+		v, ok := version()
+		if !ok {
+			continue
+		}
+		// a write of d's that was in progress, or done, around the read
+		// may be what changed v
+		own := writing > 0 || wrote != lastWrote || d.writing.Load() > 0 || d.wrote.Load() != wrote
+		changed := v != last
+		last, lastWrote = v, wrote
+		if changed && !own {
+			d.notifyExternal()
+		}
+	}
+}
+
+// notifyExternal signals every subscriber of ExternalChanges that hasn't
+// received the last signal yet.
+func (d *DB) notifyExternal() {
+	d.muExternal.Lock()
+	defer d.muExternal.Unlock()
+	for sub := range d.external {
+		select {
+		case sub.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// execOwn runs a write outside the transactions of begin, in turn with
+// them, counted as d's own for ExternalChanges.
+func (d *DB) execOwn(query string, args ...any) (sql.Result, error) {
+	if err := d.gate.enter(context.Background()); err != nil {
+		return nil, err
+	}
+	defer d.gate.leave()
+	unlock, err := d.lockWriter(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer d.ownWrite()()
+	return d.db.Exec(query, args...)
+}
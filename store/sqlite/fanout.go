@@ -0,0 +1,96 @@
+package sqlite
+
+import "sync"
+
+// inbox queues the events published to one watcher, which its own
+// goroutine hands over to the watcher's channel. Writers only append to it,
+// so a watcher that is slow to decode or filter doesn't hold them up.
+type inbox struct {
+	mu     sync.Mutex
+	queue  []*rawEvent
+	closed bool
+	// whether events taken last are still being delivered
+	busy bool
+	// signalled, without blocking, after queue or closed changed
+	wake chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{wake: make(chan struct{}, 1)}
+}
+
+// post queues evs. It never blocks, and drops evs once the inbox is shut.
+func (b *inbox) post(evs []*rawEvent) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.queue = append(b.queue, evs...)
+	b.mu.Unlock()
+	b.signal()
+}
+
+// shut makes take report closed once the queued events are taken.
+func (b *inbox) shut() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *inbox) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for queued events and returns them, or returns closed once
+// the inbox is shut and empty.
+func (b *inbox) take() (evs []*rawEvent, closed bool) {
+	for {
+		b.mu.Lock()
+		evs, b.queue = b.queue, nil
+		closed = b.closed
+		b.busy = len(evs) > 0
+		b.mu.Unlock()
+		if len(evs) > 0 || closed {
+			return evs, closed && len(evs) == 0
+		}
+		<-b.wake
+	}
+}
+
+// idle reports whether every event posted so far has been delivered.
+func (b *inbox) idle() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue) == 0 && !b.busy
+}
+
+// run hands the events posted to w over to its channel until w is closed,
+// then closes the channel. A watcher that dropped evictAfter events in a
+// row is unsubscribed and gets no more.
+func (w *watcher[T]) run() {
+	d := w.s.h
+	evicted := false
+	for {
+		evs, closed := w.box.take()
+		if closed {
+			close(w.ch)
+			return
+		}
+		for _, ev := range evs {
+			if evicted || w.deliver(ev) {
+				continue
+			}
+			evicted = true
+			d.muSubs.Lock()
+			if d.unsubscribe(w) {
+				w.close()
+			}
+			d.muSubs.Unlock()
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// filterDoc is the value column read as JSON; the CAST keeps SQLite from
+// reading a blob as JSONB.
+const filterDoc = `CAST(value AS TEXT)`
+
+// filterOps are the SQL operators of the store.Filter comparisons.
+var filterOps = map[store.FilterOp]string{
+	store.FilterOpEq:  "=",
+	store.FilterOpNe:  "<>",
+	store.FilterOpLt:  "<",
+	store.FilterOpLte: "<=",
+	store.FilterOpGt:  ">",
+	store.FilterOpGte: ">=",
+}
+
+// filterSQL is a store.Filter translated to conditions on a row of
+// zestor_kv, for stores with a JSON codec.
+type filterSQL struct {
+	// cond holds for the rows passing the filter
+	cond     string
+	condArgs []any
+	// mismatch holds for the rows where a comparison meets a field of
+	// another type, which fail the filter
+	mismatch     string
+	mismatchArgs []any
+}
+
+// translateFilter translates a validated f. A comparison of a value
+// field is false, not NULL, where the field is missing, so that not
+// negates it as Filter.Match does.
+func translateFilter(f store.Filter) filterSQL {
+	var out filterSQL
+	switch f.Op {
+	case store.FilterOpAnd, store.FilterOpOr, store.FilterOpNot:
+		var conds, mismatches []string
+		for _, a := range f.Args {
+			t := translateFilter(a)
+			conds = append(conds, t.cond)
+			out.condArgs = append(out.condArgs, t.condArgs...)
+			if t.mismatch != "0" {
+				mismatches = append(mismatches, t.mismatch)
+				out.mismatchArgs = append(out.mismatchArgs, t.mismatchArgs...)
+			}
+		}
+		switch {
+		case f.Op == store.FilterOpNot:
+			out.cond = "NOT " + conds[0]
+		case len(conds) == 0 && f.Op == store.FilterOpAnd:
+			out.cond = "1"
+		case len(conds) == 0:
+			out.cond = "0"
+		default:
+			out.cond = "(" + strings.Join(conds, " "+strings.ToUpper(string(f.Op))+" ") + ")"
+		}
+		out.mismatch = "0"
+		if len(mismatches) > 0 {
+			out.mismatch = "(" + strings.Join(mismatches, " OR ") + ")"
+		}
+		return out
+	}
+
+	value := f.Value
+	types := `'text'`
+	switch v := f.Value.(type) {
+	case float64:
+		types = `'integer','real'`
+	case bool:
+		// json_extract reads true and false as 1 and 0
+		types = `'true','false'`
+		value = 0
+		if v {
+			value = 1
+		}
+	}
+	cmp := func(x string) string {
+		if f.Op == store.FilterOpPrefix {
+			return fmt.Sprintf("instr(%s, ?) = 1", x)
+		}
+		return fmt.Sprintf("%s %s ?", x, filterOps[f.Op])
+	}
+	if f.Field == store.FilterKeyField {
+		out.cond, out.condArgs = "("+cmp("key")+")", []any{value}
+		out.mismatch = "0"
+		return out
+	}
+	path := `$."` + strings.ReplaceAll(f.Field, ".", `"."`) + `"`
+	out.cond = fmt.Sprintf("COALESCE(json_type(%[1]s, ?) IN (%[2]s) AND %[3]s, 0)", filterDoc, types, cmp("json_extract("+filterDoc+", ?)"))
+	out.condArgs = []any{path, path, value}
+	out.mismatch = fmt.Sprintf("COALESCE(json_type(%s, ?) NOT IN ('null',%s), 0)", filterDoc, types)
+	out.mismatchArgs = []any{path}
+	return out
+}
+
+// The filter queries take the kind, then the arguments of the condition
+// they are formatted with.
+const (
+	whereQuery         = `SELECT key, value, version FROM zestor_kv WHERE kind=? AND %s ORDER BY key;`
+	countWhereQuery    = `SELECT COUNT(*) FROM zestor_kv WHERE kind=? AND %s;`
+	firstMismatchQuery = `SELECT key, value FROM zestor_kv WHERE kind=? AND %s LIMIT 1;`
+	kindRowsQuery      = `SELECT key, value, version FROM zestor_kv WHERE kind=? ORDER BY key;`
+)
+
+// FilterStream reads a batch of rows at a time, in key order, each batch
+// its own query, so no read stays open while fn runs.
+const (
+	streamFirstQuery = `SELECT key, value FROM zestor_kv WHERE kind=? ORDER BY key LIMIT ?;`
+	streamNextQuery  = `SELECT key, value FROM zestor_kv WHERE kind=? AND key > ? ORDER BY key LIMIT ?;`
+)
+
+// filterStreamBatch is how many rows FilterStream reads per query.
+var filterStreamBatch = 256
+
+// FilterStream decodes one row at a time, and holds the encoded values of
+// one batch of rows at most.
+func (s *sqLiteStore[T]) FilterStream(kind string, filter store.FilterFunc[T], fn func(key string, val T) error) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	defer s.flushRewrites()
+	var last string
+	for first := true; ; first = false {
+		s.mu.RLock()
+		closed := s.closed
+		s.mu.RUnlock()
+		if closed {
+			return store.ErrClosed
+		}
+		if !s.h.hasTable(kind) {
+			return nil
+		}
+		batch, err := s.streamBatch(kind, first, last)
+		if err != nil {
+			return err
+		}
+		for _, r := range batch {
+			var v T
+			if err := s.decode(kind, r.key, r.blob, &v); err != nil {
+				return err
+			}
+			if filter != nil && !filter(r.key, v) {
+				continue
+			}
+			if err := fn(r.key, v); err != nil {
+				return err
+			}
+		}
+		if len(batch) < filterStreamBatch {
+			return nil
+		}
+		last = batch[len(batch)-1].key
+	}
+}
+
+// streamBatch reads the rows of kind after last, or from the first one.
+func (s *sqLiteStore[T]) streamBatch(kind string, first bool, last string) ([]row, error) {
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var batch []row
+	err := s.read(ctx, func(q querier) error {
+		batch = batch[:0]
+		var rs *sql.Rows
+		var err error
+		if first {
+			rs, err = q.Query(s.h.q(kind, streamFirstQuery), kind, filterStreamBatch)
+		} else {
+			rs, err = q.Query(s.h.q(kind, streamNextQuery), kind, last, filterStreamBatch)
+		}
+		if err != nil {
+			return err
+		}
+		defer rs.Close()
+		for rs.Next() {
+			var r row
+			if err := rs.Scan(&r.key, &r.blob); err != nil {
+				return err
+			}
+			batch = append(batch, r)
+		}
+		return rs.Err()
+	})
+	return batch, timeoutErr(ctx, err)
+}
+
+// filtered is a row that passed a filter. v is its decoded value, or nil
+// if the filter was evaluated in SQL.
+type filtered[T any] struct {
+	key     string
+	data    []byte
+	version int64
+	v       *T
+}
+
+// where returns the rows of kind that pass f, by key. With a JSON codec
+// the filter runs in SQL and no value is decoded; otherwise each value is
+// decoded and passed to Filter.Match.
+func (s *sqLiteStore[T]) where(q querier, kind string, f store.Filter) ([]filtered[T], error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	if !s.h.hasTable(kind) {
+		return nil, nil
+	}
+	var rows []filtered[T]
+	if s.isJSON() {
+		t := translateFilter(f)
+		if err := s.filterMismatch(q, kind, f, t); err != nil {
+			return nil, err
+		}
+		rs, err := q.Query(s.h.q(kind, fmt.Sprintf(whereQuery, t.cond)), append([]any{kind}, t.condArgs...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rs.Close()
+		for rs.Next() {
+			var r filtered[T]
+			if err := rs.Scan(&r.key, &r.data, &r.version); err != nil {
+				return nil, err
+			}
+			rows = append(rows, r)
+		}
+		return rows, rs.Err()
+	}
+
+	rs, err := q.Query(s.h.q(kind, kindRowsQuery), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		r := filtered[T]{v: new(T)}
+		if err := rs.Scan(&r.key, &r.data, &r.version); err != nil {
+			return nil, err
+		}
+		if err := s.decode(kind, r.key, r.data, r.v); err != nil {
+			return nil, err
+		}
+		ok, err := f.Match(r.key, *r.v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rows = append(rows, r)
+		}
+	}
+	return rows, rs.Err()
+}
+
+// filterMismatch returns the *store.FilterError of the first row of kind
+// that t's mismatch condition finds, as Filter.Match describes it.
+func (s *sqLiteStore[T]) filterMismatch(q querier, kind string, f store.Filter, t filterSQL) error {
+	if t.mismatch == "0" {
+		return nil
+	}
+	var key string
+	var data []byte
+	err := q.QueryRow(s.h.q(kind, fmt.Sprintf(firstMismatchQuery, t.mismatch)), append([]any{kind}, t.mismatchArgs...)...).Scan(&key, &data)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	}
+	if _, err := f.Match(key, json.RawMessage(data)); err != nil {
+		return err
+	}
+	return &store.FilterError{Filter: f, Key: key, Reason: "type mismatch"}
+}
+
+// ListWhere runs f in SQL when the codec is codec.JSON, so that only the
+// values passing it are decoded, and decodes every value of kind to match
+// it otherwise. StoreOptions.MaxListResults limits the values that pass f.
+func (s *sqLiteStore[T]) ListWhere(kind string, f store.Filter) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	out := make(map[string]T)
+	err := s.read(ctx, func(q querier) error {
+		rows, err := s.where(q, kind, f)
+		if err != nil {
+			return err
+		}
+		if err := store.CheckResultSize(len(rows), s.maxList); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if r.v == nil {
+				r.v = new(T)
+				if err := s.decode(kind, r.key, r.data, r.v); err != nil {
+					return err
+				}
+			}
+			out[r.key] = *r.v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, timeoutErr(ctx, err)
+	}
+	return out, nil
+}
+
+// CountWhere counts in SQL when the codec is codec.JSON, like ListWhere.
+func (s *sqLiteStore[T]) CountWhere(kind string, f store.Filter) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var n int
+	err := s.read(ctx, func(q querier) error {
+		if !s.isJSON() || !s.h.hasTable(kind) {
+			rows, err := s.where(q, kind, f)
+			n = len(rows)
+			return err
+		}
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		t := translateFilter(f)
+		if err := s.filterMismatch(q, kind, f, t); err != nil {
+			return err
+		}
+		return q.QueryRow(s.h.q(kind, fmt.Sprintf(countWhereQuery, t.cond)), append([]any{kind}, t.condArgs...)...).Scan(&n)
+	})
+	return n, timeoutErr(ctx, err)
+}
+
+// DeleteWhere selects the rows like ListWhere and deletes them in the
+// same transaction. Chunked values (Streamer) are kept. With
+// store.WithDeleteEvents, a value that fails to decode is published with
+// PrevOmitted set.
+func (s *sqLiteStore[T]) DeleteWhere(kind string, f store.Filter, opts ...store.WriteOption) (n int, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return 0, store.ErrReadOnly
+	}
+	if err := f.Validate(); err != nil {
+		return 0, err
+	}
+	if !s.h.hasTable(kind) {
+		return 0, nil
+	}
+	observed := wc.DeleteEvents && s.observed(kind)
+
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	rows, err := s.where(tx, kind, f)
+	if err != nil {
+		return 0, err
+	}
+	var evs []*store.Event[T]
+	prev := make(map[string][]byte)
+	for _, r := range rows {
+		if observed {
+			ev := &store.Event[T]{Kind: kind, Name: r.key, EventType: store.EventTypeDelete, Version: r.version}
+			switch {
+			case r.v != nil:
+				ev.Object, prev[r.key] = *r.v, r.data
+			case s.unmarshal(kind, r.key, r.data, &ev.Object) == nil:
+				prev[r.key] = r.data
+			default:
+				var zero T
+				ev.Object, ev.PrevOmitted = zero, true
+			}
+			if err = s.withinWrite(tx.Tx, ev); err != nil {
+				return 0, err
+			}
+			evs = append(evs, ev)
+		}
+		if _, err = tx.Exec(`DELETE FROM zestor_labels WHERE kind=? AND key=?;`, kind, r.key); err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec(s.h.q(kind, deleteQuery), kind, r.key); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	at := s.now()
+	for _, ev := range evs {
+		ev.At = at
+	}
+	if len(evs) > 0 {
+		s.publishAll(kind, evs, prev, nil)
+	}
+	return len(rows), nil
+}
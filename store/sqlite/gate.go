@@ -0,0 +1,134 @@
+package sqlite
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// opGate lets the operations of the stores on a DB run concurrently,
+// through enter and leave, and maintenance run with none of them, through
+// acquire: a sync.RWMutex whose lock waits with a context. Maintenance
+// pending or held holds back operations entering after it, so a stream of
+// them can't starve it. Operations don't enter while they are in, or
+// pending maintenance would deadlock them.
+type opGate struct {
+	mu sync.Mutex
+	// operations in
+	ops int
+	// maintenance pending or held; done is closed when it ends, drained
+	// when ops drops to 0 while it is pending
+	maint   bool
+	done    chan struct{}
+	drained chan struct{}
+	// turn is held by the maintenance pending or held, one at a time
+	turn chan struct{}
+}
+
+func newOpGate() *opGate {
+	return &opGate{turn: make(chan struct{}, 1)}
+}
+
+// enter waits until no maintenance is pending or held and counts an
+// operation in, or returns ctx's error.
+func (g *opGate) enter(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		if !g.maint {
+			g.ops++
+			g.mu.Unlock()
+			return nil
+		}
+		done := g.done
+		g.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// leave counts an operation out.
+func (g *opGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ops--
+	if g.ops == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+// acquire waits for the other maintenance, if any, to end, holds back new
+// operations and waits for those in to leave. It returns ctx's error if
+// ctx ends first, and otherwise the func ending the maintenance, which
+// may be called more than once.
+func (g *opGate) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case g.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	g.mu.Lock()
+	g.maint, g.done = true, make(chan struct{})
+	var drained chan struct{}
+	if g.ops > 0 {
+		drained = make(chan struct{})
+		g.drained = drained
+	}
+	g.mu.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.maint, g.drained = false, nil
+			close(g.done)
+			g.mu.Unlock()
+			<-g.turn
+		})
+	}
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// MaintenanceMode waits for the reads and writes in progress on the
+// stores of d to finish and holds back new ones until release is called,
+// for work that needs the database to itself, e.g. copying the file for a
+// filesystem snapshot. Operations held back wait, within their
+// Options.ReadTimeout or WriteTimeout; Watch, snapshot views and streamed
+// reads carry on. Recent commits may still be in the WAL: copy the -wal
+// file along with the database file.
+//
+// It returns ctx's error if ctx ends before the operations in progress
+// do, and store.ErrClosed once d is closed. The stores of d must not be
+// used by the goroutine that holds the maintenance mode, which would wait
+// for its release. release may be called more than once.
+func (d *DB) MaintenanceMode(ctx context.Context) (release func(), err error) {
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		return nil, store.ErrClosed
+	}
+	return d.gate.acquire(ctx)
+}
+
+func (s *sqLiteStore[T]) MaintenanceMode(ctx context.Context) (func(), error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	return s.h.MaintenanceMode(ctx)
+}
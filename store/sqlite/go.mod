@@ -9,6 +9,7 @@ replace github.com/zestor-dev/zestor => ../..
 require (
 	github.com/zestor-dev/zestor v0.0.0-00010101000000-000000000000
 	github.com/zestor-dev/zestor/codec v0.0.0-00010101000000-000000000000
+	golang.org/x/time v0.14.0
 	modernc.org/sqlite v1.39.1
 )
 
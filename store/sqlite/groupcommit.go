@@ -0,0 +1,213 @@
+package sqlite
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// DefaultGroupCommitBatch is the most writes a group commit applies in one
+// transaction when GroupCommit.MaxBatch is 0.
+const DefaultGroupCommitBatch = 128
+
+// GroupCommit configures group commit (Options.GroupCommit). It is enabled
+// when either field is set.
+//
+// A single writer goroutine per store takes the queued Set, SetLabeled and
+// Delete calls in order and applies up to MaxBatch of them in one
+// transaction. One failing write doesn't fail the others: it is rolled
+// back and the rest of the batch applied again without it. Events are published after the commit, in queue order, and
+// each call returns once its batch has committed. SetFn and SetAll keep
+// their own transactions. Options.WriteTimeout bounds each batch.
+//
+// The AfterWrite hook runs on the writer goroutine and must not write to
+// the store, which would wait on itself.
+type GroupCommit struct {
+	// How long the writer waits for more writes after the first of a
+	// batch. 0 batches only the writes already queued.
+	MaxDelay time.Duration
+	// The most writes per transaction (0 means DefaultGroupCommitBatch).
+	MaxBatch int
+}
+
+func (g GroupCommit) enabled() bool {
+	return g.MaxDelay > 0 || g.MaxBatch > 0
+}
+
+// groupOp is a write queued for the group committer.
+type groupOp struct {
+	// apply runs the write inside the batch transaction. The returned func,
+	// if not nil, publishes its event after the commit.
+	apply func(tx *writeTx) (publish func(), err error)
+	done  chan error
+}
+
+type groupCommitter struct {
+	cfg GroupCommit
+	// starts a batch's transaction, and bounds it
+	begin   func(ctx context.Context) (*writeTx, error)
+	timeout time.Duration
+
+	mu      sync.RWMutex // guards closed against sends on queue
+	closed  bool
+	queue   chan *groupOp
+	stopped chan struct{}
+}
+
+// startGroupCommit starts the writer goroutine of s.
+func (s *sqLiteStore[T]) startGroupCommit(cfg GroupCommit) {
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = DefaultGroupCommitBatch
+	}
+	g := &groupCommitter{
+		cfg:     cfg,
+		begin:   s.begin,
+		timeout: s.h.writeTimeout,
+		queue:   make(chan *groupOp, cfg.MaxBatch),
+		stopped: make(chan struct{}),
+	}
+	s.group = g
+	go g.run()
+}
+
+// publishFn returns the publishing of ev after its batch commits, or nil
+// when there is no event.
+func (s *sqLiteStore[T]) publishFn(kind string, ev *store.Event[T], data, prev []byte) func() {
+	if ev == nil {
+		return nil
+	}
+	return func() {
+		ev.At = s.now()
+		s.publish(kind, ev, data, prev)
+	}
+}
+
+// do queues apply and waits for its batch to commit. It returns
+// store.ErrClosed once the committer was stopped.
+func (g *groupCommitter) do(apply func(tx *writeTx) (func(), error)) error {
+	op := &groupOp{apply: apply, done: make(chan error, 1)}
+	g.mu.RLock()
+	if g.closed {
+		g.mu.RUnlock()
+		return store.ErrClosed
+	}
+	g.queue <- op
+	g.mu.RUnlock()
+	return <-op.done
+}
+
+// stop applies the writes still queued and ends the writer.
+func (g *groupCommitter) stop() {
+	g.mu.Lock()
+	g.closed = true
+	close(g.queue)
+	g.mu.Unlock()
+	<-g.stopped
+}
+
+func (g *groupCommitter) run() {
+	defer close(g.stopped)
+	for op := range g.queue {
+		batch := []*groupOp{op}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if g.cfg.MaxDelay > 0 {
+			timer = time.NewTimer(g.cfg.MaxDelay)
+			timeout = timer.C
+		}
+	collect:
+		for len(batch) < g.cfg.MaxBatch {
+			if timeout == nil {
+				select {
+				case op, ok := <-g.queue:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, op)
+				default:
+					break collect
+				}
+				continue
+			}
+			select {
+			case op, ok := <-g.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, op)
+			case <-timeout:
+				break collect
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		g.commit(batch)
+	}
+}
+
+// commit applies batch in one transaction, publishes the events of the
+// writes that succeeded in order, then hands every caller its result.
+//
+// A write that fails rolls the transaction back and the batch is applied
+// again without it. Failures are rare, and this keeps savepoints, whose
+// journaling costs more than the fsync they save on fast disks, off the
+// common path.
+func (g *groupCommitter) commit(batch []*groupOp) {
+	ctx, cancel := opCtx(g.timeout)
+	defer cancel()
+
+	errs := make([]error, len(batch))
+	publish := make([]func(), len(batch))
+	for {
+		failed, err := g.apply(ctx, batch, errs, publish)
+		if err != nil {
+			for i, op := range batch {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+				op.done <- timeoutErr(ctx, errs[i])
+			}
+			return
+		}
+		if failed < 0 {
+			break
+		}
+		errs[failed] = timeoutErr(ctx, errs[failed])
+	}
+	for i, op := range batch {
+		if publish[i] != nil {
+			publish[i]()
+		}
+		op.done <- errs[i]
+	}
+}
+
+// apply runs the writes of batch that haven't failed yet in one
+// transaction. If one fails, it records the error, rolls back and returns
+// the write's index; otherwise it commits and returns -1. err is a failure
+// of the transaction itself.
+func (g *groupCommitter) apply(ctx context.Context, batch []*groupOp, errs []error, publish []func()) (failed int, err error) {
+	tx, err := g.begin(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.release()
+	for i, op := range batch {
+		if errs[i] != nil {
+			continue
+		}
+		publish[i], errs[i] = op.apply(tx)
+		if errs[i] != nil {
+			_ = tx.Rollback()
+			return i, nil
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return -1, err
+	}
+	return -1, nil
+}
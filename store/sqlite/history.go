@@ -0,0 +1,24 @@
+package sqlite
+
+// ring holds the last n items pushed to it.
+type ring[E any] struct {
+	buf   []E
+	start int // index of the oldest item once buf is full
+}
+
+// push adds e, overwriting the oldest item once n are held.
+func (r *ring[E]) push(n int, e E) {
+	if len(r.buf) < n {
+		r.buf = append(r.buf, e)
+		return
+	}
+	r.buf[r.start] = e
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// items returns the held items, oldest first.
+func (r *ring[E]) items() []E {
+	out := make([]E, 0, len(r.buf))
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:r.start]...)
+}
@@ -0,0 +1,89 @@
+package sqlite
+
+import (
+	"fmt"
+
+	"github.com/zestor-dev/zestor/codec"
+	"github.com/zestor-dev/zestor/store"
+)
+
+// JSONLister is implemented by sqlite stores. Its queries read fields of
+// the stored documents inside SQLite, so they only work with a JSON codec.
+type JSONLister[T any] interface {
+	// ListOrderByJSON returns the values of kind sorted by the field at
+	// jsonPath (an SQLite JSON path such as "$.updated"), ties broken by
+	// key. Values lacking the field sort first, or last when desc. limit
+	// <= 0 means no limit. It returns store.ErrUnsupported unless the
+	// store's codec is codec.JSON.
+	ListOrderByJSON(kind, jsonPath string, desc bool, limit int) ([]store.KeyValue[T], error)
+}
+
+// the CAST keeps SQLite from reading a blob as JSONB
+const listOrderByJSONQuery = `
+SELECT key, value FROM zestor_kv
+WHERE kind=?1
+ORDER BY json_extract(CAST(value AS TEXT), ?2) %s, key
+LIMIT ?3;`
+
+func (s *sqLiteStore[T]) ListOrderByJSON(kind, jsonPath string, desc bool, limit int) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+
+	if !s.isJSON() {
+		return nil, fmt.Errorf("sqlite: ListOrderByJSON with %T codec: %w", s.codec, store.ErrUnsupported)
+	}
+	if !s.h.hasTable(kind) {
+		return []store.KeyValue[T]{}, nil
+	}
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var out []store.KeyValue[T]
+	err := s.read(ctx, func(q querier) (err error) {
+		out, err = s.listOrderByJSON(q, kind, jsonPath, dir, limit)
+		return err
+	})
+	return out, timeoutErr(ctx, err)
+}
+
+func (s *sqLiteStore[T]) listOrderByJSON(q querier, kind, jsonPath, dir string, limit int) ([]store.KeyValue[T], error) {
+	rows, err := q.Query(s.h.q(kind, fmt.Sprintf(listOrderByJSONQuery, dir)), kind, jsonPath, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]store.KeyValue[T], 0)
+	for rows.Next() {
+		var k string
+		var blob []byte
+		if err := rows.Scan(&k, &blob); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := s.unmarshal(kind, k, blob, &v); err != nil {
+			return nil, err
+		}
+		out = append(out, store.KeyValue[T]{Key: k, Value: v})
+	}
+	return out, rows.Err()
+}
+
+// isJSON reports whether values are stored as JSON text.
+func (s *sqLiteStore[T]) isJSON() bool {
+	_, ok := s.codec.(*codec.JSON)
+	return ok
+}
@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// Maintainer is implemented by sqlite stores, for periodic maintenance of
+// the database file.
+type Maintainer interface {
+	// Optimize refreshes the statistics the query planner picks indexes
+	// with (ANALYZE, then PRAGMA optimize) and, on a database created with
+	// AutoVacuumIncremental, returns free pages to the filesystem. Unlike
+	// VACUUM it doesn't rewrite the file, but it does hold the write lock
+	// while it runs. It is not bounded by Options.WriteTimeout.
+	Optimize() error
+	// MaintenanceMode quiesces the reads and writes of every store on the
+	// store's DB until release is called; see DB.MaintenanceMode.
+	MaintenanceMode(ctx context.Context) (release func(), err error)
+}
+
+func (s *sqLiteStore[T]) Optimize() error {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return store.ErrReadOnly
+	}
+
+	ctx := context.Background()
+	if err := s.h.gate.enter(ctx); err != nil {
+		return err
+	}
+	defer s.h.gate.leave()
+	defer s.h.ownWrite()()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, stmt := range []string{`ANALYZE;`, `PRAGMA optimize;`} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("sqlite: Optimize: %s %w", stmt, err)
+		}
+	}
+	// incremental_vacuum frees a page per step, so it is run as a query
+	// and drained; it does nothing unless auto_vacuum is INCREMENTAL
+	rows, err := conn.QueryContext(ctx, `PRAGMA incremental_vacuum;`)
+	if err != nil {
+		return fmt.Errorf("sqlite: Optimize: incremental_vacuum: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("sqlite: Optimize: incremental_vacuum: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSchemaTooNew is returned by New and Open for a database whose schema
+// a newer version of this package upgraded.
+var ErrSchemaTooNew = errors.New("sqlite: database schema is newer than this version supports")
+
+// migration is one step of the schema upgrade Open applies to databases
+// written by older versions. PRAGMA user_version counts the steps a file
+// has had, so each runs once per file.
+//
+// Step 1 creates the current schema, so a new file has every later step
+// applied already; later steps must be no-ops on it, which is why they use
+// IF NOT EXISTS and addColumn. Files from before user_version was kept are
+// at 0 and take step 1 like an empty one. Released steps are never edited
+// or reordered: a schema change is a new step at the end, plus the same
+// change to kvSchema, blobSchema or kindTableSchema.
+type migration struct {
+	name string
+	up   func(ctx context.Context, conn *sql.Conn) error
+}
+
+var migrations = []migration{
+	{"create tables", func(ctx context.Context, conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, kvSchema); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, blobSchema)
+		return err
+	}},
+	{"index updated_at", indexUpdatedAt},
+	{"create trash", func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, trashSchema)
+		return err
+	}},
+	{"create recode progress", func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, recodeSchema)
+		return err
+	}},
+	{"index idempotency keys", func(ctx context.Context, conn *sql.Conn) error {
+		if err := addColumn(ctx, conn, "zestor_idempotency", "version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_idempotency_at ON zestor_idempotency(at);`)
+		return err
+	}},
+}
+
+// schemaVersion is the user_version of an up-to-date file.
+var schemaVersion = len(migrations)
+
+// migrate applies the steps conn's file lacks, each in its own IMMEDIATE
+// transaction that sets user_version, so a failed step leaves the file at
+// the previous one and processes opening the file at once apply each step
+// once.
+func migrate(ctx context.Context, conn *sql.Conn) error {
+	v, err := userVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for v < schemaVersion {
+		if v, err = migrateStep(ctx, conn); err != nil {
+			return err
+		}
+	}
+	return checkSchemaVersion(v)
+}
+
+// migrateStep applies the next step, unless another process did meanwhile,
+// and returns the file's user_version after it.
+func migrateStep(ctx context.Context, conn *sql.Conn) (v int, err error) {
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE;`); err != nil {
+		return 0, fmt.Errorf("sqlite: migrate: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_, _ = conn.ExecContext(context.Background(), `ROLLBACK;`)
+		}
+	}()
+	if v, err = userVersion(ctx, conn); err != nil || v >= schemaVersion {
+		if err == nil {
+			_, err = conn.ExecContext(ctx, `COMMIT;`)
+		}
+		return v, err
+	}
+	m := migrations[v]
+	if err := m.up(ctx, conn); err != nil {
+		return 0, fmt.Errorf("sqlite: migrate to schema %d (%s): %w", v+1, m.name, err)
+	}
+	// PRAGMA takes no parameters; v+1 is an int
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version=%d;`, v+1)); err != nil {
+		return 0, err
+	}
+	if _, err := conn.ExecContext(ctx, `COMMIT;`); err != nil {
+		return 0, fmt.Errorf("sqlite: migrate to schema %d (%s): %w", v+1, m.name, err)
+	}
+	return v + 1, nil
+}
+
+func userVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var v int
+	if err := conn.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("sqlite: read user_version: %w", err)
+	}
+	return v, nil
+}
+
+func checkSchemaVersion(v int) error {
+	if v > schemaVersion {
+		return fmt.Errorf("%w: the file is at schema %d, this version knows %d; upgrade the library", ErrSchemaTooNew, v, schemaVersion)
+	}
+	return nil
+}
+
+// addColumn adds column, declared as decl (e.g. "INTEGER NOT NULL DEFAULT
+// 0"), to table unless it has it. SQLite has no ADD COLUMN IF NOT EXISTS.
+func addColumn(ctx context.Context, conn *sql.Conn, table, column, decl string) error {
+	var n int
+	err := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?;`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, quoteIdent(table), quoteIdent(column), decl))
+	return err
+}
+
+// indexUpdatedAt indexes zestor_kv and the per-kind tables by (kind,
+// updated_at) for store.Pruner; files from before it have neither index.
+func indexUpdatedAt(ctx context.Context, conn *sql.Conn) error {
+	if _, err := conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_kv_updated ON zestor_kv(kind, updated_at);`); err != nil {
+		return err
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type='table' AND name LIKE ? ESCAPE '\';`,
+		strings.ReplaceAll(kindTablePrefix, "_", `\_`)+"%")
+	if err != nil {
+		return err
+	}
+	var kinds []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		kinds = append(kinds, strings.TrimPrefix(name, kindTablePrefix))
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, kind := range kinds {
+		_, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s ON %s(kind, updated_at);`,
+			quoteIdent(kindIndexPrefix+kind), quoteIdent(kindTablePrefix+kind)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package sqlite
+
+import (
+	"fmt"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// The queries of store.KindMover take the destination kind as ?1 and the
+// source kind as ?2, and are formatted with the destination's table as
+// %[1]s and the source's as %[2]s (both zestor_kv without TablePerKind).
+const (
+	kindHasRowsQuery = `SELECT EXISTS(SELECT 1 FROM %[1]s WHERE kind=?1);`
+	copyKindQuery    = `
+INSERT INTO %[1]s(kind,key,value,version,updated_at)
+SELECT ?1, key, value, version, updated_at FROM %[2]s WHERE kind=?2
+ON CONFLICT(kind,key) DO UPDATE
+SET value=excluded.value, version=%[1]s.version+1, updated_at=STRFTIME('%%Y-%%m-%%dT%%H:%%M:%%fZ','now');`
+	// renames in place within zestor_kv, when no key of the source exists
+	// in the destination
+	renameKindQuery = `UPDATE zestor_kv SET kind=?1 WHERE kind=?2;`
+	dropKindQuery   = `DELETE FROM %[2]s WHERE kind=?2;`
+	// the labels of the destination's overwritten keys, and of the source
+	// keys held in the main table; chunked values keep theirs
+	dropOverwrittenLabelsQuery = `
+DELETE FROM zestor_labels
+WHERE kind=?1 AND key IN (SELECT key FROM %[2]s WHERE kind=?2);`
+	copyLabelsQuery = `
+INSERT INTO zestor_labels(kind,key,label,value)
+SELECT ?1, key, label, value FROM zestor_labels
+WHERE kind=?2 AND key IN (SELECT key FROM %[2]s WHERE kind=?2);`
+	moveLabelsQuery = `
+UPDATE zestor_labels SET kind=?1
+WHERE kind=?2 AND key IN (SELECT key FROM %[2]s WHERE kind=?2);`
+	// the rows of the source, each with the version of the destination's
+	// key it overwrites (0 if none)
+	selectMovedQuery = `
+SELECT s.key, s.value, s.version, COALESCE(d.version, 0)
+FROM %[2]s s LEFT JOIN %[1]s d ON d.kind=?1 AND d.key=s.key
+WHERE s.kind=?2 ORDER BY s.key;`
+	selectOverwrittenQuery = `
+SELECT key, value FROM %[1]s
+WHERE kind=?1 AND key IN (SELECT key FROM %[2]s WHERE kind=?2);`
+)
+
+// CopyKind copies the rows of srcKind with one INSERT ... SELECT. Chunked
+// values (Streamer) are not copied.
+func (s *sqLiteStore[T]) CopyKind(srcKind, dstKind string, opts ...store.WriteOption) (int, error) {
+	return s.copyKind(srcKind, dstKind, false, opts)
+}
+
+// RenameKind moves the rows of srcKind with one UPDATE of their kind
+// column, or, with TablePerKind or when it overwrites keys, by copying
+// and deleting them. Chunked values (Streamer) stay in srcKind.
+func (s *sqLiteStore[T]) RenameKind(srcKind, dstKind string, opts ...store.WriteOption) (int, error) {
+	return s.copyKind(srcKind, dstKind, true, opts)
+}
+
+// copyKind implements CopyKind, and RenameKind if move is set, in one
+// transaction.
+func (s *sqLiteStore[T]) copyKind(srcKind, dstKind string, move bool, opts []store.WriteOption) (n int, err error) {
+	if err := s.checkKind(srcKind, dstKind); err != nil {
+		return 0, err
+	}
+	if srcKind == dstKind {
+		return 0, fmt.Errorf("sqlite: kind %q is both source and destination", srcKind)
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return 0, store.ErrReadOnly
+	}
+	if !s.h.hasTable(srcKind) {
+		return 0, nil
+	}
+	if err := s.h.ensureTable(dstKind); err != nil {
+		return 0, err
+	}
+	events := wc.KindEvents && (s.observed(dstKind) || move && s.observed(srcKind))
+	q := func(query string) string {
+		return fmt.Sprintf(query, s.h.table(dstKind), s.h.table(srcKind))
+	}
+
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var nonEmpty bool
+	if err = tx.QueryRow(q(kindHasRowsQuery), dstKind).Scan(&nonEmpty); err != nil {
+		return 0, err
+	}
+	if nonEmpty && !wc.Overwrite {
+		return 0, fmt.Errorf("sqlite: %s: %w", dstKind, store.ErrKindNotEmpty)
+	}
+	var moved []movedRow[T]
+	if events {
+		if moved, err = s.movedRows(tx, q, srcKind, dstKind, nonEmpty); err != nil {
+			return 0, err
+		}
+	}
+
+	if nonEmpty {
+		if _, err = tx.Exec(q(dropOverwrittenLabelsQuery), dstKind, srcKind); err != nil {
+			return 0, err
+		}
+	}
+	labelsQuery := copyLabelsQuery
+	if move {
+		labelsQuery = moveLabelsQuery
+	}
+	if _, err = tx.Exec(q(labelsQuery), dstKind, srcKind); err != nil {
+		return 0, err
+	}
+	if move && !nonEmpty && !s.h.tablePerKind {
+		res, err := tx.Exec(renameKindQuery, dstKind, srcKind)
+		if err != nil {
+			return 0, err
+		}
+		rows, _ := res.RowsAffected()
+		n = int(rows)
+	} else {
+		res, err := tx.Exec(q(copyKindQuery), dstKind, srcKind)
+		if err != nil {
+			return 0, err
+		}
+		rows, _ := res.RowsAffected()
+		n = int(rows)
+		if move {
+			if _, err = tx.Exec(q(dropKindQuery), dstKind, srcKind); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var dels, evs []*store.Event[T]
+	data, prev := make(map[string][]byte), make(map[string][]byte)
+	for _, r := range moved {
+		if move {
+			ev := &store.Event[T]{Kind: srcKind, Name: r.key, EventType: store.EventTypeDelete, Object: r.value, Version: r.version}
+			if err = s.withinWrite(tx.Tx, ev); err != nil {
+				return 0, err
+			}
+			dels = append(dels, ev)
+		}
+		ev := &store.Event[T]{Kind: dstKind, Name: r.key, EventType: store.EventTypeCreate, Object: r.value, Version: r.version}
+		if r.overwrites > 0 {
+			ev.EventType, ev.Version = store.EventTypeUpdate, r.overwrites+1
+			prev[r.key] = r.prev
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return 0, err
+		}
+		evs = append(evs, ev)
+		data[r.key] = r.data
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	at := s.now()
+	for _, ev := range append(dels, evs...) {
+		ev.At = at
+	}
+	if len(dels) > 0 {
+		s.publishAll(srcKind, dels, data, nil)
+	}
+	if len(evs) > 0 {
+		s.publishAll(dstKind, evs, data, prev)
+	}
+	return n, nil
+}
+
+// movedRow is a row CopyKind or RenameKind writes, read for its events.
+type movedRow[T any] struct {
+	key     string
+	data    []byte
+	value   T
+	version int64
+	// version of the destination key it overwrites, 0 if none
+	overwrites int64
+	// encoding of the overwritten value
+	prev []byte
+}
+
+// movedRows reads the rows of srcKind that copyKind is about to write to
+// dstKind, sorted by key. With overwrites set it also reads the values of
+// dstKind they replace. A value that fails to decode fails the call.
+func (s *sqLiteStore[T]) movedRows(tx *writeTx, q func(string) string, srcKind, dstKind string, overwrites bool) ([]movedRow[T], error) {
+	prev := make(map[string][]byte)
+	if overwrites {
+		rows, err := tx.Query(q(selectOverwrittenQuery), dstKind, srcKind)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var k string
+			var data []byte
+			if err := rows.Scan(&k, &data); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			prev[k] = data
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.Query(q(selectMovedQuery), dstKind, srcKind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var moved []movedRow[T]
+	for rows.Next() {
+		var r movedRow[T]
+		if err := rows.Scan(&r.key, &r.data, &r.version, &r.overwrites); err != nil {
+			return nil, err
+		}
+		if err := s.unmarshal(srcKind, r.key, r.data, &r.value); err != nil {
+			return nil, err
+		}
+		r.prev = prev[r.key]
+		moved = append(moved, r)
+	}
+	return moved, rows.Err()
+}
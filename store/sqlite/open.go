@@ -0,0 +1,77 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// Scheme is the URL scheme store.Open serves with a sqlite store:
+// "sqlite:///abs/path.db" or "sqlite://relative/path.db". These query
+// parameters set the Options of the same name: busy_timeout, read_timeout
+// and write_timeout (durations such as "5s"), wal, read_only, create_dirs
+// and table_per_kind (true or false).
+const Scheme = "sqlite"
+
+func init() {
+	store.RegisterBackend(Scheme, store.Backend{
+		Params: []string{"busy_timeout", "read_timeout", "write_timeout", "wal", "read_only", "create_dirs", "table_per_kind"},
+		Open:   open,
+	})
+}
+
+func open(u *url.URL, c store.Codec, p store.Params, so store.StoreOptions[any]) (store.Store[any], error) {
+	if c == nil {
+		return nil, errors.New("sqlite: store.Open needs a codec")
+	}
+	o, err := urlOptions(u, p)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %s: %w", u.Redacted(), err)
+	}
+	o.Codec = c
+	return New[any](o, so)
+}
+
+// urlOptions returns the Options of a store.Open URL.
+func urlOptions(u *url.URL, p store.Params) (Options, error) {
+	var o Options
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return o, errors.New("no path, want sqlite:///path/to.db")
+	}
+	if path == ":memory:" {
+		// each pooled connection would get a database of its own
+		return o, errors.New("use mem:// for an in-memory store")
+	}
+	o.DSN = "file:" + (&url.URL{Path: path}).EscapedPath()
+	var err error
+	if o.BusyTimeout, err = p.Duration("busy_timeout", 0); err != nil {
+		return o, err
+	}
+	if o.ReadTimeout, err = p.Duration("read_timeout", 0); err != nil {
+		return o, err
+	}
+	if o.WriteTimeout, err = p.Duration("write_timeout", 0); err != nil {
+		return o, err
+	}
+	wal, err := p.Bool("wal", true)
+	if err != nil {
+		return o, err
+	}
+	o.DisableWAL = !wal
+	if o.ReadOnly, err = p.Bool("read_only", false); err != nil {
+		return o, err
+	}
+	if o.CreateDirs, err = p.Bool("create_dirs", false); err != nil {
+		return o, err
+	}
+	if o.TablePerKind, err = p.Bool("table_per_kind", false); err != nil {
+		return o, err
+	}
+	return o, nil
+}
@@ -0,0 +1,164 @@
+package sqlite
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// The queries of store.Pruner compare updated_at, which the
+// idx_kv_updated index covers, with a cutoff from updatedAtCutoff.
+const (
+	countOlderQuery  = `SELECT COUNT(*) FROM zestor_kv WHERE kind=? AND updated_at < ?;`
+	selectOlderQuery = `SELECT key, value, version FROM zestor_kv WHERE kind=? AND updated_at < ? ORDER BY key;`
+	deleteOlderQuery = `DELETE FROM zestor_kv WHERE kind=? AND updated_at < ?;`
+	// run before deleteOlderQuery, while the rows still exist
+	deleteOlderLabelsQuery = `
+DELETE FROM zestor_labels
+WHERE kind=?1 AND key IN (SELECT key FROM zestor_kv WHERE kind=?1 AND updated_at < ?2);`
+)
+
+// updatedAtCutoff formats cutoff like updated_at, which keeps
+// milliseconds. A cutoff between two milliseconds is rounded up, so that
+// updated_at < cutoff holds exactly for the rows changed strictly before
+// it.
+func updatedAtCutoff(cutoff time.Time) string {
+	c := cutoff.UTC()
+	if t := c.Truncate(time.Millisecond); !t.Equal(c) {
+		c = t.Add(time.Millisecond)
+	}
+	return c.Format("2006-01-02T15:04:05.000Z")
+}
+
+// CountOlderThan counts by updated_at, the database clock's time of the
+// last change, not StoreOptions.Now. Chunked values (Streamer) are not
+// counted.
+func (s *sqLiteStore[T]) CountOlderThan(kind string, cutoff time.Time) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if !s.h.hasTable(kind) {
+		return 0, nil
+	}
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var n int
+	err := s.read(ctx, func(q querier) error {
+		return q.QueryRow(s.h.q(kind, countOlderQuery), kind, updatedAtCutoff(cutoff)).Scan(&n)
+	})
+	return n, timeoutErr(ctx, err)
+}
+
+// DeleteOlderThan deletes by updated_at like CountOlderThan, in one
+// transaction. Chunked values are kept. With store.WithDeleteEvents, the
+// rows are read first for their events; a value that fails to decode is
+// published with PrevOmitted set.
+func (s *sqLiteStore[T]) DeleteOlderThan(kind string, cutoff time.Time, opts ...store.WriteOption) (n int, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return 0, store.ErrReadOnly
+	}
+	if !s.h.hasTable(kind) {
+		return 0, nil
+	}
+	observed := wc.DeleteEvents && s.observed(kind)
+	c := updatedAtCutoff(cutoff)
+
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var evs []*store.Event[T]
+	prev := make(map[string][]byte)
+	if observed {
+		if evs, err = s.olderEvents(tx, kind, c, prev); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = tx.Exec(s.h.q(kind, deleteOlderLabelsQuery), kind, c); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(s.h.q(kind, deleteOlderQuery), kind, c)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := res.RowsAffected()
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	at := s.now()
+	for _, ev := range evs {
+		ev.At = at
+	}
+	if len(evs) > 0 {
+		s.publishAll(kind, evs, prev, nil)
+	}
+	return int(deleted), nil
+}
+
+// olderEvents reads the rows DeleteOlderThan is about to delete and
+// returns their delete events, running the WithinWrite hook for each. It
+// stores the encoding of each decoded value in prev.
+func (s *sqLiteStore[T]) olderEvents(tx *writeTx, kind, cutoff string, prev map[string][]byte) ([]*store.Event[T], error) {
+	rows, err := tx.Query(s.h.q(kind, selectOlderQuery), kind, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var evs []*store.Event[T]
+	for rows.Next() {
+		var k string
+		var data []byte
+		var version int64
+		if err := rows.Scan(&k, &data, &version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ev := &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeDelete, Version: version}
+		if err := s.unmarshal(kind, k, data, &ev.Object); err != nil {
+			var zero T
+			ev.Object, ev.PrevOmitted = zero, true
+		} else {
+			prev[k] = data
+		}
+		evs = append(evs, ev)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlite: DeleteOlderThan %s: %w", kind, err)
+	}
+	// the hook may write through tx, so it runs once the rows are closed
+	for _, ev := range evs {
+		if err := s.withinWrite(tx.Tx, ev); err != nil {
+			return nil, err
+		}
+	}
+	return evs, nil
+}
@@ -0,0 +1,28 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// throttle takes a token of Options.WriteRateLimit for a write
+// transaction about to begin under ctx. It waits for one with
+// WriteRateWait, as long as ctx allows, and fails with
+// store.ErrRateLimited otherwise.
+func (d *DB) throttle(ctx context.Context) error {
+	if d.writeLimit == nil {
+		return nil
+	}
+	if !d.writeWait {
+		if !d.writeLimit.Allow() {
+			return store.ErrRateLimited
+		}
+		return nil
+	}
+	if err := d.writeLimit.Wait(ctx); err != nil {
+		return fmt.Errorf("%w: %v", store.ErrRateLimited, err)
+	}
+	return nil
+}
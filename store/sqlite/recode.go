@@ -0,0 +1,196 @@
+package sqlite
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/zestor-dev/zestor/codec"
+	"github.com/zestor-dev/zestor/store"
+)
+
+// recodeSchema, part of kvSchema, holds the progress of each unfinished
+// Recode: the kind's keys up to last_key are recoded from one codec to
+// another, both named by their Go types in codecs.
+const (
+	recodeSchema = `
+CREATE TABLE IF NOT EXISTS zestor_recode (
+  kind     TEXT NOT NULL PRIMARY KEY,
+  last_key TEXT NOT NULL,
+  codecs   TEXT NOT NULL
+);
+`
+	recodeProgressQuery = `SELECT last_key, codecs FROM zestor_recode WHERE kind=?;`
+	recodeMarkQuery     = `INSERT OR REPLACE INTO zestor_recode(kind,last_key,codecs) VALUES(?,?,?);`
+	recodeDoneQuery     = `DELETE FROM zestor_recode WHERE kind=?;`
+	recodeBatchQuery    = `SELECT key, value FROM zestor_kv WHERE kind=? AND key > ? ORDER BY key LIMIT ?;`
+	recodeRowQuery      = `UPDATE zestor_kv SET value=? WHERE kind=? AND key=?;`
+	recodeTrashQuery    = `SELECT key, value FROM zestor_trash WHERE kind=?;`
+	recodeTrashRowQuery = `UPDATE zestor_trash SET value=? WHERE kind=? AND key=?;`
+)
+
+// recodeBatch is how many rows Recode rewrites per transaction.
+var recodeBatch = 500
+
+// Recoder is implemented by sqlite stores, for moving the values of a kind
+// to another codec in place.
+type Recoder interface {
+	// Recode rewrites every value of kind encoded with from in the format
+	// of to, and returns how many values it rewrote. Values that from
+	// fails to decode but to decodes are taken for recoded already and
+	// left alone; a value neither decodes stops Recode with an error
+	// naming its key.
+	//
+	// It works in batches, each its own transaction that also records
+	// how far it got, so an interrupted Recode is resumed by calling it
+	// again with the same codecs: values are never half written, and the
+	// ones already recoded aren't decoded again. Recoding the kind with
+	// other codecs before the last one finished fails. The trash of
+	// store.SoftDeleter is recoded in the last transaction.
+	//
+	// Values keep their version and change time, and no event is
+	// published. Chunked values (Streamer) are left alone. Open the store
+	// with a codec.Fallback whose Primary is to and whose Secondary holds
+	// from, so that it reads both formats while Recode runs, and writes
+	// the new one.
+	Recode(kind string, from, to codec.Codec) (migrated int, err error)
+}
+
+func (s *sqLiteStore[T]) Recode(kind string, from, to codec.Codec) (migrated int, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return 0, store.ErrReadOnly
+	}
+	if !s.h.hasTable(kind) {
+		return 0, nil
+	}
+	codecs := fmt.Sprintf("%T>%T", from, to)
+	for {
+		n, done, err := s.recodeBatch(kind, from, to, codecs)
+		migrated += n
+		if err != nil || done {
+			return migrated, err
+		}
+	}
+}
+
+// recodeBatch recodes the next batch of kind after the recorded progress,
+// in one transaction. done reports that the kind is fully recoded and its
+// progress dropped.
+func (s *sqLiteStore[T]) recodeBatch(kind string, from, to codec.Codec, codecs string) (n int, done bool, err error) {
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var last, was string
+	switch err = tx.QueryRow(recodeProgressQuery, kind).Scan(&last, &was); {
+	case errors.Is(err, sql.ErrNoRows):
+		last, err = "", nil
+	case err != nil:
+		return 0, false, err
+	case was != codecs:
+		_ = tx.Rollback()
+		return 0, false, fmt.Errorf("sqlite: Recode %s with %s: a recode with %s is unfinished", kind, codecs, was)
+	}
+
+	rows, err := s.recodeRows(tx, s.h.q(kind, recodeBatchQuery), kind, last, recodeBatch)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, r := range rows {
+		var ok bool
+		if r.blob, ok, err = s.recode(kind, r.key, r.blob, from, to); err != nil {
+			return 0, false, err
+		}
+		if !ok {
+			continue
+		}
+		if _, err = tx.Exec(s.h.q(kind, recodeRowQuery), r.blob, kind, r.key); err != nil {
+			return 0, false, err
+		}
+		n++
+	}
+
+	if done = len(rows) < recodeBatch; done {
+		var trashed []row
+		if trashed, err = s.recodeRows(tx, recodeTrashQuery, kind); err != nil {
+			return 0, false, err
+		}
+		for _, r := range trashed {
+			var ok bool
+			if r.blob, ok, err = s.recode(kind, r.key, r.blob, from, to); err != nil {
+				return 0, false, err
+			}
+			if !ok {
+				continue
+			}
+			if _, err = tx.Exec(recodeTrashRowQuery, r.blob, kind, r.key); err != nil {
+				return 0, false, err
+			}
+			n++
+		}
+		_, err = tx.Exec(recodeDoneQuery, kind)
+	} else {
+		_, err = tx.Exec(recodeMarkQuery, kind, rows[len(rows)-1].key, codecs)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return n, done, nil
+}
+
+// recodeRows reads the key and value rows of query, for Recode to write
+// back once they are closed.
+func (s *sqLiteStore[T]) recodeRows(tx *writeTx, query string, args ...any) ([]row, error) {
+	rs, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var rows []row
+	for rs.Next() {
+		var r row
+		if err := rs.Scan(&r.key, &r.blob); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	return rows, rs.Err()
+}
+
+// recode returns data, the value of kind and key, decoded with from and
+// encoded with to. ok is false if data is in the format of to already, or
+// encodes the same with both.
+func (s *sqLiteStore[T]) recode(kind, key string, data []byte, from, to codec.Codec) (out []byte, ok bool, err error) {
+	defer recoverCodec("Recode", &err)
+	var v T
+	if err := codec.UnmarshalCtx(from, kind, key, data, &v); err != nil {
+		if codec.UnmarshalCtx(to, kind, key, data, &v) == nil {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("sqlite: Recode %s/%s: %w", kind, key, err)
+	}
+	if out, err = codec.MarshalCtx(to, kind, key, v); err != nil {
+		return nil, false, fmt.Errorf("sqlite: Recode %s/%s: %w", kind, key, err)
+	}
+	return out, !bytes.Equal(out, data), nil
+}
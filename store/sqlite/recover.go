@@ -0,0 +1,98 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// ErrCorrupt is matched by the error of New and Open for a database file
+// SQLite finds corrupt, or not to be a database at all.
+var ErrCorrupt = errors.New("sqlite: database file is corrupt")
+
+// largeWAL is the size from which Open logs a WAL it finds next to the
+// database file.
+var largeWAL int64 = 64 << 20
+
+// corruptErr returns err, met opening the database at path, as an
+// ErrCorrupt if SQLite reported corruption, and unchanged otherwise.
+func corruptErr(path string, err error) error {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return err
+	}
+	switch coded.Code() & 0xff {
+	case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+		return fmt.Errorf("%w: %s: %v; restore it from a backup, or salvage it with the sqlite3 CLI's .recover", ErrCorrupt, path, coded)
+	}
+	return err
+}
+
+// checkWAL looks at the -wal and -shm files next to the database file at
+// path before SQLite opens it. A WAL holds the commits a process made
+// since its last checkpoint; one that is large was likely left by a
+// process killed before it could checkpoint, and is logged. WAL and SHM
+// files without a database file belong to one that was deleted, and SQLite
+// would replay them into the new file: they are logged, and removed with
+// recover. pending reports a WAL with frames to checkpoint.
+func checkWAL(path string, recover bool) (pending bool, err error) {
+	wal, shm := path+"-wal", path+"-shm"
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		var orphans []string
+		for _, name := range []string{wal, shm} {
+			if _, err := os.Stat(name); err == nil {
+				orphans = append(orphans, name)
+			}
+		}
+		if len(orphans) == 0 {
+			return false, nil
+		}
+		if !recover {
+			log.Printf("zestor/sqlite: %s is missing but %v are left from a deleted database, which SQLite will replay into the new file; remove them or set Options.RecoverOnOpen", path, orphans)
+			return false, nil
+		}
+		for _, name := range orphans {
+			if err := os.Remove(name); err != nil {
+				return false, fmt.Errorf("sqlite: open %s: remove orphaned %s: %w", path, name, err)
+			}
+			log.Printf("zestor/sqlite: removed %s, left without its database file", name)
+		}
+		return false, nil
+	}
+	info, err := os.Stat(wal)
+	if err != nil || info.Size() == 0 {
+		return false, nil
+	}
+	if info.Size() >= largeWAL {
+		hint := "set Options.RecoverOnOpen to checkpoint it on open"
+		if recover {
+			hint = "checkpointing it"
+		}
+		log.Printf("zestor/sqlite: %s holds %d bytes not checkpointed, likely left by a process that was killed; %s", wal, info.Size(), hint)
+	}
+	return true, nil
+}
+
+// recoverWAL checkpoints the WAL checkWAL found, copying its commits into
+// the database file and truncating it. A checkpoint blocked by another
+// connection's read is logged and left to later ones.
+func recoverWAL(ctx context.Context, db *sql.DB, path string) error {
+	var busy, frames, done int
+	if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE);`).Scan(&busy, &frames, &done); err != nil {
+		return fmt.Errorf("sqlite: recover %s: checkpoint: %w", path, err)
+	}
+	if busy != 0 {
+		log.Printf("zestor/sqlite: recovery checkpoint of %s blocked by another connection, %d of %d frames copied", path, done, frames)
+		return nil
+	}
+	if frames > 0 {
+		log.Printf("zestor/sqlite: recovered %s: checkpointed %d WAL frames", path, frames)
+	}
+	return nil
+}
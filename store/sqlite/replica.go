@@ -0,0 +1,75 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// openReplicas opens a read-only pool on each of dsns (Options.ReadDSNs).
+// The files are not touched until the first read, so a replica that isn't
+// there yet only makes its reads fall back to the primary.
+func openReplicas(dsns []string) ([]*sql.DB, error) {
+	replicas := make([]*sql.DB, 0, len(dsns))
+	for _, dsn := range dsns {
+		db, err := sql.Open("sqlite", readOnlyDSN(dsn))
+		if err != nil {
+			closeAll(replicas)
+			return nil, err
+		}
+		replicas = append(replicas, db)
+	}
+	return replicas, nil
+}
+
+func closeAll(dbs []*sql.DB) {
+	for _, db := range dbs {
+		_ = db.Close()
+	}
+}
+
+// replica returns the pool the next read goes to: the replicas in turn, or
+// nil for the primary when there are none or s wrote within the DB's
+// read-your-writes window.
+func (s *sqLiteStore[T]) replica() *sql.DB {
+	replicas := s.h.replicas
+	if len(replicas) == 0 {
+		return nil
+	}
+	if ryw := s.h.readYourWrites; ryw > 0 {
+		if at := s.lastWrite.Load(); at != 0 && time.Since(time.Unix(0, at)) < ryw {
+			return nil
+		}
+	}
+	return replicas[s.h.nextReplica.Add(1)%uint64(len(replicas))]
+}
+
+// read runs fn on a querier bound to ctx: a replica's if there is one to
+// read from, and the primary's if not or if fn failed on the replica.
+func (s *sqLiteStore[T]) read(ctx context.Context, fn func(q querier) error) error {
+	if err := s.h.gate.enter(ctx); err != nil {
+		return err
+	}
+	defer s.h.gate.leave()
+	if r := s.replica(); r != nil {
+		err := fn(bindQuerier(ctx, r))
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return fn(s.reader(ctx))
+}
+
+// tracked makes tx record when it ends as the store's last write, for
+// Options.ReadYourWrites.
+func (s *sqLiteStore[T]) tracked(tx *writeTx) *writeTx {
+	if len(s.h.replicas) == 0 || s.h.readYourWrites <= 0 {
+		return tx
+	}
+	release := tx.release
+	tx.release = func() {
+		release()
+		s.lastWrite.Store(time.Now().UnixNano())
+	}
+	return tx
+}
@@ -0,0 +1,64 @@
+package sqlite
+
+import (
+	"bytes"
+	"log"
+)
+
+// only replaces the row if it still holds the bytes that were read
+const rewriteQuery = `UPDATE zestor_kv SET value=? WHERE kind=? AND key=? AND value=?;`
+
+type rowKey struct {
+	kind, key string
+}
+
+// rewrite is a pending re-encoding of a row read in a secondary format.
+type rewrite struct {
+	old, enc []byte
+}
+
+// decode unmarshals a stored value. With Options.LazyRewrite, a value that
+// only a secondary codec could decode is queued for rewriting in the
+// primary format; flushRewrites applies the queue.
+func (s *sqLiteStore[T]) decode(kind, key string, blob []byte, v *T) (err error) {
+	if s.fallback == nil {
+		return s.unmarshal(kind, key, blob, v)
+	}
+	defer recoverCodec("Unmarshal", &err)
+	c, err := s.fallback.UnmarshalMatchCtx(kind, key, blob, v)
+	if err != nil || c == s.fallback.Primary {
+		return err
+	}
+	enc, err := s.fallback.MarshalCtx(kind, key, *v)
+	if err != nil || bytes.Equal(enc, blob) {
+		// not fatal for the read; the row is retried on the next one
+		return nil
+	}
+	s.muRewrite.Lock()
+	s.rewrites[rowKey{kind, key}] = rewrite{old: blob, enc: enc}
+	s.muRewrite.Unlock()
+	return nil
+}
+
+// flushRewrites writes back the rows queued by decode. It runs after the
+// read that queued them has released its rows, so it never writes while
+// the same call holds a read cursor.
+func (s *sqLiteStore[T]) flushRewrites() {
+	if s.fallback == nil {
+		return
+	}
+	s.muRewrite.Lock()
+	if len(s.rewrites) == 0 {
+		s.muRewrite.Unlock()
+		return
+	}
+	pending := s.rewrites
+	s.rewrites = make(map[rowKey]rewrite)
+	s.muRewrite.Unlock()
+
+	for rk, rw := range pending {
+		if _, err := s.h.execOwn(s.h.q(rk.kind, rewriteQuery), rw.enc, rk.kind, rk.key, rw.old); err != nil {
+			log.Printf("zestor/sqlite: lazy rewrite of %s/%s: %v", rk.kind, rk.key, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// AutoVacuum is a PRAGMA auto_vacuum mode.
+type AutoVacuum string
+
+const (
+	AutoVacuumNone        AutoVacuum = "NONE"
+	AutoVacuumFull        AutoVacuum = "FULL"
+	AutoVacuumIncremental AutoVacuum = "INCREMENTAL"
+)
+
+// pragma value reported by PRAGMA auto_vacuum
+func (a AutoVacuum) code() (int, error) {
+	switch AutoVacuum(strings.ToUpper(string(a))) {
+	case AutoVacuumNone:
+		return 0, nil
+	case AutoVacuumFull:
+		return 1, nil
+	case AutoVacuumIncremental:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("sqlite: unknown Options.AutoVacuum %q", string(a))
+}
+
+// setup prepares a freshly opened database. Everything runs on one
+// connection because the storage pragmas only stick on the connection that
+// first writes the file.
+func setup(ctx context.Context, db *sql.DB, o Options) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// storage layout must be settled before anything (including the WAL
+	// switch) writes to the file
+	if err := applyStorage(ctx, conn, o); err != nil {
+		return err
+	}
+	if o.ReadOnly {
+		// nothing below may write; the file must already be set up, and
+		// not by a newer version
+		v, err := userVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return checkSchemaVersion(v)
+	}
+	if !o.DisableWAL {
+		if _, err := conn.ExecContext(ctx, `PRAGMA journal_mode=WAL;`); err != nil {
+			return fmt.Errorf("enable WAL: %w", err)
+		}
+	}
+
+	return migrate(ctx, conn)
+}
+
+// readOnlyDSN opens dsn with mode=ro, turning a plain path into a file: URI.
+func readOnlyDSN(dsn string) string {
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&mode=ro"
+	}
+	return dsn + "?mode=ro"
+}
+
+// applyStorage sets page size and auto-vacuum on a new database, or checks
+// that an existing one already uses them.
+func applyStorage(ctx context.Context, conn *sql.Conn, o Options) error {
+	if o.PageSize == 0 && o.AutoVacuum == "" {
+		return nil
+	}
+	if o.PageSize != 0 && (o.PageSize < 512 || o.PageSize > 65536 || o.PageSize&(o.PageSize-1) != 0) {
+		return fmt.Errorf("sqlite: Options.PageSize %d must be a power of two between 512 and 65536", o.PageSize)
+	}
+	var vacuum int
+	if o.AutoVacuum != "" {
+		var err error
+		if vacuum, err = o.AutoVacuum.code(); err != nil {
+			return err
+		}
+	}
+
+	var pages int
+	if err := conn.QueryRowContext(ctx, `PRAGMA page_count;`).Scan(&pages); err != nil {
+		return err
+	}
+	if pages == 0 {
+		// empty database: the settings take effect on the first write
+		if o.PageSize != 0 {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA page_size=%d;`, o.PageSize)); err != nil {
+				return fmt.Errorf("set page_size: %w", err)
+			}
+		}
+		if o.AutoVacuum != "" {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA auto_vacuum=%d;`, vacuum)); err != nil {
+				return fmt.Errorf("set auto_vacuum: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if o.PageSize != 0 {
+		var cur int
+		if err := conn.QueryRowContext(ctx, `PRAGMA page_size;`).Scan(&cur); err != nil {
+			return err
+		}
+		if cur != o.PageSize {
+			return fmt.Errorf("sqlite: database already exists with page_size %d, Options.PageSize is %d (page size can only be chosen at creation)", cur, o.PageSize)
+		}
+	}
+	if o.AutoVacuum != "" {
+		var cur int
+		if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum;`).Scan(&cur); err != nil {
+			return err
+		}
+		if cur != vacuum {
+			return fmt.Errorf("sqlite: database already exists with auto_vacuum %d, Options.AutoVacuum is %s (changing it requires a VACUUM)", cur, o.AutoVacuum)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// DefaultMaxSnapshotDuration bounds how long a snapshot may hold its read
+// transaction when Options.MaxSnapshotDuration is not set.
+const DefaultMaxSnapshotDuration = 30 * time.Second
+
+// snapshot is a read-only view backed by a read transaction.
+type snapshot[T any] struct {
+	s    *sqLiteStore[T]
+	kind string
+
+	mu       sync.Mutex
+	tx       *sql.Tx
+	err      error // set once the view is released or expired
+	released bool
+	timer    *time.Timer
+}
+
+// Snapshot holds a read transaction for the lifetime of the view. In WAL mode
+// this does not block writers, but it does stop checkpoints from reclaiming
+// the WAL past the snapshot, which is why views expire after
+// Options.MaxSnapshotDuration. Without WAL the view blocks writers.
+func (s *sqLiteStore[T]) Snapshot(kind string) (store.Reader[T], func(), error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	// a deferred transaction only pins its snapshot on the first read
+	var n int
+	if err := tx.QueryRow(countQuery, kind).Scan(&n); err != nil {
+		_ = tx.Rollback()
+		return nil, nil, err
+	}
+
+	v := &snapshot[T]{s: s, kind: kind, tx: tx}
+	v.mu.Lock()
+	v.timer = time.AfterFunc(s.h.maxSnapshot, func() { v.end(store.ErrSnapshotExpired) })
+	v.mu.Unlock()
+	runtime.SetFinalizer(v, func(v *snapshot[T]) {
+		if !v.released {
+			log.Printf("zestor/sqlite: snapshot of kind %q was never released", v.kind)
+			v.end(store.ErrClosed)
+		}
+	})
+	release := func() {
+		v.mu.Lock()
+		v.released = true
+		v.mu.Unlock()
+		v.end(store.ErrClosed)
+	}
+	return v, release, nil
+}
+
+// end rolls back the read transaction; later reads return err.
+func (v *snapshot[T]) end(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err != nil {
+		return
+	}
+	v.err = err
+	v.timer.Stop()
+	_ = v.tx.Rollback()
+}
+
+// begin locks the view for one read and checks it is still usable.
+func (v *snapshot[T]) begin(kind string) error {
+	v.mu.Lock()
+	if v.err != nil {
+		v.mu.Unlock()
+		return v.err
+	}
+	if kind != v.kind {
+		v.mu.Unlock()
+		return store.ErrOutsideSnapshot
+	}
+	return nil
+}
+
+func (v *snapshot[T]) Get(kind, key string) (T, bool, error) {
+	if err := v.begin(kind); err != nil {
+		var zero T
+		return zero, false, err
+	}
+	defer v.mu.Unlock()
+	return v.s.get(v.tx, kind, key)
+}
+
+func (v *snapshot[T]) List(kind string, filter ...store.FilterFunc[T]) (map[string]T, error) {
+	if err := v.begin(kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	return v.s.list(v.tx, kind, filter...)
+}
+
+func (v *snapshot[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	if err := v.begin(kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	return v.s.listPrefix(v.tx, kind, prefix)
+}
+
+func (v *snapshot[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	if err := v.begin(kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	return v.s.keySegments(v.tx, kind, separator, prefix)
+}
+
+func (v *snapshot[T]) Count(kind string) (int, error) {
+	if err := v.begin(kind); err != nil {
+		return 0, err
+	}
+	defer v.mu.Unlock()
+	return v.s.count(v.tx, kind)
+}
+
+func (v *snapshot[T]) Keys(kind string) ([]string, error) {
+	if err := v.begin(kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	return v.s.keys(v.tx, kind)
+}
+
+func (v *snapshot[T]) Values(kind string) ([]store.KeyValue[T], error) {
+	if err := v.begin(kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	return v.s.values(v.tx, kind)
+}
+
+func (v *snapshot[T]) SelectByLabel(kind string, selector map[string]string) ([]store.KeyValue[T], error) {
+	if err := v.begin(kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	return v.s.selectByLabel(v.tx, kind, selector)
+}
+
+// Kinds returns the snapshotted kind if it holds any key.
+func (v *snapshot[T]) Kinds() ([]string, error) {
+	n, err := v.Count(v.kind)
+	if err != nil || n == 0 {
+		return []string{}, err
+	}
+	return []string{v.kind}, nil
+}
+
+// GetAll returns only the snapshotted kind.
+func (v *snapshot[T]) GetAll() (map[string]map[string]T, error) {
+	if err := v.begin(v.kind); err != nil {
+		return nil, err
+	}
+	defer v.mu.Unlock()
+	m, err := v.s.list(v.tx, v.kind)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]map[string]T{v.kind: m}, nil
+}
@@ -6,10 +6,18 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"golang.org/x/time/rate"
 	_ "modernc.org/sqlite"
 
 	"github.com/zestor-dev/zestor/codec"
@@ -27,51 +35,417 @@ CREATE TABLE IF NOT EXISTS zestor_kv (
   PRIMARY KEY(kind, key)	
 );
 CREATE INDEX IF NOT EXISTS idx_kv_kind ON zestor_kv(kind);
-`
-
-	getQuery    = `SELECT value FROM zestor_kv WHERE kind=? AND key=?;`
-	listQuery   = `SELECT key, value FROM zestor_kv WHERE kind=?;`
-	countQuery  = `SELECT COUNT(*) FROM zestor_kv WHERE kind=?;`
-	keysQuery   = `SELECT key FROM zestor_kv WHERE kind=?;`
-	valuesQuery = `SELECT key, value FROM zestor_kv WHERE kind=?;`
-	setQuery    = `INSERT INTO zestor_kv(kind,key,value) VALUES(?,?,?) ON CONFLICT(kind,key) DO NOTHING;`
+CREATE INDEX IF NOT EXISTS idx_kv_updated ON zestor_kv(kind, updated_at);
+CREATE TABLE IF NOT EXISTS zestor_idempotency (
+  kind    TEXT    NOT NULL,
+  key     TEXT    NOT NULL,
+  id      TEXT    NOT NULL,
+  created INTEGER NOT NULL,
+  at      INTEGER NOT NULL,
+  version INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY(kind, key, id)
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_at ON zestor_idempotency(at);
+CREATE TABLE IF NOT EXISTS zestor_labels (
+  kind  TEXT NOT NULL,
+  key   TEXT NOT NULL,
+  label TEXT NOT NULL,
+  value TEXT NOT NULL,
+  PRIMARY KEY(kind, key, label)
+);
+CREATE INDEX IF NOT EXISTS idx_labels_selector ON zestor_labels(kind, label, value);
+` + trashSchema + recodeSchema
+
+	getQuery      = `SELECT value FROM zestor_kv WHERE kind=? AND key=?;`
+	listQuery     = `SELECT key, value FROM zestor_kv WHERE kind=?;`
+	countQuery    = `SELECT COUNT(*) FROM zestor_kv WHERE kind=?;`
+	keysQuery     = `SELECT key FROM zestor_kv WHERE kind=?;`
+	valuesQuery   = `SELECT key, value FROM zestor_kv WHERE kind=?;`
+	sampleQuery   = `SELECT key, value FROM zestor_kv WHERE kind=? ORDER BY RANDOM() LIMIT ?;`
+	rowsQuery     = `SELECT key, value, version FROM zestor_kv WHERE kind=?;`
+	replayQuery   = `SELECT key, value, version, updated_at FROM zestor_kv WHERE kind=?;`
+	versionsQuery = `SELECT key, version FROM zestor_kv WHERE kind=?;`
+	setQuery      = `INSERT INTO zestor_kv(kind,key,value) VALUES(?,?,?) ON CONFLICT(kind,key) DO NOTHING;`
+	updateQuery   = `
+UPDATE zestor_kv
+SET value=?, version=version+1, updated_at=STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')
+WHERE kind=? AND key=?;`
+	deleteQuery = `DELETE FROM zestor_kv WHERE kind=? AND key=?;`
+
+	listPrefixQuery = `SELECT key, value FROM zestor_kv WHERE kind=?1 AND substr(key, 1, ?2) = ?3;`
+	// ?1: first character after the prefix, ?2: separator
+	keySegmentsQuery = `
+SELECT DISTINCT
+  CASE WHEN instr(substr(key, ?1), ?2) > 0
+       THEN substr(key, ?1, instr(substr(key, ?1), ?2) - 1 + length(?2))
+       ELSE substr(key, ?1)
+  END AS seg
+FROM zestor_kv
+WHERE kind=?3 AND substr(key, 1, ?4) = ?5 AND length(key) > ?4
+ORDER BY seg;`
 )
 
 type Options struct {
 	// SQLite DSN.
 	// modernc: "file:zestor.db?cache=shared&_pragma=busy_timeout(5000)"
+	// A plain path such as "/var/lib/app/zestor.db" is taken as a file: URI.
+	// The file's directory is checked before opening, so a missing
+	// directory or file or a path that isn't writable fails with an error
+	// naming it.
 	DSN string
 
 	// Codec to use for marshaling/unmarshaling values.
 	Codec codec.Codec
 
-	// If > 0, PRAGMA busy_timeout (ms) will be set.
+	// If > 0, PRAGMA busy_timeout (ms) is set on every connection: a
+	// write waits this long for the write lock before failing with
+	// "database is locked". The writes of the DB queue for it in turn.
 	BusyTimeout time.Duration
 
 	// If true, WAL mode will be disabled.
 	DisableWAL bool
+
+	// If true, missing parent directories of the database file are created
+	// with DirMode (0 means DefaultDirMode). Otherwise New fails, naming the
+	// directory.
+	CreateDirs bool
+	DirMode    fs.FileMode
+
+	// If true, Open checkpoints a WAL it finds next to the database file,
+	// e.g. one left by a process that was killed, into the file and
+	// truncates it, and removes WAL and SHM files left without a database
+	// file. Otherwise these are only logged. Ignored with ReadOnly.
+	RecoverOnOpen bool
+
+	// If true, the database is opened with mode=ro: it must already exist,
+	// the schema and WAL setup are skipped, and writes return
+	// store.ErrReadOnly. LazyRewrite and StoreOptions.Defaults are ignored.
+	ReadOnly bool
+
+	// If > 0, reads fail with store.ErrTimeout when they take longer.
+	ReadTimeout time.Duration
+
+	// If > 0, each write transaction fails with store.ErrTimeout when it
+	// takes longer, including the time spent waiting for the write lock:
+	// the busy_timeout of a write is capped to what is left of it.
+	WriteTimeout time.Duration
+
+	// If > 0, write transactions through the DB are limited to this many
+	// per second, with bursts of up to WriteBurst (at least 1). A write
+	// over the limit fails with store.ErrRateLimited, or with
+	// WriteRateWait waits its turn, within WriteTimeout if set. A group
+	// commit batch counts as one transaction, as does a batch write.
+	// Reads, and the writes Open and LazyRewrite make, aren't limited.
+	WriteRateLimit rate.Limit
+	WriteBurst     int
+	WriteRateWait  bool
+
+	// If > 0, PRAGMA page_size is set when the database file is created.
+	// Must be a power of two between 512 and 65536. Opening an existing
+	// database with a different page size fails.
+	PageSize int
+
+	// If set, PRAGMA auto_vacuum is set when the database file is created.
+	// Opening an existing database with a different mode fails.
+	AutoVacuum AutoVacuum
+
+	// Snapshot views expire after this long (0 means DefaultMaxSnapshotDuration).
+	MaxSnapshotDuration time.Duration
+
+	// If true, each kind is stored in its own table ("zestor_kind_<kind>",
+	// created on first write) instead of the shared zestor_kv table. This
+	// keeps hot and cold kinds in separate B-trees and lets a kind be
+	// vacuumed or dropped on its own, at the cost of one table per kind and
+	// DDL at runtime. Labels and idempotency keys stay in shared tables.
+	TablePerKind bool
+
+	// WithinWrite, if set, is called inside the transaction of every write
+	// that changes a row, after the row is written and before the commit,
+	// with the event the write will publish. It can write to other tables
+	// through tx, e.g. a transactional outbox; returning an error rolls the
+	// write back and returns the error to the caller. Object holds the
+	// written value (the deleted one for deletes) as the writing store's T.
+	// It sees the writes of every store on the DB.
+	WithinWrite func(tx *sql.Tx, ev *store.Event[any]) error
+
+	// If set, Set and Delete are queued to a writer goroutine that applies
+	// them in batches, one transaction each, so many concurrent writes
+	// share one commit (and fsync). Each call still returns its own result
+	// once its batch commits. See GroupCommit.
+	GroupCommit GroupCommit
+
+	// DSNs of read-only replicas of the database, e.g. files kept up to
+	// date by Litestream or LiteFS. Reads are spread across them in turn,
+	// and a read that fails on a replica is retried on the primary. Writes,
+	// SetFn, snapshots, Watch and Dump always use the primary. Replicas lag
+	// behind it, so reads may not see the latest writes.
+	ReadDSNs []string
+
+	// If > 0 and ReadDSNs is set, a store's reads go to the primary for
+	// this long after each of its writes, so it reads its own writes.
+	ReadYourWrites time.Duration
+
+	// Values written with Streamer.SetReader larger than this many bytes are
+	// stored in chunks instead of the main table (0 means
+	// DefaultStreamThreshold).
+	StreamThreshold int64
+
+	// If > 1, List decodes and filters rows on this many goroutines while
+	// it scans them, for large kinds with a costly codec. Filters must then
+	// be safe for concurrent use.
+	DecodeParallelism int
+
+	// If true, Codec must be a *codec.Fallback, and rows that a read decodes
+	// with one of its Secondary codecs are rewritten in the Primary format
+	// once the read returns. The rewrite keeps version and updated_at and
+	// sends no event, and is skipped if the row changed meanwhile.
+	LazyRewrite bool
+
+	// How often ExternalChanges (ExternalWatcher) polls the database for
+	// writes made by other processes (0 means
+	// DefaultExternalPollInterval).
+	ExternalPollInterval time.Duration
 }
 
 type watcher[T any] struct {
+	s          *sqLiteStore[T] // store the watcher belongs to
 	ch         chan *store.Event[T]
 	eventTypes map[store.EventType]struct{}
+	// key allowlist (empty means all keys)
+	muKeys sync.RWMutex
+	keys   map[string]struct{}
+	// events published to the watcher, which run delivers
+	box *inbox
+
+	// consecutive dropped events, and the count that evicts (0 = never)
+	drops      atomic.Int64
+	evictAfter int
+	transition store.TransitionFunc[T]
+	// WithMinVersions, nil without
+	minVersions *store.VersionFilter
+	// WithSaturationAlert, nil without
+	saturation *store.SaturationMonitor
+
+	// counters of WatchHandle.Stats
+	delivered atomic.Int64
+	dropped   atomic.Int64
+	started   time.Time
+
+	// how many recorded events replay sends (0 means all), and the keys
+	// whose latest change it sent, which the initial replay skips
+	replayLast int
+	replayed   map[rowKey]struct{}
+}
+
+// wants reports whether ev passes the watcher's version, event type and
+// key filters.
+func (w *watcher[T]) wants(ev *rawEvent) bool {
+	et, key := ev.typ, ev.key
+	if w.minVersions.Stale(key, et, ev.version) {
+		return false
+	}
+	// check event type filter (nil means all events)
+	if w.eventTypes != nil {
+		if _, ok := w.eventTypes[et]; !ok {
+			return false
+		}
+	}
+	return w.hasKey(key)
+}
+
+// hasKey reports whether key passes the watcher's key allowlist.
+func (w *watcher[T]) hasKey(key string) bool {
+	w.muKeys.RLock()
+	defer w.muKeys.RUnlock()
+	if len(w.keys) == 0 {
+		return true
+	}
+	_, ok := w.keys[key]
+	return ok
+}
+
+// event returns ev as an event of the watcher's type. It reports false if
+// ev was published by a store of another type and doesn't decode.
+func (w *watcher[T]) event(ev *rawEvent) (*store.Event[T], bool) {
+	if e, ok := ev.event.(*store.Event[T]); ok {
+		return e, true
+	}
+	// published by a store of another type
+	var v T
+	if ev.data == nil {
+		// a chunked value (Streamer) or a delete that didn't read the
+		// value, sent with a zero Object
+		return &store.Event[T]{Kind: ev.kind, Name: ev.key, EventType: ev.typ, PrevOmitted: ev.typ == store.EventTypeDelete, At: ev.at, Seq: ev.seq, Version: ev.version, Silent: ev.silent}, true
+	}
+	if err := w.s.unmarshal(ev.kind, ev.key, ev.data, &v); err != nil {
+		return nil, false
+	}
+	return &store.Event[T]{Kind: ev.kind, Name: ev.key, EventType: ev.typ, Object: v, At: ev.at, Seq: ev.seq, Version: ev.version, Silent: ev.silent}, true
+}
+
+// passes reports whether e, the watcher's copy of ev, passes its transition
+// filter. The value an update replaced is only decoded here.
+func (w *watcher[T]) passes(ev *rawEvent, e *store.Event[T]) bool {
+	if w.transition == nil {
+		return true
+	}
+	var old, new T
+	switch e.EventType {
+	case store.EventTypeCreate:
+		new = e.Object
+	case store.EventTypeDelete:
+		old = e.Object
+	default:
+		if ev.prev != nil {
+			if err := w.s.unmarshal(ev.kind, ev.key, ev.prev, &old); err != nil {
+				return false
+			}
+		}
+		new = e.Object
+	}
+	return w.transition(old, new)
+}
+
+func (w *watcher[T]) post(evs []*rawEvent) {
+	w.box.post(evs)
+}
+
+// deliver sends ev to the watcher's channel, if it wants it, without
+// blocking. It reports false once the watcher has dropped evictAfter
+// events in a row and should be evicted. Only run calls it.
+func (w *watcher[T]) deliver(ev *rawEvent) bool {
+	if !w.wants(ev) {
+		return true
+	}
+	e, ok := w.event(ev)
+	if !ok || !w.passes(ev, e) {
+		return true
+	}
+	select {
+	case w.ch <- e:
+		w.drops.Store(0)
+		w.delivered.Add(1)
+		w.saturation.Observe(len(w.ch), cap(w.ch))
+		return true
+	default:
+		// drop if slow consumer
+		w.dropped.Add(1)
+		w.saturation.Observe(cap(w.ch), cap(w.ch))
+		return w.evictAfter <= 0 || w.drops.Add(1) < int64(w.evictAfter)
+	}
+}
+
+func (w *watcher[T]) stats() store.WatchStats {
+	return store.WatchStats{
+		Delivered: w.delivered.Load(),
+		Dropped:   w.dropped.Load(),
+		BufferLen: len(w.ch),
+		BufferCap: cap(w.ch),
+		Age:       time.Since(w.started),
+	}
+}
+
+// close stops the watcher once the events posted to it are delivered, and
+// run closes its channel then.
+func (w *watcher[T]) close() {
+	w.box.shut()
+}
+
+// replay sends the wanted events of evs, the last replayLast of them and
+// as many of the newest as fit in the watcher's buffer.
+func (w *watcher[T]) replay(evs []*rawEvent) {
+	var out []*store.Event[T]
+	latest := make(map[rowKey]uint64)
+	for _, ev := range evs {
+		latest[rowKey{ev.kind, ev.key}] = ev.seq
+		if !w.wants(ev) {
+			continue
+		}
+		if e, ok := w.event(ev); ok && w.passes(ev, e) {
+			c := *e
+			out = append(out, &c)
+		}
+	}
+	if w.replayLast > 0 && len(out) > w.replayLast {
+		out = out[len(out)-w.replayLast:]
+	}
+	if len(out) > cap(w.ch) {
+		out = out[len(out)-cap(w.ch):]
+	}
+	w.replayed = make(map[rowKey]struct{})
+	for _, e := range out {
+		k := rowKey{e.Kind, e.Name}
+		if latest[k] == e.Seq && e.EventType != store.EventTypeDelete {
+			w.replayed[k] = struct{}{}
+		}
+		w.ch <- e
+		w.delivered.Add(1)
+	}
+}
+
+// querier is implemented by *sql.DB and *sql.Tx, so read paths can run
+// against the pool or inside a snapshot transaction.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
 type sqLiteStore[T any] struct {
-	db    *sql.DB
+	h  *DB
+	db *sql.DB // h.db
+	// whether Close also closes h (stores made by New)
+	ownsDB bool
+
 	codec codec.Codec
 
-	// in-proc pubsub for Watch(kind)
-	muSubs sync.RWMutex
-	subs   map[string]map[*watcher[T]]struct{}
+	// kind -> validation / normalization function
+	validateFns  map[string]store.ValidateFunc[T]
+	normalizeFns map[string]store.NormalizeFunc[T]
+
+	// how long idempotency keys are remembered
+	idemWindow time.Duration
+
+	// SetAll chunking (StoreOptions.SetAllBatchSize / SetAllProgress)
+	setAllBatch    int
+	setAllProgress func(kind string, done, total int)
+
+	afterWrite func(ev *store.Event[T])
+	// StoreOptions.AllowedKinds; nil allows every kind
+	allowedKinds map[string]struct{}
+	// StoreOptions.MaxListResults and MaxGetAllResults; 0 means no limit
+	maxList, maxGetAll int
+	// StoreOptions.KeyGen
+	keyGen func() string
+	// StoreOptions.CompareFn; nil compares encodings
+	compareFn store.CompareFunc[T]
+	// StoreOptions.RejectZeroValues; nil accepts zero values
+	checkZero func(kind, key string, v T) error
+	// clock stamping events
+	now func() time.Time
+
+	// batches Set and Delete into shared transactions (Options.GroupCommit)
+	group *groupCommitter
+	// when the last write transaction of this store ended, in Unix
+	// nanoseconds (Options.ReadYourWrites)
+	lastWrite atomic.Int64
+
+	// lazy rewrite of rows decoded by a secondary codec (Options.LazyRewrite)
+	fallback  *codec.Fallback
+	muRewrite sync.Mutex
+	rewrites  map[rowKey]rewrite
 
 	// closed flag
 	mu     sync.RWMutex
 	closed bool
 }
 
-// New creates/opens the DB, applies the schema, and returns a Store[T].
-func New[T any](o Options) (store.Store[T], error) {
+// New creates/opens the DB, applies the schema (see Open), and returns a
+// Store[T]. An optional store.StoreOptions supplies the backend-agnostic
+// settings (per-kind validation and normalization, idempotency window);
+// passing more than one is an error. The store owns its database: closing
+// the store closes it. Use Open and NewWithDB to share one database
+// between typed stores.
+func New[T any](o Options, so ...store.StoreOptions[T]) (store.Store[T], error) {
 	if o.DSN == "" {
 		return nil, errors.New("sqlite: Options.DSN is required")
 	}
@@ -79,50 +453,222 @@ func New[T any](o Options) (store.Store[T], error) {
 		return nil, errors.New("sqlite: Options.Codec is required")
 	}
 
-	db, err := sql.Open("sqlite", o.DSN)
+	h, err := Open(o)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(h, o.Codec, so...)
 	if err != nil {
+		_ = h.Close()
 		return nil, err
 	}
+	s.ownsDB = true
+	return s, nil
+}
+
+// NewWithDB returns a Store[T] on a database opened with Open, encoding
+// values with c. Stores on one DB share its connection pool and Watch
+// events: a watcher of a kind sees the writes of every store on the DB,
+// decoded with its own store's codec. Closing the store leaves db open.
+// It takes at most one store.StoreOptions, as New does.
+func NewWithDB[T any](db *DB, c codec.Codec, so ...store.StoreOptions[T]) (store.Store[T], error) {
+	if db == nil {
+		return nil, errors.New("sqlite: DB is required")
+	}
+	if c == nil {
+		return nil, errors.New("sqlite: codec is required")
+	}
+	return newStore(db, c, so...)
+}
 
-	ctx := context.Background()
-	if !o.DisableWAL {
-		if _, err := db.ExecContext(ctx, `PRAGMA journal_mode=WAL;`); err != nil {
-			_ = db.Close()
-			return nil, fmt.Errorf("enable WAL: %w", err)
+func newStore[T any](h *DB, c codec.Codec, so ...store.StoreOptions[T]) (*sqLiteStore[T], error) {
+	if len(so) > 1 {
+		return nil, fmt.Errorf("sqlite: %d StoreOptions given, want at most one", len(so))
+	}
+	var fallback *codec.Fallback
+	if h.lazyRewrite {
+		fb, ok := c.(*codec.Fallback)
+		if !ok {
+			return nil, errors.New("sqlite: Options.LazyRewrite requires a *codec.Fallback Codec")
+		}
+		fallback = fb
+	}
+
+	s := &sqLiteStore[T]{
+		h:            h,
+		db:           h.db,
+		codec:        c,
+		validateFns:  make(map[string]store.ValidateFunc[T]),
+		normalizeFns: make(map[string]store.NormalizeFunc[T]),
+		idemWindow:   store.DefaultIdempotencyWindow,
+		fallback:     fallback,
+		rewrites:     make(map[rowKey]rewrite),
+		now:          time.Now,
+	}
+	if len(so) > 0 {
+		maps.Copy(s.validateFns, so[0].ValidateFns)
+		maps.Copy(s.normalizeFns, so[0].NormalizeFns)
+		if so[0].IdempotencyWindow > 0 {
+			s.idemWindow = so[0].IdempotencyWindow
+		}
+		s.setAllBatch = so[0].SetAllBatchSize
+		s.setAllProgress = so[0].SetAllProgress
+		s.afterWrite = so[0].AfterWrite
+		s.allowedKinds = store.KindSet(so[0].AllowedKinds)
+		s.maxList = so[0].MaxListResults
+		s.maxGetAll = so[0].MaxGetAllResults
+		s.keyGen = so[0].KeyGen
+		s.compareFn = so[0].CompareFn
+		s.checkZero = store.ZeroValueCheck(so[0])
+		if so[0].Now != nil {
+			s.now = so[0].Now
 		}
+		h.keepHistory(so[0].EventHistory)
+		if !h.readOnly {
+			for _, kind := range slices.Sorted(maps.Keys(so[0].Defaults)) {
+				if err := s.seed(kind, so[0].Defaults[kind]); err != nil {
+					return nil, fmt.Errorf("sqlite: seed defaults of %q: %w", kind, err)
+				}
+			}
+		}
+		if err := store.ValidateStored[T](s, so[0]); err != nil {
+			return nil, err
+		}
+	}
+	// last, as nothing stops the committer of a store that isn't returned
+	if h.groupCommit.enabled() && !h.readOnly {
+		s.startGroupCommit(h.groupCommit)
+	}
+	return s, nil
+}
+
+// seed creates the keys of values that kind doesn't hold yet, in one
+// transaction, and publishes their create events. Existing keys are left
+// alone.
+func (s *sqLiteStore[T]) seed(kind string, values map[string]T) (err error) {
+	if err := s.checkKind(kind); err != nil {
+		return err
 	}
-	if o.BusyTimeout > 0 {
-		ms := int(o.BusyTimeout / time.Millisecond)
-		if _, err := db.ExecContext(ctx, fmt.Sprintf(`PRAGMA busy_timeout=%d;`, ms)); err != nil {
-			_ = db.Close()
-			return nil, fmt.Errorf("set busy_timeout: %w", err)
+	keys := slices.Sorted(maps.Keys(values))
+	prepared := make(map[string]T, len(values))
+	encoded := make(map[string][]byte, len(values))
+	for _, k := range keys {
+		v, err := s.prepare(kind, k, values[k])
+		if err != nil {
+			return err
 		}
+		enc, err := s.marshal(kind, k, v)
+		if err != nil {
+			return err
+		}
+		prepared[k], encoded[k] = v, enc
+	}
+	if err := s.h.ensureTable(kind); err != nil {
+		return err
 	}
 
-	// apply schema
-	if _, err := db.ExecContext(ctx, kvSchema); err != nil {
-		_ = db.Close()
-		return nil, err
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
 	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
 
-	return &sqLiteStore[T]{
-		db:    db,
-		codec: o.Codec,
-		subs:  make(map[string]map[*watcher[T]]struct{}),
-	}, nil
+	var created []*store.Event[T]
+	for _, k := range keys {
+		// chunked values (Streamer) are not overwritten either
+		if chunked, err := s.chunked(tx, kind, k); err != nil || chunked {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		res, err := tx.Exec(s.h.q(kind, setQuery), kind, k, encoded[k])
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		// inserted rows start at version 1
+		ev := &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: prepared[k], Version: 1}
+		if err := s.withinWrite(tx.Tx, ev); err != nil {
+			return err
+		}
+		created = append(created, ev)
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	at := s.now()
+	for _, ev := range created {
+		ev.At = at
+	}
+	s.publishAll(kind, created, encoded, nil)
+	return nil
+}
+
+// prepare normalizes and validates a value before it is marshaled.
+// Normalizing first keeps the stored bytes canonical, so byte-level no-op
+// detection also catches writes that only differ before normalization.
+func (s *sqLiteStore[T]) prepare(kind, key string, value T) (T, error) {
+	if fn, ok := s.normalizeFns[kind]; ok {
+		nv, err := fn(value)
+		if err != nil {
+			return value, &store.NormalizeError{Kind: kind, Key: key, Err: err}
+		}
+		value = nv
+	}
+	if s.checkZero != nil {
+		if err := s.checkZero(kind, key, value); err != nil {
+			return value, err
+		}
+	}
+	if fn, ok := s.validateFns[kind]; ok {
+		if err := fn(value); err != nil {
+			return value, err
+		}
+	}
+	return value, nil
 }
 
 func (s *sqLiteStore[T]) Get(kind, key string) (T, bool, error) {
 	var zero T
+	if err := s.checkKind(kind); err != nil {
+		return zero, false, err
+	}
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
 		return zero, false, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var v T
+	var ok bool
+	err := s.read(ctx, func(q querier) (err error) {
+		v, ok, err = s.get(q, kind, key)
+		return err
+	})
+	return v, ok, timeoutErr(ctx, err)
+}
 
+func (s *sqLiteStore[T]) get(q querier, kind, key string) (T, bool, error) {
+	var zero T
+	if !s.h.hasTable(kind) {
+		return zero, false, nil
+	}
+	if _, ok := s.codec.(codec.BufferedCodec); ok {
+		return s.getRaw(q, kind, key)
+	}
 	var blob []byte
-	row := s.db.QueryRow(getQuery, kind, key)
+	row := q.QueryRow(s.h.q(kind, getQuery), kind, key)
 	if err := row.Scan(&blob); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return zero, false, nil
@@ -130,22 +676,100 @@ func (s *sqLiteStore[T]) Get(kind, key string) (T, bool, error) {
 		return zero, false, err
 	}
 	var v T
-	if err := s.codec.Unmarshal(blob, &v); err != nil {
+	if err := s.decode(kind, key, blob, &v); err != nil {
+		return zero, false, err
+	}
+	return v, true, nil
+}
+
+// getRaw is get decoding straight from the driver's memory instead of a
+// copy of the blob, for codecs whose Unmarshal doesn't keep the data
+// (codec.BufferedCodec).
+func (s *sqLiteStore[T]) getRaw(q querier, kind, key string) (T, bool, error) {
+	var zero T
+	rows, err := q.Query(s.h.q(kind, getQuery), kind, key)
+	if err != nil {
+		return zero, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return zero, false, rows.Err()
+	}
+	var blob sql.RawBytes
+	if err := rows.Scan(&blob); err != nil {
+		return zero, false, err
+	}
+	var v T
+	if err := s.decode(kind, key, blob, &v); err != nil {
 		return zero, false, err
 	}
 	return v, true, nil
 }
 
 func (s *sqLiteStore[T]) List(kind string, filter ...store.FilterFunc[T]) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var m map[string]T
+	err := s.read(ctx, func(q querier) (err error) {
+		if err := s.checkSize(q, kind); err != nil {
+			return err
+		}
+		m, err = s.list(q, kind, filter...)
+		return err
+	})
+	return m, timeoutErr(ctx, err)
+}
+
+func (s *sqLiteStore[T]) list(q querier, kind string, filter ...store.FilterFunc[T]) (map[string]T, error) {
+	if !s.h.hasTable(kind) {
+		return make(map[string]T), nil
+	}
+	rows, err := q.Query(s.h.q(kind, listQuery), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.listRows(rows, kind, filter)
+}
+
+func (s *sqLiteStore[T]) ListPrefix(kind, prefix string) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
 		return nil, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var m map[string]T
+	err := s.read(ctx, func(q querier) (err error) {
+		m, err = s.listPrefix(q, kind, prefix)
+		return err
+	})
+	return m, timeoutErr(ctx, err)
+}
 
+func (s *sqLiteStore[T]) listPrefix(q querier, kind, prefix string) (map[string]T, error) {
 	out := make(map[string]T, 64)
-	rows, err := s.db.Query(listQuery, kind)
+	if !s.h.hasTable(kind) {
+		return out, nil
+	}
+	// substr/length count characters, so compare against the prefix's rune count
+	rows, err := q.Query(s.h.q(kind, listPrefixQuery), kind, utf8.RuneCountInString(prefix), prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -158,64 +782,60 @@ func (s *sqLiteStore[T]) List(kind string, filter ...store.FilterFunc[T]) (map[s
 			return nil, err
 		}
 		var v T
-		if err := s.codec.Unmarshal(blob, &v); err != nil {
+		if err := s.decode(kind, k, blob, &v); err != nil {
 			return nil, err
 		}
-		include := true
-		for _, f := range filter {
-			if f != nil && !f(k, v) {
-				include = false
-				break
-			}
-		}
-		if include {
-			out[k] = v
-		}
+		out[k] = v
 	}
 	return out, rows.Err()
 }
 
-func (s *sqLiteStore[T]) Count(kind string) (int, error) {
-	s.mu.RLock()
-	if s.closed {
-		s.mu.RUnlock()
-		return 0, store.ErrClosed
-	}
-	s.mu.RUnlock()
-
-	var n int
-	if err := s.db.QueryRow(countQuery, kind).Scan(&n); err != nil {
-		return 0, err
+func (s *sqLiteStore[T]) KeySegments(kind, separator, prefix string) ([]string, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
 	}
-	return n, nil
-}
-
-func (s *sqLiteStore[T]) Keys(kind string) ([]string, error) {
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
 		return nil, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var segs []string
+	err := s.read(ctx, func(q querier) (err error) {
+		segs, err = s.keySegments(q, kind, separator, prefix)
+		return err
+	})
+	return segs, timeoutErr(ctx, err)
+}
 
-	rows, err := s.db.Query(keysQuery, kind)
+func (s *sqLiteStore[T]) keySegments(q querier, kind, separator, prefix string) ([]string, error) {
+	if separator == "" {
+		return nil, store.ErrSeparatorRequired
+	}
+	if !s.h.hasTable(kind) {
+		return []string{}, nil
+	}
+	n := utf8.RuneCountInString(prefix)
+	rows, err := q.Query(s.h.q(kind, keySegmentsQuery), n+1, separator, kind, n, prefix)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	keys := make([]string, 0, 64)
+	segments := make([]string, 0, 16)
 	for rows.Next() {
-		var k string
-		if err := rows.Scan(&k); err != nil {
+		var seg string
+		if err := rows.Scan(&seg); err != nil {
 			return nil, err
 		}
-		keys = append(keys, k)
+		segments = append(segments, seg)
 	}
-	return keys, rows.Err()
+	return segments, rows.Err()
 }
 
-func (s *sqLiteStore[T]) Values(kind string) ([]store.KeyValue[T], error) {
+func (s *sqLiteStore[T]) Kinds() ([]string, error) {
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
@@ -223,288 +843,1702 @@ func (s *sqLiteStore[T]) Values(kind string) ([]store.KeyValue[T], error) {
 	}
 	s.mu.RUnlock()
 
-	rows, err := s.db.Query(valuesQuery, kind)
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var kinds []string
+	err := s.read(ctx, func(q querier) (err error) {
+		kinds, err = s.kinds(q)
+		return err
+	})
+	return kinds, timeoutErr(ctx, err)
+}
+
+func (s *sqLiteStore[T]) kinds(q querier) ([]string, error) {
+	kinds := make([]string, 0, 16)
+	query := s.h.kindsQuery()
+	if query == "" {
+		return kinds, nil
+	}
+	rows, err := q.Query(query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	out := make([]store.KeyValue[T], 0, 64)
 	for rows.Next() {
 		var k string
-		var blob []byte
-		if err := rows.Scan(&k, &blob); err != nil {
-			return nil, err
-		}
-		var v T
-		if err := s.codec.Unmarshal(blob, &v); err != nil {
+		if err := rows.Scan(&k); err != nil {
 			return nil, err
 		}
-		out = append(out, store.KeyValue[T]{Key: k, Value: v})
+		kinds = append(kinds, k)
 	}
-	return out, rows.Err()
+	return kinds, rows.Err()
 }
 
-func (s *sqLiteStore[T]) Set(kind, key string, value T) (bool, error) {
+func (s *sqLiteStore[T]) Count(kind string) (int, error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
-		return false, store.ErrClosed
+		return 0, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var n int
+	err := s.read(ctx, func(q querier) (err error) {
+		n, err = s.count(q, kind)
+		return err
+	})
+	return n, timeoutErr(ctx, err)
+}
 
-	enc, err := s.codec.Marshal(value)
-	if err != nil {
-		return false, err
-	}
-
-	// to figure out if this was a create or update.
-	// try INSERT: if conflict -> UPDATE.
-	tx, err := s.db.Begin()
-	if err != nil {
-		return false, err
+// checkSize counts the rows of kind, before a List or Values decodes them,
+// when StoreOptions.MaxListResults is set.
+func (s *sqLiteStore[T]) checkSize(q querier, kind string) error {
+	if s.maxList <= 0 {
+		return nil
 	}
-	defer func() { _ = rollbackIfNeeded(tx, &err) }()
-
-	res, err := tx.Exec(setQuery, kind, key, enc)
+	n, err := s.count(q, kind)
 	if err != nil {
-		return false, err
-	}
-	createdRows, _ := res.RowsAffected()
-	created := createdRows > 0
-
-	if !created {
-		// update only if bytes changed then bump version if changed
-		var cur []byte
-		row := tx.QueryRow(getQuery, kind, key)
-		if err := row.Scan(&cur); err != nil {
-			return false, err
-		}
-		if bytes.Equal(cur, enc) {
-			// No-op
-			if err = tx.Commit(); err != nil {
-				return false, err
-			}
-			return false, nil
-		}
-		if _, err := tx.Exec(`
-UPDATE zestor_kv
-SET value=?, version=version+1, updated_at=STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')
-WHERE kind=? AND key=?;`, enc, kind, key); err != nil {
-			return false, err
-		}
+		return err
 	}
+	return store.CheckResultSize(n, s.maxList)
+}
 
-	if err = tx.Commit(); err != nil {
-		return false, err
+func (s *sqLiteStore[T]) count(q querier, kind string) (int, error) {
+	if !s.h.hasTable(kind) {
+		return 0, nil
 	}
-
-	etype := store.EventTypeUpdate
-	if created {
-		etype = store.EventTypeCreate
+	var n int
+	if err := q.QueryRow(s.h.q(kind, countQuery), kind).Scan(&n); err != nil {
+		return 0, err
 	}
-	s.publish(kind, &store.Event[T]{Kind: kind, Name: key, EventType: etype, Object: value})
-	return created, nil
+	return n, nil
 }
 
-func (s *sqLiteStore[T]) SetFn(kind, key string, fn func(v T) (T, error)) (bool, error) {
+func (s *sqLiteStore[T]) Keys(kind string) ([]string, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
-		return false, store.ErrClosed
+		return nil, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var keys []string
+	err := s.read(ctx, func(q querier) (err error) {
+		keys, err = s.keys(q, kind)
+		return err
+	})
+	return keys, timeoutErr(ctx, err)
+}
 
-	tx, err := s.db.Begin()
+func (s *sqLiteStore[T]) keys(q querier, kind string) ([]string, error) {
+	if !s.h.hasTable(kind) {
+		return []string{}, nil
+	}
+	rows, err := q.Query(s.h.q(kind, keysQuery), kind)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	defer func() { _ = rollbackIfNeeded(tx, &err) }()
+	defer rows.Close()
 
-	var cur T
-	var curBytes []byte
-	row := tx.QueryRow(getQuery, kind, key)
-	scanErr := row.Scan(&curBytes)
-	if errors.Is(scanErr, sql.ErrNoRows) {
-		_ = tx.Rollback()
-		return false, store.ErrKeyNotFound
+	keys := make([]string, 0, 64)
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Versions returns the version of every key of kind held in the main
+// table; like the typed reads, it leaves out chunked values (Streamer).
+func (s *sqLiteStore[T]) Versions(kind string) (map[string]int64, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	versions := make(map[string]int64)
+	if !s.h.hasTable(kind) {
+		return versions, nil
+	}
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	err := s.read(ctx, func(q querier) error {
+		rows, err := q.Query(s.h.q(kind, versionsQuery), kind)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		clear(versions) // read falls back from a replica
+		for rows.Next() {
+			var k string
+			var v int64
+			if err := rows.Scan(&k, &v); err != nil {
+				return err
+			}
+			versions[k] = v
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, timeoutErr(ctx, err)
+	}
+	return versions, nil
+}
+
+// existingKeysChunk is how many keys one ExistingKeys query binds, well
+// below SQLite's limit on the number of variables of a statement.
+const existingKeysChunk = 500
+
+// ExistingKeys queries the keys in chunks, reading no value. Like Keys, it
+// doesn't see chunked values (Streamer).
+func (s *sqLiteStore[T]) ExistingKeys(kind string, keys []string) (map[string]bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	exist := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		exist[k] = false
+	}
+	if len(keys) == 0 || !s.h.hasTable(kind) {
+		return exist, nil
+	}
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	err := s.read(ctx, func(q querier) error {
+		// read falls back from a replica
+		for _, k := range keys {
+			exist[k] = false
+		}
+		for chunk := range slices.Chunk(keys, existingKeysChunk) {
+			if err := s.existingKeys(q, kind, chunk, exist); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, timeoutErr(ctx, err)
+	}
+	return exist, nil
+}
+
+// existingKeys sets exist[k] for each of keys that kind holds.
+func (s *sqLiteStore[T]) existingKeys(q querier, kind string, keys []string, exist map[string]bool) error {
+	args := make([]any, 0, 1+len(keys))
+	args = append(args, kind)
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	query := fmt.Sprintf(`SELECT key FROM zestor_kv WHERE kind=? AND key IN (?%s);`, strings.Repeat(",?", len(keys)-1))
+	rows, err := q.Query(s.h.q(kind, query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return err
+		}
+		exist[k] = true
+	}
+	return rows.Err()
+}
+
+func (s *sqLiteStore[T]) Values(kind string) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var kvs []store.KeyValue[T]
+	err := s.read(ctx, func(q querier) (err error) {
+		if err := s.checkSize(q, kind); err != nil {
+			return err
+		}
+		kvs, err = s.values(q, kind)
+		return err
+	})
+	return kvs, timeoutErr(ctx, err)
+}
+
+// Sample picks the rows with ORDER BY RANDOM(), which scans the kind but
+// decodes only the rows returned.
+func (s *sqLiteStore[T]) Sample(kind string, n int) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if n <= 0 || !s.h.hasTable(kind) {
+		return []store.KeyValue[T]{}, nil
+	}
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var kvs []store.KeyValue[T]
+	err := s.read(ctx, func(q querier) error {
+		rows, err := q.Query(s.h.q(kind, sampleQuery), kind, n)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		kvs = make([]store.KeyValue[T], 0, min(n, 64))
+		for rows.Next() {
+			var k string
+			var blob []byte
+			if err := rows.Scan(&k, &blob); err != nil {
+				return err
+			}
+			var v T
+			if err := s.decode(kind, k, blob, &v); err != nil {
+				return err
+			}
+			kvs = append(kvs, store.KeyValue[T]{Key: k, Value: v})
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, timeoutErr(ctx, err)
+	}
+	return kvs, nil
+}
+
+func (s *sqLiteStore[T]) values(q querier, kind string) ([]store.KeyValue[T], error) {
+	if !s.h.hasTable(kind) {
+		return []store.KeyValue[T]{}, nil
+	}
+	rows, err := q.Query(s.h.q(kind, valuesQuery), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]store.KeyValue[T], 0, 64)
+	for rows.Next() {
+		var k string
+		var blob []byte
+		if err := rows.Scan(&k, &blob); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := s.decode(kind, k, blob, &v); err != nil {
+			return nil, err
+		}
+		out = append(out, store.KeyValue[T]{Key: k, Value: v})
+	}
+	return out, rows.Err()
+}
+
+// idemEvictBatch is how many expired idempotency keys a write evicts at
+// most, keeping the cost of a backlog off any one write.
+const idemEvictBatch = 100
+
+// seenWrite returns the recorded result of an earlier write carrying the same
+// idempotency key, evicting a batch of expired keys first. A key past the
+// window but not evicted yet doesn't count as seen.
+func (s *sqLiteStore[T]) seenWrite(tx *writeTx, kind, key, id string) (created, seen bool, err error) {
+	cutoff := s.now().Add(-s.idemWindow).UnixNano()
+	if _, err := tx.Exec(`
+DELETE FROM zestor_idempotency WHERE rowid IN
+  (SELECT rowid FROM zestor_idempotency WHERE at < ? ORDER BY at LIMIT ?);`, cutoff, idemEvictBatch); err != nil {
+		return false, false, err
+	}
+	err = tx.QueryRow(`SELECT created FROM zestor_idempotency WHERE kind=? AND key=? AND id=? AND at >= ?;`, kind, key, id, cutoff).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return created, true, nil
+}
+
+// recordWrite remembers the result of a write carrying an idempotency key,
+// with the version it left the key at.
+func (s *sqLiteStore[T]) recordWrite(tx *writeTx, kind, key, id string, created bool) error {
+	if id == "" {
+		return nil
+	}
+	version, err := s.versionOf(tx, kind, key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO zestor_idempotency(kind,key,id,created,at,version) VALUES(?,?,?,?,?,?);`,
+		kind, key, id, created, s.now().UnixNano(), version)
+	return err
+}
+
+func (s *sqLiteStore[T]) SelectByLabel(kind string, selector map[string]string) ([]store.KeyValue[T], error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	defer s.flushRewrites()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var kvs []store.KeyValue[T]
+	err := s.read(ctx, func(q querier) (err error) {
+		kvs, err = s.selectByLabel(q, kind, selector)
+		return err
+	})
+	return kvs, timeoutErr(ctx, err)
+}
+
+func (s *sqLiteStore[T]) selectByLabel(q querier, kind string, selector map[string]string) ([]store.KeyValue[T], error) {
+	// every selector pair must match one label row of the key
+	query := valuesQuery
+	args := []any{kind}
+	if len(selector) > 0 {
+		conds := make([]string, 0, len(selector))
+		for label, value := range selector {
+			conds = append(conds, `(l.label=? AND l.value=?)`)
+			args = append(args, label, value)
+		}
+		args = append(args, len(selector))
+		query = `
+SELECT kv.key, kv.value FROM zestor_kv kv
+WHERE kv.kind=? AND (
+  SELECT COUNT(*) FROM zestor_labels l
+  WHERE l.kind=kv.kind AND l.key=kv.key AND (` + strings.Join(conds, " OR ") + `)
+) = ?;`
+	}
+
+	if !s.h.hasTable(kind) {
+		return []store.KeyValue[T]{}, nil
+	}
+	rows, err := q.Query(s.h.q(kind, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]store.KeyValue[T], 0)
+	for rows.Next() {
+		var k string
+		var blob []byte
+		if err := rows.Scan(&k, &blob); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := s.decode(kind, k, blob, &v); err != nil {
+			return nil, err
+		}
+		out = append(out, store.KeyValue[T]{Key: k, Value: v})
+	}
+	return out, rows.Err()
+}
+
+func (s *sqLiteStore[T]) Set(kind, key string, value T, opts ...store.WriteOption) (bool, error) {
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	return s.set(kind, key, value, wc, nil)
+}
+
+func (s *sqLiteStore[T]) Add(kind string, value T) (string, error) {
+	return store.AddNew(s.keyGen, func(key string) error {
+		_, err := s.set(kind, key, value, &store.WriteCfg{CreateOnly: true}, nil)
+		return err
+	})
+}
+
+func (s *sqLiteStore[T]) SetLabeled(kind, key string, value T, labels map[string]string) (bool, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return s.set(kind, key, value, &store.WriteCfg{}, labels)
+}
+
+// replaceLabels swaps the labels of a key within the write transaction.
+func replaceLabels(tx *writeTx, kind, key string, labels map[string]string) error {
+	if _, err := tx.Exec(`DELETE FROM zestor_labels WHERE kind=? AND key=?;`, kind, key); err != nil {
+		return err
+	}
+	for label, value := range labels {
+		if _, err := tx.Exec(`INSERT INTO zestor_labels(kind,key,label,value) VALUES(?,?,?,?);`, kind, key, label, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set writes value and, if labels is non-nil, replaces the key's labels.
+func (s *sqLiteStore[T]) set(kind, key string, value T, wc *store.WriteCfg, labels map[string]string) (created bool, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return false, store.ErrReadOnly
+	}
+
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	value, err = s.prepare(kind, key, value)
+	if err != nil {
+		return false, err
+	}
+	enc, buf, err := s.encode(kind, key, value)
+	if err != nil {
+		return false, err
+	}
+	defer putBuf(buf)
+	if err := s.h.ensureTable(kind); err != nil {
+		return false, err
+	}
+
+	observed := s.observed(kind)
+	if s.group != nil {
+		err = s.group.do(func(tx *writeTx) (func(), error) {
+			var ev *store.Event[T]
+			var err error
+			var prev []byte
+			created, ev, prev, err = s.setTx(tx, kind, key, value, enc, wc, labels, observed)
+			return s.publishFn(kind, ev, enc, prev), err
+		})
+		return created, err
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	created, ev, prev, err := s.setTx(tx, kind, key, value, enc, wc, labels, observed)
+	if err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	if ev != nil {
+		ev.At = s.now()
+		s.publish(kind, ev, enc, prev)
+	}
+	return created, nil
+}
+
+// setTx applies set in tx, given value's encoding enc. It returns the event
+// to publish once tx commits, nil for no-ops, repeated idempotent writes
+// and unobserved kinds, and for updates the encoding it replaced.
+func (s *sqLiteStore[T]) setTx(tx *writeTx, kind, key string, value T, enc []byte, wc *store.WriteCfg, labels map[string]string, observed bool) (created bool, ev *store.Event[T], prev []byte, err error) {
+	if wc.IdempotencyKey != "" {
+		created, seen, err := s.seenWrite(tx, kind, key, wc.IdempotencyKey)
+		if err != nil || seen {
+			return created, nil, nil, err
+		}
+	}
+
+	// to figure out if this was a create or update.
+	// try INSERT: if conflict -> UPDATE.
+	res, err := tx.Exec(s.h.q(kind, setQuery), kind, key, enc)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	createdRows, _ := res.RowsAffected()
+	inserted := createdRows > 0
+	created = inserted
+	if inserted {
+		// the key may hold a chunked value (Streamer), which this replaces
+		chunked, _, err := s.dropChunks(tx, kind, key)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		created = !chunked
+	}
+	if wc.CreateOnly && !created {
+		// the caller rolls back the insert and the dropped chunks
+		return false, nil, nil, store.ErrKeyExists
+	}
+
+	if labels != nil {
+		if err = replaceLabels(tx, kind, key, labels); err != nil {
+			return false, nil, nil, err
+		}
+	}
+
+	if !inserted {
+		// update only if bytes changed then bump version if changed
+		row := tx.QueryRow(s.h.q(kind, getQuery), kind, key)
+		if err := row.Scan(&prev); err != nil {
+			return false, nil, nil, err
+		}
+		if s.unchanged(kind, key, prev, enc, value) {
+			// No-op
+			if err := s.keepVersion(tx, kind, key, prev, enc); err != nil {
+				return false, nil, nil, err
+			}
+			return false, nil, nil, s.recordWrite(tx, kind, key, wc.IdempotencyKey, false)
+		}
+		if _, err := tx.Exec(s.h.q(kind, updateQuery), enc, kind, key); err != nil {
+			return false, nil, nil, err
+		}
+	}
+
+	if observed {
+		etype := store.EventTypeUpdate
+		if created {
+			etype = store.EventTypeCreate
+		}
+		ev = &store.Event[T]{Kind: kind, Name: key, EventType: etype, Object: value, Silent: wc.Silent}
+		if ev.Version, err = s.versionOf(tx, kind, key); err != nil {
+			return false, nil, nil, err
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return false, nil, nil, err
+		}
+	}
+	if err = s.recordWrite(tx, kind, key, wc.IdempotencyKey, created); err != nil {
+		return false, nil, nil, err
+	}
+	return created, ev, prev, nil
+}
+
+// unchanged reports whether the stored bytes cur already hold v, whose
+// encoding is enc. Differing bytes only prove a change when the codec is
+// deterministic and there is no StoreOptions.CompareFn; otherwise the
+// stored value is decoded and compared, with the CompareFn if set.
+func (s *sqLiteStore[T]) unchanged(kind, key string, cur, enc []byte, v T) bool {
+	if bytes.Equal(cur, enc) {
+		return true
+	}
+	if s.bytesDecide() {
+		return false
+	}
+	var old T
+	if err := s.unmarshal(kind, key, cur, &old); err != nil {
+		return false
+	}
+	if s.compareFn != nil {
+		return s.compareFn(old, v)
+	}
+	return reflect.DeepEqual(old, v)
+}
+
+// bytesDecide reports whether unchanged goes by the bytes alone: without
+// a CompareFn, with a deterministic codec.
+func (s *sqLiteStore[T]) bytesDecide() bool {
+	if s.compareFn != nil {
+		return false
+	}
+	d, ok := s.codec.(codec.Deterministic)
+	return !ok || d.Deterministic()
+}
+
+// keepVersion stores enc over cur without bumping the version or
+// updated_at, for a value the CompareFn found unchanged, so reads return
+// what was written last as they do from gomap.
+func (s *sqLiteStore[T]) keepVersion(tx *writeTx, kind, key string, cur, enc []byte) error {
+	if s.compareFn == nil || bytes.Equal(cur, enc) {
+		return nil
+	}
+	_, err := tx.Exec(s.h.q(kind, rewriteQuery), enc, kind, key, cur)
+	return err
+}
+
+func (s *sqLiteStore[T]) SetFn(kind, key string, fn func(v T) (T, error), opts ...store.WriteOption) (created bool, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return false, store.ErrReadOnly
+	}
+
+	if !s.h.hasTable(kind) {
+		return false, store.ErrKeyNotFound
+	}
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var cur T
+	var curBytes []byte
+	row := tx.QueryRow(s.h.q(kind, getQuery), kind, key)
+	scanErr := row.Scan(&curBytes)
+	if errors.Is(scanErr, sql.ErrNoRows) {
+		_ = tx.Rollback()
+		return false, store.ErrKeyNotFound
 	}
 	if scanErr != nil {
 		return false, scanErr
 	}
-	if err2 := s.codec.Unmarshal(curBytes, &cur); err2 != nil {
-		return false, err2
+	if err2 := s.unmarshal(kind, key, curBytes, &cur); err2 != nil {
+		return false, err2
+	}
+
+	nv, err := fn(cur)
+	if err != nil {
+		return false, err
+	}
+	nv, err = s.prepare(kind, key, nv)
+	if err != nil {
+		return false, err
+	}
+	newBytes, buf, err := s.encode(kind, key, nv)
+	if err != nil {
+		return false, err
+	}
+	defer putBuf(buf)
+	if s.unchanged(kind, key, curBytes, newBytes, nv) {
+		// no change
+		if err = s.keepVersion(tx, kind, key, curBytes, newBytes); err != nil {
+			return false, err
+		}
+		if err = tx.Commit(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if _, err := tx.Exec(s.h.q(kind, updateQuery), newBytes, kind, key); err != nil {
+		return false, err
+	}
+	var ev *store.Event[T]
+	if observed {
+		ev = &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeUpdate, Object: nv, Silent: wc.Silent}
+		if ev.Version, err = s.versionOf(tx, kind, key); err != nil {
+			return false, err
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return false, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	if ev != nil {
+		ev.At = s.now()
+		s.publish(kind, ev, newBytes, curBytes)
+	}
+	return false, nil
+}
+
+func (s *sqLiteStore[T]) Swap(kind, keyA, keyB string) (err error) {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return store.ErrReadOnly
+	}
+
+	if !s.h.hasTable(kind) {
+		return store.ErrKeyNotFound
+	}
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	keys := [2]string{keyA, keyB}
+	var blobs [2][]byte
+	var vals [2]T
+	for i, key := range keys {
+		err = tx.QueryRow(s.h.q(kind, getQuery), kind, key).Scan(&blobs[i])
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+			_ = tx.Rollback()
+			return store.ErrKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err = s.unmarshal(kind, key, blobs[i], &vals[i]); err != nil {
+			return err
+		}
+	}
+	// each key gets the other's value; a codec that binds values to their
+	// key encodes them anew
+	var enc [2][]byte
+	for i, key := range keys {
+		other := 1 - i
+		enc[i] = blobs[other]
+		if _, ok := s.codec.(codec.ContextCodec); ok {
+			if enc[i], err = s.marshal(kind, key, vals[other]); err != nil {
+				return err
+			}
+		}
+	}
+	if keyA == keyB || s.unchanged(kind, keyA, blobs[0], enc[0], vals[1]) {
+		return tx.Commit()
+	}
+
+	var evs []*store.Event[T]
+	data := make(map[string][]byte, 2)
+	prev := make(map[string][]byte, 2)
+	for i, key := range keys {
+		if _, err = tx.Exec(s.h.q(kind, updateQuery), enc[i], kind, key); err != nil {
+			return err
+		}
+		data[key], prev[key] = enc[i], blobs[i]
+		if observed {
+			ev := &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeUpdate, Object: vals[1-i]}
+			if ev.Version, err = s.versionOf(tx, kind, key); err != nil {
+				return err
+			}
+			if err = s.withinWrite(tx.Tx, ev); err != nil {
+				return err
+			}
+			evs = append(evs, ev)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	at := s.now()
+	for _, ev := range evs {
+		ev.At = at
+	}
+	s.publishAll(kind, evs, data, prev)
+	return nil
+}
+
+func (s *sqLiteStore[T]) SetAll(kind string, values map[string]T, opts ...store.WriteOption) error {
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	return s.setAll(kind, keys, values, false, wc.Silent)
+}
+
+// SetAllOrdered splits the slice into SetAllBatchSize chunks in its order.
+func (s *sqLiteStore[T]) SetAllOrdered(kind string, values []store.KeyValue[T]) error {
+	keys, m := store.DedupeKeyValues(values)
+	return s.setAll(kind, keys, m, true, false)
+}
+
+// setAll sets values[k] for each of keys. If ordered, the keys are written
+// and published in their order; otherwise chunks take them sorted and
+// events list the created keys first. silent marks the events Silent.
+func (s *sqLiteStore[T]) setAll(kind string, keys []string, values map[string]T, ordered, silent bool) error {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return store.ErrReadOnly
+	}
+
+	prepared := make(map[string]T, len(values))
+	for k, v := range values {
+		pv, err := s.prepare(kind, k, v)
+		if err != nil {
+			return err
+		}
+		prepared[k] = pv
+	}
+	values = prepared
+
+	if err := s.h.ensureTable(kind); err != nil {
+		return err
+	}
+
+	batch := s.setAllBatch
+	if batch <= 0 || batch >= len(keys) {
+		// one transaction for everything
+		if err := s.setAllTx(kind, keys, values, ordered, silent); err != nil {
+			return err
+		}
+		if s.setAllProgress != nil {
+			s.setAllProgress(kind, len(keys), len(keys))
+		}
+		return nil
+	}
+
+	// one transaction per chunk keeps the write lock short and lets
+	// checkpoints run between chunks, so the WAL stays small
+	if !ordered {
+		sort.Strings(keys)
+	}
+	for start := 0; start < len(keys); start += batch {
+		end := min(start+batch, len(keys))
+		if err := s.setAllTx(kind, keys[start:end], values, ordered, silent); err != nil {
+			return err
+		}
+		if s.setAllProgress != nil {
+			s.setAllProgress(kind, end, len(keys))
+		}
+	}
+	return nil
+}
+
+// setAllTx writes values[k] for each of keys in one transaction, then
+// publishes their events.
+func (s *sqLiteStore[T]) setAllTx(kind string, keys []string, values map[string]T, ordered, silent bool) (err error) {
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	publish, err := s.setKeys(ctx, tx, kind, keys, values, ordered, silent)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	publish()
+	return nil
+}
+
+// SetMulti writes every kind in one transaction, regardless of
+// Options.SetAllBatchSize.
+func (s *sqLiteStore[T]) SetMulti(values []store.KindKeyValue[T]) (err error) {
+	kinds, keys, byKind := store.GroupKinds(values)
+	if err := s.checkKind(kinds...); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return store.ErrReadOnly
+	}
+	for _, kind := range kinds {
+		for k, v := range byKind[kind] {
+			pv, err := s.prepare(kind, k, v)
+			if err != nil {
+				return err
+			}
+			byKind[kind][k] = pv
+		}
+		if err := s.h.ensureTable(kind); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	publish := make([]func(), 0, len(kinds))
+	for _, kind := range kinds {
+		p, err := s.setKeys(ctx, tx, kind, keys[kind], byKind[kind], true, false)
+		if err != nil {
+			return err
+		}
+		publish = append(publish, p)
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, p := range publish {
+		p()
+	}
+	return nil
+}
+
+// setKeys writes values[k] for each of keys in tx and returns the func
+// publishing their events once tx commits: in the order of keys if
+// ordered, else creates first. An unchanged value (see unchanged) keeps
+// its version and publishes nothing. Without anyone observing kind, the
+// existing rows are only looked up where telling an unchanged value takes
+// decoding it.
+func (s *sqLiteStore[T]) setKeys(ctx context.Context, tx *writeTx, kind string, keys []string, values map[string]T, ordered, silent bool) (publish func(), err error) {
+	observed := s.observed(kind)
+	// encoded values are kept for publishing, and their buffers with them
+	var bufs []*[]byte
+	release := func() {
+		for _, buf := range bufs {
+			putBuf(buf)
+		}
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	var stmtGet *sql.Stmt
+	if observed || !s.bytesDecide() {
+		if stmtGet, err = tx.Prepare(s.h.q(kind, getQuery)); err != nil {
+			return nil, err
+		}
+		defer stmtGet.Close()
+	}
+
+	stmtIns, err := tx.Prepare(s.h.q(kind, `
+INSERT INTO zestor_kv(kind,key,value) VALUES(?,?,?)
+ON CONFLICT(kind,key) DO UPDATE SET
+  value      = excluded.value,
+  version    = CASE WHEN zestor_kv.value != excluded.value
+                    THEN zestor_kv.version + 1
+                    ELSE zestor_kv.version
+               END,
+  updated_at = CASE WHEN zestor_kv.value != excluded.value
+                    THEN STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')
+                    ELSE zestor_kv.updated_at
+               END;
+`))
+	if err != nil {
+		return nil, err
+	}
+	defer stmtIns.Close()
+
+	// Track creates vs updates
+	var evs, created, updated []*store.Event[T]
+	var encoded, replaced map[string][]byte
+	if observed {
+		created = make([]*store.Event[T], 0, len(keys))
+		updated = make([]*store.Event[T], 0, len(keys))
+		encoded = make(map[string][]byte, len(keys))
+		replaced = make(map[string][]byte)
+	}
+	for _, k := range keys {
+		var enc []byte
+		var buf *[]byte
+		enc, buf, err = s.encode(kind, k, values[k])
+		if err != nil {
+			return nil, err
+		}
+		var cur []byte
+		existed := false
+		if stmtGet != nil {
+			switch err = stmtGet.QueryRowContext(ctx, kind, k).Scan(&cur); {
+			case err == nil:
+				existed = true
+			case !errors.Is(err, sql.ErrNoRows):
+				putBuf(buf)
+				return nil, err
+			}
+			err = nil
+		}
+		if existed && s.unchanged(kind, k, cur, enc, values[k]) {
+			err = s.keepVersion(tx, kind, k, cur, enc)
+			putBuf(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !observed {
+			if _, _, err = s.dropChunks(tx, kind, k); err == nil {
+				_, err = stmtIns.ExecContext(ctx, kind, k, enc)
+			}
+			putBuf(buf)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if buf != nil {
+			bufs = append(bufs, buf)
+		}
+		ev := &store.Event[T]{Kind: kind, Name: k, Object: values[k], Silent: silent}
+		if existed {
+			ev.EventType = store.EventTypeUpdate
+			replaced[k] = cur
+		} else {
+			var chunked bool
+			if chunked, _, err = s.dropChunks(tx, kind, k); err != nil {
+				return nil, err
+			}
+			ev.EventType = store.EventTypeCreate
+			if chunked {
+				ev.EventType = store.EventTypeUpdate
+			}
+		}
+		switch {
+		case ordered:
+			evs = append(evs, ev)
+		case ev.EventType == store.EventTypeCreate:
+			created = append(created, ev)
+		default:
+			updated = append(updated, ev)
+		}
+		if _, err = stmtIns.ExecContext(ctx, kind, k, enc); err != nil {
+			return nil, err
+		}
+		if ev.Version, err = s.versionOf(tx, kind, k); err != nil {
+			return nil, err
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return nil, err
+		}
+		encoded[k] = enc
+	}
+
+	return func() {
+		// post-commit notifications with correct event types
+		at := s.now()
+		if !ordered {
+			evs = append(created, updated...)
+		}
+		for _, ev := range evs {
+			ev.At = at
+		}
+		s.publishAll(kind, evs, encoded, replaced)
+		release()
+	}, nil
+}
+
+// MergeAll runs in one transaction, regardless of Options.SetAllBatchSize.
+// A chunked value (Streamer) can't be decoded for resolve and is replaced
+// by the incoming value, as SetAll would.
+func (s *sqLiteStore[T]) MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) (err error) {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return store.ErrReadOnly
+	}
+	if err := s.h.ensureTable(kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(incoming))
+	for k := range incoming {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	nv, err := fn(cur)
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
 	if err != nil {
-		return false, err
+		return err
 	}
-	newBytes, err := s.codec.Marshal(nv)
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	stmtGet, err := tx.Prepare(s.h.q(kind, getQuery))
 	if err != nil {
-		return false, err
+		return err
 	}
-	if bytes.Equal(curBytes, newBytes) {
-		// no change
-		if err = tx.Commit(); err != nil {
-			return false, err
+	defer stmtGet.Close()
+
+	var created, updated []*store.Event[T]
+	encoded := make(map[string][]byte)
+	replaced := make(map[string][]byte)
+	for _, k := range keys {
+		v := incoming[k]
+		var cur []byte
+		existed := true
+		switch err = stmtGet.QueryRowContext(ctx, kind, k).Scan(&cur); {
+		case errors.Is(err, sql.ErrNoRows):
+			existed = false
+		case err != nil:
+			return err
+		}
+		if existed && resolve != nil {
+			var old T
+			if err = s.unmarshal(kind, k, cur, &old); err != nil {
+				return err
+			}
+			v = resolve(k, old, v)
+		}
+		if v, err = s.prepare(kind, k, v); err != nil {
+			return err
+		}
+		enc, err := s.marshal(kind, k, v)
+		if err != nil {
+			return err
 		}
-		return false, nil
-	}
 
-	if _, err := tx.Exec(`
-UPDATE zestor_kv
-SET value=?, version=version+1, updated_at=STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')
-WHERE kind=? AND key=?;`, newBytes, kind, key); err != nil {
-		return false, err
+		ev := &store.Event[T]{Kind: kind, Name: k, Object: v, EventType: store.EventTypeUpdate}
+		if existed {
+			if s.unchanged(kind, k, cur, enc, v) {
+				if err = s.keepVersion(tx, kind, k, cur, enc); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err = tx.Exec(s.h.q(kind, updateQuery), enc, kind, k); err != nil {
+				return err
+			}
+			replaced[k] = cur
+			updated = append(updated, ev)
+		} else {
+			chunked, _, err := s.dropChunks(tx, kind, k)
+			if err != nil {
+				return err
+			}
+			if _, err = tx.Exec(s.h.q(kind, setQuery), kind, k, enc); err != nil {
+				return err
+			}
+			if chunked {
+				updated = append(updated, ev)
+			} else {
+				ev.EventType = store.EventTypeCreate
+				created = append(created, ev)
+			}
+		}
+		if !observed {
+			continue
+		}
+		encoded[k] = enc
+		if ev.Version, err = s.versionOf(tx, kind, k); err != nil {
+			return err
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return err
+		}
 	}
-
 	if err = tx.Commit(); err != nil {
-		return false, err
+		return err
 	}
-
-	s.publish(kind, &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeUpdate, Object: nv})
-	return false, nil
+	if !observed {
+		return nil
+	}
+	at := s.now()
+	evs := append(created, updated...)
+	for _, ev := range evs {
+		ev.At = at
+	}
+	s.publishAll(kind, evs, encoded, replaced)
+	return nil
 }
 
-func (s *sqLiteStore[T]) SetAll(kind string, values map[string]T) error {
+// ReplaceAll reads every row of kind to classify the keys, in the write
+// transaction, or with DryRun in a read. Values stored in chunks
+// (Streamer) are left alone unless values sets their key.
+func (s *sqLiteStore[T]) ReplaceAll(kind string, values map[string]T, opts ...store.WriteOption) (rep store.ReplaceReport, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return rep, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
-		return store.ErrClosed
+		return rep, store.ErrClosed
 	}
 	s.mu.RUnlock()
-
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
+	if s.h.readOnly && !wc.DryRun {
+		return rep, store.ErrReadOnly
 	}
-	defer func() { _ = rollbackIfNeeded(tx, &err) }()
-
-	// check which keys already exist
-	existingKeys := make(map[string]struct{})
-	rows, err := tx.Query(`SELECT key FROM zestor_kv WHERE kind=?;`, kind)
-	if err != nil {
-		return err
+	keys := make([]string, 0, len(values))
+	final := make(map[string]T, len(values))
+	for k, v := range values {
+		pv, err := s.prepare(kind, k, v)
+		if err != nil {
+			return rep, err
+		}
+		keys = append(keys, k)
+		final[k] = pv
 	}
-	for rows.Next() {
-		var k string
-		if err := rows.Scan(&k); err != nil {
-			rows.Close()
+	sort.Strings(keys)
+
+	if wc.DryRun {
+		ctx, cancel := opCtx(s.h.readTimeout)
+		defer cancel()
+		var p *replacePlan
+		err := s.read(ctx, func(q querier) (err error) {
+			p, err = s.planReplace(q, kind, keys, final)
 			return err
+		})
+		if err != nil {
+			return rep, timeoutErr(ctx, err)
 		}
-		existingKeys[k] = struct{}{}
+		return p.report, nil
 	}
-	rows.Close()
 
-	stmtIns, err := tx.Prepare(`
-INSERT INTO zestor_kv(kind,key,value) VALUES(?,?,?)
-ON CONFLICT(kind,key) DO UPDATE SET
-  value      = excluded.value,
-  version    = CASE WHEN zestor_kv.value != excluded.value
-                    THEN zestor_kv.version + 1
-                    ELSE zestor_kv.version
-               END,
-  updated_at = CASE WHEN zestor_kv.value != excluded.value
-                    THEN STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')
-                    ELSE zestor_kv.updated_at
-               END;
-`)
+	if err := s.h.ensureTable(kind); err != nil {
+		return rep, err
+	}
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
 	if err != nil {
-		return err
+		return rep, err
 	}
-	defer stmtIns.Close()
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
 
-	// Track creates vs updates
-	created := make(map[string]T)
-	updated := make(map[string]T)
-	for k, v := range values {
-		enc, err := s.codec.Marshal(v)
+	p, err := s.planReplace(tx, kind, keys, final)
+	if err != nil {
+		return rep, err
+	}
+	var created, updated, deleted []*store.Event[T]
+	data := make(map[string][]byte)
+	replaced := make(map[string][]byte)
+	var recreated []string
+	for _, k := range p.report.Created {
+		chunked, _, err := s.dropChunks(tx, kind, k)
 		if err != nil {
-			return err
+			return rep, err
 		}
-		if _, err := stmtIns.Exec(kind, k, enc); err != nil {
-			return err
+		if _, err = tx.Exec(s.h.q(kind, setQuery), kind, k, p.enc[k]); err != nil {
+			return rep, err
 		}
-		if _, existed := existingKeys[k]; existed {
-			updated[k] = v
+		ev := &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: final[k], Silent: wc.Silent}
+		if chunked {
+			// the key held a chunked value, which this replaced
+			ev.EventType = store.EventTypeUpdate
+			recreated = append(recreated, k)
+			updated = append(updated, ev)
 		} else {
-			created[k] = v
+			created = append(created, ev)
+		}
+	}
+	for _, k := range p.report.Unchanged {
+		if err = s.keepVersion(tx, kind, k, p.cur[k], p.enc[k]); err != nil {
+			return rep, err
+		}
+	}
+	for _, k := range p.report.Updated {
+		if _, err = tx.Exec(s.h.q(kind, updateQuery), p.enc[k], kind, k); err != nil {
+			return rep, err
+		}
+		replaced[k] = p.cur[k]
+		updated = append(updated, &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeUpdate, Object: final[k], Silent: wc.Silent})
+	}
+	if observed {
+		for _, ev := range append(created, updated...) {
+			data[ev.Name] = p.enc[ev.Name]
+			if ev.Version, err = s.versionOf(tx, kind, ev.Name); err != nil {
+				return rep, err
+			}
+			if err = s.withinWrite(tx.Tx, ev); err != nil {
+				return rep, err
+			}
+		}
+	}
+	for _, k := range p.report.Deleted {
+		if observed {
+			ev := &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeDelete, Version: p.version[k], Silent: wc.Silent}
+			if s.unmarshal(kind, k, p.cur[k], &ev.Object) == nil {
+				data[k] = p.cur[k]
+			} else {
+				ev.PrevOmitted = true
+			}
+			if err = s.withinWrite(tx.Tx, ev); err != nil {
+				return rep, err
+			}
+			deleted = append(deleted, ev)
+		}
+		if _, err = tx.Exec(`DELETE FROM zestor_labels WHERE kind=? AND key=?;`, kind, k); err != nil {
+			return rep, err
+		}
+		if _, err = tx.Exec(s.h.q(kind, deleteQuery), kind, k); err != nil {
+			return rep, err
 		}
 	}
-
 	if err = tx.Commit(); err != nil {
-		return err
+		return rep, err
+	}
+	rep = p.report
+	if len(recreated) > 0 {
+		rep.Created = slices.DeleteFunc(rep.Created, func(k string) bool { return slices.Contains(recreated, k) })
+		rep.Updated = append(rep.Updated, recreated...)
+		sort.Strings(rep.Updated)
 	}
+	if !observed {
+		return rep, nil
+	}
+	// the recreated keys go with the updates, in key order
+	sort.Slice(updated, func(i, j int) bool { return updated[i].Name < updated[j].Name })
+	at := s.now()
+	evs := append(append(created, updated...), deleted...)
+	for _, ev := range evs {
+		ev.At = at
+	}
+	if len(evs) > 0 {
+		s.publishAll(kind, evs, data, replaced)
+	}
+	return rep, nil
+}
 
-	// post-commit notifications with correct event types
-	for k, v := range created {
-		s.publish(kind, &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: v})
+// replacePlan is what ReplaceAll writes: its report, the encodings of the
+// values it sets, and the stored encodings of the keys it updates, keeps
+// and deletes, with the versions of the deleted ones.
+type replacePlan struct {
+	report  store.ReplaceReport
+	enc     map[string][]byte
+	cur     map[string][]byte
+	version map[string]int64
+}
+
+// planReplace classifies keys, sorted, against the rows of kind.
+func (s *sqLiteStore[T]) planReplace(q querier, kind string, keys []string, values map[string]T) (*replacePlan, error) {
+	p := &replacePlan{
+		enc:     make(map[string][]byte, len(keys)),
+		cur:     make(map[string][]byte),
+		version: make(map[string]int64),
+	}
+	stored := make(map[string][]byte)
+	versions := make(map[string]int64)
+	if s.h.hasTable(kind) {
+		rows, err := q.Query(s.h.q(kind, rowsQuery), kind)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var k string
+			var blob []byte
+			var version int64
+			if err := rows.Scan(&k, &blob, &version); err != nil {
+				return nil, err
+			}
+			stored[k], versions[k] = blob, version
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range keys {
+		enc, err := s.marshal(kind, k, values[k])
+		if err != nil {
+			return nil, err
+		}
+		p.enc[k] = enc
+		cur, existed := stored[k]
+		switch {
+		case !existed:
+			p.report.Created = append(p.report.Created, k)
+			continue
+		case s.unchanged(kind, k, cur, enc, values[k]):
+			p.report.Unchanged = append(p.report.Unchanged, k)
+		default:
+			p.report.Updated = append(p.report.Updated, k)
+		}
+		p.cur[k] = cur
+		delete(stored, k)
 	}
-	for k, v := range updated {
-		s.publish(kind, &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeUpdate, Object: v})
+	for k, cur := range stored {
+		p.report.Deleted = append(p.report.Deleted, k)
+		p.cur[k], p.version[k] = cur, versions[k]
 	}
-	return nil
+	sort.Strings(p.report.Deleted)
+	return p, nil
 }
 
-func (s *sqLiteStore[T]) Delete(kind, key string) (bool, T, error) {
+func (s *sqLiteStore[T]) Delete(kind, key string, opts ...store.WriteOption) (existed bool, prev T, err error) {
 	var zero T
+	if err := s.checkKind(kind); err != nil {
+		return false, zero, err
+	}
+	wc := &store.WriteCfg{}
+	for _, o := range opts {
+		o(wc)
+	}
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
 		return false, zero, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	if s.h.readOnly {
+		return false, zero, store.ErrReadOnly
+	}
+
+	if !s.h.hasTable(kind) {
+		return false, zero, nil
+	}
+	observed := s.observed(kind)
+	var prevErr error
+	if s.group != nil {
+		err = s.group.do(func(tx *writeTx) (func(), error) {
+			var prevBytes []byte
+			var ev *store.Event[T]
+			var err error
+			existed, prev, prevBytes, ev, prevErr, err = s.deleteTx(tx, kind, key, observed, wc)
+			return s.publishFn(kind, ev, prevBytes, nil), err
+		})
+		if err != nil {
+			return false, zero, err
+		}
+		return existed, prev, prevErr
+	}
+
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
 
-	tx, err := s.db.Begin()
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return false, zero, err
 	}
-	defer func() { _ = rollbackIfNeeded(tx, &err) }()
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
 
-	var prevBytes []byte
-	row := tx.QueryRow(`SELECT value FROM zestor_kv WHERE kind=? AND key=?;`, kind, key)
-	if err := row.Scan(&prevBytes); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			_ = tx.Rollback()
-			return false, zero, nil
-		}
-		return false, zero, err
-	}
-	var prev T
-	if err := s.codec.Unmarshal(prevBytes, &prev); err != nil {
+	existed, prev, prevBytes, ev, prevErr, err := s.deleteTx(tx, kind, key, observed, wc)
+	if err != nil {
 		return false, zero, err
 	}
-
-	if _, err := tx.Exec(`DELETE FROM zestor_kv WHERE kind=? AND key=?;`, kind, key); err != nil {
-		return false, zero, err
+	if !existed {
+		_ = tx.Rollback()
+		return false, zero, nil
 	}
 	if err = tx.Commit(); err != nil {
 		return false, zero, err
 	}
-
-	s.publish(kind, &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeDelete, Object: prev})
-	return true, prev, nil
+	if ev != nil {
+		ev.At = s.now()
+		s.publish(kind, ev, prevBytes, nil)
+	}
+	return true, prev, prevErr
 }
 
-func (s *sqLiteStore[T]) Watch(kind string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
-	if kind == "" {
-		return nil, nil, store.ErrKindRequired
+// deleteTx applies Delete in tx. It returns the deleted value and its
+// encoding, and the event to publish once tx commits (nil for unobserved
+// kinds). With WithoutPrev, or when the value fails to decode, prev and
+// prevBytes are zero; prevErr is the decode error, which doesn't stop the
+// delete.
+func (s *sqLiteStore[T]) deleteTx(tx *writeTx, kind, key string, observed bool, wc *store.WriteCfg) (existed bool, prev T, prevBytes []byte, ev *store.Event[T], prevErr, err error) {
+	var zero T
+	var version int64
+	if observed {
+		switch err := tx.QueryRow(s.h.q(kind, getVersionQuery), kind, key).Scan(&version); {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return false, zero, nil, nil, nil, err
+		}
+	}
+	if wc.WithoutPrev {
+		res, err := tx.Exec(s.h.q(kind, deleteQuery), kind, key)
+		if err != nil {
+			return false, zero, nil, nil, nil, err
+		}
+		n, _ := res.RowsAffected()
+		existed = n > 0
+	} else {
+		switch err := tx.QueryRow(s.h.q(kind, getQuery), kind, key).Scan(&prevBytes); {
+		case err == nil:
+			existed = true
+			if prevErr = s.unmarshal(kind, key, prevBytes, &prev); prevErr != nil {
+				prev, prevBytes = zero, nil
+				prevErr = fmt.Errorf("sqlite: deleted %s/%s, its value failed to decode: %w", kind, key, prevErr)
+			}
+			if _, err := tx.Exec(s.h.q(kind, deleteQuery), kind, key); err != nil {
+				return false, zero, nil, nil, nil, err
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return false, zero, nil, nil, nil, err
+		}
+	}
+	if existed {
+		if _, err := tx.Exec(`DELETE FROM zestor_labels WHERE kind=? AND key=?;`, kind, key); err != nil {
+			return false, zero, nil, nil, nil, err
+		}
+	} else {
+		// a chunked value (Streamer) is deleted with a zero prev
+		chunked, blobVersion, err := s.dropChunks(tx, kind, key)
+		if err != nil || !chunked {
+			return false, zero, nil, nil, nil, err
+		}
+		existed, version = true, blobVersion
+	}
+	if observed {
+		ev = &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeDelete, Object: prev, PrevOmitted: prevBytes == nil, Version: version, Silent: wc.Silent}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return false, zero, nil, nil, nil, err
+		}
 	}
+	return true, prev, prevBytes, ev, prevErr, nil
+}
 
+// replay returns a create event for every key of kind, stamped with the
+// time the key was last modified.
+func (s *sqLiteStore[T]) replay(kind string) ([]*store.Event[T], error) {
 	s.mu.RLock()
 	if s.closed {
 		s.mu.RUnlock()
-		return nil, nil, store.ErrClosed
+		return nil, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	defer s.flushRewrites()
+
+	if !s.h.hasTable(kind) {
+		return nil, nil
+	}
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, s.h.q(kind, replayQuery), kind)
+	if err != nil {
+		return nil, timeoutErr(ctx, err)
+	}
+	defer rows.Close()
+
+	var evs []*store.Event[T]
+	for rows.Next() {
+		var k, updated string
+		var blob []byte
+		var version int64
+		if err := rows.Scan(&k, &blob, &version, &updated); err != nil {
+			return nil, err
+		}
+		var v T
+		if err := s.decode(kind, k, blob, &v); err != nil {
+			return nil, err
+		}
+		at, err := time.Parse(time.RFC3339Nano, updated)
+		if err != nil {
+			return nil, fmt.Errorf("sqlite: updated_at of %s/%s: %w", kind, k, err)
+		}
+		evs = append(evs, &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: v, At: at, Version: version})
+	}
+	return evs, timeoutErr(ctx, rows.Err())
+}
+
+func (s *sqLiteStore[T]) Watch(kind string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	h, err := s.WatchH(kind, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.C, h.Cancel, nil
+}
+
+func (s *sqLiteStore[T]) WatchH(kind string, opts ...store.WatchOption[T]) (*store.WatchHandle[T], error) {
+	return s.watch([]string{kind}, false, opts...)
+}
+
+func (s *sqLiteStore[T]) WatchKinds(kinds []string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	if len(kinds) == 0 {
+		return nil, nil, store.ErrNoKinds
+	}
+	h, err := s.watch(kinds, false, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.C, h.Cancel, nil
+}
 
+func (s *sqLiteStore[T]) WatchAll(opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	h, err := s.watch(nil, true, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.C, h.Cancel, nil
+}
+
+// watch subscribes one watcher to each of kinds, or, with all, to every
+// kind.
+func (s *sqLiteStore[T]) watch(kinds []string, all bool, opts ...store.WatchOption[T]) (*store.WatchHandle[T], error) {
+	if err := s.checkKind(kinds...); err != nil {
+		return nil, err
+	}
 	cfg := &store.WatchCfg[T]{}
 	for _, o := range opts {
 		if o != nil {
 			o(cfg)
 		}
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckFeatures("sqlite", s.watchFeatures()); err != nil {
+		return nil, err
+	}
 
 	bufSize := cfg.BufferSize
 	if bufSize <= 0 {
@@ -512,71 +2546,163 @@ func (s *sqLiteStore[T]) Watch(kind string, opts ...store.WatchOption[T]) (<-cha
 	}
 
 	w := &watcher[T]{
-		ch:         make(chan *store.Event[T], bufSize),
-		eventTypes: cfg.EventTypes,
+		s:           s,
+		ch:          make(chan *store.Event[T], bufSize),
+		eventTypes:  cfg.EventTypes,
+		keys:        make(map[string]struct{}, len(cfg.Keys)),
+		evictAfter:  cfg.EvictAfterDrops,
+		transition:  cfg.Transition,
+		replayLast:  cfg.ReplayLast,
+		minVersions: store.NewVersionFilter(cfg.MinVersions),
+		started:     time.Now(),
+		box:         newInbox(),
+	}
+	maps.Copy(w.keys, cfg.Keys)
+
+	kinds = uniqueKinds(kinds)
+	if all {
+		w.saturation = store.NewSaturationMonitor(cfg.Saturation, nil, w.stats)
+	} else {
+		w.saturation = store.NewSaturationMonitor(cfg.Saturation, kinds, w.stats)
+	}
+	// registered under the read lock, so that Close, which sets closed
+	// under the write lock, either finds w to close or makes Watch fail
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
 	}
-
-	s.muSubs.Lock()
-	if s.subs[kind] == nil {
-		s.subs[kind] = make(map[*watcher[T]]struct{})
+	var err error
+	if all {
+		err = s.h.subscribeAll(w, cfg.History)
+	} else {
+		err = s.h.subscribe(w, cfg.History, kinds...)
 	}
-	s.subs[kind][w] = struct{}{}
-	s.muSubs.Unlock()
-
-	// initial replay (nil eventTypes means all events)
-	sendInitial := cfg.EventTypes == nil
-	if !sendInitial && cfg.EventTypes != nil {
-		_, sendInitial = cfg.EventTypes[store.EventTypeCreate]
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
 	}
-	if cfg.Initial && sendInitial {
+	go w.run()
+
+	// initial replay
+	if cfg.Initial {
 		go func() {
-			m, err := s.List(kind)
-			if err != nil {
-				// TODO: channel is already returned
-				return
-			}
-			for k, v := range m {
-				select {
-				case w.ch <- &store.Event[T]{Kind: kind, Name: k, EventType: store.EventTypeCreate, Object: v}:
-				default:
-					// buffer full, skip
+			if all {
+				// the kinds existing now; later ones are seen live
+				var err error
+				if kinds, err = s.Kinds(); err != nil {
+					return
+				}
+			}
+			for _, kind := range kinds {
+				evs, err := s.replay(kind)
+				if err != nil {
+					// TODO: channel is already returned
+					return
+				}
+				s.h.muSubs.RLock()
+				if !s.h.subscribed(w, kind) {
+					// cancelled meanwhile, w.ch is closing
+					s.h.muSubs.RUnlock()
+					return
 				}
+				for _, ev := range evs {
+					if !w.hasKey(ev.Name) {
+						continue
+					}
+					if _, ok := w.replayed[rowKey{kind, ev.Name}]; ok {
+						continue
+					}
+					if w.minVersions.Stale(ev.Name, ev.EventType, ev.Version) {
+						continue
+					}
+					if w.transition != nil {
+						var zero T
+						if !w.transition(zero, ev.Object) {
+							continue
+						}
+					}
+					select {
+					case w.ch <- ev:
+						w.delivered.Add(1)
+					default:
+						// buffer full, skip
+						w.dropped.Add(1)
+					}
+				}
+				s.h.muSubs.RUnlock()
 			}
 		}()
 	}
 
 	cancel := func() {
-		s.muSubs.Lock()
-		defer s.muSubs.Unlock()
-		if subs, ok := s.subs[kind]; ok {
-			if _, exists := subs[w]; exists {
-				delete(subs, w)
-				if len(subs) == 0 {
-					delete(s.subs, kind)
-				}
-				close(w.ch)
-			}
+		s.h.muSubs.Lock()
+		defer s.h.muSubs.Unlock()
+		if s.h.unsubscribe(w) {
+			w.close()
 		}
 	}
-	return w.ch, cancel, nil
+	return &store.WatchHandle[T]{
+		C:      w.ch,
+		Cancel: cancel,
+		AddKey: func(key string) {
+			w.muKeys.Lock()
+			defer w.muKeys.Unlock()
+			w.keys[key] = struct{}{}
+		},
+		RemoveKey: func(key string) {
+			w.muKeys.Lock()
+			defer w.muKeys.Unlock()
+			delete(w.keys, key)
+		},
+		Stats: w.stats,
+	}, nil
 }
 
-func (s *sqLiteStore[T]) publish(kind string, ev *store.Event[T]) {
-	s.muSubs.RLock()
-	defer s.muSubs.RUnlock()
-	for w := range s.subs[kind] {
-		// check event type filter (nil means all events)
-		if w.eventTypes != nil {
-			if _, ok := w.eventTypes[ev.EventType]; !ok {
-				continue
-			}
-		}
-		select {
-		case w.ch <- ev:
-		default:
-			// drop if slow consumer
+// checkKind returns store.ErrUnknownKind for kinds outside
+// StoreOptions.AllowedKinds.
+func (s *sqLiteStore[T]) checkKind(kinds ...string) error {
+	return store.CheckKind(s.allowedKinds, kinds...)
+}
+
+// observed reports whether writes to kind need their events: for a
+// watcher or the event history, or for the WithinWrite and AfterWrite hooks.
+// Writes to an unobserved kind skip building them. A watcher subscribing
+// while a write is in flight may not see that write.
+func (s *sqLiteStore[T]) observed(kind string) bool {
+	return s.afterWrite != nil || s.h.withinWrite != nil || s.h.watched(kind)
+}
+
+// withinWrite runs the Options.WithinWrite hook inside the write's
+// transaction; an error aborts the write.
+func (s *sqLiteStore[T]) withinWrite(tx *sql.Tx, ev *store.Event[T]) error {
+	if s.h.withinWrite == nil {
+		return nil
+	}
+	return s.h.withinWrite(tx, &store.Event[any]{Kind: ev.Kind, Name: ev.Name, EventType: ev.EventType, Object: ev.Object, Silent: ev.Silent})
+}
+
+// publish runs the AfterWrite hook for a committed write, then hands ev to
+// the watchers of kind on every store of the DB. data is the encoding of
+// ev.Object, for watchers on stores of another type.
+func (s *sqLiteStore[T]) publish(kind string, ev *store.Event[T], data, prev []byte) {
+	if s.afterWrite != nil {
+		s.afterWrite(ev)
+	}
+	s.h.publish(&rawEvent{kind: kind, key: ev.Name, typ: ev.EventType, event: ev, data: data, prev: prev, at: ev.At, seqOf: &ev.Seq, version: ev.Version, silent: ev.Silent})
+}
+
+// publishAll is publish for the events of one write, which go to each
+// watcher in one batch. data and prev hold their encodings by key.
+func (s *sqLiteStore[T]) publishAll(kind string, evs []*store.Event[T], data, prev map[string][]byte) {
+	raws := make([]*rawEvent, len(evs))
+	for i, ev := range evs {
+		if s.afterWrite != nil {
+			s.afterWrite(ev)
 		}
+		raws[i] = &rawEvent{kind: kind, key: ev.Name, typ: ev.EventType, event: ev, data: data[ev.Name], prev: prev[ev.Name], at: ev.At, seqOf: &ev.Seq, version: ev.Version, silent: ev.Silent}
 	}
+	s.h.publish(raws...)
 }
 
 func (s *sqLiteStore[T]) Close() error {
@@ -588,22 +2714,41 @@ func (s *sqLiteStore[T]) Close() error {
 	s.closed = true
 	s.mu.Unlock()
 
-	// close all watchers
-	s.muSubs.Lock()
-	for _, m := range s.subs {
-		for w := range m {
-			close(w.ch)
+	if s.group != nil {
+		// queued writes still commit and publish
+		s.group.stop()
+	}
+
+	// close this store's watchers; other stores on the DB keep theirs
+	s.h.muSubs.Lock()
+	for _, m := range s.h.subs {
+		for sub := range m {
+			if s.owns(sub) && s.h.unsubscribe(sub) {
+				sub.close()
+			}
+		}
+	}
+	for sub := range s.h.all {
+		if s.owns(sub) && s.h.unsubscribe(sub) {
+			sub.close()
 		}
 	}
-	s.subs = nil
-	s.muSubs.Unlock()
+	s.h.muSubs.Unlock()
+	s.h.cancelExternal(func(sub *externalSub) bool { return sub.owner == s })
 
-	return s.db.Close()
+	if s.ownsDB {
+		return s.h.Close()
+	}
+	return nil
 }
 
 func (s *sqLiteStore[T]) Dump() string {
 	var sb strings.Builder
-	rows, err := s.db.Query(`SELECT kind, key, value, version, updated_at FROM zestor_kv ORDER BY kind, key;`)
+	query := s.h.allRowsQuery(`kind, key, value, version, updated_at`)
+	if query == "" {
+		return ""
+	}
+	rows, err := s.db.Query(query)
 	if err != nil {
 		return err.Error()
 	}
@@ -625,8 +2770,34 @@ func (s *sqLiteStore[T]) GetAll() (map[string]map[string]T, error) {
 		return nil, store.ErrClosed
 	}
 	s.mu.RUnlock()
+	defer s.flushRewrites()
+
+	query := s.h.allRowsQuery(`kind, key, value`)
+	if query == "" {
+		return make(map[string]map[string]T), nil
+	}
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	var out map[string]map[string]T
+	err := s.read(ctx, func(q querier) (err error) {
+		if s.maxGetAll > 0 {
+			var n int
+			if err := q.QueryRow(s.h.countAllQuery()).Scan(&n); err != nil {
+				return err
+			}
+			if err := store.CheckResultSize(n, s.maxGetAll); err != nil {
+				return err
+			}
+		}
+		out, err = s.getAll(q, query)
+		return err
+	})
+	return out, timeoutErr(ctx, err)
+}
 
-	rows, err := s.db.Query(`SELECT kind, key, value FROM zestor_kv ORDER BY kind, key;`)
+// getAll decodes the rows of query, the kind, key and value of every row.
+func (s *sqLiteStore[T]) getAll(q querier, query string) (map[string]map[string]T, error) {
+	rows, err := q.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -640,7 +2811,7 @@ func (s *sqLiteStore[T]) GetAll() (map[string]map[string]T, error) {
 			return nil, err
 		}
 		var v T
-		if err := s.codec.Unmarshal(blob, &v); err != nil {
+		if err := s.decode(kind, key, blob, &v); err != nil {
 			return nil, err
 		}
 		if _, ok := out[kind]; !ok {
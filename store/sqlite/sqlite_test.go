@@ -1,13 +1,29 @@
 package sqlite
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/zestor-dev/zestor/codec"
 	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/storetest"
 )
 
 type TestData struct {
@@ -59,6 +75,42 @@ func TestNew(t *testing.T) {
 			}
 		})
 	}
+
+	two := []store.StoreOptions[TestData]{{}, {}}
+	if _, err := New[TestData](tests[0].opts, two...); err == nil {
+		t.Error("New() with two StoreOptions succeeded")
+	}
+}
+
+// settle waits until the watchers on the DB of s have delivered the events
+// published to them, which they do on their own goroutines.
+func settle(t testing.TB, s store.Store[TestData]) {
+	t.Helper()
+	d := s.(*sqLiteStore[TestData]).h
+	idle := func(sub subscriber) bool {
+		w, ok := sub.(*watcher[TestData])
+		return !ok || w.box.idle()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		settled := true
+		d.muSubs.RLock()
+		for _, m := range d.subs {
+			for sub := range m {
+				settled = settled && idle(sub)
+			}
+		}
+		for sub := range d.all {
+			settled = settled && idle(sub)
+		}
+		d.muSubs.RUnlock()
+		if settled {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watchers did not settle")
+		}
+		time.Sleep(time.Millisecond)
+	}
 }
 
 func setupStore(t *testing.T) store.Store[TestData] {
@@ -233,6 +285,52 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteWithoutPrev(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+	ch, cancel, err := s.Watch("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	if _, err := s.Set("test", "a", TestData{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	existed, prev, err := s.Delete("test", "a", store.WithoutPrev())
+	if err != nil || !existed || prev != (TestData{}) {
+		t.Fatalf("Delete(WithoutPrev) = %v, %+v, %v", existed, prev, err)
+	}
+	if ev := <-ch; ev.EventType != store.EventTypeDelete || !ev.PrevOmitted || ev.Object != (TestData{}) {
+		t.Fatalf("event = %+v", ev)
+	}
+	if existed, _, err := s.Delete("test", "a", store.WithoutPrev()); err != nil || existed {
+		t.Fatalf("second Delete(WithoutPrev) = %v, %v", existed, err)
+	}
+
+	// a value that doesn't decode is deleted anyway, by either path
+	db := s.(*sqLiteStore[TestData]).db
+	for _, opts := range [][]store.WriteOption{nil, {store.WithoutPrev()}} {
+		if _, err := db.Exec(`INSERT INTO zestor_kv(kind,key,value) VALUES('test','bad',x'00ff')`); err != nil {
+			t.Fatal(err)
+		}
+		existed, prev, err := s.Delete("test", "bad", opts...)
+		if !existed || prev != (TestData{}) {
+			t.Fatalf("Delete of a corrupt value = %v, %+v, %v", existed, prev, err)
+		}
+		if (err != nil) != (opts == nil) {
+			t.Fatalf("Delete of a corrupt value with %d options: err = %v", len(opts), err)
+		}
+		if _, ok, err := s.Get("test", "bad"); ok || err != nil {
+			t.Fatalf("Get after Delete = %v, %v", ok, err)
+		}
+		if ev := <-ch; ev.Name != "bad" || !ev.PrevOmitted {
+			t.Fatalf("event = %+v", ev)
+		}
+	}
+}
+
 func TestList(t *testing.T) {
 	s := setupStore(t)
 	defer s.Close()
@@ -545,6 +643,62 @@ func TestClose(t *testing.T) {
 	cancel()
 }
 
+func TestWatchCloseRace(t *testing.T) {
+	// each Watch racing Close either fails with ErrClosed or returns a
+	// channel that Close closes; run with -race
+	for round := 0; round < 20; round++ {
+		db, err := Open(Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewWithDB[TestData](db, &codec.JSON{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chs := make(chan (<-chan *store.Event[TestData]), 8)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(chs); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var ch <-chan *store.Event[TestData]
+				var err error
+				if i%2 == 0 {
+					ch, _, err = s.Watch("test")
+				} else {
+					ch, _, err = store.WatchAll(s)
+				}
+				switch {
+				case err == nil:
+					chs <- ch
+				case !errors.Is(err, store.ErrClosed):
+					t.Errorf("Watch = %v, want nil or ErrClosed", err)
+				}
+			}(i)
+		}
+		// the store is closed in even rounds, the DB under it in odd ones
+		if round%2 == 0 {
+			s.Close()
+		} else {
+			db.Close()
+		}
+		wg.Wait()
+		close(chs)
+		for ch := range chs {
+			select {
+			case _, ok := <-ch:
+				if ok {
+					t.Fatal("event on a closed store")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("watch channel still open after Close")
+			}
+		}
+		s.Close()
+		db.Close()
+	}
+}
+
 func TestDump(t *testing.T) {
 	s := setupStore(t)
 	defer s.Close()
@@ -643,60 +797,5013 @@ func TestPersistence(t *testing.T) {
 	}
 }
 
-// Benchmarks
-func BenchmarkSet(b *testing.B) {
-	tmpDir := b.TempDir()
-	s, _ := New[TestData](Options{
-		DSN:   "file:" + filepath.Join(tmpDir, "bench.db"),
+func TestNormalize(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(tmpDir, "test.db"),
 		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{
+		NormalizeFns: map[string]store.NormalizeFunc[TestData]{
+			"users": func(v TestData) (TestData, error) {
+				if v.Value < 0 {
+					return v, errors.New("negative value")
+				}
+				v.Name = strings.ToLower(strings.TrimSpace(v.Name))
+				return v, nil
+			},
+		},
 	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
 	defer s.Close()
 
-	kind := "bench"
-	val := TestData{Name: "benchmark", Value: 42}
+	if _, err := s.Set("users", "u1", TestData{Name: " Alice ", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	got, _, err := s.Get("users", "u1")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Name != "alice" {
+		t.Errorf("Get() name = %q, want %q", got.Name, "alice")
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := fmt.Sprintf("key%d", i)
-		_, _ = s.Set(kind, key, val)
+	ch, cancel, err := s.Watch("users")
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	defer cancel()
+
+	// un-normalized value equal to the stored canonical form is a no-op
+	if _, err := s.Set("users", "u1", TestData{Name: "ALICE", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, err := s.SetFn("users", "u1", func(v TestData) (TestData, error) {
+		v.Name = "Alice"
+		return v, nil
+	}); err != nil {
+		t.Fatalf("SetFn() error = %v", err)
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("Received unexpected event for normalized no-op: %+v", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	_, err = s.Set("users", "u2", TestData{Name: "bob", Value: -1})
+	var nerr *store.NormalizeError
+	if !errors.As(err, &nerr) {
+		t.Fatalf("Set() error = %v, want NormalizeError", err)
+	}
+	if nerr.Kind != "users" || nerr.Key != "u2" {
+		t.Errorf("NormalizeError = %+v", nerr)
+	}
+	if err := s.SetAll("users", map[string]TestData{"u3": {Name: "x", Value: -1}}); !errors.As(err, &nerr) {
+		t.Fatalf("SetAll() error = %v, want NormalizeError", err)
+	}
+	if n, _ := s.Count("users"); n != 1 {
+		t.Errorf("Count() = %d, want 1", n)
 	}
 }
 
-func BenchmarkGet(b *testing.B) {
-	tmpDir := b.TempDir()
-	s, _ := New[TestData](Options{
-		DSN:   "file:" + filepath.Join(tmpDir, "bench.db"),
-		Codec: &codec.JSON{},
-	})
+func TestWatchHandleKeys(t *testing.T) {
+	s := setupStore(t)
 	defer s.Close()
 
-	kind := "bench"
-	key := "key1"
-	val := TestData{Name: "benchmark", Value: 42}
-	_, _ = s.Set(kind, key, val)
+	kind := "test"
+	h, err := store.WatchH(s, kind, store.WithKeys[TestData]("a"))
+	if err != nil {
+		t.Fatalf("WatchH() error = %v", err)
+	}
+	defer h.Cancel()
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, _, _ = s.Get(kind, key)
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case ev := <-h.C:
+			if ev.Name != want {
+				t.Errorf("Event name = %s, want %s", ev.Name, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for event on %s", want)
+		}
 	}
+
+	_, _ = s.Set(kind, "b", TestData{Name: "b"})
+	_, _ = s.Set(kind, "a", TestData{Name: "a"})
+	expect("a")
+
+	h.AddKey("b")
+	_, _ = s.Set(kind, "c", TestData{Name: "c"})
+	_, _ = s.Set(kind, "b", TestData{Name: "b2"})
+	expect("b")
+
+	// an empty allowlist delivers every key again
+	h.RemoveKey("a")
+	h.RemoveKey("b")
+	_, _ = s.Set(kind, "c", TestData{Name: "c2"})
+	expect("c")
 }
 
-func BenchmarkSetFn(b *testing.B) {
-	tmpDir := b.TempDir()
-	s, _ := New[TestData](Options{
-		DSN:   "file:" + filepath.Join(tmpDir, "bench.db"),
-		Codec: &codec.JSON{},
+func TestSetIdempotencyKey(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	kind, key := "test", "k"
+	version := func(s store.Store[TestData]) int {
+		t.Helper()
+		var v int
+		if err := s.(*sqLiteStore[TestData]).db.QueryRow(`SELECT version FROM zestor_kv WHERE kind=? AND key=?;`, kind, key).Scan(&v); err != nil {
+			t.Fatalf("version query error = %v", err)
+		}
+		return v
+	}
+
+	ch, cancel, err := s.Watch(kind)
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		created, err := s.Set(kind, key, TestData{Name: "v1"}, store.WithIdempotencyKey("req-1"))
+		if err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+		if !created {
+			t.Errorf("Set() attempt %d created = false, want original result true", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.Set(kind, key, TestData{Name: "v2"}, store.WithIdempotencyKey("req-2")); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if v := version(s); v != 2 {
+		t.Errorf("version = %d, want 2", v)
+	}
+
+	events := 0
+	timeout := time.After(300 * time.Millisecond)
+LOOP:
+	for {
+		select {
+		case <-ch:
+			events++
+		case <-timeout:
+			break LOOP
+		}
+	}
+	if events != 2 {
+		t.Errorf("received %d events, want 2", events)
+	}
+
+	// a replay after a newer write must not resurrect the old value,
+	// even across a restart
+	if _, err := s.Set(kind, key, TestData{Name: "v3"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	_ = s.Close()
+	s, err = New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Set(kind, key, TestData{Name: "v2"}, store.WithIdempotencyKey("req-2")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	got, _, _ := s.Get(kind, key)
+	if got.Name != "v3" {
+		t.Errorf("Get() = %v, want v3", got)
+	}
+	if v := version(s); v != 3 {
+		t.Errorf("version = %d, want 3", v)
+	}
+}
+
+func TestIdempotencyEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s, err := New[TestData](Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db"), Codec: &codec.JSON{}},
+		store.StoreOptions[TestData]{IdempotencyWindow: time.Minute, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	db := s.(*sqLiteStore[TestData]).db
+	rows := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM zestor_idempotency;`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for i := 0; i < idemEvictBatch+50; i++ {
+		if _, err := s.Set("k", fmt.Sprint(i), TestData{Name: "v"}, store.WithIdempotencyKey("req")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var version int64
+	if err := db.QueryRow(`SELECT version FROM zestor_idempotency WHERE kind='k' AND key='0';`).Scan(&version); err != nil || version != 1 {
+		t.Errorf("recorded version = %d, %v, want 1", version, err)
+	}
+
+	// past the window, a replay is applied, even before its key is evicted
+	now = now.Add(2 * time.Minute)
+	if created, err := s.Set("k", "new", TestData{Name: "v"}, store.WithIdempotencyKey("req")); err != nil || !created {
+		t.Fatalf("Set() = %v, %v", created, err)
+	}
+	if n := rows(); n != 50+1 {
+		t.Errorf("%d keys left after one write, want a batch of %d evicted", n, idemEvictBatch)
+	}
+	if _, err := s.Set("k", "149", TestData{Name: "w"}, store.WithIdempotencyKey("req")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := s.Get("k", "149"); got.Name != "w" {
+		t.Errorf("expired replay not applied: %+v", got)
+	}
+	if n := rows(); n != 2 {
+		t.Errorf("%d keys left, want 2", n)
+	}
+	var plan string
+	if err := db.QueryRow(`EXPLAIN QUERY PLAN SELECT rowid FROM zestor_idempotency WHERE at < 0;`).Scan(new(int), new(int), new(int), &plan); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan, "idx_idempotency_at") {
+		t.Errorf("eviction plan = %q, want the at index", plan)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+
+	kind := "pods"
+	mustSet := func(key string, labels map[string]string) {
+		t.Helper()
+		if _, err := store.SetLabeled(s, kind, key, TestData{Name: key}, labels); err != nil {
+			t.Fatalf("SetLabeled() error = %v", err)
+		}
+	}
+	mustSet("web-1", map[string]string{"app": "web", "env": "prod"})
+	mustSet("web-2", map[string]string{"app": "web", "env": "dev"})
+	mustSet("db-1", map[string]string{"app": "db", "env": "prod"})
+	if _, err := s.Set(kind, "plain", TestData{Name: "plain"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	selectKeys := func(selector map[string]string) map[string]bool {
+		t.Helper()
+		kvs, err := store.SelectByLabel(s, kind, selector)
+		if err != nil {
+			t.Fatalf("SelectByLabel() error = %v", err)
+		}
+		keys := make(map[string]bool)
+		for _, kv := range kvs {
+			keys[kv.Key] = true
+		}
+		return keys
+	}
+
+	if got := selectKeys(map[string]string{"app": "web"}); len(got) != 2 || !got["web-1"] || !got["web-2"] {
+		t.Errorf("app=web selected %v", got)
+	}
+	if got := selectKeys(map[string]string{"app": "web", "env": "prod"}); len(got) != 1 || !got["web-1"] {
+		t.Errorf("app=web,env=prod selected %v", got)
+	}
+	if got := selectKeys(nil); len(got) != 4 {
+		t.Errorf("empty selector selected %v", got)
+	}
+
+	// plain Set keeps labels, SetLabeled replaces them
+	if _, err := s.Set(kind, "web-2", TestData{Name: "web-2", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got := selectKeys(map[string]string{"env": "dev"}); !got["web-2"] {
+		t.Errorf("Set() dropped labels: %v", got)
+	}
+	mustSet("web-2", map[string]string{"app": "web", "env": "prod"})
+	if got := selectKeys(map[string]string{"env": "dev"}); len(got) != 0 {
+		t.Errorf("SetLabeled() did not replace labels: %v", got)
+	}
+
+	// delete cascades to labels
+	if _, _, err := s.Delete(kind, "web-1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	var n int
+	if err := s.(*sqLiteStore[TestData]).db.QueryRow(`SELECT COUNT(*) FROM zestor_labels WHERE kind=? AND key=?;`, kind, "web-1").Scan(&n); err != nil {
+		t.Fatalf("label count error = %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Delete() left %d label rows", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := New[TestData](Options{
+		DSN:                 "file:" + filepath.Join(tmpDir, "test.db"),
+		Codec:               &codec.JSON{},
+		MaxSnapshotDuration: 500 * time.Millisecond,
 	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
 	defer s.Close()
 
-	kind := "bench"
-	key := "counter"
+	kind := "report"
+	for i := 0; i < 3; i++ {
+		if _, err := s.Set(kind, fmt.Sprintf("k%d", i), TestData{Value: i}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, _ = s.SetFn(kind, key, func(v TestData) (TestData, error) {
-			v.Value++
-			return v, nil
+	view, release, err := store.Snapshot(s, kind)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+
+	// interleave writes with reads on the view
+	if _, err := s.Set(kind, "k3", TestData{Value: 3}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if n, err := view.Count(kind); err != nil || n != 3 {
+		t.Errorf("view.Count() = %d, %v, want 3", n, err)
+	}
+	if _, _, err := s.Delete(kind, "k0"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if keys, err := view.Keys(kind); err != nil || len(keys) != 3 {
+		t.Errorf("view.Keys() = %v, %v, want 3 keys", keys, err)
+	}
+	if _, err := s.Set(kind, "k1", TestData{Value: 100}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	list, err := view.List(kind)
+	if err != nil || len(list) != 3 || list["k1"].Value != 1 {
+		t.Errorf("view.List() = %v, %v, want the frozen state", list, err)
+	}
+	if _, ok, _ := view.Get(kind, "k0"); !ok {
+		t.Error("view.Get() lost a key deleted after the snapshot")
+	}
+	if n, _ := s.Count(kind); n != 3 {
+		t.Errorf("Count() = %d, want 3", n)
+	}
+	if _, err := view.Count("other"); !errors.Is(err, store.ErrOutsideSnapshot) {
+		t.Errorf("view.Count(other) error = %v, want ErrOutsideSnapshot", err)
+	}
+
+	release()
+	if _, err := view.Count(kind); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("view.Count() after release error = %v, want ErrClosed", err)
+	}
+
+	// views held past MaxSnapshotDuration expire
+	view, release, err = store.Snapshot(s, kind)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	defer release()
+	time.Sleep(600 * time.Millisecond)
+	if _, err := view.Count(kind); !errors.Is(err, store.ErrSnapshotExpired) {
+		t.Errorf("view.Count() error = %v, want ErrSnapshotExpired", err)
+	}
+}
+
+func TestTablePerKind(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	open := func() store.Store[TestData] {
+		t.Helper()
+		s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}, TablePerKind: true})
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		return s
+	}
+	s := open()
+
+	// "kv" must not collide with the shared zestor_kv table
+	kinds := []string{"kv", `odd "kind"`, "notes"}
+	for _, kind := range kinds {
+		if err := s.SetAll(kind, map[string]TestData{"a": {Name: kind, Value: 1}, "b": {Name: kind, Value: 2}}); err != nil {
+			t.Fatalf("SetAll(%s) error = %v", kind, err)
+		}
+	}
+	if _, err := s.SetFn("notes", "a", func(v TestData) (TestData, error) {
+		v.Value = 10
+		return v, nil
+	}); err != nil {
+		t.Fatalf("SetFn() error = %v", err)
+	}
+	if _, _, err := s.Delete("kv", "b"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := s.SetFn("missing", "a", func(v TestData) (TestData, error) { return v, nil }); err != store.ErrKeyNotFound {
+		t.Errorf("SetFn() on missing kind error = %v, want ErrKeyNotFound", err)
+	}
+
+	var shared int
+	if err := s.(*sqLiteStore[TestData]).db.QueryRow(`SELECT COUNT(*) FROM zestor_kv;`).Scan(&shared); err != nil {
+		t.Fatalf("zestor_kv count error = %v", err)
+	}
+	if shared != 0 {
+		t.Errorf("zestor_kv holds %d rows, want 0", shared)
+	}
+	_ = s.Close()
+
+	s = open()
+	defer s.Close()
+	got, err := store.Kinds(s)
+	if err != nil {
+		t.Fatalf("Kinds() error = %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]string{"kv", "notes", `odd "kind"`}) {
+		t.Errorf("Kinds() = %q", got)
+	}
+	if n, _ := s.Count("kv"); n != 1 {
+		t.Errorf("Count(kv) = %d, want 1", n)
+	}
+	if v, ok, _ := s.Get("notes", "a"); !ok || v.Value != 10 {
+		t.Errorf("Get(notes/a) = %v, %v", v, ok)
+	}
+	if m, _ := s.List(`odd "kind"`); len(m) != 2 {
+		t.Errorf("List() = %v, want 2 entries", m)
+	}
+	if m, err := s.List("missing"); err != nil || len(m) != 0 {
+		t.Errorf("List(missing) = %v, %v, want empty", m, err)
+	}
+	all, err := s.GetAll()
+	if err != nil || len(all) != 3 || len(all["notes"]) != 2 {
+		t.Errorf("GetAll() = %v, %v", all, err)
+	}
+}
+
+func TestKinds(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+
+	if kinds, err := store.Kinds(s); err != nil || len(kinds) != 0 {
+		t.Errorf("Kinds() = %v, %v, want none", kinds, err)
+	}
+	for _, kind := range []string{"b", "a", "b"} {
+		if _, err := s.Set(kind, "k", TestData{}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if kinds, _ := store.Kinds(s); fmt.Sprint(kinds) != "[a b]" {
+		t.Errorf("Kinds() = %v, want [a b]", kinds)
+	}
+}
+
+func TestKeySegments(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+
+	kind := "paths"
+	for _, k := range []string{"org1/team1/u1", "org1/team2/u2", "org2/team1/u3", "readme", "trail/", "é/x", "a::b::c"} {
+		if _, err := s.Set(kind, k, TestData{Name: k}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		sep, prefix string
+		want        []string
+	}{
+		{"/", "", []string{"a::b::c", "org1/", "org2/", "readme", "trail/", "é/"}},
+		{"/", "org1/", []string{"team1/", "team2/"}},
+		{"/", "org1/team1/", []string{"u1"}},
+		{"/", "trail/", []string{}},
+		{"/", "é/", []string{"x"}},
+		{"::", "a::", []string{"b::"}},
+		{"/", "nope", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := store.KeySegments(s, kind, tt.sep, tt.prefix)
+		if err != nil {
+			t.Fatalf("KeySegments(%q, %q) error = %v", tt.sep, tt.prefix, err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("KeySegments(%q, %q) = %q, want %q", tt.sep, tt.prefix, got, tt.want)
+		}
+	}
+	if _, err := store.KeySegments(s, kind, "", ""); !errors.Is(err, store.ErrSeparatorRequired) {
+		t.Errorf("KeySegments() with empty separator error = %v", err)
+	}
+
+	m, err := store.ListPrefix(s, kind, "org1/")
+	if err != nil {
+		t.Fatalf("ListPrefix() error = %v", err)
+	}
+	if len(m) != 2 || m["org1/team2/u2"].Name != "org1/team2/u2" {
+		t.Errorf("ListPrefix() = %v", m)
+	}
+	if m, _ := store.ListPrefix(s, kind, "é"); len(m) != 1 {
+		t.Errorf("ListPrefix(é) = %v", m)
+	}
+}
+
+func TestPageSizeAutoVacuum(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "pages.db")
+	open := func(pageSize int, av AutoVacuum) (store.Store[TestData], error) {
+		return New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}, PageSize: pageSize, AutoVacuum: av})
+	}
+
+	s, err := open(8192, AutoVacuumIncremental)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	db := s.(*sqLiteStore[TestData]).db
+	var pageSize, av int
+	if err := db.QueryRow(`PRAGMA page_size;`).Scan(&pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`PRAGMA auto_vacuum;`).Scan(&av); err != nil {
+		t.Fatal(err)
+	}
+	if pageSize != 8192 || av != 2 {
+		t.Fatalf("expected page_size 8192 and auto_vacuum 2, got %d and %d", pageSize, av)
+	}
+	if _, err := s.Set("k", "a", TestData{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if _, err := open(4096, ""); err == nil || !strings.Contains(err.Error(), "page_size") {
+		t.Fatalf("expected page_size mismatch error, got %v", err)
+	}
+	if _, err := open(0, AutoVacuumFull); err == nil || !strings.Contains(err.Error(), "auto_vacuum") {
+		t.Fatalf("expected auto_vacuum mismatch error, got %v", err)
+	}
+	if _, err := open(1000, ""); err == nil {
+		t.Fatal("expected error for invalid page size")
+	}
+
+	s, err = open(8192, AutoVacuumIncremental)
+	if err != nil {
+		t.Fatalf("reopen with same settings failed: %v", err)
+	}
+	if _, ok, _ := s.Get("k", "a"); !ok {
+		t.Fatal("expected existing data after reopen")
+	}
+	s.Close()
+}
+
+func TestOptimize(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:        "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec:      &codec.JSON{},
+		AutoVacuum: AutoVacuumIncremental,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	values := make(map[string]TestData)
+	for i := 0; i < 2000; i++ {
+		values[fmt.Sprint(i)] = TestData{Name: strings.Repeat("x", 500), Value: i}
+	}
+	if err := s.SetAll("k", values); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < len(values); i++ {
+		if _, _, err := s.Delete("k", fmt.Sprint(i), store.WithoutPrev()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := s.(*sqLiteStore[TestData]).db
+	var free int
+	if err := db.QueryRow(`PRAGMA freelist_count;`).Scan(&free); err != nil || free == 0 {
+		t.Fatalf("freelist_count before Optimize = %d, %v", free, err)
+	}
+
+	if err := s.(Maintainer).Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`PRAGMA freelist_count;`).Scan(&free); err != nil || free != 0 {
+		t.Fatalf("freelist_count after Optimize = %d, %v", free, err)
+	}
+	var stats int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_stat1`).Scan(&stats); err != nil || stats == 0 {
+		t.Fatalf("sqlite_stat1 rows = %d, %v", stats, err)
+	}
+}
+
+// jitterCodec encodes like JSON but with a varying amount of trailing
+// whitespace, so equal values rarely produce equal bytes.
+type jitterCodec struct {
+	codec.JSON
+	n int
+}
+
+func (j *jitterCodec) Marshal(v any) ([]byte, error) {
+	b, err := j.JSON.Marshal(v)
+	j.n++
+	return append(b, strings.Repeat(" ", j.n)...), err
+}
+
+func (j *jitterCodec) Deterministic() bool { return false }
+
+func TestNonDeterministicCodecNoOp(t *testing.T) {
+	s, err := New[TestData](Options{DSN: "file:" + filepath.Join(t.TempDir(), "jitter.db"), Codec: &jitterCodec{}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer s.Close()
+
+	val := TestData{Name: "a", Value: 1}
+	if _, err := s.Set("k", "a", val); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel, err := s.Watch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	if created, err := s.Set("k", "a", val); err != nil || created {
+		t.Fatalf("expected no-op Set, got created=%v err=%v", created, err)
+	}
+	if changed, err := s.SetFn("k", "a", func(v TestData) (TestData, error) { return v, nil }); err != nil || changed {
+		t.Fatalf("expected no-op SetFn, got changed=%v err=%v", changed, err)
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event for equal value: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := s.Set("k", "a", TestData{Name: "a", Value: 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.EventType != store.EventTypeUpdate {
+			t.Fatalf("expected update event, got %v", ev.EventType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected update event for changed value")
+	}
+}
+
+func TestFallbackLazyRewrite(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "mixed.db")
+
+	// seed YAML rows, as written before the migration
+	old, err := New[TestData](Options{DSN: dsn, Codec: &codec.YAML{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if _, err := old.Set("k", k, TestData{Name: k, Value: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	if _, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}, LazyRewrite: true}); err == nil {
+		t.Fatal("expected error for LazyRewrite without a Fallback codec")
+	}
+
+	var legacy int
+	fb := &codec.Fallback{
+		Primary:     &codec.JSON{Strict: true},
+		Secondary:   []codec.Codec{&codec.YAML{}},
+		OnSecondary: func(codec.Codec) { legacy++ },
+	}
+	s, err := New[TestData](Options{DSN: dsn, Codec: fb, LazyRewrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Set("k", "c", TestData{Name: "c", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := func(key string) (string, int) {
+		var blob []byte
+		var version int
+		err := s.(*sqLiteStore[TestData]).db.QueryRow(
+			`SELECT value, version FROM zestor_kv WHERE kind='k' AND key=?`, key).Scan(&blob, &version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(blob), version
+	}
+	if b, _ := raw("a"); strings.HasPrefix(b, "{") {
+		t.Fatalf("expected YAML before the first read, got %q", b)
+	}
+
+	v, ok, err := s.Get("k", "a")
+	if err != nil || !ok || v.Name != "a" {
+		t.Fatalf("Get legacy row: %+v %v %v", v, ok, err)
+	}
+	if b, ver := raw("a"); b != `{"name":"a","value":1}` || ver != 1 {
+		t.Fatalf("expected row rewritten as JSON with version kept, got %q v%d", b, ver)
+	}
+	if b, _ := raw("b"); strings.HasPrefix(b, "{") {
+		t.Fatalf("unread row should not be rewritten yet, got %q", b)
+	}
+
+	all, err := s.List("k")
+	if err != nil || len(all) != 3 || all["b"].Name != "b" || all["c"].Name != "c" {
+		t.Fatalf("List over mixed encodings: %+v %v", all, err)
+	}
+	if b, _ := raw("b"); b != `{"name":"b","value":1}` {
+		t.Fatalf("expected b rewritten by List, got %q", b)
+	}
+	if legacy != 2 {
+		t.Fatalf("expected 2 legacy decodes, got %d", legacy)
+	}
+
+	// everything is primary now
+	legacy = 0
+	if _, err := s.List("k"); err != nil || legacy != 0 {
+		t.Fatalf("expected no legacy rows left, got %d (%v)", legacy, err)
+	}
+}
+
+func TestEmptyKind(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			ch, cancel, err := s.Watch("")
+			if err != nil {
+				t.Fatalf("Watch on the empty kind: %v", err)
+			}
+			defer cancel()
+
+			if created, err := s.Set("", "a", TestData{Name: "a"}); err != nil || !created {
+				t.Fatalf("Set: created=%v err=%v", created, err)
+			}
+			select {
+			case ev := <-ch:
+				if ev.Kind != "" || ev.Name != "a" || ev.EventType != store.EventTypeCreate {
+					t.Fatalf("unexpected event %+v", ev)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected create event on the empty kind")
+			}
+
+			if v, ok, err := s.Get("", "a"); err != nil || !ok || v.Name != "a" {
+				t.Fatalf("Get: %+v %v %v", v, ok, err)
+			}
+			if n, _ := s.Count(""); n != 1 {
+				t.Fatalf("Count = %d", n)
+			}
+			kinds, err := store.Kinds(s)
+			if err != nil || len(kinds) != 1 || kinds[0] != "" {
+				t.Fatalf("Kinds = %q, %v", kinds, err)
+			}
+			if existed, _, err := s.Delete("", "a"); err != nil || !existed {
+				t.Fatalf("Delete: existed=%v err=%v", existed, err)
+			}
+		})
+	}
+}
+
+func TestSharedDB(t *testing.T) {
+	db, err := Open(Options{DSN: "file:" + filepath.Join(t.TempDir(), "shared.db")})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewWithDB[TestData](db, &codec.JSON{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewWithDB[TestData](db, &codec.JSON{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a differently typed view of the same kind
+	raw, err := NewWithDB[map[string]any](db, &codec.JSON{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if a.(*sqLiteStore[TestData]).db != raw.(*sqLiteStore[map[string]any]).db {
+		t.Fatal("expected stores to share one pool")
+	}
+
+	chA, _, err := a.Watch("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chB, _, err := b.Watch("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chRaw, _, err := raw.Watch("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Set("items", "x", TestData{Name: "x", Value: 7}); err != nil {
+		t.Fatal(err)
+	}
+	for name, ch := range map[string]<-chan *store.Event[TestData]{"a": chA, "b": chB} {
+		select {
+		case ev := <-ch:
+			if ev.Name != "x" || ev.Object.Value != 7 {
+				t.Fatalf("store %s: unexpected event %+v", name, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("store %s: expected event", name)
+		}
+	}
+	select {
+	case ev := <-chRaw:
+		if ev.EventType != store.EventTypeCreate || ev.Object["name"] != "x" || ev.Object["value"] != float64(7) {
+			t.Fatalf("typed view: unexpected event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("typed view: expected event decoded with its own codec")
+	}
+	if v, ok, err := b.Get("items", "x"); err != nil || !ok || v.Value != 7 {
+		t.Fatalf("Get through b: %+v %v %v", v, ok, err)
+	}
+
+	// closing a store closes its watchers only, not the shared DB
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-chA; ok {
+		t.Fatal("expected a's watcher to be closed")
+	}
+	if _, _, err := b.Delete("items", "x"); err != nil {
+		t.Fatalf("Delete through b after closing a: %v", err)
+	}
+	select {
+	case ev := <-chB:
+		if ev.EventType != store.EventTypeDelete {
+			t.Fatalf("expected delete event, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected delete event on b")
+	}
+
+	// closing the DB closes the remaining watchers
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range chB {
+	}
+	for range chRaw {
+	}
+}
+
+func TestEvictAfterDrops(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+
+	slow, _, err := s.Watch("k", store.WithBufferSize[TestData](1), store.WithEvictAfterDrops[TestData](3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, cancel, err := s.Watch("k", store.WithBufferSize[TestData](1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	set := func(from, to int) {
+		for i := from; i < to; i++ {
+			if _, err := s.Set("k", "a", TestData{Value: i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// fills the buffer, then two drops: not evicted yet
+	set(0, 3)
+	settle(t, s)
+	if ev := <-slow; ev.Object.Value != 0 {
+		t.Fatalf("expected first event, got %+v", ev)
+	}
+	// the successful send resets the count
+	set(3, 6)
+	settle(t, s)
+	if ev, ok := <-slow; !ok || ev.Object.Value != 3 {
+		t.Fatalf("expected watcher alive after non-consecutive drops, got %+v %v", ev, ok)
+	}
+
+	// three drops in a row evict
+	set(6, 10)
+	settle(t, s)
+	if _, ok := <-slow; !ok {
+		t.Fatal("expected the buffered event before close")
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("expected evicted watcher to be closed")
+	}
+
+	if _, ok := <-plain; !ok {
+		t.Fatal("expected watcher without eviction to stay open")
+	}
+}
+
+func TestListOrderByJSON(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			jl := s.(JSONLister[TestData])
+
+			for k, v := range map[string]int{"a": 5, "b": 20, "c": 3, "d": 20, "e": 11} {
+				if _, err := s.Set("items", k, TestData{Name: k, Value: v}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.Set("other", "z", TestData{Name: "z", Value: 100}); err != nil {
+				t.Fatal(err)
+			}
+
+			keys := func(kvs []store.KeyValue[TestData]) string {
+				out := make([]string, len(kvs))
+				for i, kv := range kvs {
+					out[i] = kv.Key
+				}
+				return strings.Join(out, ",")
+			}
+
+			top, err := jl.ListOrderByJSON("items", "$.value", true, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// numeric, not lexical, order; ties by key
+			if got := keys(top); got != "b,d,e" {
+				t.Fatalf("top 3 desc = %s", got)
+			}
+			if top[0].Value.Value != 20 {
+				t.Fatalf("expected decoded values, got %+v", top[0])
+			}
+
+			all, err := jl.ListOrderByJSON("items", "$.value", false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keys(all); got != "c,a,e,b,d" {
+				t.Fatalf("all asc = %s", got)
+			}
+
+			none, err := jl.ListOrderByJSON("missing", "$.value", false, 0)
+			if err != nil || len(none) != 0 {
+				t.Fatalf("missing kind: %v %v", none, err)
+			}
+		})
+	}
+
+	y, err := New[TestData](Options{DSN: "file:" + filepath.Join(t.TempDir(), "yaml.db"), Codec: &codec.YAML{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer y.Close()
+	if _, err := y.(JSONLister[TestData]).ListOrderByJSON("items", "$.value", false, 0); !errors.Is(err, store.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported for a YAML codec, got %v", err)
+	}
+}
+
+func TestSetAllBatchSize(t *testing.T) {
+	var progress []int
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{
+		SetAllBatchSize: 2,
+		SetAllProgress: func(kind string, done, total int) {
+			if kind != "items" || total != 5 {
+				t.Errorf("progress(%q, %d, %d)", kind, done, total)
+			}
+			progress = append(progress, done)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Set("items", "c", TestData{Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel, err := s.Watch("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	values := map[string]TestData{}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		values[k] = TestData{Name: k}
+	}
+	if err := s.SetAll("items", values); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[2 4 5]" {
+		t.Fatalf("progress = %v", progress)
+	}
+	if n, _ := s.Count("items"); n != 5 {
+		t.Fatalf("Count = %d", n)
+	}
+	types := map[string]store.EventType{}
+	for i := 0; i < 5; i++ {
+		select {
+		case ev := <-ch:
+			types[ev.Name] = ev.EventType
+		case <-time.After(time.Second):
+			t.Fatalf("expected 5 events, got %d", i)
+		}
+	}
+	if types["c"] != store.EventTypeUpdate || types["a"] != store.EventTypeCreate {
+		t.Fatalf("event types = %v", types)
+	}
+}
+
+func TestWriteHooks(t *testing.T) {
+	errRejected := errors.New("rejected")
+	var after []string
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+		WithinWrite: func(tx *sql.Tx, ev *store.Event[any]) error {
+			if ev.Name == "reject" {
+				return errRejected
+			}
+			_, err := tx.Exec(`INSERT INTO outbox(kind, key, type, name) VALUES(?,?,?,?)`,
+				ev.Kind, ev.Name, string(ev.EventType), ev.Object.(TestData).Name)
+			return err
+		},
+	}, store.StoreOptions[TestData]{
+		AfterWrite: func(ev *store.Event[TestData]) {
+			after = append(after, string(ev.EventType)+":"+ev.Name)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	db := s.(*sqLiteStore[TestData]).db
+	if _, err := db.Exec(`CREATE TABLE outbox(kind TEXT, key TEXT, type TEXT, name TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Set("k", "a", TestData{Name: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	// no-op writes don't reach the hooks
+	if _, err := s.Set("k", "a", TestData{Name: "a1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetFn("k", "a", func(v TestData) (TestData, error) { v.Name = "a2"; return v, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAll("k", map[string]TestData{"b": {Name: "b1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Delete("k", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+	if _, err := s.Set("k", "reject", TestData{Name: "x"}); !errors.Is(err, errRejected) {
+		t.Fatalf("expected hook error, got %v", err)
+	}
+	if _, ok, _ := s.Get("k", "reject"); ok {
+		t.Fatal("rejected write was committed")
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event for rejected write: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	want := "create:a,update:a,create:b,delete:b"
+	if got := strings.Join(after, ","); got != want {
+		t.Fatalf("AfterWrite saw %s, want %s", got, want)
+	}
+	rows, err := db.Query(`SELECT type, key, name FROM outbox ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var outbox []string
+	for rows.Next() {
+		var typ, key, name string
+		if err := rows.Scan(&typ, &key, &name); err != nil {
+			t.Fatal(err)
+		}
+		outbox = append(outbox, typ+":"+key+"="+name)
+	}
+	if got := strings.Join(outbox, ","); got != "create:a=a1,update:a=a2,create:b=b1,delete:b=b1" {
+		t.Fatalf("outbox = %s", got)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	s, err := New[TestData](Options{
+		DSN:          dsn,
+		Codec:        &codec.JSON{},
+		BusyTimeout:  5 * time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	if _, err := s.Set("test", "a", TestData{Name: "a", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// hold the write lock from another connection
+	raw, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	ctx := context.Background()
+	conn, err := raw.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE;`); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = s.Set("test", "a", TestData{Name: "a", Value: 2})
+	if !errors.Is(err, store.ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Set() under lock error = %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Set() under lock took %v, want about the 200ms WriteTimeout", d)
+	}
+
+	// WAL readers aren't blocked by the writer
+	if v, ok, err := s.Get("test", "a"); err != nil || !ok || v.Value != 1 {
+		t.Errorf("Get() under lock = %v, %v, %v", v, ok, err)
+	}
+
+	if _, err := conn.ExecContext(ctx, `ROLLBACK;`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("test", "a", TestData{Name: "a", Value: 2}); err != nil {
+		t.Fatalf("Set() after unlock error = %v", err)
+	}
+	if v, _, _ := s.Get("test", "a"); v.Value != 2 {
+		t.Errorf("Get() = %v, want Value 2", v)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	w, err := New[TestData](Options{DSN: "file:" + path, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := w.Set("test", "a", TestData{Name: "a", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	defer w.Close()
+
+	// a plain path works too
+	s, err := New[TestData](Options{DSN: path, Codec: &codec.JSON{}, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("New(ReadOnly) error = %v", err)
+	}
+	defer s.Close()
+
+	if v, ok, err := s.Get("test", "a"); err != nil || !ok || v.Value != 1 {
+		t.Fatalf("Get() = %v, %v, %v", v, ok, err)
+	}
+	if _, err := s.Set("test", "b", TestData{}); !errors.Is(err, store.ErrReadOnly) {
+		t.Errorf("Set() error = %v, want ErrReadOnly", err)
+	}
+	if _, err := s.SetFn("test", "a", func(v TestData) (TestData, error) { return v, nil }); !errors.Is(err, store.ErrReadOnly) {
+		t.Errorf("SetFn() error = %v, want ErrReadOnly", err)
+	}
+	if err := s.SetAll("test", map[string]TestData{"b": {}}); !errors.Is(err, store.ErrReadOnly) {
+		t.Errorf("SetAll() error = %v, want ErrReadOnly", err)
+	}
+	if _, _, err := s.Delete("test", "a"); !errors.Is(err, store.ErrReadOnly) {
+		t.Errorf("Delete() error = %v, want ErrReadOnly", err)
+	}
+
+	// the connection itself refuses writes
+	if _, err := s.(*sqLiteStore[TestData]).db.Exec(`DELETE FROM zestor_kv;`); err == nil {
+		t.Error("raw DELETE on a read-only connection succeeded")
+	}
+
+	// writes of other processes are visible
+	if _, err := w.Set("test", "b", TestData{Name: "b", Value: 2}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if n, err := s.Count("test"); err != nil || n != 2 {
+		t.Errorf("Count() = %d, %v, want 2", n, err)
+	}
+
+	if _, err := New[TestData](Options{DSN: filepath.Join(t.TempDir(), "missing.db"), Codec: &codec.JSON{}, ReadOnly: true}); err == nil {
+		t.Error("New(ReadOnly) on a missing file succeeded")
+	}
+}
+
+func TestWatchKinds(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+	if err := s.SetAll("b", map[string]TestData{"old": {Name: "old"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, cancel, err := store.WatchKinds(s, []string{"a", "b"}, store.WithInitialReplay[TestData]())
+	if err != nil {
+		t.Fatalf("WatchKinds() error = %v", err)
+	}
+	// wait for the replay before writing, it is sent asynchronously
+	select {
+	case ev := <-ch:
+		if ev.Kind != "b" || ev.Name != "old" {
+			t.Fatalf("replayed %s/%s", ev.Kind, ev.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no replay")
+	}
+	s.Set("a", "x", TestData{Value: 1})
+	s.Set("c", "ignored", TestData{Value: 2})
+	s.Set("b", "y", TestData{Value: 3})
+	s.Delete("a", "x")
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-ch:
+			got = append(got, fmt.Sprintf("%s %s/%s", ev.EventType, ev.Kind, ev.Name))
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, want 3 events", got)
+		}
+	}
+	if g := strings.Join(got, ","); g != "create a/x,create b/y,delete a/x" {
+		t.Fatalf("events = %s", g)
+	}
+
+	cancel()
+	h := s.(*sqLiteStore[TestData]).h
+	h.muSubs.RLock()
+	left := len(h.subs)
+	h.muSubs.RUnlock()
+	if left != 0 {
+		t.Errorf("%d kinds still have watchers after cancel", left)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed after cancel")
+	}
+	cancel()
+
+	if _, _, err := store.WatchKinds(s, nil); !errors.Is(err, store.ErrNoKinds) {
+		t.Errorf("WatchKinds(nil) error = %v, want ErrNoKinds", err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	var events []string
+	so := store.StoreOptions[TestData]{
+		Defaults: map[string]map[string]TestData{
+			"config": {"a": {Name: "a", Value: 1}, "b": {Name: "b", Value: 2}},
+		},
+		AfterWrite: func(ev *store.Event[TestData]) {
+			events = append(events, fmt.Sprintf("%s %s/%s", ev.EventType, ev.Kind, ev.Name))
+		},
+	}
+	s, err := New(Options{DSN: dsn, Codec: &codec.JSON{}}, so)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if got := strings.Join(events, ","); got != "create config/a,create config/b" {
+		t.Errorf("events = %s", got)
+	}
+	// the application changes a and drops b
+	s.Set("config", "a", TestData{Name: "a", Value: 10})
+	s.Delete("config", "b")
+	s.Close()
+
+	// reopening recreates b but keeps the changed a
+	events = nil
+	so.Defaults["config"]["c"] = TestData{Name: "c", Value: 3}
+	s, err = New(Options{DSN: dsn, Codec: &codec.JSON{}}, so)
+	if err != nil {
+		t.Fatalf("New() reopen error = %v", err)
+	}
+	defer s.Close()
+	m, _ := s.List("config")
+	if m["a"].Value != 10 || m["b"].Value != 2 || m["c"].Value != 3 {
+		t.Errorf("List() after reopen = %v", m)
+	}
+	if got := strings.Join(events, ","); got != "create config/b,create config/c" {
+		t.Errorf("events after reopen = %s", got)
+	}
+
+	so.ValidateFns = map[string]store.ValidateFunc[TestData]{"config": func(TestData) error { return errors.New("invalid") }}
+	if _, err := New(Options{DSN: dsn, Codec: &codec.JSON{}}, so); err == nil {
+		t.Error("New() with an invalid default succeeded")
+	}
+}
+
+func TestEventAt(t *testing.T) {
+	fake := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	s, err := New(Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db"), Codec: &codec.JSON{}},
+		store.StoreOptions[TestData]{Now: func() time.Time { return fake }})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+
+	ch, cancel, _ := s.Watch("test")
+	defer cancel()
+	before := time.Now().Add(-time.Second)
+	s.Set("test", "a", TestData{Value: 1})
+	s.SetFn("test", "a", func(v TestData) (TestData, error) { v.Value++; return v, nil })
+	s.SetAll("test", map[string]TestData{"b": {Value: 2}})
+	s.Delete("test", "b")
+	for i := 0; i < 4; i++ {
+		select {
+		case ev := <-ch:
+			if !ev.At.Equal(fake) {
+				t.Errorf("%s %s At = %v, want the clock's %v", ev.EventType, ev.Name, ev.At, fake)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events, want 4", i)
+		}
+	}
+
+	// replay uses updated_at, written by SQLite, not the clock
+	rch, rcancel, _ := s.Watch("test", store.WithInitialReplay[TestData]())
+	defer rcancel()
+	select {
+	case ev := <-rch:
+		if ev.At.Before(before) || ev.At.After(time.Now()) {
+			t.Errorf("replayed At = %v, want the row's updated_at", ev.At)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no replay")
+	}
+}
+
+// panicCodec panics on Marshal of values named "boom" and on Unmarshal of
+// their encoding.
+type panicCodec struct {
+	codec.JSON
+}
+
+func (p *panicCodec) Marshal(v any) ([]byte, error) {
+	if d, ok := v.(TestData); ok && d.Name == "boom" {
+		panic("marshal boom")
+	}
+	return p.JSON.Marshal(v)
+}
+
+func (p *panicCodec) MarshalAppend(dst []byte, v any) ([]byte, error) {
+	if d, ok := v.(TestData); ok && d.Name == "boom" {
+		panic("marshal boom")
+	}
+	return p.JSON.MarshalAppend(dst, v)
+}
+
+func (p *panicCodec) Unmarshal(data []byte, v any) error {
+	if strings.Contains(string(data), `"boom-on-read"`) {
+		panic("unmarshal boom")
+	}
+	return p.JSON.Unmarshal(data, v)
+}
+
+func TestCodecPanic(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:         "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec:       &panicCodec{},
+		BusyTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	if _, err := s.Set("test", "a", TestData{Name: "boom"}); !errors.Is(err, store.ErrCodecPanic) {
+		t.Errorf("Set() error = %v, want ErrCodecPanic", err)
+	}
+
+	// the panic in the middle of a batch rolls the whole transaction back
+	err = s.SetAll("test", map[string]TestData{"a": {Name: "ok"}, "b": {Name: "boom"}, "c": {Name: "ok"}})
+	if !errors.Is(err, store.ErrCodecPanic) {
+		t.Errorf("SetAll() error = %v, want ErrCodecPanic", err)
+	}
+	if n, _ := s.Count("test"); n != 0 {
+		t.Errorf("Count() = %d after failed SetAll, want 0", n)
+	}
+
+	// reading a value the codec chokes on
+	if _, err := s.Set("test", "r", TestData{Name: "boom-on-read"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, _, err := s.Get("test", "r"); !errors.Is(err, store.ErrCodecPanic) {
+		t.Errorf("Get() error = %v, want ErrCodecPanic", err)
+	}
+	if _, err := s.SetFn("test", "r", func(v TestData) (TestData, error) { return v, nil }); !errors.Is(err, store.ErrCodecPanic) {
+		t.Errorf("SetFn() error = %v, want ErrCodecPanic", err)
+	}
+	// Delete removes the value all the same
+	if existed, _, err := s.Delete("test", "r"); !existed || !errors.Is(err, store.ErrCodecPanic) {
+		t.Errorf("Delete() = %v, %v, want true, ErrCodecPanic", existed, err)
+	}
+
+	// no transaction was left open: writes still go through at once
+	start := time.Now()
+	if _, err := s.Set("test", "a", TestData{Name: "ok"}); err != nil {
+		t.Fatalf("Set() after panics error = %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Set() after panics took %v, a transaction was left open", d)
+	}
+	if n, _ := s.Count("test"); n != 1 {
+		t.Errorf("Count() = %d, want 1", n)
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(dir, "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{EventHistory: 3})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	for i := 1; i <= 5; i++ {
+		s.Set("k", fmt.Sprint("key", i), TestData{Name: "n", Value: i})
+	}
+
+	ch, cancel, _ := s.Watch("k", store.WithReplayHistory[TestData]())
+	defer cancel()
+	s.Set("k", "key6", TestData{Name: "n", Value: 6})
+	for _, want := range []int{3, 4, 5, 6} {
+		select {
+		case ev := <-ch:
+			if ev.Object.Value != want || ev.At.IsZero() {
+				t.Fatalf("event = %s %+v at %v, want value %d", ev.Name, ev.Object, ev.At, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %d", want)
+		}
+	}
+
+	plain, cancelPlain, _ := s.Watch("k")
+	defer cancelPlain()
+	if len(plain) != 0 {
+		t.Fatalf("replayed %d events without WithReplayHistory", len(plain))
+	}
+}
+
+func TestWatchAfterUnwatchedWrites(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+
+	// no watchers yet: events are not built
+	s.Set("k", "a", TestData{Name: "a", Value: 1})
+	s.SetAll("k", map[string]TestData{"a": {Name: "a", Value: 2}, "b": {Name: "b", Value: 1}})
+
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+	s.Set("k", "a", TestData{Name: "a", Value: 3})
+	s.SetAll("k", map[string]TestData{"b": {Name: "b", Value: 2}, "c": {Name: "c", Value: 1}})
+	s.SetFn("k", "c", func(v TestData) (TestData, error) { v.Value++; return v, nil })
+	s.Delete("k", "b")
+
+	want := []string{"update a", "create c", "update b", "update c", "delete b"}
+	for _, w := range want {
+		select {
+		case ev := <-ch:
+			if got := string(ev.EventType) + " " + ev.Name; got != w {
+				t.Fatalf("event = %q, want %q", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %q", w)
+		}
+	}
+}
+
+func TestEncryptedPerKind(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	s, err := New[TestData](Options{
+		DSN: dsn,
+		Codec: &codec.Encrypted{
+			Codec:    &codec.JSON{},
+			Key:      []byte("public-key-16byt"),
+			KindKeys: map[string][]byte{"pii": []byte("pii-key-of-32-bytes-for-aes-256!")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+
+	s.Set("pii", "alice", TestData{Name: "alice", Value: 1})
+	s.Set("public", "bob", TestData{Name: "bob", Value: 2})
+	if created, _ := s.Set("pii", "alice", TestData{Name: "alice", Value: 1}); created {
+		t.Error("re-Set created the key")
+	}
+	for kind, key := range map[string]string{"pii": "alice", "public": "bob"} {
+		if v, ok, err := s.Get(kind, key); err != nil || !ok || v.Name != key {
+			t.Errorf("Get(%s, %s) = %+v, %v, %v", kind, key, v, ok, err)
+		}
+	}
+
+	raw, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var blob []byte
+	if err := raw.QueryRow(`SELECT value FROM zestor_kv WHERE kind='pii' AND key='alice'`).Scan(&blob); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(blob), "alice") {
+		t.Fatal("value stored in plaintext")
+	}
+	// a blob moved to another kind doesn't decrypt there
+	if _, err := raw.Exec(`INSERT INTO zestor_kv(kind, key, value) VALUES('public', 'alice', ?)`, blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get("public", "alice"); !errors.Is(err, codec.ErrDecrypt) {
+		t.Errorf("Get of moved blob error = %v, want ErrDecrypt", err)
+	}
+}
+
+// keyTagCodec prefixes encodings with the kind and key they belong to and
+// refuses to decode them anywhere else.
+type keyTagCodec struct{ codec.JSON }
+
+func (c *keyTagCodec) MarshalCtx(kind, key string, v any) ([]byte, error) {
+	data, err := c.Marshal(v)
+	return append([]byte(kind+"/"+key+":"), data...), err
+}
+
+func (c *keyTagCodec) UnmarshalCtx(kind, key string, data []byte, v any) error {
+	rest, ok := bytes.CutPrefix(data, []byte(kind+"/"+key+":"))
+	if !ok {
+		return fmt.Errorf("value of %s/%s is %q", kind, key, data)
+	}
+	return c.Unmarshal(rest, v)
+}
+
+func TestContextCodec(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	s, err := New[TestData](Options{DSN: dsn, Codec: &keyTagCodec{}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.Set("notes", "a", TestData{Name: "a", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	s.SetAll("notes", map[string]TestData{"b": {Name: "b"}, "c": {Name: "c"}})
+	if _, err := s.SetFn("notes", "a", func(v TestData) (TestData, error) { v.Value++; return v, nil }); err != nil {
+		t.Fatalf("SetFn() error = %v", err)
+	}
+	if v, _, err := s.Get("notes", "a"); err != nil || v.Value != 2 {
+		t.Errorf("Get() = %+v, %v", v, err)
+	}
+	if m, err := s.List("notes"); err != nil || len(m) != 3 {
+		t.Errorf("List() = %v, %v", m, err)
+	}
+	if _, prev, err := s.Delete("notes", "b"); err != nil || prev.Name != "b" {
+		t.Errorf("Delete() = %+v, %v", prev, err)
+	}
+
+	raw, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var blob []byte
+	if err := raw.QueryRow(`SELECT value FROM zestor_kv WHERE kind='notes' AND key='c'`).Scan(&blob); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(blob, []byte("notes/c:")) {
+		t.Errorf("stored value = %q, want the notes/c tag", blob)
+	}
+}
+
+func TestOpenContextCodec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := store.Open[TestData]("sqlite://"+path, &keyTagCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Set("notes", "a", TestData{Name: "a", Value: 1}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if v, ok, err := s.Get("notes", "a"); err != nil || !ok || v.Value != 1 {
+		t.Errorf("Get() = %+v, %v, %v", v, ok, err)
+	}
+
+	raw, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var blob []byte
+	if err := raw.QueryRow(`SELECT value FROM zestor_kv WHERE kind='notes' AND key='a'`).Scan(&blob); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(blob, []byte("notes/a:")) {
+		t.Errorf("stored value = %q, want the notes/a tag", blob)
+	}
+}
+
+func TestGroupCommitFailedStore(t *testing.T) {
+	db, err := Open(Options{
+		DSN:         "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec:       &codec.JSON{},
+		GroupCommit: GroupCommit{MaxDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	so := store.StoreOptions[TestData]{
+		ValidateFns: map[string]store.ValidateFunc[TestData]{"k": func(TestData) error { return errors.New("invalid") }},
+		Defaults:    map[string]map[string]TestData{"k": {"a": {}}},
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if _, err := NewWithDB(db, &codec.JSON{}, so); err == nil {
+			t.Fatal("NewWithDB() with invalid defaults succeeded")
+		}
+	}
+	// the committer starts once the store is built
+	if after := runtime.NumGoroutine(); after >= before+20 {
+		t.Errorf("goroutines: %d before, %d after 20 failed stores", before, after)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	errRejected := errors.New("rejected")
+	s, err := New[TestData](Options{
+		DSN:         "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec:       &codec.JSON{},
+		GroupCommit: GroupCommit{MaxDelay: 5 * time.Millisecond, MaxBatch: 16},
+		WithinWrite: func(tx *sql.Tx, ev *store.Event[any]) error {
+			if ev.Name == "reject" {
+				return errRejected
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel, _ := s.Watch("k", store.WithBufferSize[TestData](1024))
+	defer cancel()
+
+	// concurrent writers see the same created/no-op/update results as
+	// without batching
+	const n = 50
+	var wg sync.WaitGroup
+	results := make([][3]bool, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			var e [3]error
+			results[i][0], e[0] = s.Set("k", key, TestData{Name: key})
+			results[i][1], e[1] = s.Set("k", key, TestData{Name: key})
+			results[i][2], e[2] = s.Set("k", key, TestData{Name: key, Value: 1})
+			errs[i] = errors.Join(e[:]...)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if results[i] != [3]bool{true, false, false} {
+			t.Fatalf("key%d: created = %v", i, results[i])
+		}
+	}
+	// per key: one create then one update, nothing for the no-op
+	seen := map[string][]store.EventType{}
+	for i := 0; i < 2*n; i++ {
+		ev := <-ch
+		seen[ev.Name] = append(seen[ev.Name], ev.EventType)
+	}
+	for key, types := range seen {
+		if len(types) != 2 || types[0] != store.EventTypeCreate || types[1] != store.EventTypeUpdate {
+			t.Fatalf("%s: events %v", key, types)
+		}
+	}
+
+	// a failing write in a batch doesn't fail the others
+	var rejectErr, okErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); _, rejectErr = s.Set("k", "reject", TestData{Name: "x"}) }()
+	go func() { defer wg.Done(); _, okErr = s.Set("k", "accepted", TestData{Name: "y"}) }()
+	wg.Wait()
+	if !errors.Is(rejectErr, errRejected) || okErr != nil {
+		t.Fatalf("reject err = %v, accepted err = %v", rejectErr, okErr)
+	}
+	if _, ok, _ := s.Get("k", "reject"); ok {
+		t.Fatal("rejected write was committed")
+	}
+	if _, ok, _ := s.Get("k", "accepted"); !ok {
+		t.Fatal("accepted write is missing")
+	}
+	if ev := <-ch; ev.Name != "accepted" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	existed, prev, err := s.Delete("k", "accepted")
+	if err != nil || !existed || prev.Name != "y" {
+		t.Fatalf("Delete = %v, %+v, %v", existed, prev, err)
+	}
+	if existed, _, err := s.Delete("k", "accepted"); err != nil || existed {
+		t.Fatalf("second Delete = %v, %v", existed, err)
+	}
+	if ev := <-ch; ev.EventType != store.EventTypeDelete || ev.Name != "accepted" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	// writes in flight when Close is called still commit
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			_, _ = s.Set("late", fmt.Sprintf("key%d", i), TestData{Value: i})
+		}(i)
+	}
+	time.Sleep(time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if _, err := s.Set("late", "after", TestData{}); !errors.Is(err, store.ErrClosed) {
+		t.Fatalf("Set after Close: %v", err)
+	}
+}
+
+// eventNames receives up to n events from ch and returns them as
+// "type:key,...".
+func eventNames[T any](ch <-chan *store.Event[T], n int) string {
+	var names []string
+	for len(names) < n {
+		select {
+		case ev := <-ch:
+			names = append(names, string(ev.EventType)+":"+ev.Name)
+		case <-time.After(time.Second):
+			return strings.Join(names, ",")
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func TestTransitionFilter(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{EventHistory: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Name set to empty, from a non-empty value or by deleting one
+	emptied := store.WithTransitionFilter[TestData](func(old, new TestData) bool {
+		return old.Name != "" && new.Name == ""
+	})
+	ch, cancel, _ := s.Watch("k", emptied)
+	defer cancel()
+	// a store of another type on the same DB decodes the replaced value itself
+	other, err := NewWithDB[map[string]any](s.(*sqLiteStore[TestData]).h, &codec.JSON{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCh, cancelOther, _ := other.Watch("k", store.WithTransitionFilter[map[string]any](func(old, new map[string]any) bool {
+		return old["name"] != nil && old["name"] != "" && (new == nil || new["name"] == "")
+	}))
+	defer cancelOther()
+
+	s.Set("k", "a", TestData{})
+	s.Set("k", "a", TestData{Name: "x"})
+	s.Set("k", "a", TestData{Value: 1})
+	s.Set("k", "b", TestData{Name: "y"})
+	s.SetFn("k", "b", func(v TestData) (TestData, error) { v.Name = ""; return v, nil })
+	s.Set("k", "c", TestData{Name: "z"})
+	s.SetAll("k", map[string]TestData{"c": {}})
+	s.Set("k", "d", TestData{Name: "w"})
+	s.Delete("k", "d")
+	s.Delete("k", "a")
+
+	want := "update:a,update:b,update:c,delete:d"
+	if got := eventNames(ch, 4); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got := eventNames(otherCh, 4); got != want {
+		t.Fatalf("other store got %s, want %s", got, want)
+	}
+	if len(ch) != 0 || len(otherCh) != 0 {
+		t.Fatalf("%d and %d extra events", len(ch), len(otherCh))
+	}
+
+	// the history keeps the replaced values
+	hist, cancelHist, _ := s.Watch("k", emptied, store.WithReplayHistory[TestData]())
+	defer cancelHist()
+	if len(hist) != 4 {
+		t.Fatalf("replayed %d events, want 4", len(hist))
+	}
+
+	// creates, including the initial replay, pass the zero value as old
+	s.Set("k", "e", TestData{Name: "v"})
+	created, cancelCreated, _ := s.Watch("k", store.WithInitialReplay[TestData](), store.WithTransitionFilter[TestData](func(old, new TestData) bool {
+		return old.Name == "" && new.Name != ""
+	}))
+	defer cancelCreated()
+	select {
+	case ev := <-created:
+		if ev.Name != "e" || ev.EventType != store.EventTypeCreate {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no initial event")
+	}
+}
+
+func TestReadReplicas(t *testing.T) {
+	dir := t.TempDir()
+	primary := "file:" + filepath.Join(dir, "primary.db")
+	w, err := New[TestData](Options{DSN: primary, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// snapshot the primary into a replica file after each version of "a"
+	db := w.(*sqLiteStore[TestData]).db
+	for i, name := range []string{"r1.db", "r2.db"} {
+		if _, err := w.Set("k", "a", TestData{Value: i + 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`VACUUM INTO ?`, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Set("k", "a", TestData{Value: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// reads alternate between the replicas, each lagging behind
+	s, err := New[TestData](Options{
+		DSN:      primary,
+		Codec:    &codec.JSON{},
+		ReadDSNs: []string{filepath.Join(dir, "r1.db"), "file:" + filepath.Join(dir, "r2.db")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	seen := map[int]int{}
+	for i := 0; i < 4; i++ {
+		v, _, err := s.Get("k", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[v.Value]++
+	}
+	if seen[1] != 2 || seen[2] != 2 {
+		t.Fatalf("read values %v, want 1 and 2 twice each", seen)
+	}
+	if all, err := s.GetAll(); err != nil || all["k"]["a"].Value == 3 {
+		t.Fatalf("GetAll = %v, %v, want a replica's", all, err)
+	}
+	// writes and SetFn's read go to the primary
+	if _, err := s.SetFn("k", "a", func(v TestData) (TestData, error) {
+		if v.Value != 3 {
+			t.Errorf("SetFn read %d, want 3", v.Value)
+		}
+		v.Value = 4
+		return v, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := w.Get("k", "a"); v.Value != 4 {
+		t.Fatalf("primary has %d, want 4", v.Value)
+	}
+
+	// with read-your-writes, reads after a write of the store see it
+	ryw, err := New[TestData](Options{
+		DSN:            primary,
+		Codec:          &codec.JSON{},
+		ReadDSNs:       []string{filepath.Join(dir, "r1.db")},
+		ReadYourWrites: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ryw.Close()
+	if v, _, _ := ryw.Get("k", "a"); v.Value != 1 {
+		t.Fatalf("read %d before writing, want the replica's 1", v.Value)
+	}
+	if _, err := ryw.Set("k", "b", TestData{Value: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := ryw.Get("k", "a"); v.Value != 4 {
+		t.Fatalf("read %d after writing, want the primary's 4", v.Value)
+	}
+
+	// a replica that fails falls back to the primary
+	missing, err := New[TestData](Options{
+		DSN:      primary,
+		Codec:    &codec.JSON{},
+		ReadDSNs: []string{filepath.Join(dir, "missing.db")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+	if n, err := missing.Count("k"); err != nil || n != 2 {
+		t.Fatalf("Count = %d, %v, want 2 from the primary", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Fatalf("replica file was created: %v", err)
+	}
+}
+
+// patternReader yields n bytes of a repeating pattern, failing with err
+// once failAt bytes were read when err is set.
+type patternReader struct {
+	off, n, failAt int64
+	err            error
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	if p.err != nil && p.off >= p.failAt {
+		return 0, p.err
+	}
+	if p.off >= p.n {
+		return 0, io.EOF
+	}
+	if rest := p.n - p.off; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	for i := range b {
+		b[i] = byte((p.off + int64(i)) % 251)
+	}
+	p.off += int64(len(b))
+	return len(b), nil
+}
+
+// checkPattern reads r to EOF and reports whether it yields the n bytes of
+// a patternReader.
+func checkPattern(t *testing.T, r io.Reader, n int64) {
+	t.Helper()
+	buf := make([]byte, 64<<10)
+	var off int64
+	for {
+		m, err := r.Read(buf)
+		for i := 0; i < m; i++ {
+			if buf[i] != byte((off+int64(i))%251) {
+				t.Fatalf("byte %d = %d, want %d", off+int64(i), buf[i], byte((off+int64(i))%251))
+			}
+		}
+		off += int64(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if off != n {
+		t.Fatalf("read %d bytes, want %d", off, n)
+	}
+}
+
+func TestStreamer(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:             "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec:           &codec.JSON{},
+		StreamThreshold: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	st := s.(Streamer)
+	ch, cancel, err := s.Watch("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	// a small value goes to the main table, where Get decodes it
+	small := `{"name":"small","value":1}`
+	if err := st.SetReader("blob", "s", strings.NewReader(small), int64(len(small))); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := s.Get("blob", "s"); err != nil || !ok || v.Name != "small" {
+		t.Fatalf("Get = %+v, %v, %v", v, ok, err)
+	}
+	r, meta, ok, err := st.GetReader("blob", "s")
+	if err != nil || !ok || meta.Size != int64(len(small)) || meta.Version != 1 {
+		t.Fatalf("GetReader = %+v, %v, %v", meta, ok, err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != small {
+		t.Fatalf("GetReader read %q", got)
+	}
+	if err := st.SetReader("blob", "s", strings.NewReader("{}"), 10); err == nil {
+		t.Fatal("SetReader with a short reader: want error")
+	}
+
+	// a large value is chunked and invisible to typed reads
+	const size = 3*streamChunk + 100
+	if err := st.SetReader("blob", "big", &patternReader{n: size}, size); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get("blob", "big"); ok {
+		t.Fatal("Get of a chunked value: want not found")
+	}
+	r, meta, ok, err = st.GetReader("blob", "big")
+	if err != nil || !ok || meta.Size != size || meta.Version != 1 || meta.UpdatedAt.IsZero() {
+		t.Fatalf("GetReader = %+v, %v, %v", meta, ok, err)
+	}
+	// the reader keeps seeing the value it was opened on
+	if err := st.SetReader("blob", "big", &patternReader{n: 10}, -1); err != nil {
+		t.Fatal(err)
+	}
+	checkPattern(t, r, size)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r, meta, _, _ = st.GetReader("blob", "big"); meta.Size != 10 || meta.Version != 2 {
+		t.Fatalf("meta after replace = %+v", meta)
+	}
+	checkPattern(t, r, 10)
+	r.Close()
+
+	// a failed write leaves the previous value
+	boom := errors.New("boom")
+	if err := st.SetReader("blob", "big", &patternReader{n: size, failAt: 2 * streamChunk, err: boom}, size); !errors.Is(err, boom) {
+		t.Fatalf("interrupted SetReader: got %v, want %v", err, boom)
+	}
+	if r, meta, _, _ = st.GetReader("blob", "big"); meta.Size != 10 || meta.Version != 2 {
+		t.Fatalf("meta after failed write = %+v", meta)
+	}
+	checkPattern(t, r, 10)
+	r.Close()
+
+	// Set replaces a chunked value, Delete removes one
+	if _, err := s.Set("blob", "big", TestData{Name: "typed"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := s.Get("blob", "big"); !ok || v.Name != "typed" {
+		t.Fatalf("Get after Set = %+v, %v", v, ok)
+	}
+	if err := st.SetReader("blob", "big", &patternReader{n: size}, size); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get("blob", "big"); ok {
+		t.Fatal("Get after chunked SetReader: want not found")
+	}
+	if existed, _, err := s.Delete("blob", "big"); err != nil || !existed {
+		t.Fatalf("Delete = %v, %v", existed, err)
+	}
+	if _, _, ok, _ := st.GetReader("blob", "big"); ok {
+		t.Fatal("GetReader after Delete: want not found")
+	}
+	var chunks int
+	db := s.(*sqLiteStore[TestData]).db
+	if err := db.QueryRow(`SELECT COUNT(*) FROM zestor_blobs`).Scan(&chunks); err != nil || chunks != 0 {
+		t.Fatalf("chunks left = %d, %v", chunks, err)
+	}
+
+	want := "create:s,create:big,update:big,update:big,update:big,delete:big"
+	if got := eventNames(ch, 6); got != want {
+		t.Fatalf("events = %s, want %s", got, want)
+	}
+}
+
+func TestStreamerLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 64MB")
+	}
+	s, err := New[TestData](Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db"), Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	st := s.(Streamer)
+
+	const size = 64 << 20
+	if err := st.SetReader("blob", "v", &patternReader{n: size}, size); err != nil {
+		t.Fatal(err)
+	}
+	runtime.GC()
+	var base runtime.MemStats
+	runtime.ReadMemStats(&base)
+
+	// sample the heap while reading; the value is never held whole
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak.Load() {
+				peak.Store(m.HeapAlloc)
+			}
+		}
+	}()
+	r, meta, ok, err := st.GetReader("blob", "v")
+	if err != nil || !ok || meta.Size != size {
+		t.Fatalf("GetReader = %+v, %v, %v", meta, ok, err)
+	}
+	checkPattern(t, r, size)
+	r.Close()
+	close(done)
+	wg.Wait()
+
+	if grew := int64(peak.Load()) - int64(base.HeapAlloc); grew > 32<<20 {
+		t.Fatalf("heap grew by %dMB reading a 64MB value", grew>>20)
+	}
+}
+
+func TestDecodeParallelism(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:               "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec:             &codec.JSON{},
+		DecodeParallelism: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	values := make(map[string]TestData)
+	for i := 0; i < 1000; i++ {
+		values[fmt.Sprint(i)] = TestData{Name: fmt.Sprint(i), Value: i}
+	}
+	if err := s.SetAll("k", values); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.List("k")
+	if err != nil || len(got) != len(values) {
+		t.Fatalf("List = %d values, %v", len(got), err)
+	}
+	for k, v := range values {
+		if got[k] != v {
+			t.Fatalf("List[%s] = %+v, want %+v", k, got[k], v)
+		}
+	}
+	even, err := s.List("k", func(_ string, v TestData) bool { return v.Value%2 == 0 })
+	if err != nil || len(even) != 500 {
+		t.Fatalf("filtered List = %d values, %v", len(even), err)
+	}
+
+	// a row that doesn't decode fails the whole List
+	db := s.(*sqLiteStore[TestData]).db
+	if _, err := db.Exec(`INSERT INTO zestor_kv(kind,key,value) VALUES('k','bad','{')`); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := s.List("k"); err == nil || m != nil {
+		t.Fatalf("List with a corrupt row = %d values, %v", len(m), err)
+	}
+}
+
+func TestAllowedKinds(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	s, err := New(Options{DSN: dsn, Codec: &codec.JSON{}}, store.StoreOptions[TestData]{AllowedKinds: []string{"notes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Set("notes", "a", TestData{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("note", "a", TestData{Name: "a"}); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("Set of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if _, err := s.List("note"); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("List of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if _, _, err := s.Watch("note"); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("Watch of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if err := s.(Streamer).SetReader("note", "a", strings.NewReader("{}"), 2); !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("SetReader of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+	if n, err := s.Count("notes"); err != nil || n != 1 {
+		t.Fatalf("Count = %d, %v", n, err)
+	}
+
+	// defaults must stay within the allowed kinds
+	_, err = New(Options{DSN: dsn, Codec: &codec.JSON{}}, store.StoreOptions[TestData]{
+		AllowedKinds: []string{"notes"},
+		Defaults:     map[string]map[string]TestData{"users": {"root": {}}},
+	})
+	if !errors.Is(err, store.ErrUnknownKind) {
+		t.Fatalf("New with defaults of an unknown kind: got %v, want ErrUnknownKind", err)
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+			s, err := New(Options{DSN: dsn, Codec: &codec.JSON{}, TablePerKind: perKind},
+				store.StoreOptions[TestData]{MaxListResults: 3, MaxGetAllResults: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for i := 0; i < 3; i++ {
+				s.Set("a", fmt.Sprint(i), TestData{Value: i})
+				s.Set("b", fmt.Sprint(i), TestData{Value: i})
+			}
+
+			// exactly at the limit
+			if m, err := s.List("a"); err != nil || len(m) != 3 {
+				t.Fatalf("List at the limit = %d values, %v", len(m), err)
+			}
+			s.Set("a", "3", TestData{Value: 3})
+			var tooLarge *store.ResultTooLargeError
+			if _, err := s.List("a", func(_ string, v TestData) bool { return v.Value == 0 }); !errors.As(err, &tooLarge) || tooLarge.Count != 4 || tooLarge.Limit != 3 {
+				t.Fatalf("List over the limit: got %v", err)
+			}
+			if _, err := s.Values("a"); !errors.Is(err, store.ErrResultTooLarge) {
+				t.Fatalf("Values over the limit: got %v", err)
+			}
+			if _, err := s.GetAll(); !errors.As(err, &tooLarge) || tooLarge.Count != 7 || tooLarge.Limit != 5 {
+				t.Fatalf("GetAll over the limit: got %v", err)
+			}
+			// prefix reads are not guarded
+			if m, err := store.ListPrefix(s, "a", ""); err != nil || len(m) != 4 {
+				t.Fatalf("ListPrefix = %d values, %v", len(m), err)
+			}
+
+			// no limit by default
+			u, err := NewWithDB[TestData](s.(*sqLiteStore[TestData]).h, &codec.JSON{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m, err := u.List("a"); err != nil || len(m) != 4 {
+				t.Fatalf("List without a limit = %d values, %v", len(m), err)
+			}
+			if m, err := u.GetAll(); err != nil || len(m) != 2 {
+				t.Fatalf("GetAll without a limit = %d kinds, %v", len(m), err)
+			}
+		})
+	}
+}
+
+func TestSwap(t *testing.T) {
+	// keyTagCodec binds each value to its key, so a swap must re-encode
+	for _, c := range []codec.Codec{&codec.JSON{}, &keyTagCodec{}} {
+		t.Run(fmt.Sprintf("%T", c), func(t *testing.T) {
+			s, err := New[TestData](Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db"), Codec: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			active, staging := TestData{Name: "blue"}, TestData{Name: "green"}
+			s.Set("config", "active", active)
+			s.Set("config", "staging", staging)
+			ch, cancel, _ := s.Watch("config")
+			defer cancel()
+
+			if err := store.Swap(s, "config", "active", "staging"); err != nil {
+				t.Fatal(err)
+			}
+			if v, _, err := s.Get("config", "active"); err != nil || v != staging {
+				t.Fatalf("active = %+v, %v", v, err)
+			}
+			if v, _, err := s.Get("config", "staging"); err != nil || v != active {
+				t.Fatalf("staging = %+v, %v", v, err)
+			}
+			for _, want := range []struct {
+				key string
+				v   TestData
+			}{{"active", staging}, {"staging", active}} {
+				if ev := <-ch; ev.EventType != store.EventTypeUpdate || ev.Name != want.key || ev.Object != want.v {
+					t.Fatalf("event = %+v, want update of %s", ev, want.key)
+				}
+			}
+
+			if err := store.Swap(s, "config", "active", "missing"); !errors.Is(err, store.ErrKeyNotFound) {
+				t.Fatalf("Swap with a missing key: got %v", err)
+			}
+			if v, _, _ := s.Get("config", "active"); v != staging {
+				t.Fatalf("active after failed Swap = %+v", v)
+			}
+			// equal values: nothing to do
+			s.Set("config", "copy", staging)
+			if err := store.Swap(s, "config", "active", "copy"); err != nil {
+				t.Fatal(err)
+			}
+			if ev := <-ch; ev.Name != "copy" || ev.EventType != store.EventTypeCreate || len(ch) != 0 {
+				t.Fatalf("event = %+v (+%d)", ev, len(ch))
+			}
+		})
+	}
+}
+
+func TestReplayLast(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{EventHistory: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("k", "a", TestData{Value: 1})
+	s.Set("k", "b", TestData{Value: 1})
+	s.Set("k", "a", TestData{Value: 2}) // seq 3, the oldest kept
+	s.Set("k", "c", TestData{Value: 1})
+	s.Set("k", "d", TestData{Value: 1})
+	s.Delete("k", "b") // seq 6
+
+	seqs := func(ch <-chan *store.Event[TestData], n int) string {
+		var out []string
+		for len(out) < n {
+			select {
+			case ev := <-ch:
+				out = append(out, fmt.Sprint(ev.Name, ":", ev.Seq))
+			case <-time.After(time.Second):
+				return strings.Join(out, ",")
+			}
+		}
+		return strings.Join(out, ",")
+	}
+
+	// the last two of the wanted events
+	ch, cancel, _ := s.Watch("k", store.WithReplayLast[TestData](2), store.WithEventTypes[TestData](store.EventTypeCreate, store.EventTypeUpdate))
+	if got := seqs(ch, 2); got != "c:4,d:5" || len(ch) != 0 {
+		t.Fatalf("replayed %s (+%d), want c:4,d:5", got, len(ch))
+	}
+	s.Set("k", "e", TestData{Value: 1})
+	if got := seqs(ch, 1); got != "e:7" {
+		t.Fatalf("live event %s, want e:7", got)
+	}
+	cancel()
+
+	// a store of another type on the DB sees the same sequence
+	other, err := NewWithDB[map[string]any](s.(*sqLiteStore[TestData]).h, &codec.JSON{}, store.StoreOptions[map[string]any]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	och, ocancel, _ := other.Watch("k", store.WithReplayLast[map[string]any](1))
+	defer ocancel()
+	select {
+	case ev := <-och:
+		if ev.Name != "e" || ev.Seq != 7 {
+			t.Fatalf("other store replayed %s:%d, want e:7", ev.Name, ev.Seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("other store replayed nothing")
+	}
+
+	// the initial replay leaves out e, whose latest change was replayed
+	ch, cancel, _ = s.Watch("k", store.WithReplayLast[TestData](2), store.WithInitialReplay[TestData]())
+	defer cancel()
+	if got := seqs(ch, 2); got != "b:6,e:7" {
+		t.Fatalf("replayed %s, want b:6,e:7", got)
+	}
+	if got := seqs(ch, 3); got != "a:0,c:0,d:0" || len(ch) != 0 {
+		t.Fatalf("initial replay %s (+%d), want a:0,c:0,d:0", got, len(ch))
+	}
+}
+
+func TestOpenPaths(t *testing.T) {
+	dir := t.TempDir()
+	open := func(o Options) error {
+		o.Codec = &codec.JSON{}
+		s, err := New[TestData](o)
+		if err == nil {
+			s.Close()
+		}
+		return err
+	}
+
+	// a missing directory is named, or created with CreateDirs
+	nested := filepath.Join(dir, "var", "data", "notes.db")
+	err := open(Options{DSN: "file:" + nested})
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), filepath.Dir(nested)) || !strings.Contains(err.Error(), "CreateDirs") {
+		t.Fatalf("missing directory: %v", err)
+	}
+	if err := open(Options{DSN: "file:" + nested, CreateDirs: true, DirMode: 0o700}); err != nil {
+		t.Fatalf("CreateDirs: %v", err)
+	}
+	if info, err := os.Stat(filepath.Dir(nested)); err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("created directory: %v, %v", info, err)
+	}
+
+	// a bare path is taken as a file: URI, parameters included
+	bare := filepath.Join(dir, "bare.db")
+	if err := open(Options{DSN: bare + "?_pragma=busy_timeout(100)"}); err != nil {
+		t.Fatalf("bare path: %v", err)
+	}
+	if _, err := os.Stat(bare); err != nil {
+		t.Fatalf("bare path did not create the file: %v", err)
+	}
+
+	// read-only opens don't create anything
+	missing := filepath.Join(dir, "missing.db")
+	if err := open(Options{DSN: missing, ReadOnly: true}); !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "mode=ro") {
+		t.Fatalf("read-only missing file: %v", err)
+	}
+	if err := open(Options{DSN: "file:" + filepath.Join(dir, "nodir", "x.db") + "?mode=ro", CreateDirs: true}); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("CreateDirs with mode=ro: %v", err)
+	}
+
+	// mistakes SQLite would report as a logic error
+	for _, dsn := range []string{"file:" + bare + "?mode=rwx", "file:" + bare + "?cache=none", "file://server/share/x.db"} {
+		if err := open(Options{DSN: dsn}); err == nil || !strings.Contains(err.Error(), "DSN") {
+			t.Errorf("DSN %s: %v", dsn, err)
+		}
+	}
+	if err := open(Options{DSN: "file://" + bare}); err != nil {
+		t.Errorf("file:// URI: %v", err)
+	}
+	if err := open(Options{DSN: "file:" + filepath.Join(bare, "x.db")}); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("file as directory: %v", err)
+	}
+}
+
+func TestOpenReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions don't apply to root")
+	}
+	dir := filepath.Join(t.TempDir(), "ro")
+	if err := os.Mkdir(dir, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o700)
+	_, err := New[TestData](Options{DSN: filepath.Join(dir, "x.db"), Codec: &codec.JSON{}})
+	if !errors.Is(err, fs.ErrPermission) || !strings.Contains(err.Error(), "not writable") {
+		t.Fatalf("read-only directory: %v", err)
+	}
+}
+
+func TestWatchAll(t *testing.T) {
+	db, err := Open(Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, _ := NewWithDB[TestData](db, &codec.JSON{})
+	other, _ := NewWithDB[map[string]any](db, &codec.JSON{})
+	s.Set("existing", "a", TestData{Name: "a"})
+
+	ch, cancel, err := store.WatchAll(s, store.WithInitialReplay[TestData]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(ch, 1); got != "create:a" {
+		t.Fatalf("initial replay: %s", got)
+	}
+	// kinds that didn't exist when the watcher subscribed, written by this
+	// store and by one of another type
+	s.Set("brand-new", "x", TestData{Name: "x"})
+	other.Set("other-new", "y", map[string]any{"name": "y"})
+	s.Delete("existing", "a")
+	if got := eventNames(ch, 3); got != "create:x,create:y,delete:a" {
+		t.Fatalf("events: %s", got)
+	}
+
+	// closing the DB closes the channel; cancel afterwards is a no-op
+	db.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel open after DB.Close")
+	}
+	cancel()
+}
+
+func TestStoreOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "test.db")
+	s, err := store.Open[TestData]("sqlite://"+path+"?busy_timeout=5s&create_dirs=true&history=10", &codec.JSON{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel, _ := s.Watch("k", store.WithReplayHistory[TestData]())
+	defer cancel()
+	if _, err := s.Set("k", "a", TestData{Name: "a", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(ch, 1); got != "create:a" {
+		t.Fatalf("events: %s", got)
+	}
+	s.Close()
+
+	// the same file, through the package's own constructor
+	direct, err := New[TestData](Options{DSN: "file:" + path, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Close()
+	if v, ok, err := direct.Get("k", "a"); err != nil || !ok || v.Value != 1 {
+		t.Fatalf("Get = %+v, %v, %v", v, ok, err)
+	}
+
+	for url, want := range map[string]string{
+		"sqlite://" + path + "?busy_timeout=5": `busy_timeout="5": want a duration`,
+		"sqlite://" + path + "?wal=no":         `wal="no": want true or false`,
+		"sqlite://" + path + "?busy_timout=5s": `unknown parameter "busy_timout"`,
+		"sqlite::memory:":                      "mem://",
+		"sqlite://":                            "no path",
+	} {
+		if _, err := store.Open[TestData](url, &codec.JSON{}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Open(%s) = %v, want %s", url, err, want)
+		}
+	}
+	if _, err := store.Open[TestData]("sqlite://"+path, nil); err == nil {
+		t.Error("Open without a codec succeeded")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	for _, group := range []bool{false, true} {
+		t.Run(fmt.Sprint("group commit ", group), func(t *testing.T) {
+			n := 0
+			o := Options{
+				DSN:             "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:           &codec.JSON{},
+				StreamThreshold: 16,
+			}
+			if group {
+				o.GroupCommit = GroupCommit{MaxBatch: 8, MaxDelay: time.Millisecond}
+			}
+			s, err := New[TestData](o, store.StoreOptions[TestData]{KeyGen: func() string {
+				n++
+				return fmt.Sprint("id-", (n+1)/2) // each key twice
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			ch, cancel, _ := s.Watch("k")
+			defer cancel()
+
+			for i, want := range []string{"id-1", "id-2"} {
+				if key, err := store.Add(s, "k", TestData{Value: i}); key != want || err != nil {
+					t.Fatalf("Add = %q, %v, want %s", key, err, want)
+				}
+			}
+			if got := eventNames(ch, 2); got != "create:id-1,create:id-2" {
+				t.Fatalf("events: %s", got)
+			}
+
+			// CreateOnly leaves existing values alone, chunked ones included
+			big := `{"name":"a long enough name","value":7}`
+			if err := s.(Streamer).SetReader("k", "big", strings.NewReader(big), int64(len(big))); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"id-1", "big"} {
+				if _, err := s.Set("k", key, TestData{Value: -1}, store.CreateOnly()); !errors.Is(err, store.ErrKeyExists) {
+					t.Fatalf("CreateOnly Set(%s) = %v", key, err)
+				}
+			}
+			if v, _, _ := s.Get("k", "id-1"); v.Value != 0 {
+				t.Fatalf("id-1 replaced: %+v", v)
+			}
+			r, _, ok, err := s.(Streamer).GetReader("k", "big")
+			if err != nil || !ok {
+				t.Fatalf("GetReader(big) = %v, %v", ok, err)
+			}
+			got, _ := io.ReadAll(r)
+			r.Close()
+			if string(got) != big {
+				t.Fatalf("big replaced: %q", got)
+			}
+		})
+	}
+
+	// default keys are ordered UUIDv7s
+	s := setupStore(t)
+	defer s.Close()
+	k1, err := store.Add(s, "k", TestData{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := store.Add(s, "k", TestData{Value: 2})
+	if len(k1) != 36 || k1[14] != '7' || k2 <= k1 {
+		t.Fatalf("keys %q, %q", k1, k2)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for name, o := range map[string]Options{
+		"shared table":   {},
+		"table per kind": {TablePerKind: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			storetest.RunReaderTests(t, func(t *testing.T) store.Store[TestData] {
+				o.DSN = "file:" + filepath.Join(t.TempDir(), "test.db")
+				o.Codec = &codec.JSON{}
+				s, err := New[TestData](o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			})
+			for _, history := range []int{0, 10} {
+				t.Run(fmt.Sprintf("EventHistory=%d", history), func(t *testing.T) {
+					storetest.RunWatchOptionTests(t, func(t *testing.T) store.Store[TestData] {
+						o.DSN = "file:" + filepath.Join(t.TempDir(), "test.db")
+						o.Codec = &codec.JSON{}
+						s, err := New[TestData](o, store.StoreOptions[TestData]{EventHistory: history})
+						if err != nil {
+							t.Fatal(err)
+						}
+						return s
+					}, TestData{Name: "a", Value: 1}, TestData{Name: "b", Value: 2})
+				})
+			}
+			storetest.RunReplaceTests(t, func(t *testing.T) store.Store[TestData] {
+				o.DSN = "file:" + filepath.Join(t.TempDir(), "test.db")
+				o.Codec = &codec.JSON{}
+				s, err := New[TestData](o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}, TestData{Name: "a", Value: 1}, TestData{Name: "b", Value: 2})
+		})
+	}
+}
+
+func TestWatchStats(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+	s.Set("k", "a", TestData{Value: 1})
+
+	h, err := store.WatchH(s, "k", store.WithBufferSize[TestData](2), store.WithInitialReplay[TestData]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-h.C // the initial replay of a
+	// b and c fill the buffer, d is dropped
+	for _, key := range []string{"b", "c", "d"} {
+		s.Set("k", key, TestData{Value: 2})
+	}
+	settle(t, s)
+
+	st := h.Stats()
+	if st.Delivered != 3 || st.Dropped != 1 || st.BufferLen != 2 || st.BufferCap != 2 || st.Age <= 0 {
+		t.Fatalf("Stats() = %+v", st)
+	}
+	h.Cancel()
+	if st := h.Stats(); st.Delivered != 3 || st.Dropped != 1 {
+		t.Fatalf("Stats() after Cancel = %+v", st)
+	}
+}
+
+func TestMinVersions(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{EventHistory: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Set("k", "a", TestData{Value: 1})
+	s.Set("k", "a", TestData{Value: 2})
+	s.SetAll("k", map[string]TestData{"b": {Value: 1}})
+	s.SetAll("k", map[string]TestData{"b": {Value: 1}}) // unchanged, keeps version 1
+
+	// the informer records versions and lists; a write lands before it
+	// starts watching, so the replay holds events List already saw
+	versions, err := s.(store.Versioner).Versions("k")
+	if err != nil || versions["a"] != 2 || versions["b"] != 1 {
+		t.Fatalf("Versions() = %v, %v", versions, err)
+	}
+	s.Set("k", "a", TestData{Value: 3})
+
+	h, err := store.WatchH(s, "k", store.WithReplayHistory[TestData](), store.WithInitialReplay[TestData](),
+		store.WithMinVersions[TestData](versions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cancel()
+	versioned := func(n int) string {
+		t.Helper()
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case ev := <-h.C:
+				got = append(got, fmt.Sprintf("%s:%s@%d", ev.EventType, ev.Name, ev.Version))
+			case <-time.After(time.Second):
+				t.Fatalf("timeout after %v", got)
+			}
+		}
+		return strings.Join(got, ",")
+	}
+	if got := versioned(1); got != "update:a@3" {
+		t.Fatalf("replay: %s", got)
+	}
+	time.Sleep(20 * time.Millisecond) // let the initial replay finish
+	if st := h.Stats(); st.BufferLen != 0 {
+		t.Fatalf("stale events buffered: %+v", st)
+	}
+
+	// a delete lifts the filter, so the re-created key is delivered
+	s.Delete("k", "b")
+	s.Set("k", "b", TestData{Value: 5})
+	store.Swap(s, "k", "a", "b")
+	if got := versioned(4); got != "delete:b@1,create:b@1,update:a@4,update:b@2" {
+		t.Fatalf("live: %s", got)
+	}
+}
+
+func TestMergeAll(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{ValidateFns: map[string]store.ValidateFunc[TestData]{"k": func(v TestData) error {
+		if v.Value < 0 {
+			return errors.New("negative")
+		}
+		return nil
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetAll("k", map[string]TestData{"a": {Value: 1}, "b": {Value: 5}, "c": {Value: 3}})
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+
+	keepHigher := func(key string, existing, incoming TestData) TestData {
+		if existing.Value > incoming.Value {
+			return existing
+		}
+		return incoming
+	}
+	err = store.MergeAll(s, "k", map[string]TestData{"a": {Value: 4}, "b": {Value: 2}, "c": {Value: 3}, "d": {Value: 7}}, keepHigher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]int{"a": 4, "b": 5, "c": 3, "d": 7} {
+		if v, _, _ := s.Get("k", key); v.Value != want {
+			t.Errorf("%s = %d, want %d", key, v.Value, want)
+		}
+	}
+	// only the keys whose value changed get an event, creates first
+	if got := eventNames(ch, 2); got != "create:d,update:a" {
+		t.Fatalf("events: %s", got)
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// a final value failing validation rolls back the whole merge
+	err = store.MergeAll(s, "k", map[string]TestData{"a": {Value: 10}, "e": {Value: 1}}, func(string, TestData, TestData) TestData {
+		return TestData{Value: -1}
+	})
+	if err == nil {
+		t.Fatal("MergeAll with an invalid resolved value succeeded")
+	}
+	if v, _, _ := s.Get("k", "a"); v.Value != 4 {
+		t.Fatalf("a = %d after the failed merge", v.Value)
+	}
+	if _, ok, _ := s.Get("k", "e"); ok {
+		t.Fatal("e written by the failed merge")
+	}
+
+	// a nil resolve keeps the incoming values
+	if err := store.MergeAll(s, "k", map[string]TestData{"b": {Value: 0}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := s.Get("k", "b"); v.Value != 0 {
+		t.Fatalf("b = %d after a merge without resolve", v.Value)
+	}
+}
+
+func TestDeleteOlderThan(t *testing.T) {
+	for name, perKind := range map[string]bool{"shared table": false, "table per kind": true} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			p := s.(store.Pruner)
+			s.Set("k", "old", TestData{Value: 1})
+			s.Set("k", "edge", TestData{Value: 2})
+			store.SetLabeled(s, "k", "new", TestData{Value: 3}, map[string]string{"env": "prod"})
+
+			// updated_at is the database clock's; pin it
+			db := s.(*sqLiteStore[TestData]).db
+			table := "zestor_kv"
+			if perKind {
+				table = quoteIdent(kindTablePrefix + "k")
+			}
+			for key, at := range map[string]string{
+				"old":  "2024-03-01T10:00:00.000Z",
+				"edge": "2024-03-01T12:00:00.000Z",
+				"new":  "2024-03-01T12:00:00.001Z",
+			} {
+				if _, err := db.Exec(`UPDATE `+table+` SET updated_at=? WHERE kind='k' AND key=?;`, at, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var plan string
+			_ = db.QueryRow(`EXPLAIN QUERY PLAN `+strings.ReplaceAll(countOlderQuery, "zestor_kv", table), "k", "x").Scan(new(int), new(int), new(int), &plan)
+			if !strings.Contains(plan, "INDEX") || !strings.Contains(plan, "updated_at") {
+				t.Errorf("CountOlderThan doesn't use the updated_at index: %s", plan)
+			}
+
+			cutoff := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			for _, tt := range []struct {
+				cutoff time.Time
+				want   int
+			}{
+				{cutoff, 1}, // strictly before: edge is kept
+				{cutoff.Add(time.Microsecond), 2},
+				{cutoff.Add(time.Millisecond), 2},
+				{cutoff.Add(time.Millisecond + time.Microsecond), 3},
+			} {
+				if n, err := p.CountOlderThan("k", tt.cutoff); n != tt.want || err != nil {
+					t.Errorf("CountOlderThan(%s) = %d, %v, want %d", tt.cutoff.Format(time.RFC3339Nano), n, err, tt.want)
+				}
+			}
+			if n, _ := p.CountOlderThan("missing", cutoff); n != 0 {
+				t.Errorf("CountOlderThan(missing) = %d", n)
+			}
+
+			ch, cancel, _ := s.Watch("k")
+			defer cancel()
+			if n, err := p.DeleteOlderThan("k", cutoff); n != 1 || err != nil {
+				t.Fatalf("DeleteOlderThan = %d, %v, want 1", n, err)
+			}
+			select {
+			case ev := <-ch:
+				t.Fatalf("event without WithDeleteEvents: %+v", ev)
+			case <-time.After(20 * time.Millisecond):
+			}
+			n, err := p.DeleteOlderThan("k", cutoff.Add(time.Hour), store.WithDeleteEvents())
+			if n != 2 || err != nil {
+				t.Fatalf("DeleteOlderThan with events = %d, %v, want 2", n, err)
+			}
+			if got := eventNames(ch, 2); got != "delete:edge,delete:new" {
+				t.Fatalf("events: %s", got)
+			}
+			if c, _ := s.Count("k"); c != 0 {
+				t.Fatalf("Count after deleting everything = %d", c)
+			}
+			var labels int
+			_ = db.QueryRow(`SELECT COUNT(*) FROM zestor_labels;`).Scan(&labels)
+			if labels != 0 {
+				t.Fatalf("%d labels of deleted keys left", labels)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	// a file of a release before user_version was kept: no updated_at
+	// indexes, user_version 0
+	raw, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := strings.Replace(kvSchema, "CREATE INDEX IF NOT EXISTS idx_kv_updated ON zestor_kv(kind, updated_at);", "", 1)
+	old = strings.TrimSuffix(old, trashSchema+recodeSchema)
+	for _, stmt := range []string{
+		old,
+		fmt.Sprintf(strings.SplitAfter(kindTableSchema, ");")[0], quoteIdent(kindTablePrefix+"notes")),
+		`INSERT INTO zestor_kv(kind,key,value) VALUES('users','alice','{"name":"alice","value":1}');`,
+		`INSERT INTO "zestor_kind_notes"(kind,key,value) VALUES('notes','n','{"name":"n","value":2}');`,
+	} {
+		if _, err := raw.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw.Close()
+	indexes := func(db *sql.DB) string {
+		var names []string
+		rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='index' AND sql LIKE '%updated_at%' ORDER BY name;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			rows.Scan(&name)
+			names = append(names, name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	for _, perKind := range []bool{false, true} {
+		s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}, TablePerKind: perKind})
+		if err != nil {
+			t.Fatalf("open old file: %v", err)
+		}
+		db := s.(*sqLiteStore[TestData]).db
+		var v int
+		db.QueryRow(`PRAGMA user_version;`).Scan(&v)
+		if v != schemaVersion {
+			t.Errorf("user_version = %d, want %d", v, schemaVersion)
+		}
+		if got := indexes(db); got != "idx_kv_updated,zestor_updated_notes" {
+			t.Errorf("updated_at indexes: %s", got)
+		}
+		kind, want := "users", 1
+		if perKind {
+			kind, want = "notes", 2
+		}
+		if got, ok, err := s.Get(kind, map[string]string{"users": "alice", "notes": "n"}[kind]); !ok || got.Value != want || err != nil {
+			t.Errorf("Get(%s) after upgrade = %+v, %v, %v", kind, got, ok, err)
+		}
+		if _, err := s.(store.SoftDeleter[TestData]).ListDeleted(kind); err != nil {
+			t.Errorf("ListDeleted after upgrade: %v", err)
+		}
+		if _, err := s.(Recoder).Recode(kind, &codec.JSON{}, &codec.YAML{}); err != nil {
+			t.Errorf("Recode after upgrade: %v", err)
+		}
+		s.Close()
+	}
+
+	// a failing step leaves the file at the one before it
+	orig := migrations
+	defer func() { migrations, schemaVersion = orig, len(orig) }()
+	migrations = append(orig[:len(orig):len(orig)], migration{"add note", func(ctx context.Context, conn *sql.Conn) error {
+		if err := addColumn(ctx, conn, "zestor_kv", "note", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return errors.New("boom")
+	}})
+	schemaVersion = len(migrations)
+	if _, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}}); err == nil || !strings.Contains(err.Error(), "add note): boom") {
+		t.Fatalf("New with a failing step = %v", err)
+	}
+	raw, _ = sql.Open("sqlite", dsn)
+	defer raw.Close()
+	var v, cols int
+	raw.QueryRow(`PRAGMA user_version;`).Scan(&v)
+	raw.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('zestor_kv') WHERE name='note';`).Scan(&cols)
+	if v != len(orig) || cols != 0 {
+		t.Fatalf("after a failed step: user_version %d, note columns %d", v, cols)
+	}
+
+	// addColumn is a no-op on a column the table has
+	migrations[len(orig)].up = func(ctx context.Context, conn *sql.Conn) error {
+		if err := addColumn(ctx, conn, "zestor_kv", "note", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		return addColumn(ctx, conn, "zestor_kv", "note", "TEXT NOT NULL DEFAULT ''")
+	}
+	s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	raw.QueryRow(`PRAGMA user_version;`).Scan(&v)
+	raw.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('zestor_kv') WHERE name='note';`).Scan(&cols)
+	if v != len(orig)+1 || cols != 1 {
+		t.Fatalf("after adding the column: user_version %d, note columns %d", v, cols)
+	}
+
+	// the file is now ahead of a library without the step
+	migrations, schemaVersion = orig, len(orig)
+	for _, ro := range []bool{false, true} {
+		if _, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}, ReadOnly: ro}); !errors.Is(err, ErrSchemaTooNew) {
+			t.Errorf("New(ReadOnly: %v) on a newer file = %v, want ErrSchemaTooNew", ro, err)
+		}
+	}
+}
+
+func TestSetAllOrdered(t *testing.T) {
+	for _, batch := range []int{0, 2} {
+		s, err := New[TestData](Options{
+			DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+			Codec: &codec.JSON{},
+		}, store.StoreOptions[TestData]{SetAllBatchSize: batch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Set("k", "b", TestData{Value: 1})
+		ch, cancel, _ := s.Watch("k")
+		err = store.SetAllOrdered(s, "k", []store.KeyValue[TestData]{
+			{Key: "z", Value: TestData{Value: 1}},
+			{Key: "b", Value: TestData{Value: 2}},
+			{Key: "a", Value: TestData{Value: 3}},
+			{Key: "z", Value: TestData{Value: 4}},
+			{Key: "m", Value: TestData{Value: 5}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// z keeps its first position with its last value
+		if got := eventNames(ch, 4); got != "create:z,update:b,create:a,create:m" {
+			t.Fatalf("batch %d: events %s", batch, got)
+		}
+		if v, _, _ := s.Get("k", "z"); v.Value != 4 {
+			t.Fatalf("batch %d: z = %d, want the last value 4", batch, v.Value)
+		}
+		cancel()
+		s.Close()
+	}
+}
+
+func TestDBStats(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+	s.Set("k", "a", TestData{Value: 1})
+	st := s.(PoolStatser).DBStats()
+	if st.OpenConnections < 1 || st.InUse != 0 || st.Idle != st.OpenConnections {
+		t.Fatalf("DBStats after a write = %+v", st)
+	}
+
+	// a snapshot holds a connection until released
+	_, release, err := store.Snapshot(s, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := s.(PoolStatser).DBStats(); st.InUse != 1 {
+		t.Fatalf("InUse with a snapshot open = %d", st.InUse)
+	}
+	release()
+	if st := s.(PoolStatser).DBStats(); st.InUse != 0 {
+		t.Fatalf("InUse after release = %d", st.InUse)
+	}
+}
+
+func TestCompareFn(t *testing.T) {
+	type device struct {
+		Name     string    `json:"name"`
+		LastSeen time.Time `json:"last_seen"`
+	}
+	s, err := New[device](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[device]{
+		// a heartbeat alone is not a change
+		CompareFn: func(prev, new device) bool { return prev.Name == new.Name },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	version := func() int64 {
+		v, _ := s.(store.Versioner).Versions("devices")
+		return v["d"]
+	}
+	s.Set("devices", "d", device{Name: "a", LastSeen: t0})
+	ch, cancel, _ := s.Watch("devices")
+	defer cancel()
+
+	if created, err := s.Set("devices", "d", device{Name: "a", LastSeen: t0.Add(time.Minute)}); created || err != nil {
+		t.Fatalf("Set = %v, %v", created, err)
+	}
+	if _, err := s.SetFn("devices", "d", func(d device) (device, error) {
+		d.LastSeen = d.LastSeen.Add(time.Minute)
+		return d, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("event for a LastSeen-only change: %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if v := version(); v != 1 {
+		t.Fatalf("version after LastSeen-only changes = %d, want 1", v)
+	}
+	// the latest write is still what reads return
+	if d, _, _ := s.Get("devices", "d"); !d.LastSeen.Equal(t0.Add(2 * time.Minute)) {
+		t.Fatalf("LastSeen = %v, want the last written", d.LastSeen)
+	}
+
+	s.Set("devices", "d", device{Name: "b", LastSeen: t0})
+	if got := eventNames(ch, 1); got != "update:d" {
+		t.Fatalf("events for a Name change: %s", got)
+	}
+	if v := version(); v != 2 {
+		t.Fatalf("version after a Name change = %d, want 2", v)
+	}
+}
+
+func TestSetAllUnchanged(t *testing.T) {
+	type device struct {
+		Name     string    `json:"name"`
+		LastSeen time.Time `json:"last_seen"`
+	}
+	s, err := New[device](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[device]{
+		CompareFn: func(prev, new device) bool { return prev.Name == new.Name },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	beat := func(n int) device { return device{Name: "a", LastSeen: t0.Add(time.Duration(n) * time.Minute)} }
+	s.SetAll("devices", map[string]device{"d": beat(0), "e": {Name: "e"}})
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// unobserved, then observed
+	if err := s.SetAll("devices", map[string]device{"d": beat(1)}); err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel, _ := s.Watch("devices")
+	defer cancel()
+	if err := s.SetAll("devices", map[string]device{"d": beat(2), "e": {Name: "e2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetAllOrdered(s, "devices", []store.KeyValue[device]{{Key: "d", Value: beat(3)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(store.MultiKindWriter[device]).SetMulti([]store.KindKeyValue[device]{{Kind: "devices", Key: "d", Value: beat(4)}}); err != nil {
+		t.Fatal(err)
+	}
+	// d keeps its change time, e was changed
+	if n, _ := s.(store.Pruner).CountOlderThan("devices", cutoff); n != 1 {
+		t.Errorf("CountOlderThan() = %d, want 1", n)
+	}
+	s.Set("devices", "d", device{Name: "b"})
+	if got := eventNames(ch, 2); got != "update:e,update:d" {
+		t.Fatalf("events = %s, want none for the unchanged values", got)
+	}
+	if v, _ := s.(store.Versioner).Versions("devices"); v["d"] != 2 || v["e"] != 2 {
+		t.Errorf("Versions() = %v", v)
+	}
+	if d, _, _ := s.Get("devices", "d"); d.Name != "b" {
+		t.Errorf("d = %+v", d)
+	}
+}
+
+func TestRejectZeroValues(t *testing.T) {
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{RejectZeroValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Set("k", "a", TestData{}); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("Set of a zero value = %v", err)
+	}
+	if err := s.SetAll("k", map[string]TestData{"b": {Name: "b"}, "c": {}}); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("SetAll with a zero value = %v", err)
+	}
+	if n, _ := s.Count("k"); n != 0 {
+		t.Fatalf("Count after rejected writes = %d", n)
+	}
+	if _, err := s.Set("k", "a", TestData{Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetFn("k", "a", func(TestData) (TestData, error) { return TestData{}, nil }); !errors.Is(err, store.ErrZeroValue) {
+		t.Fatalf("SetFn to a zero value = %v", err)
+	}
+}
+
+func TestCopyRenameKind(t *testing.T) {
+	for name, perKind := range map[string]bool{"shared": false, "per-kind": true} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			m := s.(store.KindMover)
+			store.SetLabeled(s, "notes", "a", TestData{Name: "a"}, map[string]string{"env": "prod"})
+			s.Set("notes", "a", TestData{Name: "a", Value: 1}) // version 2
+			s.Set("notes", "b", TestData{Name: "b"})
+			notes, cancelNotes, _ := s.Watch("notes")
+			defer cancelNotes()
+			docs, cancelDocs, _ := s.Watch("docs")
+			defer cancelDocs()
+			versions := func(kind string) map[string]int64 {
+				v, _ := s.(store.Versioner).Versions(kind)
+				return v
+			}
+
+			if n, err := m.CopyKind("notes", "copies"); n != 2 || err != nil {
+				t.Fatalf("CopyKind = %d, %v", n, err)
+			}
+			if v, _, _ := s.Get("copies", "a"); v.Value != 1 {
+				t.Fatalf("copied a = %+v", v)
+			}
+			if kvs, _ := store.SelectByLabel(s, "copies", map[string]string{"env": "prod"}); len(kvs) != 1 {
+				t.Fatalf("copied labels: %v", kvs)
+			}
+			if v := versions("copies"); v["a"] != 2 || v["b"] != 1 {
+				t.Fatalf("copied versions = %v", v)
+			}
+			if _, err := m.CopyKind("notes", "copies"); !errors.Is(err, store.ErrKindNotEmpty) {
+				t.Fatalf("CopyKind into a non-empty kind = %v", err)
+			}
+			if _, err := m.RenameKind("notes", "notes"); err == nil {
+				t.Fatal("RenameKind onto itself succeeded")
+			}
+
+			if n, err := m.RenameKind("notes", "docs"); n != 2 || err != nil {
+				t.Fatalf("RenameKind = %d, %v", n, err)
+			}
+			select {
+			case ev := <-notes:
+				t.Fatalf("event without WithKindEvents: %+v", ev)
+			case ev := <-docs:
+				t.Fatalf("event without WithKindEvents: %+v", ev)
+			case <-time.After(20 * time.Millisecond):
+			}
+			if n, _ := s.Count("notes"); n != 0 {
+				t.Fatalf("%d keys left in the renamed kind", n)
+			}
+			if kvs, _ := store.SelectByLabel(s, "docs", map[string]string{"env": "prod"}); len(kvs) != 1 || kvs[0].Key != "a" {
+				t.Fatalf("renamed labels: %v", kvs)
+			}
+			if v := versions("docs"); v["a"] != 2 {
+				t.Fatalf("renamed versions = %v", v)
+			}
+
+			// a's labels are replaced by the source's, which has none
+			s.Set("notes", "a", TestData{Name: "a", Value: 2})
+			s.Set("notes", "c", TestData{Name: "c"})
+			n, err := m.RenameKind("notes", "docs", store.WithOverwrite(), store.WithKindEvents())
+			if n != 2 || err != nil {
+				t.Fatalf("RenameKind with WithOverwrite = %d, %v", n, err)
+			}
+			if got := eventNames(notes, 4); got != "create:a,create:c,delete:a,delete:c" {
+				t.Fatalf("source events %s", got)
+			}
+			if got := eventNames(docs, 2); got != "update:a,create:c" {
+				t.Fatalf("destination events %s", got)
+			}
+			if vals, _ := s.List("docs"); len(vals) != 3 || vals["a"].Value != 2 {
+				t.Fatalf("docs after overwrite = %v", vals)
+			}
+			if kvs, _ := store.SelectByLabel(s, "docs", map[string]string{"env": "prod"}); len(kvs) != 0 {
+				t.Fatalf("overwritten labels kept: %v", kvs)
+			}
+			if v := versions("docs"); v["a"] != 3 || v["c"] != 1 {
+				t.Fatalf("versions after overwrite = %v", v)
+			}
+			if n, _ := s.Count("notes"); n != 0 {
+				t.Fatalf("%d keys left in the renamed kind", n)
+			}
+		})
+	}
+}
+
+func TestSilent(t *testing.T) {
+	var silent []string
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+		Codec: &codec.JSON{},
+	}, store.StoreOptions[TestData]{
+		EventHistory: 10,
+		AfterWrite: func(ev *store.Event[TestData]) {
+			if ev.Silent {
+				silent = append(silent, string(ev.EventType)+":"+ev.Name)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Set("k", "a", TestData{Name: "a"})
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+
+	err = s.SetAll("k", map[string]TestData{"a": {Name: "a", Value: 1}, "b": {Name: "b"}}, store.Silent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetFn("k", "a", func(v TestData) (TestData, error) { v.Value++; return v, nil }, store.Silent())
+	s.Delete("k", "b", store.Silent())
+	select {
+	case ev := <-ch:
+		t.Fatalf("event of a silent write: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := strings.Join(silent, ","); got != "create:b,update:a,update:a,delete:b" {
+		t.Fatalf("AfterWrite saw %s", got)
+	}
+	if v, _, _ := s.Get("k", "a"); v.Value != 2 {
+		t.Fatalf("a = %+v", v)
+	}
+	if vs, _ := s.(store.Versioner).Versions("k"); vs["a"] != 3 {
+		t.Fatalf("versions after silent writes = %v", vs)
+	}
+
+	s.Set("k", "c", TestData{Name: "c"})
+	if got := eventNames(ch, 1); got != "create:c" {
+		t.Fatalf("events after silent writes: %s", got)
+	}
+	// the history keeps the silent events
+	hist, cancelHist, _ := s.Watch("k", store.WithReplayHistory[TestData]())
+	defer cancelHist()
+	if got := eventNames(hist, 6); got != "create:a,create:b,update:a,update:a,delete:b,create:c" {
+		t.Fatalf("history replay %s", got)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			d := s.(store.SoftDeleter[TestData])
+			store.SetLabeled(s, "k", "a", TestData{Name: "a"}, map[string]string{"env": "prod"})
+			s.Set("k", "a", TestData{Name: "a", Value: 1})
+			s.Set("k", "b", TestData{Name: "b"})
+			ch, cancel, _ := s.Watch("k")
+			defer cancel()
+
+			if existed, err := d.SoftDelete("k", "a"); !existed || err != nil {
+				t.Fatalf("SoftDelete = %v, %v", existed, err)
+			}
+			if existed, _ := d.SoftDelete("k", "missing"); existed {
+				t.Fatal("SoftDelete of a missing key existed")
+			}
+			if _, ok, _ := s.Get("k", "a"); ok {
+				t.Fatal("soft-deleted key still read")
+			}
+			if kvs, _ := store.SelectByLabel(s, "k", map[string]string{"env": "prod"}); len(kvs) != 0 {
+				t.Fatalf("soft-deleted key still selected: %v", kvs)
+			}
+			if m, _ := d.ListDeleted("k"); len(m) != 1 || m["a"].Value != 1 {
+				t.Fatalf("ListDeleted = %v", m)
+			}
+
+			if restored, err := d.Restore("k", "a"); !restored || err != nil {
+				t.Fatalf("Restore = %v, %v", restored, err)
+			}
+			if got := eventNames(ch, 2); got != "delete:a,create:a" {
+				t.Fatalf("events %s", got)
+			}
+			if v, _ := s.(store.Versioner).Versions("k"); v["a"] != 2 {
+				t.Fatalf("restored versions = %v", v)
+			}
+			if kvs, _ := store.SelectByLabel(s, "k", map[string]string{"env": "prod"}); len(kvs) != 1 || kvs[0].Value.Value != 1 {
+				t.Fatalf("restored labels: %v", kvs)
+			}
+			if m, _ := d.ListDeleted("k"); len(m) != 0 {
+				t.Fatalf("ListDeleted after Restore = %v", m)
+			}
+			if restored, _ := d.Restore("k", "a"); restored {
+				t.Fatal("restored twice")
+			}
+
+			d.SoftDelete("k", "b")
+			s.Set("k", "b", TestData{Name: "b", Value: 2})
+			if _, err := d.Restore("k", "b"); !errors.Is(err, store.ErrKeyExists) {
+				t.Fatalf("Restore over a live key = %v", err)
+			}
+			if v, _, _ := s.Get("k", "b"); v.Value != 2 {
+				t.Fatalf("b = %+v", v)
+			}
+			if n, _ := d.PurgeDeleted("k", time.Now().Add(-time.Hour)); n != 0 {
+				t.Fatalf("PurgeDeleted of nothing old = %d", n)
+			}
+			if n, _ := d.PurgeDeleted("k", time.Now().Add(time.Hour)); n != 1 {
+				t.Fatalf("PurgeDeleted = %d", n)
+			}
+			if m, _ := d.ListDeleted("k"); len(m) != 0 {
+				t.Fatalf("ListDeleted after PurgeDeleted = %v", m)
+			}
+		})
+	}
+}
+
+func TestExternalChanges(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	const poll = 10 * time.Millisecond
+	s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}, ExternalPollInterval: poll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ch, cancel := s.(ExternalWatcher).ExternalChanges()
+
+	// the store's own writes aren't reported
+	for i := 0; i < 10; i++ {
+		s.Set("k", "a", TestData{Value: i})
+		time.Sleep(poll / 2)
+	}
+	select {
+	case <-ch:
+		t.Fatal("own write reported as external")
+	case <-time.After(5 * poll):
+	}
+
+	other, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Set("k", "b", TestData{Name: "b"})
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("write through another handle not reported")
+	}
+	if _, ok, _ := s.Get("k", "b"); !ok {
+		t.Fatal("external write not visible")
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel open after cancel")
+	}
+	ch, _ = s.(ExternalWatcher).ExternalChanges()
+	s.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel open after Close")
+	}
+}
+
+type filterAuthor struct {
+	Name string `json:"name"`
+}
+
+type filterRow struct {
+	Status   string        `json:"status"`
+	Priority int           `json:"priority"`
+	Score    float64       `json:"score"`
+	Done     bool          `json:"done"`
+	Author   *filterAuthor `json:"author,omitempty"`
+	Note     *string       `json:"note"`
+}
+
+// TestWhereEquivalence runs filters through Filter.Match, through the SQL
+// translation of JSON stores and through the decoding path of other
+// codecs, and compares what they select.
+func TestWhereEquivalence(t *testing.T) {
+	statuses := []string{"open", "done", "", "Open", "ün"}
+	names := []string{"ann", "bob", "anna"}
+	note := "n"
+	values := make(map[string]filterRow)
+	for i := 0; i < 30; i++ {
+		v := filterRow{Status: statuses[i%5], Priority: i%7 - 2, Score: float64(i) / 2, Done: i%3 == 0}
+		if i%4 != 0 {
+			v.Author = &filterAuthor{Name: names[i%3]}
+		}
+		if i%5 == 1 {
+			v.Note = &note
+		}
+		values[fmt.Sprintf("%s/%02d", []string{"a", "b"}[i%2], i)] = v
+	}
+	filters := []store.Filter{
+		store.F.Eq("status", "open"),
+		store.F.Ne("status", "open"),
+		store.F.Gt("status", "done"),
+		store.F.Lte("status", "Open"),
+		store.F.Prefix("status", "o"),
+		store.F.Prefix("status", ""),
+		store.F.Gt("priority", 1),
+		store.F.Lt("priority", 0),
+		store.F.Gte("score", 7.5),
+		store.F.Eq("score", 3),
+		store.F.Eq("done", true),
+		store.F.Ne("done", true),
+		store.F.Eq("author.name", "ann"),
+		store.F.Prefix("author.name", "ann"),
+		store.F.Ne("author.name", "bob"),
+		store.F.Not(store.F.Eq("author.name", "bob")),
+		store.F.Eq("note", "n"),
+		store.F.Not(store.F.Eq("note", "n")),
+		store.F.Eq("missing", 1),
+		store.F.Prefix("key", "a/"),
+		store.F.Gt("key", "b/20"),
+		store.F.And(store.F.Prefix("key", "b/"), store.F.Gt("priority", 0)),
+		store.F.Or(store.F.Eq("done", true), store.F.Lt("score", 2)),
+		store.F.Not(store.F.Or(store.F.Eq("status", "open"), store.F.Eq("status", "done"))),
+		store.F.And(),
+		store.F.Or(),
+	}
+
+	stores := map[string]store.Store[filterRow]{}
+	for _, perKind := range []bool{false, true} {
+		s, err := New[filterRow](Options{
+			DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+			Codec:        &codec.JSON{},
+			TablePerKind: perKind,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		stores[fmt.Sprintf("JSON/TablePerKind=%v", perKind)] = s
+	}
+	y, err := New[filterRow](Options{DSN: "file:" + filepath.Join(t.TempDir(), "yaml.db"), Codec: &codec.YAML{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer y.Close()
+	stores["YAML"] = y
+	for _, s := range stores {
+		if err := s.SetAll("rows", values); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, f := range filters {
+		var want []string
+		for k, v := range values {
+			ok, err := f.Match(k, v)
+			if err != nil {
+				t.Fatalf("%s: Match = %v", f, err)
+			}
+			if ok {
+				want = append(want, k)
+			}
+		}
+		sort.Strings(want)
+		for name, s := range stores {
+			q := s.(store.FilterQuerier[filterRow])
+			m, err := q.ListWhere("rows", f)
+			if err != nil {
+				t.Fatalf("%s: %s: ListWhere = %v", name, f, err)
+			}
+			got := make([]string, 0, len(m))
+			for k, v := range m {
+				if !reflect.DeepEqual(v, values[k]) {
+					t.Errorf("%s: %s: value of %s = %+v", name, f, k, v)
+				}
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s: %s selects %v, Match %v", name, f, got, want)
+			}
+			if n, err := q.CountWhere("rows", f); err != nil || n != len(want) {
+				t.Errorf("%s: %s: CountWhere = %d, %v, want %d", name, f, n, err, len(want))
+			}
+		}
+	}
+
+	// one value, so that every evaluation reports the same key
+	bad := store.F.Or(store.F.Eq("done", true), store.F.Gt("status", 1))
+	_, want := bad.Match("x", filterRow{Status: "open"})
+	for name, s := range stores {
+		s.Set("one", "x", filterRow{Status: "open"})
+		q := s.(store.FilterQuerier[filterRow])
+		if _, err := q.ListWhere("one", bad); err == nil || err.Error() != want.Error() {
+			t.Errorf("%s: ListWhere = %v, want %v", name, err, want)
+		}
+		if _, err := q.CountWhere("one", bad); !errors.Is(err, store.ErrInvalidFilter) {
+			t.Errorf("%s: CountWhere = %v", name, err)
+		}
+		if _, err := q.ListWhere("rows", store.F.Gt("done", true)); !errors.Is(err, store.ErrInvalidFilter) {
+			t.Errorf("%s: ListWhere of a malformed filter = %v", name, err)
+		}
+		if m, err := q.ListWhere("nothing", store.F.Eq("status", "open")); err != nil || len(m) != 0 {
+			t.Errorf("%s: ListWhere of an empty kind = %v, %v", name, m, err)
+		}
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			q := s.(store.FilterQuerier[TestData])
+			store.SetLabeled(s, "k", "a", TestData{Name: "a", Value: 1}, map[string]string{"env": "prod"})
+			s.Set("k", "b", TestData{Name: "b", Value: 2})
+			s.Set("k", "c", TestData{Name: "c", Value: 3})
+
+			if _, err := q.DeleteWhere("k", store.F.Or(store.F.Lt("value", 3), store.F.Eq("name", 1))); !errors.Is(err, store.ErrInvalidFilter) {
+				t.Fatalf("DeleteWhere with a type mismatch = %v", err)
+			}
+			if n, _ := s.Count("k"); n != 3 {
+				t.Fatalf("a failed DeleteWhere deleted values: %d left", n)
+			}
+
+			ch, cancel, _ := s.Watch("k")
+			defer cancel()
+			if n, err := q.DeleteWhere("k", store.F.Lt("value", 3), store.WithDeleteEvents()); err != nil || n != 2 {
+				t.Fatalf("DeleteWhere = %d, %v", n, err)
+			}
+			if got := eventNames(ch, 2); got != "delete:a,delete:b" {
+				t.Fatalf("events %s", got)
+			}
+			if kvs, _ := store.SelectByLabel(s, "k", map[string]string{"env": "prod"}); len(kvs) != 0 {
+				t.Fatalf("labels of a deleted key: %v", kvs)
+			}
+			if keys, _ := s.Keys("k"); len(keys) != 1 || keys[0] != "c" {
+				t.Fatalf("Keys after DeleteWhere = %v", keys)
+			}
+			if n, err := q.DeleteWhere("k", store.F.Eq("key", "c")); err != nil || n != 1 {
+				t.Fatalf("silent DeleteWhere = %d, %v", n, err)
+			}
+			select {
+			case ev := <-ch:
+				t.Fatalf("event %+v without WithDeleteEvents", ev)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRecode(t *testing.T) {
+	defer func(n int) { recodeBatch = n }(recodeBatch)
+	recodeBatch = 3
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+			old, err := New[TestData](Options{DSN: dsn, Codec: &codec.YAML{}, TablePerKind: perKind})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 7; i++ {
+				old.Set("k", fmt.Sprintf("k%d", i), TestData{Name: "v", Value: i})
+			}
+			old.Set("k", "t", TestData{Name: "trashed"})
+			old.(store.SoftDeleter[TestData]).SoftDelete("k", "t")
+			old.Set("k", "k1", TestData{Name: "v", Value: 10})
+			old.Close()
+
+			s, err := New[TestData](Options{DSN: dsn, TablePerKind: perKind, Codec: &codec.Fallback{
+				Primary:   &codec.JSON{Strict: true},
+				Secondary: []codec.Codec{&codec.YAML{}},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			st := s.(*sqLiteStore[TestData])
+			ch, cancel, _ := s.Watch("k")
+			defer cancel()
+
+			// a value no codec reads stops the second batch
+			if _, err := st.db.Exec(st.h.q("k", `UPDATE zestor_kv SET value=x'00ff' WHERE kind='k' AND key='k4';`)); err != nil {
+				t.Fatal(err)
+			}
+			n, err := st.Recode("k", &codec.YAML{}, &codec.JSON{})
+			if err == nil || !strings.Contains(err.Error(), "k/k4") || n != 3 {
+				t.Fatalf("Recode with a broken value = %d, %v", n, err)
+			}
+			if _, err := st.Recode("k", &codec.JSON{}, &codec.YAML{}); err == nil || !strings.Contains(err.Error(), "unfinished") {
+				t.Fatalf("Recode with other codecs = %v", err)
+			}
+
+			// resumed after the first batch, which isn't decoded again;
+			// k4, rewritten meanwhile, is in the new format already
+			s.Set("k", "k4", TestData{Name: "v", Value: 4})
+			if n, err := st.Recode("k", &codec.YAML{}, &codec.JSON{}); err != nil || n != 4 {
+				t.Fatalf("resumed Recode = %d, %v", n, err)
+			}
+			if got := eventNames(ch, 1); got != "update:k4" {
+				t.Fatalf("events %s, want only the Set", got)
+			}
+
+			rows, err := st.db.Query(st.h.q("k", `SELECT key, value, version FROM zestor_kv WHERE kind='k' UNION ALL SELECT key, value, version FROM zestor_trash WHERE kind='k';`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			seen := 0
+			for rows.Next() {
+				var k string
+				var data []byte
+				var version int64
+				rows.Scan(&k, &data, &version)
+				if !json.Valid(data) {
+					t.Errorf("%s not recoded: %q", k, data)
+				}
+				if want := map[string]int64{"k1": 2, "k4": 2}[k]; want == 0 && version != 1 || want != 0 && version != want {
+					t.Errorf("version of %s = %d", k, version)
+				}
+				seen++
+			}
+			if seen != 8 {
+				t.Fatalf("%d rows", seen)
+			}
+			var progress int
+			st.db.QueryRow(`SELECT COUNT(*) FROM zestor_recode;`).Scan(&progress)
+			if progress != 0 {
+				t.Fatalf("%d progress rows left", progress)
+			}
+
+			j, err := NewWithDB[TestData](st.h, &codec.JSON{Strict: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, _, err := j.Get("k", "k1"); err != nil || v.Value != 10 {
+				t.Fatalf("Get with the new codec = %+v, %v", v, err)
+			}
+			if m, err := j.(store.SoftDeleter[TestData]).ListDeleted("k"); err != nil || m["t"].Name != "trashed" {
+				t.Fatalf("ListDeleted with the new codec = %v, %v", m, err)
+			}
+			if n, err := st.Recode("k", &codec.YAML{}, &codec.JSON{}); err != nil || n != 0 {
+				t.Fatalf("Recode of a recoded kind = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestInitialReplayEventTypes(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+	s.Set("k", "a", TestData{Name: "a"})
+	for _, initial := range []bool{false, true} {
+		for _, types := range [][]store.EventType{nil, {store.EventTypeCreate}, {store.EventTypeUpdate}, {store.EventTypeDelete}} {
+			opts := []store.WatchOption[TestData]{}
+			if initial {
+				opts = append(opts, store.WithInitialReplay[TestData]())
+			}
+			if types != nil {
+				opts = append(opts, store.WithEventTypes[TestData](types...))
+			}
+			ch, cancel, err := s.Watch("k", opts...)
+			if initial && len(types) == 1 && types[0] != store.EventTypeCreate {
+				if !errors.Is(err, store.ErrInitialReplayFiltered) {
+					t.Errorf("initial, %v: Watch = %v, want ErrInitialReplayFiltered", types, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("initial=%v, %v: Watch = %v", initial, types, err)
+			}
+			want, n := "", 0
+			if initial {
+				want, n = "create:a", 1
+			}
+			if got := eventNames(ch, n); got != want {
+				t.Errorf("initial=%v, %v: events %q, want %q", initial, types, got, want)
+			}
+			select {
+			case ev := <-ch:
+				t.Errorf("initial=%v, %v: unexpected %+v", initial, types, ev)
+			case <-time.After(20 * time.Millisecond):
+			}
+			cancel()
+		}
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	newStore := func(wait bool) store.Store[TestData] {
+		s, err := New[TestData](Options{
+			DSN:            "file:" + filepath.Join(t.TempDir(), "test.db"),
+			Codec:          &codec.JSON{},
+			BusyTimeout:    5 * time.Second,
+			WriteRateLimit: 10,
+			WriteBurst:     2,
+			WriteRateWait:  wait,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		s := newStore(false)
+		for i := 0; i < 2; i++ {
+			if _, err := s.Set("test", fmt.Sprint(i), TestData{Value: i}); err != nil {
+				t.Fatalf("Set() within burst error = %v", err)
+			}
+		}
+		if _, err := s.Set("test", "2", TestData{Value: 2}); !errors.Is(err, store.ErrRateLimited) {
+			t.Fatalf("Set() over limit error = %v, want ErrRateLimited", err)
+		}
+		if _, _, err := s.Delete("test", "0"); !errors.Is(err, store.ErrRateLimited) {
+			t.Fatalf("Delete() over limit error = %v, want ErrRateLimited", err)
+		}
+		// reads aren't limited, and the failed writes changed nothing
+		if n, err := s.Count("test"); err != nil || n != 2 {
+			t.Fatalf("Count() = %d, %v, want 2", n, err)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if _, err := s.Set("test", "2", TestData{Value: 2}); err != nil {
+			t.Fatalf("Set() after refill error = %v", err)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		s := newStore(true)
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			if _, err := s.Set("test", fmt.Sprint(i), TestData{Value: i}); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+		}
+		// a burst of 2, then 3 writes 100ms apart
+		if d := time.Since(start); d < 250*time.Millisecond {
+			t.Errorf("5 writes took %v, want at least 300ms", d)
+		}
+	})
+}
+
+func TestJSONTimePrecisionNoOp(t *testing.T) {
+	type note struct {
+		Text string    `json:"text"`
+		At   time.Time `json:"at"`
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 123_456_789, time.UTC)
+	// the same instant as it comes back from YAML or another language
+	again := at.Truncate(time.Microsecond).In(time.FixedZone("X", 3600))
+
+	for _, precision := range []time.Duration{0, time.Millisecond} {
+		t.Run(fmt.Sprintf("TimePrecision=%v", precision), func(t *testing.T) {
+			s, err := New[note](Options{
+				DSN:   "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec: codec.NewJSON(codec.JSONOptions{TimePrecision: precision}),
+			})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer s.Close()
+			if _, err := s.Set("notes", "n", note{Text: "a", At: at}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Set("notes", "n", note{Text: "a", At: again}); err != nil {
+				t.Fatal(err)
+			}
+			vs, err := s.(store.Versioner).Versions("notes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := int64(1)
+			if precision == 0 {
+				want = 2
+			}
+			if vs["n"] != want {
+				t.Errorf("version = %d, want %d", vs["n"], want)
+			}
+		})
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	notDB := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(notDB, bytes.Repeat([]byte("not a database "), 512), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a database whose schema page is overwritten after the file header
+	broken := filepath.Join(dir, "broken.db")
+	s, err := New[TestData](Options{DSN: broken, Codec: &codec.JSON{}, DisableWAL: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := s.Set("test", "a", TestData{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	data, err := os.ReadFile(broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[100:], bytes.Repeat([]byte{0xff}, 400))
+	if err := os.WriteFile(broken, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{notDB, broken} {
+		_, err := New[TestData](Options{DSN: path, Codec: &codec.JSON{}})
+		if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), path) {
+			t.Errorf("New(%s) error = %v, want ErrCorrupt naming the file", filepath.Base(path), err)
+		}
+	}
+}
+
+// crashedDB returns the path of a copy of a database, with its WAL, as a
+// process killed before checkpointing its n writes leaves it.
+func crashedDB(t *testing.T, n int) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "live.db")
+	s, err := New[TestData](Options{DSN: src, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	raw, err := sql.Open("sqlite", "file:"+src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	// an open reader keeps the store's connections from checkpointing
+	conn, err := raw.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), `BEGIN; SELECT COUNT(*) FROM zestor_kv;`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := s.Set("test", fmt.Sprint(i), TestData{Name: strings.Repeat("x", 100), Value: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(t.TempDir(), "crashed.db")
+	for _, suffix := range []string{"", "-wal"} {
+		data, err := os.ReadFile(src + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst+suffix, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+func TestRecoverOnOpen(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer func(n int64) { largeWAL = n }(largeWAL)
+	largeWAL = 1
+
+	for _, recover := range []bool{false, true} {
+		t.Run(fmt.Sprintf("RecoverOnOpen=%v", recover), func(t *testing.T) {
+			logs.Reset()
+			path := crashedDB(t, 50)
+			s, err := New[TestData](Options{DSN: path, Codec: &codec.JSON{}, RecoverOnOpen: recover})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer s.Close()
+			if n, err := s.Count("test"); err != nil || n != 50 {
+				t.Errorf("Count() = %d, %v, want the 50 writes in the WAL", n, err)
+			}
+			info, err := os.Stat(path + "-wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recover {
+				if info.Size() != 0 {
+					t.Errorf("WAL has %d bytes after recovery, want it truncated", info.Size())
+				}
+				if !strings.Contains(logs.String(), "checkpointed") {
+					t.Errorf("log = %q, want the recovery logged", logs.String())
+				}
+			} else if !strings.Contains(logs.String(), "not checkpointed") || !strings.Contains(logs.String(), "RecoverOnOpen") {
+				t.Errorf("log = %q, want the large WAL logged", logs.String())
+			}
+		})
+	}
+
+	t.Run("orphans", func(t *testing.T) {
+		for _, recover := range []bool{false, true} {
+			logs.Reset()
+			path := filepath.Join(t.TempDir(), "test.db")
+			for _, suffix := range []string{"-wal", "-shm"} {
+				if err := os.WriteFile(path+suffix, []byte("stale"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err := New[TestData](Options{DSN: path, Codec: &codec.JSON{}, RecoverOnOpen: recover})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			s.Close()
+			if recover {
+				if !strings.Contains(logs.String(), "removed "+path+"-shm") {
+					t.Errorf("log = %q, want the orphans removed", logs.String())
+				}
+			} else if !strings.Contains(logs.String(), "left from a deleted database") {
+				t.Errorf("log = %q, want the orphans logged", logs.String())
+			}
+		}
+	})
+}
+
+func TestOpGate(t *testing.T) {
+	g := newOpGate()
+	short := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+	if err := g.enter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// maintenance waits for the operation in, and gives up with its ctx
+	if _, err := g.acquire(short()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire() with an operation in = %v, want DeadlineExceeded", err)
+	}
+	if err := g.enter(short()); err != nil {
+		t.Fatalf("enter() after abandoned maintenance = %v", err)
+	}
+	g.leave()
+	g.leave()
+
+	release, err := g.acquire(short())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.enter(short()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("enter() during maintenance = %v, want DeadlineExceeded", err)
+	}
+	if _, err := g.acquire(short()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second acquire() = %v, want DeadlineExceeded", err)
+	}
+	entered := make(chan error)
+	go func() { entered <- g.enter(context.Background()) }()
+	select {
+	case err := <-entered:
+		t.Fatalf("enter() returned %v during maintenance", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	release()
+	if err := <-entered; err != nil {
+		t.Fatal(err)
+	}
+	g.leave()
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	var inMaintenance, overlaps atomic.Int64
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)",
+		Codec: &codec.JSON{},
+		// operations wait out the maintenance windows
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		WithinWrite: func(tx *sql.Tx, ev *store.Event[any]) error {
+			if inMaintenance.Load() != 0 {
+				overlaps.Add(1)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	m := s.(Maintainer)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var ops atomic.Int64
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var err error
+				if w == 0 {
+					_, err = s.Set("test", fmt.Sprint(i%50), TestData{Value: i})
+				} else {
+					_, err = s.Count("test")
+				}
+				switch {
+				case err == nil:
+					ops.Add(1)
+				case errors.Is(err, store.ErrTimeout):
+				default:
+					t.Errorf("operation during maintenance toggling: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for i := 0; i < 20; i++ {
+		release, err := m.MaintenanceMode(context.Background())
+		if err != nil {
+			t.Fatalf("MaintenanceMode() error = %v", err)
+		}
+		inMaintenance.Store(1)
+		time.Sleep(time.Duration(i%3) * 30 * time.Millisecond)
+		inMaintenance.Store(0)
+		release()
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if n := overlaps.Load(); n != 0 {
+		t.Errorf("%d writes ran during maintenance", n)
+	}
+	if ops.Load() == 0 {
+		t.Error("no operation got through between maintenance windows")
+	}
+
+	// an operation during maintenance waits for its release
+	release, err := m.MaintenanceMode(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := make(chan error)
+	go func() {
+		_, err := s.Count("test")
+		counted <- err
+	}()
+	select {
+	case err := <-counted:
+		t.Fatalf("Count() returned %v during maintenance", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	release()
+	if err := <-counted; err != nil {
+		t.Errorf("Count() after release = %v", err)
+	}
+
+	s.Close()
+	if _, err := m.MaintenanceMode(context.Background()); !errors.Is(err, store.ErrClosed) {
+		t.Errorf("MaintenanceMode() after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	c := &codec.JSON{}
+	s, err := New[TestData](Options{DSN: "file:" + path + "?_pragma=busy_timeout(5000)", Codec: c, TablePerKind: true}, store.StoreOptions[TestData]{EventHistory: 8})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	i := s.(store.Introspector)
+	want := store.Info{Backend: "sqlite", Location: path, Table: "zestor_kind_<kind>", Features: []string{"history", "table-per-kind"}, WatchFeatures: []store.WatchFeature{
+		store.WatchEvictAfterDrops, store.WatchEventTypes, store.WatchInitialReplay, store.WatchKeys,
+		store.WatchMinVersions, store.WatchReplayHistory, store.WatchSaturationAlert, store.WatchTransition,
+	}}
+	if got := i.Info(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Info() = %+v, want %+v", got, want)
+	}
+	if i.Codec() != c {
+		t.Errorf("Codec() = %v, want the store's codec", i.Codec())
+	}
+
+	// through Open and a wrapper
+	o, err := store.Open[TestData]("sqlite://"+path, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	got := store.Overlay(o).Info()
+	if got.Backend != "sqlite" || got.Location != path || got.Table != "zestor_kv" || !reflect.DeepEqual(got.Wrappers, []string{"overlay"}) {
+		t.Errorf("Info() through Open and an overlay = %+v", got)
+	}
+	if store.Overlay(o).Codec() != c {
+		t.Error("Codec() through Open and an overlay isn't the store's codec")
+	}
+
+	mem, err := New[TestData](Options{DSN: ":memory:", Codec: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mem.Close()
+	if got := mem.(store.Introspector).Info(); got.Location != ":memory:" || got.Features != nil {
+		t.Errorf("Info() of an in-memory database = %+v", got)
+	}
+}
+
+func TestSlowWatcherDoesNotBlockWrites(t *testing.T) {
+	s := setupStore(t)
+	defer s.Close()
+
+	release := make(chan struct{})
+	stuck := func(old, new TestData) bool {
+		<-release
+		return true
+	}
+	slow, cancel, err := s.Watch("k", store.WithTransitionFilter(stuck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	fast, cancelFast, err := s.Watch("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelFast()
+
+	// the slow watcher's filter blocks, the writes and the other watcher
+	// go on
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 5; i++ {
+			if _, err := s.Set("k", fmt.Sprintf("key%d", i), TestData{Value: i}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on a slow watcher")
+	}
+	for i := 0; i < 5; i++ {
+		if ev := <-fast; ev.Object.Value != i {
+			t.Fatalf("fast watcher got %+v, want value %d", ev, i)
+		}
+	}
+
+	// the slow watcher gets them all, in order, once its filter returns
+	close(release)
+	for i := 0; i < 5; i++ {
+		if ev := <-slow; ev.Object.Value != i {
+			t.Fatalf("slow watcher got %+v, want value %d", ev, i)
+		}
+	}
+}
+
+func TestWatcherCount(t *testing.T) {
+	db, err := Open(Options{DSN: "file:" + filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, _ := NewWithDB[TestData](db, &codec.JSON{})
+	other, _ := NewWithDB[TestData](db, &codec.JSON{})
+	o := store.Overlay(s)
+	var wc store.WatchCounter = o
+
+	_, cancelA, _ := o.Watch("a")
+	_, cancelAB, _ := store.WatchKinds(s, []string{"a", "b"})
+	_, cancelAll, _ := store.WatchAll(s)
+	// watchers of another store on the DB don't count
+	_, cancelOther, _ := other.Watch("a")
+	defer cancelOther()
+	if n := wc.WatcherCount(); n != 3 {
+		t.Fatalf("WatcherCount() = %d, want 3", n)
+	}
+	for kind, want := range map[string]int{"a": 3, "b": 2, "c": 1} {
+		if n := wc.KindWatcherCount(kind); n != want {
+			t.Errorf("KindWatcherCount(%q) = %d, want %d", kind, n, want)
+		}
+	}
+
+	cancelA()
+	cancelAB()
+	if n := wc.WatcherCount(); n != 1 {
+		t.Fatalf("WatcherCount() after cancel = %d, want 1", n)
+	}
+	cancelAll()
+	if n := store.WatcherCountOf(s); n != 0 {
+		t.Fatalf("WatcherCount() after cancelling all = %d, want 0", n)
+	}
+}
+
+func TestExistingKeys(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			kc := s.(store.KeyChecker)
+
+			// more keys than one query binds
+			values := make(map[string]TestData)
+			var keys []string
+			for i := 0; i < 2*existingKeysChunk+10; i++ {
+				k := fmt.Sprintf("key%04d", i)
+				keys = append(keys, k)
+				if i%3 == 0 {
+					values[k] = TestData{Value: i}
+				}
+			}
+			if err := s.SetAll("k", values); err != nil {
+				t.Fatal(err)
+			}
+			got, err := kc.ExistingKeys("k", keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(keys) {
+				t.Fatalf("ExistingKeys returned %d keys, want %d", len(got), len(keys))
+			}
+			for _, k := range keys {
+				if _, ok := values[k]; got[k] != ok {
+					t.Fatalf("ExistingKeys[%s] = %v, want %v", k, got[k], ok)
+				}
+			}
+
+			// a kind without values, and no keys
+			if got, err := kc.ExistingKeys("empty", []string{"a"}); err != nil || got["a"] {
+				t.Fatalf("ExistingKeys of an empty kind = %v, %v", got, err)
+			}
+			if got, err := kc.ExistingKeys("k", nil); err != nil || len(got) != 0 {
+				t.Fatalf("ExistingKeys(nil) = %v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSetMulti(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			}, store.StoreOptions[TestData]{
+				ValidateFns: map[string]store.ValidateFunc[TestData]{"b": func(v TestData) error {
+					if v.Value < 0 {
+						return errors.New("negative")
+					}
+					return nil
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			w := s.(store.MultiKindWriter[TestData])
+
+			err = w.SetMulti([]store.KindKeyValue[TestData]{
+				{Kind: "a", Key: "x", Value: TestData{Value: 1}},
+				{Kind: "b", Key: "y", Value: TestData{Value: -1}},
+			})
+			if err == nil {
+				t.Fatal("expected validation error")
+			}
+			if _, ok, _ := s.Get("a", "x"); ok {
+				t.Fatal("a/x written although b/y failed")
+			}
+
+			ch, cancel, _ := store.WatchAll(s)
+			defer cancel()
+			err = w.SetMulti([]store.KindKeyValue[TestData]{
+				{Kind: "a", Key: "x", Value: TestData{Value: 1}},
+				{Kind: "b", Key: "y", Value: TestData{Value: 2}},
+				{Kind: "a", Key: "x", Value: TestData{Value: 3}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i := 0; i < 2; i++ {
+				select {
+				case ev := <-ch:
+					got = append(got, fmt.Sprintf("%s/%s=%d", ev.Kind, ev.Name, ev.Object.Value))
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for events")
+				}
+			}
+			if want := []string{"a/x=3", "b/y=2"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("events = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFilterStream(t *testing.T) {
+	defer func(n int) { filterStreamBatch = n }(filterStreamBatch)
+	filterStreamBatch = 4
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			fs := s.(store.FilterStreamer[TestData])
+
+			// nothing stored yet
+			if err := fs.FilterStream("k", nil, func(string, TestData) error { t.Fatal("fn called"); return nil }); err != nil {
+				t.Fatal(err)
+			}
+
+			values := map[string]TestData{"": {Value: 0}}
+			var want []string
+			for i := 1; i <= 17; i++ {
+				k := fmt.Sprintf("key%02d", i)
+				values[k] = TestData{Value: i}
+				if i%3 == 0 {
+					want = append(want, k)
+				}
+			}
+			if err := s.SetAll("k", values); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			err = fs.FilterStream("k", func(_ string, v TestData) bool { return v.Value%3 == 0 && v.Value > 0 }, func(key string, v TestData) error {
+				if v != values[key] {
+					t.Errorf("%s = %+v, want %+v", key, v, values[key])
+				}
+				got = append(got, key)
+				// fn may write to the store
+				_, err := s.Set("seen", key, v)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("streamed %v, want %v", got, want)
+			}
+
+			// every key once, the empty one first
+			var all []string
+			if err := fs.FilterStream("k", nil, func(key string, _ TestData) error { all = append(all, key); return nil }); err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != len(values) || all[0] != "" || !sort.StringsAreSorted(all) {
+				t.Fatalf("streamed %q", all)
+			}
+
+			stop := errors.New("stop")
+			n := 0
+			err = fs.FilterStream("k", nil, func(string, TestData) error {
+				if n++; n == 6 {
+					return stop
+				}
+				return nil
+			})
+			if !errors.Is(err, stop) || n != 6 {
+				t.Fatalf("FilterStream = %v after %d calls, want stop after 6", err, n)
+			}
+		})
+	}
+}
+
+func TestConcurrentSetAllKinds(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			s, err := New[TestData](Options{DSN: path, Codec: &codec.JSON{}, BusyTimeout: 5 * time.Second, TablePerKind: perKind})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer s.Close()
+
+			const kinds, rounds, keys = 6, 10, 50
+			var wg sync.WaitGroup
+			errs := make(chan error, kinds)
+			for g := 0; g < kinds; g++ {
+				wg.Add(1)
+				go func(kind string) {
+					defer wg.Done()
+					for r := 0; r < rounds; r++ {
+						values := make(map[string]TestData, keys)
+						for i := 0; i < keys; i++ {
+							values[fmt.Sprintf("k%d", i)] = TestData{Name: kind, Value: r}
+						}
+						// reads between writes leave the connections with
+						// snapshots that deferred transactions would trip on
+						if _, err := s.Count(kind); err != nil {
+							errs <- err
+							return
+						}
+						if err := s.SetAll(kind, values); err != nil {
+							errs <- fmt.Errorf("SetAll(%s) round %d: %w", kind, r, err)
+							return
+						}
+					}
+				}(fmt.Sprintf("kind%d", g))
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			for g := 0; g < kinds; g++ {
+				kind := fmt.Sprintf("kind%d", g)
+				all, err := s.List(kind)
+				if err != nil {
+					t.Fatalf("List(%s) error = %v", kind, err)
+				}
+				if len(all) != keys {
+					t.Errorf("List(%s) has %d keys, want %d", kind, len(all), keys)
+				}
+				for k, v := range all {
+					if v.Name != kind || v.Value != rounds-1 {
+						t.Errorf("%s/%s = %+v, want {%s %d}", kind, k, v, kind, rounds-1)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBusyTimeoutEveryConnection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := New[TestData](Options{DSN: path, Codec: &codec.JSON{}, BusyTimeout: 1234 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	db := s.(*sqLiteStore[TestData]).db
+	ctx := context.Background()
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		if conns[i], err = db.Conn(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+	for i, c := range conns {
+		var ms int
+		if err := c.QueryRowContext(ctx, `PRAGMA busy_timeout;`).Scan(&ms); err != nil {
+			t.Fatal(err)
+		}
+		if ms != 1234 {
+			t.Errorf("connection %d: busy_timeout = %d, want 1234", i, ms)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	for _, perKind := range []bool{false, true} {
+		t.Run(fmt.Sprintf("TablePerKind=%v", perKind), func(t *testing.T) {
+			s, err := New[TestData](Options{
+				DSN:          "file:" + filepath.Join(t.TempDir(), "test.db"),
+				Codec:        &codec.JSON{},
+				TablePerKind: perKind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			sm := s.(store.Sampler[TestData])
+
+			if got, err := sm.Sample("k", 3); err != nil || got == nil || len(got) != 0 {
+				t.Fatalf("Sample of an empty kind = %v, %v", got, err)
+			}
+			values := make(map[string]TestData)
+			for i := 0; i < 100; i++ {
+				values[fmt.Sprintf("key%03d", i)] = TestData{Name: fmt.Sprintf("key%03d", i), Value: i}
+			}
+			if err := s.SetAll("k", values); err != nil {
+				t.Fatal(err)
+			}
+
+			seen := make(map[string]bool)
+			for round := 0; round < 50; round++ {
+				got, err := sm.Sample("k", 5)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != 5 {
+					t.Fatalf("Sample(5) returned %d entries", len(got))
+				}
+				keys := make(map[string]bool)
+				for _, kv := range got {
+					if values[kv.Key] != kv.Value || keys[kv.Key] {
+						t.Fatalf("Sample(5) = %v, want distinct stored entries", got)
+					}
+					keys[kv.Key], seen[kv.Key] = true, true
+				}
+			}
+			if len(seen) < 50 {
+				t.Errorf("50 samples of 5 saw only %d keys", len(seen))
+			}
+			if got, _ := sm.Sample("k", 1000); len(got) != 100 {
+				t.Errorf("Sample(1000) returned %d entries, want all 100", len(got))
+			}
+			if got, err := sm.Sample("k", 0); err != nil || len(got) != 0 {
+				t.Errorf("Sample(0) = %v, %v, want empty", got, err)
+			}
+		})
+	}
+}
+
+func TestValidateOnOpen(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set("k", "ok", TestData{Name: "ok", Value: 1})
+	s.Set("k", "bad", TestData{Name: "bad"})
+	s.Close()
+
+	positive := func(v TestData) error {
+		if v.Value <= 0 {
+			return errors.New("not positive")
+		}
+		return nil
+	}
+	for _, mode := range []store.ValidateMode{store.ValidateOff, store.ValidateWarn, store.ValidateFailFast} {
+		s, err := New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}}, store.StoreOptions[TestData]{
+			ValidateFns:    map[string]store.ValidateFunc[TestData]{"k": positive},
+			ValidateOnOpen: mode,
+		})
+		if mode == store.ValidateFailFast {
+			var vf *store.ValidationFailedError
+			if !errors.As(err, &vf) || vf.Report.Checked != 2 || len(vf.Report.Violations) != 1 || vf.Report.Violations[0].Key != "bad" {
+				t.Errorf("fail-fast open = %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		s.Close()
+	}
+
+	s, err = New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := store.ValidateKind(s, "k", positive, store.ValidateOptions[TestData]{
+		FixWith: func(v TestData) (TestData, error) {
+			v.Value = 1
+			return v, nil
+		},
+	})
+	if err != nil || len(rep.Violations) != 1 || !rep.Violations[0].Fixed {
+		t.Errorf("ValidateKind = %+v, %v", rep, err)
+	}
+	s.Close()
+	s, err = New[TestData](Options{DSN: dsn, Codec: &codec.JSON{}}, store.StoreOptions[TestData]{
+		ValidateFns:    map[string]store.ValidateFunc[TestData]{"k": positive},
+		ValidateOnOpen: store.ValidateFailFast,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+// Benchmarks
+func BenchmarkSet(b *testing.B) {
+	tmpDir := b.TempDir()
+	s, _ := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(tmpDir, "bench.db"),
+		Codec: &codec.JSON{},
+	})
+	defer s.Close()
+
+	kind := "bench"
+	val := TestData{Name: "benchmark", Value: 42}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key%d", i)
+		_, _ = s.Set(kind, key, val)
+	}
+}
+
+// BenchmarkSetWatched compares Set on a kind nobody watches, which skips
+// building events, with Set on a watched kind.
+func BenchmarkSetWatched(b *testing.B) {
+	for _, watched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("watched=%v", watched), func(b *testing.B) {
+			s, _ := New[TestData](Options{
+				DSN:   "file:" + filepath.Join(b.TempDir(), "bench.db"),
+				Codec: &codec.JSON{},
+			})
+			defer s.Close()
+			if watched {
+				ch, cancel, _ := s.Watch("bench")
+				defer cancel()
+				go func() {
+					for range ch {
+					}
+				}()
+			}
+			val := TestData{Name: "benchmark", Value: 42}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = s.Set("bench", fmt.Sprintf("key%d", i), val)
+			}
+		})
+	}
+}
+
+// BenchmarkSetSlowWatcher measures Set with a watcher whose transition
+// filter takes 100µs, which runs on the watcher's goroutine rather than
+// the writer's.
+func BenchmarkSetSlowWatcher(b *testing.B) {
+	s, _ := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(b.TempDir(), "bench.db"),
+		Codec: &codec.JSON{},
+	})
+	defer s.Close()
+	slow := func(old, new TestData) bool {
+		time.Sleep(100 * time.Microsecond)
+		return true
+	}
+	ch, cancel, _ := s.Watch("bench", store.WithTransitionFilter(slow))
+	defer cancel()
+	go func() {
+		for range ch {
+		}
+	}()
+	val := TestData{Name: "benchmark", Value: 42}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = s.Set("bench", fmt.Sprintf("key%d", i), val)
+	}
+}
+
+// plainJSON is codec.JSON without codec.BufferedCodec.
+type plainJSON struct{ json codec.JSON }
+
+func (p *plainJSON) Marshal(v any) ([]byte, error)      { return p.json.Marshal(v) }
+func (p *plainJSON) Unmarshal(data []byte, v any) error { return p.json.Unmarshal(data, v) }
+
+// BenchmarkBufferedCodec compares Set and Get of a 2 KB value with a
+// codec.BufferedCodec, which encodes into pooled buffers and decodes from
+// the driver's memory, against the same codec without the interface.
+func BenchmarkBufferedCodec(b *testing.B) {
+	val := TestData{Name: strings.Repeat("x", 2048), Value: 42}
+	codecs := []struct {
+		name string
+		c    codec.Codec
+	}{{"buffered", &codec.JSON{}}, {"plain", &plainJSON{}}}
+	for _, c := range codecs {
+		s, _ := New[TestData](Options{
+			DSN:   "file:" + filepath.Join(b.TempDir(), "bench.db"),
+			Codec: c.c,
+		})
+		b.Run("Set/"+c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				val.Value = i
+				_, _ = s.Set("bench", "key", val)
+			}
+		})
+		b.Run("Get/"+c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, _ = s.Get("bench", "key")
+			}
+		})
+		s.Close()
+	}
+}
+
+// BenchmarkGroupCommit runs concurrent Sets with a synchronous fsync per
+// commit, with and without group commit.
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, group := range []bool{false, true} {
+		b.Run(fmt.Sprintf("group=%v", group), func(b *testing.B) {
+			opts := Options{
+				DSN:   "file:" + filepath.Join(b.TempDir(), "bench.db") + "?_pragma=synchronous(FULL)&_pragma=busy_timeout(10000)",
+				Codec: &codec.JSON{},
+			}
+			if group {
+				opts.GroupCommit = GroupCommit{MaxBatch: DefaultGroupCommitBatch}
+			}
+			s, err := New[TestData](opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			val := TestData{Name: "benchmark", Value: 42}
+			var n atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.Set("bench", fmt.Sprintf("key%d", n.Add(1)), val); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkListParallel(b *testing.B) {
+	type doc struct {
+		ID      int               `json:"id"`
+		Title   string            `json:"title"`
+		Body    string            `json:"body"`
+		Tags    []string          `json:"tags"`
+		Attrs   map[string]string `json:"attrs"`
+		Updated time.Time         `json:"updated"`
+	}
+	dsn := "file:" + filepath.Join(b.TempDir(), "bench.db")
+	s, err := New[doc](Options{DSN: dsn, Codec: &codec.JSON{}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	values := make(map[string]doc, 200_000)
+	for i := 0; i < 200_000; i++ {
+		values[fmt.Sprint(i)] = doc{
+			ID: i, Title: fmt.Sprintf("document %d", i), Body: strings.Repeat("lorem ipsum ", 20),
+			Tags: []string{"a", "b", "c"}, Attrs: map[string]string{"owner": "x", "state": "open"},
+			Updated: time.Unix(int64(i), 0).UTC(),
+		}
+	}
+	if err := s.SetAll("docs", values); err != nil {
+		b.Fatal(err)
+	}
+	s.Close()
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			s, err := New[doc](Options{DSN: dsn, Codec: &codec.JSON{}, DecodeParallelism: workers})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if m, err := s.List("docs"); err != nil || len(m) != len(values) {
+					b.Fatalf("List = %d values, %v", len(m), err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	tmpDir := b.TempDir()
+	s, _ := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(tmpDir, "bench.db"),
+		Codec: &codec.JSON{},
+	})
+	defer s.Close()
+
+	kind := "bench"
+	key := "key1"
+	val := TestData{Name: "benchmark", Value: 42}
+	_, _ = s.Set(kind, key, val)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _ = s.Get(kind, key)
+	}
+}
+
+func BenchmarkSetFn(b *testing.B) {
+	tmpDir := b.TempDir()
+	s, _ := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(tmpDir, "bench.db"),
+		Codec: &codec.JSON{},
+	})
+	defer s.Close()
+
+	kind := "bench"
+	key := "counter"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = s.SetFn(kind, key, func(v TestData) (TestData, error) {
+			v.Value++
+			return v, nil
+		})
+	}
+}
+
+// BenchmarkSetAll100k writes 100k rows in one SetAll and reports the size of
+// the WAL file afterwards. SQLite reuses the WAL without shrinking it, so
+// that is its peak size: one transaction has to log every row before it
+// can be checkpointed, chunks let checkpoints run in between.
+// BenchmarkSetAllWatched measures SetAll of 10k keys, whose events are
+// published to 10 watchers.
+func BenchmarkSetAllWatched(b *testing.B) {
+	s, err := New[TestData](Options{
+		DSN:   "file:" + filepath.Join(b.TempDir(), "bench.db"),
+		Codec: &codec.JSON{},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		ch, cancel, _ := s.Watch("bench", store.WithBufferSize[TestData](1024))
+		defer cancel()
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+	values := make(map[string]TestData, 10_000)
+	for i := 0; i < 10_000; i++ {
+		values[fmt.Sprintf("key%05d", i)] = TestData{Name: "benchmark", Value: i}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.SetAll("bench", values); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetAll100k(b *testing.B) {
+	values := make(map[string]TestData, 100_000)
+	for i := 0; i < 100_000; i++ {
+		values[fmt.Sprintf("key%06d", i)] = TestData{Name: "benchmark", Value: i}
+	}
+	for _, batch := range []int{0, 5_000} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			var wal int64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				path := filepath.Join(b.TempDir(), "bench.db")
+				s, err := New[TestData](Options{DSN: "file:" + path, Codec: &codec.JSON{}},
+					store.StoreOptions[TestData]{SetAllBatchSize: batch})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := s.SetAll("bench", values); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if fi, err := os.Stat(path + "-wal"); err == nil {
+					wal = fi.Size()
+				}
+				s.Close()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(wal), "wal-bytes")
 		})
 	}
 }
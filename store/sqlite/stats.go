@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"database/sql"
+	"slices"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// PoolStatser is implemented by sqlite stores, to tune the connection pool
+// of the underlying database/sql handle. It is specific to this backend.
+type PoolStatser interface {
+	// DBStats returns the statistics of the pool writes and the reads
+	// without replicas (Options.ReadDSNs) use: open, in-use and idle
+	// connections, and how often and how long callers waited for one.
+	DBStats() sql.DBStats
+}
+
+func (s *sqLiteStore[T]) DBStats() sql.DBStats {
+	return s.h.DBStats()
+}
+
+// DBStats returns the statistics of the DB's primary connection pool,
+// shared by every store on it.
+func (d *DB) DBStats() sql.DBStats {
+	return d.db.Stats()
+}
+
+func (s *sqLiteStore[T]) Codec() store.Codec { return s.codec }
+
+// watchFeatures returns every watch feature but WatchSynchronous, as
+// watchers are fed by their own goroutines, and WatchReplayHistory while
+// no store of the DB keeps a history.
+func (s *sqLiteStore[T]) watchFeatures() []store.WatchFeature {
+	s.h.muHistory.Lock()
+	history := s.h.historySize > 0
+	s.h.muHistory.Unlock()
+	return slices.DeleteFunc(slices.Clone(store.AllWatchFeatures), func(f store.WatchFeature) bool {
+		return f == store.WatchSynchronous || f == store.WatchReplayHistory && !history
+	})
+}
+
+// Info reports the "sqlite" backend, its database file and table, and
+// the features "group-commit", "history", "lazy-rewrite", "read-only",
+// "replicas", "table-per-kind" and "write-rate-limit" where the options
+// of its DB set them.
+func (s *sqLiteStore[T]) Info() store.Info {
+	d := s.h
+	info := store.Info{Backend: "sqlite", Location: d.location, Table: "zestor_kv"}
+	if d.tablePerKind {
+		info.Table = kindTablePrefix + "<kind>"
+	}
+	d.muHistory.Lock()
+	history := d.historySize > 0
+	d.muHistory.Unlock()
+	info.WatchFeatures = s.watchFeatures()
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"group-commit", d.groupCommit.enabled()},
+		{"history", history},
+		{"lazy-rewrite", d.lazyRewrite},
+		{"read-only", d.readOnly},
+		{"replicas", len(d.replicas) > 0},
+		{"table-per-kind", d.tablePerKind},
+		{"write-rate-limit", d.writeLimit != nil},
+	} {
+		if f.on {
+			info.Features = append(info.Features, f.name)
+		}
+	}
+	return info
+}
+
+// WatcherCount returns how many watchers of this store are subscribed.
+// Watchers of other stores on its DB don't count, though they receive its
+// events.
+func (s *sqLiteStore[T]) WatcherCount() int {
+	s.h.muSubs.RLock()
+	defer s.h.muSubs.RUnlock()
+	seen := make(map[subscriber]struct{})
+	for _, m := range s.h.subs {
+		for sub := range m {
+			if s.owns(sub) {
+				seen[sub] = struct{}{}
+			}
+		}
+	}
+	for sub := range s.h.all {
+		if s.owns(sub) {
+			seen[sub] = struct{}{}
+		}
+	}
+	return len(seen)
+}
+
+// KindWatcherCount returns how many watchers of this store receive the
+// events of kind.
+func (s *sqLiteStore[T]) KindWatcherCount(kind string) int {
+	s.h.muSubs.RLock()
+	defer s.h.muSubs.RUnlock()
+	n := 0
+	for sub := range s.h.subs[kind] {
+		if s.owns(sub) {
+			n++
+		}
+	}
+	for sub := range s.h.all {
+		if s.owns(sub) {
+			n++
+		}
+	}
+	return n
+}
+
+// owns reports whether sub is a watcher of s.
+func (s *sqLiteStore[T]) owns(sub subscriber) bool {
+	w, ok := sub.(*watcher[T])
+	return ok && w.s == s
+}
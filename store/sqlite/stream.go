@@ -0,0 +1,415 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// DefaultStreamThreshold is the largest value SetReader stores in the main
+// table when Options.StreamThreshold is 0.
+const DefaultStreamThreshold = 1 << 20
+
+// streamChunk is the size of the rows a chunked value is split into.
+const streamChunk = 1 << 20
+
+const (
+	blobSchema = `
+CREATE TABLE IF NOT EXISTS zestor_blobs (
+  kind TEXT    NOT NULL,
+  key  TEXT    NOT NULL,
+  seq  INTEGER NOT NULL,
+  data BLOB    NOT NULL,
+  PRIMARY KEY(kind, key, seq)
+);
+CREATE TABLE IF NOT EXISTS zestor_blob_meta (
+  kind       TEXT    NOT NULL,
+  key        TEXT    NOT NULL,
+  size       INTEGER NOT NULL,
+  version    INTEGER NOT NULL,
+  updated_at TEXT    NOT NULL DEFAULT (STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')),
+  PRIMARY KEY(kind, key)
+);
+`
+	getMetaQuery     = `SELECT value, version, updated_at FROM zestor_kv WHERE kind=? AND key=?;`
+	getVersionQuery  = `SELECT version FROM zestor_kv WHERE kind=? AND key=?;`
+	setVersionQuery  = `INSERT INTO zestor_kv(kind,key,value,version) VALUES(?,?,?,?) ON CONFLICT(kind,key) DO NOTHING;`
+	blobMetaQuery    = `SELECT size, version, updated_at FROM zestor_blob_meta WHERE kind=? AND key=?;`
+	blobVersionQuery = `SELECT version FROM zestor_blob_meta WHERE kind=? AND key=?;`
+	putBlobMetaQuery = `INSERT OR REPLACE INTO zestor_blob_meta(kind,key,size,version) VALUES(?,?,?,?);`
+	putChunkQuery    = `INSERT INTO zestor_blobs(kind,key,seq,data) VALUES(?,?,?,?);`
+	getChunkQuery    = `SELECT data FROM zestor_blobs WHERE kind=? AND key=? AND seq=?;`
+)
+
+// Meta describes a value read with GetReader.
+type Meta struct {
+	// Size is the length of the value in bytes.
+	Size int64
+	// Version starts at 1 and is bumped by every write that changes the
+	// value.
+	Version int64
+	// UpdatedAt is when the value was last changed.
+	UpdatedAt time.Time
+}
+
+// Streamer is implemented by sqlite stores. It writes and reads values as
+// byte streams, so a value of hundreds of MB never has to be held in
+// memory at once.
+//
+// Values up to Options.StreamThreshold go to the main table like any
+// other: the bytes must then be the codec's encoding of a T for Get and
+// List to decode them. Larger values, and values of unknown size, are
+// split into rows of a side table and are only visible to GetReader and
+// Delete; Get, List, Count and the other typed reads don't see them. A
+// Set that creates the key removes its chunked value.
+//
+// The events of SetReader, and the delete events of chunked values, carry
+// a zero Object; GetReader returns the content.
+type Streamer interface {
+	// SetReader stores the size bytes read from r under kind and key. A
+	// negative size means unknown: the value is read to EOF and chunked. If
+	// r fails or doesn't yield size bytes, nothing is written. A chunked
+	// write holds the write lock until r is drained.
+	SetReader(kind, key string, r io.Reader, size int64) error
+	// GetReader returns the value of kind and key as a stream. The reader
+	// sees the value as of the call and must be closed; a chunked value
+	// keeps a read transaction open until then.
+	GetReader(kind, key string) (r io.ReadCloser, meta Meta, ok bool, err error)
+}
+
+func (s *sqLiteStore[T]) SetReader(kind, key string, r io.Reader, size int64) (err error) {
+	if err := s.checkKind(kind); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return store.ErrReadOnly
+	}
+
+	if size >= 0 && size <= s.h.streamThreshold {
+		data, err := io.ReadAll(io.LimitReader(r, size+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != size {
+			return fmt.Errorf("sqlite: SetReader %s/%s: got %d bytes, want %d", kind, key, len(data), size)
+		}
+		if err := s.h.ensureTable(kind); err != nil {
+			return err
+		}
+		return s.setSmall(kind, key, data)
+	}
+	return s.setChunked(kind, key, r, size)
+}
+
+// setSmall stores data in the main table, replacing a chunked value.
+func (s *sqLiteStore[T]) setSmall(kind, key string, data []byte) (err error) {
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	chunked, version, err := s.dropChunks(tx, kind, key)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(s.h.q(kind, setVersionQuery), kind, key, data, version+1)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	created := n > 0 && !chunked
+	if n == 0 {
+		var cur []byte
+		if err = tx.QueryRow(s.h.q(kind, getQuery), kind, key).Scan(&cur); err != nil {
+			return err
+		}
+		if bytes.Equal(cur, data) {
+			return tx.Commit()
+		}
+		if _, err = tx.Exec(s.h.q(kind, updateQuery), data, kind, key); err != nil {
+			return err
+		}
+	}
+	return s.commitStreamed(tx, kind, key, created, observed)
+}
+
+// setChunked stores the value read from r in chunks, replacing the key's
+// value in the main table or its previous chunks.
+func (s *sqLiteStore[T]) setChunked(kind, key string, r io.Reader, size int64) (err error) {
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var version int64
+	existed := false
+	if s.h.hasTable(kind) {
+		switch err = tx.QueryRow(s.h.q(kind, getVersionQuery), kind, key).Scan(&version); {
+		case err == nil:
+			existed = true
+			if _, err = tx.Exec(s.h.q(kind, deleteQuery), kind, key); err != nil {
+				return err
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+	}
+	if !existed {
+		var chunked bool
+		if chunked, version, err = s.dropChunks(tx, kind, key); err != nil {
+			return err
+		}
+		existed = chunked
+	} else if _, _, err = s.dropChunks(tx, kind, key); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(putChunkQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	buf := make([]byte, streamChunk)
+	var total int64
+	for seq := 0; ; seq++ {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err = stmt.ExecContext(ctx, kind, key, seq, buf[:n]); err != nil {
+				return err
+			}
+			total += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if size >= 0 && total != size {
+		return fmt.Errorf("sqlite: SetReader %s/%s: got %d bytes, want %d", kind, key, total, size)
+	}
+	if _, err = tx.Exec(putBlobMetaQuery, kind, key, total, version+1); err != nil {
+		return err
+	}
+	s.h.blobs.Store(true)
+	return s.commitStreamed(tx, kind, key, !existed, observed)
+}
+
+// commitStreamed commits a SetReader write and publishes its event.
+func (s *sqLiteStore[T]) commitStreamed(tx *writeTx, kind, key string, created, observed bool) (err error) {
+	var ev *store.Event[T]
+	if observed {
+		etype := store.EventTypeUpdate
+		if created {
+			etype = store.EventTypeCreate
+		}
+		ev = &store.Event[T]{Kind: kind, Name: key, EventType: etype}
+		if ev.Version, err = s.versionOf(tx, kind, key); err != nil {
+			return err
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if ev != nil {
+		ev.At = s.now()
+		s.publishStreamed(kind, ev)
+	}
+	return nil
+}
+
+// publishStreamed publishes ev, an event of a streamed value with a zero
+// Object. Its nil data tells watchers of other types so.
+func (s *sqLiteStore[T]) publishStreamed(kind string, ev *store.Event[T]) {
+	if s.afterWrite != nil {
+		s.afterWrite(ev)
+	}
+	s.publish(kind, ev, nil, nil)
+}
+
+// versionOf returns the version of the value kind and key hold in tx,
+// chunked or not, for the event of a write.
+func (s *sqLiteStore[T]) versionOf(tx *writeTx, kind, key string) (int64, error) {
+	var version int64
+	err := tx.QueryRow(s.h.q(kind, getVersionQuery), kind, key).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) && s.h.blobs.Load() {
+		err = tx.QueryRow(blobVersionQuery, kind, key).Scan(&version)
+	}
+	return version, err
+}
+
+// chunked reports whether kind and key hold a chunked value.
+func (s *sqLiteStore[T]) chunked(tx *writeTx, kind, key string) (bool, error) {
+	if !s.h.blobs.Load() {
+		return false, nil
+	}
+	var version int64
+	err := tx.QueryRow(blobVersionQuery, kind, key).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// dropChunks deletes the chunked value of kind and key in tx, reporting
+// whether there was one and its version. It does nothing until the DB has
+// held chunked values.
+func (s *sqLiteStore[T]) dropChunks(tx *writeTx, kind, key string) (existed bool, version int64, err error) {
+	if !s.h.blobs.Load() {
+		return false, 0, nil
+	}
+	switch err = tx.QueryRow(blobVersionQuery, kind, key).Scan(&version); {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, 0, nil
+	case err != nil:
+		return false, 0, err
+	}
+	if _, err = tx.Exec(`DELETE FROM zestor_blobs WHERE kind=? AND key=?;`, kind, key); err != nil {
+		return false, 0, err
+	}
+	if _, err = tx.Exec(`DELETE FROM zestor_blob_meta WHERE kind=? AND key=?;`, kind, key); err != nil {
+		return false, 0, err
+	}
+	return true, version, nil
+}
+
+func (s *sqLiteStore[T]) GetReader(kind, key string) (io.ReadCloser, Meta, bool, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, Meta{}, false, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, Meta{}, false, store.ErrClosed
+	}
+	s.mu.RUnlock()
+
+	if s.h.hasTable(kind) {
+		ctx, cancel := opCtx(s.h.readTimeout)
+		defer cancel()
+		var data []byte
+		var meta Meta
+		var updated string
+		switch err := s.reader(ctx).QueryRow(s.h.q(kind, getMetaQuery), kind, key).Scan(&data, &meta.Version, &updated); {
+		case err == nil:
+			meta.Size = int64(len(data))
+			if meta.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+				return nil, Meta{}, false, err
+			}
+			return io.NopCloser(bytes.NewReader(data)), meta, true, nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, Meta{}, false, timeoutErr(ctx, err)
+		}
+	}
+
+	// the chunks are read in one transaction, so the value can't change
+	// underneath the reader
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, Meta{}, false, err
+	}
+	var meta Meta
+	var updated string
+	switch err := tx.QueryRow(blobMetaQuery, kind, key).Scan(&meta.Size, &meta.Version, &updated); {
+	case errors.Is(err, sql.ErrNoRows):
+		_ = tx.Rollback()
+		return nil, Meta{}, false, nil
+	case err != nil:
+		_ = tx.Rollback()
+		return nil, Meta{}, false, err
+	}
+	if meta.UpdatedAt, err = time.Parse(time.RFC3339Nano, updated); err != nil {
+		_ = tx.Rollback()
+		return nil, Meta{}, false, err
+	}
+	return &chunkReader{tx: tx, kind: kind, key: key}, meta, true, nil
+}
+
+// chunkReader reads a chunked value one row at a time.
+type chunkReader struct {
+	tx        *sql.Tx
+	kind, key string
+	seq       int
+	buf       []byte // rest of the current chunk
+	chunk     []byte // reused for each chunk
+	err       error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.next()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next loads the next chunk into buf, or sets err at the end.
+func (c *chunkReader) next() {
+	if c.tx == nil {
+		c.err = errors.New("sqlite: read of closed value reader")
+		return
+	}
+	rows, err := c.tx.Query(getChunkQuery, c.kind, c.key, c.seq)
+	if err != nil {
+		c.err = err
+		return
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if c.err = rows.Err(); c.err == nil {
+			c.err = io.EOF
+		}
+		return
+	}
+	// copy out of the driver's memory into the reused chunk buffer
+	var raw sql.RawBytes
+	if c.err = rows.Scan(&raw); c.err != nil {
+		return
+	}
+	c.chunk = append(c.chunk[:0], raw...)
+	c.buf = c.chunk
+	c.seq++
+}
+
+func (c *chunkReader) Close() error {
+	if c.tx == nil {
+		return nil
+	}
+	err := c.tx.Rollback()
+	c.tx = nil
+	return err
+}
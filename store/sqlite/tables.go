@@ -0,0 +1,167 @@
+package sqlite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// kindTablePrefix prefixes the per-kind tables of Options.TablePerKind.
+	// It differs from the system tables' "zestor_" prefix so that no kind
+	// name can collide with them.
+	kindTablePrefix = "zestor_kind_"
+	// kindIndexPrefix prefixes the updated_at index of each per-kind
+	// table; indexes share the tables' namespace
+	kindIndexPrefix = "zestor_updated_"
+
+	// per-kind tables keep the kind column so every zestor_kv query runs
+	// unchanged against them; %[2]s names the updated_at index
+	kindTableSchema = `
+CREATE TABLE IF NOT EXISTS %[1]s (
+  kind       TEXT    NOT NULL,
+  key        TEXT    NOT NULL,
+  value      BLOB    NOT NULL,
+  version    INTEGER NOT NULL DEFAULT 1,
+  updated_at TEXT    NOT NULL DEFAULT (STRFTIME('%%Y-%%m-%%dT%%H:%%M:%%fZ','now')),
+  PRIMARY KEY(kind, key)
+);
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s(kind, updated_at);`
+)
+
+// quoteIdent quotes an SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// q rewrites a zestor_kv query to target kind's own table when
+// Options.TablePerKind is set.
+func (d *DB) q(kind, query string) string {
+	if !d.tablePerKind {
+		return query
+	}
+	return strings.ReplaceAll(query, "zestor_kv", quoteIdent(kindTablePrefix+kind))
+}
+
+// table returns the quoted name of the table holding kind.
+func (d *DB) table(kind string) string {
+	if !d.tablePerKind {
+		return "zestor_kv"
+	}
+	return quoteIdent(kindTablePrefix + kind)
+}
+
+// hasTable reports whether kind's table exists. It is always true for the
+// shared zestor_kv layout.
+func (d *DB) hasTable(kind string) bool {
+	if !d.tablePerKind {
+		return true
+	}
+	d.muTables.RLock()
+	_, ok := d.tables[kind]
+	d.muTables.RUnlock()
+	if ok {
+		return true
+	}
+	// the table may have been created through another DB or process
+	var n int
+	_ = d.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?;`, kindTablePrefix+kind).Scan(&n)
+	if n == 0 {
+		return false
+	}
+	d.muTables.Lock()
+	d.tables[kind] = struct{}{}
+	d.muTables.Unlock()
+	return true
+}
+
+// ensureTable creates kind's table on first write.
+func (d *DB) ensureTable(kind string) error {
+	if d.hasTable(kind) {
+		return nil
+	}
+	if _, err := d.execOwn(fmt.Sprintf(kindTableSchema, quoteIdent(kindTablePrefix+kind), quoteIdent(kindIndexPrefix+kind))); err != nil {
+		return err
+	}
+	d.muTables.Lock()
+	d.tables[kind] = struct{}{}
+	d.muTables.Unlock()
+	return nil
+}
+
+// loadTables fills the table cache from sqlite_master.
+func (d *DB) loadTables() error {
+	rows, err := d.db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name LIKE ? ESCAPE '\';`,
+		strings.ReplaceAll(kindTablePrefix, "_", `\_`)+"%")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		d.tables[strings.TrimPrefix(name, kindTablePrefix)] = struct{}{}
+	}
+	return rows.Err()
+}
+
+// tableKinds returns the kinds that have a table, sorted.
+func (d *DB) tableKinds() []string {
+	d.muTables.RLock()
+	defer d.muTables.RUnlock()
+	kinds := make([]string, 0, len(d.tables))
+	for k := range d.tables {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// countAllQuery counts the rows of every kind.
+func (d *DB) countAllQuery() string {
+	if !d.tablePerKind {
+		return `SELECT COUNT(*) FROM zestor_kv;`
+	}
+	parts := []string{`SELECT 0`}
+	for _, kind := range d.tableKinds() {
+		parts = append(parts, `(SELECT COUNT(*) FROM `+quoteIdent(kindTablePrefix+kind)+`)`)
+	}
+	return strings.Join(parts, " + ") + `;`
+}
+
+// kindsQuery selects the kinds that hold at least one key, sorted. It
+// returns "" when TablePerKind is set and no kind table exists yet; a
+// table whose keys were all deleted is left out like an absent one.
+func (d *DB) kindsQuery() string {
+	if !d.tablePerKind {
+		return `SELECT DISTINCT kind FROM zestor_kv ORDER BY kind;`
+	}
+	kinds := d.tableKinds()
+	if len(kinds) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, `SELECT * FROM (SELECT kind FROM `+quoteIdent(kindTablePrefix+kind)+` LIMIT 1)`)
+	}
+	return strings.Join(parts, " UNION ALL ") + ` ORDER BY kind;`
+}
+
+// allRowsQuery selects cols from every kind, ordered by kind and key. It
+// returns "" when TablePerKind is set and no kind table exists yet.
+func (d *DB) allRowsQuery(cols string) string {
+	if !d.tablePerKind {
+		return `SELECT ` + cols + ` FROM zestor_kv ORDER BY kind, key;`
+	}
+	kinds := d.tableKinds()
+	if len(kinds) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, `SELECT `+cols+` FROM `+quoteIdent(kindTablePrefix+kind))
+	}
+	return strings.Join(parts, " UNION ALL ") + ` ORDER BY kind, key;`
+}
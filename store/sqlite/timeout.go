@@ -0,0 +1,210 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// opCtx returns the context of one read or write: bounded by d, or
+// unbounded when d is 0.
+func opCtx(d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), d)
+}
+
+// timeoutErr reports err as store.ErrTimeout when it happened because ctx
+// ran out.
+func timeoutErr(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, store.ErrTimeout) {
+		return fmt.Errorf("sqlite: %w (%v)", store.ErrTimeout, err)
+	}
+	return err
+}
+
+// ctxQuerier runs a querier's queries under ctx, so read helpers taking a
+// querier honour Options.ReadTimeout.
+type ctxQuerier struct {
+	ctx context.Context
+	q   interface {
+		QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	}
+}
+
+func (c ctxQuerier) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.q.QueryContext(c.ctx, query, args...)
+}
+
+func (c ctxQuerier) QueryRow(query string, args ...any) *sql.Row {
+	return c.q.QueryRowContext(c.ctx, query, args...)
+}
+
+// reader returns the primary pool as a querier bound to ctx.
+func (s *sqLiteStore[T]) reader(ctx context.Context) querier {
+	return bindQuerier(ctx, s.db)
+}
+
+// bindQuerier returns db as a querier bound to ctx.
+func bindQuerier(ctx context.Context, db *sql.DB) querier {
+	if ctx.Done() == nil {
+		return db
+	}
+	return ctxQuerier{ctx: ctx, q: db}
+}
+
+// writeTx is a write transaction whose statements all run under the
+// write's context.
+type writeTx struct {
+	*sql.Tx
+	ctx context.Context
+	// release returns the connection the transaction was pinned to
+	release func()
+	// ended, if set, is called once the transaction commits, before the
+	// write publishes, and again on release
+	ended func()
+}
+
+// Commit commits the transaction and calls ended, so that the AfterWrite
+// hook and watchers run outside the gate of MaintenanceMode.
+func (tx *writeTx) Commit() error {
+	err := tx.Tx.Commit()
+	if tx.ended != nil {
+		tx.ended()
+	}
+	return err
+}
+
+func (tx *writeTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.ExecContext(tx.ctx, query, args...)
+}
+
+func (tx *writeTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.QueryContext(tx.ctx, query, args...)
+}
+
+func (tx *writeTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.QueryRowContext(tx.ctx, query, args...)
+}
+
+func (tx *writeTx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.PrepareContext(tx.ctx, query)
+}
+
+// begin starts a write transaction under ctx. Callers defer tx.release()
+// before any rollback so it runs once the transaction is over. It waits,
+// within ctx, for DB.MaintenanceMode to end, and holds it back until the
+// transaction commits or is released.
+//
+// SQLite's busy wait doesn't watch the context: a write waiting on a lock
+// would sit out the whole busy_timeout. When ctx has a deadline the
+// transaction therefore runs on a pinned connection whose busy_timeout is
+// capped to the time left, and restored on release.
+func (s *sqLiteStore[T]) begin(ctx context.Context) (*writeTx, error) {
+	if err := s.h.throttle(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.h.gate.enter(ctx); err != nil {
+		return nil, err
+	}
+	unlock, err := s.h.lockWriter(ctx)
+	if err != nil {
+		s.h.gate.leave()
+		return nil, err
+	}
+	var left sync.Once
+	leave := func() {
+		left.Do(func() {
+			unlock()
+			s.h.gate.leave()
+		})
+	}
+	done := s.h.ownWrite()
+	tx, err := s.beginTx(ctx)
+	if err != nil {
+		done()
+		leave()
+		return nil, err
+	}
+	release := tx.release
+	tx.ended = leave
+	tx.release = func() {
+		release()
+		done()
+		leave()
+	}
+	return s.tracked(tx), nil
+}
+
+// lockWriter waits, within ctx and Options.BusyTimeout, for the write
+// transactions of the DB that began before to end, and returns the func
+// that lets the next one begin. SQLite's busy handler polls the lock with
+// growing sleeps, so writers contending through it don't get it in turn:
+// under load one can lose every round until its busy_timeout runs out.
+// Queueing in the process keeps SQLite's lock for other processes.
+func (d *DB) lockWriter(ctx context.Context) (unlock func(), err error) {
+	if d.writer == nil {
+		return func() {}, nil
+	}
+	select {
+	case d.writer <- struct{}{}:
+		return func() { <-d.writer }, nil
+	default:
+	}
+	t := time.NewTimer(d.busyTimeout)
+	defer t.Stop()
+	select {
+	case d.writer <- struct{}{}:
+		return func() { <-d.writer }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.C:
+		return nil, fmt.Errorf("sqlite: database is locked: no write lock within busy_timeout %v", d.busyTimeout)
+	}
+}
+
+// beginTx starts the transaction of begin.
+func (s *sqLiteStore[T]) beginTx(ctx context.Context) (*writeTx, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &writeTx{Tx: tx, ctx: ctx, release: func() {}}, nil
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var busy int64
+	if err := conn.QueryRowContext(ctx, `PRAGMA busy_timeout;`).Scan(&busy); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	release := func() { _ = conn.Close() }
+	if left := time.Until(deadline).Milliseconds() + 1; busy > left {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA busy_timeout=%d;`, left)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		release = func() {
+			_, _ = conn.ExecContext(context.Background(), fmt.Sprintf(`PRAGMA busy_timeout=%d;`, busy))
+			_ = conn.Close()
+		}
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &writeTx{Tx: tx, ctx: ctx, release: release}, nil
+}
@@ -0,0 +1,277 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// The trash of store.SoftDeleter, part of kvSchema, holds the rows of every kind, in either
+// layout, with their labels apart from the live ones so that a key set
+// anew doesn't mix them up. deleted_at is the database clock's time, like
+// updated_at.
+const (
+	trashSchema = `
+CREATE TABLE IF NOT EXISTS zestor_trash (
+  kind       TEXT    NOT NULL,
+  key        TEXT    NOT NULL,
+  value      BLOB    NOT NULL,
+  version    INTEGER NOT NULL,
+  deleted_at TEXT    NOT NULL DEFAULT (STRFTIME('%Y-%m-%dT%H:%M:%fZ','now')),
+  PRIMARY KEY(kind, key)
+);
+CREATE INDEX IF NOT EXISTS idx_trash_deleted ON zestor_trash(kind, deleted_at);
+CREATE TABLE IF NOT EXISTS zestor_trash_labels (
+  kind  TEXT NOT NULL,
+  key   TEXT NOT NULL,
+  label TEXT NOT NULL,
+  value TEXT NOT NULL,
+  PRIMARY KEY(kind, key, label)
+);
+`
+	selectLiveQuery      = `SELECT value, version FROM zestor_kv WHERE kind=? AND key=?;`
+	trashRowQuery        = `INSERT OR REPLACE INTO zestor_trash(kind,key,value,version) SELECT kind, key, value, version FROM zestor_kv WHERE kind=?1 AND key=?2;`
+	dropTrashLabelsQuery = `DELETE FROM zestor_trash_labels WHERE kind=?1 AND key=?2;`
+	trashLabelsQuery     = `
+INSERT INTO zestor_trash_labels(kind,key,label,value)
+SELECT kind, key, label, value FROM zestor_labels WHERE kind=?1 AND key=?2;`
+	selectTrashedQuery = `SELECT value, version FROM zestor_trash WHERE kind=? AND key=?;`
+	restoreRowQuery    = `INSERT INTO zestor_kv(kind,key,value,version) SELECT kind, key, value, version FROM zestor_trash WHERE kind=?1 AND key=?2;`
+	restoreLabelsQuery = `
+INSERT OR REPLACE INTO zestor_labels(kind,key,label,value)
+SELECT kind, key, label, value FROM zestor_trash_labels WHERE kind=?1 AND key=?2;`
+	deleteTrashedQuery = `DELETE FROM zestor_trash WHERE kind=?1 AND key=?2;`
+	listTrashQuery     = `SELECT key, value FROM zestor_trash WHERE kind=?;`
+	purgeLabelsQuery   = `
+DELETE FROM zestor_trash_labels
+WHERE kind=?1 AND key IN (SELECT key FROM zestor_trash WHERE kind=?1 AND deleted_at < ?2);`
+	purgeTrashQuery = `DELETE FROM zestor_trash WHERE kind=?1 AND deleted_at < ?2;`
+)
+
+// SoftDelete moves the row of kind and key, with its labels, to the trash
+// in one transaction. Chunked values (Streamer) are not soft-deleted:
+// existed is false for them.
+func (s *sqLiteStore[T]) SoftDelete(kind, key string) (existed bool, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return false, store.ErrReadOnly
+	}
+	if !s.h.hasTable(kind) {
+		return false, nil
+	}
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var data []byte
+	var version int64
+	switch err = tx.QueryRow(s.h.q(kind, selectLiveQuery), kind, key).Scan(&data, &version); {
+	case errors.Is(err, sql.ErrNoRows):
+		err = nil
+		_ = tx.Rollback()
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	for _, q := range []string{s.h.q(kind, trashRowQuery), dropTrashLabelsQuery, trashLabelsQuery} {
+		if _, err = tx.Exec(q, kind, key); err != nil {
+			return false, err
+		}
+	}
+	if _, err = tx.Exec(`DELETE FROM zestor_labels WHERE kind=? AND key=?;`, kind, key); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(s.h.q(kind, deleteQuery), kind, key); err != nil {
+		return false, err
+	}
+	var ev *store.Event[T]
+	if observed {
+		// like Delete, a value that fails to decode is published omitted
+		ev = &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeDelete, Version: version}
+		if s.unmarshal(kind, key, data, &ev.Object) != nil {
+			var zero T
+			ev.Object, ev.PrevOmitted, data = zero, true, nil
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	if ev != nil {
+		ev.At = s.now()
+		s.publish(kind, ev, data, nil)
+	}
+	return true, nil
+}
+
+// Restore moves the trashed row back in one transaction.
+func (s *sqLiteStore[T]) Restore(kind, key string) (restored bool, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return false, store.ErrReadOnly
+	}
+	if err := s.h.ensureTable(kind); err != nil {
+		return false, err
+	}
+	observed := s.observed(kind)
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	var data []byte
+	var version int64
+	switch err = tx.QueryRow(selectTrashedQuery, kind, key).Scan(&data, &version); {
+	case errors.Is(err, sql.ErrNoRows):
+		err = nil
+		_ = tx.Rollback()
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	switch _, err = s.versionOf(tx, kind, key); {
+	case err == nil:
+		_ = tx.Rollback()
+		return false, store.ErrKeyExists
+	case !errors.Is(err, sql.ErrNoRows):
+		return false, err
+	}
+	for _, q := range []string{s.h.q(kind, restoreRowQuery), restoreLabelsQuery, dropTrashLabelsQuery, deleteTrashedQuery} {
+		if _, err = tx.Exec(q, kind, key); err != nil {
+			return false, err
+		}
+	}
+	var ev *store.Event[T]
+	if observed {
+		ev = &store.Event[T]{Kind: kind, Name: key, EventType: store.EventTypeCreate, Version: version}
+		if err = s.unmarshal(kind, key, data, &ev.Object); err != nil {
+			return false, err
+		}
+		if err = s.withinWrite(tx.Tx, ev); err != nil {
+			return false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	if ev != nil {
+		ev.At = s.now()
+		s.publish(kind, ev, data, nil)
+	}
+	return true, nil
+}
+
+// ListDeleted fails if a trashed value fails to decode.
+func (s *sqLiteStore[T]) ListDeleted(kind string) (map[string]T, error) {
+	if err := s.checkKind(kind); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	ctx, cancel := opCtx(s.h.readTimeout)
+	defer cancel()
+	out := make(map[string]T)
+	err := s.read(ctx, func(q querier) error {
+		rows, err := q.Query(listTrashQuery, kind)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var k string
+			var data []byte
+			if err := rows.Scan(&k, &data); err != nil {
+				return err
+			}
+			var v T
+			if err := s.unmarshal(kind, k, data, &v); err != nil {
+				return err
+			}
+			out[k] = v
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, timeoutErr(ctx, err)
+	}
+	return out, nil
+}
+
+// PurgeDeleted compares cutoff with deleted_at, the database clock's time
+// of the soft delete, not StoreOptions.Now.
+func (s *sqLiteStore[T]) PurgeDeleted(kind string, cutoff time.Time) (n int, err error) {
+	if err := s.checkKind(kind); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return 0, store.ErrClosed
+	}
+	s.mu.RUnlock()
+	if s.h.readOnly {
+		return 0, store.ErrReadOnly
+	}
+	ctx, cancel := opCtx(s.h.writeTimeout)
+	defer cancel()
+	defer func() { err = timeoutErr(ctx, err) }()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.release()
+	defer func() { _ = rollbackIfNeeded(tx.Tx, &err) }()
+
+	c := updatedAtCutoff(cutoff)
+	if _, err = tx.Exec(purgeLabelsQuery, kind, c); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(purgeTrashQuery, kind, c)
+	if err != nil {
+		return 0, err
+	}
+	rows, _ := res.RowsAffected()
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(rows), nil
+}
@@ -1,18 +1,123 @@
+// Package store defines the interfaces the zestor backends implement and
+// the helpers shared between them.
+//
+// # Empty kinds
+//
+// A kind exists as long as it holds a key; there is no way to create or
+// drop one. A kind that never held a key therefore reads exactly like one
+// whose keys were all deleted:
+//
+//   - Get returns the zero value, false and a nil error
+//   - Count returns 0
+//   - List, ListPrefix, KeySegments, Keys, Values and SelectByLabel return
+//     an empty, non-nil map or slice
+//   - Kinds and GetAll leave the kind out
+//
+// More generally, no Reader method returns a nil map or slice with a nil
+// error, so callers may range over or index results without checking for
+// nil. Errors still apply: a kind outside StoreOptions.AllowedKinds is
+// ErrUnknownKind, not an empty kind. Package storetest checks a backend
+// against these rules.
+//
+// # Zero values and absence
+//
+// A stored zero value is a value like any other: Get returns it with ok
+// true, while a missing key returns the zero value with ok false. Check ok
+// rather than comparing the value with the zero value, or store pointers
+// when the zero value must stand for "unset". A zero value stored by
+// mistake, like a struct that was never filled in, reads back as present;
+// StoreOptions.RejectZeroValues makes such writes fail with ErrZeroValue
+// instead.
+//
+// # Optional interfaces
+//
+// Beyond Store, a backend may implement optional interfaces for what not
+// every backend can do, such as Pruner or Swapper. Check for one with a
+// type assertion or, where the interface has one, call the helper named
+// after its method, such as Swap: it returns ErrUnsupported for a store
+// without the method or, like ListPrefix, falls back on the core methods.
+// The gomap and sqlite stores implement all of them. Stores returned by
+// Open implement them too, and their methods do what the helper does on
+// the backend, or return ErrUnsupported if there is no helper and the
+// backend doesn't.
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	ErrClosed       = errors.New("store closed")
-	ErrKeyNotFound  = errors.New("key not found")
+	ErrClosed      = errors.New("store closed")
+	ErrKeyNotFound = errors.New("key not found")
+	// Deprecated: the empty kind is a valid namespace like any other and
+	// no method returns ErrKindRequired anymore.
 	ErrKindRequired = errors.New("kind required")
+	// ErrSeparatorRequired is returned by KeySegments for an empty separator.
+	ErrSeparatorRequired = errors.New("separator required")
+	// ErrOutsideSnapshot is returned when a snapshot view is asked about a
+	// kind other than the one it was taken for.
+	ErrOutsideSnapshot = errors.New("kind outside snapshot")
+	// ErrSnapshotExpired is returned by a snapshot view held past the
+	// backend's maximum snapshot duration.
+	ErrSnapshotExpired = errors.New("snapshot expired")
+	// ErrUnsupported is returned for operations the backend, or its current
+	// configuration, cannot perform. It is errors.ErrUnsupported.
+	ErrUnsupported = errors.ErrUnsupported
+	// ErrTimeout is returned when an operation runs past a timeout the
+	// backend was configured with. It wraps context.DeadlineExceeded. The
+	// in-memory backend has no timeouts and never returns it.
+	ErrTimeout = fmt.Errorf("timed out: %w", context.DeadlineExceeded)
+	// ErrRateLimited is returned by writes over a rate limit the backend
+	// was configured with. The in-memory backend has no rate limits.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrNoKinds is returned by WatchKinds for an empty list of kinds.
+	ErrNoKinds = errors.New("no kinds to watch")
+	// ErrCodecPanic is returned when the codec panicked while encoding or
+	// decoding a value. The operation's transaction is rolled back.
+	ErrCodecPanic = errors.New("codec panicked")
+	// ErrReadOnly is returned by the writes of a store opened read-only.
+	ErrReadOnly = errors.New("store is read-only")
+	// ErrUnknownKind is returned for a kind outside
+	// StoreOptions.AllowedKinds.
+	ErrUnknownKind = errors.New("unknown kind")
+	// ErrResultTooLarge is matched by the *ResultTooLargeError of reads
+	// over StoreOptions.MaxListResults or MaxGetAllResults.
+	ErrResultTooLarge = errors.New("result too large")
+	// ErrKeyExists is returned by a CreateOnly write to a key that holds a
+	// value, and by Add when every key it generated was taken.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrZeroValue is returned by writes of the zero value to a kind that
+	// StoreOptions.RejectZeroValues guards.
+	ErrZeroValue = errors.New("zero value")
+	// ErrKindNotEmpty is returned by CopyKind and RenameKind (KindMover)
+	// when the destination kind holds keys and WithOverwrite wasn't passed.
+	ErrKindNotEmpty = errors.New("kind not empty")
+	// ErrInitialReplayFiltered is returned by watches asking for the
+	// initial replay, which sends create events, with WithEventTypes
+	// excluding EventTypeCreate.
+	ErrInitialReplayFiltered = errors.New("initial replay with create events filtered out")
+	// ErrSynchronousHistory is returned by synchronous watches
+	// (WithSynchronous) asking for a history replay, which only fills a
+	// buffer.
+	ErrSynchronousHistory = errors.New("history replay on a synchronous watch")
+	// ErrDuplicate is matched by a *DuplicateError, returned by writes that
+	// would give a unique field (see package unique) a value another key
+	// holds.
+	ErrDuplicate = errors.New("duplicate value")
 )
 
-// Reader provides read-only access to the store.
+// Reader provides read-only access to the store. Unknown kinds read as
+// empty ones, never as nil results; see the package documentation.
 type Reader[T any] interface {
+	// Get returns the value of key. ok tells a stored zero value (true)
+	// from a missing key (false); both return the zero value.
 	Get(kind, key string) (val T, ok bool, err error)
 	List(kind string, filter ...FilterFunc[T]) (map[string]T, error)
 	Count(kind string) (int, error)
@@ -23,10 +128,18 @@ type Reader[T any] interface {
 
 // Writer provides write access to the store.
 type Writer[T any] interface {
-	Set(kind, key string, value T) (created bool, err error)
-	SetFn(kind, key string, fn func(v T) (T, error)) (changed bool, err error)
-	SetAll(kind string, values map[string]T) error
-	Delete(kind, key string) (existed bool, prev T, err error)
+	Set(kind, key string, value T, opts ...WriteOption) (created bool, err error)
+	// SetFn replaces the value of key with what fn returns for it. As with
+	// Set, a normalized result equal to the stored value is a no-op that
+	// bumps no version and publishes nothing.
+	SetFn(kind, key string, fn func(v T) (T, error), opts ...WriteOption) (changed bool, err error)
+	// SetAll sets every value of the map in no particular order; its
+	// events list the created keys first, then the updated ones.
+	SetAll(kind string, values map[string]T, opts ...WriteOption) error
+	// Delete removes the value of kind and key and returns it. If the
+	// stored value fails to decode, the key is still deleted: existed is
+	// true, prev is zero and err tells why. WithoutPrev skips reading prev.
+	Delete(kind, key string, opts ...WriteOption) (existed bool, prev T, err error)
 }
 
 // Watcher provides the ability to watch for changes.
@@ -34,6 +147,600 @@ type Watcher[T any] interface {
 	Watch(kind string, opts ...WatchOption[T]) (r <-chan *Event[T], cancel func(), err error)
 }
 
+// KindsWatcher is implemented by stores that can watch several kinds on
+// one channel.
+type KindsWatcher[T any] interface {
+	// WatchKinds is like Watch for several kinds at once: their events are
+	// delivered in publish order on one channel, with one buffer and one
+	// drop count, and cancel ends the subscription on every kind. Initial
+	// replay covers each of the kinds, in order. Duplicate kinds are
+	// ignored; an empty list returns ErrNoKinds.
+	WatchKinds(kinds []string, opts ...WatchOption[T]) (r <-chan *Event[T], cancel func(), err error)
+}
+
+// WatchKinds returns the WatchKinds of w if it is a KindsWatcher, and
+// ErrUnsupported otherwise.
+func WatchKinds[T any](w Watcher[T], kinds []string, opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	kw, ok := w.(KindsWatcher[T])
+	if !ok {
+		return nil, nil, ErrUnsupported
+	}
+	return kw.WatchKinds(kinds, opts...)
+}
+
+// AllWatcher is implemented by stores that can watch every kind on one
+// channel, present and future.
+type AllWatcher[T any] interface {
+	// WatchAll is like WatchKinds for every kind, including kinds first
+	// written after it subscribed. Initial replay and WithReplayHistory
+	// cover the kinds that exist when it subscribes, in sorted order.
+	WatchAll(opts ...WatchOption[T]) (r <-chan *Event[T], cancel func(), err error)
+}
+
+// WatchAll returns the WatchAll of s if it is an AllWatcher, and
+// otherwise the WatchKinds of the Kinds of s. The fallback misses the
+// kinds first written after it subscribed, and returns ErrNoKinds while s
+// holds no kind.
+func WatchAll[T any](s Store[T], opts ...WatchOption[T]) (<-chan *Event[T], func(), error) {
+	if aw, ok := s.(AllWatcher[T]); ok {
+		return aw.WatchAll(opts...)
+	}
+	kinds, err := Kinds(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return WatchKinds(s, kinds, opts...)
+}
+
+// HandleWatcher is implemented by stores whose subscriptions can be
+// adjusted and inspected while they are live.
+type HandleWatcher[T any] interface {
+	// WatchH is like Watch but returns a handle whose key allowlist can be
+	// adjusted while the subscription is live.
+	WatchH(kind string, opts ...WatchOption[T]) (*WatchHandle[T], error)
+}
+
+// WatchH returns the WatchH of w if it is a HandleWatcher, and
+// ErrUnsupported otherwise.
+func WatchH[T any](w Watcher[T], kind string, opts ...WatchOption[T]) (*WatchHandle[T], error) {
+	hw, ok := w.(HandleWatcher[T])
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return hw.WatchH(kind, opts...)
+}
+
+// WatchHandle is a live subscription returned by WatchH.
+type WatchHandle[T any] struct {
+	// C receives the events; it is closed on Cancel or when the store closes.
+	C <-chan *Event[T]
+	// Cancel unsubscribes and closes C.
+	Cancel func()
+	// AddKey adds key to the watcher's allowlist. While the allowlist is
+	// empty, events for every key are delivered.
+	AddKey func(key string)
+	// RemoveKey removes key from the watcher's allowlist.
+	RemoveKey func(key string)
+	// Stats reports the subscription's counters. It keeps working after
+	// Cancel, with the counts at the time the subscription ended.
+	Stats func() WatchStats
+}
+
+// WatchStats describes the health of one subscription. A consumer that
+// lags shows a BufferLen close to BufferCap and a growing Dropped.
+type WatchStats struct {
+	// Delivered counts the events put in the buffer, replayed ones
+	// included.
+	Delivered int64
+	// Dropped counts the events lost because the buffer was full.
+	Dropped int64
+	// BufferLen is the number of events waiting in the buffer, out of
+	// BufferCap (WithBufferSize).
+	BufferLen int
+	BufferCap int
+	// Age is the time since the subscription started.
+	Age time.Duration
+}
+
+// MultiKindWriter is implemented by stores that can write to several kinds
+// in one atomic step, e.g. a value and a message about it (see package
+// outbox).
+type MultiKindWriter[T any] interface {
+	// SetMulti sets every value in one atomic step: if one fails to
+	// normalize, validate or store, none is written. Values are written
+	// and published in slice order, kind by kind in the order each kind
+	// first appears; a kind and key listed more than once is written
+	// once, with its last value, as in SetAllOrdered.
+	SetMulti(values []KindKeyValue[T]) error
+}
+
+// KindKeyValue is a value with its kind and key, for SetMulti.
+type KindKeyValue[T any] struct {
+	Kind  string
+	Key   string
+	Value T
+}
+
+// GroupKinds implements SetMulti for a backend: it returns the kinds of
+// values in the order of their first occurrence, and the keys and values
+// of each as DedupeKeyValues does.
+func GroupKinds[T any](values []KindKeyValue[T]) (kinds []string, keys map[string][]string, byKind map[string]map[string]T) {
+	kvs := make(map[string][]KeyValue[T])
+	for _, v := range values {
+		if _, ok := kvs[v.Kind]; !ok {
+			kinds = append(kinds, v.Kind)
+		}
+		kvs[v.Kind] = append(kvs[v.Kind], KeyValue[T]{Key: v.Key, Value: v.Value})
+	}
+	keys = make(map[string][]string, len(kinds))
+	byKind = make(map[string]map[string]T, len(kinds))
+	for _, kind := range kinds {
+		keys[kind], byKind[kind] = DedupeKeyValues(kvs[kind])
+	}
+	return kinds, keys, byKind
+}
+
+// Replacer is implemented by stores that can make a kind hold exactly a
+// given set of values in one atomic step, e.g. to sync a kind to a desired
+// state computed elsewhere without a racy set-then-delete pass.
+type Replacer[T any] interface {
+	// ReplaceAll sets each of values and deletes every other key of kind,
+	// in one atomic step: if a value fails to normalize or validate,
+	// nothing is written. A value the store already holds
+	// (StoreOptions.CompareFn) keeps its version and publishes no event.
+	// Once written, the creates are published, then the updates, then the
+	// deletes, each in key order, so watchers see the new keys before the
+	// old ones go. With DryRun it writes nothing and only reports. It
+	// honors Silent.
+	ReplaceAll(kind string, values map[string]T, opts ...WriteOption) (ReplaceReport, error)
+}
+
+// ReplaceReport lists the keys ReplaceAll created, updated, left
+// unchanged and deleted, or would have with DryRun, each sorted.
+type ReplaceReport struct {
+	Created   []string
+	Updated   []string
+	Unchanged []string
+	Deleted   []string
+}
+
+// Sampler is implemented by stores that can pick entries of a kind at
+// random without listing it, e.g. to spot-check the data or build a
+// preview.
+type Sampler[T any] interface {
+	// Sample returns up to n entries of kind, picked pseudo-randomly and
+	// in random order: all of them if kind holds n or fewer. It returns
+	// an empty slice if n <= 0.
+	Sample(kind string, n int) ([]KeyValue[T], error)
+}
+
+// KeyChecker is implemented by stores that can tell which of many keys
+// hold a value without reading the values, e.g. to split an import into
+// creates and updates.
+type KeyChecker interface {
+	// ExistingKeys reports for each of keys whether kind holds a value
+	// under it. The map has an entry for every key.
+	ExistingKeys(kind string, keys []string) (map[string]bool, error)
+}
+
+// Versioner is implemented by stores that can report the version of each
+// key, the Version of its latest event.
+type Versioner interface {
+	// Versions returns the version of every key of kind. Record them
+	// before listing kind and pass them to WithMinVersions, so a watch
+	// started afterwards skips the events List already reflected.
+	Versions(kind string) (map[string]int64, error)
+}
+
+// Pruner is implemented by stores that record when each key last changed
+// and can drop old keys by that time alone, without decoding values, for
+// retention jobs. A key is older than cutoff if it last changed strictly
+// before it.
+type Pruner interface {
+	// CountOlderThan returns how many keys of kind are older than cutoff.
+	CountOlderThan(kind string, cutoff time.Time) (int, error)
+	// DeleteOlderThan deletes the keys of kind older than cutoff, with
+	// their labels, in one atomic step, and returns how many it deleted.
+	// It publishes no events unless WithDeleteEvents is passed.
+	DeleteOlderThan(kind string, cutoff time.Time, opts ...WriteOption) (int, error)
+}
+
+// KindMover is implemented by stores that can copy or rename a whole kind
+// in one atomic step without decoding its values. Keys keep their value,
+// labels, version and change time, except where they overwrite a key (see
+// WithOverwrite). srcKind and dstKind must differ.
+//
+// Both fail with ErrKindNotEmpty if dstKind holds keys, unless
+// WithOverwrite is passed. They publish no events unless WithKindEvents
+// is passed.
+type KindMover interface {
+	// CopyKind copies every key of srcKind to dstKind and returns how
+	// many it copied.
+	CopyKind(srcKind, dstKind string, opts ...WriteOption) (int, error)
+	// RenameKind moves every key of srcKind to dstKind, leaving srcKind
+	// empty, and returns how many it moved.
+	RenameKind(srcKind, dstKind string, opts ...WriteOption) (int, error)
+}
+
+// SoftDeleter is implemented by stores that can move a key to a trash of
+// its kind instead of deleting it, so that it can be restored, for undo.
+// A trashed key is hidden from every read and can be set anew; its trash
+// entry stays until Restore or PurgeDeleted.
+type SoftDeleter[T any] interface {
+	// SoftDelete moves the value of kind and key, with its labels and
+	// version, to the trash, replacing a value trashed earlier under the
+	// same key, and publishes a delete event. existed is false if the key
+	// holds no value.
+	SoftDelete(kind, key string) (existed bool, err error)
+	// Restore moves the trashed value of kind and key back, with its
+	// labels and the version it had, and publishes a create event.
+	// restored is false if the trash holds no such key. It fails with
+	// ErrKeyExists, keeping the trash entry, if the key was set anew.
+	Restore(kind, key string) (restored bool, err error)
+	// ListDeleted returns the trashed values of kind.
+	ListDeleted(kind string) (map[string]T, error)
+	// PurgeDeleted drops the values of kind trashed strictly before
+	// cutoff, for ending the grace period of deletes, and returns how
+	// many it dropped.
+	PurgeDeleted(kind string, cutoff time.Time) (int, error)
+}
+
+// FilterQuerier is implemented by stores that can select the values of a
+// kind with a Filter, which, unlike a FilterFunc, a backend may evaluate
+// without decoding every value.
+//
+// Its methods fail with a *FilterError, and change nothing, if f is
+// malformed or compares a field of a value of kind with a Value of
+// another type.
+type FilterQuerier[T any] interface {
+	// ListWhere returns the values of kind that pass f.
+	ListWhere(kind string, f Filter) (map[string]T, error)
+	// CountWhere returns how many values of kind pass f.
+	CountWhere(kind string, f Filter) (int, error)
+	// DeleteWhere deletes the values of kind that pass f, with their
+	// labels, in one atomic step, and returns how many it deleted. It
+	// publishes no events unless WithDeleteEvents is passed.
+	DeleteWhere(kind string, f Filter, opts ...WriteOption) (int, error)
+}
+
+// FilterStreamer is implemented by stores that can filter a large kind
+// without holding it in memory: List decodes every value into one map
+// before it returns, FilterStream hands the values over one at a time.
+type FilterStreamer[T any] interface {
+	// FilterStream calls fn with each value of kind that filter keeps,
+	// or every value if filter is nil, in key order, and stops with the
+	// first error fn returns. It reads kind in chunks, not as one
+	// snapshot: each key is seen at most once, and writes made meanwhile,
+	// by fn too, may or may not be.
+	FilterStream(kind string, filter FilterFunc[T], fn func(key string, val T) error) error
+}
+
+// WatchCounter is implemented by stores that can tell how many watchers
+// are subscribed to them, e.g. for tests to catch a watch whose cancel was
+// never called. The gomap and sqlite stores, stores returned by Open, and
+// the OverlayStore, debug, loader and typed wrappers implement it; a wrapper
+// reports 0 if the store it wraps doesn't.
+type WatchCounter interface {
+	// WatcherCount returns how many watchers are subscribed, each counted
+	// once whatever kinds it watches. Cancelled, evicted and closed
+	// watchers are not counted.
+	WatcherCount() int
+	// KindWatcherCount returns how many of them receive the events of
+	// kind, including those of WatchAll.
+	KindWatcherCount(kind string) int
+}
+
+// WatcherCountOf returns the WatcherCount of s if it is a WatchCounter,
+// and 0 otherwise.
+func WatcherCountOf(s any) int {
+	if c, ok := s.(WatchCounter); ok {
+		return c.WatcherCount()
+	}
+	return 0
+}
+
+// KindWatcherCountOf returns the KindWatcherCount of s if it is a
+// WatchCounter, and 0 otherwise.
+func KindWatcherCountOf(s any, kind string) int {
+	if c, ok := s.(WatchCounter); ok {
+		return c.KindWatcherCount(kind)
+	}
+	return 0
+}
+
+// Introspector is implemented by stores that can tell how they were
+// built, for wrappers and tooling that handle their encoded values, such
+// as exporters. The gomap and sqlite stores, stores returned by Open, and
+// the OverlayStore, debug, loader and typed wrappers implement it. A wrapper
+// reports the store it wraps with itself added to Info.Wrappers, or only
+// itself, and a nil Codec, if that store doesn't implement it.
+type Introspector interface {
+	// Codec returns the codec the store encodes values with, nil for a
+	// store that keeps them as they are.
+	Codec() Codec
+	// Info describes the store.
+	Info() Info
+}
+
+// Info describes a store, as Introspector reports it.
+type Info struct {
+	// Backend names the implementation: "gomap" or "sqlite".
+	Backend string
+	// Location is where the data lives, without credentials or options:
+	// the database file of sqlite, ":memory:" for an in-memory database,
+	// and empty for gomap.
+	Location string
+	// Table is the table holding the values, empty if there is none. With
+	// sqlite's TablePerKind it is the pattern naming the kinds' tables.
+	Table string
+	// Features lists, sorted, the options in effect that tooling may care
+	// about, such as "history" (StoreOptions.EventHistory), "read-only" or
+	// "ttl"; the backends and wrappers document theirs.
+	Features []string
+	// Wrappers lists the wrappers the store is seen through, innermost
+	// first, e.g. ["overlay", "loader"].
+	Wrappers []string
+	// WatchFeatures lists, sorted, the watch features the store supports,
+	// as WithRequire checks them.
+	WatchFeatures []WatchFeature
+}
+
+// CodecOf returns the Codec of s if it is an Introspector, and nil
+// otherwise.
+func CodecOf(s any) Codec {
+	if i, ok := s.(Introspector); ok {
+		return i.Codec()
+	}
+	return nil
+}
+
+// WrappedInfo returns the Info of inner, the store a wrapper wraps, with
+// wrapper appended to its Wrappers and features added to its Features,
+// for wrappers implementing Introspector. If inner isn't an Introspector,
+// the Info holds only the wrapper and its features.
+func WrappedInfo(inner any, wrapper string, features ...string) Info {
+	var info Info
+	if i, ok := inner.(Introspector); ok {
+		info = i.Info()
+	}
+	info.Wrappers = append(append([]string(nil), info.Wrappers...), wrapper)
+	info.Features = append(append([]string(nil), info.Features...), features...)
+	slices.Sort(info.Features)
+	info.Features = slices.Compact(info.Features)
+	return info
+}
+
+// Snapshotter is implemented by stores that provide consistent
+// multi-call reads.
+type Snapshotter[T any] interface {
+	// Snapshot returns a read-only view of kind frozen at the time of the
+	// call: writes made afterwards are not visible through it, so Count,
+	// Keys and List on the view always agree. The release func must always
+	// be called once the view is no longer needed.
+	Snapshot(kind string) (view Reader[T], release func(), err error)
+}
+
+// Snapshot returns the Snapshot of r if it is a Snapshotter, and
+// ErrUnsupported otherwise.
+func Snapshot[T any](r Reader[T], kind string) (view Reader[T], release func(), err error) {
+	sn, ok := r.(Snapshotter[T])
+	if !ok {
+		return nil, nil, ErrUnsupported
+	}
+	return sn.Snapshot(kind)
+}
+
+// KindLister is implemented by stores, and their snapshot views, that can
+// list their kinds without reading the values.
+type KindLister interface {
+	// Kinds returns the known kinds, sorted.
+	Kinds() ([]string, error)
+}
+
+// Kinds returns the Kinds of r if it is a KindLister, and otherwise the
+// kinds holding a value in the GetAll of r, sorted.
+func Kinds[T any](r Reader[T]) ([]string, error) {
+	if kl, ok := r.(KindLister); ok {
+		return kl.Kinds()
+	}
+	all, err := r.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	kinds := make([]string, 0, len(all))
+	for kind := range all {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	return kinds, nil
+}
+
+// PrefixReader is implemented by stores, and their snapshot views, that
+// can read the keys of a kind as paths, e.g. built with package
+// compositekey, without going through the whole kind.
+type PrefixReader[T any] interface {
+	// ListPrefix returns the values of kind whose key starts with prefix.
+	ListPrefix(kind, prefix string) (map[string]T, error)
+	// KeySegments returns the distinct next path segments of the keys under
+	// prefix, sorted, without decoding any value. A segment is the part of
+	// the key after prefix up to and including the next separator
+	// ("org1/"), or the rest of the key if it has no further separator
+	// ("leaf"). Drill down with prefix+segment.
+	KeySegments(kind, separator, prefix string) ([]string, error)
+}
+
+// ListPrefix returns the ListPrefix of r if it is a PrefixReader, and
+// otherwise the List of kind filtered by prefix.
+func ListPrefix[T any](r Reader[T], kind, prefix string) (map[string]T, error) {
+	if pr, ok := r.(PrefixReader[T]); ok {
+		return pr.ListPrefix(kind, prefix)
+	}
+	return r.List(kind, func(key string, _ T) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// KeySegments returns the KeySegments of r if it is a PrefixReader, and
+// otherwise the segments of the Keys of kind.
+func KeySegments[T any](r Reader[T], kind, separator, prefix string) ([]string, error) {
+	if pr, ok := r.(PrefixReader[T]); ok {
+		return pr.KeySegments(kind, separator, prefix)
+	}
+	if separator == "" {
+		return nil, ErrSeparatorRequired
+	}
+	keys, err := r.Keys(kind)
+	if err != nil {
+		return nil, err
+	}
+	return keySegments(keys, separator, prefix), nil
+}
+
+// keySegments returns the distinct next segments of keys under prefix,
+// sorted, as KeySegments does.
+func keySegments(keys []string, separator, prefix string) []string {
+	segments := make([]string, 0)
+	for _, k := range keys {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, separator); i >= 0 {
+			rest = rest[:i+len(separator)]
+		}
+		segments = append(segments, rest)
+	}
+	slices.Sort(segments)
+	return slices.Compact(segments)
+}
+
+// OrderedWriter is implemented by stores that can write a batch of values
+// in a given order.
+type OrderedWriter[T any] interface {
+	// SetAllOrdered is SetAll for a slice: it writes the values, and
+	// publishes their events, in slice order. A key listed more than once
+	// is written once, with its last value, at its first position, so a
+	// parent written before its children stays first.
+	SetAllOrdered(kind string, values []KeyValue[T]) error
+}
+
+// SetAllOrdered calls the SetAllOrdered of w if it is an OrderedWriter,
+// and otherwise writes values with SetMulti if w is a MultiKindWriter. It
+// returns ErrUnsupported if w is neither.
+func SetAllOrdered[T any](w Writer[T], kind string, values []KeyValue[T]) error {
+	if ow, ok := w.(OrderedWriter[T]); ok {
+		return ow.SetAllOrdered(kind, values)
+	}
+	mw, ok := w.(MultiKindWriter[T])
+	if !ok {
+		return ErrUnsupported
+	}
+	kvs := make([]KindKeyValue[T], len(values))
+	for i, kv := range values {
+		kvs[i] = KindKeyValue[T]{Kind: kind, Key: kv.Key, Value: kv.Value}
+	}
+	return mw.SetMulti(kvs)
+}
+
+// Merger is implemented by stores that can merge values into a kind in
+// one atomic step.
+type Merger[T any] interface {
+	// MergeAll is SetAll for reconciling two sources: for a key that
+	// already holds a value, resolve(key, existing, incoming) returns the
+	// value to store; new keys store the incoming value, and a nil resolve
+	// keeps it for every key. The merge is one atomic step, so resolve sees
+	// the values it replaces and must not call the store. Only keys whose
+	// final value differs from the existing one are written and get an
+	// event. Final values are normalized and validated; one failing aborts
+	// the merge.
+	MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error
+}
+
+// MergeAll calls the MergeAll of w if it is a Merger, and returns
+// ErrUnsupported otherwise.
+func MergeAll[T any](w Writer[T], kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error {
+	m, ok := w.(Merger[T])
+	if !ok {
+		return ErrUnsupported
+	}
+	return m.MergeAll(kind, incoming, resolve)
+}
+
+// Adder is implemented by stores that generate the keys of new values.
+type Adder[T any] interface {
+	// Add stores value under a new key from StoreOptions.KeyGen and
+	// returns the key. It never replaces a value: a generated key that is
+	// taken is replaced by another, up to AddAttempts times.
+	Add(kind string, value T) (key string, err error)
+}
+
+// Add returns the Add of w if it is an Adder, and otherwise sets value
+// with CreateOnly under a key from NewUUIDv7, as AddNew does.
+func Add[T any](w Writer[T], kind string, value T) (string, error) {
+	if a, ok := w.(Adder[T]); ok {
+		return a.Add(kind, value)
+	}
+	return AddNew(nil, func(key string) error {
+		_, err := w.Set(kind, key, value, CreateOnly())
+		return err
+	})
+}
+
+// Swapper is implemented by stores that can exchange the values of two
+// keys in one atomic step.
+type Swapper interface {
+	// Swap exchanges the values of keyA and keyB of kind atomically and
+	// publishes an update event for each. Labels stay with their keys. It
+	// returns ErrKeyNotFound if either key is missing.
+	Swap(kind, keyA, keyB string) error
+}
+
+// Swap calls the Swap of s if it is a Swapper, and returns ErrUnsupported
+// otherwise.
+func Swap(s any, kind, keyA, keyB string) error {
+	sw, ok := s.(Swapper)
+	if !ok {
+		return ErrUnsupported
+	}
+	return sw.Swap(kind, keyA, keyB)
+}
+
+// LabelReader is implemented by stores, and their snapshot views, that
+// can select values by the labels attached to their keys (LabelWriter).
+type LabelReader[T any] interface {
+	// SelectByLabel returns the values of kind whose labels match every
+	// label=value pair of selector. An empty selector matches everything.
+	SelectByLabel(kind string, selector map[string]string) ([]KeyValue[T], error)
+}
+
+// SelectByLabel returns the SelectByLabel of r if it is a LabelReader,
+// and ErrUnsupported otherwise.
+func SelectByLabel[T any](r Reader[T], kind string, selector map[string]string) ([]KeyValue[T], error) {
+	lr, ok := r.(LabelReader[T])
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return lr.SelectByLabel(kind, selector)
+}
+
+// LabelWriter is implemented by stores that can attach labels to keys,
+// string pairs kept beside the value for LabelReader to select by.
+type LabelWriter[T any] interface {
+	// SetLabeled is like Set but also replaces the labels attached to the
+	// key. Plain Set keeps existing labels; Delete removes them.
+	SetLabeled(kind, key string, value T, labels map[string]string) (created bool, err error)
+}
+
+// SetLabeled calls the SetLabeled of w if it is a LabelWriter, and
+// returns ErrUnsupported otherwise.
+func SetLabeled[T any](w Writer[T], kind, key string, value T, labels map[string]string) (bool, error) {
+	lw, ok := w.(LabelWriter[T])
+	if !ok {
+		return false, ErrUnsupported
+	}
+	return lw.SetLabeled(kind, key, value, labels)
+}
+
 // ReadWriter combines Reader and Writer interfaces.
 type ReadWriter[T any] interface {
 	Reader[T]
@@ -41,6 +748,9 @@ type ReadWriter[T any] interface {
 }
 
 // Store is the full interface combining all capabilities.
+//
+// Kinds are arbitrary strings, including the empty kind, which every method
+// accepts as a default namespace for users that need only one.
 type Store[T any] interface {
 	Reader[T]
 	Writer[T]
@@ -61,6 +771,24 @@ type Event[T any] struct {
 	Name      string
 	EventType EventType
 	Object    T // for delete: previous value
+	// for delete: the previous value was not read (WithoutPrev, or it
+	// failed to decode), so Object is zero
+	PrevOmitted bool
+	// when the write was applied (committed), by the store's clock; for
+	// initial replay, when the key was last modified
+	At time.Time
+	// position of the event among the events of its kind, from 1, when the
+	// store keeps an event history (StoreOptions.EventHistory); 0
+	// otherwise and for initial replay. Set on the events watchers receive.
+	Seq uint64
+	// version of the key after the write: 1 on create, bumped by every
+	// update that changes the value. A delete carries the version it
+	// removed, and a key re-created after a delete starts over at 1.
+	// Initial replay carries the current version. See Versioner.
+	Version int64
+	// the write was made with Silent: the event reaches AfterWrite and the
+	// event history, but no live watcher
+	Silent bool
 }
 
 type EventType string
@@ -71,12 +799,119 @@ const (
 	EventTypeDelete EventType = "delete"
 )
 
+// Write options
+type WriteOption func(*WriteCfg)
+
+// DefaultIdempotencyWindow is how long idempotency keys are remembered when
+// the backend is not configured otherwise.
+const DefaultIdempotencyWindow = 10 * time.Minute
+
+type WriteCfg struct {
+	// writes carrying an already seen id (for the same kind and key) within
+	// the idempotency window return the original result without re-applying
+	IdempotencyKey string
+	// Delete doesn't read the value it removes
+	WithoutPrev bool
+	// Set fails with ErrKeyExists instead of replacing a value
+	CreateOnly bool
+	// DeleteOlderThan and DeleteWhere publish the delete event of every
+	// key they remove
+	DeleteEvents bool
+	// CopyKind and RenameKind replace keys of a non-empty destination
+	Overwrite bool
+	// CopyKind and RenameKind publish the events of the keys they write
+	KindEvents bool
+	// the write's events are not delivered to watchers
+	Silent bool
+	// ReplaceAll only reports what it would write
+	DryRun bool
+}
+
+// WithIdempotencyKey tags a Set with a client-chosen id so retries of the
+// same logical write are applied and published only once.
+func WithIdempotencyKey(id string) WriteOption {
+	return func(w *WriteCfg) {
+		w.IdempotencyKey = id
+	}
+}
+
+// WithoutPrev makes a Delete skip reading and decoding the value it
+// removes, for cleanup that doesn't need it. Delete returns a zero prev
+// and its event has a zero Object and PrevOmitted set.
+func WithoutPrev() WriteOption {
+	return func(w *WriteCfg) {
+		w.WithoutPrev = true
+	}
+}
+
+// CreateOnly makes a Set fail with ErrKeyExists, writing nothing, when the
+// key already holds a value.
+func CreateOnly() WriteOption {
+	return func(w *WriteCfg) {
+		w.CreateOnly = true
+	}
+}
+
+// WithDeleteEvents makes a DeleteOlderThan (Pruner) or DeleteWhere
+// (FilterQuerier) publish a delete event, with the removed value, for
+// every key it deletes. Without it the deletes are silent and no value is
+// read beyond what the filter needs.
+func WithDeleteEvents() WriteOption {
+	return func(w *WriteCfg) {
+		w.DeleteEvents = true
+	}
+}
+
+// WithOverwrite lets CopyKind and RenameKind (KindMover) write into a
+// kind that holds keys: a key of both kinds takes the source's value and
+// labels, as an update that bumps its version, and the destination's
+// other keys are kept.
+func WithOverwrite() WriteOption {
+	return func(w *WriteCfg) {
+		w.Overwrite = true
+	}
+}
+
+// WithKindEvents makes CopyKind and RenameKind (KindMover) publish a
+// create event on the destination kind for every key they write, or an
+// update event for a key they overwrite, and RenameKind a delete event on
+// the source kind for every key it moves. Without it they are silent and
+// no value is decoded.
+func WithKindEvents() WriteOption {
+	return func(w *WriteCfg) {
+		w.KindEvents = true
+	}
+}
+
+// Silent makes a Set, SetFn, SetAll or Delete publish no event to the
+// watchers of the kind, for bulk fixes and migrations that subscribers
+// shouldn't react to. The write is applied as usual and bumps versions,
+// and its events still reach StoreOptions.AfterWrite, with Event.Silent
+// set, and the event history (StoreOptions.EventHistory), so a watcher
+// resuming with WithReplayHistory sees them.
+func Silent() WriteOption {
+	return func(w *WriteCfg) {
+		w.Silent = true
+	}
+}
+
+// DryRun makes a ReplaceAll (Replacer) compute and return its report
+// without writing anything or publishing events, for "plan" workflows
+// that show a sync before applying it.
+func DryRun() WriteOption {
+	return func(w *WriteCfg) {
+		w.DryRun = true
+	}
+}
+
 // Watch options
 type WatchOption[T any] func(*WatchCfg[T])
 
 // DefaultWatchBufferSize is the default channel buffer size for watchers.
 const DefaultWatchBufferSize = 128
 
+// WatchCfg holds the watch options. Stores opened with Open copy each field
+// to the backend's options (watchOpts in boxed.go).
 type WatchCfg[T any] struct {
 	// send current keys as create events immediately
 	Initial bool
@@ -84,8 +919,142 @@ type WatchCfg[T any] struct {
 	EventTypes map[EventType]struct{}
 	// channel buffer size (0 means use default)
 	BufferSize int
+	// only send events for these keys (empty means all keys)
+	Keys map[string]struct{}
+	// cancel the watcher after this many consecutive dropped events
+	// (0 means never)
+	EvictAfterDrops int
+	// send the store's recent events (StoreOptions.EventHistory) first
+	History bool
+	// with History, only the last this many of them (0 means all)
+	ReplayLast int
+	// skip events at or below these versions, by key (WithMinVersions)
+	MinVersions map[string]int64
+	// only send events whose change from old to new passes (nil means all)
+	Transition TransitionFunc[T]
+	// call back when the buffer stays saturated (WithSaturationAlert)
+	Saturation *SaturationAlert
+	// deliver on an unbuffered channel, blocking writers (WithSynchronous)
+	Synchronous bool
+	// fail the watch if the backend doesn't support these features, or
+	// with RequireAll any feature the options above ask for (WithRequire)
+	Require    map[WatchFeature]struct{}
+	RequireAll bool
+}
+
+// WatchFeature names what a watch option asks of a backend, for
+// WithRequire and Info.WatchFeatures.
+type WatchFeature string
+
+const (
+	WatchInitialReplay   WatchFeature = "initial-replay"    // WithInitialReplay
+	WatchEventTypes      WatchFeature = "event-types"       // WithEventTypes
+	WatchKeys            WatchFeature = "keys"              // WithKeys
+	WatchEvictAfterDrops WatchFeature = "evict-after-drops" // WithEvictAfterDrops
+	// WithReplayHistory and WithReplayLast; backends support it when
+	// they keep a history (StoreOptions.EventHistory)
+	WatchReplayHistory   WatchFeature = "replay-history"
+	WatchMinVersions     WatchFeature = "min-versions"      // WithMinVersions
+	WatchSaturationAlert WatchFeature = "saturation-alert"  // WithSaturationAlert
+	WatchSynchronous     WatchFeature = "synchronous"       // WithSynchronous
+	WatchTransition      WatchFeature = "transition-filter" // WithTransitionFilter
+)
+
+// AllWatchFeatures lists every WatchFeature, sorted.
+var AllWatchFeatures = []WatchFeature{
+	WatchEvictAfterDrops, WatchEventTypes, WatchInitialReplay, WatchKeys,
+	WatchMinVersions, WatchReplayHistory, WatchSaturationAlert, WatchSynchronous,
+	WatchTransition,
+}
+
+// UnsupportedOptionError is returned by a watch requiring (WithRequire) a
+// feature its backend doesn't support, or asking for WithSynchronous
+// there. It matches ErrUnsupported.
+type UnsupportedOptionError struct {
+	Option  WatchFeature
+	Backend string
+}
+
+func (e *UnsupportedOptionError) Error() string {
+	return fmt.Sprintf("watch option %s is not supported by %s", e.Option, e.Backend)
+}
+
+// Is reports whether target is ErrUnsupported.
+func (e *UnsupportedOptionError) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+// Features returns the features the options of c ask for, sorted.
+func (c *WatchCfg[T]) Features() []WatchFeature {
+	var fs []WatchFeature
+	for _, f := range []struct {
+		feature WatchFeature
+		on      bool
+	}{
+		{WatchEvictAfterDrops, c.EvictAfterDrops > 0},
+		{WatchEventTypes, c.EventTypes != nil},
+		{WatchInitialReplay, c.Initial},
+		{WatchKeys, len(c.Keys) > 0},
+		{WatchMinVersions, len(c.MinVersions) > 0},
+		{WatchReplayHistory, c.History},
+		{WatchSaturationAlert, c.Saturation != nil},
+		{WatchSynchronous, c.Synchronous},
+		{WatchTransition, c.Transition != nil},
+	} {
+		if f.on {
+			fs = append(fs, f.feature)
+		}
+	}
+	return fs
+}
+
+// CheckFeatures returns an *UnsupportedOptionError naming the first
+// feature c requires that isn't among supported, the features of backend.
+// WithSynchronous is always required: a watch delivering asynchronously
+// would break its promise silently. Backends call it before subscribing,
+// with the features they report in Info.WatchFeatures.
+func (c *WatchCfg[T]) CheckFeatures(backend string, supported []WatchFeature) error {
+	required := make([]WatchFeature, 0, len(c.Require)+1)
+	for f := range c.Require {
+		required = append(required, f)
+	}
+	if c.RequireAll {
+		required = append(required, c.Features()...)
+	} else if c.Synchronous {
+		required = append(required, WatchSynchronous)
+	}
+	slices.Sort(required)
+	for _, f := range required {
+		if !slices.Contains(supported, f) {
+			return &UnsupportedOptionError{Option: f, Backend: backend}
+		}
+	}
+	return nil
 }
 
+// Validate reports the options that contradict each other: the initial
+// replay with event types that exclude creates (ErrInitialReplayFiltered),
+// and a synchronous watch replaying history (ErrSynchronousHistory).
+// Backends call it before subscribing.
+func (c *WatchCfg[T]) Validate() error {
+	if c.Initial && c.EventTypes != nil {
+		if _, ok := c.EventTypes[EventTypeCreate]; !ok {
+			return ErrInitialReplayFiltered
+		}
+	}
+	if c.Synchronous && c.History {
+		return ErrSynchronousHistory
+	}
+	return nil
+}
+
+// TransitionFunc reports whether a change of a key from old to new is of
+// interest. For creates old is the zero value, and for deletes new is.
+type TransitionFunc[T any] func(old, new T) bool
+
+// WithInitialReplay sends the current keys as create events before the
+// live ones. The watch fails with ErrInitialReplayFiltered if
+// WithEventTypes leaves out EventTypeCreate.
 func WithInitialReplay[T any]() WatchOption[T] {
 	return func(w *WatchCfg[T]) {
 		w.Initial = true
@@ -109,13 +1078,495 @@ func WithBufferSize[T any](size int) WatchOption[T] {
 	}
 }
 
+// WithKeys limits the watcher to events for the given keys. The allowlist
+// can be changed later through the WatchHandle returned by WatchH.
+func WithKeys[T any](keys ...string) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		if w.Keys == nil {
+			w.Keys = make(map[string]struct{})
+		}
+		for _, key := range keys {
+			w.Keys[key] = struct{}{}
+		}
+	}
+}
+
+// WithSynchronous delivers events on an unbuffered channel, and makes each
+// write wait until the watcher has received its events, so the watcher
+// sees every change in the order the writes returned, none dropped. It
+// makes watch-based tests deterministic, without sleeping for events to
+// arrive. BufferSize, EvictAfterDrops and WithSaturationAlert have no
+// effect, and WithReplayHistory is refused (ErrSynchronousHistory).
+//
+// It is meant for a single watcher of one kind: every write to the kind
+// waits for each synchronous watcher in turn. A consumer that writes to
+// the kind itself, or stops receiving without cancelling, deadlocks the
+// writers.
+//
+// Backends that can't block writers on their watchers, such as sqlite and
+// the stores returned by Open, fail the watch with an
+// *UnsupportedOptionError, with or without WithRequire.
+func WithSynchronous[T any]() WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.Synchronous = true
+	}
+}
+
+// WithEvictAfterDrops cancels the watcher once n consecutive events were
+// dropped because its buffer was full. Its channel is closed, which tells
+// the consumer it fell behind and must resync, and the store stops
+// producing events nobody reads.
+func WithEvictAfterDrops[T any](n int) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.EvictAfterDrops = n
+	}
+}
+
+// WithReplayHistory starts the watcher with the events the store kept in
+// its history (StoreOptions.EventHistory), oldest first, so a consumer that
+// subscribes late still sees the last few changes. The history is only
+// kept in memory and is best-effort: it starts empty when the store is
+// created, and events that don't fit in the watcher's buffer are skipped,
+// oldest first.
+//
+// Combined with WithInitialReplay, keys whose latest change is among the
+// replayed events are left out of the initial replay, which would only
+// repeat their current value.
+func WithReplayHistory[T any]() WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.History = true
+	}
+}
+
+// WithReplayLast is WithReplayHistory limited to the last n of the
+// recorded events the watcher wants.
+func WithReplayLast[T any](n int) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.History = true
+		w.ReplayLast = n
+	}
+}
+
+// WithMinVersions skips the events of a key that are not newer than its
+// version in versions, as recorded from Versioner before a List: creates
+// and updates at or below it, and deletes of an older value. Stale events
+// are dropped in the publish path, before they take buffer space, and are
+// skipped by initial replay and WithReplayHistory alike, which makes
+// List, then Watch with replay, miss no change and repeat none. Keys not
+// in versions are not filtered. Since versions start over when a key is
+// re-created, a delete lifts the key's filter; a delete can still be
+// dropped if its event is older than the recorded version. The keys apply
+// to every kind watched.
+func WithMinVersions[T any](versions map[string]int64) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.MinVersions = versions
+	}
+}
+
+// VersionFilter tracks the versions of WithMinVersions for one watcher.
+// Backends create it with NewVersionFilter and consult Stale before
+// delivering an event; a nil *VersionFilter filters nothing.
+type VersionFilter struct {
+	mu  sync.Mutex
+	min map[string]int64
+}
+
+// NewVersionFilter returns a filter for versions, or nil if it is empty.
+// It copies versions.
+func NewVersionFilter(versions map[string]int64) *VersionFilter {
+	if len(versions) == 0 {
+		return nil
+	}
+	f := &VersionFilter{min: make(map[string]int64, len(versions))}
+	for k, v := range versions {
+		f.min[k] = v
+	}
+	return f
+}
+
+// Stale reports whether the event of type et at version for key should be
+// dropped. A delete removes key from the filter.
+func (f *VersionFilter) Stale(key string, et EventType, version int64) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recorded, ok := f.min[key]
+	if !ok {
+		return false
+	}
+	if et == EventTypeDelete {
+		delete(f.min, key)
+		return version < recorded
+	}
+	return version <= recorded
+}
+
+// WithTransitionFilter only sends events for changes that fn accepts, given
+// the value before and after the write, e.g. a field going from set to
+// empty. Creates, including the initial replay, pass the zero value as old;
+// deletes pass the zero value as new. Combine it with WithEventTypes to
+// consider updates only. fn runs synchronously in the write path and must
+// not modify its arguments.
+func WithTransitionFilter[T any](fn TransitionFunc[T]) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.Transition = fn
+	}
+}
+
+// WithSaturationAlert calls fn when the watcher's buffer has been at
+// least threshold full (0.9 for 90%) for sustained, so a consumer can shed
+// load or page someone before events are dropped. fn runs on its own
+// goroutine, at most once per saturation episode: the episode ends when
+// the buffer is found below threshold again. The buffer is checked on each
+// event sent or dropped, so an episode is only noticed while events keep
+// coming.
+func WithSaturationAlert[T any](threshold float64, sustained time.Duration, fn func(WatcherInfo)) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		w.Saturation = &SaturationAlert{Threshold: threshold, Sustained: sustained, Fn: fn}
+	}
+}
+
+// SaturationAlert holds the arguments of WithSaturationAlert.
+type SaturationAlert struct {
+	Threshold float64
+	Sustained time.Duration
+	Fn        func(WatcherInfo)
+}
+
+// WatcherInfo describes a watcher whose buffer stayed saturated, for
+// WithSaturationAlert.
+type WatcherInfo struct {
+	// Kinds the watcher watches; nil for WatchAll.
+	Kinds []string
+	// Since is when the buffer became saturated.
+	Since time.Time
+	// Stats are the watcher's counters when the alert fired.
+	Stats WatchStats
+}
+
+// SaturationMonitor tracks the saturation episodes of one watcher for
+// WithSaturationAlert. Backends create it with NewSaturationMonitor and
+// call Observe after each event they send to the watcher or drop; a nil
+// *SaturationMonitor observes nothing.
+type SaturationMonitor struct {
+	alert SaturationAlert
+	kinds []string
+	stats func() WatchStats
+
+	mu sync.Mutex
+	// start of the current episode, zero while the buffer is below
+	// the threshold, and whether it was alerted
+	since time.Time
+	fired bool
+}
+
+// NewSaturationMonitor returns a monitor for a, or nil if a is nil. stats
+// reports the watcher's counters for the alerts.
+func NewSaturationMonitor(a *SaturationAlert, kinds []string, stats func() WatchStats) *SaturationMonitor {
+	if a == nil || a.Fn == nil {
+		return nil
+	}
+	return &SaturationMonitor{alert: *a, kinds: kinds, stats: stats}
+}
+
+// Observe records that the watcher's buffer holds n events out of
+// capacity, and fires the alert if it has been saturated long enough.
+func (m *SaturationMonitor) Observe(n, capacity int) {
+	if m == nil {
+		return
+	}
+	saturated := capacity > 0 && float64(n) >= m.alert.Threshold*float64(capacity)
+	m.mu.Lock()
+	if !saturated {
+		m.since, m.fired = time.Time{}, false
+		m.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if m.since.IsZero() {
+		m.since = now
+	}
+	fire := !m.fired && now.Sub(m.since) >= m.alert.Sustained
+	m.fired = m.fired || fire
+	since := m.since
+	m.mu.Unlock()
+	if fire {
+		go m.alert.Fn(WatcherInfo{Kinds: m.kinds, Since: since, Stats: m.stats()})
+	}
+}
+
+// WithRequire fails the watch with an *UnsupportedOptionError if its
+// backend doesn't support one of features, rather than leaving the option
+// without effect. With no features, it requires every feature the watch's
+// other options ask for:
+//
+//	ch, cancel, err := s.Watch("orders", store.WithReplayHistory[Order](), store.WithRequire[Order]())
+//	// err is an *UnsupportedOptionError if s keeps no history
+//
+// Wrappers pass it on to the store they wrap.
+func WithRequire[T any](features ...WatchFeature) WatchOption[T] {
+	return func(w *WatchCfg[T]) {
+		if len(features) == 0 {
+			w.RequireAll = true
+			return
+		}
+		if w.Require == nil {
+			w.Require = make(map[WatchFeature]struct{})
+		}
+		for _, f := range features {
+			w.Require[f] = struct{}{}
+		}
+	}
+}
+
 type StoreOptions[T any] struct {
+	// CompareFn reports whether a write leaves a value unchanged, so that
+	// it keeps its version and change time and publishes no event.
+	// gomap defaults to DefaultCompareFunc. sqlite compares encodings
+	// without it; with it, a write whose encoding differs decodes the
+	// stored value to compare.
 	CompareFn   CompareFunc[T]
 	ValidateFns map[string]ValidateFunc[T]
+	// ValidateOnOpen checks the values a persistent store already holds
+	// against ValidateFns when it is built, catching data written before a
+	// validator was added (see ValidateKind). The default is ValidateOff.
+	ValidateOnOpen ValidateMode
+	// per-kind normalizers, applied before validation and no-op detection
+	NormalizeFns map[string]NormalizeFunc[T]
+	// how long idempotency keys are remembered (0 means DefaultIdempotencyWindow)
+	IdempotencyWindow time.Duration
+	// SetAllBatchSize splits SetAll calls with more values into chunks of
+	// this many, each applied atomically (one transaction, or one lock
+	// hold) with its events published after it. A failed chunk leaves the
+	// earlier ones applied. 0 applies the whole batch atomically.
+	SetAllBatchSize int
+	// SetAllProgress, if set, is called after each applied SetAll chunk
+	// with the number of values written so far and the batch total.
+	SetAllProgress func(kind string, done, total int)
+	// AfterWrite, if set, is called synchronously with the event of every
+	// write that changed the store, after it was applied (committed) and
+	// before watchers are notified.
+	AfterWrite func(ev *Event[T])
+	// EventHistory is how many recent events the store keeps per kind for
+	// watchers subscribing with WithReplayHistory. 0 keeps none.
+	EventHistory int
+	// CloneFn, if set, returns a deep copy of a value. The in-memory backend
+	// hands out stored values themselves, so for a T holding pointers,
+	// slices or maps a caller or watcher mutating a returned value or event
+	// object would change the stored one; with CloneFn it gets a copy
+	// instead. Event objects and the value passed to SetFn's function are
+	// cloned, and with CloneOnRead the values returned by reads too. Leave
+	// it nil for plain value types. Backends that decode values on every
+	// read, like sqlite, don't use it.
+	CloneFn func(v T) T
+	// CloneOnRead makes Get, List, ListPrefix, Values, SelectByLabel, GetAll
+	// and snapshot views return clones made with CloneFn. Each read then
+	// costs one CloneFn call per value returned; leave it off when readers
+	// don't mutate what they get.
+	CloneOnRead bool
+	// Defaults are baseline values per kind and key, created when the store
+	// is built if the key doesn't exist yet. Existing keys are never
+	// overwritten, so reopening a persistent store keeps its data. Defaults
+	// are normalized and validated like writes and publish create events.
+	Defaults map[string]map[string]T
+	// Now is the clock stamping events (nil means time.Now).
+	Now func() time.Time
+	// AllowedKinds, if non-nil, is the fixed set of kinds the store holds:
+	// reads, writes and watches of any other kind fail with ErrUnknownKind,
+	// catching misspelled kind names. nil allows every kind.
+	AllowedKinds []string
+	// MaxListResults, if > 0, makes List and Values fail with a
+	// *ResultTooLargeError when the kind holds more values, before any is
+	// decoded, so an accidental read of a huge kind doesn't exhaust memory.
+	// The limit applies to the kind, not to what List's filters keep.
+	MaxListResults int
+	// MaxGetAllResults is MaxListResults for GetAll, counting the values of
+	// every kind.
+	MaxGetAllResults int
+	// KeyGen generates the keys of Add (nil means NewUUIDv7). It must be
+	// safe for concurrent use.
+	KeyGen func() string
+	// RejectZeroValues makes writes of the zero value of T fail with
+	// ErrZeroValue, catching values that were never filled in. The check
+	// runs after normalization. It guards the kinds in RejectZeroKinds, or
+	// every kind if that is nil.
+	RejectZeroValues bool
+	RejectZeroKinds  []string
+	// Journal, if its Path is set, makes the in-memory store log every
+	// write to a file and recover its values from it when built, by
+	// gomap.NewMemStoreFromJournal. Backends that persist their data
+	// themselves, like sqlite, ignore it.
+	Journal JournalConfig
+}
+
+// DefaultJournalCompactSize is the JournalConfig.CompactSize used when it
+// is 0.
+const DefaultJournalCompactSize = 64 << 20
+
+// JournalConfig configures the write-ahead journal of an in-memory store.
+type JournalConfig struct {
+	// Path is the journal file, created if it doesn't exist.
+	Path string
+	// Codec encodes the values in the journal.
+	Codec Codec
+	// FsyncEvery syncs the file to disk after every FsyncEvery writes. 0
+	// never syncs, leaving it to the OS: writes survive the process
+	// crashing, but not the machine. 1 syncs every write, which is
+	// durable and slowest.
+	FsyncEvery int
+	// CompactSize is the size in bytes past which the journal is
+	// rewritten as a snapshot of the values, once it has also doubled
+	// since the last snapshot; 0 means DefaultJournalCompactSize.
+	CompactSize int64
+}
+
+// ZeroValueCheck returns the check a backend applies to every value it
+// writes for o's RejectZeroValues, or nil if the option is off.
+func ZeroValueCheck[T any](o StoreOptions[T]) func(kind, key string, v T) error {
+	if !o.RejectZeroValues {
+		return nil
+	}
+	kinds := KindSet(o.RejectZeroKinds)
+	return func(kind, key string, v T) error {
+		if _, ok := kinds[kind]; kinds != nil && !ok {
+			return nil
+		}
+		if reflect.ValueOf(&v).Elem().IsZero() {
+			return fmt.Errorf("%s/%s: %w", kind, key, ErrZeroValue)
+		}
+		return nil
+	}
+}
+
+// AddAttempts is how many generated keys Add tries before it fails with
+// ErrKeyExists.
+const AddAttempts = 3
+
+// AddNew implements Add for a backend: it calls insert, a CreateOnly write,
+// with keys from gen (nil means NewUUIDv7) until one isn't taken.
+func AddNew(gen func() string, insert func(key string) error) (string, error) {
+	if gen == nil {
+		gen = NewUUIDv7
+	}
+	for i := 0; i < AddAttempts; i++ {
+		key := gen()
+		if err := insert(key); !errors.Is(err, ErrKeyExists) {
+			return key, err
+		}
+	}
+	return "", fmt.Errorf("add: %d generated keys taken: %w", AddAttempts, ErrKeyExists)
+}
+
+// DedupeKeyValues implements SetAllOrdered for a backend: it returns the
+// keys of kvs in the order of their first occurrence, and the last value
+// of each.
+func DedupeKeyValues[T any](kvs []KeyValue[T]) (keys []string, values map[string]T) {
+	keys = make([]string, 0, len(kvs))
+	values = make(map[string]T, len(kvs))
+	for _, kv := range kvs {
+		if _, dup := values[kv.Key]; !dup {
+			keys = append(keys, kv.Key)
+		}
+		values[kv.Key] = kv.Value
+	}
+	return keys, values
+}
+
+// ResultTooLargeError is returned by reads of more values than the store's
+// StoreOptions.MaxListResults or MaxGetAllResults allows. Read such kinds
+// in parts instead, e.g. with ListPrefix or with Keys and Get.
+type ResultTooLargeError struct {
+	Count int // values the read would return
+	Limit int
+}
+
+func (e *ResultTooLargeError) Error() string {
+	return fmt.Sprintf("result of %d values exceeds the limit of %d", e.Count, e.Limit)
+}
+
+// Is reports whether target is ErrResultTooLarge.
+func (e *ResultTooLargeError) Is(target error) bool {
+	return target == ErrResultTooLarge
+}
+
+// DuplicateError is returned by a write that would give Field the Value
+// that ExistingKey already holds. It matches ErrDuplicate.
+type DuplicateError struct {
+	Field       string
+	Value       string
+	ExistingKey string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("duplicate %s %q, held by key %q", e.Field, e.Value, e.ExistingKey)
+}
+
+// Is reports whether target is ErrDuplicate.
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrDuplicate
+}
+
+// CheckResultSize returns a *ResultTooLargeError if limit > 0 and count
+// exceeds it.
+func CheckResultSize(count, limit int) error {
+	if limit > 0 && count > limit {
+		return &ResultTooLargeError{Count: count, Limit: limit}
+	}
+	return nil
+}
+
+// KindSet returns kinds as a set for checking them with CheckKind, or nil
+// for a nil kinds, which allows every kind.
+func KindSet(kinds []string) map[string]struct{} {
+	if kinds == nil {
+		return nil
+	}
+	set := make(map[string]struct{}, len(kinds))
+	for _, k := range kinds {
+		set[k] = struct{}{}
+	}
+	return set
+}
+
+// CheckKind returns an error wrapping ErrUnknownKind for the first of
+// kinds that a non-nil allowed set made by KindSet doesn't hold.
+func CheckKind(allowed map[string]struct{}, kinds ...string) error {
+	if allowed == nil {
+		return nil
+	}
+	for _, k := range kinds {
+		if _, ok := allowed[k]; !ok {
+			return fmt.Errorf("%w %q", ErrUnknownKind, k)
+		}
+	}
+	return nil
 }
 
 type ValidateFunc[T any] func(v T) error
 
+// NormalizeFunc returns the canonical form of v (e.g. trimmed, lowercased,
+// defaults filled in). It is applied on every write before the value is
+// validated, compared against the stored value and persisted.
+type NormalizeFunc[T any] func(v T) (T, error)
+
+// NormalizeError is returned when a kind's NormalizeFunc fails. The write is
+// aborted and nothing is stored.
+type NormalizeError struct {
+	Kind string
+	Key  string
+	Err  error
+}
+
+func (e *NormalizeError) Error() string {
+	return fmt.Sprintf("normalize %s/%s: %v", e.Kind, e.Key, e.Err)
+}
+
+func (e *NormalizeError) Unwrap() error {
+	return e.Err
+}
+
 type CompareFunc[T any] func(prev, new T) bool
 
 func DefaultCompareFunc[T any](prev, new T) bool {
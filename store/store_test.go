@@ -0,0 +1,135 @@
+package store_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+// coreOnly hides the optional interfaces of its store.
+type coreOnly struct {
+	store.Store[int]
+}
+
+func newCoreOnly(t *testing.T) (coreOnly, store.Store[int]) {
+	t.Helper()
+	base := gomap.NewMemStore(store.StoreOptions[int]{})
+	t.Cleanup(func() { base.Close() })
+	return coreOnly{base}, base
+}
+
+func TestUnsupported(t *testing.T) {
+	s, _ := newCoreOnly(t)
+	for name, err := range map[string]error{
+		"SelectByLabel": func() error { _, err := store.SelectByLabel(s, "k", nil); return err }(),
+		"SetLabeled":    func() error { _, err := store.SetLabeled(s, "k", "a", 1, nil); return err }(),
+		"Snapshot":      func() error { _, _, err := store.Snapshot(s, "k"); return err }(),
+		"Swap":          store.Swap(s, "k", "a", "b"),
+		"MergeAll":      store.MergeAll(s, "k", map[string]int{"a": 1}, nil),
+		"SetAllOrdered": store.SetAllOrdered(s, "k", []store.KeyValue[int]{{Key: "a", Value: 1}}),
+		"WatchH":        func() error { _, err := store.WatchH(s, "k"); return err }(),
+		"WatchKinds":    func() error { _, _, err := store.WatchKinds(s, []string{"k"}); return err }(),
+		"WatchAll":      func() error { s.Set("w", "a", 1); _, _, err := store.WatchAll(s); return err }(),
+	} {
+		if !errors.Is(err, store.ErrUnsupported) {
+			t.Errorf("%s() = %v, want ErrUnsupported", name, err)
+		}
+	}
+	if n, _ := s.Count("k"); n != 0 {
+		t.Errorf("%d values written", n)
+	}
+}
+
+// multiOnly keeps only the MultiKindWriter of its store.
+type multiOnly struct {
+	coreOnly
+	store.MultiKindWriter[int]
+}
+
+func TestSetAllOrderedFallback(t *testing.T) {
+	s, base := newCoreOnly(t)
+	ch, cancel, _ := base.Watch("k")
+	defer cancel()
+	kvs := []store.KeyValue[int]{{Key: "b", Value: 1}, {Key: "a", Value: 2}, {Key: "b", Value: 3}}
+	if err := store.SetAllOrdered(multiOnly{s, base.(store.MultiKindWriter[int])}, "k", kvs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []store.KeyValue[int]{{Key: "b", Value: 3}, {Key: "a", Value: 2}} {
+		if ev := <-ch; ev.Name != want.Key || ev.Object != want.Value {
+			t.Errorf("event %s=%d, want %s=%d", ev.Name, ev.Object, want.Key, want.Value)
+		}
+	}
+}
+
+func TestAddFallback(t *testing.T) {
+	s, _ := newCoreOnly(t)
+	key, err := store.Add(s, "k", 1)
+	if err != nil || len(key) != 36 {
+		t.Fatalf("Add() = %q, %v", key, err)
+	}
+	if v, ok, _ := s.Get("k", key); !ok || v != 1 {
+		t.Errorf("Get(%q) = %d, %v", key, v, ok)
+	}
+}
+
+func TestKindsFallback(t *testing.T) {
+	s, _ := newCoreOnly(t)
+	if kinds, err := store.Kinds(s); err != nil || kinds == nil || len(kinds) != 0 {
+		t.Errorf("Kinds() of an empty store = %#v, %v, want empty non-nil", kinds, err)
+	}
+	s.Set("b", "x", 1)
+	s.Set("a", "x", 2)
+	if kinds, err := store.Kinds(s); err != nil || !reflect.DeepEqual(kinds, []string{"a", "b"}) {
+		t.Errorf("Kinds() = %v, %v", kinds, err)
+	}
+}
+
+// kindsOnly keeps only the KindsWatcher of its store.
+type kindsOnly struct {
+	coreOnly
+	store.KindsWatcher[int]
+}
+
+func TestWatchAllFallback(t *testing.T) {
+	s, base := newCoreOnly(t)
+	ko := kindsOnly{s, base.(store.KindsWatcher[int])}
+	if _, _, err := store.WatchAll(ko); !errors.Is(err, store.ErrNoKinds) {
+		t.Errorf("WatchAll() of an empty store = %v, want ErrNoKinds", err)
+	}
+	s.Set("a", "x", 1)
+	s.Set("b", "x", 2)
+	ch, cancel, err := store.WatchAll(ko)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	// a kind written after subscribing is missed
+	s.Set("c", "x", 3)
+	s.Set("b", "x", 4)
+	if ev := <-ch; ev.Kind != "b" || ev.Object != 4 {
+		t.Errorf("event %s=%d, want b=4", ev.Kind, ev.Object)
+	}
+}
+
+func TestPrefixFallback(t *testing.T) {
+	s, _ := newCoreOnly(t)
+	s.SetAll("k", map[string]int{"org1/team1/a": 1, "org1/team2": 2, "org1/team1/b": 3, "org2/x": 4})
+
+	m, err := store.ListPrefix(s, "k", "org1/team1/")
+	if err != nil || !reflect.DeepEqual(m, map[string]int{"org1/team1/a": 1, "org1/team1/b": 3}) {
+		t.Errorf("ListPrefix() = %v, %v", m, err)
+	}
+	segs, err := store.KeySegments(s, "k", "/", "org1/")
+	if err != nil || !reflect.DeepEqual(segs, []string{"team1/", "team2"}) {
+		t.Errorf("KeySegments() = %v, %v", segs, err)
+	}
+	if segs, err := store.KeySegments(s, "k", "/", "none/"); err != nil || segs == nil || len(segs) != 0 {
+		t.Errorf("KeySegments(none/) = %#v, %v, want empty non-nil", segs, err)
+	}
+	if _, err := store.KeySegments(s, "k", "", ""); !errors.Is(err, store.ErrSeparatorRequired) {
+		t.Errorf("KeySegments without separator = %v", err)
+	}
+}
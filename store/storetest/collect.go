@@ -0,0 +1,76 @@
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// Collect reads events from ch until it has n, ch closes or ctx is done,
+// and returns them sorted by kind and key. Events of one key keep the
+// order they arrived in, while the order across keys, which backends don't
+// all define (e.g. for SetAll), doesn't leak into the result:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//	defer cancel()
+//	evs := storetest.Collect(ctx, ch, 2)
+//	storetest.AssertEvents(t, evs, "create:a", "update:b")
+func Collect[T any](ctx context.Context, ch <-chan *store.Event[T], n int) []*store.Event[T] {
+	evs := make([]*store.Event[T], 0, n)
+	for len(evs) < n {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return sortEvents(evs)
+			}
+			evs = append(evs, ev)
+		case <-ctx.Done():
+			return sortEvents(evs)
+		}
+	}
+	return sortEvents(evs)
+}
+
+func sortEvents[T any](evs []*store.Event[T]) []*store.Event[T] {
+	sort.SliceStable(evs, func(i, j int) bool {
+		if evs[i].Kind != evs[j].Kind {
+			return evs[i].Kind < evs[j].Kind
+		}
+		return evs[i].Name < evs[j].Name
+	})
+	return evs
+}
+
+// AssertEventTypes fails t unless evs have exactly the types want, in
+// order.
+func AssertEventTypes[T any](t testing.TB, evs []*store.Event[T], want ...store.EventType) {
+	t.Helper()
+	got := make([]string, len(evs))
+	for i, ev := range evs {
+		got[i] = string(ev.EventType)
+	}
+	wantS := make([]string, len(want))
+	for i, typ := range want {
+		wantS[i] = string(typ)
+	}
+	if strings.Join(got, ",") != strings.Join(wantS, ",") {
+		t.Errorf("event types %v, want %v", got, wantS)
+	}
+}
+
+// AssertEvents fails t unless evs are exactly want, in order, each given
+// as "type:key" (e.g. "create:a").
+func AssertEvents[T any](t testing.TB, evs []*store.Event[T], want ...string) {
+	t.Helper()
+	got := make([]string, len(evs))
+	for i, ev := range evs {
+		got[i] = fmt.Sprintf("%s:%s", ev.EventType, ev.Name)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package storetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+func TestCollect(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[int]{})
+	defer s.Close()
+	ch, cancel, _ := s.Watch("k")
+	defer cancel()
+	s.Set("k", "b", 1)
+	s.Set("k", "a", 1)
+	s.Set("k", "b", 2)
+
+	ctx, done := context.WithTimeout(context.Background(), time.Second)
+	defer done()
+	evs := Collect(ctx, ch, 3)
+	AssertEvents(t, evs, "create:a", "create:b", "update:b")
+	AssertEventTypes(t, evs, store.EventTypeCreate, store.EventTypeCreate, store.EventTypeUpdate)
+	if evs[2].Object != 2 {
+		t.Fatalf("events of b out of order: %+v", evs[2])
+	}
+
+	// fewer events than asked for: Collect returns when ctx is done
+	s.Delete("k", "a")
+	ctx, done = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer done()
+	AssertEvents(t, Collect(ctx, ch, 5), "delete:a")
+
+	// a closed channel ends the collection too
+	cancel()
+	if evs := Collect(context.Background(), ch, 1); len(evs) != 0 {
+		t.Fatalf("events from a cancelled watch: %v", evs)
+	}
+}
+
+func TestAssertEventsFails(t *testing.T) {
+	evs := []*store.Event[int]{{Name: "a", EventType: store.EventTypeCreate}}
+	for name, check := range map[string]func(tb testing.TB){
+		"AssertEvents":     func(tb testing.TB) { AssertEvents(tb, evs, "update:a") },
+		"AssertEventTypes": func(tb testing.TB) { AssertEventTypes(tb, evs) },
+	} {
+		r := &recorder{TB: t}
+		check(r)
+		if !r.failed {
+			t.Errorf("%s passed on mismatching events", name)
+		}
+	}
+}
+
+// recorder is a testing.TB that records failures instead of failing.
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Helper()               {}
+func (r *recorder) Errorf(string, ...any) { r.failed = true }
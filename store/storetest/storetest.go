@@ -0,0 +1,555 @@
+// Package storetest checks store.Store implementations against the contract
+// of the store package that generic callers rely on. Backends run it from
+// their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunReaderTests(t, func(t *testing.T) store.Store[Config] {
+//			return mybackend.New[Config]()
+//		})
+//	}
+//
+// RunWatchOptionTests checks that a store either honours each watch option or
+// rejects it when it is required, and RunReplaceTests checks a
+// store.Replacer.
+//
+// Collect and the Assert helpers read and check the events of a watch, for
+// backends and for code consuming watches alike.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// RunReaderTests runs the read contract as subtests of t, each on a fresh
+// store from newStore, which must accept every kind and value:
+//
+//   - a kind that never held a key reads exactly like one whose keys were
+//     all deleted: Get finds nothing, Count is 0, and the map and slice
+//     results are empty
+//   - no method returns a nil map or slice with a nil error, including a
+//     filter, prefix or selector that matches nothing in a non-empty kind
+//   - Kinds and GetAll leave out kinds without keys
+//   - a snapshot view of an empty kind reads the same way
+//
+// The closed store is left to newStore's cleanup, if any.
+func RunReaderTests[T any](t *testing.T, newStore func(t *testing.T) store.Store[T]) {
+	t.Helper()
+	var zero T
+
+	t.Run("empty store", func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		if kinds, err := store.Kinds(s); err != nil || kinds == nil || len(kinds) != 0 {
+			t.Errorf("Kinds() = %#v, %v, want empty non-nil", kinds, err)
+		}
+		if all, err := s.GetAll(); err != nil || all == nil || len(all) != 0 {
+			t.Errorf("GetAll() = %#v, %v, want empty non-nil", all, err)
+		}
+	})
+
+	t.Run("unknown and emptied kinds", func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		if _, err := s.Set("emptied", "k", zero); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Delete("emptied", "k"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Set("other", "k", zero); err != nil {
+			t.Fatal(err)
+		}
+		for _, kind := range []string{"never", "emptied", ""} {
+			checkEmpty(t, s, kind)
+		}
+		if kinds, err := store.Kinds(s); err != nil || !reflect.DeepEqual(kinds, []string{"other"}) {
+			t.Errorf("Kinds() = %#v, %v, want [other]", kinds, err)
+		}
+		all, err := s.GetAll()
+		if err != nil || len(all) != 1 || len(all["other"]) != 1 {
+			t.Errorf("GetAll() = %#v, %v, want only other", all, err)
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		if _, err := store.SetLabeled(s, "k", "a/b", zero, map[string]string{"env": "prod"}); err != nil {
+			t.Fatal(err)
+		}
+		none := func(string, T) bool { return false }
+		if m, err := s.List("k", none); err != nil || m == nil || len(m) != 0 {
+			t.Errorf("List(filter matching nothing) = %#v, %v, want empty non-nil", m, err)
+		}
+		if m, err := store.ListPrefix(s, "k", "z"); err != nil || m == nil || len(m) != 0 {
+			t.Errorf("ListPrefix(z) = %#v, %v, want empty non-nil", m, err)
+		}
+		if segs, err := store.KeySegments(s, "k", "/", "z"); err != nil || segs == nil || len(segs) != 0 {
+			t.Errorf("KeySegments(z) = %#v, %v, want empty non-nil", segs, err)
+		}
+		if kvs, err := store.SelectByLabel(s, "k", map[string]string{"env": "dev"}); err != nil || kvs == nil || len(kvs) != 0 {
+			t.Errorf("SelectByLabel(env=dev) = %#v, %v, want empty non-nil", kvs, err)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		for _, kind := range []string{"never", ""} {
+			view, release, err := store.Snapshot(s, kind)
+			if err != nil {
+				t.Fatalf("Snapshot(%q): %v", kind, err)
+			}
+			checkEmpty(t, view, kind)
+			release()
+		}
+	})
+}
+
+// checkEmpty checks that every per-kind method of r reads kind as empty.
+func checkEmpty[T any](t *testing.T, r store.Reader[T], kind string) {
+	t.Helper()
+	var zero T
+	if v, ok, err := r.Get(kind, "k"); err != nil || ok || !reflect.DeepEqual(v, zero) {
+		t.Errorf("Get(%q, k) = %#v, %v, %v, want zero, false, nil", kind, v, ok, err)
+	}
+	if n, err := r.Count(kind); err != nil || n != 0 {
+		t.Errorf("Count(%q) = %d, %v, want 0", kind, n, err)
+	}
+	all := func(string, T) bool { return true }
+	for name, list := range map[string]func() (map[string]T, error){
+		"List":          func() (map[string]T, error) { return r.List(kind) },
+		"List(filter)":  func() (map[string]T, error) { return r.List(kind, all) },
+		"ListPrefix()":  func() (map[string]T, error) { return store.ListPrefix(r, kind, "") },
+		"ListPrefix(k)": func() (map[string]T, error) { return store.ListPrefix(r, kind, "k") },
+	} {
+		if m, err := list(); err != nil || m == nil || len(m) != 0 {
+			t.Errorf("%s on kind %q = %#v, %v, want empty non-nil", name, kind, m, err)
+		}
+	}
+	for name, strs := range map[string]func() ([]string, error){
+		"Keys":        func() ([]string, error) { return r.Keys(kind) },
+		"KeySegments": func() ([]string, error) { return store.KeySegments(r, kind, "/", "") },
+	} {
+		if s, err := strs(); err != nil || s == nil || len(s) != 0 {
+			t.Errorf("%s on kind %q = %#v, %v, want empty non-nil", name, kind, s, err)
+		}
+	}
+	for name, kvs := range map[string]func() ([]store.KeyValue[T], error){
+		"Values":          func() ([]store.KeyValue[T], error) { return r.Values(kind) },
+		"SelectByLabel()": func() ([]store.KeyValue[T], error) { return store.SelectByLabel(r, kind, nil) },
+		"SelectByLabel(env=dev)": func() ([]store.KeyValue[T], error) {
+			return store.SelectByLabel(r, kind, map[string]string{"env": "dev"})
+		},
+	} {
+		if s, err := kvs(); err != nil || s == nil || len(s) != 0 {
+			t.Errorf("%s on kind %q = %#v, %v, want empty non-nil", name, kind, s, err)
+		}
+	}
+}
+
+// RunWatchOptionTests runs the watch option contract as subtests of t,
+// each on a fresh store from newStore, which must accept every kind and
+// value: a watch requiring (store.WithRequire) a feature either fails
+// with a *store.UnsupportedOptionError naming it, or honors the option,
+// never leaving it without effect; and the store's Info.WatchFeatures, if
+// it is a store.Introspector, lists the features it honors. a and b are
+// two different values other than the zero value.
+func RunWatchOptionTests[T any](t *testing.T, newStore func(t *testing.T) store.Store[T], a, b T) {
+	t.Helper()
+	var zero T
+	// each case sets up s, watches kind "w" with opts, writes and checks
+	// the events
+	cases := []struct {
+		feature store.WatchFeature
+		before  func(s store.Store[T]) error
+		opts    []store.WatchOption[T]
+		after   func(s store.Store[T]) error
+		want    []string
+	}{
+		{
+			feature: store.WatchInitialReplay,
+			before:  func(s store.Store[T]) error { _, err := s.Set("w", "old", a); return err },
+			opts:    []store.WatchOption[T]{store.WithInitialReplay[T]()},
+			want:    []string{"create:old"},
+		},
+		{
+			feature: store.WatchEventTypes,
+			opts:    []store.WatchOption[T]{store.WithEventTypes[T](store.EventTypeDelete)},
+			after: func(s store.Store[T]) error {
+				if _, err := s.Set("w", "k", a); err != nil {
+					return err
+				}
+				_, _, err := s.Delete("w", "k")
+				return err
+			},
+			want: []string{"delete:k"},
+		},
+		{
+			feature: store.WatchKeys,
+			opts:    []store.WatchOption[T]{store.WithKeys[T]("k2")},
+			after: func(s store.Store[T]) error {
+				if _, err := s.Set("w", "k1", a); err != nil {
+					return err
+				}
+				_, err := s.Set("w", "k2", a)
+				return err
+			},
+			want: []string{"create:k2"},
+		},
+		{
+			feature: store.WatchReplayHistory,
+			before:  func(s store.Store[T]) error { _, err := s.Set("w", "old", a); return err },
+			opts:    []store.WatchOption[T]{store.WithReplayHistory[T]()},
+			want:    []string{"create:old"},
+		},
+		{
+			feature: store.WatchMinVersions,
+			before:  func(s store.Store[T]) error { _, err := s.Set("w", "k", a); return err },
+			opts:    []store.WatchOption[T]{store.WithMinVersions[T](map[string]int64{"k": 2})},
+			after: func(s store.Store[T]) error {
+				// version 2 is skipped, 3 isn't
+				for _, v := range []T{b, a} {
+					if _, err := s.Set("w", "k", v); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			want: []string{"update:k"},
+		},
+		{
+			feature: store.WatchTransition,
+			opts: []store.WatchOption[T]{store.WithTransitionFilter(func(old, _ T) bool {
+				return !reflect.DeepEqual(old, zero)
+			})},
+			after: func(s store.Store[T]) error {
+				if _, err := s.Set("w", "k", a); err != nil {
+					return err
+				}
+				_, err := s.Set("w", "k", b)
+				return err
+			},
+			want: []string{"update:k"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(string(c.feature), func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+			if c.before != nil {
+				if err := c.before(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ch, cancel, err := s.Watch("w", append(c.opts, store.WithRequire[T]())...)
+			if !checkRequired(t, s, c.feature, err) {
+				return
+			}
+			defer cancel()
+			if c.after != nil {
+				if err := c.after(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+			defer done()
+			AssertEvents(t, Collect(ctx, ch, len(c.want)), c.want...)
+			// nothing else is sent
+			ctx, done = context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer done()
+			if extra := Collect(ctx, ch, 1); len(extra) > 0 {
+				t.Errorf("unexpected event %s:%s", extra[0].EventType, extra[0].Name)
+			}
+		})
+	}
+
+	t.Run(string(store.WatchEvictAfterDrops), func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		ch, cancel, err := s.Watch("w", store.WithBufferSize[T](1), store.WithEvictAfterDrops[T](1), store.WithRequire[T](store.WatchEvictAfterDrops))
+		if !checkRequired(t, s, store.WatchEvictAfterDrops, err) {
+			return
+		}
+		defer cancel()
+		for i := 0; i < 10; i++ {
+			if _, err := s.Set("w", fmt.Sprintf("k%d", i), a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case _, ok := <-ch:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatal("watcher not evicted")
+			}
+		}
+	})
+
+	t.Run(string(store.WatchSynchronous), func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		// refused without WithRequire too, rather than delivered asynchronously
+		ch, cancel, err := s.Watch("w", store.WithSynchronous[T]())
+		if !checkRequired(t, s, store.WatchSynchronous, err) {
+			return
+		}
+		defer cancel()
+		keys := []string{"k1", "k2", "k3"}
+		written := make(chan error, 1)
+		go func() {
+			for _, k := range keys {
+				if _, err := s.Set("w", k, a); err != nil {
+					written <- err
+					return
+				}
+			}
+			written <- nil
+		}()
+		for _, k := range keys {
+			// each write waits for its event to be received
+			select {
+			case err := <-written:
+				t.Fatalf("writes returned (%v) before %s was received", err, k)
+			case <-time.After(20 * time.Millisecond):
+			}
+			select {
+			case ev := <-ch:
+				if ev.Name != k {
+					t.Fatalf("got %s:%s, want create:%s", ev.EventType, ev.Name, k)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no event for %s", k)
+			}
+		}
+		select {
+		case err := <-written:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("writes still blocked after their events were received")
+		}
+	})
+
+	t.Run(string(store.WatchSaturationAlert), func(t *testing.T) {
+		s := newStore(t)
+		defer s.Close()
+		alerts := make(chan store.WatcherInfo, 10)
+		ch, cancel, err := s.Watch("w", store.WithBufferSize[T](4),
+			store.WithSaturationAlert[T](0.75, 20*time.Millisecond, func(info store.WatcherInfo) { alerts <- info }),
+			store.WithRequire[T](store.WatchSaturationAlert))
+		if !checkRequired(t, s, store.WatchSaturationAlert, err) {
+			return
+		}
+		defer cancel()
+		n := 0
+		write := func() {
+			t.Helper()
+			n++
+			if _, err := s.Set("w", fmt.Sprintf("k%d", n), a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// a consumer that stops reading saturates the buffer once per
+		// episode, however long the writes go on
+		for episode := 1; episode <= 2; episode++ {
+			for start := time.Now(); time.Since(start) < 100*time.Millisecond; time.Sleep(2 * time.Millisecond) {
+				write()
+			}
+			select {
+			case info := <-alerts:
+				if !reflect.DeepEqual(info.Kinds, []string{"w"}) || info.Stats.BufferCap != 4 || info.Since.IsZero() {
+					t.Errorf("episode %d: alert %+v, want kinds [w] and BufferCap 4", episode, info)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("episode %d: no alert", episode)
+			}
+			// the episode ends once a send finds the buffer drained
+			drain(ch)
+			write()
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatal("event after draining not delivered")
+			}
+		}
+		select {
+		case info := <-alerts:
+			t.Errorf("unexpected alert %+v", info)
+		case <-time.After(50 * time.Millisecond):
+		}
+		cancel()
+		drain(ch)
+
+		// a consumer that keeps up is never alerted
+		ch, cancel, err = s.Watch("w", store.WithBufferSize[T](4),
+			store.WithSaturationAlert[T](0.75, 20*time.Millisecond, func(info store.WatcherInfo) { alerts <- info }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cancel()
+		for i := 0; i < 50; i++ {
+			write()
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatal("event not delivered")
+			}
+		}
+		select {
+		case info := <-alerts:
+			t.Errorf("alert for a consumer keeping up: %+v", info)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+// RunReplaceTests runs the contract of store.Replacer on a fresh store
+// from newStore, which must implement it: a dry run reports without
+// writing, and ReplaceAll creates, updates and deletes as reported, keeps
+// unchanged values without an event, and publishes creates, updates and
+// deletes in that order. a and b are two different values other than the
+// zero value.
+func RunReplaceTests[T any](t *testing.T, newStore func(t *testing.T) store.Store[T], a, b T) {
+	t.Helper()
+	s := newStore(t)
+	defer s.Close()
+	r, ok := s.(store.Replacer[T])
+	if !ok {
+		t.Fatalf("%T is not a store.Replacer", s)
+	}
+	for _, k := range []string{"same", "changed", "gone"} {
+		if _, err := s.Set("r", k, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := s.List("r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel, err := s.Watch("r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	values := map[string]T{"same": a, "changed": b, "new": a}
+	want := store.ReplaceReport{
+		Created:   []string{"new"},
+		Updated:   []string{"changed"},
+		Unchanged: []string{"same"},
+		Deleted:   []string{"gone"},
+	}
+	rep, err := r.ReplaceAll("r", values, store.DryRun())
+	if err != nil || !reflect.DeepEqual(rep, want) {
+		t.Fatalf("dry run = %+v, %v, want %+v", rep, err, want)
+	}
+	if after, err := s.List("r"); err != nil || !reflect.DeepEqual(after, before) {
+		t.Fatalf("after dry run List = %v, %v, want %v", after, err, before)
+	}
+
+	rep, err = r.ReplaceAll("r", values)
+	if err != nil || !reflect.DeepEqual(rep, want) {
+		t.Fatalf("ReplaceAll = %+v, %v, want %+v", rep, err, want)
+	}
+	if after, err := s.List("r"); err != nil || !reflect.DeepEqual(after, values) {
+		t.Fatalf("after ReplaceAll List = %v, %v, want %v", after, err, values)
+	}
+	// the dry run published nothing, and "same" has no event
+	AssertEvents(t, receive(ch, 3, 5*time.Second), "create:new", "update:changed", "delete:gone")
+	if extra := receive(ch, 1, 50*time.Millisecond); len(extra) > 0 {
+		t.Errorf("unexpected event %s:%s", extra[0].EventType, extra[0].Name)
+	}
+	if vs, ok := s.(store.Versioner); ok {
+		versions, err := vs.Versions("r")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions["same"] != 1 || versions["changed"] != 2 || versions["new"] != 1 {
+			t.Errorf("versions = %v, want same 1, changed 2, new 1", versions)
+		}
+	}
+
+	// replacing with nothing empties the kind
+	rep, err = r.ReplaceAll("r", nil)
+	want = store.ReplaceReport{Deleted: []string{"changed", "new", "same"}}
+	if err != nil || !reflect.DeepEqual(rep, want) {
+		t.Fatalf("ReplaceAll(nil) = %+v, %v, want %+v", rep, err, want)
+	}
+	if n, err := s.Count("r"); err != nil || n != 0 {
+		t.Errorf("Count after ReplaceAll(nil) = %d, %v", n, err)
+	}
+	AssertEvents(t, receive(ch, 3, 5*time.Second), "delete:changed", "delete:new", "delete:same")
+}
+
+// receive reads up to n events from ch within d, in the order they
+// arrive, unlike Collect.
+func receive[T any](ch <-chan *store.Event[T], n int, d time.Duration) []*store.Event[T] {
+	var evs []*store.Event[T]
+	timeout := time.After(d)
+	for len(evs) < n {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return evs
+			}
+			evs = append(evs, ev)
+		case <-timeout:
+			return evs
+		}
+	}
+	return evs
+}
+
+// drain reads the events of ch until none came for 20ms or ch closed.
+func drain[T any](ch <-chan *store.Event[T]) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-time.After(20 * time.Millisecond):
+			return
+		}
+	}
+}
+
+// checkRequired checks the error of a watch requiring feature against the
+// features s reports, and reports whether the watch is on.
+func checkRequired[T any](t *testing.T, s store.Store[T], feature store.WatchFeature, err error) bool {
+	t.Helper()
+	var listed, known bool
+	if i, ok := s.(store.Introspector); ok {
+		known = true
+		for _, f := range i.Info().WatchFeatures {
+			listed = listed || f == feature
+		}
+	}
+	if err != nil {
+		var uerr *store.UnsupportedOptionError
+		if !errors.As(err, &uerr) || uerr.Option != feature || !errors.Is(err, store.ErrUnsupported) {
+			t.Fatalf("Watch requiring %s: %v, want an *UnsupportedOptionError naming it", feature, err)
+		}
+		if listed {
+			t.Errorf("Info.WatchFeatures lists %s, which Watch rejects", feature)
+		}
+		return false
+	}
+	if known && !listed {
+		t.Errorf("Info.WatchFeatures leaves out %s, which Watch accepts", feature)
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+// Package typed keeps several small kinds of different Go types in one
+// store. The underlying store holds raw JSON messages; a Registry records
+// the type of each kind, and GetAs and SetAs check it before decoding or
+// encoding a value:
+//
+//	reg := typed.NewRegistry(nil)
+//	typed.Register[Settings](reg, "settings")
+//	typed.Register[int](reg, "counters")
+//
+//	s := typed.Wrap(raw, reg)
+//	_, err := typed.SetAs(s, "counters", "visits", 42)
+//	n, ok, err := typed.GetAs[int](s, "counters", "visits")
+//	_, _, err = typed.GetAs[Settings](s, "counters", "visits") // *TypeMismatchError
+package typed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// ErrUnregistered is returned for kinds that were not registered.
+var ErrUnregistered = errors.New("kind not registered")
+
+// TypeMismatchError is returned when a kind is accessed as another type
+// than the one it was registered with.
+type TypeMismatchError struct {
+	Kind       string
+	Registered reflect.Type
+	Requested  reflect.Type
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("typed: kind %q holds %v, not %v", e.Kind, e.Registered, e.Requested)
+}
+
+// Codec encodes the values of a Registry. The codec.Codec implementations
+// satisfy it. It must produce JSON when the underlying store encodes its
+// json.RawMessage values as JSON, as the sqlite store with codec.JSON does.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// Registry maps kinds to the Go type of their values.
+type Registry struct {
+	codec Codec
+
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+}
+
+// NewRegistry returns an empty registry encoding values with c, or with
+// encoding/json when c is nil.
+func NewRegistry(c Codec) *Registry {
+	if c == nil {
+		c = jsonCodec{}
+	}
+	return &Registry{codec: c, types: make(map[string]reflect.Type)}
+}
+
+// Register records K as the type of kind's values. Registering a kind
+// again with the same type is a no-op; with another type it panics.
+func Register[K any](reg *Registry, kind string) {
+	t := typeOf[K]()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if cur, ok := reg.types[kind]; ok && cur != t {
+		panic(fmt.Sprintf("typed: kind %q registered as %v and %v", kind, cur, t))
+	}
+	reg.types[kind] = t
+}
+
+// Type returns the type registered for kind.
+func (r *Registry) Type(kind string) (reflect.Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[kind]
+	return t, ok
+}
+
+// check fails unless kind is registered with type K.
+func check[K any](reg *Registry, kind string) error {
+	t, ok := reg.Type(kind)
+	if !ok {
+		return fmt.Errorf("typed: %q: %w", kind, ErrUnregistered)
+	}
+	if want := typeOf[K](); t != want {
+		return &TypeMismatchError{Kind: kind, Registered: t, Requested: want}
+	}
+	return nil
+}
+
+func typeOf[K any]() reflect.Type {
+	return reflect.TypeOf((*K)(nil)).Elem()
+}
+
+// Store is a raw store with a registry of kind types. The embedded
+// store's methods work on raw messages and are not checked against the
+// registry; use GetAs and SetAs for typed access.
+type Store struct {
+	store.Store[json.RawMessage]
+	reg *Registry
+}
+
+// Wrap returns s with typed access through reg.
+func Wrap(s store.Store[json.RawMessage], reg *Registry) *Store {
+	return &Store{Store: s, reg: reg}
+}
+
+// Codec returns the codec of the wrapped store, which encodes the raw
+// messages; the registry's codec encodes the values within them.
+func (s *Store) Codec() store.Codec {
+	return store.CodecOf(s.Store)
+}
+
+// Info describes the wrapped store, seen through "typed".
+func (s *Store) Info() store.Info {
+	return store.WrappedInfo(s.Store, "typed")
+}
+
+// WatcherCount returns the watchers of the wrapped store.
+func (s *Store) WatcherCount() int {
+	return store.WatcherCountOf(s.Store)
+}
+
+// KindWatcherCount returns the watchers of kind on the wrapped store.
+func (s *Store) KindWatcherCount(kind string) int {
+	return store.KindWatcherCountOf(s.Store, kind)
+}
+
+// Registry returns the registry the store was wrapped with.
+func (s *Store) Registry() *Registry {
+	return s.reg
+}
+
+// GetAs returns the value of kind/key decoded as K.
+func GetAs[K any](s *Store, kind, key string) (K, bool, error) {
+	var v K
+	if err := check[K](s.reg, kind); err != nil {
+		return v, false, err
+	}
+	raw, ok, err := s.Get(kind, key)
+	if err != nil || !ok {
+		return v, ok, err
+	}
+	if err := s.reg.codec.Unmarshal(raw, &v); err != nil {
+		return v, false, fmt.Errorf("typed: decode %s/%s: %w", kind, key, err)
+	}
+	return v, true, nil
+}
+
+// SetAs encodes v and stores it under kind/key. It reports whether the key
+// was created, like Writer.Set.
+func SetAs[K any](s *Store, kind, key string, v K, opts ...store.WriteOption) (bool, error) {
+	if err := check[K](s.reg, kind); err != nil {
+		return false, err
+	}
+	raw, err := s.reg.codec.Marshal(v)
+	if err != nil {
+		return false, fmt.Errorf("typed: encode %s/%s: %w", kind, key, err)
+	}
+	return s.Set(kind, key, json.RawMessage(raw), opts...)
+}
+
+// DecodeInto decodes the object of an event from the underlying store's
+// Watch as K, the type registered for the event's kind.
+func DecodeInto[K any](s *Store, ev *store.Event[json.RawMessage]) (K, error) {
+	var v K
+	if err := check[K](s.reg, ev.Kind); err != nil {
+		return v, err
+	}
+	if err := s.reg.codec.Unmarshal(ev.Object, &v); err != nil {
+		return v, fmt.Errorf("typed: decode %s/%s: %w", ev.Kind, ev.Name, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,144 @@
+package typed
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+type settings struct {
+	Theme string `json:"theme"`
+	Beta  bool   `json:"beta"`
+}
+
+func setup(t *testing.T) *Store {
+	t.Helper()
+	reg := NewRegistry(nil)
+	Register[settings](reg, "settings")
+	Register[int](reg, "counters")
+	Register[[]string](reg, "flags")
+	raw := gomap.NewMemStore[json.RawMessage](store.StoreOptions[json.RawMessage]{})
+	t.Cleanup(func() { raw.Close() })
+	return Wrap(raw, reg)
+}
+
+func TestGetSetAs(t *testing.T) {
+	s := setup(t)
+
+	if created, err := SetAs(s, "settings", "app", settings{Theme: "dark"}); err != nil || !created {
+		t.Fatalf("SetAs(settings) = %v, %v", created, err)
+	}
+	if _, err := SetAs(s, "counters", "visits", 42); err != nil {
+		t.Fatalf("SetAs(counters) error = %v", err)
+	}
+	if _, err := SetAs(s, "flags", "on", []string{"a", "b"}); err != nil {
+		t.Fatalf("SetAs(flags) error = %v", err)
+	}
+
+	st, ok, err := GetAs[settings](s, "settings", "app")
+	if err != nil || !ok || st.Theme != "dark" {
+		t.Errorf("GetAs[settings] = %+v, %v, %v", st, ok, err)
+	}
+	n, ok, err := GetAs[int](s, "counters", "visits")
+	if err != nil || !ok || n != 42 {
+		t.Errorf("GetAs[int] = %v, %v, %v", n, ok, err)
+	}
+	f, _, err := GetAs[[]string](s, "flags", "on")
+	if err != nil || !reflect.DeepEqual(f, []string{"a", "b"}) {
+		t.Errorf("GetAs[[]string] = %v, %v", f, err)
+	}
+	if _, ok, err := GetAs[int](s, "counters", "missing"); ok || err != nil {
+		t.Errorf("GetAs(missing) = %v, %v", ok, err)
+	}
+
+	// one raw store underneath
+	raw, _, _ := s.Get("counters", "visits")
+	if string(raw) != "42" {
+		t.Errorf("raw value = %s", raw)
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	s := setup(t)
+	SetAs(s, "counters", "visits", 1)
+
+	tests := []struct {
+		name string
+		call func() error
+		want reflect.Type
+	}{
+		{"GetAs", func() error { _, _, err := GetAs[settings](s, "counters", "visits"); return err }, reflect.TypeOf(settings{})},
+		{"GetAs int64", func() error { _, _, err := GetAs[int64](s, "counters", "visits"); return err }, reflect.TypeOf(int64(0))},
+		{"GetAs pointer", func() error { _, _, err := GetAs[*settings](s, "settings", "app"); return err }, reflect.TypeOf(&settings{})},
+		{"SetAs", func() error { _, err := SetAs(s, "counters", "visits", "one"); return err }, reflect.TypeOf("")},
+		{"SetAs slice", func() error { _, err := SetAs(s, "flags", "on", []int{1}); return err }, reflect.TypeOf([]int{})},
+		{"DecodeInto", func() error {
+			_, err := DecodeInto[string](s, &store.Event[json.RawMessage]{Kind: "counters", Object: json.RawMessage("1")})
+			return err
+		}, reflect.TypeOf("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			var mm *TypeMismatchError
+			if !errors.As(err, &mm) {
+				t.Fatalf("error = %v, want *TypeMismatchError", err)
+			}
+			if mm.Requested != tt.want {
+				t.Errorf("Requested = %v, want %v", mm.Requested, tt.want)
+			}
+		})
+	}
+
+	// a failed SetAs writes nothing
+	if n, _, _ := GetAs[int](s, "counters", "visits"); n != 1 {
+		t.Errorf("visits = %d after mismatched SetAs", n)
+	}
+}
+
+func TestUnregistered(t *testing.T) {
+	s := setup(t)
+	if _, err := SetAs(s, "other", "k", 1); !errors.Is(err, ErrUnregistered) {
+		t.Errorf("SetAs error = %v, want ErrUnregistered", err)
+	}
+	if _, _, err := GetAs[int](s, "other", "k"); !errors.Is(err, ErrUnregistered) {
+		t.Errorf("GetAs error = %v, want ErrUnregistered", err)
+	}
+	if _, err := DecodeInto[int](s, &store.Event[json.RawMessage]{Kind: "other"}); !errors.Is(err, ErrUnregistered) {
+		t.Errorf("DecodeInto error = %v, want ErrUnregistered", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	reg := NewRegistry(nil)
+	Register[int](reg, "k")
+	Register[int](reg, "k") // same type again is fine
+	defer func() {
+		if recover() == nil {
+			t.Error("registering another type did not panic")
+		}
+	}()
+	Register[string](reg, "k")
+}
+
+func TestDecodeInto(t *testing.T) {
+	s := setup(t)
+	ch, cancel, _ := s.Watch("settings")
+	defer cancel()
+	SetAs(s, "settings", "app", settings{Theme: "light", Beta: true})
+
+	select {
+	case ev := <-ch:
+		st, err := DecodeInto[settings](s, ev)
+		if err != nil || st != (settings{Theme: "light", Beta: true}) {
+			t.Errorf("DecodeInto = %+v, %v", st, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+}
@@ -0,0 +1,535 @@
+// Package unique keeps a field of the values of one kind unique across
+// keys, e.g. the usernames of users keyed by UUID:
+//
+//	users := unique.Wrap(s, "users", func(u User) string { return u.Username }, unique.Options{Field: "username"})
+//	_, err := users.Set("users", id, u)
+//	var dup *store.DuplicateError
+//	if errors.As(err, &dup) {
+//		// dup.ExistingKey holds the username
+//	}
+//
+// The field values are indexed in a kind of their own,
+// "__unique_<kind>_<field>", whose keys pair a field value with the key
+// holding it. Writes to the kind through the Store claim the new field
+// values in the index, and release the ones the keys gave up after.
+//
+// Where the underlying store is a store.MultiKindWriter, Set, SetAll and
+// SetAllOrdered without write options, MergeAll and Add write the values
+// and their claims in one atomic SetMulti. Other writes, and every write
+// to other stores, claim first and write then, so a write failing or
+// crashing halfway leaves at most a claim its key doesn't hold. Such
+// claims, and those a crash keeps from being released, are ignored.
+//
+// Writes through one Store are serialized, making two racing claims of one
+// value fail for all but one of them. Two Stores wrapping one kind, other
+// processes, and writes made to the underlying store directly are not
+// serialized with them and may create duplicates, which Reindex reports.
+package unique
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/compositekey"
+)
+
+// Options configures Wrap.
+type Options struct {
+	// Field names the unique field in errors and in the index kind;
+	// "value" when empty.
+	Field string
+	// KeyGen generates the keys of Add (nil means store.NewUUIDv7), in
+	// place of the underlying store's StoreOptions.KeyGen.
+	KeyGen func() string
+}
+
+// Store is a store.Store whose writes to one kind keep a field unique.
+// Writes to other kinds and every read pass through unchanged. The
+// backend's optional interfaces, such as store.Replacer, are not exposed,
+// so that no write bypasses the check.
+type Store[T any] struct {
+	store.Store[T]
+	kind, field, index string
+	extract            func(T) string
+	keyGen             func() string
+
+	// serializes the writes to kind
+	mu sync.Mutex
+}
+
+// Wrap returns s with the field extract returns kept unique among the
+// values of kind. An empty field value is not indexed, so any number of
+// keys may leave the field empty. Run Reindex once when kind already
+// holds values.
+func Wrap[T any](s store.Store[T], kind string, extract func(T) string, o Options) *Store[T] {
+	if o.Field == "" {
+		o.Field = "value"
+	}
+	return &Store[T]{
+		Store:   s,
+		kind:    kind,
+		field:   o.Field,
+		index:   IndexKind(kind, o.Field),
+		extract: extract,
+		keyGen:  o.KeyGen,
+	}
+}
+
+// IndexKind returns the kind indexing field of kind.
+func IndexKind(kind, field string) string {
+	return "__unique_" + kind + "_" + field
+}
+
+// errClaim stops a SetFn whose function changed the field, which has to
+// be claimed first.
+var errClaim = errors.New("unique: field changed")
+
+func (u *Store[T]) Set(kind, key string, value T, opts ...store.WriteOption) (created bool, err error) {
+	if kind != u.kind {
+		return u.Store.Set(kind, key, value, opts...)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var order []string
+	if len(opts) == 0 {
+		order = []string{key}
+	}
+	held, err := u.apply(map[string]T{key: value}, order, func() error {
+		created, err = u.Store.Set(kind, key, value, opts...)
+		return err
+	})
+	if err == nil && order != nil {
+		created = !held[key]
+	}
+	return created, err
+}
+
+// SetLabeled fails with store.ErrUnsupported, claiming nothing, if the
+// wrapped store can't label keys.
+func (u *Store[T]) SetLabeled(kind, key string, value T, labels map[string]string) (created bool, err error) {
+	if _, ok := u.Store.(store.LabelWriter[T]); !ok || kind != u.kind {
+		return store.SetLabeled(u.Store, kind, key, value, labels)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, err = u.apply(map[string]T{key: value}, nil, func() error {
+		created, err = store.SetLabeled(u.Store, kind, key, value, labels)
+		return err
+	})
+	return created, err
+}
+
+// SetFn calls fn once. A value whose field fn leaves alone is written in
+// one step; otherwise the new field value is claimed first, and what fn
+// returned is written then.
+func (u *Store[T]) SetFn(kind, key string, fn func(v T) (T, error), opts ...store.WriteOption) (changed bool, err error) {
+	if kind != u.kind {
+		return u.Store.SetFn(kind, key, fn, opts...)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var next T
+	changed, err = u.Store.SetFn(kind, key, func(v T) (T, error) {
+		n, err := fn(v)
+		if err != nil {
+			return v, err
+		}
+		if u.extract(n) != u.extract(v) {
+			next = n
+			return v, errClaim
+		}
+		return n, nil
+	}, opts...)
+	if !errors.Is(err, errClaim) {
+		return changed, err
+	}
+	_, err = u.apply(map[string]T{key: next}, nil, func() error {
+		changed, err = u.Store.SetFn(kind, key, func(T) (T, error) { return next, nil }, opts...)
+		return err
+	})
+	return changed, err
+}
+
+func (u *Store[T]) SetAll(kind string, values map[string]T, opts ...store.WriteOption) error {
+	if kind != u.kind {
+		return u.Store.SetAll(kind, values, opts...)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var order []string
+	if len(opts) == 0 {
+		order = sortedKeys(values)
+	}
+	_, err := u.apply(values, order, func() error {
+		return u.Store.SetAll(kind, values, opts...)
+	})
+	return err
+}
+
+func (u *Store[T]) SetAllOrdered(kind string, values []store.KeyValue[T]) error {
+	if kind != u.kind {
+		return store.SetAllOrdered(u.Store, kind, values)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	order, final := store.DedupeKeyValues(values)
+	_, err := u.apply(final, order, func() error {
+		return store.SetAllOrdered(u.Store, kind, values)
+	})
+	return err
+}
+
+// MergeAll resolves the values it merges before the underlying MergeAll
+// runs, to check them. It fails with store.ErrUnsupported, claiming
+// nothing, if the wrapped store can't merge.
+func (u *Store[T]) MergeAll(kind string, incoming map[string]T, resolve func(key string, existing, incoming T) T) error {
+	if _, ok := u.Store.(store.Merger[T]); !ok || kind != u.kind {
+		return store.MergeAll(u.Store, kind, incoming, resolve)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	final := make(map[string]T, len(incoming))
+	for k, in := range incoming {
+		final[k] = in
+		if resolve == nil {
+			continue
+		}
+		existing, ok, err := u.Store.Get(kind, k)
+		if err != nil {
+			return err
+		}
+		if ok {
+			final[k] = resolve(k, existing, in)
+		}
+	}
+	_, err := u.apply(final, sortedKeys(final), func() error {
+		return store.MergeAll(u.Store, kind, incoming, func(k string, _, _ T) T { return final[k] })
+	})
+	return err
+}
+
+// Swap fails with store.ErrUnsupported, claiming nothing, if the wrapped
+// store can't swap values.
+func (u *Store[T]) Swap(kind, keyA, keyB string) error {
+	if _, ok := u.Store.(store.Swapper); !ok || kind != u.kind {
+		return store.Swap(u.Store, kind, keyA, keyB)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	a, okA, err := u.Store.Get(kind, keyA)
+	if err != nil {
+		return err
+	}
+	b, okB, err := u.Store.Get(kind, keyB)
+	if err != nil {
+		return err
+	}
+	if !okA || !okB {
+		// reports the missing key
+		return store.Swap(u.Store, kind, keyA, keyB)
+	}
+	_, err = u.apply(map[string]T{keyA: b, keyB: a}, nil, func() error {
+		return store.Swap(u.Store, kind, keyA, keyB)
+	})
+	return err
+}
+
+// Add generates the key with Options.KeyGen, so that the field value can
+// be claimed along with it, and writes value as a Set would.
+func (u *Store[T]) Add(kind string, value T) (key string, err error) {
+	if kind != u.kind {
+		return store.Add(u.Store, kind, value)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return store.AddNew(u.keyGen, func(key string) error {
+		if _, ok, err := u.Store.Get(kind, key); err != nil {
+			return err
+		} else if ok {
+			return store.ErrKeyExists
+		}
+		_, err := u.apply(map[string]T{key: value}, []string{key}, func() error {
+			_, err := u.Store.Set(kind, key, value, store.CreateOnly())
+			return err
+		})
+		return err
+	})
+}
+
+func (u *Store[T]) Delete(kind, key string, opts ...store.WriteOption) (existed bool, prev T, err error) {
+	if kind != u.kind {
+		return u.Store.Delete(kind, key, opts...)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// read first, as WithoutPrev leaves prev zero
+	old, ok, err := u.Store.Get(kind, key)
+	if err != nil {
+		return false, prev, err
+	}
+	existed, prev, err = u.Store.Delete(kind, key, opts...)
+	if err == nil && ok {
+		u.release(key, u.extract(old))
+	}
+	return existed, prev, err
+}
+
+// Owner returns the key holding value in the field.
+func (u *Store[T]) Owner(value string) (key string, ok bool, err error) {
+	owners, err := u.owners(value, nil)
+	if err != nil || len(owners) == 0 {
+		return "", false, err
+	}
+	return owners[0], true, nil
+}
+
+// Duplicate is a field value held by more than one key.
+type Duplicate struct {
+	Value string
+	Keys  []string // sorted
+}
+
+// Reindex rebuilds the index from the values of the kind, for a kind
+// holding values before it was wrapped, or written to directly. It returns
+// the field values held by more than one key, sorted: every such key keeps
+// its claim, so none of them can be written with the value until the
+// others give it up.
+func (u *Store[T]) Reindex() ([]Duplicate, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	values, err := u.Store.List(u.kind)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]T)
+	byValue := make(map[string][]string)
+	for k, v := range values {
+		if val := u.extract(v); val != "" {
+			want[compositekey.Encode(val, k)] = v
+			byValue[val] = append(byValue[val], k)
+		}
+	}
+	claims, err := u.Store.Keys(u.index)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range claims {
+		if _, ok := want[c]; ok {
+			delete(want, c)
+			continue
+		}
+		if _, _, err := u.Store.Delete(u.index, c, store.WithoutPrev()); err != nil {
+			return nil, err
+		}
+	}
+	if len(want) > 0 {
+		if err := u.Store.SetAll(u.index, want); err != nil {
+			return nil, err
+		}
+	}
+	var dups []Duplicate
+	for val, keys := range byValue {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			dups = append(dups, Duplicate{Value: val, Keys: keys})
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].Value < dups[j].Value })
+	return dups, nil
+}
+
+// apply checks final, the values the keys of a write will hold, writes
+// them with the claims of their new field values, and then releases the
+// field values the keys gave up. With order, the keys of final in the
+// order to write them, a store.MultiKindWriter backend writes the values
+// and the claims in one SetMulti; otherwise the claims are written first,
+// then write runs, and a failed write releases them. It returns the keys
+// of final that held a value. Callers hold u.mu.
+func (u *Store[T]) apply(final map[string]T, order []string, write func() error) (map[string]bool, error) {
+	held := make(map[string]bool, len(final))
+	old := make(map[string]string, len(final))
+	for k := range final {
+		v, ok, err := u.Store.Get(u.kind, k)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			held[k] = true
+			old[k] = u.extract(v)
+		}
+	}
+	if err := u.check(final); err != nil {
+		return nil, err
+	}
+	var claims []store.KindKeyValue[T]
+	for _, k := range sortedKeys(final) {
+		v := final[k]
+		if val := u.extract(v); val != "" && old[k] != val {
+			claims = append(claims, store.KindKeyValue[T]{Kind: u.index, Key: compositekey.Encode(val, k), Value: v})
+		}
+	}
+	err := store.ErrUnsupported
+	if mw, ok := u.Store.(store.MultiKindWriter[T]); ok && order != nil {
+		values := make([]store.KindKeyValue[T], 0, len(order)+len(claims))
+		for _, k := range order {
+			values = append(values, store.KindKeyValue[T]{Kind: u.kind, Key: k, Value: final[k]})
+		}
+		err = mw.SetMulti(append(values, claims...))
+	}
+	if errors.Is(err, store.ErrUnsupported) {
+		err = u.claimThen(claims, write)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, val := range old {
+		if val != u.extract(final[k]) {
+			u.release(k, val)
+		}
+	}
+	return held, nil
+}
+
+// claimThen writes claims one by one, then runs write. A failed write
+// releases the claims made.
+func (u *Store[T]) claimThen(claims []store.KindKeyValue[T], write func() error) error {
+	var claimed []string
+	for _, c := range claims {
+		if _, err := u.Store.Set(c.Kind, c.Key, c.Value); err != nil {
+			u.unclaim(claimed)
+			return err
+		}
+		claimed = append(claimed, c.Key)
+	}
+	if err := write(); err != nil {
+		u.unclaim(claimed)
+		return err
+	}
+	return nil
+}
+
+// check returns a *store.DuplicateError for the first key of final, in
+// key order, whose field value another key holds after the write: a key
+// of final, or a key claiming it in the index and holding it still.
+func (u *Store[T]) check(final map[string]T) error {
+	keys := sortedKeys(final)
+	seen := make(map[string]string, len(final))
+	for _, k := range keys {
+		val := u.extract(final[k])
+		if val == "" {
+			continue
+		}
+		if other, ok := seen[val]; ok {
+			return u.duplicate(val, other)
+		}
+		seen[val] = k
+		owners, err := u.owners(val, final)
+		if err != nil {
+			return err
+		}
+		for _, o := range owners {
+			if o != k {
+				return u.duplicate(val, o)
+			}
+		}
+	}
+	return nil
+}
+
+// owners returns the keys, sorted, that claim val in the index and hold
+// it, in final if they are written along, or in the store.
+func (u *Store[T]) owners(val string, final map[string]T) ([]string, error) {
+	claims, err := store.ListPrefix(u.Store, u.index, compositekey.Prefix(val))
+	if err != nil {
+		return nil, err
+	}
+	var owners []string
+	for claim := range claims {
+		parts := compositekey.Decode(claim)
+		if len(parts) != 2 {
+			continue
+		}
+		key := parts[1]
+		v, ok := final[key]
+		if !ok {
+			if v, ok, err = u.Store.Get(u.kind, key); err != nil {
+				return nil, err
+			}
+		}
+		if ok && u.extract(v) == val {
+			owners = append(owners, key)
+		}
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (u *Store[T]) duplicate(val, key string) error {
+	return &store.DuplicateError{Field: u.field, Value: val, ExistingKey: key}
+}
+
+// release drops the claim of key on val. A claim left behind by a failed
+// release is ignored, as key doesn't hold val anymore.
+func (u *Store[T]) release(key, val string) {
+	if val != "" {
+		_, _, _ = u.Store.Delete(u.index, compositekey.Encode(val, key), store.WithoutPrev())
+	}
+}
+
+func (u *Store[T]) unclaim(claims []string) {
+	for _, c := range claims {
+		_, _, _ = u.Store.Delete(u.index, c, store.WithoutPrev())
+	}
+}
+
+// Kinds returns the kinds of the wrapped store.
+func (u *Store[T]) Kinds() ([]string, error) {
+	return store.Kinds(u.Store)
+}
+
+// WatchH subscribes to kind on the wrapped store.
+func (u *Store[T]) WatchH(kind string, opts ...store.WatchOption[T]) (*store.WatchHandle[T], error) {
+	return store.WatchH(u.Store, kind, opts...)
+}
+
+// WatchKinds subscribes to kinds on the wrapped store.
+func (u *Store[T]) WatchKinds(kinds []string, opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	return store.WatchKinds(u.Store, kinds, opts...)
+}
+
+// WatchAll subscribes to every kind of the wrapped store.
+func (u *Store[T]) WatchAll(opts ...store.WatchOption[T]) (<-chan *store.Event[T], func(), error) {
+	return store.WatchAll(u.Store, opts...)
+}
+
+// Codec returns the codec of the wrapped store.
+func (u *Store[T]) Codec() store.Codec {
+	return store.CodecOf(u.Store)
+}
+
+// Info describes the wrapped store, seen through "unique".
+func (u *Store[T]) Info() store.Info {
+	return store.WrappedInfo(u.Store, "unique")
+}
+
+// WatcherCount returns the watchers of the wrapped store.
+func (u *Store[T]) WatcherCount() int {
+	return store.WatcherCountOf(u.Store)
+}
+
+// KindWatcherCount returns the watchers of kind on the wrapped store.
+func (u *Store[T]) KindWatcherCount(kind string) int {
+	return store.KindWatcherCountOf(u.Store, kind)
+}
@@ -0,0 +1,325 @@
+package unique_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+	"github.com/zestor-dev/zestor/store/unique"
+)
+
+type user struct {
+	Name     string
+	Username string
+}
+
+func username(u user) string { return u.Username }
+
+func newUsers(t *testing.T) (*unique.Store[user], store.Store[user]) {
+	t.Helper()
+	base := gomap.NewMemStore(store.StoreOptions[user]{})
+	t.Cleanup(func() { base.Close() })
+	return unique.Wrap[user](base, "users", username, unique.Options{Field: "username"}), base
+}
+
+// indexKeys returns the keys of the users' index, sorted.
+func indexKeys(s store.Store[user]) []string {
+	keys, _ := s.Keys(unique.IndexKind("users", "username"))
+	sort.Strings(keys)
+	return keys
+}
+
+// wantDup checks that err is a duplicate of value held by key.
+func wantDup(t *testing.T, err error, value, key string) {
+	t.Helper()
+	var dup *store.DuplicateError
+	if !errors.As(err, &dup) || !errors.Is(err, store.ErrDuplicate) {
+		t.Fatalf("err = %v, want a duplicate of %q", err, value)
+	}
+	if want := (store.DuplicateError{Field: "username", Value: value, ExistingKey: key}); *dup != want {
+		t.Fatalf("duplicate = %+v, want %+v", *dup, want)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s, base := newUsers(t)
+	if _, err := s.Set("users", "u1", user{Name: "Bob", Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Set("users", "u2", user{Name: "Other Bob", Username: "bob"})
+	wantDup(t, err, "bob", "u1")
+	if _, ok, _ := s.Get("users", "u2"); ok {
+		t.Error("duplicate written")
+	}
+
+	// a key keeps its own value, and gives it up when changing it
+	if _, err := s.Set("users", "u1", user{Name: "Robert", Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("users", "u1", user{Name: "Robert", Username: "robert"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("users", "u2", user{Username: "bob"}); err != nil {
+		t.Fatalf("Set of a released value = %v", err)
+	}
+	if key, ok, err := s.Owner("robert"); err != nil || !ok || key != "u1" {
+		t.Errorf("Owner(robert) = %q, %v, %v", key, ok, err)
+	}
+	if keys := indexKeys(base); !reflect.DeepEqual(keys, []string{"bob/u2", "robert/u1"}) {
+		t.Errorf("index = %v", keys)
+	}
+
+	// empty values and other kinds aren't checked
+	for _, k := range []string{"e1", "e2"} {
+		if _, err := s.Set("users", k, user{Name: k}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Set("admins", k, user{Username: "bob"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleting releases the value
+	if _, _, err := s.Delete("users", "u1", store.WithoutPrev()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("users", user{Username: "robert"}); err != nil {
+		t.Fatalf("Add of a deleted key's value = %v", err)
+	}
+	_, err = s.Add("users", user{Username: "robert"})
+	if !errors.Is(err, store.ErrDuplicate) {
+		t.Errorf("second Add = %v", err)
+	}
+}
+
+func TestSetFn(t *testing.T) {
+	s, _ := newUsers(t)
+	s.Set("users", "u1", user{Username: "bob"})
+	s.Set("users", "u2", user{Username: "alice"})
+
+	calls := 0
+	_, err := s.SetFn("users", "u2", func(u user) (user, error) {
+		calls++
+		u.Username = "bob"
+		return u, nil
+	})
+	wantDup(t, err, "bob", "u1")
+	if calls != 1 {
+		t.Errorf("fn called %d times", calls)
+	}
+	if _, err := s.SetFn("users", "u2", func(u user) (user, error) {
+		u.Name = "Alice"
+		return u, nil
+	}); err != nil {
+		t.Fatalf("SetFn keeping the field = %v", err)
+	}
+	if _, err := s.SetFn("users", "u2", func(u user) (user, error) {
+		u.Username = "al"
+		return u, nil
+	}); err != nil {
+		t.Fatalf("SetFn changing the field = %v", err)
+	}
+	if got, _, _ := s.Get("users", "u2"); got != (user{Name: "Alice", Username: "al"}) {
+		t.Errorf("u2 = %+v", got)
+	}
+	if _, err := s.Set("users", "u3", user{Username: "alice"}); err != nil {
+		t.Errorf("Set of the value SetFn released = %v", err)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	s, _ := newUsers(t)
+	s.Set("users", "u1", user{Username: "bob"})
+
+	err := s.SetAll("users", map[string]user{"u2": {Username: "carol"}, "u3": {Username: "carol"}})
+	wantDup(t, err, "carol", "u2")
+	err = s.SetAllOrdered("users", []store.KeyValue[user]{{Key: "u2", Value: user{Username: "bob"}}})
+	wantDup(t, err, "bob", "u1")
+	if n, _ := s.Count("users"); n != 1 {
+		t.Errorf("failed batches wrote %d values", n-1)
+	}
+
+	// u1 gives bob up in the same batch
+	if err := s.SetAll("users", map[string]user{"u1": {Username: "robert"}, "u2": {Username: "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Swap("users", "u1", "u2"); err != nil {
+		t.Fatal(err)
+	}
+	if key, _, _ := s.Owner("bob"); key != "u1" {
+		t.Errorf("bob held by %q after Swap", key)
+	}
+	err = s.MergeAll("users", map[string]user{"u2": {Name: "x"}}, func(_ string, existing, incoming user) user {
+		existing.Username = "bob"
+		return existing
+	})
+	wantDup(t, err, "bob", "u1")
+}
+
+func TestReindex(t *testing.T) {
+	s, base := newUsers(t)
+	// written before the store was wrapped
+	base.SetAll("users", map[string]user{"a": {Username: "x"}, "b": {Username: "x"}, "c": {Username: "y"}})
+	base.Set(unique.IndexKind("users", "username"), "stale/z", user{})
+
+	dups, err := s.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []unique.Duplicate{{Value: "x", Keys: []string{"a", "b"}}}; !reflect.DeepEqual(dups, want) {
+		t.Errorf("Reindex() = %+v, want %+v", dups, want)
+	}
+	if keys := indexKeys(base); !reflect.DeepEqual(keys, []string{"x/a", "x/b", "y/c"}) {
+		t.Errorf("index = %v", keys)
+	}
+	_, err = s.Set("users", "d", user{Username: "y"})
+	wantDup(t, err, "y", "c")
+	// b resolves the duplicate, after which a keeps x
+	if _, err := s.Set("users", "b", user{Username: "w"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Set("users", "a", user{Name: "A", Username: "x"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaleClaim(t *testing.T) {
+	s, base := newUsers(t)
+	// a claim whose write never happened
+	base.Set(unique.IndexKind("users", "username"), "bob/ghost", user{})
+	if _, err := s.Set("users", "u1", user{Username: "bob"}); err != nil {
+		t.Fatalf("Set over a stale claim = %v", err)
+	}
+}
+
+// claimFirst hides the optional interfaces of its store, such as
+// store.MultiKindWriter.
+type claimFirst struct {
+	store.Store[user]
+}
+
+func TestFailedWrites(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wrap func(store.Store[user]) store.Store[user]
+	}{
+		{"set-multi", func(s store.Store[user]) store.Store[user] { return s }},
+		{"claim-first", func(s store.Store[user]) store.Store[user] { return claimFirst{s} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// the index kind can't be written
+			base := gomap.NewMemStore(store.StoreOptions[user]{AllowedKinds: []string{"users"}})
+			defer base.Close()
+			s := unique.Wrap[user](tc.wrap(base), "users", username, unique.Options{Field: "username"})
+			if _, err := s.Set("users", "u1", user{Username: "bob"}); !errors.Is(err, store.ErrUnknownKind) {
+				t.Errorf("Set = %v", err)
+			}
+			if _, err := s.Add("users", user{Username: "bob"}); !errors.Is(err, store.ErrUnknownKind) {
+				t.Errorf("Add = %v", err)
+			}
+			if n, _ := base.Count("users"); n != 0 {
+				t.Errorf("%d values written without their claims", n)
+			}
+			// values without a field value aren't claimed
+			if _, err := s.Set("users", "u1", user{Name: "Bob"}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[user]{})
+	defer base.Close()
+	s := unique.Wrap[user](claimFirst{base}, "users", username, unique.Options{Field: "username"})
+	s.Set("users", "u1", user{Username: "bob"})
+	s.Set("users", "u2", user{Username: "alice"})
+	if err := s.Swap("users", "u1", "u2"); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("Swap() = %v", err)
+	}
+	if _, err := s.SetLabeled("users", "u3", user{Username: "carol"}, nil); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("SetLabeled() = %v", err)
+	}
+	if err := s.MergeAll("users", map[string]user{"u3": {Username: "carol"}}, nil); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("MergeAll() = %v", err)
+	}
+	if keys := indexKeys(base); !reflect.DeepEqual(keys, []string{"alice/u2", "bob/u1"}) {
+		t.Errorf("index = %v", keys)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	base := gomap.NewMemStore(store.StoreOptions[user]{})
+	defer base.Close()
+	s := unique.Wrap[user](base, "users", username, unique.Options{
+		Field:  "username",
+		KeyGen: func() string { return "fixed" },
+	})
+	key, err := s.Add("users", user{Username: "bob"})
+	if err != nil || key != "fixed" {
+		t.Fatalf("Add() = %q, %v", key, err)
+	}
+	if owner, _, _ := s.Owner("bob"); owner != "fixed" {
+		t.Errorf("bob held by %q", owner)
+	}
+	if _, err := s.Add("users", user{Username: "carol"}); !errors.Is(err, store.ErrKeyExists) {
+		t.Errorf("Add() with a taken key = %v", err)
+	}
+	if got, _, _ := base.Get("users", "fixed"); got.Username != "bob" {
+		t.Errorf("fixed = %+v", got)
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	for _, url := range []string{"", "mem://"} {
+		t.Run(url, func(t *testing.T) {
+			var base store.Store[user]
+			if url == "" {
+				base = gomap.NewMemStore(store.StoreOptions[user]{})
+			} else {
+				var err error
+				if base, err = store.Open[user](url, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer base.Close()
+			s := unique.Wrap[user](base, "users", username, unique.Options{Field: "username"})
+			for round := 0; round < 50; round++ {
+				name := fmt.Sprintf("user%d", round)
+				var wg sync.WaitGroup
+				errs := make([]error, 2)
+				for i := range errs {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						_, errs[i] = s.Set("users", fmt.Sprintf("%s-%d", name, i), user{Username: name})
+					}(i)
+				}
+				wg.Wait()
+				won := 0
+				for _, err := range errs {
+					if err == nil {
+						won++
+					} else if !errors.Is(err, store.ErrDuplicate) {
+						t.Fatal(err)
+					}
+				}
+				if won != 1 {
+					t.Fatalf("round %d: %d winners", round, won)
+				}
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	s, _ := newUsers(t)
+	if info := s.Info(); info.Backend != "gomap" || !reflect.DeepEqual(info.Wrappers, []string{"unique"}) {
+		t.Errorf("Info() = %+v", info)
+	}
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// uuidClock keeps UUIDv7s from one process increasing: the millisecond of
+// the last one, and the counter ordering those within it.
+var uuidClock struct {
+	sync.Mutex
+	ms  int64
+	seq uint16 // 12 bits
+}
+
+// NewUUIDv7 returns a random UUID version 7 (RFC 9562) in its canonical
+// form, e.g. "01920f5e-7c4a-7b3e-9c1d-2f6a8e4b5d70". Its leading bits are
+// the Unix time in milliseconds, so keys made later sort after earlier
+// ones, and those made by one process sort in the order they were made,
+// even within a millisecond or if the clock steps back.
+func NewUUIDv7() string {
+	var u [16]byte
+	if _, err := rand.Read(u[6:]); err != nil {
+		panic("store: NewUUIDv7: " + err.Error())
+	}
+
+	uuidClock.Lock()
+	ms := time.Now().UnixMilli()
+	if ms <= uuidClock.ms {
+		ms = uuidClock.ms
+		uuidClock.seq++
+		if uuidClock.seq >= 1<<12 {
+			// counter exhausted: borrow the next millisecond
+			ms++
+			uuidClock.seq = 0
+		}
+	} else {
+		// a random start leaves room to count up within the millisecond
+		uuidClock.seq = uint16(u[6]&0x07)<<8 | uint16(u[7])
+	}
+	uuidClock.ms = ms
+	seq := uuidClock.seq
+	uuidClock.Unlock()
+
+	u[0] = byte(ms >> 40)
+	u[1] = byte(ms >> 32)
+	u[2] = byte(ms >> 24)
+	u[3] = byte(ms >> 16)
+	u[4] = byte(ms >> 8)
+	u[5] = byte(ms)
+	u[6] = 0x70 | byte(seq>>8) // version 7
+	u[7] = byte(seq)
+	u[8] = 0x80 | u[8]&0x3f // variant 10
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
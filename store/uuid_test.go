@@ -0,0 +1,66 @@
+package store
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var uuidV7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewUUIDv7(t *testing.T) {
+	before := time.Now().UnixMilli()
+	prev := ""
+	for i := 0; i < 10000; i++ {
+		id := NewUUIDv7()
+		if !uuidV7.MatchString(id) {
+			t.Fatalf("%q is not a UUIDv7", id)
+		}
+		if id <= prev {
+			t.Fatalf("%q after %q", id, prev)
+		}
+		prev = id
+	}
+	// the leading 48 bits are the time in milliseconds; a few thousand ids
+	// within one millisecond may borrow the next ones
+	ms, _ := strconv.ParseInt(strings.ReplaceAll(prev[:13], "-", ""), 16, 64)
+	if after := time.Now().UnixMilli(); ms < before || ms > after+3 {
+		t.Errorf("timestamp %d outside [%d, %d]", ms, before, after)
+	}
+}
+
+func TestAddNew(t *testing.T) {
+	taken := map[string]bool{"k1": true, "k2": true}
+	keys := []string{"k1", "k2", "k3"}
+	gen := func() string {
+		k := keys[0]
+		keys = keys[1:]
+		return k
+	}
+	insert := func(key string) error {
+		if taken[key] {
+			return ErrKeyExists
+		}
+		taken[key] = true
+		return nil
+	}
+	if key, err := AddNew(gen, insert); key != "k3" || err != nil {
+		t.Fatalf("AddNew = %q, %v, want k3", key, err)
+	}
+
+	// a generator stuck on a taken key gives up
+	calls := 0
+	_, err := AddNew(func() string { calls++; return "k1" }, insert)
+	if !errors.Is(err, ErrKeyExists) || calls != AddAttempts {
+		t.Fatalf("AddNew = %v after %d calls", err, calls)
+	}
+
+	// other errors end it at once
+	boom := errors.New("boom")
+	if _, err := AddNew(nil, func(string) error { return boom }); err != boom {
+		t.Fatalf("AddNew = %v, want boom", err)
+	}
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// ValidateMode selects what a store does, when it is built, about stored
+// values failing StoreOptions.ValidateFns.
+type ValidateMode int
+
+const (
+	// ValidateOff skips the check.
+	ValidateOff ValidateMode = iota
+	// ValidateWarn logs the values failing validation, and builds the
+	// store anyway.
+	ValidateWarn
+	// ValidateFailFast fails building the store with a
+	// *ValidationFailedError for the first kind holding values failing
+	// validation.
+	ValidateFailFast
+)
+
+// ValidationReport lists the values of a kind failing a validator. It
+// encodes to JSON for tools.
+type ValidationReport struct {
+	Kind string `json:"kind"`
+	// Checked is the number of values validated.
+	Checked    int         `json:"checked"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Violation is a value failing validation.
+type Violation struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+	// Err is the error the validator returned.
+	Err error `json:"-"`
+	// Fixed reports whether ValidateOptions.FixWith rewrote the value.
+	Fixed bool `json:"fixed,omitempty"`
+	// FixError is why it couldn't, if it was tried.
+	FixError string `json:"fixError,omitempty"`
+}
+
+// ValidateOptions configures ValidateKind.
+type ValidateOptions[T any] struct {
+	// FixWith, if set, returns the fixed version of a value failing
+	// validation, which ValidateKind writes in its place with SetFn. A
+	// value fixed meanwhile is left alone, and a fix still failing
+	// validation isn't written.
+	FixWith func(T) (T, error)
+}
+
+// ValidationFailedError is returned when building a store with
+// ValidateFailFast finds stored values failing validation.
+type ValidationFailedError struct {
+	Report ValidationReport
+}
+
+func (e *ValidationFailedError) Error() string {
+	v := e.Report.Violations[0]
+	return fmt.Sprintf("store: %d of %d values of kind %q fail validation, first %q: %s",
+		len(e.Report.Violations), e.Report.Checked, e.Report.Kind, v.Key, v.Error)
+}
+
+// ValidateKind runs fn on every value of kind and reports those it
+// rejects, for data written before a validator was added or changed. It
+// streams the kind where the store is a FilterStreamer, and modifies
+// nothing unless opts.FixWith is set. Values written while it runs may or
+// may not be checked.
+func ValidateKind[T any](s Store[T], kind string, fn ValidateFunc[T], opts ValidateOptions[T]) (ValidationReport, error) {
+	rep := ValidationReport{Kind: kind}
+	check := func(key string, v T) error {
+		rep.Checked++
+		if err := fn(v); err != nil {
+			rep.Violations = append(rep.Violations, Violation{Key: key, Error: err.Error(), Err: err})
+		}
+		return nil
+	}
+	err := ErrUnsupported
+	if fs, ok := s.(FilterStreamer[T]); ok {
+		err = fs.FilterStream(kind, nil, check)
+	}
+	if errors.Is(err, ErrUnsupported) {
+		rep = ValidationReport{Kind: kind}
+		var all map[string]T
+		if all, err = s.List(kind); err == nil {
+			keys := make([]string, 0, len(all))
+			for k := range all {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				_ = check(k, all[k])
+			}
+		}
+	}
+	if err != nil || opts.FixWith == nil {
+		return rep, err
+	}
+	for i := range rep.Violations {
+		v := &rep.Violations[i]
+		_, err := s.SetFn(kind, v.Key, func(cur T) (T, error) {
+			if fn(cur) == nil {
+				return cur, nil
+			}
+			fixed, err := opts.FixWith(cur)
+			if err != nil {
+				return cur, err
+			}
+			if err := fn(fixed); err != nil {
+				return cur, fmt.Errorf("fixed value fails validation: %w", err)
+			}
+			return fixed, nil
+		})
+		if err != nil {
+			v.FixError = err.Error()
+		} else {
+			v.Fixed = true
+		}
+	}
+	return rep, nil
+}
+
+// ValidateStored checks the values s holds against o.ValidateFns, kind by
+// kind in name order, as o.ValidateOnOpen says. Backends call it once
+// built.
+func ValidateStored[T any](s Store[T], o StoreOptions[T]) error {
+	if o.ValidateOnOpen == ValidateOff {
+		return nil
+	}
+	kinds := make([]string, 0, len(o.ValidateFns))
+	for k := range o.ValidateFns {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		rep, err := ValidateKind(s, kind, o.ValidateFns[kind], ValidateOptions[T]{})
+		if err != nil {
+			return fmt.Errorf("store: validate kind %q: %w", kind, err)
+		}
+		if len(rep.Violations) == 0 {
+			continue
+		}
+		if o.ValidateOnOpen == ValidateFailFast {
+			return &ValidationFailedError{Report: rep}
+		}
+		for _, v := range rep.Violations {
+			log.Printf("zestor: %s/%s fails validation: %s", kind, v.Key, v.Error)
+		}
+	}
+	return nil
+}
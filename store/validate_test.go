@@ -0,0 +1,74 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+func nonEmpty(v item) error {
+	if v.Name == "" {
+		return errors.New("no name")
+	}
+	return nil
+}
+
+func TestValidateKind(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[item]{})
+	defer s.Close()
+	for k, v := range map[string]item{"a": {Name: "a"}, "b": {Count: 1}, "c": {Count: 2}} {
+		if _, err := s.Set("items", k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rep, err := store.ValidateKind(s, "items", nonEmpty, store.ValidateOptions[item]{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Checked != 3 || len(rep.Violations) != 2 || rep.Violations[0].Key != "b" || rep.Violations[1].Key != "c" {
+		t.Fatalf("report = %+v", rep)
+	}
+	data, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"kind":"items","checked":3,"violations":[{"key":"b","error":"no name"},{"key":"c","error":"no name"}]}`; string(data) != want {
+		t.Errorf("JSON = %s, want %s", data, want)
+	}
+	if got, _, _ := s.Get("items", "b"); got != (item{Count: 1}) {
+		t.Errorf("ValidateKind modified b: %+v", got)
+	}
+
+	// c's fix still fails, so it isn't written
+	rep, err = store.ValidateKind(s, "items", nonEmpty, store.ValidateOptions[item]{
+		FixWith: func(v item) (item, error) {
+			if v.Count == 1 {
+				v.Name = "fixed"
+			}
+			return v, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := rep.Violations; !v[0].Fixed || v[0].FixError != "" || v[1].Fixed || !strings.Contains(v[1].FixError, "no name") {
+		t.Errorf("violations = %+v", v)
+	}
+	if got, _, _ := s.Get("items", "b"); got != (item{Name: "fixed", Count: 1}) {
+		t.Errorf("b = %+v, want it fixed", got)
+	}
+	if got, _, _ := s.Get("items", "c"); got != (item{Count: 2}) {
+		t.Errorf("c = %+v, want it unchanged", got)
+	}
+
+	rep, err = store.ValidateKind(s, "none", nonEmpty, store.ValidateOptions[item]{})
+	if err != nil || !reflect.DeepEqual(rep, store.ValidationReport{Kind: "none"}) {
+		t.Errorf("empty kind = %+v, %v", rep, err)
+	}
+}
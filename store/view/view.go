@@ -0,0 +1,249 @@
+// Package view maintains a read model, such as a count of notes per
+// author, by folding the watch events of a kind into a value:
+//
+//	perAuthor, err := view.NewView(notes, "notes", func(m map[string]int, ev *store.Event[Note]) map[string]int {
+//		m = maps.Clone(m)
+//		if m == nil {
+//			m = map[string]int{}
+//		}
+//		switch ev.EventType {
+//		case store.EventTypeCreate:
+//			m[ev.Object.Author]++
+//		case store.EventTypeDelete:
+//			m[ev.Object.Author]--
+//		}
+//		return m
+//	})
+//	counts := perAuthor.Snapshot()
+//
+// The view subscribes with initial replay and folds in the kind's keys,
+// then follows the changes to them. reduce only sees creates and deletes:
+// an update reaches it as the delete of the old value followed by the
+// create of the new one, so an aggregate like the one above stays right
+// when a note changes author. Each value is created once and deleted
+// once, however the replay and the live events interleave on the watch.
+package view
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+)
+
+// View is a value kept up to date from the events of one kind of a store.
+// It is safe for concurrent use.
+type View[V any] struct {
+	mu    sync.RWMutex
+	state V
+	err   error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewView folds the keys of kind, then every change to them, into a value
+// of type V, starting from the zero V. It returns once the keys kind held
+// when it was called have been folded in.
+//
+// reduce is called with the current state and an event and returns the
+// new state. Calls are serialized, and Snapshot returns the state between
+// them, so a reduce that keeps maps or slices in V must return modified
+// copies rather than change the ones it was given. The events reduce sees
+// are a create of a value the view didn't hold and a delete of one it
+// held, with Kind, Name, EventType, Object and At set.
+//
+// The view keeps a copy of every value of kind, and treats each event as
+// a sign that its key changed: it reads the key with Get and folds in the
+// difference from its copy, so events the store repeats or sends out of
+// order change nothing. Each event thus costs a Get.
+//
+// If the watch falls behind and loses an event, the view resubscribes and
+// catches up. When src is closed the view stops following it and keeps
+// its last state, and Err returns store.ErrClosed.
+func NewView[T, V any](src store.Store[T], kind string, reduce func(state V, ev *store.Event[T]) V) (*View[V], error) {
+	v := &View[V]{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	f := &folder[T, V]{
+		v:      v,
+		src:    src,
+		kind:   kind,
+		reduce: reduce,
+		keys:   make(map[string]T),
+	}
+	ready := make(chan struct{})
+	go f.run(ready)
+	select {
+	case <-ready:
+		return v, nil
+	case <-v.done:
+		return nil, v.Err()
+	}
+}
+
+// Snapshot returns the current state.
+func (v *View[V]) Snapshot() V {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.state
+}
+
+// Err returns why the view stopped following its store, or nil while it
+// follows it and after Close.
+func (v *View[V]) Err() error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.err
+}
+
+// Done is closed once the view stops following its store.
+func (v *View[V]) Done() <-chan struct{} {
+	return v.done
+}
+
+// Close stops following the store and waits until the view has stopped.
+// Snapshot keeps returning the last state.
+func (v *View[V]) Close() {
+	v.stopOnce.Do(func() { close(v.stop) })
+	<-v.done
+}
+
+// folder follows the watch of a View.
+type folder[T, V any] struct {
+	v      *View[V]
+	src    store.Store[T]
+	kind   string
+	reduce func(V, *store.Event[T]) V
+	// the value the view holds for each key
+	keys map[string]T
+}
+
+// run subscribes to the kind, resubscribing whenever the watch ends,
+// until the view is closed or the store fails. ready is closed once the
+// first subscription caught up.
+func (f *folder[T, V]) run(ready chan struct{}) {
+	for {
+		// room for the whole replay, so that it can't crowd out live
+		// events while it is read
+		n, err := f.src.Count(f.kind)
+		if err != nil {
+			f.finish(err)
+			return
+		}
+		ch, cancel, err := f.src.Watch(f.kind,
+			store.WithInitialReplay[T](),
+			store.WithEvictAfterDrops[T](1),
+			store.WithBufferSize[T](n+store.DefaultWatchBufferSize))
+		if err != nil {
+			f.finish(err)
+			return
+		}
+		keys, err := f.src.Keys(f.kind)
+		if err != nil {
+			cancel()
+			f.finish(err)
+			return
+		}
+		pending, err := f.resync(keys)
+		if err == nil {
+			err = f.follow(ch, pending, &ready)
+		}
+		cancel()
+		if err != nil {
+			f.finish(err)
+			return
+		}
+		select {
+		case <-f.v.stop:
+			f.finish(nil)
+			return
+		default:
+		}
+	}
+}
+
+// resync refreshes every key the view holds that isn't among keys, which
+// the store listed after subscribing, and returns keys as a set: the view
+// has caught up once it has seen an event for each.
+func (f *folder[T, V]) resync(keys []string) (map[string]struct{}, error) {
+	pending := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		pending[k] = struct{}{}
+	}
+	for k := range f.keys {
+		if _, ok := pending[k]; ok {
+			continue
+		}
+		if err := f.refresh(&store.Event[T]{Kind: f.kind, Name: k, At: time.Now()}); err != nil {
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// follow folds the events of ch in until it closes, or the view is
+// closed, and returns nil then. It closes *ready and sets it to nil once
+// every pending key was seen.
+func (f *folder[T, V]) follow(ch <-chan *store.Event[T], pending map[string]struct{}, ready *chan struct{}) error {
+	for {
+		if *ready != nil && len(pending) == 0 {
+			close(*ready)
+			*ready = nil
+		}
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := f.refresh(ev); err != nil {
+				return err
+			}
+			delete(pending, ev.Name)
+		case <-f.v.stop:
+			return nil
+		}
+	}
+}
+
+// refresh folds the change of ev's key into the state.
+//
+// The store sends the initial replay alongside the live events, and may
+// publish the events of concurrent writes to a key out of order, so an
+// event's value can be older than one the view has already seen. An
+// event therefore only says that its key changed: refresh reads the key's
+// current value and folds in the difference from the value the view
+// holds. The last event of a key is published after its write, so the
+// view ends up with the value the write left.
+func (f *folder[T, V]) refresh(ev *store.Event[T]) error {
+	k := ev.Name
+	val, ok, err := f.src.Get(f.kind, k)
+	if err != nil {
+		return err
+	}
+	cur, held := f.keys[k]
+	if ok && held && store.DefaultCompareFunc(cur, val) || !ok && !held {
+		return nil
+	}
+	f.v.mu.Lock()
+	defer f.v.mu.Unlock()
+	if held {
+		delete(f.keys, k)
+		f.v.state = f.reduce(f.v.state, &store.Event[T]{Kind: f.kind, Name: k, EventType: store.EventTypeDelete, Object: cur, At: ev.At})
+	}
+	if ok {
+		f.keys[k] = val
+		f.v.state = f.reduce(f.v.state, &store.Event[T]{Kind: f.kind, Name: k, EventType: store.EventTypeCreate, Object: val, At: ev.At})
+	}
+	return nil
+}
+
+// finish records why the view stopped and closes done.
+func (f *folder[T, V]) finish(err error) {
+	f.v.mu.Lock()
+	f.v.err = err
+	f.v.mu.Unlock()
+	close(f.v.done)
+}
@@ -0,0 +1,191 @@
+package view
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zestor-dev/zestor/store"
+	"github.com/zestor-dev/zestor/store/gomap"
+)
+
+type note struct {
+	Author string
+	Text   string
+}
+
+// perAuthor counts notes by author.
+func perAuthor(m map[string]int, ev *store.Event[note]) map[string]int {
+	m = maps.Clone(m)
+	if m == nil {
+		m = map[string]int{}
+	}
+	switch ev.EventType {
+	case store.EventTypeCreate:
+		m[ev.Object.Author]++
+	case store.EventTypeDelete:
+		if m[ev.Object.Author]--; m[ev.Object.Author] == 0 {
+			delete(m, ev.Object.Author)
+		}
+	default:
+		panic(fmt.Sprintf("reduce got a %s event", ev.EventType))
+	}
+	return m
+}
+
+// count recomputes perAuthor from the notes s holds.
+func count(t *testing.T, s store.Store[note]) map[string]int {
+	t.Helper()
+	notes, err := s.List("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]int{}
+	for _, n := range notes {
+		m[n.Author]++
+	}
+	return m
+}
+
+// settle waits until the view's state is want.
+func settle(t *testing.T, v *View[map[string]int], want map[string]int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := v.Snapshot()
+		if len(got) == 0 && len(want) == 0 || reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("view = %v, want %v", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestView(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[note]{})
+	defer s.Close()
+	s.Set("notes", "1", note{Author: "ann"})
+	s.Set("notes", "2", note{Author: "ann"})
+	s.Set("notes", "3", note{Author: "bob"})
+
+	v, err := NewView(s, "notes", perAuthor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	// the existing keys are folded in before NewView returns
+	if got := v.Snapshot(); !reflect.DeepEqual(got, map[string]int{"ann": 2, "bob": 1}) {
+		t.Fatalf("initial view = %v", got)
+	}
+
+	s.Set("notes", "4", note{Author: "cat"})
+	s.Set("notes", "1", note{Author: "bob"}) // an update changing the author
+	s.Set("notes", "1", note{Author: "bob", Text: "edited"})
+	s.Delete("notes", "2", store.WithoutPrev())
+	settle(t, v, map[string]int{"bob": 2, "cat": 1})
+}
+
+func TestViewConcurrentWrites(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s := gomap.NewMemStore(store.StoreOptions[note]{})
+		for k := 0; k < 50; k++ {
+			s.Set("notes", fmt.Sprint(k), note{Author: fmt.Sprint(k % 3)})
+		}
+		// writes racing with the initial replay
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					key := fmt.Sprint(r.Intn(60))
+					if r.Intn(3) == 0 {
+						s.Delete("notes", key)
+					} else {
+						s.Set("notes", key, note{Author: fmt.Sprint(r.Intn(3))})
+					}
+				}
+			}(int64(i*10 + w))
+		}
+		v, err := NewView(s, "notes", perAuthor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+		settle(t, v, count(t, s))
+		v.Close()
+		s.Close()
+	}
+}
+
+func TestViewCatchesUp(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[note]{})
+	defer s.Close()
+	s.Set("notes", "a", note{Author: "ann"})
+	s.Set("notes", "b", note{Author: "ann"})
+	block := make(chan struct{})
+	var once sync.Once
+	v, err := NewView(s, "notes", func(m map[string]int, ev *store.Event[note]) map[string]int {
+		if ev.Name == "stall" {
+			// hold up the view until its watch overflows
+			once.Do(func() { <-block })
+		}
+		return perAuthor(m, ev)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	s.Set("notes", "stall", note{Author: "bob"})
+	for i := 0; i < 3*store.DefaultWatchBufferSize; i++ {
+		s.Set("notes", "n", note{Author: fmt.Sprint(i % 5)})
+	}
+	s.Delete("notes", "a")
+	s.Delete("notes", "n")
+	s.Set("notes", "c", note{Author: "cat"})
+	close(block)
+	settle(t, v, map[string]int{"ann": 1, "bob": 1, "cat": 1})
+}
+
+func TestViewStoreClosed(t *testing.T) {
+	s := gomap.NewMemStore(store.StoreOptions[note]{})
+	s.Set("notes", "a", note{Author: "ann"})
+	v, err := NewView(s, "notes", perAuthor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	select {
+	case <-v.Done():
+	case <-time.After(time.Second):
+		t.Fatal("view still running after the store closed")
+	}
+	if !errors.Is(v.Err(), store.ErrClosed) {
+		t.Fatalf("Err = %v, want ErrClosed", v.Err())
+	}
+	if got := v.Snapshot(); !reflect.DeepEqual(got, map[string]int{"ann": 1}) {
+		t.Fatalf("view after Close = %v", got)
+	}
+	v.Close()
+
+	if _, err := NewView(s, "notes", perAuthor); !errors.Is(err, store.ErrClosed) {
+		t.Fatalf("NewView on a closed store = %v", err)
+	}
+}